@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ipAccessDenied = metricsRegistry.Counter("ip_access_denied_total",
+		"Requests refused for the client IP, by list (allowlist, denylist).", "list")
+	abuseDetections = metricsRegistry.Counter("abuse_detections_total",
+		"Clients caught by an abuse heuristic, by heuristic (burst, duplicate_prompts).", "heuristic")
+	abuseRequests = metricsRegistry.Counter("abuse_requests_total",
+		"Requests of flagged clients, by action (throttled, banned).", "action")
+	abuseBans = metricsRegistry.Counter("abuse_bans_total",
+		"Temporary bans of clients.")
+	abuseBannedClients = metricsRegistry.Gauge("abuse_banned_clients",
+		"Clients currently banned.")
+)
+
+const (
+	// abuseThrottleFor is how long a client is slowed down after an offense
+	abuseThrottleFor = 10 * time.Minute
+	// abuseThrottleStep is the delay added to each request of a throttled
+	// client per strike it has
+	abuseThrottleStep = time.Second
+	// abuseMemory is how long strikes and bans count against a client that
+	// stays quiet
+	abuseMemory = 24 * time.Hour
+	// abuseMaxBan caps the bans, which double with each one
+	abuseMaxBan = 24 * time.Hour
+	// abuseMaxPrompts caps the prompts counted per client and window
+	abuseMaxPrompts = 1000
+)
+
+// parseIPPrefixes reads a comma-separated list of addresses and CIDR ranges
+func parseIPPrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR range %q: %v", item, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", item, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// IPAccessList admits clients by IP: the denylist always wins, and with an
+// allowlist only the addresses in it get through
+type IPAccessList struct {
+	allow, deny []netip.Prefix
+	proxies     []netip.Prefix
+}
+
+func NewIPAccessList(allow, deny, proxies []netip.Prefix) *IPAccessList {
+	return &IPAccessList{allow: allow, deny: deny, proxies: proxies}
+}
+
+// Check returns "" when the IP is admitted, otherwise the list refusing it.
+// An unreadable IP is only refused by an allowlist.
+func (l *IPAccessList) Check(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		if len(l.allow) > 0 {
+			return "allowlist"
+		}
+		return ""
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.deny {
+		if prefix.Contains(addr) {
+			return "denylist"
+		}
+	}
+	if len(l.allow) == 0 {
+		return ""
+	}
+	for _, prefix := range l.allow {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	return "allowlist"
+}
+
+// Middleware refuses the clients the lists don't admit with 403
+func (l *IPAccessList) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, l.proxies)
+		if list := l.Check(ip); list != "" {
+			ipAccessDenied.Inc(list)
+			slog.InfoContext(r.Context(), "Client IP refused", "client", ip, "list", list)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AbuseDetector catches clients bursting far past any normal use or
+// flooding the same prompt, per IP. Each window a client is caught in is a
+// strike: a struck client is slowed down by a second per strike, and
+// banAfter strikes get it banned for banDuration, doubled with every ban.
+// State is kept per replica.
+type AbuseDetector struct {
+	window      time.Duration
+	burst       int
+	duplicates  int
+	banAfter    int
+	banDuration time.Duration
+	proxies     []netip.Prefix
+	audit       *AuditLog
+	adminKey    string
+	now         func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*abuseClient
+}
+
+// abuseClient is what the detector knows about one IP
+type abuseClient struct {
+	windowStart time.Time
+	requests    int
+	prompts     map[uint64]int
+	// struck is set once the client got a strike in the current window
+	struck bool
+
+	strikes     int
+	bans        int
+	lastSeen    time.Time
+	lastOffense time.Time
+	bannedUntil time.Time
+}
+
+// NewAbuseDetector strikes clients making more than burst requests, or
+// sending the same prompt more than duplicates times, within window
+func NewAbuseDetector(window time.Duration, burst, duplicates, banAfter int, banDuration time.Duration, proxies []netip.Prefix) *AbuseDetector {
+	return &AbuseDetector{
+		window:      window,
+		burst:       burst,
+		duplicates:  duplicates,
+		banAfter:    banAfter,
+		banDuration: banDuration,
+		proxies:     proxies,
+		now:         time.Now,
+		clients:     make(map[string]*abuseClient),
+	}
+}
+
+// UseAbuseDetector counts the prompts searched against identical-prompt
+// flooding
+func (h *SearchHandler) UseAbuseDetector(abuse *AbuseDetector) {
+	h.abuse = abuse
+}
+
+// UseAuditLog records every ban to the audit log
+func (d *AbuseDetector) UseAuditLog(audit *AuditLog) {
+	d.audit = audit
+}
+
+// UseAdminKey exempts the operator requests carrying adminKey
+func (d *AbuseDetector) UseAdminKey(adminKey string) {
+	d.adminKey = adminKey
+}
+
+// clientLocked returns the state of ip with its window rolled forward.
+// Callers hold the detector's lock.
+func (d *AbuseDetector) clientLocked(ip string, now time.Time) *abuseClient {
+	c, ok := d.clients[ip]
+	if !ok {
+		c = &abuseClient{windowStart: now}
+		d.clients[ip] = c
+	}
+	if now.Sub(c.windowStart) >= d.window {
+		c.windowStart, c.requests, c.prompts, c.struck = now, 0, nil, false
+	}
+	if !c.lastOffense.IsZero() && now.Sub(c.lastOffense) >= abuseMemory {
+		c.strikes, c.bans = 0, 0
+	}
+	c.lastSeen = now
+	return c
+}
+
+// strikeLocked gives the client a strike, at most one per window, and bans
+// it on the last one. It returns the length of a new ban, or zero.
+func (d *AbuseDetector) strikeLocked(c *abuseClient, heuristic string, now time.Time) time.Duration {
+	if c.struck {
+		return 0
+	}
+	c.struck = true
+	c.strikes++
+	c.lastOffense = now
+	abuseDetections.Inc(heuristic)
+	if c.strikes < d.banAfter {
+		return 0
+	}
+	c.strikes = 0
+	c.bans++
+	ban := d.banDuration
+	for i := 1; i < c.bans && ban < abuseMaxBan; i++ {
+		ban *= 2
+	}
+	ban = min(ban, abuseMaxBan)
+	c.bannedUntil = now.Add(ban)
+	abuseBans.Inc()
+	d.reportLocked(now)
+	return ban
+}
+
+// reportLocked updates the gauge of banned clients
+func (d *AbuseDetector) reportLocked(now time.Time) {
+	banned := 0
+	for _, c := range d.clients {
+		if now.Before(c.bannedUntil) {
+			banned++
+		}
+	}
+	abuseBannedClients.Set(float64(banned))
+}
+
+// banned logs and audits a new ban
+func (d *AbuseDetector) banned(r *http.Request, ip, heuristic string, ban time.Duration) {
+	slog.WarnContext(r.Context(), "Client banned for abuse", "client", ip, "heuristic", heuristic, "duration", ban)
+	d.audit.Record(AuditEvent{
+		Type:      AuditClientBanned,
+		Actor:     "abuse_detector",
+		RequestID: requestIDFromContext(r.Context()),
+		Client:    ip,
+		Details:   map[string]any{"heuristic": heuristic, "duration": ban.String()},
+	})
+}
+
+// Middleware answers banned clients with 429 until the ban is over, delays
+// the requests of struck clients and counts every request against bursts.
+// Operator requests with the admin key are left alone, so an operator
+// sharing a banned address can still lift the ban; without the key they
+// count like any other, as guessing it is abuse too.
+func (d *AbuseDetector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) && hasAdminKey(r, d.adminKey) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r, d.proxies)
+		now := d.now()
+		d.mu.Lock()
+		c := d.clientLocked(ip, now)
+		if now.Before(c.bannedUntil) {
+			retryAfter := c.bannedUntil.Sub(now)
+			d.mu.Unlock()
+			abuseRequests.Inc("banned")
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "Too many requests, please retry later", http.StatusTooManyRequests)
+			return
+		}
+		c.requests++
+		var ban time.Duration
+		if c.requests > d.burst {
+			ban = d.strikeLocked(c, "burst", now)
+		}
+		var delay time.Duration
+		if c.strikes > 0 && now.Sub(c.lastOffense) < abuseThrottleFor {
+			delay = time.Duration(c.strikes) * abuseThrottleStep
+		}
+		d.mu.Unlock()
+		if ban > 0 {
+			d.banned(r, ip, "burst", ban)
+		}
+
+		if delay > 0 {
+			abuseRequests.Inc("throttled")
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ObservePrompt counts a prompt searched by the request's client, striking
+// clients that send the same prompt over and over. Case and spacing don't
+// make prompts different.
+func (d *AbuseDetector) ObservePrompt(r *http.Request, prompt string) {
+	if d == nil {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(strings.Fields(strings.ToLower(prompt)), " ")))
+	sum := h.Sum64()
+
+	ip := clientIP(r, d.proxies)
+	now := d.now()
+	d.mu.Lock()
+	c := d.clientLocked(ip, now)
+	if c.prompts == nil {
+		c.prompts = make(map[uint64]int)
+	}
+	var ban time.Duration
+	if _, ok := c.prompts[sum]; ok || len(c.prompts) < abuseMaxPrompts {
+		c.prompts[sum]++
+		if c.prompts[sum] > d.duplicates {
+			ban = d.strikeLocked(c, "duplicate_prompts", now)
+		}
+	}
+	d.mu.Unlock()
+	if ban > 0 {
+		d.banned(r, ip, "duplicate_prompts", ban)
+	}
+}
+
+// Run forgets the clients gone quiet, every minute until ctx is cancelled
+func (d *AbuseDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sweep()
+		}
+	}
+}
+
+// sweep drops the clients with nothing left counting against them
+func (d *AbuseDetector) sweep() {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ip, c := range d.clients {
+		idle := now.Sub(c.lastSeen)
+		if now.Before(c.bannedUntil) || idle < d.window {
+			continue
+		}
+		if c.strikes+c.bans == 0 || now.Sub(c.lastOffense) >= abuseMemory {
+			delete(d.clients, ip)
+		}
+	}
+	d.reportLocked(now)
+}
+
+// abuseClientStatus is a flagged client as shown by the admin API
+type abuseClientStatus struct {
+	Client         string     `json:"client"`
+	Strikes        int        `json:"strikes"`
+	Bans           int        `json:"bans"`
+	LastOffense    time.Time  `json:"last_offense"`
+	ThrottledUntil *time.Time `json:"throttled_until,omitempty"`
+	BannedUntil    *time.Time `json:"banned_until,omitempty"`
+}
+
+// handleAdmin lists the clients with strikes or bans, banned ones first
+func (d *AbuseDetector) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := d.now()
+	d.mu.Lock()
+	clients := []abuseClientStatus{}
+	for ip, c := range d.clients {
+		if c.strikes+c.bans == 0 && !now.Before(c.bannedUntil) {
+			continue
+		}
+		status := abuseClientStatus{Client: ip, Strikes: c.strikes, Bans: c.bans, LastOffense: c.lastOffense}
+		if until := c.lastOffense.Add(abuseThrottleFor); c.strikes > 0 && now.Before(until) {
+			status.ThrottledUntil = &until
+		}
+		if now.Before(c.bannedUntil) {
+			until := c.bannedUntil
+			status.BannedUntil = &until
+		}
+		clients = append(clients, status)
+	}
+	d.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		if (clients[i].BannedUntil != nil) != (clients[j].BannedUntil != nil) {
+			return clients[i].BannedUntil != nil
+		}
+		return clients[i].LastOffense.After(clients[j].LastOffense)
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"clients": clients})
+}
+
+// handleUnban lifts the ban of a client and clears its strikes:
+// POST {"client": "203.0.113.7"}
+func (d *AbuseDetector) handleUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Client string `json:"client"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || req.Client == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	d.mu.Lock()
+	c, ok := d.clients[req.Client]
+	wasBanned := ok && d.now().Before(c.bannedUntil)
+	if ok {
+		delete(d.clients, req.Client)
+		d.reportLocked(d.now())
+	}
+	d.mu.Unlock()
+	slog.InfoContext(r.Context(), "Client unbanned", "client", req.Client, "was_banned", wasBanned)
+	writeJSON(w, http.StatusOK, map[string]any{"client": req.Client, "was_banned": wasBanned})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// requireAdmin guards operator endpoints with the ADMIN_API_KEY, sent as
+// X-Admin-Key or a bearer token. Without a configured key they're disabled.
+func requireAdmin(adminKey string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminKey == "" {
+			http.Error(w, "Admin API disabled", http.StatusNotFound)
+			return
+		}
+		if !hasAdminKey(r, adminKey) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAdminKey tells whether r carries the configured ADMIN_API_KEY
+func hasAdminKey(r *http.Request, adminKey string) bool {
+	if adminKey == "" {
+		return false
+	}
+	key := strings.TrimSpace(r.Header.Get("X-Admin-Key"))
+	if key == "" {
+		key = strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+// configSecretRe matches the Config fields never shown by the admin API
+var configSecretRe = regexp.MustCompile(`Secret|Key$|Keys$|Headers$|Password$`)
+
+// AdminHandler serves the operator endpoints that act on the running server
+type AdminHandler struct {
+	cfg     *Config
+	keys    *KeyPool
+	cache   *IntentCache
+	prompts *PromptTemplate
+}
+
+func NewAdminHandler(cfg *Config, keys *KeyPool, cache *IntentCache, prompts *PromptTemplate) *AdminHandler {
+	return &AdminHandler{cfg: cfg, keys: keys, cache: cache, prompts: prompts}
+}
+
+// Register mounts the endpoints on mux behind the admin key
+func (a *AdminHandler) Register(mux *http.ServeMux, adminKey string) {
+	mux.HandleFunc("/v1/admin/cache/flush", requireAdmin(adminKey, a.handleFlushCache))
+	mux.HandleFunc("/v1/admin/breaker/reset", requireAdmin(adminKey, a.handleResetBreaker))
+	mux.HandleFunc("/v1/admin/config", requireAdmin(adminKey, a.handleConfig))
+}
+
+// handleFlushCache empties the intent cache
+func (a *AdminHandler) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := a.cache.Flush()
+	slog.InfoContext(r.Context(), "Intent cache flushed", "entries", n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flushed": n})
+}
+
+// handleResetBreaker puts quarantined OpenAI keys back in rotation and
+// clears the connection failures that fail readiness
+func (a *AdminHandler) handleResetBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := a.keys.Reset()
+	openAIUpstream.success()
+	slog.InfoContext(r.Context(), "OpenAI breaker reset", "released_keys", n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"released_keys": n,
+		"keys":          a.keys.Status(),
+	})
+}
+
+// handleConfig shows the effective configuration (GET) or changes the
+// settings that apply without a restart (PATCH {"system_prompt", "search_engine"})
+func (a *AdminHandler) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.effectiveConfig())
+
+	case http.MethodPatch:
+		var req struct {
+			SystemPrompt *string `json:"system_prompt"`
+			SearchEngine *string `json:"search_engine"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxSystemPromptBytes)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// Validate everything before applying anything
+		if req.SearchEngine != nil {
+			if _, ok := searchEngines[*req.SearchEngine]; !ok {
+				http.Error(w, fmt.Sprintf("search_engine must be one of %v", engineNames()), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.SystemPrompt != nil {
+			if err := a.prompts.Reload([]byte(*req.SystemPrompt)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.InfoContext(r.Context(), "System prompt changed through the admin API", "bytes", len(*req.SystemPrompt))
+		}
+		if req.SearchEngine != nil {
+			setDefaultEngine(*req.SearchEngine)
+			slog.InfoContext(r.Context(), "Search engine changed through the admin API", "engine", *req.SearchEngine)
+		}
+		writeJSON(w, http.StatusOK, a.effectiveConfig())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// effectiveConfig lists every setting as loaded, with secrets masked, and
+// the current values of the runtime settings
+func (a *AdminHandler) effectiveConfig() map[string]interface{} {
+	settings := make(map[string]interface{})
+	v := reflect.ValueOf(a.cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		field := v.Field(i)
+		switch value := field.Interface().(type) {
+		case time.Duration:
+			settings[name] = value.String()
+		case *time.Location:
+			settings[name] = value.String()
+		case []TimeWindow:
+			windows := make([]string, len(value))
+			for i, tw := range value {
+				windows[i] = fmt.Sprintf("%02d:%02d-%02d:%02d", int(tw.Start.Hours()), int(tw.Start.Minutes())%60,
+					int(tw.End.Hours()), int(tw.End.Minutes())%60)
+			}
+			settings[name] = windows
+		case string:
+			settings[name] = maskConfigValue(name, value)
+		default:
+			if configSecretRe.MatchString(name) && !field.IsZero() {
+				settings[name] = "[redacted]"
+			} else {
+				settings[name] = value
+			}
+		}
+	}
+	return map[string]interface{}{
+		"config": settings,
+		"runtime": map[string]interface{}{
+			"system_prompt":      a.prompts.System(VerticalWeb, NewPromptData(time.Now(), "")),
+			"prompt_version":     a.prompts.Version(),
+			"search_engine":      defaultEngine.Load().Name,
+			"intent_cache_items": a.cache.Len(),
+		},
+	}
+}
+
+// configSecretParamRe matches the URL query parameters and DSN keywords
+// carrying credentials, like password, sslpassword, token or api_key
+var configSecretParamRe = regexp.MustCompile(`(?i)pass|pwd|secret|token|key|sig|auth|credential`)
+
+// dsnSecretRe matches the credentials of a keyword/value DSN such as
+// "host=db user=app password='s3 cret'", quoted values included
+var dsnSecretRe = regexp.MustCompile(`(?i)\b([a-z_]*(?:pass|pwd|secret|token|key)[a-z_]*)\s*=\s*('(?:[^'\\]|\\.)*'|\S*)`)
+
+// maskConfigValue hides secrets and the credentials of URLs and DSNs: the
+// user info, query parameters named like credentials, the password of
+// keyword DSNs, and the whole path of webhooks, where services like Slack
+// put their token
+func maskConfigValue(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if configSecretRe.MatchString(name) {
+		return "[redacted]"
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return dsnSecretRe.ReplaceAllString(value, "${1}=[redacted]")
+	}
+	if i := strings.LastIndex(u.Opaque, "@"); i >= 0 {
+		// user:password@host forms that aren't URLs, like MySQL's
+		return "[redacted]@" + value[strings.LastIndex(value, "@")+1:]
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		query, masked := u.Query(), false
+		for param := range query {
+			if configSecretParamRe.MatchString(param) {
+				query.Set(param, "redacted")
+				masked = true
+			}
+		}
+		if masked {
+			u.RawQuery = query.Encode()
+		}
+	}
+	if strings.Contains(name, "Webhook") && strings.Trim(u.Path, "/") != "" {
+		u.Path, u.RawPath = "/redacted", ""
+	}
+	return u.String()
+}
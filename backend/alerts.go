@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSavedSearchesPerUser bounds what one end user can schedule
+	maxSavedSearchesPerUser = 50
+	// maxSeenResults is how many reported URLs a saved search remembers
+	maxSeenResults = 500
+	// maxAlertResults caps the new results listed in one notification
+	maxAlertResults = 20
+)
+
+var errTooManySavedSearches = fmt.Errorf("at most %d saved searches per user", maxSavedSearchesPerUser)
+
+// savedSearchSchedules maps a schedule name to how often it runs
+var savedSearchSchedules = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+var alertNotifications = metricsRegistry.Counter("alert_notifications_total",
+	"Saved-search alerts sent, by channel (webhook, slack, email) and result (sent, failed, unverified).", "channel", "result")
+
+// AlertTargets are where new results of a saved search are announced. Slack
+// takes an incoming webhook URL. Email only gets alerts once its recipient
+// confirmed the code sent to it, so alerts can't be aimed at anyone's inbox.
+type AlertTargets struct {
+	Webhook       string `json:"webhook,omitempty"`
+	Slack         string `json:"slack,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+}
+
+// SavedSearch is an intent an end user asked to re-run on a schedule
+type SavedSearch struct {
+	ID        string        `json:"id"`
+	TenantID  string        `json:"tenant_id"`
+	UserID    string        `json:"user_id,omitempty"`
+	Name      string        `json:"name"`
+	Prompt    string        `json:"prompt,omitempty"`
+	Intent    *SearchIntent `json:"intent"`
+	Engine    string        `json:"engine,omitempty"`
+	Locale    string        `json:"locale,omitempty"`
+	Schedule  string        `json:"schedule"`
+	Notify    AlertTargets  `json:"notify"`
+	CreatedAt time.Time     `json:"created_at"`
+	LastRunAt *time.Time    `json:"last_run_at,omitempty"`
+	NextRunAt time.Time     `json:"next_run_at"`
+	LastError string        `json:"last_error,omitempty"`
+	// Seen are the result URLs already reported, oldest first
+	Seen []string `json:"seen,omitempty"`
+	// Delivered are the result URLs of a partly failed alert that each
+	// channel already got, by channel, so its retry skips them
+	Delivered map[string][]string `json:"delivered,omitempty"`
+	// EmailCode is the hash of the code verifying the email target
+	EmailCode string `json:"email_code,omitempty"`
+}
+
+// view is the saved search as the API returns it
+func (s *SavedSearch) view() SavedSearch {
+	v := *s
+	v.Seen, v.Delivered, v.EmailCode = nil, nil, ""
+	return v
+}
+
+// AlertEvent is posted to webhooks when a saved search finds new results
+type AlertEvent struct {
+	Event         string         `json:"event"`
+	SavedSearchID string         `json:"saved_search_id"`
+	Name          string         `json:"name"`
+	TenantID      string         `json:"tenant_id"`
+	UserID        string         `json:"user_id,omitempty"`
+	Query         string         `json:"query"`
+	Results       []SearchResult `json:"results"`
+	RunAt         time.Time      `json:"run_at"`
+}
+
+// SMTPConfig is the mail relay alerts are sent through
+type SMTPConfig struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// SavedSearches keeps saved searches, saved to path after every change, and
+// hands due ones to the job scheduler so re-runs happen in batch windows
+type SavedSearches struct {
+	path      string
+	search    *SearchHandler
+	provider  ResultsProvider
+	scheduler *JobScheduler
+	feed      *TriggerFeed
+	client    *http.Client
+	smtp      SMTPConfig
+	now       func() time.Time
+
+	mu   sync.Mutex
+	byID map[string]*SavedSearch
+}
+
+// NewSavedSearches loads the saved searches at path, if any. Re-runs query
+// provider directly rather than through the shared cache, so each run sees
+// current results.
+func NewSavedSearches(path string, search *SearchHandler, provider ResultsProvider, scheduler *JobScheduler, feed *TriggerFeed, client *http.Client, smtpConfig SMTPConfig) (*SavedSearches, error) {
+	ss := &SavedSearches{
+		path:      path,
+		search:    search,
+		provider:  provider,
+		scheduler: scheduler,
+		feed:      feed,
+		client:    client,
+		smtp:      smtpConfig,
+		now:       time.Now,
+		byID:      make(map[string]*SavedSearch),
+	}
+	if path == "" {
+		return ss, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ss, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading saved searches file: %v", err)
+	}
+	var list []*SavedSearch
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error parsing saved searches file: %v", err)
+	}
+	for _, s := range list {
+		ss.byID[s.ID] = s
+	}
+	return ss, nil
+}
+
+// save writes every saved search to the file; the caller holds mu
+func (ss *SavedSearches) save() error {
+	if ss.path == "" {
+		return nil
+	}
+	list := make([]*SavedSearch, 0, len(ss.byID))
+	for _, s := range ss.byID {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling saved searches: %v", err)
+	}
+	if err := writeFileAtomic(ss.path, data); err != nil {
+		return fmt.Errorf("error saving saved searches: %v", err)
+	}
+	return nil
+}
+
+// validate checks a new saved search before it is analyzed and stored. The
+// hosts of webhooks must resolve to public addresses only.
+func (ss *SavedSearches) validate(ctx context.Context, s *SavedSearch) error {
+	if strings.TrimSpace(s.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if s.Intent == nil && strings.TrimSpace(s.Prompt) == "" {
+		return fmt.Errorf("prompt or intent is required")
+	}
+	if _, ok := savedSearchSchedules[s.Schedule]; !ok {
+		return fmt.Errorf("schedule must be hourly, daily or weekly")
+	}
+	if s.Engine != "" {
+		if _, ok := searchEngines[s.Engine]; !ok {
+			return fmt.Errorf("engine must be one of %v", engineNames())
+		}
+	}
+	n := s.Notify
+	if n.Webhook == "" && n.Slack == "" && n.Email == "" {
+		return fmt.Errorf("notify needs a webhook, slack or email target")
+	}
+	if n.Webhook != "" {
+		u, err := url.Parse(n.Webhook)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("notify.webhook must be an https URL")
+		}
+		if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+			return fmt.Errorf("notify.webhook: %v", err)
+		}
+	}
+	if n.Slack != "" && !strings.HasPrefix(n.Slack, "https://hooks.slack.com/") {
+		return fmt.Errorf("notify.slack must be a Slack incoming webhook URL")
+	}
+	if n.Email != "" {
+		if ss.smtp.Addr == "" {
+			return fmt.Errorf("email alerts are not configured on this server")
+		}
+		if _, err := mail.ParseAddress(n.Email); err != nil {
+			return fmt.Errorf("notify.email is not a valid address")
+		}
+	}
+	return nil
+}
+
+// Create stores a validated saved search whose intent is already known
+func (ss *SavedSearches) Create(s *SavedSearch) error {
+	now := ss.now().UTC()
+	s.ID = newHistoryID()
+	s.CreatedAt = now
+	s.NextRunAt = now
+	s.LastRunAt, s.LastError, s.Seen, s.Delivered = nil, "", nil, nil
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	owned := 0
+	for _, other := range ss.byID {
+		if other.TenantID == s.TenantID && other.UserID == s.UserID {
+			owned++
+		}
+	}
+	if owned >= maxSavedSearchesPerUser {
+		return errTooManySavedSearches
+	}
+	// The caller keeps s; runs update their own copy
+	stored := *s
+	ss.byID[s.ID] = &stored
+	if err := ss.save(); err != nil {
+		delete(ss.byID, s.ID)
+		return err
+	}
+	return nil
+}
+
+// List returns the owner's saved searches, newest first
+func (ss *SavedSearches) List(tenantID, userID string) []SavedSearch {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	out := []SavedSearch{}
+	for _, s := range ss.byID {
+		if s.TenantID == tenantID && s.UserID == userID {
+			out = append(out, s.view())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Delete removes one of the owner's saved searches
+func (ss *SavedSearches) Delete(tenantID, userID, id string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.byID[id]
+	if !ok || s.TenantID != tenantID || s.UserID != userID {
+		return false, nil
+	}
+	delete(ss.byID, id)
+	if err := ss.save(); err != nil {
+		ss.byID[id] = s
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteAllOwned removes every saved search of the owner, for user erasure
+func (ss *SavedSearches) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	removed := make(map[string]*SavedSearch)
+	for id, s := range ss.byID {
+		if s.TenantID == tenantID && s.UserID == userID {
+			removed[id] = s
+			delete(ss.byID, id)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	if err := ss.save(); err != nil {
+		for id, s := range removed {
+			ss.byID[id] = s
+		}
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// Run submits due saved searches to the scheduler every interval until ctx
+// is cancelled
+func (ss *SavedSearches) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ss.submitDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// submitDue hands every due saved search to the scheduler as an alert job.
+// The next run is booked right away, so a job waiting for its window is not
+// submitted twice; failed runs are retried by the scheduler.
+func (ss *SavedSearches) submitDue() {
+	now := ss.now().UTC()
+	ss.mu.Lock()
+	var due []SavedSearch
+	for _, s := range ss.byID {
+		if !now.Before(s.NextRunAt) {
+			s.NextRunAt = now.Add(savedSearchSchedules[s.Schedule])
+			due = append(due, *s)
+		}
+	}
+	if len(due) > 0 {
+		if err := ss.save(); err != nil {
+			slog.Error("Error saving saved searches", "error", err)
+		}
+	}
+	ss.mu.Unlock()
+
+	for _, s := range due {
+		id := s.ID
+		ss.scheduler.Submit(&Job{
+			ID:          "alert-" + id,
+			Kind:        "alert",
+			Description: fmt.Sprintf("Re-run saved search %q", s.Name),
+			Priority:    PriorityNormal,
+			// Late is fine, but not later than the next scheduled run
+			Deadline: s.NextRunAt,
+			Run: func(ctx context.Context) error {
+				return ss.runOne(ctx, id)
+			},
+		})
+	}
+}
+
+// runOne re-runs a saved search and announces results it hasn't reported
+// yet. The first run only records what is already there.
+func (ss *SavedSearches) runOne(ctx context.Context, id string) error {
+	ss.mu.Lock()
+	s, ok := ss.byID[id]
+	if !ok {
+		ss.mu.Unlock()
+		return nil
+	}
+	snapshot := *s
+	snapshot.Seen = slices.Clone(s.Seen)
+	snapshot.Delivered = maps.Clone(s.Delivered)
+	ss.mu.Unlock()
+
+	engine := snapshot.Engine
+	if engine == "" {
+		engine = defaultEngine.Load().Name
+	}
+	query := buildQueryString(snapshot.Intent)
+	results, err := ss.provider.Search(ctx, ResultsQuery{Query: query, Engine: engine, Locale: snapshot.Locale})
+	if err != nil {
+		ss.finish(id, nil, nil, fmt.Sprintf("results provider: %v", err))
+		return fmt.Errorf("error fetching results: %v", err)
+	}
+
+	seen := make(map[string]bool, len(snapshot.Seen))
+	for _, u := range snapshot.Seen {
+		seen[u] = true
+	}
+	var fresh []SearchResult
+	for _, r := range results {
+		if r.URL != "" && !seen[r.URL] {
+			seen[r.URL] = true
+			fresh = append(fresh, r)
+		}
+	}
+
+	if snapshot.LastRunAt != nil && len(fresh) > 0 {
+		delivered, err := ss.notify(ctx, &snapshot, query, fresh)
+		if err != nil {
+			// Nothing is marked seen, so the retry announces the same
+			// results, but only on the channels that didn't get them
+			ss.finish(id, nil, delivered, err.Error())
+			return err
+		}
+	}
+	ss.finish(id, fresh, nil, "")
+	return nil
+}
+
+// finish records the outcome of a run: the fresh results of a successful
+// one, or what a failed one delivered anyway
+func (ss *SavedSearches) finish(id string, fresh []SearchResult, delivered map[string][]string, lastError string) {
+	now := ss.now().UTC()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.byID[id]
+	if !ok {
+		return
+	}
+	s.LastError = lastError
+	if lastError == "" {
+		s.LastRunAt = &now
+		for _, r := range fresh {
+			s.Seen = append(s.Seen, r.URL)
+		}
+		if len(s.Seen) > maxSeenResults {
+			s.Seen = s.Seen[len(s.Seen)-maxSeenResults:]
+		}
+		s.Delivered = nil
+	}
+	for channel, urls := range delivered {
+		if s.Delivered == nil {
+			s.Delivered = make(map[string][]string)
+		}
+		s.Delivered[channel] = append(s.Delivered[channel], urls...)
+	}
+	if err := ss.save(); err != nil {
+		slog.Error("Error saving saved searches", "error", err)
+	}
+}
+
+// notify sends the new results to every target of the saved search and
+// publishes them to the owner's no-code trigger feed. A channel is only sent
+// the results an earlier, partly failed attempt didn't get to it, and every
+// channel is tried whatever the others do. It returns the result URLs each
+// channel got, for the retry to skip when some channel failed.
+func (ss *SavedSearches) notify(ctx context.Context, s *SavedSearch, query string, fresh []SearchResult) (map[string][]string, error) {
+	delivered := make(map[string][]string)
+	// pending are the results the channel hasn't had yet, of which at most
+	// maxAlertResults are sent; once it got them, all count as delivered
+	pending := func(channel string) (send []SearchResult, urls []string) {
+		had := make(map[string]bool, len(s.Delivered[channel]))
+		for _, u := range s.Delivered[channel] {
+			had[u] = true
+		}
+		for _, r := range fresh {
+			if !had[r.URL] {
+				send = append(send, r)
+				urls = append(urls, r.URL)
+			}
+		}
+		if len(send) > maxAlertResults {
+			send = send[:maxAlertResults]
+		}
+		return send, urls
+	}
+
+	var failed []string
+	send := func(channel string, fn func(AlertEvent) error) {
+		results, urls := pending(channel)
+		if len(results) == 0 {
+			return
+		}
+		event := AlertEvent{
+			Event:         "saved_search.new_results",
+			SavedSearchID: s.ID,
+			Name:          s.Name,
+			TenantID:      s.TenantID,
+			UserID:        s.UserID,
+			Query:         query,
+			Results:       results,
+			RunAt:         ss.now().UTC(),
+		}
+		if err := fn(event); err != nil {
+			slog.WarnContext(ctx, "Alert delivery failed", "channel", channel, "saved_search_id", s.ID, "error", err)
+			alertNotifications.Inc(channel, "failed")
+			failed = append(failed, channel)
+			return
+		}
+		alertNotifications.Inc(channel, "sent")
+		delivered[channel] = urls
+	}
+	if s.Notify.Webhook != "" {
+		send("webhook", func(e AlertEvent) error { return ss.postJSON(ctx, s.Notify.Webhook, e) })
+	}
+	if s.Notify.Slack != "" {
+		send("slack", func(e AlertEvent) error { return ss.postJSON(ctx, s.Notify.Slack, slackAlertMessage(e)) })
+	}
+	if s.Notify.Email != "" && !s.Notify.EmailVerified {
+		alertNotifications.Inc("email", "unverified")
+	} else if s.Notify.Email != "" {
+		send("email", func(e AlertEvent) error { return ss.sendEmail(s.Notify.Email, e) })
+	}
+
+	results, urls := pending("feed")
+	for _, r := range results {
+		ss.feed.Publish(s.TenantID, s.UserID, TriggerItem{
+			SavedSearchID: s.ID,
+			Prompt:        s.Prompt,
+			Title:         r.Title,
+			URL:           r.URL,
+			Snippet:       r.Snippet,
+		})
+	}
+	if len(urls) > 0 {
+		delivered["feed"] = urls
+	}
+
+	if len(failed) > 0 {
+		return delivered, fmt.Errorf("alert delivery failed for %s", strings.Join(failed, ", "))
+	}
+	return delivered, nil
+}
+
+func (ss *SavedSearches) postJSON(ctx context.Context, target string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error marshaling alert: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// slackAlertMessage formats an alert as Slack mrkdwn
+func slackAlertMessage(e AlertEvent) map[string]string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s*: %d new result(s) for `%s`", e.Name, len(e.Results), e.Query)
+	for _, r := range e.Results {
+		title := strings.NewReplacer("<", "", ">", "", "|", "").Replace(r.Title)
+		fmt.Fprintf(&b, "\n• <%s|%s>", r.URL, title)
+	}
+	return map[string]string{"text": b.String()}
+}
+
+func (ss *SavedSearches) sendEmail(to string, e AlertEvent) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d new result(s) for %q:\r\n\r\n", len(e.Results), e.Query)
+	for _, r := range e.Results {
+		fmt.Fprintf(&body, "%s\r\n%s\r\n\r\n", r.Title, r.URL)
+	}
+	return ss.mail(to, "New results for "+e.Name, body.String())
+}
+
+// sendVerification mails the code confirming an email target
+func (ss *SavedSearches) sendVerification(s *SavedSearch, code string) error {
+	body := fmt.Sprintf("Someone asked for alerts of the saved search %q to be sent to this address.\r\n\r\n"+
+		"If it was you, confirm with the code %s. Otherwise ignore this email: nothing will be sent.\r\n", s.Name, code)
+	return ss.mail(s.Notify.Email, "Confirm alerts for "+s.Name, body)
+}
+
+func (ss *SavedSearches) mail(to, subject, body string) error {
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		ss.smtp.From, to, subject, body)
+
+	var auth smtp.Auth
+	if ss.smtp.Username != "" {
+		host, _, _ := strings.Cut(ss.smtp.Addr, ":")
+		auth = smtp.PlainAuth("", ss.smtp.Username, ss.smtp.Password, host)
+	}
+	if err := smtp.SendMail(ss.smtp.Addr, auth, ss.smtp.From, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	return nil
+}
+
+// handleSavedSearches lists (GET) and creates (POST) the caller's saved
+// searches. An email target is sent a code to confirm with handleVerify.
+func (ss *SavedSearches) handleSavedSearches(w http.ResponseWriter, r *http.Request) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"saved_searches": ss.List(tenantID, userID)})
+
+	case http.MethodPost:
+		var s SavedSearch
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := ss.validate(r.Context(), &s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Prompts are analyzed once here, so re-runs only cost a results
+		// provider call
+		if s.Intent == nil {
+			result, err := ss.search.analyze(r.Context(), s.Prompt, AnalyzeOptions{})
+			if err != nil {
+				writeAnalyzeError(w, r, err)
+				return
+			}
+			s.Intent = result.Intent
+		}
+		if strings.TrimSpace(buildQueryString(s.Intent)) == "" {
+			http.Error(w, "Intent has nothing to search for", http.StatusBadRequest)
+			return
+		}
+		s.TenantID, s.UserID = tenantID, userID
+		s.Notify.EmailVerified, s.EmailCode = false, ""
+		var code string
+		if s.Notify.Email != "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			code = hex.EncodeToString(b)
+			s.EmailCode = hashAPIKey(code)
+		}
+		if err := ss.Create(&s); err != nil {
+			if errors.Is(err, errTooManySavedSearches) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.ErrorContext(r.Context(), "Error creating saved search", "error", err)
+			http.Error(w, "Error saving saved search", http.StatusInternalServerError)
+			return
+		}
+		if code != "" {
+			if err := ss.sendVerification(&s, code); err != nil {
+				slog.WarnContext(r.Context(), "Error sending alert verification", "saved_search_id", s.ID, "error", err)
+				ss.Delete(tenantID, userID, s.ID)
+				http.Error(w, "Error sending the verification email", http.StatusBadGateway)
+				return
+			}
+		}
+		slog.InfoContext(r.Context(), "Saved search created", "saved_search_id", s.ID, "tenant", tenantID, "schedule", s.Schedule)
+		writeJSON(w, http.StatusCreated, s.view())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSavedSearch deletes one of the caller's saved searches
+func (ss *SavedSearches) handleSavedSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := ss.Delete(tenantID, userID, r.PathValue("id"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting saved search", "error", err)
+		http.Error(w, "Error deleting saved search", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleVerify confirms the email target of one of the caller's saved
+// searches with the code mailed to it: {"code": "..."}
+func (ss *SavedSearches) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.byID[r.PathValue("id")]
+	if !ok || s.TenantID != tenantID || s.UserID != userID {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if s.Notify.EmailVerified {
+		writeJSON(w, http.StatusOK, s.view())
+		return
+	}
+	if s.EmailCode == "" || subtle.ConstantTimeCompare([]byte(hashAPIKey(strings.TrimSpace(req.Code))), []byte(s.EmailCode)) != 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_code"})
+		return
+	}
+	s.Notify.EmailVerified, s.EmailCode = true, ""
+	if err := ss.save(); err != nil {
+		s.Notify.EmailVerified, s.EmailCode = false, hashAPIKey(strings.TrimSpace(req.Code))
+		slog.ErrorContext(r.Context(), "Error saving saved search", "error", err)
+		http.Error(w, "Error saving saved search", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.view())
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnalyticsSample is everything product analytics keeps about a sampled
+// search. It describes the shape of the intent only: no prompt, no query
+// words, no user ID, no exact timestamp.
+type AnalyticsSample struct {
+	TenantID      string    `json:"tenant_id"`
+	Hour          time.Time `json:"hour"`
+	Analyzer      string    `json:"analyzer"`
+	Route         string    `json:"route,omitempty"`
+	Model         string    `json:"model,omitempty"`
+	Vertical      string    `json:"vertical,omitempty"`
+	QueryType     string    `json:"query_type,omitempty"`
+	QueryWords    int       `json:"query_words"`
+	ExactPhrases  int       `json:"exact_phrases"`
+	ExcludeWords  int       `json:"exclude_words"`
+	HasSiteFilter bool      `json:"has_site_filter"`
+	SiteTLD       string    `json:"site_tld,omitempty"`
+	FileType      string    `json:"file_type,omitempty"`
+	HasDateRange  bool      `json:"has_date_range"`
+}
+
+// analyticsFields documents each collected field for the transparency endpoint
+var analyticsFields = map[string]string{
+	"tenant_id":       "Tenant the search was made for",
+	"hour":            "Time of the search, truncated to the hour",
+	"analyzer":        "openai or heuristic",
+	"route":           "Model route (cheap, capable, default, override)",
+	"model":           "Model used for the analysis",
+	"vertical":        "Detected kind of search (web, code, academic, shopping)",
+	"query_type":      "Detected query type (navigational, informational, transactional)",
+	"query_words":     "Number of words in the main query",
+	"exact_phrases":   "Number of exact phrases",
+	"exclude_words":   "Number of excluded words",
+	"has_site_filter": "Whether the search was limited to a site",
+	"site_tld":        "Top-level domain of that site, e.g. org",
+	"file_type":       "Requested file type, e.g. pdf",
+	"has_date_range":  "Whether the search had a date restriction",
+}
+
+var analyticsNeverCollected = []string{
+	"prompt", "query words", "exact phrases", "excluded words", "site name",
+	"user id", "api key", "ip address", "exact time",
+}
+
+var analyticsSamples = metricsRegistry.Counter("analytics_samples_total",
+	"Anonymized intents sampled for product analytics.")
+
+// AnalyticsSampler keeps a random sample of anonymized intents from tenants
+// that opted in, in a bounded ring buffer
+type AnalyticsSampler struct {
+	enabled     bool
+	defaultRate float64
+
+	mu      sync.Mutex
+	samples []AnalyticsSample
+	next    int
+	full    bool
+}
+
+func NewAnalyticsSampler(enabled bool, defaultRate float64, capacity int) *AnalyticsSampler {
+	return &AnalyticsSampler{
+		enabled:     enabled,
+		defaultRate: defaultRate,
+		samples:     make([]AnalyticsSample, capacity),
+	}
+}
+
+// rate returns the tenant's sampling rate, zero unless it opted in
+func (a *AnalyticsSampler) rate(t *Tenant) float64 {
+	if !a.enabled || t == nil || !t.AnalyticsOptIn {
+		return 0
+	}
+	if t.AnalyticsSampleRate > 0 {
+		return t.AnalyticsSampleRate
+	}
+	return a.defaultRate
+}
+
+// Observe samples a completed analysis
+func (a *AnalyticsSampler) Observe(ctx context.Context, result *AnalysisResult) {
+	t := tenantFromContext(ctx)
+	if rate := a.rate(t); rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+
+	intent := result.Intent
+	sample := AnalyticsSample{
+		TenantID:      t.ID,
+		Hour:          time.Now().UTC().Truncate(time.Hour),
+		Analyzer:      result.Analyzer,
+		Route:         result.Route,
+		Model:         result.Model,
+		Vertical:      result.Vertical,
+		QueryType:     result.QueryType,
+		QueryWords:    len(strings.Fields(intent.MainQuery)),
+		ExactPhrases:  len(intent.ExactPhrases),
+		ExcludeWords:  len(intent.ExcludeWords),
+		HasSiteFilter: intent.SiteFilter != "",
+		FileType:      strings.ToLower(intent.FileType),
+		HasDateRange:  intent.DateRange != "",
+	}
+	if i := strings.LastIndex(intent.SiteFilter, "."); i >= 0 && i < len(intent.SiteFilter)-1 {
+		sample.SiteTLD = strings.ToLower(intent.SiteFilter[i+1:])
+	}
+
+	a.mu.Lock()
+	a.samples[a.next] = sample
+	a.next = (a.next + 1) % len(a.samples)
+	if a.next == 0 {
+		a.full = true
+	}
+	a.mu.Unlock()
+	analyticsSamples.Inc()
+}
+
+// PurgeBefore drops samples taken before cutoff and returns how many
+func (a *AnalyticsSampler) PurgeBefore(cutoff time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ordered := a.samples[:a.next]
+	if a.full {
+		ordered = append(append([]AnalyticsSample{}, a.samples[a.next:]...), a.samples[:a.next]...)
+	}
+	kept := make([]AnalyticsSample, 0, len(a.samples))
+	for _, s := range ordered {
+		if !s.Hour.Before(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	purged := len(ordered) - len(kept)
+	if purged == 0 {
+		return 0
+	}
+	// Restart the ring from the kept samples, oldest first
+	a.full = false
+	a.next = len(kept)
+	a.samples = kept[:cap(kept)]
+	return purged
+}
+
+// Samples returns the stored samples, oldest first, optionally of one tenant
+func (a *AnalyticsSampler) Samples(tenantID string) []AnalyticsSample {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ordered := a.samples[:a.next]
+	if a.full {
+		ordered = append(append([]AnalyticsSample{}, a.samples[a.next:]...), a.samples[:a.next]...)
+	}
+	out := []AnalyticsSample{}
+	for _, s := range ordered {
+		if tenantID == "" || s.TenantID == tenantID {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// handleTransparency shows the calling tenant whether it is sampled and
+// exactly which records were collected about its searches
+func (a *AnalyticsSampler) handleTransparency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t := tenantFromContext(r.Context())
+	tenantID := DefaultTenantID
+	if t != nil {
+		tenantID = t.ID
+	}
+	rate := a.rate(t)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tenant_id":       tenantID,
+		"collecting":      rate > 0,
+		"sample_rate":     rate,
+		"fields":          analyticsFields,
+		"never_collected": analyticsNeverCollected,
+		"samples":         a.Samples(tenantID),
+	})
+}
+
+// handleAdmin returns every sample for product analytics
+func (a *AnalyticsSampler) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"samples": a.Samples(r.URL.Query().Get("tenant_id")),
+	})
+}
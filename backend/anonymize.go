@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Query privacy policies: what usage analytics keep of the queries searched
+const (
+	// QueryPrivacyRaw keeps the text of every query
+	QueryPrivacyRaw = "raw"
+	// QueryPrivacyHashed keeps a keyed hash of each query, never its text,
+	// so identical queries are still counted together
+	QueryPrivacyHashed = "hashed"
+	// QueryPrivacyKAnonymous keeps hashes, and the text of a query only once
+	// k different users have searched it
+	QueryPrivacyKAnonymous = "k_anonymous"
+)
+
+var anonymizedQueries = metricsRegistry.Counter("usage_queries_anonymized_total",
+	"Queries counted by usage analytics, by privacy policy and whether their text is kept (kept, withheld).", "privacy", "text")
+
+func validateQueryPrivacy(privacy string) error {
+	switch privacy {
+	case QueryPrivacyRaw, QueryPrivacyHashed, QueryPrivacyKAnonymous:
+		return nil
+	}
+	return fmt.Errorf("invalid analytics privacy %q (want raw, hashed or k_anonymous)", privacy)
+}
+
+// QueryAnonymizer turns queries into what usage analytics may keep of them
+// under each tenant's privacy policy. Hashes are keyed, so a query can't be
+// found by hashing guesses without the key.
+type QueryAnonymizer struct {
+	// privacy is the policy of tenants without their own
+	privacy string
+	k       int
+	key     []byte
+}
+
+// NewQueryAnonymizer hashes with key, or with a random key when empty: the
+// usage analytics don't outlive the process, so neither must the key
+func NewQueryAnonymizer(privacy string, k int, key string) (*QueryAnonymizer, error) {
+	if err := validateQueryPrivacy(privacy); err != nil {
+		return nil, err
+	}
+	a := &QueryAnonymizer{privacy: privacy, k: k, key: []byte(key)}
+	if key == "" {
+		a.key = make([]byte, 32)
+		rand.Read(a.key)
+	}
+	return a, nil
+}
+
+// privacyFor returns the privacy policy of the request's tenant
+func (a *QueryAnonymizer) privacyFor(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil && t.AnalyticsPrivacy != "" {
+		return t.AnalyticsPrivacy
+	}
+	return a.privacy
+}
+
+// hash returns the keyed hash of a query or a requester
+func (a *QueryAnonymizer) hash(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// requesterFromContext tells apart the people searching, for k-anonymity:
+// by X-User-ID, or by the address the request came from. "" outside a
+// request.
+func requesterFromContext(ctx context.Context) string {
+	info := requestInfoFromContext(ctx)
+	if info == nil {
+		return ""
+	}
+	if info.user != "" {
+		return "user:" + info.user
+	}
+	if info.client != "" {
+		return "client:" + info.client
+	}
+	return ""
+}
+
+// usageQueryText is what a tenant's usage analytics keep to show a query:
+// its text once the policy allows it, and until then the hashes of the
+// requesters who searched it, at most k of them
+type usageQueryText struct {
+	text       string
+	requesters map[string]bool
+	seen       time.Time
+}
+
+// anonymizeLocked returns the hash a query is counted under and records
+// what the tenant's policy allows of its text. Callers hold the stats' lock.
+func (u *UsageStats) anonymizeLocked(ctx context.Context, tenantID, query string, now time.Time) string {
+	a := u.anonymizer
+	privacy := a.privacyFor(ctx)
+	hash := a.hash(query)
+	texts, ok := u.texts[tenantID]
+	if !ok {
+		texts = make(map[string]*usageQueryText)
+		u.texts[tenantID] = texts
+	}
+	entry := texts[hash]
+	switch privacy {
+	case QueryPrivacyHashed:
+		// A text kept under an earlier policy goes too
+		delete(texts, hash)
+		anonymizedQueries.Inc(privacy, "withheld")
+		return hash
+	case QueryPrivacyRaw:
+		texts[hash] = &usageQueryText{text: query, seen: now}
+		anonymizedQueries.Inc(privacy, "kept")
+		return hash
+	}
+	if entry == nil {
+		entry = &usageQueryText{requesters: make(map[string]bool)}
+		texts[hash] = entry
+	}
+	entry.seen = now
+	if entry.text == "" {
+		if requester := requesterFromContext(ctx); requester != "" {
+			entry.requesters[a.hash(requester)] = true
+		}
+		if len(entry.requesters) >= a.k {
+			entry.text, entry.requesters = query, nil
+		}
+	}
+	if entry.text == "" {
+		anonymizedQueries.Inc(privacy, "withheld")
+	} else {
+		anonymizedQueries.Inc(privacy, "kept")
+	}
+	return hash
+}
+
+// pruneTextsLocked forgets the queries not searched since cutoff
+func (u *UsageStats) pruneTextsLocked(cutoff time.Time) {
+	for tenantID, texts := range u.texts {
+		for hash, entry := range texts {
+			if entry.seen.Before(cutoff) {
+				delete(texts, hash)
+			}
+		}
+		if len(texts) == 0 {
+			delete(u.texts, tenantID)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Managed API key states; expired is final
+const (
+	KeyActive    = "active"
+	KeySuspended = "suspended"
+	KeyExpired   = "expired"
+)
+
+const (
+	managedKeyPrefix = "aps_"
+	maxKeysPerBulk   = 1000
+)
+
+var (
+	managedKeyOps = metricsRegistry.Counter("api_key_operations_total",
+		"Managed API key lifecycle operations, by operation.", "operation")
+	managedKeyNotifications = metricsRegistry.Counter("api_key_notifications_total",
+		"Key lifecycle webhook deliveries, by result (sent, failed).", "result")
+)
+
+// ManagedKey is a tenant API key issued through the admin API. Only a hash of
+// the secret is kept; the secret itself is shown once, when it is issued.
+type ManagedKey struct {
+	ID        string     `json:"id"`
+	TenantID  string     `json:"tenant_id"`
+	Team      string     `json:"team,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	UserID    string     `json:"user_id,omitempty"` // end user of a per-user key
+	Prefix    string     `json:"prefix"`            // first characters of the secret, to recognize it
+	Hash      string     `json:"hash,omitempty"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ReplacedBy is the key issued when this one was rotated
+	ReplacedBy   string `json:"replaced_by,omitempty"`
+	ExpiryWarned bool   `json:"expiry_warned,omitempty"`
+}
+
+// view is the key as returned by the admin API, without its hash
+func (k *ManagedKey) view() ManagedKey {
+	v := *k
+	v.Hash = ""
+	return v
+}
+
+// KeyEvent is sent to the lifecycle webhook
+type KeyEvent struct {
+	Event     string     `json:"event"` // key.created, key.rotated, key.suspended, key.resumed, key.expiry_scheduled, key.expiring, key.expired
+	Time      time.Time  `json:"time"`
+	KeyID     string     `json:"key_id"`
+	TenantID  string     `json:"tenant_id"`
+	Team      string     `json:"team,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ReplacedBy is set on key.rotated
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// APIKeyStore issues and tracks managed tenant API keys, next to the static
+// ones of TENANTS_FILE. Keys are saved to path after every change, or kept in
+// memory only when path is empty.
+type APIKeyStore struct {
+	path       string
+	webhookURL string
+	warning    time.Duration
+	grace      time.Duration
+	client     *http.Client
+	now        func() time.Time
+
+	mu      sync.RWMutex
+	byID    map[string]*ManagedKey
+	byHash  map[string]*ManagedKey
+	pending []KeyEvent
+	notify  chan struct{}
+}
+
+// NewAPIKeyStore loads the keys saved at path, if any. Webhook events go to
+// webhookURL; warning is how long before expiry key.expiring is sent, and
+// grace how long a rotated key keeps working by default.
+func NewAPIKeyStore(path, webhookURL string, warning, grace time.Duration, client *http.Client) (*APIKeyStore, error) {
+	s := &APIKeyStore{
+		path:       path,
+		webhookURL: webhookURL,
+		warning:    warning,
+		grace:      grace,
+		client:     client,
+		now:        time.Now,
+		byID:       make(map[string]*ManagedKey),
+		byHash:     make(map[string]*ManagedKey),
+		notify:     make(chan struct{}, 1),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading API keys file: %v", err)
+	}
+	var keys []*ManagedKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("error parsing API keys file: %v", err)
+	}
+	for _, k := range keys {
+		s.byID[k.ID] = k
+		s.byHash[k.Hash] = k
+	}
+	return s, nil
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeySecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return managedKeyPrefix + hex.EncodeToString(b)
+}
+
+// status is the key's state at now; keys past their expiry are expired even
+// before the next check marks them
+func (s *APIKeyStore) status(k *ManagedKey, now time.Time) string {
+	if k.Status != KeyExpired && k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return KeyExpired
+	}
+	return k.Status
+}
+
+// Check returns the tenant and current status of a managed key secret
+func (s *APIKeyStore) Check(secret string) (tenantID, status string, ok bool) {
+	if s == nil || !strings.HasPrefix(secret, managedKeyPrefix) {
+		return "", "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[hashAPIKey(secret)]
+	if !ok {
+		return "", "", false
+	}
+	return k.TenantID, s.status(k, s.now()), true
+}
+
+// User returns the end user a managed key secret was issued to, empty for
+// keys of the whole tenant
+func (s *APIKeyStore) User(secret string) string {
+	if s == nil || !strings.HasPrefix(secret, managedKeyPrefix) {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if k, ok := s.byHash[hashAPIKey(secret)]; ok {
+		return k.UserID
+	}
+	return ""
+}
+
+// KeySpec describes a key to create
+type KeySpec struct {
+	TenantID  string     `json:"tenant_id"`
+	Team      string     `json:"team,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	UserID    string     `json:"user_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// IssuedKey is a newly created key with its secret
+type IssuedKey struct {
+	ManagedKey
+	Secret string `json:"secret"`
+}
+
+// Create issues a key for every spec
+func (s *APIKeyStore) Create(specs []KeySpec) ([]IssuedKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	issued := make([]IssuedKey, 0, len(specs))
+	for _, spec := range specs {
+		k, secret := s.issue(spec, now)
+		issued = append(issued, IssuedKey{ManagedKey: k.view(), Secret: secret})
+		s.emit("key.created", k, now)
+		managedKeyOps.Inc("create")
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+func (s *APIKeyStore) issue(spec KeySpec, now time.Time) (*ManagedKey, string) {
+	secret := newAPIKeySecret()
+	k := &ManagedKey{
+		ID:        "key_" + newHistoryID()[:16],
+		TenantID:  spec.TenantID,
+		Team:      spec.Team,
+		Label:     spec.Label,
+		UserID:    spec.UserID,
+		Prefix:    secret[:len(managedKeyPrefix)+6],
+		Hash:      hashAPIKey(secret),
+		Status:    KeyActive,
+		CreatedAt: now,
+		ExpiresAt: spec.ExpiresAt,
+	}
+	s.byID[k.ID] = k
+	s.byHash[k.Hash] = k
+	return k, secret
+}
+
+// KeySelector picks keys for a bulk operation: the listed IDs, or every key
+// of a tenant and/or team
+type KeySelector struct {
+	IDs      []string `json:"ids,omitempty"`
+	TenantID string   `json:"tenant_id,omitempty"`
+	Team     string   `json:"team,omitempty"`
+}
+
+func (sel KeySelector) empty() bool {
+	return len(sel.IDs) == 0 && sel.TenantID == "" && sel.Team == ""
+}
+
+// selectKeys returns the selected keys that aren't expired, and the listed
+// IDs that don't exist
+func (s *APIKeyStore) selectKeys(sel KeySelector, now time.Time) ([]*ManagedKey, []string) {
+	var keys []*ManagedKey
+	missing := []string{}
+	if len(sel.IDs) > 0 {
+		for _, id := range sel.IDs {
+			k, ok := s.byID[id]
+			if !ok {
+				missing = append(missing, id)
+				continue
+			}
+			if s.status(k, now) != KeyExpired {
+				keys = append(keys, k)
+			}
+		}
+		return keys, missing
+	}
+	for _, k := range s.byID {
+		if sel.TenantID != "" && k.TenantID != sel.TenantID {
+			continue
+		}
+		if sel.Team != "" && k.Team != sel.Team {
+			continue
+		}
+		if s.status(k, now) != KeyExpired {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, missing
+}
+
+// Rotate issues a replacement for each selected key; the old key keeps
+// working for grace so clients can switch over
+func (s *APIKeyStore) Rotate(sel KeySelector, grace time.Duration) ([]IssuedKey, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	keys, missing := s.selectKeys(sel, now)
+	issued := make([]IssuedKey, 0, len(keys))
+	for _, old := range keys {
+		if old.ReplacedBy != "" {
+			continue
+		}
+		k, secret := s.issue(KeySpec{TenantID: old.TenantID, Team: old.Team, Label: old.Label, UserID: old.UserID}, now)
+		if old.Status == KeySuspended {
+			k.Status = KeySuspended
+		}
+		until := now.Add(grace)
+		if old.ExpiresAt == nil || until.Before(*old.ExpiresAt) {
+			old.ExpiresAt = &until
+		}
+		old.ReplacedBy = k.ID
+		issued = append(issued, IssuedKey{ManagedKey: k.view(), Secret: secret})
+		s.emit("key.rotated", old, now)
+		managedKeyOps.Inc("rotate")
+	}
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+	return issued, missing, nil
+}
+
+// SetStatus suspends or resumes the selected keys
+func (s *APIKeyStore) SetStatus(sel KeySelector, status string) ([]ManagedKey, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	event := "key.resumed"
+	if status == KeySuspended {
+		event = "key.suspended"
+	}
+	keys, missing := s.selectKeys(sel, now)
+	changed := []ManagedKey{}
+	for _, k := range keys {
+		if k.Status == status {
+			continue
+		}
+		k.Status = status
+		changed = append(changed, k.view())
+		s.emit(event, k, now)
+		managedKeyOps.Inc(strings.TrimPrefix(event, "key."))
+	}
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+	return changed, missing, nil
+}
+
+// Expire schedules the selected keys to expire at the given time; a time in
+// the past expires them now
+func (s *APIKeyStore) Expire(sel KeySelector, at time.Time) ([]ManagedKey, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	keys, missing := s.selectKeys(sel, now)
+	changed := []ManagedKey{}
+	for _, k := range keys {
+		when := at.UTC()
+		k.ExpiresAt = &when
+		k.ExpiryWarned = false
+		if !now.Before(when) {
+			k.Status = KeyExpired
+			s.emit("key.expired", k, now)
+		} else {
+			s.emit("key.expiry_scheduled", k, now)
+		}
+		changed = append(changed, k.view())
+		managedKeyOps.Inc("expire")
+	}
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+	return changed, missing, nil
+}
+
+// List returns the keys matching the filters, without their hashes
+func (s *APIKeyStore) List(tenantID, team, status string) []ManagedKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	out := []ManagedKey{}
+	for _, k := range s.byID {
+		v := k.view()
+		v.Status = s.status(k, now)
+		if (tenantID != "" && v.TenantID != tenantID) || (team != "" && v.Team != team) || (status != "" && v.Status != status) {
+			continue
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// CheckExpiry marks keys past their expiry as expired and warns about the
+// ones expiring soon
+func (s *APIKeyStore) CheckExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	changed := false
+	for _, k := range s.byID {
+		if k.Status == KeyExpired || k.ExpiresAt == nil {
+			continue
+		}
+		switch {
+		case !now.Before(*k.ExpiresAt):
+			k.Status = KeyExpired
+			s.emit("key.expired", k, now)
+			changed = true
+		case !k.ExpiryWarned && k.ReplacedBy == "" && s.warning > 0 && k.ExpiresAt.Sub(now) <= s.warning:
+			k.ExpiryWarned = true
+			s.emit("key.expiring", k, now)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			slog.Error("Error saving API keys", "error", err)
+		}
+	}
+}
+
+// Run checks expiry and delivers notifications every interval until ctx is
+// cancelled
+func (s *APIKeyStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.CheckExpiry()
+		case <-s.notify:
+		}
+		s.deliver(ctx)
+	}
+}
+
+// emit queues a webhook event; the caller holds the lock
+func (s *APIKeyStore) emit(event string, k *ManagedKey, now time.Time) {
+	slog.Info("API key lifecycle", "event", event, "key_id", k.ID, "tenant", k.TenantID, "team", k.Team)
+	if s.webhookURL == "" {
+		return
+	}
+	s.pending = append(s.pending, KeyEvent{
+		Event:      event,
+		Time:       now,
+		KeyID:      k.ID,
+		TenantID:   k.TenantID,
+		Team:       k.Team,
+		Label:      k.Label,
+		ExpiresAt:  k.ExpiresAt,
+		ReplacedBy: k.ReplacedBy,
+	})
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// deliver posts the pending events in one batch; failed batches are retried
+// on the next run
+func (s *APIKeyStore) deliver(ctx context.Context) {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	if err := s.post(ctx, events); err != nil {
+		slog.Warn("API key webhook failed, retrying later", "events", len(events), "error", err)
+		managedKeyNotifications.Add(float64(len(events)), "failed")
+		s.mu.Lock()
+		s.pending = append(events, s.pending...)
+		if len(s.pending) > telemetryMaxBuffer {
+			s.pending = s.pending[len(s.pending)-telemetryMaxBuffer:]
+		}
+		s.mu.Unlock()
+		return
+	}
+	managedKeyNotifications.Add(float64(len(events)), "sent")
+}
+
+func (s *APIKeyStore) post(ctx context.Context, events []KeyEvent) error {
+	body, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		return fmt.Errorf("error marshaling events: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// save writes every key to the file, replacing it at once; the caller holds
+// the lock
+func (s *APIKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	keys := make([]*ManagedKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling API keys: %v", err)
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("error saving API keys: %v", err)
+	}
+	return nil
+}
+
+// APIKeyAdmin serves the bulk key lifecycle endpoints
+type APIKeyAdmin struct {
+	store   *APIKeyStore
+	tenants *TenantRegistry
+}
+
+func NewAPIKeyAdmin(store *APIKeyStore, tenants *TenantRegistry) *APIKeyAdmin {
+	return &APIKeyAdmin{store: store, tenants: tenants}
+}
+
+// Register mounts the endpoints on mux behind the admin key
+func (a *APIKeyAdmin) Register(mux *http.ServeMux, adminKey string) {
+	mux.HandleFunc("/v1/admin/api-keys", requireAdmin(adminKey, a.handleKeys))
+	mux.HandleFunc("/v1/admin/api-keys/rotate", requireAdmin(adminKey, a.handleRotate))
+	mux.HandleFunc("/v1/admin/api-keys/suspend", requireAdmin(adminKey, a.handleStatus(KeySuspended)))
+	mux.HandleFunc("/v1/admin/api-keys/resume", requireAdmin(adminKey, a.handleStatus(KeyActive)))
+	mux.HandleFunc("/v1/admin/api-keys/expire", requireAdmin(adminKey, a.handleExpire))
+}
+
+// handleKeys lists keys (GET ?tenant_id=&team=&status=) or creates them in
+// bulk (POST {"keys": [{"tenant_id", "team", "label", "expires_at"}]})
+func (a *APIKeyAdmin) handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"keys": a.store.List(q.Get("tenant_id"), q.Get("team"), q.Get("status")),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Keys []KeySpec `json:"keys"`
+		}
+		if !decodeKeyRequest(w, r, &req) {
+			return
+		}
+		if len(req.Keys) == 0 || len(req.Keys) > maxKeysPerBulk {
+			http.Error(w, fmt.Sprintf("keys must list 1 to %d keys", maxKeysPerBulk), http.StatusBadRequest)
+			return
+		}
+		for i, spec := range req.Keys {
+			if spec.TenantID == "" || spec.TenantID == DefaultTenantID {
+				http.Error(w, fmt.Sprintf("keys[%d]: tenant_id is required", i), http.StatusBadRequest)
+				return
+			}
+			if _, ok := a.tenants.ByID(spec.TenantID); !ok {
+				http.Error(w, fmt.Sprintf("keys[%d]: unknown tenant %q", i, spec.TenantID), http.StatusBadRequest)
+				return
+			}
+			if spec.ExpiresAt != nil && !spec.ExpiresAt.After(time.Now()) {
+				http.Error(w, fmt.Sprintf("keys[%d]: expires_at is in the past", i), http.StatusBadRequest)
+				return
+			}
+		}
+		issued, err := a.store.Create(req.Keys)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error creating API keys", "error", err)
+			http.Error(w, "Error saving keys", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"keys": issued})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRotate issues replacements: POST {"ids", "tenant_id", "team", "grace": "24h"}
+func (a *APIKeyAdmin) handleRotate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		KeySelector
+		Grace string `json:"grace"`
+	}
+	if !a.decodeSelector(w, r, &req, &req.KeySelector) {
+		return
+	}
+	grace := a.store.grace
+	if req.Grace != "" {
+		d, err := time.ParseDuration(req.Grace)
+		if err != nil || d < 0 {
+			http.Error(w, "grace must be a duration like 24h", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	issued, missing, err := a.store.Rotate(req.KeySelector, grace)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rotating API keys", "error", err)
+		http.Error(w, "Error saving keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": issued, "not_found": missing})
+}
+
+// handleStatus suspends or resumes keys: POST {"ids", "tenant_id", "team"}
+func (a *APIKeyAdmin) handleStatus(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var sel KeySelector
+		if !a.decodeSelector(w, r, &sel, &sel) {
+			return
+		}
+		changed, missing, err := a.store.SetStatus(sel, status)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error updating API keys", "error", err)
+			http.Error(w, "Error saving keys", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": changed, "not_found": missing})
+	}
+}
+
+// handleExpire schedules expiry: POST {"ids", "tenant_id", "team", "at"}; no
+// at expires the keys immediately
+func (a *APIKeyAdmin) handleExpire(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		KeySelector
+		At *time.Time `json:"at"`
+	}
+	if !a.decodeSelector(w, r, &req, &req.KeySelector) {
+		return
+	}
+	at := time.Now()
+	if req.At != nil {
+		at = *req.At
+	}
+	changed, missing, err := a.store.Expire(req.KeySelector, at)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error expiring API keys", "error", err)
+		http.Error(w, "Error saving keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": changed, "not_found": missing})
+}
+
+// decodeSelector reads a POST body into v and checks that its selector picks
+// something
+func (a *APIKeyAdmin) decodeSelector(w http.ResponseWriter, r *http.Request, v interface{}, sel *KeySelector) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !decodeKeyRequest(w, r, v) {
+		return false
+	}
+	if sel.empty() {
+		http.Error(w, "ids, tenant_id or team is required", http.StatusBadRequest)
+		return false
+	}
+	if len(sel.IDs) > maxKeysPerBulk {
+		http.Error(w, fmt.Sprintf("at most %d ids per request", maxKeysPerBulk), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func decodeKeyRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	historyArchivePrefix  = "history/"
+	historyArchiveVersion = 1
+	historyArchiveBatch   = 1000
+)
+
+var archivedRecords = metricsRegistry.Counter("history_archived_records_total",
+	"History records moved to cold storage.")
+
+// historyArchive is the on-disk format: one gzipped JSON document per
+// tenant and day, laid out in columns so similar values compress together
+type historyArchive struct {
+	Version int `json:"version"`
+	Count   int `json:"count"`
+
+	ID           []string            `json:"id"`
+	TenantID     []string            `json:"tenant_id"`
+	UserID       []string            `json:"user_id"`
+	CreatedAt    []int64             `json:"created_at"` // unix milliseconds
+	Prompt       []string            `json:"prompt"`
+	Intent       []*SearchIntent     `json:"intent"`
+	SearchURL    []string            `json:"search_url"`
+	Analyzer     []string            `json:"analyzer"`
+	Encrypted    []*EncryptedPayload `json:"encrypted"`
+	Fingerprints [][]string          `json:"fingerprints"`
+	// TraceID and Engine were added later; archives without them are still
+	// version 1
+	TraceID []string `json:"trace_id,omitempty"`
+	Engine  []string `json:"engine,omitempty"`
+}
+
+func encodeHistoryArchive(records []*HistoryRecord) ([]byte, error) {
+	a := historyArchive{Version: historyArchiveVersion, Count: len(records)}
+	for _, rec := range records {
+		a.ID = append(a.ID, rec.ID)
+		a.TenantID = append(a.TenantID, rec.TenantID)
+		a.UserID = append(a.UserID, rec.UserID)
+		a.CreatedAt = append(a.CreatedAt, rec.CreatedAt.UnixMilli())
+		a.Prompt = append(a.Prompt, rec.Prompt)
+		a.Intent = append(a.Intent, rec.Intent)
+		a.SearchURL = append(a.SearchURL, rec.SearchURL)
+		a.Analyzer = append(a.Analyzer, rec.Analyzer)
+		a.Encrypted = append(a.Encrypted, rec.Encrypted)
+		a.Fingerprints = append(a.Fingerprints, rec.Fingerprints)
+		a.TraceID = append(a.TraceID, rec.TraceID)
+		a.Engine = append(a.Engine, rec.Engine)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(a); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeHistoryArchive(data []byte) ([]*HistoryRecord, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var a historyArchive
+	if err := json.Unmarshal(raw, &a); err != nil {
+		return nil, err
+	}
+	if a.Version != historyArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	for _, col := range []int{len(a.ID), len(a.TenantID), len(a.UserID), len(a.CreatedAt), len(a.Prompt),
+		len(a.Intent), len(a.SearchURL), len(a.Analyzer), len(a.Encrypted), len(a.Fingerprints)} {
+		if col != a.Count {
+			return nil, fmt.Errorf("corrupt archive: column length %d, expected %d", col, a.Count)
+		}
+	}
+	for _, col := range [][]string{a.TraceID, a.Engine} {
+		if col != nil && len(col) != a.Count {
+			return nil, fmt.Errorf("corrupt archive: column length %d, expected %d", len(col), a.Count)
+		}
+	}
+
+	records := make([]*HistoryRecord, a.Count)
+	for i := range records {
+		records[i] = &HistoryRecord{
+			ID:           a.ID[i],
+			TenantID:     a.TenantID[i],
+			UserID:       a.UserID[i],
+			CreatedAt:    time.UnixMilli(a.CreatedAt[i]).UTC(),
+			Prompt:       a.Prompt[i],
+			Intent:       a.Intent[i],
+			SearchURL:    a.SearchURL[i],
+			Analyzer:     a.Analyzer[i],
+			Encrypted:    a.Encrypted[i],
+			Fingerprints: a.Fingerprints[i],
+		}
+		if a.TraceID != nil {
+			records[i].TraceID = a.TraceID[i]
+		}
+		if a.Engine != nil {
+			records[i].Engine = a.Engine[i]
+		}
+	}
+	return records, nil
+}
+
+// HistoryArchiver moves old history to cold storage and brings it back on demand
+type HistoryArchiver struct {
+	store   HistoryStore
+	objects ObjectStore
+	after   time.Duration
+	now     func() time.Time
+}
+
+func NewHistoryArchiver(store HistoryStore, objects ObjectStore, after time.Duration) *HistoryArchiver {
+	return &HistoryArchiver{store: store, objects: objects, after: after, now: time.Now}
+}
+
+// archiveKey is history/<tenant>/<day>/<unique>.json.gz, so rehydration can
+// pick objects by tenant and date from their names alone
+func archiveKey(tenantID string, day time.Time) string {
+	return fmt.Sprintf("%s%s/%s/%d-%s.json.gz", historyArchivePrefix,
+		url.PathEscape(tenantID), day.Format("2006-01-02"), time.Now().UnixNano(), newHistoryID()[:8])
+}
+
+// Archive moves every record older than the retention window to the object
+// store. Records are only deleted once their archive object is written.
+func (a *HistoryArchiver) Archive(ctx context.Context) (int, error) {
+	cutoff := a.now().Add(-a.after)
+	total := 0
+	for {
+		records, err := a.store.ListOlderThan(ctx, cutoff, historyArchiveBatch)
+		if err != nil {
+			return total, fmt.Errorf("error listing old history: %v", err)
+		}
+		if len(records) == 0 {
+			return total, nil
+		}
+
+		groups := make(map[string][]*HistoryRecord)
+		for _, rec := range records {
+			key := rec.TenantID + "\x00" + rec.CreatedAt.UTC().Format("2006-01-02")
+			groups[key] = append(groups[key], rec)
+		}
+		for _, group := range groups {
+			data, err := encodeHistoryArchive(group)
+			if err != nil {
+				return total, fmt.Errorf("error encoding archive: %v", err)
+			}
+			if err := a.objects.Put(ctx, archiveKey(group[0].TenantID, group[0].CreatedAt.UTC()), data); err != nil {
+				return total, fmt.Errorf("error writing archive: %v", err)
+			}
+			ids := make([]string, len(group))
+			for i, rec := range group {
+				ids[i] = rec.ID
+			}
+			if err := a.store.Delete(ctx, ids); err != nil {
+				return total, fmt.Errorf("error deleting archived history: %v", err)
+			}
+			total += len(group)
+			archivedRecords.Add(float64(len(group)))
+		}
+		if len(records) < historyArchiveBatch {
+			return total, nil
+		}
+	}
+}
+
+// Rehydrate reads back a tenant's archived records created in [from, to),
+// optionally only one user's
+func (a *HistoryArchiver) Rehydrate(ctx context.Context, tenantID, userID string, from, to time.Time) ([]*HistoryRecord, error) {
+	prefix := historyArchivePrefix + url.PathEscape(tenantID) + "/"
+	keys, err := a.objects.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing archives: %v", err)
+	}
+
+	var out []*HistoryRecord
+	for _, key := range keys {
+		dayPart, _, _ := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		day, err := time.Parse("2006-01-02", dayPart)
+		if err != nil || !day.Before(to) || day.Add(24*time.Hour).Before(from) {
+			continue
+		}
+		data, err := a.objects.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive %s: %v", key, err)
+		}
+		records, err := decodeHistoryArchive(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding archive %s: %v", key, err)
+		}
+		for _, rec := range records {
+			if rec.CreatedAt.Before(from) || !rec.CreatedAt.Before(to) {
+				continue
+			}
+			if userID != "" && rec.UserID != userID {
+				continue
+			}
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+// Schedule submits an archival job to the scheduler every interval, so the
+// work runs in the batch window
+func (a *HistoryArchiver) Schedule(ctx context.Context, scheduler *JobScheduler, every time.Duration) {
+	submit := func() {
+		scheduler.Submit(&Job{
+			ID:          "history-archive",
+			Kind:        "history_archive",
+			Description: fmt.Sprintf("Move history older than %v to cold storage", a.after),
+			Priority:    PriorityLow,
+			Run: func(ctx context.Context) error {
+				n, err := a.Archive(ctx)
+				if n > 0 {
+					slog.Info("Archived history records", "records", n)
+				}
+				return err
+			},
+		})
+	}
+
+	submit()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			submit()
+		}
+	}
+}
+
+// handleRehydrate serves compliance lookups in archived history:
+// {"tenant_id", "user_id", "from", "to", "restore"}. With restore the records
+// are also put back in the primary store.
+func (a *HistoryArchiver) handleRehydrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		TenantID string    `json:"tenant_id"`
+		UserID   string    `json:"user_id"`
+		From     time.Time `json:"from"`
+		To       time.Time `json:"to"`
+		Restore  bool      `json:"restore"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TenantID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.To.IsZero() {
+		req.To = a.now()
+	}
+	if !req.From.Before(req.To) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	records, err := a.Rehydrate(r.Context(), req.TenantID, req.UserID, req.From, req.To)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error rehydrating history", "error", err)
+		http.Error(w, "Error reading archived history", http.StatusInternalServerError)
+		return
+	}
+	if req.Restore {
+		for _, rec := range records {
+			if err := a.store.Add(r.Context(), rec); err != nil {
+				slog.ErrorContext(r.Context(), "Error restoring history record", "id", rec.ID, "error", err)
+				http.Error(w, "Error restoring history", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if records == nil {
+		records = []*HistoryRecord{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(records), "restored": req.Restore, "records": records})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AssistRequest is what a Home Assistant conversation agent forwards for a
+// spoken or typed sentence
+type AssistRequest struct {
+	Text           string `json:"text"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	Language       string `json:"language,omitempty"`
+	DeviceID       string `json:"device_id,omitempty"`
+}
+
+// AssistResponse mirrors Home Assistant's ConversationResult
+type AssistResponse struct {
+	Response       AssistIntentResponse `json:"response"`
+	ConversationID string               `json:"conversation_id,omitempty"`
+}
+
+// AssistIntentResponse mirrors Home Assistant's IntentResponse
+type AssistIntentResponse struct {
+	Speech       map[string]AssistSpeech `json:"speech"`
+	Card         map[string]AssistCard   `json:"card"`
+	Language     string                  `json:"language"`
+	ResponseType string                  `json:"response_type"`
+	Data         map[string]interface{}  `json:"data"`
+}
+
+// AssistSpeech is the text the voice assistant reads out
+type AssistSpeech struct {
+	Speech    string      `json:"speech"`
+	ExtraData interface{} `json:"extra_data"`
+}
+
+// AssistCard is shown in the companion app next to the spoken reply
+type AssistCard struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// handleAssist fulfills a voice assistant request with a short spoken summary
+// of the search and the link to open it
+func (h *SearchHandler) handleAssist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req AssistRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Language == "" {
+		req.Language = "en"
+	}
+
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		writeJSON(w, http.StatusOK, assistError(req, "no_intent_match", "Sorry, I didn't catch what you want to search for."))
+		return
+	}
+
+	result, err := h.analyze(r.Context(), text, AnalyzeOptions{})
+	if err != nil {
+		// Voice clients can't show HTTP errors, so failures are spoken too
+		writeJSON(w, http.StatusOK, assistError(req, "failed_to_handle", "Sorry, I couldn't run that search right now."))
+		return
+	}
+
+	intent := result.Intent
+	searchURL := constructSearchQuery(intent)
+	speech := spokenSummary(intent)
+
+	writeJSON(w, http.StatusOK, AssistResponse{
+		ConversationID: req.ConversationID,
+		Response: AssistIntentResponse{
+			Speech: map[string]AssistSpeech{
+				"plain": {Speech: speech},
+			},
+			Card: map[string]AssistCard{
+				"simple": {Title: intent.MainQuery, Content: searchURL},
+			},
+			Language:     req.Language,
+			ResponseType: "action_done",
+			Data: map[string]interface{}{
+				"search_url": searchURL,
+				"query":      buildQueryString(intent),
+				"intent":     intent,
+			},
+		},
+	})
+}
+
+func assistError(req AssistRequest, code, speech string) AssistResponse {
+	return AssistResponse{
+		ConversationID: req.ConversationID,
+		Response: AssistIntentResponse{
+			Speech:       map[string]AssistSpeech{"plain": {Speech: speech}},
+			Card:         map[string]AssistCard{},
+			Language:     req.Language,
+			ResponseType: "error",
+			Data:         map[string]interface{}{"code": code},
+		},
+	}
+}
+
+// spokenSummary describes the search in one sentence that reads well aloud,
+// leaving out operator syntax and the URL itself
+func spokenSummary(intent *SearchIntent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "I searched for %s", intent.MainQuery)
+
+	if len(intent.ExactPhrases) > 0 {
+		fmt.Fprintf(&b, " mentioning %s", spokenList(intent.ExactPhrases))
+	}
+	if intent.FileType != "" {
+		fmt.Fprintf(&b, ", %s files only", strings.ToUpper(intent.FileType))
+	}
+	if intent.SiteFilter != "" {
+		fmt.Fprintf(&b, ", on %s", intent.SiteFilter)
+	}
+	if len(intent.ExcludeWords) > 0 {
+		fmt.Fprintf(&b, ", leaving out %s", spokenList(intent.ExcludeWords))
+	}
+	if intent.DateRange != "" {
+		fmt.Fprintf(&b, ", from %s onwards", intent.DateRange)
+	}
+	b.WriteString(". I've put the link in your Home Assistant app.")
+	return b.String()
+}
+
+// spokenList joins items as "a, b and c"
+func spokenList(items []string) string {
+	switch len(items) {
+	case 0:
+		return ""
+	case 1:
+		return items[0]
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+}
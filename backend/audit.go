@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	// AuditAuthFailure is a request refused for a missing, wrong, suspended
+	// or expired key
+	AuditAuthFailure = "auth_failure"
+	// AuditAdminAction is an authenticated request to an operator endpoint
+	AuditAdminAction = "admin_action"
+	// AuditConfigChange is a watched file reloaded, or failing to
+	AuditConfigChange = "config_change"
+	// AuditBudgetOverride is a tenant's spend limits or budget action changed
+	// from what they were
+	AuditBudgetOverride = "budget_override"
+	// AuditClientBanned is a client banned by the abuse detector
+	AuditClientBanned = "client_banned"
+)
+
+var (
+	auditEvents = metricsRegistry.Counter("audit_events_total",
+		"Events recorded to the audit log, by type.", "type")
+	auditSinkErrors = metricsRegistry.Counter("audit_sink_errors_total",
+		"Audit events a sink failed to write, by sink (file, syslog, archive, or queue when the writer fell behind).", "sink")
+)
+
+// auditArchivePrefix is where batches of audit events go in the object store
+const auditArchivePrefix = "audit/"
+
+// AuditEvent is one line of the audit log. Each line carries the hash of
+// the one before, so a line removed or edited breaks the chain from there.
+type AuditEvent struct {
+	Seq       uint64         `json:"seq"`
+	Time      time.Time      `json:"time"`
+	Type      string         `json:"type"`
+	Actor     string         `json:"actor,omitempty"`
+	Tenant    string         `json:"tenant,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Client    string         `json:"client,omitempty"`
+	Method    string         `json:"method,omitempty"`
+	Path      string         `json:"path,omitempty"`
+	Status    int            `json:"status,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+	// Prev is the hash of the previous event, "" for the first one
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of the event encoded without it
+	Hash string `json:"hash,omitempty"`
+}
+
+// auditSink is where the audit log writes its events, one JSON line each
+type auditSink interface {
+	Name() string
+	Write(line []byte) error
+	Close() error
+}
+
+// maxAuditQueue is how many events can wait for the sinks; past it new
+// events are dropped rather than make requests wait
+const maxAuditQueue = 4096
+
+// auditLine is an encoded event waiting for the sinks, or a marker closed
+// once the events before it are written
+type auditLine struct {
+	line    []byte
+	typ     string
+	written chan struct{}
+}
+
+// AuditLog records security-relevant events, in order, to every sink. Events
+// are chained as they are recorded and written by a background writer, so a
+// burst of refused keys never waits on the disk or the syslog server. A
+// failing sink is counted and logged but never fails the request that caused
+// the event. A nil log records nothing.
+type AuditLog struct {
+	mu      sync.Mutex
+	archive *auditArchiveSink
+	seq     uint64
+	prev    string
+	now     func() time.Time
+	queue   chan auditLine
+	closed  bool
+	stopped chan struct{}
+
+	// sinksMu is only held by the writer and while configuring
+	sinksMu sync.Mutex
+	sinks   []auditSink
+}
+
+func NewAuditLog() *AuditLog {
+	a := &AuditLog{now: time.Now, queue: make(chan auditLine, maxAuditQueue), stopped: make(chan struct{})}
+	go a.write()
+	return a
+}
+
+// UseFile appends events to path, continuing the chain of the events
+// already in it
+func (a *AuditLog) UseFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %v", err)
+	}
+	last, err := lastAuditEvent(path)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.mu.Lock()
+	if last != nil && last.Seq >= a.seq {
+		a.seq, a.prev = last.Seq, last.Hash
+	}
+	a.mu.Unlock()
+	a.sinksMu.Lock()
+	a.sinks = append(a.sinks, &fileAuditSink{f: f})
+	a.sinksMu.Unlock()
+	return nil
+}
+
+// UseSyslog sends events to a syslog server, addressed as udp://host:port,
+// tcp://host:port or unix:///dev/log
+func (a *AuditLog) UseSyslog(addr string) error {
+	sink, err := newSyslogAuditSink(addr)
+	if err != nil {
+		return err
+	}
+	a.sinksMu.Lock()
+	a.sinks = append(a.sinks, sink)
+	a.sinksMu.Unlock()
+	return nil
+}
+
+// UseArchive exports events to objects in batches, one new object per batch
+// under audit/<YYYY-MM-DD>/, written by Run and Flush
+func (a *AuditLog) UseArchive(objects ObjectStore) {
+	sink := &auditArchiveSink{objects: objects, now: a.now}
+	a.sinksMu.Lock()
+	a.sinks = append(a.sinks, sink)
+	a.archive = sink
+	a.sinksMu.Unlock()
+}
+
+// Run exports the pending events to the archive every interval until ctx
+// is cancelled
+func (a *AuditLog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports the pending events to the archive, if any, once the
+// events recorded so far are written
+func (a *AuditLog) Flush(ctx context.Context) {
+	if a == nil || a.archive == nil {
+		return
+	}
+	a.wait()
+	if err := a.archive.Flush(ctx); err != nil {
+		slog.Error("Error archiving audit events", "error", err)
+	}
+}
+
+// Record chains the event to the log and queues it for the sinks
+func (a *AuditLog) Record(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	a.seq++
+	ev.Seq, ev.Time, ev.Prev, ev.Hash = a.seq, a.now().UTC(), a.prev, ""
+	data, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Error encoding audit event", "type", ev.Type, "error", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	ev.Hash = hex.EncodeToString(sum[:])
+	line, _ := json.Marshal(ev)
+	a.prev = ev.Hash
+	auditEvents.Inc(ev.Type)
+	select {
+	case a.queue <- auditLine{line: line, typ: ev.Type}:
+	default:
+		// The chain shows the gap: the next event's prev matches no event
+		auditSinkErrors.Inc("queue")
+		slog.Error("Audit queue full, event dropped", "type", ev.Type, "seq", ev.Seq)
+	}
+}
+
+// write hands the queued events to every sink, in order, until Close
+func (a *AuditLog) write() {
+	defer close(a.stopped)
+	for item := range a.queue {
+		if item.written != nil {
+			close(item.written)
+			continue
+		}
+		a.sinksMu.Lock()
+		for _, sink := range a.sinks {
+			if err := sink.Write(item.line); err != nil {
+				auditSinkErrors.Inc(sink.Name())
+				slog.Error("Error writing audit event", "sink", sink.Name(), "type", item.typ, "error", err)
+			}
+		}
+		a.sinksMu.Unlock()
+	}
+}
+
+// wait returns once the events recorded so far are written
+func (a *AuditLog) wait() {
+	written := make(chan struct{})
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	// The writer never takes mu, so this send can't block it
+	a.queue <- auditLine{written: written}
+	a.mu.Unlock()
+	<-written
+}
+
+// RecordRequest records an event about an HTTP request, with the request ID,
+// tenant and client of its context
+func (a *AuditLog) RecordRequest(r *http.Request, eventType string, status int, details map[string]any) {
+	if a == nil {
+		return
+	}
+	ev := AuditEvent{
+		Type:      eventType,
+		RequestID: requestIDFromContext(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Details:   details,
+	}
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		ev.Client = info.client
+		info.mu.Lock()
+		ev.Tenant = info.tenant
+		info.mu.Unlock()
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ev.Client = host
+	}
+	a.Record(ev)
+}
+
+// Close writes the queued events and closes every sink; Flush the archive
+// first
+func (a *AuditLog) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.stopped
+
+	a.sinksMu.Lock()
+	defer a.sinksMu.Unlock()
+	for _, sink := range a.sinks {
+		if err := sink.Close(); err != nil {
+			slog.Error("Error closing audit sink", "sink", sink.Name(), "error", err)
+		}
+	}
+}
+
+// isAdminPath tells whether a path is an operator endpoint
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/v1/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// Middleware records the requests refused for their key and every request
+// let through to an operator endpoint, reads included: exporting a dataset
+// or the config is as much an action as flushing the cache
+func (a *AuditLog) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		switch {
+		case status == http.StatusUnauthorized:
+			details := map[string]any{}
+			// Which key was tried, without the key: a leaked or stale key
+			// shows up as the same fingerprint again and again
+			if key := presentedKey(r); key != "" {
+				details["key_fingerprint"] = keyFingerprint(key)
+			}
+			if isAdminPath(r.URL.Path) {
+				details["scope"] = "admin"
+			} else {
+				details["scope"] = "api"
+			}
+			a.RecordRequest(r, AuditAuthFailure, status, details)
+		case isAdminPath(r.URL.Path) && status != http.StatusNotFound:
+			var details map[string]any
+			if r.URL.RawQuery != "" {
+				details = map[string]any{"query": r.URL.Query()}
+			}
+			a.RecordRequest(r, AuditAdminAction, status, details)
+		}
+	})
+}
+
+// presentedKey returns the admin key, API key or signing key ID a request
+// authenticates with
+func presentedKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-Admin-Key")); key != "" {
+		return key
+	}
+	if key := apiKeyFromRequest(r); key != "" {
+		return key
+	}
+	return r.Header.Get(signatureKeyHeader)
+}
+
+// keyFingerprint identifies a key in the audit log without revealing it
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// auditReload records the reloads of a watched file, with the hash of the
+// content loaded so the change can be matched to a version of the file
+func (a *AuditLog) auditReload(path string, data []byte, err error) {
+	if a == nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	details := map[string]any{"file": path, "sha256": hex.EncodeToString(sum[:]), "result": "ok"}
+	if err != nil {
+		details["result"], details["error"] = "error", err.Error()
+	}
+	a.Record(AuditEvent{Type: AuditConfigChange, Actor: "config_watcher", Details: details})
+}
+
+// tenantBudget is the part of a tenant the budget overrides are audited on
+type tenantBudget struct {
+	Daily   float64 `json:"daily_budget_usd"`
+	Monthly float64 `json:"monthly_budget_usd"`
+	Action  string  `json:"budget_action,omitempty"`
+}
+
+// auditBudgets records every tenant whose budget differs between two
+// versions of the tenants file, including tenants added or removed
+func (a *AuditLog) auditBudgets(before, after map[string]*Tenant) {
+	if a == nil {
+		return
+	}
+	budget := func(t *Tenant) *tenantBudget {
+		if t == nil {
+			return nil
+		}
+		return &tenantBudget{Daily: t.DailyBudgetUSD, Monthly: t.MonthlyBudgetUSD, Action: t.BudgetAction}
+	}
+	ids := make(map[string]bool)
+	for id := range before {
+		ids[id] = true
+	}
+	for id := range after {
+		ids[id] = true
+	}
+	for id := range ids {
+		old, cur := budget(before[id]), budget(after[id])
+		if old != nil && cur != nil && *old == *cur {
+			continue
+		}
+		a.Record(AuditEvent{
+			Type:    AuditBudgetOverride,
+			Actor:   "config_watcher",
+			Tenant:  id,
+			Details: map[string]any{"before": old, "after": cur},
+		})
+	}
+}
+
+// lastAuditEvent reads the last event of an audit log file, or nil when the
+// file is empty
+func lastAuditEvent(path string) (*AuditEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var ev AuditEvent
+	if err := json.Unmarshal(last, &ev); err != nil {
+		return nil, fmt.Errorf("error parsing the last event of the audit log: %v", err)
+	}
+	return &ev, nil
+}
+
+// fileAuditSink appends events to a local file, synced on every event
+type fileAuditSink struct {
+	f *os.File
+}
+
+func (s *fileAuditSink) Name() string { return "file" }
+
+func (s *fileAuditSink) Write(line []byte) error {
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+// syslogAuditSink sends events as RFC 5424 messages of the authpriv
+// facility, octet-counted over TCP
+type syslogAuditSink struct {
+	network, addr string
+	hostname      string
+	conn          net.Conn
+}
+
+func newSyslogAuditSink(rawURL string) (*syslogAuditSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %v", rawURL, err)
+	}
+	s := &syslogAuditSink{network: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: no host", rawURL)
+		}
+	case "unix", "unixgram":
+		s.network, s.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q (want udp://, tcp:// or unix://)", rawURL)
+	}
+	if s.hostname, err = os.Hostname(); err != nil || s.hostname == "" {
+		s.hostname = "-"
+	}
+	return s, nil
+}
+
+func (s *syslogAuditSink) Name() string { return "syslog" }
+
+// syslogPriority is authpriv (10) at notice (5)
+const syslogPriority = 10*8 + 5
+
+func (s *syslogAuditSink) Write(line []byte) error {
+	msg := fmt.Sprintf("<%d>1 %s %s ai-powered-search %d audit - %s",
+		syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), s.hostname, os.Getpid(), line)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	// One reconnect, for a server restarted since the last event
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+			if err != nil {
+				return fmt.Errorf("error connecting to syslog: %v", err)
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.WriteString(s.conn, msg)
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("error writing to syslog: %v", err)
+		}
+	}
+}
+
+func (s *syslogAuditSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// auditArchiveSink buffers events and writes them to the object store in
+// batches. Each batch is a new object, never overwritten, so the archive is
+// append-only like the file.
+type auditArchiveSink struct {
+	objects ObjectStore
+	now     func() time.Time
+
+	mu      sync.Mutex
+	pending []byte
+	first   uint64
+	last    uint64
+}
+
+func (s *auditArchiveSink) Name() string { return "archive" }
+
+func (s *auditArchiveSink) Write(line []byte) error {
+	var ev struct {
+		Seq uint64 `json:"seq"`
+	}
+	json.Unmarshal(line, &ev)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		s.first = ev.Seq
+	}
+	s.last = ev.Seq
+	s.pending = append(append(s.pending, line...), '\n')
+	return nil
+}
+
+// Flush writes the pending events as one object named after the range of
+// their sequence numbers. Events failing to upload stay pending.
+func (s *auditArchiveSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	data, first, last := s.pending, s.first, s.last
+	s.pending = nil
+	s.mu.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	now := s.now().UTC()
+	key := fmt.Sprintf("%s%s/%s-%020d-%020d.jsonl", auditArchivePrefix, now.Format("2006-01-02"), now.Format("150405.000000000"), first, last)
+	if err := s.objects.Put(ctx, key, data); err != nil {
+		auditSinkErrors.Inc(s.Name())
+		s.mu.Lock()
+		s.pending = append(data, s.pending...)
+		s.first = first
+		s.mu.Unlock()
+		return fmt.Errorf("error archiving audit events: %v", err)
+	}
+	return nil
+}
+
+func (s *auditArchiveSink) Close() error {
+	return nil
+}
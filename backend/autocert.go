@@ -0,0 +1,25 @@
+//go:build autocert
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newAutocert obtains and renews Let's Encrypt certificates for hosts. The
+// returned handler answers HTTP-01 challenges and passes everything else to
+// fallback.
+func newAutocert(hosts []string, cacheDir, email string, fallback http.Handler) (*tls.Config, http.Handler, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	cfg := m.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, m.HTTPHandler(fallback), nil
+}
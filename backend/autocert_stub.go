@@ -0,0 +1,14 @@
+//go:build !autocert
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// newAutocert needs golang.org/x/crypto, which default builds leave out
+func newAutocert(hosts []string, cacheDir, email string, fallback http.Handler) (*tls.Config, http.Handler, error) {
+	return nil, nil, fmt.Errorf("built without autocert support, rebuild with -tags autocert")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters, the usual defaults: k1 is how fast repeated terms stop
+// counting, bm25B how much long passages are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// rrfK damps reciprocal rank fusion so that the first few ranks of one
+// list don't drown the other; 60 is the value of the original paper
+const rrfK = 60
+
+// keywordIndex is an in-memory BM25 full-text index over passages
+type keywordIndex struct {
+	passages []*ChunkMatch
+	lengths  []int
+	avgLen   float64
+	// postings maps a term to the passages it occurs in and how often
+	postings map[string]map[int]int
+}
+
+func newKeywordIndex(passages []*ChunkMatch) *keywordIndex {
+	idx := &keywordIndex{passages: passages, lengths: make([]int, len(passages)), postings: make(map[string]map[int]int)}
+	total := 0
+	for i, p := range passages {
+		terms := keywordTerms(p.Text)
+		idx.lengths[i] = len(terms)
+		total += len(terms)
+		for _, term := range terms {
+			if idx.postings[term] == nil {
+				idx.postings[term] = make(map[int]int)
+			}
+			idx.postings[term][i]++
+		}
+	}
+	if len(passages) > 0 {
+		idx.avgLen = float64(total) / float64(len(passages))
+	}
+	return idx
+}
+
+// Search returns up to limit passages scored by BM25 against the query,
+// best first; passages without any of its terms are left out
+func (idx *keywordIndex) Search(query string, limit int) []*ChunkMatch {
+	scores := make(map[int]float64)
+	seen := make(map[string]bool)
+	n := float64(len(idx.passages))
+	for _, term := range keywordTerms(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for i, tf := range postings {
+			norm := 1 - bm25B + bm25B*float64(idx.lengths[i])/idx.avgLen
+			scores[i] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+	matches := make([]*ChunkMatch, 0, len(scores))
+	for i, score := range scores {
+		match := *idx.passages[i]
+		match.Score = score
+		matches = append(matches, &match)
+	}
+	return nearestMatches(matches, limit)
+}
+
+// keywordTerms splits text into lowercase terms. Identifiers like
+// ERR_CONN_RESET, v1.2.3 or ISO-8601 are kept whole as well as split into
+// their parts, so both the exact identifier and its words are found.
+func keywordTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if word == "" {
+			continue
+		}
+		parts := strings.FieldsFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if len(parts) > 1 {
+			terms = append(terms, word)
+		}
+		terms = append(terms, parts...)
+	}
+	return terms
+}
+
+// fuseRanks merges ranked lists by reciprocal rank fusion: a passage
+// scores the sum of 1/(rrfK+rank) over the lists it is in, which needs no
+// calibration between BM25 scores and cosine similarities
+func fuseRanks(limit int, vector, keyword []*ChunkMatch) []*ChunkMatch {
+	type chunkKey struct {
+		document string
+		chunk    int
+	}
+	fused := make(map[chunkKey]*ChunkMatch)
+	var order []*ChunkMatch
+	add := func(list []*ChunkMatch, setRank func(m *ChunkMatch, rank int)) {
+		for i, m := range list {
+			key := chunkKey{m.DocumentID, m.Chunk}
+			match, ok := fused[key]
+			if !ok {
+				copied := *m
+				copied.Score = 0
+				match = &copied
+				fused[key] = match
+				order = append(order, match)
+			}
+			match.Score += 1 / float64(rrfK+i+1)
+			setRank(match, i+1)
+		}
+	}
+	add(vector, func(m *ChunkMatch, rank int) { m.VectorRank = rank })
+	add(keyword, func(m *ChunkMatch, rank int) { m.KeywordRank = rank })
+	return nearestMatches(order, limit)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Budget actions applied once a spend limit is reached
+const (
+	BudgetActionFallback = "fallback" // answer with the heuristic parser
+	BudgetActionReject   = "reject"   // fail with budget_exceeded
+)
+
+func validateBudgetAction(action string) error {
+	if action != BudgetActionFallback && action != BudgetActionReject {
+		return fmt.Errorf("unknown budget action %q", action)
+	}
+	return nil
+}
+
+// modelPrice is the OpenAI list price in USD per million tokens
+type modelPrice struct {
+	Input  float64
+	Output float64
+}
+
+var modelPricing = map[string]modelPrice{
+	"gpt-3.5-turbo": {Input: 0.50, Output: 1.50},
+	"gpt-4o-mini":   {Input: 0.15, Output: 0.60},
+	"gpt-4o":        {Input: 2.50, Output: 10.00},
+	"gpt-4-turbo":   {Input: 10.00, Output: 30.00},
+
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"text-embedding-ada-002": {Input: 0.10},
+}
+
+var (
+	openAITokens = metricsRegistry.Counter("openai_tokens_total",
+		"Tokens used in OpenAI calls.", "model", "kind")
+	openAICost = metricsRegistry.Counter("openai_cost_usd_total",
+		"Estimated OpenAI spend in USD.", "model")
+)
+
+// fallbackPrice is charged for models missing from the table, erring on the expensive side
+var fallbackPrice = modelPrice{Input: 10.00, Output: 30.00}
+
+// costUSD prices a completion from its token usage
+func costUSD(model string, promptTokens, completionTokens int) float64 {
+	price, ok := modelPricing[model]
+	if !ok {
+		price = fallbackPrice
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6
+}
+
+// BudgetExceededError reports which limit stopped the request
+type BudgetExceededError struct {
+	Scope    string // "global" or "tenant"
+	Period   string // "daily" or "monthly"
+	LimitUSD float64
+	ResetAt  time.Time
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s %s budget of $%.2f exceeded", e.Scope, e.Period, e.LimitUSD)
+}
+
+// SpendStore accumulates spend per key. Keys embed the day or month, so old
+// counters only need to live until their period is over.
+type SpendStore interface {
+	Add(ctx context.Context, key string, usd float64, ttl time.Duration) error
+	Get(ctx context.Context, key string) (float64, error)
+}
+
+// BudgetTracker enforces daily and monthly spend limits globally and per tenant
+type BudgetTracker struct {
+	store         SpendStore
+	globalDaily   float64
+	globalMonthly float64
+	defaultAction string
+	now           func() time.Time
+}
+
+func NewBudgetTracker(store SpendStore, globalDaily, globalMonthly float64, defaultAction string) *BudgetTracker {
+	return &BudgetTracker{
+		store:         store,
+		globalDaily:   globalDaily,
+		globalMonthly: globalMonthly,
+		defaultAction: defaultAction,
+		now:           time.Now,
+	}
+}
+
+// Action returns what to do for the tenant once over budget
+func (b *BudgetTracker) Action(t *Tenant) string {
+	if t != nil && t.BudgetAction != "" {
+		return t.BudgetAction
+	}
+	return b.defaultAction
+}
+
+// Check returns a *BudgetExceededError if any limit covering the tenant is used up
+func (b *BudgetTracker) Check(ctx context.Context, t *Tenant) error {
+	now := b.now().UTC()
+	day, month := periodKeys(now)
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	monthEnd := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	type limit struct {
+		scope, period, key string
+		usd                float64
+		reset              time.Time
+	}
+	limits := []limit{
+		{"global", "daily", "global:" + day, b.globalDaily, dayEnd},
+		{"global", "monthly", "global:" + month, b.globalMonthly, monthEnd},
+	}
+	if t != nil {
+		limits = append(limits,
+			limit{"tenant", "daily", "tenant:" + t.ID + ":" + day, t.DailyBudgetUSD, dayEnd},
+			limit{"tenant", "monthly", "tenant:" + t.ID + ":" + month, t.MonthlyBudgetUSD, monthEnd},
+		)
+	}
+
+	for _, l := range limits {
+		if l.usd <= 0 {
+			continue
+		}
+		spent, err := b.store.Get(ctx, l.key)
+		if err != nil {
+			// Don't block traffic on a broken store, but make it visible
+			slog.ErrorContext(ctx, "Error reading spend", "key", l.key, "error", err)
+			continue
+		}
+		if spent >= l.usd {
+			return &BudgetExceededError{Scope: l.scope, Period: l.period, LimitUSD: l.usd, ResetAt: l.reset}
+		}
+	}
+	return nil
+}
+
+// Remaining returns the smallest headroom left under the global limits, or
+// +Inf when no global limit is configured
+func (b *BudgetTracker) Remaining(ctx context.Context) float64 {
+	day, month := periodKeys(b.now().UTC())
+	remaining := math.Inf(1)
+	for key, limit := range map[string]float64{"global:" + day: b.globalDaily, "global:" + month: b.globalMonthly} {
+		if limit <= 0 {
+			continue
+		}
+		spent, err := b.store.Get(ctx, key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading spend", "key", key, "error", err)
+			return 0
+		}
+		remaining = math.Min(remaining, math.Max(0, limit-spent))
+	}
+	return remaining
+}
+
+// Record adds the cost of a call to the global and tenant counters
+func (b *BudgetTracker) Record(ctx context.Context, t *Tenant, usd float64) {
+	if usd <= 0 {
+		return
+	}
+	day, month := periodKeys(b.now().UTC())
+	keys := map[string]time.Duration{
+		"global:" + day:   48 * time.Hour,
+		"global:" + month: 32 * 24 * time.Hour,
+	}
+	if t != nil {
+		keys["tenant:"+t.ID+":"+day] = 48 * time.Hour
+		keys["tenant:"+t.ID+":"+month] = 32 * 24 * time.Hour
+	}
+	for key, ttl := range keys {
+		if err := b.store.Add(ctx, key, usd, ttl); err != nil {
+			slog.ErrorContext(ctx, "Error recording spend", "key", key, "error", err)
+		}
+	}
+}
+
+func periodKeys(t time.Time) (day, month string) {
+	return "day:" + t.Format("2006-01-02"), "month:" + t.Format("2006-01")
+}
+
+// memorySpendStore keeps counters in process memory
+type memorySpendStore struct {
+	mu      sync.Mutex
+	spend   map[string]float64
+	expires map[string]time.Time
+}
+
+func NewMemorySpendStore() *memorySpendStore {
+	return &memorySpendStore{
+		spend:   make(map[string]float64),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (s *memorySpendStore) Add(ctx context.Context, key string, usd float64, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, exp := range s.expires {
+		if now.After(exp) {
+			delete(s.spend, k)
+			delete(s.expires, k)
+		}
+	}
+	s.spend[key] += usd
+	if _, ok := s.expires[key]; !ok {
+		s.expires[key] = now.Add(ttl)
+	}
+	return nil
+}
+
+func (s *memorySpendStore) Get(ctx context.Context, key string) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spend[key], nil
+}
+
+// redisSpendStore shares counters across replicas
+type redisSpendStore struct {
+	client *RedisClient
+	prefix string
+}
+
+func NewRedisSpendStore(client *RedisClient) *redisSpendStore {
+	return &redisSpendStore{client: client, prefix: "spend:"}
+}
+
+func (s *redisSpendStore) Add(ctx context.Context, key string, usd float64, ttl time.Duration) error {
+	if _, err := s.client.Do(ctx, "INCRBYFLOAT", s.prefix+key, strconv.FormatFloat(usd, 'f', -1, 64)); err != nil {
+		return err
+	}
+	_, err := s.client.Do(ctx, "EXPIRE", s.prefix+key, strconv.Itoa(int(ttl.Seconds())), "NX")
+	return err
+}
+
+func (s *redisSpendStore) Get(ctx context.Context, key string) (float64, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected redis reply type %T", reply)
+	}
+	return strconv.ParseFloat(v, 64)
+}
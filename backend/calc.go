@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Instant answers computed by the server
+const (
+	InstantCalculation = "calculation"
+	InstantConversion  = "conversion"
+)
+
+// CalculationAnswer is the result of an arithmetic or unit conversion prompt
+type CalculationAnswer struct {
+	// Expression is what was computed, as read from the prompt
+	Expression string  `json:"expression"`
+	Value      float64 `json:"value"`
+	// Unit is the unit of the value of conversions
+	Unit string `json:"unit,omitempty"`
+	// Text is the answer to show, e.g. 230 lb = 104.326 kg
+	Text string `json:"text"`
+}
+
+var (
+	// calcPrefixRe and calcSuffixRe are the words around an expression
+	calcPrefixRe = regexp.MustCompile(`(?i)^\s*(?:what(?:'s| is)|how much is|calculate|compute|evaluate|solve|calc)\s+`)
+	calcSuffixRe = regexp.MustCompile(`\s*[=?]+\s*$`)
+	// calcCharsRe is what an expression is made of; anything else is a
+	// question for the search
+	calcCharsRe = regexp.MustCompile(`^[0-9a-z.,+\-*/^()%×÷ ]+$`)
+	// calcTimesRe is an x between two numbers, meaning times
+	calcTimesRe = regexp.MustCompile(`(\d|\))\s*x\s*(\d|\()`)
+	// calcThousandsRe is a thousands separator
+	calcThousandsRe = regexp.MustCompile(`(\d),(\d{3})\b`)
+	calcPercentOfRe = regexp.MustCompile(`%\s*of\b`)
+	// calcDateRe is a date or a range of years, not a subtraction or division
+	calcDateRe = regexp.MustCompile(`^\d{1,4}[-/.]\d{1,2}[-/.]\d{1,4}$|^\d{4}\s*-\s*\d{2,4}$`)
+	// calcNamePairRe is a bare hyphenated pair of numbers, more often a name
+	// (7-11, 24-7) or a score than a subtraction; "what is 7-11" or "7 - 11"
+	// still are
+	calcNamePairRe = regexp.MustCompile(`^\d+-\d+$`)
+
+	// conversionRe is "230 lbs in kg" and conversionQuestionRe "how many
+	// ounces in a pound"
+	conversionRe         = regexp.MustCompile(`(?i)^\s*(?:convert\s+)?(-?[\d.,]+|an?|one)\s*([a-z°][a-z0-9°²³/ ]*?)\s+(?:in|to|into|as)\s+([a-z°][a-z0-9°²³/ ]*?)\s*[?=]?\s*$`)
+	conversionQuestionRe = regexp.MustCompile(`(?i)^\s*how many ([a-z°][a-z0-9°²³/ ]*?)\s+(?:are\s+)?in\s+(-?[\d.,]+|an?|one)\s*([a-z°][a-z0-9°²³/ ]*?)\s*\??\s*$`)
+)
+
+// calcFunctions are the functions expressions may call, trigonometry in
+// radians
+var calcFunctions = map[string]func(float64) float64{
+	"sqrt": math.Sqrt, "abs": math.Abs, "ln": math.Log, "log": math.Log10, "exp": math.Exp,
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"round": math.Round, "floor": math.Floor, "ceil": math.Ceil,
+}
+
+var calcConstants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// routeToCalculator answers an arithmetic or unit conversion prompt,
+// telling whether it did. Like the other instant answers nothing is
+// analyzed, and it costs nothing either.
+func (h *SearchHandler) routeToCalculator(w http.ResponseWriter, r *http.Request, prompt string) bool {
+	kind, answer := InstantConversion, convertUnits(prompt)
+	if answer == nil {
+		kind, answer = InstantCalculation, calculate(prompt)
+	}
+	if answer == nil || !h.flags.Enabled(r.Context(), FlagCalculator, true) {
+		return false
+	}
+	instantAnswers.Inc(kind, "answered")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source":     "instant",
+		"type":       kind,
+		kind:         answer,
+		"search_url": constructSearchQuery(&SearchIntent{MainQuery: strings.TrimSpace(prompt)}),
+		"trace_id":   spanFromContext(r.Context()).TraceID(),
+	})
+	return true
+}
+
+// calculate evaluates a prompt that is an arithmetic expression, e.g.
+// "15% of 89" or "what is (3+4)*2^3", or returns nil. A lone number isn't a
+// calculation.
+func calculate(prompt string) *CalculationAnswer {
+	if calcNamePairRe.MatchString(strings.TrimSpace(calcSuffixRe.ReplaceAllString(prompt, ""))) {
+		return nil
+	}
+	expr := calcSuffixRe.ReplaceAllString(calcPrefixRe.ReplaceAllString(prompt, ""), "")
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if expr == "" || len(expr) > 200 || !calcCharsRe.MatchString(expr) || calcDateRe.MatchString(expr) {
+		return nil
+	}
+	normalized := calcThousandsRe.ReplaceAllString(expr, "$1$2")
+	normalized = calcTimesRe.ReplaceAllString(normalized, "$1*$2")
+	normalized = calcPercentOfRe.ReplaceAllString(normalized, "%*")
+	normalized = strings.NewReplacer("×", "*", "÷", "/", "**", "^").Replace(normalized)
+	p := &calcParser{input: normalized}
+	value, _, err := p.expr()
+	if err != nil || p.skipSpace() < len(p.input) || p.ops == 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &CalculationAnswer{Expression: expr, Value: value, Text: expr + " = " + formatCalcNumber(value)}
+}
+
+// calcParser evaluates expressions by recursive descent: + and - bind
+// loosest, then * and /, unary signs, ^ (right to left) and a postfix %
+type calcParser struct {
+	input string
+	pos   int
+	// ops counts the operators and functions applied
+	ops int
+}
+
+func (p *calcParser) skipSpace() int {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	return p.pos
+}
+
+// peek returns the next non-space byte, 0 at the end
+func (p *calcParser) peek() byte {
+	if p.skipSpace() < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// expr returns the value and whether it is a bare percentage, which adding
+// or subtracting applies to the left side: 80 + 15% is 92
+func (p *calcParser) expr() (float64, bool, error) {
+	left, percent, err := p.term()
+	if err != nil {
+		return 0, false, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, percent, nil
+		}
+		p.pos++
+		p.ops++
+		right, rightPercent, err := p.term()
+		if err != nil {
+			return 0, false, err
+		}
+		switch {
+		case rightPercent && op == '+':
+			left *= 1 + right
+		case rightPercent:
+			left *= 1 - right
+		case op == '+':
+			left += right
+		default:
+			left -= right
+		}
+		percent = false
+	}
+}
+
+func (p *calcParser) term() (float64, bool, error) {
+	left, percent, err := p.unary()
+	if err != nil {
+		return 0, false, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, percent, nil
+		}
+		p.pos++
+		p.ops++
+		right, _, err := p.unary()
+		if err != nil {
+			return 0, false, err
+		}
+		if op == '*' {
+			left *= right
+		} else if right == 0 {
+			return 0, false, fmt.Errorf("division by zero")
+		} else {
+			left /= right
+		}
+		percent = false
+	}
+}
+
+func (p *calcParser) unary() (float64, bool, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, percent, err := p.unary()
+		return -v, percent, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (float64, bool, error) {
+	base, percent, err := p.postfix()
+	if err != nil {
+		return 0, false, err
+	}
+	if p.peek() != '^' {
+		return base, percent, nil
+	}
+	p.pos++
+	p.ops++
+	exponent, _, err := p.unary()
+	if err != nil {
+		return 0, false, err
+	}
+	return math.Pow(base, exponent), false, nil
+}
+
+func (p *calcParser) postfix() (float64, bool, error) {
+	v, err := p.primary()
+	if err != nil {
+		return 0, false, err
+	}
+	if p.peek() == '%' {
+		p.pos++
+		p.ops++
+		return v / 100, true, nil
+	}
+	return v, false, nil
+}
+
+func (p *calcParser) primary() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		v, _, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		return strconv.ParseFloat(p.input[start:p.pos], 64)
+	case c >= 'a' && c <= 'z':
+		start := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] >= 'a' && p.input[p.pos] <= 'z' {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if v, ok := calcConstants[name]; ok {
+			return v, nil
+		}
+		f, ok := calcFunctions[name]
+		if !ok || p.peek() != '(' {
+			return 0, fmt.Errorf("unknown name %q", name)
+		}
+		arg, err := p.primary()
+		if err != nil {
+			return 0, err
+		}
+		p.ops++
+		return f(arg), nil
+	}
+	return 0, fmt.Errorf("unexpected %q", c)
+}
+
+// unitDef is a unit of a dimension, factor times the dimension's base unit
+type unitDef struct {
+	symbol    string
+	dimension string
+	factor    float64
+}
+
+// units maps the names of units to their definition; temperatures are
+// converted by convertTemperature instead of a factor
+var units = map[string]unitDef{}
+
+func init() {
+	define := func(symbol, dimension string, factor float64, names ...string) {
+		u := unitDef{symbol: symbol, dimension: dimension, factor: factor}
+		units[symbol] = u
+		for _, name := range names {
+			units[name] = u
+		}
+	}
+	define("mm", "length", 0.001, "millimeter", "millimetre")
+	define("cm", "length", 0.01, "centimeter", "centimetre")
+	define("m", "length", 1, "meter", "metre")
+	define("km", "length", 1000, "kilometer", "kilometre")
+	define("in", "length", 0.0254, "inch", "inches")
+	define("ft", "length", 0.3048, "foot", "feet")
+	define("yd", "length", 0.9144, "yard")
+	define("mi", "length", 1609.344, "mile")
+	define("nmi", "length", 1852, "nautical mile")
+
+	define("mg", "mass", 1e-6, "milligram", "milligramme")
+	define("g", "mass", 0.001, "gram", "gramme")
+	define("kg", "mass", 1, "kilo", "kilogram", "kilogramme")
+	define("t", "mass", 1000, "tonne", "metric ton")
+	define("oz", "mass", 0.028349523125, "ounce")
+	define("lb", "mass", 0.45359237, "lbs", "pound")
+	define("st", "mass", 6.35029318, "stone")
+
+	define("ml", "volume", 0.001, "milliliter", "millilitre")
+	define("cl", "volume", 0.01, "centiliter", "centilitre")
+	define("l", "volume", 1, "liter", "litre")
+	define("m³", "volume", 1000, "m3", "cubic meter", "cubic metre")
+	define("gal", "volume", 3.785411784, "gallon")
+	define("qt", "volume", 0.946352946, "quart")
+	define("pt", "volume", 0.473176473, "pint")
+	define("cup", "volume", 0.2365882365)
+	define("fl oz", "volume", 0.0295735295625, "fluid ounce")
+	define("tbsp", "volume", 0.01478676478125, "tablespoon")
+	define("tsp", "volume", 0.00492892159375, "teaspoon")
+
+	define("m²", "area", 1, "m2", "sq m", "square meter", "square metre")
+	define("km²", "area", 1e6, "km2", "sq km", "square kilometer", "square kilometre")
+	define("ft²", "area", 0.09290304, "ft2", "sq ft", "square foot", "square feet")
+	define("mi²", "area", 2589988.110336, "mi2", "sq mi", "square mile")
+	define("ac", "area", 4046.8564224, "acre")
+	define("ha", "area", 10000, "hectare")
+
+	define("m/s", "speed", 1, "meters per second", "metres per second")
+	define("km/h", "speed", 1000.0/3600, "kph", "kmh", "kilometers per hour", "kilometres per hour")
+	define("mph", "speed", 0.44704, "miles per hour")
+	define("kn", "speed", 1852.0/3600, "knot", "kt")
+
+	define("ms", "time", 0.001, "millisecond")
+	define("s", "time", 1, "sec", "second")
+	define("min", "time", 60, "minute")
+	define("h", "time", 3600, "hr", "hour")
+	define("d", "time", 86400, "day")
+	define("wk", "time", 604800, "week")
+	define("yr", "time", 31557600, "year")
+
+	define("bit", "data", 0.125)
+	define("B", "data", 1, "byte")
+	define("KB", "data", 1e3, "kb", "kilobyte")
+	define("MB", "data", 1e6, "mb", "megabyte")
+	define("GB", "data", 1e9, "gb", "gigabyte")
+	define("TB", "data", 1e12, "tb", "terabyte")
+	define("KiB", "data", 1<<10, "kib", "kibibyte")
+	define("MiB", "data", 1<<20, "mib", "mebibyte")
+	define("GiB", "data", 1<<30, "gib", "gibibyte")
+	define("TiB", "data", 1<<40, "tib", "tebibyte")
+
+	define("°C", "temperature", 0, "c", "°c", "celsius", "degree celsius", "degrees celsius", "centigrade")
+	define("°F", "temperature", 0, "f", "°f", "fahrenheit", "degree fahrenheit", "degrees fahrenheit")
+	define("K", "temperature", 0, "k", "kelvin")
+}
+
+// lookupUnit finds a unit by name, ignoring case and plurals
+func lookupUnit(name string) (unitDef, bool) {
+	name = strings.Join(strings.Fields(name), " ")
+	for _, candidate := range []string{name, strings.ToLower(name)} {
+		if u, ok := units[candidate]; ok {
+			return u, true
+		}
+		for _, plural := range []string{"s", "es"} {
+			if u, ok := units[strings.TrimSuffix(candidate, plural)]; ok && strings.HasSuffix(candidate, plural) {
+				return u, true
+			}
+		}
+	}
+	return unitDef{}, false
+}
+
+// convertUnits answers a unit conversion prompt, e.g. "230 lbs in kg" or
+// "how many ounces in a pound", or returns nil
+func convertUnits(prompt string) *CalculationAnswer {
+	var amount, fromName, toName string
+	if m := conversionRe.FindStringSubmatch(prompt); m != nil {
+		amount, fromName, toName = m[1], m[2], m[3]
+	} else if m := conversionQuestionRe.FindStringSubmatch(prompt); m != nil {
+		amount, fromName, toName = m[2], m[3], m[1]
+	} else {
+		return nil
+	}
+	from, ok := lookupUnit(fromName)
+	if !ok {
+		return nil
+	}
+	to, ok := lookupUnit(toName)
+	if !ok || to.dimension != from.dimension {
+		return nil
+	}
+	var value float64
+	switch strings.ToLower(amount) {
+	case "a", "an", "one":
+		value = 1
+	default:
+		var err error
+		if value, err = strconv.ParseFloat(strings.ReplaceAll(amount, ",", ""), 64); err != nil {
+			return nil
+		}
+	}
+	converted := value * from.factor / to.factor
+	if from.dimension == "temperature" {
+		converted = convertTemperature(value, from.symbol, to.symbol)
+	}
+	expression := fmt.Sprintf("%s %s in %s", formatCalcNumber(value), strings.TrimSpace(fromName), strings.TrimSpace(toName))
+	return &CalculationAnswer{
+		Expression: expression,
+		Value:      converted,
+		Unit:       to.symbol,
+		Text:       fmt.Sprintf("%s %s = %s %s", formatCalcNumber(value), from.symbol, formatCalcNumber(converted), to.symbol),
+	}
+}
+
+// convertTemperature converts between °C, °F and K
+func convertTemperature(v float64, from, to string) float64 {
+	celsius := v
+	switch from {
+	case "°F":
+		celsius = (v - 32) * 5 / 9
+	case "K":
+		celsius = v - 273.15
+	}
+	switch to {
+	case "°F":
+		return celsius*9/5 + 32
+	case "K":
+		return celsius + 273.15
+	}
+	return celsius
+}
+
+// formatCalcNumber writes a number with up to 6 significant digits,
+// without an exponent unless it is very large or small
+func formatCalcNumber(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if a := math.Abs(v); a >= 1e15 || a < 1e-4 {
+		return strconv.FormatFloat(v, 'g', 6, 64)
+	}
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 6, 64), 64)
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
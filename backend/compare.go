@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var engineComparisons = metricsRegistry.Counter("engine_comparisons_total",
+	"Calls of /v1/compare, by result (ok, invalid, error).", "result")
+
+// EngineResults is what one engine answered in a comparison
+type EngineResults struct {
+	Results []SearchResult `json:"results"`
+	Cache   string         `json:"results_cache,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// RankDelta is a result both engines of a pair returned, with its 1-based
+// rank in each; Delta is the second rank minus the first
+type RankDelta struct {
+	URL   string `json:"url"`
+	Ranks [2]int `json:"ranks"`
+	Delta int    `json:"delta"`
+}
+
+// EnginePair compares the results of two engines
+type EnginePair struct {
+	Engines [2]string `json:"engines"`
+	Shared  int       `json:"shared"`
+	// Jaccard is the shared results over all the results of the pair
+	Jaccard    float64     `json:"jaccard"`
+	RankDeltas []RankDelta `json:"rank_deltas"`
+}
+
+// handleCompare runs one intent on several engines of the results provider
+// and diffs their answers (POST): {"prompt": "...", "engines": ["google",
+// "bing"]}, or an "intent" in either schema version instead of the prompt
+// to skip the analysis. Engines default to all of them.
+func (h *SearchHandler) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.results == nil || !h.flags.Enabled(r.Context(), FlagResults, true) || !h.flags.Enabled(r.Context(), FlagCompare, true) {
+		http.Error(w, "Engine comparison is disabled", http.StatusNotFound)
+		return
+	}
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Prompt string          `json:"prompt"`
+		Intent json.RawMessage `json:"intent"`
+		AnalyzeOptions
+		Engines []string `json:"engines"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		engineComparisons.Inc("invalid")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	engines, err := comparedEngines(req.Engines)
+	if err != nil {
+		engineComparisons.Inc("invalid")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.policy.Validate(req.AnalyzeOptions); err != nil {
+		engineComparisons.Inc("invalid")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var intent *SearchIntent
+	switch {
+	case len(req.Intent) > 0 && string(req.Intent) != "null":
+		decoded, err := decodeIntentJSON(req.Intent)
+		if err != nil || strings.TrimSpace(decoded.MainQuery) == "" {
+			engineComparisons.Inc("invalid")
+			http.Error(w, "intent must be an intent with a main_query", http.StatusBadRequest)
+			return
+		}
+		intent = cleanIntent(decoded)
+		tenant := tenantFromContext(ctx)
+		intent.ExcludeSites = tenant.ExcludedSites(intent)
+		if tenant != nil {
+			tenant.Prompt.enforce(intent)
+		}
+	case strings.TrimSpace(req.Prompt) != "":
+		result, err := h.analyze(ctx, req.Prompt, req.AnalyzeOptions)
+		if err != nil {
+			engineComparisons.Inc("error")
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		intent = result.Intent
+	default:
+		engineComparisons.Inc("invalid")
+		http.Error(w, "prompt or intent is required", http.StatusBadRequest)
+		return
+	}
+
+	query := buildQueryString(intent)
+	answers := make(map[string]*EngineResults, len(engines))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, engine := range engines {
+		wg.Add(1)
+		go func(engine string) {
+			defer wg.Done()
+			results, served, err := h.results.Search(ctx, ResultsQuery{Query: query, Engine: engine, Locale: req.Locale})
+			answer := &EngineResults{Results: []SearchResult{}}
+			if err != nil {
+				slog.WarnContext(ctx, "Error fetching results", "engine", engine, "error", err)
+				answer.Error = "results provider unavailable"
+			} else {
+				answer.Results = filterResults(tenantFromContext(ctx), intent, results)
+				answer.Cache = served
+			}
+			mu.Lock()
+			answers[engine] = answer
+			mu.Unlock()
+		}(engine)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, answer := range answers {
+		if answer.Error != "" {
+			failed++
+		}
+	}
+	if failed == len(engines) {
+		engineComparisons.Inc("error")
+		http.Error(w, "Results provider unavailable", http.StatusBadGateway)
+		return
+	}
+	engineComparisons.Inc("ok")
+	common, unique, pairs := compareResults(engines, answers)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"query":   query,
+		"intent":  renderIntent(intent, version),
+		"engines": answers,
+		"common":  common,
+		"unique":  unique,
+		"pairs":   pairs,
+	})
+}
+
+// comparedEngines checks the engines of a comparison, all of them when
+// none are named
+func comparedEngines(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return engineNames(), nil
+	}
+	var engines []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := searchEngines[name]; !ok {
+			return nil, fmt.Errorf("unknown engine %q, expected some of %v", name, engineNames())
+		}
+		if !seen[name] {
+			seen[name] = true
+			engines = append(engines, name)
+		}
+	}
+	if len(engines) < 2 {
+		return nil, fmt.Errorf("engines must name at least 2 engines")
+	}
+	return engines, nil
+}
+
+// compareResults diffs the answers of the engines that didn't fail: the
+// results all of them returned, the ones only one did, and each pair's
+// overlap and rank deltas. Results are matched by URL, ignoring the scheme,
+// a www. prefix, a trailing slash and the fragment; the URLs listed are as
+// the first engine returning them wrote them.
+func compareResults(engines []string, answers map[string]*EngineResults) ([]string, map[string][]string, []EnginePair) {
+	// ranks maps each result to its 1-based rank by engine
+	ranks := make(map[string]map[string]int)
+	urls := make(map[string]string)
+	var keys []string
+	var answered []string
+	for _, engine := range engines {
+		answer := answers[engine]
+		if answer.Error != "" {
+			continue
+		}
+		answered = append(answered, engine)
+		for i, result := range answer.Results {
+			key := compareKey(result.URL)
+			if _, ok := ranks[key]; !ok {
+				ranks[key] = make(map[string]int)
+				urls[key] = result.URL
+				keys = append(keys, key)
+			}
+			if _, ok := ranks[key][engine]; !ok {
+				ranks[key][engine] = i + 1
+			}
+		}
+	}
+
+	common := []string{}
+	unique := make(map[string][]string, len(answered))
+	for _, engine := range answered {
+		unique[engine] = []string{}
+	}
+	if len(answered) > 1 {
+		for _, key := range keys {
+			switch len(ranks[key]) {
+			case len(answered):
+				common = append(common, urls[key])
+			case 1:
+				for engine := range ranks[key] {
+					unique[engine] = append(unique[engine], urls[key])
+				}
+			}
+		}
+	}
+
+	pairs := []EnginePair{}
+	for i, a := range answered {
+		for _, b := range answered[i+1:] {
+			pair := EnginePair{Engines: [2]string{a, b}, RankDeltas: []RankDelta{}}
+			union := 0
+			for _, key := range keys {
+				ra, inA := ranks[key][a]
+				rb, inB := ranks[key][b]
+				if inA || inB {
+					union++
+				}
+				if inA && inB {
+					pair.Shared++
+					pair.RankDeltas = append(pair.RankDeltas, RankDelta{URL: urls[key], Ranks: [2]int{ra, rb}, Delta: rb - ra})
+				}
+			}
+			if union > 0 {
+				pair.Jaccard = float64(pair.Shared) / float64(union)
+			}
+			sort.SliceStable(pair.RankDeltas, func(i, j int) bool { return pair.RankDeltas[i].Ranks[0] < pair.RankDeltas[j].Ranks[0] })
+			pairs = append(pairs, pair)
+		}
+	}
+	return common, unique, pairs
+}
+
+// compareKey is the form of a result URL that engines returning the same
+// page agree on
+func compareKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	key := resultHost(rawURL) + path
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
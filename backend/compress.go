@@ -0,0 +1,230 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var compressedResponses = metricsRegistry.Counter("http_compressed_responses_total",
+	"Responses sent compressed, by encoding (gzip, deflate).", "encoding")
+
+// compressor is what gzip and zlib writers have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return zw
+	}},
+	// HTTP's "deflate" is the zlib format, not raw deflate
+	"deflate": {New: func() any {
+		zw, _ := zlib.NewWriterLevel(nil, zlib.DefaultCompression)
+		return zw
+	}},
+}
+
+// incompressibleTypes are already compressed, a second pass only costs CPU
+var incompressibleTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+	"video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/octet-stream",
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// gzip winning ties, or "" when neither is acceptable
+func negotiateEncoding(header string) string {
+	weights := make(map[string]float64)
+	wildcard := 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else if name != "" {
+			weights[name] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// withCompression compresses responses of at least minSize bytes with the
+// encoding the client accepts. Flushes go through, so streamed exports
+// reach the client batch by batch rather than once the stream ends.
+func withCompression(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		next.ServeHTTP(cw, r)
+		// Not deferred: after a panic the stream must stay unterminated, so a
+		// cut export can't pass for a complete one
+		cw.close()
+	})
+}
+
+// compressWriter holds the start of a response back until it knows whether
+// compressing it is worth it: the response is big enough, has a body and
+// isn't compressed already
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	zw      compressor
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	if status < 200 {
+		// Informational responses go out as they are
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.started {
+		if w.zw != nil {
+			return w.zw.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < w.minSize {
+		return len(b), nil
+	}
+	if err := w.start(w.compressible()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// FlushError sends what was written so far. A response flushed before it
+// reached minSize is compressed anyway: it is a stream and will grow.
+func (w *compressWriter) FlushError() error {
+	if !w.started {
+		if err := w.start(w.compressible()); err != nil {
+			return err
+		}
+	}
+	if w.zw != nil {
+		if err := w.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compressible tells whether the response should be compressed
+func (w *compressWriter) compressible() bool {
+	if w.status == http.StatusNoContent || w.status == http.StatusPartialContent || (w.status >= 300 && w.status < 400) {
+		// No body, a byte range of the uncompressed body, or a redirect
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		// Sniff now, net/http would sniff the compressed bytes
+		contentType = http.DetectContentType(w.buf)
+		h.Set("Content-Type", contentType)
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// start sends the header and what was held back, compressed or not
+func (w *compressWriter) start(compress bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if compress {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.zw = compressorPools[w.encoding].Get().(compressor)
+		w.zw.Reset(w.ResponseWriter)
+		compressedResponses.Inc(w.encoding)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.zw != nil {
+		_, err = w.zw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends a response that stayed under minSize as is, or ends the
+// compressed stream
+func (w *compressWriter) close() {
+	if !w.started {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Nothing was written, leave the response to net/http
+			return
+		}
+		w.start(false)
+		return
+	}
+	if w.zw != nil {
+		w.zw.Close()
+		compressorPools[w.encoding].Put(w.zw)
+		w.zw = nil
+	}
+}
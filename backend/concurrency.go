@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUpstreamBusy is returned when no upstream slot frees up within the queue limits
+var ErrUpstreamBusy = errors.New("upstream capacity exhausted, try again shortly")
+
+var (
+	upstreamInFlight = metricsRegistry.Gauge("upstream_in_flight",
+		"OpenAI calls holding an upstream slot.")
+	upstreamQueueDepth = metricsRegistry.Gauge("upstream_queue_depth",
+		"Calls waiting for an upstream slot.")
+	upstreamQueueWait = metricsRegistry.Histogram("upstream_queue_wait_seconds",
+		"Time calls waited for an upstream slot, by result (granted, timeout).",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30}, "result")
+	upstreamLoadShed = metricsRegistry.Counter("upstream_load_shed_total",
+		"Calls turned away up front because the upstream is saturated, by reason (queue_full, wait_estimate).", "reason")
+)
+
+// UpstreamOverloadedError is returned when a call is shed on arrival rather
+// than queued to time out: the queue is full, or the wait it would face is
+// longer than the limiter lets calls wait. It is an ErrUpstreamBusy.
+type UpstreamOverloadedError struct {
+	// RetryAfter is when a slot is expected to be free for it
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamOverloadedError) Error() string {
+	return fmt.Sprintf("upstream overloaded, retry in %s", e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *UpstreamOverloadedError) Is(target error) bool {
+	return target == ErrUpstreamBusy
+}
+
+// holdSmoothing weighs the latest slot hold time in the moving average the
+// expected waits are estimated from
+const holdSmoothing = 0.2
+
+// UpstreamLimiter bounds the number of simultaneous OpenAI calls. Callers over
+// the limit wait in a bounded queue for at most maxWait before giving up.
+//
+// Waiting requests are queued per tenant and freed slots are handed out by
+// weighted fair queuing: each tenant advances a virtual clock by 1/weight for
+// every slot it receives, and the tenant with the earliest virtual clock goes
+// next. A noisy tenant therefore only delays itself once others are waiting.
+//
+// With load shedding, a call that would wait longer than maxWait, estimated
+// from how long calls hold their slot, or that finds the queue full is
+// refused at once with an UpstreamOverloadedError.
+type UpstreamLimiter struct {
+	maxConcurrent int
+	maxQueue      int
+	maxWait       time.Duration
+	shedLoad      bool
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  int
+	queues   map[string]*tenantQueue
+	vclock   float64 // virtual time of the last grant
+	avgHold  float64 // moving average of slot hold times, in seconds
+}
+
+type tenantQueue struct {
+	weight  float64
+	vtime   float64
+	waiters *list.List // of *upstreamWaiter
+}
+
+type upstreamWaiter struct {
+	ready chan struct{}
+}
+
+func NewUpstreamLimiter(maxConcurrent, maxQueue int, maxWait time.Duration, shedLoad bool) *UpstreamLimiter {
+	return &UpstreamLimiter{
+		maxConcurrent: maxConcurrent,
+		maxQueue:      maxQueue,
+		maxWait:       maxWait,
+		shedLoad:      shedLoad,
+		queues:        make(map[string]*tenantQueue),
+	}
+}
+
+// Acquire blocks until a slot is available and returns the function releasing it.
+// The tenant attached to ctx decides the caller's place in the queue.
+func (l *UpstreamLimiter) Acquire(ctx context.Context) (func(), error) {
+	tenantID, weight := DefaultTenantID, 1.0
+	if t := tenantFromContext(ctx); t != nil {
+		tenantID, weight = t.ID, t.Weight
+	}
+
+	l.mu.Lock()
+	// Fast path, no queueing
+	if l.inFlight < l.maxConcurrent && l.waiting == 0 {
+		l.inFlight++
+		l.reportLocked()
+		l.mu.Unlock()
+		upstreamQueueWait.Observe(0, "granted")
+		return l.releaser(), nil
+	}
+	if l.waiting >= l.maxQueue {
+		wait := l.expectedWaitLocked()
+		l.mu.Unlock()
+		if l.shedLoad {
+			upstreamLoadShed.Inc("queue_full")
+			return nil, &UpstreamOverloadedError{RetryAfter: wait}
+		}
+		return nil, ErrUpstreamBusy
+	}
+	if wait := l.expectedWaitLocked(); l.shedLoad && wait > l.maxWait {
+		l.mu.Unlock()
+		upstreamLoadShed.Inc("wait_estimate")
+		return nil, &UpstreamOverloadedError{RetryAfter: wait}
+	}
+
+	q, ok := l.queues[tenantID]
+	if !ok {
+		q = &tenantQueue{waiters: list.New()}
+		l.queues[tenantID] = q
+	}
+	q.weight = weight
+	if q.waiters.Len() == 0 && q.vtime < l.vclock {
+		// A tenant returning from idle doesn't get credit for the time it was away
+		q.vtime = l.vclock
+	}
+	waiter := &upstreamWaiter{ready: make(chan struct{})}
+	elem := q.waiters.PushBack(waiter)
+	l.waiting++
+	l.reportLocked()
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-waiter.ready:
+		upstreamQueueWait.Observe(time.Since(start).Seconds(), "granted")
+		return l.releaser(), nil
+	case <-timer.C:
+		upstreamQueueWait.Observe(time.Since(start).Seconds(), "timeout")
+		err = ErrUpstreamBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.ready:
+		// Granted while we were giving up; pass the slot on
+		l.releaseLocked()
+	default:
+		q.waiters.Remove(elem)
+		l.waiting--
+		l.reportLocked()
+	}
+	return nil, err
+}
+
+// TryAcquire takes a slot only if one is free and nobody is queued for it,
+// for optional work that must never delay interactive requests
+func (l *UpstreamLimiter) TryAcquire() (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= l.maxConcurrent || l.waiting > 0 {
+		return nil, false
+	}
+	l.inFlight++
+	l.reportLocked()
+	return l.releaser(), true
+}
+
+// releaser returns the function releasing a slot taken now, which times
+// how long the slot was held
+func (l *UpstreamLimiter) releaser() func() {
+	start := time.Now()
+	return func() {
+		held := time.Since(start).Seconds()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.avgHold == 0 {
+			l.avgHold = held
+		} else {
+			l.avgHold += holdSmoothing * (held - l.avgHold)
+		}
+		l.releaseLocked()
+	}
+}
+
+// expectedWaitLocked estimates how long a call queued now waits for a slot:
+// every caller ahead of it, and itself, waits for one of the slots to turn
+// over. It is zero until a slot has been released.
+func (l *UpstreamLimiter) expectedWaitLocked() time.Duration {
+	seconds := float64(l.waiting+1) * l.avgHold / float64(l.maxConcurrent)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (l *UpstreamLimiter) reportLocked() {
+	upstreamInFlight.Set(float64(l.inFlight))
+	upstreamQueueDepth.Set(float64(l.waiting))
+}
+
+// releaseLocked hands the freed slot to the next waiter by virtual time, or
+// returns it to the pool when nobody is waiting
+func (l *UpstreamLimiter) releaseLocked() {
+	var next *tenantQueue
+	for _, q := range l.queues {
+		if q.waiters.Len() == 0 {
+			continue
+		}
+		if next == nil || q.vtime < next.vtime {
+			next = q
+		}
+	}
+	if next == nil {
+		l.inFlight--
+		l.reportLocked()
+		return
+	}
+
+	waiter := next.waiters.Remove(next.waiters.Front()).(*upstreamWaiter)
+	l.waiting--
+	l.reportLocked()
+	l.vclock = next.vtime
+	next.vtime += 1 / next.weight
+	close(waiter.ready)
+}
+
+// Load reports the calls in flight and the callers waiting for a slot
+func (l *UpstreamLimiter) Load() (inFlight, waiting int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight, l.waiting
+}
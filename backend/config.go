@@ -0,0 +1,1151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings read from the environment
+type Config struct {
+	Port string
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish on
+	// SIGTERM; ShutdownDelay keeps serving while readiness reports draining
+	ShutdownTimeout time.Duration
+	ShutdownDelay   time.Duration
+
+	// HTTPS is served from TLSCertFile/TLSKeyFile, or with certificates from
+	// Let's Encrypt for TLSAutocertHosts; plain HTTP is served otherwise.
+	// HTTPRedirectPort optionally redirects HTTP to HTTPS (and answers ACME
+	// challenges with autocert).
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSAutocertHosts    []string
+	TLSAutocertCacheDir string
+	TLSAutocertEmail    string
+	HTTPRedirectPort    string
+	// TLSClientCAFile makes HTTPS clients authenticate with a certificate
+	// signed by one of its CAs; TLSClientAuth "require" refuses clients
+	// without one, "optional" lets them use an API key
+	TLSClientCAFile string
+	TLSClientAuth   string
+
+	// PublicURL is where clients reach the server, e.g.
+	// https://search.example.com, for links it hands out
+	PublicURL string
+
+	// ServeFrontend serves the React app on the API's origin, from
+	// FrontendDir or, when that is empty, from the binary (-tags embedui).
+	// CORSAllowedOrigins lists the other origins browsers may call from,
+	// "*" for any, the default without the frontend.
+	ServeFrontend      bool
+	FrontendDir        string
+	CORSAllowedOrigins []string
+
+	// LogFormat is text or json; LogLevel is debug, info, warn or error
+	LogFormat string
+	LogLevel  string
+	// LogPrivacy is off, truncate or hash; tenants can override it
+	LogPrivacy string
+
+	// TenantsFile is an optional JSON file mapping API keys to tenants
+	TenantsFile string
+	// PromptFile optionally replaces the general analysis system prompt
+	PromptFile string
+	// PromptVersion selects the prompt templates, from PromptDir/<version>
+	// or the built-in ones when PromptDir is empty
+	PromptVersion string
+	PromptDir     string
+	// PIIMode is off, redact or confirm: what happens to emails, phone,
+	// card and social security numbers and street addresses in prompts
+	// before they go to OpenAI; tenants can override it
+	PIIMode string
+	// PromptGuard is off, strip or refuse: what to do with prompts that try
+	// to override the analyzer's instructions
+	PromptGuard string
+	// SynonymsFile optionally holds the synonyms of abbreviations and
+	// codenames, applied as SynonymExpansion says: or or prompt
+	SynonymsFile     string
+	SynonymExpansion string
+	// FlagsFile keeps the feature flags set through the admin API; they are
+	// lost on restart when empty
+	FlagsFile string
+	// ExperimentsFile keeps the experiments set through the admin API; they
+	// are lost on restart when empty
+	ExperimentsFile string
+	// SearchEngine is where search URLs point: google, bing or duckduckgo
+	SearchEngine string
+	// VerticalPrompts selects dedicated prompts for code, academic and
+	// shopping searches
+	VerticalPrompts bool
+	// ConfigWatchInterval is how often TenantsFile, PromptFile and FlagsFile are checked
+	// for changes, zero disables reloading
+	ConfigWatchInterval time.Duration
+
+	// HistoryFingerprintSecret keys the fingerprints of encrypted history
+	HistoryFingerprintSecret string
+	// HistoryStore keeps search history in "memory", "sqlite" (single node,
+	// HistoryDSN is the file) or "postgres" (HistoryDSN is a connection URL)
+	HistoryStore string
+	HistoryDSN   string
+
+	// Saved searches are kept in SavedSearchesFile (in memory only when
+	// empty); email alerts go through the SMTP relay at SMTPAddr
+	SavedSearchesFile string
+	SMTPAddr          string
+	SMTPFrom          string
+	SMTPUsername      string
+	SMTPPassword      string
+
+	// AdminAPIKey protects the /v1/admin endpoints; they are disabled when empty
+	AdminAPIKey string
+	// DebugAddr is the listener for pprof and runtime stats, also behind the
+	// admin key; empty disables it
+	DebugAddr string
+
+	// Tenant API keys issued through the admin API are saved to APIKeysFile
+	// (in memory only when empty). Lifecycle events are posted to
+	// APIKeyWebhookURL, with a warning APIKeyExpiryWarning before a key
+	// expires; rotated keys keep working for APIKeyRotationGrace.
+	APIKeysFile         string
+	APIKeyWebhookURL    string
+	APIKeyExpiryWarning time.Duration
+	APIKeyRotationGrace time.Duration
+
+	// Requests signed with a tenant's signing key are accepted within
+	// RequestSigningMaxSkew of the server's clock, their nonces remembered
+	// in RequestSigningReplayStore ("memory" or "redis")
+	RequestSigningMaxSkew     time.Duration
+	RequestSigningReplayStore string
+
+	// TrustProxyHeaders makes the client IP come from X-Forwarded-For / X-Real-IP
+	// of requests from TrustedProxies, by default the private networks
+	TrustProxyHeaders bool
+	TrustedProxies    []netip.Prefix
+
+	RateLimitEnabled bool
+	RateLimitRPS     float64
+	RateLimitBurst   int
+	RateLimitStore   string // "memory" or "redis"
+	RedisURL         string
+
+	// IPDenylist refuses clients by IP; with an IPAllowlist only the
+	// addresses in it are served
+	IPAllowlist []netip.Prefix
+	IPDenylist  []netip.Prefix
+	// AbuseDetection strikes clients making more than AbuseBurst requests,
+	// or sending the same prompt more than AbuseDuplicatePrompts times,
+	// within AbuseWindow; struck clients are slowed down and AbuseBanAfter
+	// strikes ban them for AbuseBanDuration, doubled with every ban
+	AbuseDetection        bool
+	AbuseWindow           time.Duration
+	AbuseBurst            int
+	AbuseDuplicatePrompts int
+	AbuseBanAfter         int
+	AbuseBanDuration      time.Duration
+
+	UpstreamMaxConcurrency int
+	UpstreamMaxQueue       int
+	UpstreamQueueTimeout   time.Duration
+	// UpstreamLoadShedding answers 429 at once to calls that would wait
+	// longer than UpstreamQueueTimeout or find the queue full
+	UpstreamLoadShedding bool
+
+	// LLMProvider answers the analyses: "openai", or "mock" to answer them
+	// locally from the rules in LLMMockRules and the heuristic parser
+	LLMProvider  string
+	LLMMockRules string
+	// LLMVCRMode records the OpenAI calls into fixtures in LLMVCRDir
+	// ("record") or answers them from there without the network ("replay")
+	LLMVCRMode string
+	LLMVCRDir  string
+
+	// OutboundProxy overrides HTTPS_PROXY for OpenAI and search provider calls;
+	// http(s):// and socks5(h):// URLs are accepted
+	OutboundProxy string
+
+	// Outbound HTTP client tuning; OutboundTimeout bounds a whole call
+	OutboundConnectTimeout      time.Duration
+	OutboundTLSTimeout          time.Duration
+	OutboundTimeout             time.Duration
+	OutboundKeepAlive           time.Duration
+	OutboundMaxIdleConnsPerHost int
+	OutboundIdleConnTimeout     time.Duration
+
+	// RequestTimeout is the deadline of every incoming request, zero disables it
+	RequestTimeout time.Duration
+
+	// HedgeDelay starts a second OpenAI request when the first hasn't answered
+	// in time, zero disables hedging
+	HedgeDelay time.Duration
+
+	// OpenAIKeys are load-balanced; keys answering 401/429 are quarantined
+	OpenAIKeys []string
+
+	// IntentVersion is the SearchIntent schema served when the client doesn't ask
+	IntentVersion int
+
+	// OpenAIModel is used for every analysis unless the model router is enabled
+	OpenAIModel          string
+	ModelRouterEnabled   bool
+	CheapModel           string
+	CapableModel         string
+	ModelRouterThreshold int
+	// AllowedModels may be requested per call; defaults to the models above
+	AllowedModels  []string
+	MaxTemperature float64
+	// OpenAIMaxTokens caps each completion, zero leaves it to the model
+	OpenAIMaxTokens int
+
+	// FewShotExamples is how many of the tenant's corrected prompts, picked by
+	// EmbeddingModel similarity of at least FewShotMinSimilarity, go with each
+	// analysis; zero disables few-shot. Corrections are reloaded every
+	// FewShotRefresh.
+	FewShotExamples      int
+	FewShotMinSimilarity float64
+	FewShotRefresh       time.Duration
+	EmbeddingModel       string
+
+	// Personalization re-ranks the results of signed-in users by the domains
+	// they clicked and skipped in the last PersonalizationWindow, reloaded
+	// from the click feedback every PersonalizationRefresh
+	Personalization        bool
+	PersonalizationWindow  time.Duration
+	PersonalizationRefresh time.Duration
+
+	// InstantAnswers answers weather prompts from Open-Meteo and stock
+	// prompts from Stooq without an analysis, caching the answers for
+	// InstantAnswersTTL
+	InstantAnswers    bool
+	InstantAnswersTTL time.Duration
+
+	// AnalysisDedup has replicas analyzing the same prompt at the same time
+	// share one OpenAI call through Redis (RedisURL), waiting up to
+	// AnalysisDedupWait for the replica making it
+	AnalysisDedup     bool
+	AnalysisDedupWait time.Duration
+
+	// VoiceSearch accepts voice queries on /v1/search/audio, transcribed with
+	// WhisperModel by OpenAI, or by the server at WhisperURL (its
+	// transcriptions endpoint) when set. Recordings are limited to
+	// AudioMaxBytes.
+	VoiceSearch   bool
+	WhisperURL    string
+	WhisperModel  string
+	AudioMaxBytes int64
+
+	// ImageSearch accepts image queries on /v1/search/image, turned into a
+	// prompt by VisionModel. Images are limited to ImageMaxBytes.
+	ImageSearch   bool
+	VisionModel   string
+	ImageMaxBytes int64
+	// OCREngine reads the text in images to add it to the intent's exact
+	// phrases: OCREngineVision uses the text read by VisionModel,
+	// OCREngineTesseract runs TesseractPath with TesseractLangs, at most
+	// TesseractMaxConcurrency at a time
+	OCREngine               string
+	TesseractPath           string
+	TesseractLangs          string
+	TesseractMaxConcurrency int
+
+	// Documents lets users upload documents (PDF, text, Markdown or Word, up
+	// to DocumentMaxBytes) on /v1/documents, embedded with EmbeddingModel,
+	// and routes prompts like "search my docs for ..." to them
+	Documents        bool
+	DocumentMaxBytes int64
+	// VectorStore keeps the documents: "memory", "sql" (the history
+	// database, with sqlite-vec or pgvector) or "qdrant" (the
+	// QdrantCollection collection of the server at QdrantURL)
+	VectorStore      string
+	QdrantURL        string
+	QdrantAPIKey     string
+	QdrantCollection string
+	// Crawl sources are kept in CrawlSourcesFile (in memory only when
+	// empty); crawls fetch at most CrawlMaxPages pages per source, one every
+	// CrawlDelay at least, as CrawlUserAgent
+	CrawlSourcesFile string
+	CrawlMaxPages    int
+	CrawlDelay       time.Duration
+	CrawlUserAgent   string
+
+	// ShadowModel and ShadowPromptVersion make a candidate that SHADOW_SAMPLE_RATE
+	// of the analyses are repeated with in the background, at most
+	// ShadowMaxConcurrency at a time, to compare with production. Both empty
+	// disables shadowing.
+	ShadowModel          string
+	ShadowPromptVersion  string
+	ShadowSampleRate     float64
+	ShadowMaxConcurrency int
+	// EvalCorpusFile replaces the built-in golden set of /v1/admin/eval
+	EvalCorpusFile string
+
+	// ResultsProvider ("serpapi") fetches result pages when a search asks for
+	// them. Answers are shared by all tenants in ResultsCacheStore ("memory" or
+	// "redis"), fresh for ResultsCacheTTL and served stale for
+	// ResultsCacheStale more while they are refreshed.
+	ResultsProvider   string
+	SerpAPIKey        string
+	ResultsCacheStore string
+	ResultsCacheSize  int
+	ResultsCacheTTL   time.Duration
+	ResultsCacheStale time.Duration
+
+	// IntentCacheSize analyses are kept for IntentCacheTTL, zero disables the cache
+	IntentCacheSize int
+	IntentCacheTTL  time.Duration
+
+	// Background jobs run inside BatchWindows (in BatchTimezone) or when traffic is low
+	BatchWindows      []TimeWindow
+	BatchTimezone     *time.Location
+	SchedulerInterval time.Duration
+
+	// History older than HistoryArchiveAfterDays moves to cold storage
+	// (ArchiveStore "file" or "s3"); zero keeps everything in the primary store
+	HistoryArchiveAfterDays int
+	ArchiveInterval         time.Duration
+	ArchiveStore            string
+	ArchiveDir              string
+	ArchiveS3Endpoint       string
+	ArchiveS3Bucket         string
+	ArchiveS3Region         string
+	ArchiveS3AccessKey      string
+	ArchiveS3SecretKey      string
+
+	// Auth failures, admin actions, config reloads and budget changes go to
+	// the audit log: appended to AuditLogFile, sent to AuditSyslogAddr and,
+	// with AuditArchive, exported to the archive store every
+	// AuditArchiveInterval. Without any of them nothing is audited.
+	AuditLogFile         string
+	AuditSyslogAddr      string
+	AuditArchive         bool
+	AuditArchiveInterval time.Duration
+
+	// History older than HistoryRetentionDays and dead letters and analytics
+	// samples older than LogRetentionDays are deleted every RetentionInterval,
+	// archives included; zero keeps them forever
+	HistoryRetentionDays int
+	LogRetentionDays     int
+	RetentionInterval    time.Duration
+
+	// Product analytics only samples tenants that opted in, and only when enabled
+	AnalyticsEnabled    bool
+	AnalyticsSampleRate float64
+	AnalyticsMaxSamples int
+	// UsageAnalytics aggregates every analysis by tenant and hour for the
+	// usage analytics API, kept for UsageAnalyticsRetention
+	UsageAnalytics          bool
+	UsageAnalyticsRetention time.Duration
+	// UsageAnalyticsPrivacy is what is kept of the queries (raw, hashed or
+	// k_anonymous: their text once UsageAnalyticsK users searched them),
+	// hashed with UsageAnalyticsHashKey, random per process when empty
+	UsageAnalyticsPrivacy string
+	UsageAnalyticsK       int
+	UsageAnalyticsHashKey string
+
+	// Traces are exported over OTLP/HTTP when OTLPTracesEndpoint is set
+	OTLPTracesEndpoint string
+	OTLPHeaders        map[string]string
+	ServiceName        string
+	TraceSampleRatio   float64
+
+	// Responses of at least CompressionMinSize bytes are compressed for
+	// clients that accept it
+	CompressionEnabled bool
+	CompressionMinSize int
+
+	// TelemetryFlushInterval is how often tenant telemetry sinks receive events
+	TelemetryFlushInterval time.Duration
+
+	// Global spend limits in USD, zero means unlimited
+	BudgetDailyUSD   float64
+	BudgetMonthlyUSD float64
+	BudgetAction     string // "fallback" or "reject"
+	BudgetStore      string // "memory" or "redis"
+}
+
+// LoadConfig reads the configuration from environment variables, applying defaults
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		Port:        envString("PORT", "8080"),
+		TLSCertFile: envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:  envString("TLS_KEY_FILE", ""),
+
+		TLSAutocertCacheDir: envString("TLS_AUTOCERT_CACHE_DIR", "autocert-cache"),
+		TLSAutocertEmail:    envString("TLS_AUTOCERT_EMAIL", ""),
+		TLSClientCAFile:     envString("TLS_CLIENT_CA_FILE", ""),
+		TLSClientAuth:       envString("TLS_CLIENT_AUTH", ClientAuthRequire),
+		HTTPRedirectPort:    envString("HTTP_REDIRECT_PORT", ""),
+		FrontendDir:         envString("FRONTEND_DIR", ""),
+		PublicURL:           envString("PUBLIC_URL", ""),
+
+		LogFormat:   envString("LOG_FORMAT", "text"),
+		LogLevel:    envString("LOG_LEVEL", "info"),
+		LogPrivacy:  envString("LOG_PRIVACY", LogPrivacyOff),
+		TenantsFile: envString("TENANTS_FILE", ""),
+		PromptFile:  envString("PROMPT_FILE", ""),
+
+		PromptVersion: envString("PROMPT_VERSION", DefaultPromptVersion),
+		PromptDir:     envString("PROMPT_DIR", ""),
+		PromptGuard:   envString("PROMPT_GUARD", PromptGuardLog),
+		PIIMode:       envString("PII_MODE", PIIRedact),
+
+		SynonymsFile:     envString("SYNONYMS_FILE", ""),
+		SynonymExpansion: envString("SYNONYM_EXPANSION", SynonymsOR),
+
+		SearchEngine:    envString("SEARCH_ENGINE", "google"),
+		FlagsFile:       envString("FLAGS_FILE", ""),
+		ExperimentsFile: envString("EXPERIMENTS_FILE", ""),
+
+		VerticalPrompts: true,
+
+		ConfigWatchInterval: 5 * time.Second,
+		ShutdownTimeout:     30 * time.Second,
+
+		ResultsProvider:   envString("RESULTS_PROVIDER", ""),
+		SerpAPIKey:        envString("SERPAPI_KEY", ""),
+		ResultsCacheStore: envString("RESULTS_CACHE_STORE", "memory"),
+		ResultsCacheSize:  10000,
+		ResultsCacheTTL:   time.Hour,
+		ResultsCacheStale: 24 * time.Hour,
+
+		IntentCacheSize: 10000,
+		IntentCacheTTL:  24 * time.Hour,
+
+		HistoryFingerprintSecret: envString("HISTORY_FINGERPRINT_SECRET", ""),
+		HistoryStore:             envString("HISTORY_STORE", HistoryStoreMemory),
+		HistoryDSN:               envString("HISTORY_DSN", ""),
+		SavedSearchesFile:        envString("SAVED_SEARCHES_FILE", ""),
+		SMTPAddr:                 envString("SMTP_ADDR", ""),
+		SMTPFrom:                 envString("SMTP_FROM", ""),
+		SMTPUsername:             envString("SMTP_USERNAME", ""),
+		SMTPPassword:             envString("SMTP_PASSWORD", ""),
+		AdminAPIKey:              envString("ADMIN_API_KEY", ""),
+		DebugAddr:                envString("DEBUG_ADDR", ""),
+
+		APIKeysFile:         envString("API_KEYS_FILE", ""),
+		APIKeyWebhookURL:    envString("API_KEY_WEBHOOK_URL", ""),
+		APIKeyExpiryWarning: 7 * 24 * time.Hour,
+		APIKeyRotationGrace: 24 * time.Hour,
+
+		RequestSigningMaxSkew:     5 * time.Minute,
+		RequestSigningReplayStore: envString("REQUEST_SIGNING_REPLAY_STORE", "memory"),
+
+		TrustProxyHeaders: false,
+		RateLimitEnabled:  true,
+		RateLimitRPS:      1,
+		RateLimitBurst:    10,
+		RateLimitStore:    envString("RATE_LIMIT_STORE", "memory"),
+		RedisURL:          envString("REDIS_URL", "redis://localhost:6379/0"),
+
+		UpstreamMaxConcurrency: 8,
+		UpstreamMaxQueue:       64,
+		UpstreamQueueTimeout:   10 * time.Second,
+		UpstreamLoadShedding:   true,
+
+		OutboundProxy:               envString("OUTBOUND_PROXY", ""),
+		LLMProvider:                 envString("LLM_PROVIDER", LLMProviderOpenAI),
+		LLMMockRules:                envString("LLM_MOCK_RULES", ""),
+		LLMVCRMode:                  envString("LLM_VCR_MODE", ""),
+		LLMVCRDir:                   envString("LLM_VCR_DIR", "testdata/llm"),
+		OutboundConnectTimeout:      5 * time.Second,
+		OutboundTLSTimeout:          5 * time.Second,
+		OutboundTimeout:             60 * time.Second,
+		OutboundKeepAlive:           30 * time.Second,
+		OutboundMaxIdleConnsPerHost: 16,
+		OutboundIdleConnTimeout:     90 * time.Second,
+		RequestTimeout:              30 * time.Second,
+
+		IntentVersion: IntentV1,
+
+		OpenAIModel:          envString("OPENAI_MODEL", "gpt-3.5-turbo"),
+		ModelRouterEnabled:   false,
+		CheapModel:           envString("MODEL_CHEAP", "gpt-4o-mini"),
+		CapableModel:         envString("MODEL_CAPABLE", "gpt-4o"),
+		ModelRouterThreshold: 3,
+		MaxTemperature:       1,
+
+		FewShotMinSimilarity: 0.75,
+		FewShotRefresh:       5 * time.Minute,
+		EmbeddingModel:       envString("EMBEDDING_MODEL", "text-embedding-3-small"),
+
+		PersonalizationWindow:  90 * 24 * time.Hour,
+		PersonalizationRefresh: 5 * time.Minute,
+		InstantAnswersTTL:      10 * time.Minute,
+		AnalysisDedupWait:      5 * time.Second,
+
+		VoiceSearch:  true,
+		WhisperURL:   envString("WHISPER_URL", ""),
+		WhisperModel: envString("WHISPER_MODEL", "whisper-1"),
+		// OpenAI's limit
+		AudioMaxBytes: 25 << 20,
+
+		ImageSearch: true,
+		VisionModel: envString("VISION_MODEL", "gpt-4o-mini"),
+		// OpenAI's limit
+		ImageMaxBytes:           20 << 20,
+		OCREngine:               envString("OCR_ENGINE", OCREngineVision),
+		TesseractPath:           envString("TESSERACT_PATH", "tesseract"),
+		TesseractLangs:          envString("TESSERACT_LANGS", "eng"),
+		TesseractMaxConcurrency: 2,
+
+		DocumentMaxBytes: 10 << 20,
+		VectorStore:      envString("VECTOR_STORE", VectorStoreMemory),
+		QdrantURL:        envString("QDRANT_URL", "http://localhost:6333"),
+		QdrantAPIKey:     envString("QDRANT_API_KEY", ""),
+		QdrantCollection: envString("QDRANT_COLLECTION", "documents"),
+		CrawlSourcesFile: envString("CRAWL_SOURCES_FILE", ""),
+		CrawlMaxPages:    1000,
+		CrawlDelay:       time.Second,
+		CrawlUserAgent:   envString("CRAWL_USER_AGENT", "ai-powered-search-crawler/1.0"),
+
+		ShadowModel:          envString("SHADOW_MODEL", ""),
+		ShadowPromptVersion:  envString("SHADOW_PROMPT_VERSION", ""),
+		ShadowSampleRate:     0.1,
+		ShadowMaxConcurrency: 4,
+		EvalCorpusFile:       envString("EVAL_CORPUS_FILE", ""),
+
+		SchedulerInterval: 30 * time.Second,
+
+		TelemetryFlushInterval: 10 * time.Second,
+
+		CompressionEnabled: true,
+		CompressionMinSize: 1024,
+
+		AnalyticsSampleRate:     0.1,
+		AnalyticsMaxSamples:     10000,
+		UsageAnalyticsRetention: 30 * 24 * time.Hour,
+		UsageAnalyticsPrivacy:   envString("USAGE_ANALYTICS_PRIVACY", QueryPrivacyKAnonymous),
+		UsageAnalyticsK:         5,
+		UsageAnalyticsHashKey:   envString("USAGE_ANALYTICS_HASH_KEY", ""),
+
+		OTLPTracesEndpoint: envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""),
+		OTLPHeaders:        parseOTLPHeaders(envString("OTEL_EXPORTER_OTLP_HEADERS", "")),
+		ServiceName:        envString("OTEL_SERVICE_NAME", "ai-powered-search"),
+		TraceSampleRatio:   1,
+
+		ArchiveInterval:    24 * time.Hour,
+		RetentionInterval:  time.Hour,
+		ArchiveStore:       envString("ARCHIVE_STORE", "file"),
+		ArchiveDir:         envString("ARCHIVE_DIR", "archive"),
+		ArchiveS3Endpoint:  envString("ARCHIVE_S3_ENDPOINT", "https://s3.amazonaws.com"),
+		ArchiveS3Bucket:    envString("ARCHIVE_S3_BUCKET", ""),
+		ArchiveS3Region:    envString("ARCHIVE_S3_REGION", "us-east-1"),
+		ArchiveS3AccessKey: envString("ARCHIVE_S3_ACCESS_KEY", ""),
+		ArchiveS3SecretKey: envString("ARCHIVE_S3_SECRET_KEY", ""),
+
+		AuditLogFile:         envString("AUDIT_LOG_FILE", ""),
+		AuditSyslogAddr:      envString("AUDIT_SYSLOG_ADDR", ""),
+		AuditArchiveInterval: 5 * time.Minute,
+
+		BudgetAction: envString("BUDGET_ACTION", BudgetActionFallback),
+		BudgetStore:  envString("BUDGET_STORE", "memory"),
+
+		AbuseWindow:           time.Minute,
+		AbuseBurst:            120,
+		AbuseDuplicatePrompts: 20,
+		AbuseBanAfter:         3,
+		AbuseBanDuration:      15 * time.Minute,
+	}
+
+	var err error
+	if cfg.TrustProxyHeaders, err = envBool("TRUST_PROXY_HEADERS", cfg.TrustProxyHeaders); err != nil {
+		return nil, err
+	}
+	if cfg.TrustedProxies, err = parseIPPrefixes(envString("TRUSTED_PROXIES", "")); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %v", err)
+	}
+	switch {
+	case !cfg.TrustProxyHeaders:
+		cfg.TrustedProxies = nil
+	case len(cfg.TrustedProxies) == 0:
+		cfg.TrustedProxies, _ = parseIPPrefixes("127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7")
+	}
+	if cfg.ServeFrontend, err = envBool("SERVE_FRONTEND", cfg.ServeFrontend); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitEnabled, err = envBool("RATE_LIMIT_ENABLED", cfg.RateLimitEnabled); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitRPS, err = envFloat("RATE_LIMIT_RPS", cfg.RateLimitRPS); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitBurst, err = envInt("RATE_LIMIT_BURST", cfg.RateLimitBurst); err != nil {
+		return nil, err
+	}
+	if cfg.IPAllowlist, err = parseIPPrefixes(envString("IP_ALLOWLIST", "")); err != nil {
+		return nil, fmt.Errorf("IP_ALLOWLIST: %v", err)
+	}
+	if cfg.IPDenylist, err = parseIPPrefixes(envString("IP_DENYLIST", "")); err != nil {
+		return nil, fmt.Errorf("IP_DENYLIST: %v", err)
+	}
+	if cfg.AbuseDetection, err = envBool("ABUSE_DETECTION_ENABLED", cfg.AbuseDetection); err != nil {
+		return nil, err
+	}
+	if cfg.AbuseWindow, err = envDuration("ABUSE_WINDOW", cfg.AbuseWindow); err != nil {
+		return nil, err
+	}
+	if cfg.AbuseBurst, err = envInt("ABUSE_BURST", cfg.AbuseBurst); err != nil {
+		return nil, err
+	}
+	if cfg.AbuseDuplicatePrompts, err = envInt("ABUSE_DUPLICATE_PROMPTS", cfg.AbuseDuplicatePrompts); err != nil {
+		return nil, err
+	}
+	if cfg.AbuseBanAfter, err = envInt("ABUSE_BAN_AFTER", cfg.AbuseBanAfter); err != nil {
+		return nil, err
+	}
+	if cfg.AbuseBanDuration, err = envDuration("ABUSE_BAN_DURATION", cfg.AbuseBanDuration); err != nil {
+		return nil, err
+	}
+
+	if cfg.UpstreamMaxConcurrency, err = envInt("UPSTREAM_MAX_CONCURRENCY", cfg.UpstreamMaxConcurrency); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamMaxQueue, err = envInt("UPSTREAM_MAX_QUEUE", cfg.UpstreamMaxQueue); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamQueueTimeout, err = envDuration("UPSTREAM_QUEUE_TIMEOUT", cfg.UpstreamQueueTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamLoadShedding, err = envBool("UPSTREAM_LOAD_SHEDDING", cfg.UpstreamLoadShedding); err != nil {
+		return nil, err
+	}
+
+	if cfg.ModelRouterEnabled, err = envBool("MODEL_ROUTER_ENABLED", cfg.ModelRouterEnabled); err != nil {
+		return nil, err
+	}
+	if cfg.ModelRouterThreshold, err = envInt("MODEL_ROUTER_THRESHOLD", cfg.ModelRouterThreshold); err != nil {
+		return nil, err
+	}
+	if cfg.ResultsCacheSize, err = envInt("RESULTS_CACHE_SIZE", cfg.ResultsCacheSize); err != nil {
+		return nil, err
+	}
+	if cfg.IntentCacheSize, err = envInt("INTENT_CACHE_SIZE", cfg.IntentCacheSize); err != nil {
+		return nil, err
+	}
+	if cfg.VerticalPrompts, err = envBool("VERTICAL_PROMPTS", cfg.VerticalPrompts); err != nil {
+		return nil, err
+	}
+	if cfg.OpenAIMaxTokens, err = envInt("OPENAI_MAX_TOKENS", cfg.OpenAIMaxTokens); err != nil {
+		return nil, err
+	}
+	if cfg.OpenAIMaxTokens < 0 {
+		return nil, fmt.Errorf("OPENAI_MAX_TOKENS must not be negative")
+	}
+	if cfg.FewShotExamples, err = envInt("FEW_SHOT_EXAMPLES", cfg.FewShotExamples); err != nil {
+		return nil, err
+	}
+	if cfg.FewShotExamples < 0 || cfg.FewShotExamples > 10 {
+		return nil, fmt.Errorf("FEW_SHOT_EXAMPLES must be between 0 and 10")
+	}
+	if cfg.FewShotMinSimilarity, err = envFloat("FEW_SHOT_MIN_SIMILARITY", cfg.FewShotMinSimilarity); err != nil {
+		return nil, err
+	}
+	if cfg.FewShotMinSimilarity < -1 || cfg.FewShotMinSimilarity > 1 {
+		return nil, fmt.Errorf("FEW_SHOT_MIN_SIMILARITY must be between -1 and 1")
+	}
+	if cfg.FewShotRefresh, err = envDuration("FEW_SHOT_REFRESH", cfg.FewShotRefresh); err != nil {
+		return nil, err
+	}
+	if cfg.FewShotRefresh <= 0 {
+		return nil, fmt.Errorf("FEW_SHOT_REFRESH must be positive")
+	}
+	if cfg.Personalization, err = envBool("PERSONALIZATION_ENABLED", cfg.Personalization); err != nil {
+		return nil, err
+	}
+	if cfg.PersonalizationWindow, err = envDuration("PERSONALIZATION_WINDOW", cfg.PersonalizationWindow); err != nil {
+		return nil, err
+	}
+	if cfg.PersonalizationWindow <= 0 {
+		return nil, fmt.Errorf("PERSONALIZATION_WINDOW must be positive")
+	}
+	if cfg.PersonalizationRefresh, err = envDuration("PERSONALIZATION_REFRESH", cfg.PersonalizationRefresh); err != nil {
+		return nil, err
+	}
+	if cfg.PersonalizationRefresh <= 0 {
+		return nil, fmt.Errorf("PERSONALIZATION_REFRESH must be positive")
+	}
+	if cfg.InstantAnswers, err = envBool("INSTANT_ANSWERS_ENABLED", cfg.InstantAnswers); err != nil {
+		return nil, err
+	}
+	if cfg.InstantAnswersTTL, err = envDuration("INSTANT_ANSWERS_TTL", cfg.InstantAnswersTTL); err != nil {
+		return nil, err
+	}
+	if cfg.InstantAnswersTTL <= 0 {
+		return nil, fmt.Errorf("INSTANT_ANSWERS_TTL must be positive")
+	}
+	if cfg.AnalysisDedup, err = envBool("ANALYSIS_DEDUP_ENABLED", cfg.AnalysisDedup); err != nil {
+		return nil, err
+	}
+	if cfg.AnalysisDedupWait, err = envDuration("ANALYSIS_DEDUP_WAIT", cfg.AnalysisDedupWait); err != nil {
+		return nil, err
+	}
+	if cfg.AnalysisDedupWait <= 0 {
+		return nil, fmt.Errorf("ANALYSIS_DEDUP_WAIT must be positive")
+	}
+	if cfg.VoiceSearch, err = envBool("VOICE_SEARCH_ENABLED", cfg.VoiceSearch); err != nil {
+		return nil, err
+	}
+	audioMaxBytes, err := envInt("AUDIO_MAX_BYTES", int(cfg.AudioMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AudioMaxBytes = int64(audioMaxBytes); cfg.AudioMaxBytes <= 0 {
+		return nil, fmt.Errorf("AUDIO_MAX_BYTES must be positive")
+	}
+	if cfg.ImageSearch, err = envBool("IMAGE_SEARCH_ENABLED", cfg.ImageSearch); err != nil {
+		return nil, err
+	}
+	imageMaxBytes, err := envInt("IMAGE_MAX_BYTES", int(cfg.ImageMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ImageMaxBytes = int64(imageMaxBytes); cfg.ImageMaxBytes <= 0 {
+		return nil, fmt.Errorf("IMAGE_MAX_BYTES must be positive")
+	}
+	if cfg.Documents, err = envBool("DOCUMENTS_ENABLED", cfg.Documents); err != nil {
+		return nil, err
+	}
+	documentMaxBytes, err := envInt("DOCUMENT_MAX_BYTES", int(cfg.DocumentMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DocumentMaxBytes = int64(documentMaxBytes); cfg.DocumentMaxBytes <= 0 {
+		return nil, fmt.Errorf("DOCUMENT_MAX_BYTES must be positive")
+	}
+	switch cfg.VectorStore {
+	case VectorStoreMemory:
+	case VectorStoreSQL:
+		if cfg.HistoryStore == HistoryStoreMemory {
+			return nil, fmt.Errorf("VECTOR_STORE=sql needs HISTORY_STORE=sqlite or postgres")
+		}
+	case VectorStoreQdrant:
+		if u, err := url.Parse(cfg.QdrantURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("QDRANT_URL must be an http(s) URL")
+		}
+		if cfg.QdrantCollection == "" {
+			return nil, fmt.Errorf("VECTOR_STORE=qdrant needs QDRANT_COLLECTION")
+		}
+	default:
+		return nil, fmt.Errorf("unknown VECTOR_STORE %q", cfg.VectorStore)
+	}
+	if cfg.CrawlMaxPages, err = envInt("CRAWL_MAX_PAGES", cfg.CrawlMaxPages); err != nil {
+		return nil, err
+	}
+	if cfg.CrawlMaxPages <= 0 {
+		return nil, fmt.Errorf("CRAWL_MAX_PAGES must be positive")
+	}
+	if cfg.CrawlDelay, err = envDuration("CRAWL_DELAY", cfg.CrawlDelay); err != nil {
+		return nil, err
+	}
+	if cfg.CrawlUserAgent == "" {
+		return nil, fmt.Errorf("CRAWL_USER_AGENT must not be empty")
+	}
+	if err := validateOCREngine(cfg.OCREngine); err != nil {
+		return nil, fmt.Errorf("OCR_ENGINE: %v", err)
+	}
+	if cfg.ImageSearch && cfg.OCREngine == OCREngineTesseract {
+		if _, err := exec.LookPath(cfg.TesseractPath); err != nil {
+			return nil, fmt.Errorf("OCR_ENGINE=tesseract needs TESSERACT_PATH: %v", err)
+		}
+	}
+	if cfg.TesseractMaxConcurrency, err = envInt("TESSERACT_MAX_CONCURRENCY", cfg.TesseractMaxConcurrency); err != nil {
+		return nil, err
+	}
+	if cfg.TesseractMaxConcurrency <= 0 {
+		return nil, fmt.Errorf("TESSERACT_MAX_CONCURRENCY must be positive")
+	}
+	if cfg.WhisperURL != "" {
+		if u, err := url.Parse(cfg.WhisperURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("WHISPER_URL must be an http(s) URL")
+		}
+	}
+	if err := validatePIIMode(cfg.PIIMode); err != nil {
+		return nil, fmt.Errorf("PII_MODE: %v", err)
+	}
+	if err := validatePromptGuard(cfg.PromptGuard); err != nil {
+		return nil, fmt.Errorf("PROMPT_GUARD: %v", err)
+	}
+	if err := validateSynonymMode(cfg.SynonymExpansion); err != nil {
+		return nil, fmt.Errorf("SYNONYM_EXPANSION: %v", err)
+	}
+	switch cfg.LLMProvider {
+	case LLMProviderOpenAI, LLMProviderMock:
+	default:
+		return nil, fmt.Errorf("LLM_PROVIDER must be openai or mock")
+	}
+	if cfg.LLMProvider == LLMProviderMock && cfg.LLMVCRMode != "" {
+		return nil, fmt.Errorf("LLM_VCR_MODE can't be used with LLM_PROVIDER=mock")
+	}
+	switch cfg.LLMVCRMode {
+	case "", VCRRecord, VCRReplay:
+	default:
+		return nil, fmt.Errorf("LLM_VCR_MODE must be record or replay")
+	}
+	if cfg.ShadowSampleRate, err = envFloat("SHADOW_SAMPLE_RATE", cfg.ShadowSampleRate); err != nil {
+		return nil, err
+	}
+	if cfg.ShadowSampleRate < 0 || cfg.ShadowSampleRate > 1 {
+		return nil, fmt.Errorf("SHADOW_SAMPLE_RATE must be between 0 and 1")
+	}
+	if cfg.ShadowMaxConcurrency, err = envInt("SHADOW_MAX_CONCURRENCY", cfg.ShadowMaxConcurrency); err != nil {
+		return nil, err
+	}
+	if cfg.ShadowMaxConcurrency <= 0 {
+		return nil, fmt.Errorf("SHADOW_MAX_CONCURRENCY must be positive")
+	}
+	if cfg.ShadowPromptVersion != "" && !promptVersionRe.MatchString(cfg.ShadowPromptVersion) {
+		return nil, fmt.Errorf("SHADOW_PROMPT_VERSION must be a directory name like v2")
+	}
+	if cfg.MaxTemperature, err = envFloat("MAX_TEMPERATURE", cfg.MaxTemperature); err != nil {
+		return nil, err
+	}
+	switch {
+	case envString("OPENAI_API_KEYS", "") != "":
+		cfg.OpenAIKeys = strings.Split(envString("OPENAI_API_KEYS", ""), ",")
+	case envString("OPENAI_API_KEY", "") != "":
+		cfg.OpenAIKeys = []string{envString("OPENAI_API_KEY", "")}
+	default:
+		cfg.OpenAIKeys = []string{OPENAI_API_KEY}
+	}
+	if v := envString("ALLOWED_MODELS", ""); v != "" {
+		cfg.AllowedModels = strings.Split(v, ",")
+	} else {
+		cfg.AllowedModels = []string{cfg.OpenAIModel, cfg.CheapModel, cfg.CapableModel}
+	}
+	if cfg.IntentVersion, err = envInt("INTENT_VERSION_DEFAULT", cfg.IntentVersion); err != nil {
+		return nil, err
+	}
+	if cfg.BatchWindows, err = ParseTimeWindows(envString("BATCH_WINDOWS", "01:00-06:00")); err != nil {
+		return nil, fmt.Errorf("invalid BATCH_WINDOWS: %v", err)
+	}
+	if cfg.BatchTimezone, err = time.LoadLocation(envString("BATCH_TIMEZONE", "UTC")); err != nil {
+		return nil, fmt.Errorf("invalid BATCH_TIMEZONE: %v", err)
+	}
+	for name, d := range map[string]*time.Duration{
+		"OUTBOUND_CONNECT_TIMEOUT":   &cfg.OutboundConnectTimeout,
+		"OUTBOUND_TLS_TIMEOUT":       &cfg.OutboundTLSTimeout,
+		"OUTBOUND_TIMEOUT":           &cfg.OutboundTimeout,
+		"OUTBOUND_KEEPALIVE":         &cfg.OutboundKeepAlive,
+		"OUTBOUND_IDLE_CONN_TIMEOUT": &cfg.OutboundIdleConnTimeout,
+		"REQUEST_TIMEOUT":            &cfg.RequestTimeout,
+		"HEDGE_DELAY":                &cfg.HedgeDelay,
+		"CONFIG_WATCH_INTERVAL":      &cfg.ConfigWatchInterval,
+		"SHUTDOWN_TIMEOUT":           &cfg.ShutdownTimeout,
+		"SHUTDOWN_DELAY":             &cfg.ShutdownDelay,
+		"INTENT_CACHE_TTL":           &cfg.IntentCacheTTL,
+		"RESULTS_CACHE_TTL":          &cfg.ResultsCacheTTL,
+		"RESULTS_CACHE_STALE":        &cfg.ResultsCacheStale,
+		"API_KEY_EXPIRY_WARNING":     &cfg.APIKeyExpiryWarning,
+		"API_KEY_ROTATION_GRACE":     &cfg.APIKeyRotationGrace,
+		"REQUEST_SIGNING_MAX_SKEW":   &cfg.RequestSigningMaxSkew,
+	} {
+		if *d, err = envDuration(name, *d); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.OutboundMaxIdleConnsPerHost, err = envInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", cfg.OutboundMaxIdleConnsPerHost); err != nil {
+		return nil, err
+	}
+	if cfg.SchedulerInterval, err = envDuration("SCHEDULER_INTERVAL", cfg.SchedulerInterval); err != nil {
+		return nil, err
+	}
+	if cfg.TelemetryFlushInterval, err = envDuration("TELEMETRY_FLUSH_INTERVAL", cfg.TelemetryFlushInterval); err != nil {
+		return nil, err
+	}
+	if base := envString("OTEL_EXPORTER_OTLP_ENDPOINT", ""); cfg.OTLPTracesEndpoint == "" && base != "" {
+		cfg.OTLPTracesEndpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if cfg.AnalyticsEnabled, err = envBool("ANALYTICS_ENABLED", cfg.AnalyticsEnabled); err != nil {
+		return nil, err
+	}
+	if cfg.AnalyticsSampleRate, err = envFloat("ANALYTICS_SAMPLE_RATE", cfg.AnalyticsSampleRate); err != nil {
+		return nil, err
+	}
+	if cfg.AnalyticsMaxSamples, err = envInt("ANALYTICS_MAX_SAMPLES", cfg.AnalyticsMaxSamples); err != nil {
+		return nil, err
+	}
+	if cfg.UsageAnalytics, err = envBool("USAGE_ANALYTICS_ENABLED", cfg.UsageAnalytics); err != nil {
+		return nil, err
+	}
+	if cfg.UsageAnalyticsRetention, err = envDuration("USAGE_ANALYTICS_RETENTION", cfg.UsageAnalyticsRetention); err != nil {
+		return nil, err
+	}
+	if cfg.UsageAnalyticsRetention <= 0 {
+		return nil, fmt.Errorf("USAGE_ANALYTICS_RETENTION must be positive")
+	}
+	if err := validateQueryPrivacy(cfg.UsageAnalyticsPrivacy); err != nil {
+		return nil, fmt.Errorf("invalid USAGE_ANALYTICS_PRIVACY: %v", err)
+	}
+	if cfg.UsageAnalyticsK, err = envInt("USAGE_ANALYTICS_K", cfg.UsageAnalyticsK); err != nil {
+		return nil, err
+	}
+	if cfg.UsageAnalyticsK < 2 {
+		return nil, fmt.Errorf("USAGE_ANALYTICS_K must be at least 2")
+	}
+	if cfg.TraceSampleRatio, err = envFloat("OTEL_TRACES_SAMPLER_ARG", cfg.TraceSampleRatio); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryArchiveAfterDays, err = envInt("HISTORY_ARCHIVE_AFTER_DAYS", cfg.HistoryArchiveAfterDays); err != nil {
+		return nil, err
+	}
+	if cfg.ArchiveInterval, err = envDuration("ARCHIVE_INTERVAL", cfg.ArchiveInterval); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryRetentionDays, err = envInt("HISTORY_RETENTION_DAYS", cfg.HistoryRetentionDays); err != nil {
+		return nil, err
+	}
+	if cfg.AuditArchive, err = envBool("AUDIT_ARCHIVE", cfg.AuditArchive); err != nil {
+		return nil, err
+	}
+	if cfg.AuditArchiveInterval, err = envDuration("AUDIT_ARCHIVE_INTERVAL", cfg.AuditArchiveInterval); err != nil {
+		return nil, err
+	}
+	if cfg.LogRetentionDays, err = envInt("LOG_RETENTION_DAYS", cfg.LogRetentionDays); err != nil {
+		return nil, err
+	}
+	if cfg.RetentionInterval, err = envDuration("RETENTION_INTERVAL", cfg.RetentionInterval); err != nil {
+		return nil, err
+	}
+	if cfg.CompressionEnabled, err = envBool("COMPRESSION_ENABLED", cfg.CompressionEnabled); err != nil {
+		return nil, err
+	}
+	if cfg.CompressionMinSize, err = envInt("COMPRESSION_MIN_SIZE", cfg.CompressionMinSize); err != nil {
+		return nil, err
+	}
+	if cfg.BudgetDailyUSD, err = envFloat("BUDGET_DAILY_USD", cfg.BudgetDailyUSD); err != nil {
+		return nil, err
+	}
+	if cfg.BudgetMonthlyUSD, err = envFloat("BUDGET_MONTHLY_USD", cfg.BudgetMonthlyUSD); err != nil {
+		return nil, err
+	}
+
+	if cfg.UpstreamMaxConcurrency < 1 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_CONCURRENCY must be at least 1")
+	}
+	if cfg.UpstreamMaxQueue < 0 {
+		return nil, fmt.Errorf("UPSTREAM_MAX_QUEUE must not be negative")
+	}
+
+	if cfg.TelemetryFlushInterval <= 0 {
+		return nil, fmt.Errorf("TELEMETRY_FLUSH_INTERVAL must be positive")
+	}
+	if cfg.CompressionMinSize < 0 {
+		return nil, fmt.Errorf("COMPRESSION_MIN_SIZE must not be negative")
+	}
+	if cfg.AnalyticsSampleRate < 0 || cfg.AnalyticsSampleRate > 1 {
+		return nil, fmt.Errorf("ANALYTICS_SAMPLE_RATE must be between 0 and 1")
+	}
+	if cfg.AnalyticsMaxSamples < 1 {
+		return nil, fmt.Errorf("ANALYTICS_MAX_SAMPLES must be at least 1")
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1")
+	}
+	switch cfg.HistoryStore {
+	case HistoryStoreMemory:
+	case HistoryStoreSQLite:
+		if cfg.HistoryDSN == "" {
+			cfg.HistoryDSN = "history.db"
+		}
+	case HistoryStorePostgres:
+		if cfg.HistoryDSN == "" {
+			return nil, fmt.Errorf("HISTORY_STORE=postgres needs HISTORY_DSN")
+		}
+	default:
+		return nil, fmt.Errorf("unknown HISTORY_STORE %q", cfg.HistoryStore)
+	}
+	if cfg.HistoryArchiveAfterDays > 0 || cfg.AuditArchive {
+		if cfg.ArchiveStore != "file" && cfg.ArchiveStore != "s3" {
+			return nil, fmt.Errorf("unknown ARCHIVE_STORE %q", cfg.ArchiveStore)
+		}
+	}
+	if cfg.HistoryArchiveAfterDays > 0 && cfg.ArchiveInterval <= 0 {
+		return nil, fmt.Errorf("ARCHIVE_INTERVAL must be positive")
+	}
+	if cfg.AuditArchive && cfg.AuditArchiveInterval <= 0 {
+		return nil, fmt.Errorf("AUDIT_ARCHIVE_INTERVAL must be positive")
+	}
+	if cfg.HistoryRetentionDays < 0 || cfg.LogRetentionDays < 0 {
+		return nil, fmt.Errorf("HISTORY_RETENTION_DAYS and LOG_RETENTION_DAYS must not be negative")
+	}
+	if cfg.HistoryRetentionDays > 0 && cfg.HistoryArchiveAfterDays >= cfg.HistoryRetentionDays {
+		return nil, fmt.Errorf("HISTORY_RETENTION_DAYS must be longer than HISTORY_ARCHIVE_AFTER_DAYS, or nothing is ever archived")
+	}
+	if cfg.RetentionInterval <= 0 {
+		return nil, fmt.Errorf("RETENTION_INTERVAL must be positive")
+	}
+	for _, host := range strings.Split(envString("TLS_AUTOCERT_HOSTS", ""), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.TLSAutocertHosts = append(cfg.TLSAutocertHosts, host)
+		}
+	}
+	// A frontend served from here needs no other origin
+	defaultOrigins := "*"
+	if cfg.ServeFrontend {
+		defaultOrigins = ""
+	}
+	for _, origin := range strings.Split(envString("CORS_ALLOWED_ORIGINS", defaultOrigins), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			cfg.CORSAllowedOrigins = append(cfg.CORSAllowedOrigins, origin)
+		}
+	}
+	if cfg.PublicURL != "" {
+		if u, err := url.Parse(cfg.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("PUBLIC_URL must be an http(s) URL")
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSCertFile != "" && len(cfg.TLSAutocertHosts) > 0 {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS can't both be set")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" && len(cfg.TLSAutocertHosts) == 0 {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+	}
+	if err := validateClientAuth(cfg.TLSClientAuth); err != nil {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH: %v", err)
+	}
+	if cfg.HTTPRedirectPort != "" && cfg.TLSCertFile == "" && len(cfg.TLSAutocertHosts) == 0 {
+		return nil, fmt.Errorf("HTTP_REDIRECT_PORT needs TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+	}
+	if cfg.HTTPRedirectPort != "" && cfg.HTTPRedirectPort == cfg.Port {
+		return nil, fmt.Errorf("HTTP_REDIRECT_PORT must differ from PORT")
+	}
+	if _, ok := searchEngines[cfg.SearchEngine]; !ok {
+		return nil, fmt.Errorf("SEARCH_ENGINE must be one of %v", engineNames())
+	}
+	switch cfg.ResultsProvider {
+	case "":
+	case "serpapi":
+		if cfg.SerpAPIKey == "" {
+			return nil, fmt.Errorf("RESULTS_PROVIDER=serpapi needs SERPAPI_KEY")
+		}
+		if cfg.ResultsCacheStore != "memory" && cfg.ResultsCacheStore != "redis" {
+			return nil, fmt.Errorf("unknown RESULTS_CACHE_STORE %q", cfg.ResultsCacheStore)
+		}
+		if cfg.ResultsCacheSize < 1 {
+			return nil, fmt.Errorf("RESULTS_CACHE_SIZE must be at least 1")
+		}
+		if cfg.ResultsCacheTTL <= 0 {
+			return nil, fmt.Errorf("RESULTS_CACHE_TTL must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown RESULTS_PROVIDER %q", cfg.ResultsProvider)
+	}
+	if cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR must be host:port")
+		}
+		if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR needs a valid SMTP_FROM address")
+		}
+	}
+	if cfg.DebugAddr != "" && cfg.AdminAPIKey == "" {
+		return nil, fmt.Errorf("DEBUG_ADDR needs ADMIN_API_KEY")
+	}
+	if !promptVersionRe.MatchString(cfg.PromptVersion) {
+		return nil, fmt.Errorf("PROMPT_VERSION must be a directory name like v2")
+	}
+	if _, ok := intentSchemas[cfg.IntentVersion]; !ok {
+		return nil, fmt.Errorf("INTENT_VERSION_DEFAULT must be %s", intentVersionList())
+	}
+
+	if err := validateBudgetAction(cfg.BudgetAction); err != nil {
+		return nil, fmt.Errorf("BUDGET_ACTION: %v", err)
+	}
+	if cfg.BudgetStore != "memory" && cfg.BudgetStore != "redis" {
+		return nil, fmt.Errorf("unknown BUDGET_STORE %q", cfg.BudgetStore)
+	}
+
+	if cfg.RateLimitEnabled {
+		if cfg.RateLimitRPS <= 0 {
+			return nil, fmt.Errorf("RATE_LIMIT_RPS must be positive")
+		}
+		if cfg.RateLimitBurst < 1 {
+			return nil, fmt.Errorf("RATE_LIMIT_BURST must be at least 1")
+		}
+		if cfg.RateLimitStore != "memory" && cfg.RateLimitStore != "redis" {
+			return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", cfg.RateLimitStore)
+		}
+	}
+	if cfg.RequestSigningMaxSkew <= 0 {
+		return nil, fmt.Errorf("REQUEST_SIGNING_MAX_SKEW must be positive")
+	}
+	if cfg.RequestSigningReplayStore != "memory" && cfg.RequestSigningReplayStore != "redis" {
+		return nil, fmt.Errorf("unknown REQUEST_SIGNING_REPLAY_STORE %q", cfg.RequestSigningReplayStore)
+	}
+	if cfg.AbuseDetection {
+		if cfg.AbuseWindow <= 0 || cfg.AbuseBanDuration <= 0 {
+			return nil, fmt.Errorf("ABUSE_WINDOW and ABUSE_BAN_DURATION must be positive")
+		}
+		if cfg.AbuseBurst < 1 || cfg.AbuseDuplicatePrompts < 1 || cfg.AbuseBanAfter < 1 {
+			return nil, fmt.Errorf("ABUSE_BURST, ABUSE_DUPLICATE_PROMPTS and ABUSE_BAN_AFTER must be at least 1")
+		}
+	}
+
+	return cfg, nil
+}
+
+func envString(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(name string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return b, nil
+}
+
+func envInt(name string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return n, nil
+}
+
+func envFloat(name string, def float64) (float64, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return f, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var configReloads = metricsRegistry.Counter("config_reloads_total",
+	"Reloads of watched files, by file and result (ok, error).", "file", "result")
+
+// watchedFile is a file reloaded whenever its content changes
+type watchedFile struct {
+	path   string
+	reload func(data []byte) error
+	sum    [sha256.Size]byte
+}
+
+// ConfigWatcher polls files and hands their new content to a reload function.
+// A failed reload keeps the last good version, and is retried only once the
+// file changes again.
+type ConfigWatcher struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	files []*watchedFile
+	audit *AuditLog
+}
+
+func NewConfigWatcher(interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{interval: interval}
+}
+
+// UseAuditLog records every reload, failed ones included, to the audit log
+func (w *ConfigWatcher) UseAuditLog(audit *AuditLog) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.audit = audit
+}
+
+// Watch registers a file. Its current content is taken as already loaded.
+func (w *ConfigWatcher) Watch(path string, reload func(data []byte) error) {
+	f := &watchedFile{path: path, reload: reload}
+	if data, err := os.ReadFile(path); err == nil {
+		f.sum = sha256.Sum256(data)
+	}
+	w.mu.Lock()
+	w.files = append(w.files, f)
+	w.mu.Unlock()
+}
+
+// Run checks the files every interval until ctx is cancelled
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+// Check reloads every file whose content changed
+func (w *ConfigWatcher) Check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			// Editors briefly remove files while saving; keep the loaded version
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if sum == f.sum {
+			continue
+		}
+		f.sum = sum
+		err = f.reload(data)
+		w.audit.auditReload(f.path, data, err)
+		if err != nil {
+			configReloads.Inc(f.path, "error")
+			slog.Error("Error reloading file, keeping the previous version", "file", f.path, "error", err)
+			continue
+		}
+		configReloads.Inc(f.path, "ok")
+		slog.Info("Reloaded file", "file", f.path)
+	}
+}
+
+// writeFileAtomic replaces path with data in one step, so that readers and
+// the watcher never see a partly written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
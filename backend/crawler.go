@@ -0,0 +1,966 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCrawlDepth = 2
+	maxCrawlDepth     = 10
+	defaultCrawlPages = 100
+	// maxSitemapFiles bounds the sitemaps read through sitemap indexes
+	maxSitemapFiles = 50
+	// maxCrawlDelay caps the Crawl-delay a robots.txt can ask for
+	maxCrawlDelay = time.Minute
+	// maxCrawlRedirects bounds the redirects followed for one URL
+	maxCrawlRedirects = 10
+)
+
+// crawlSchedules maps a schedule name to how often a source is re-crawled
+var crawlSchedules = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// crawledFormats maps the media types the crawler indexes to a format
+var crawledFormats = map[string]string{
+	"text/html": "html", "application/xhtml+xml": "html", "application/pdf": "pdf", "text/plain": "txt", "text/markdown": "md",
+}
+
+var (
+	crawledPages = metricsRegistry.Counter("crawled_pages_total",
+		"Pages fetched by the crawler, by result (indexed, unchanged, not_modified, no_text, skipped, error).", "result")
+	crawlRuns = metricsRegistry.Counter("crawl_runs_total",
+		"Crawls of sources, by result (ok, error).", "result")
+)
+
+// errCrawlStopped ends a crawl that can't go on, like one over budget
+var errCrawlStopped = errors.New("crawl stopped")
+
+// errCrawlOutOfScope is a redirect off the site or to a path robots.txt
+// disallows, never followed
+var errCrawlOutOfScope = errors.New("redirected out of scope")
+
+// CrawlSource is a website crawled into a tenant's documents, from a seed
+// page or a sitemap. Its pages are shared by the tenant's users.
+type CrawlSource struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id"`
+	URL      string `json:"url"`
+	// Sitemap tells that URL is a sitemap (or sitemap index) listing the
+	// pages, rather than a page to start following links from
+	Sitemap  bool `json:"sitemap,omitempty"`
+	MaxDepth int  `json:"max_depth"`
+	MaxPages int  `json:"max_pages"`
+	// Schedule re-crawls the source hourly, daily or weekly; empty crawls
+	// it once, and again when asked
+	Schedule  string     `json:"schedule,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// LastStats counts what the last crawl did with the pages
+	LastStats *CrawlStats `json:"last_stats,omitempty"`
+	// Pages are the pages indexed by the last crawl, by URL
+	Pages map[string]*CrawledPage `json:"pages,omitempty"`
+}
+
+// CrawledPage is a page of a source, indexed as a document. Its validators
+// and the hash of its text tell on the next crawl whether it changed.
+type CrawledPage struct {
+	DocumentID string `json:"document_id"`
+	Title      string `json:"title,omitempty"`
+	// CrawledAt is when the page was last embedded, CheckedAt when it was
+	// last fetched
+	CrawledAt      time.Time `json:"crawled_at"`
+	CheckedAt      time.Time `json:"checked_at"`
+	ETag           string    `json:"etag,omitempty"`
+	LastModified   string    `json:"last_modified,omitempty"`
+	ContentHash    string    `json:"content_hash"`
+	EmbeddingModel string    `json:"embedding_model,omitempty"`
+	// Links are the links followed from the page, kept for when it comes
+	// back unchanged
+	Links []string `json:"links,omitempty"`
+}
+
+// CrawlStats counts the pages of a crawl: Indexed were embedded (new or
+// changed), Unchanged fetched with the same text, NotModified answered 304,
+// Failed couldn't be fetched and Removed are gone since the crawl before
+type CrawlStats struct {
+	Indexed     int `json:"indexed"`
+	Unchanged   int `json:"unchanged"`
+	NotModified int `json:"not_modified"`
+	Failed      int `json:"failed"`
+	Removed     int `json:"removed"`
+}
+
+// Crawler keeps the crawl sources, saved to path after every change, and
+// hands crawls to the job scheduler so they run in batch windows
+type Crawler struct {
+	path      string
+	index     *DocumentIndex
+	client    HTTPDoer
+	scheduler *JobScheduler
+	tenants   *TenantRegistry
+	userAgent string
+	// maxPages caps the pages of any source, delay is the least time
+	// between two requests to a site
+	maxPages int
+	delay    time.Duration
+	maxBytes int64
+	now      func() time.Time
+
+	mu   sync.Mutex
+	byID map[string]*CrawlSource
+}
+
+// NewCrawler loads the crawl sources saved at path, if any
+func NewCrawler(path string, index *DocumentIndex, client HTTPDoer, scheduler *JobScheduler, tenants *TenantRegistry, userAgent string, maxPages int, delay time.Duration) (*Crawler, error) {
+	// The crawler follows redirects itself, checking each hop's scope
+	if hc, ok := client.(*http.Client); ok {
+		own := *hc
+		own.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		client = &own
+	}
+	c := &Crawler{
+		path:      path,
+		index:     index,
+		client:    client,
+		scheduler: scheduler,
+		tenants:   tenants,
+		userAgent: userAgent,
+		maxPages:  maxPages,
+		delay:     delay,
+		maxBytes:  index.maxBytes,
+		now:       time.Now,
+		byID:      make(map[string]*CrawlSource),
+	}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading crawl sources file: %v", err)
+	}
+	var list []*CrawlSource
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error parsing crawl sources file: %v", err)
+	}
+	for _, src := range list {
+		c.byID[src.ID] = src
+	}
+	return c, nil
+}
+
+// save writes every source to the file; the caller holds mu
+func (c *Crawler) save() error {
+	if c.path == "" {
+		return nil
+	}
+	list := make([]*CrawlSource, 0, len(c.byID))
+	for _, src := range c.byID {
+		list = append(list, src)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling crawl sources: %v", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("error saving crawl sources: %v", err)
+	}
+	return nil
+}
+
+// Run submits due crawls every interval until ctx is cancelled
+func (c *Crawler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.submitDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// submitDue hands every due source to the scheduler. The next run is booked
+// right away, so a crawl waiting for its window is not submitted twice.
+func (c *Crawler) submitDue() {
+	now := c.now().UTC()
+	c.mu.Lock()
+	var due []*CrawlSource
+	for _, src := range c.byID {
+		if src.NextRunAt != nil && !now.Before(*src.NextRunAt) {
+			if every, ok := crawlSchedules[src.Schedule]; ok {
+				next := now.Add(every)
+				src.NextRunAt = &next
+			} else {
+				src.NextRunAt = nil
+			}
+			due = append(due, src)
+		}
+	}
+	if len(due) > 0 {
+		if err := c.save(); err != nil {
+			slog.Error("Error saving crawl sources", "error", err)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, src := range due {
+		c.submit(src, PriorityLow)
+	}
+}
+
+func (c *Crawler) submit(src *CrawlSource, priority int) {
+	id := src.ID
+	var deadline time.Time
+	if src.NextRunAt != nil {
+		deadline = *src.NextRunAt
+	}
+	c.scheduler.Submit(&Job{
+		ID:          "crawl-" + id,
+		Kind:        "crawl",
+		Description: fmt.Sprintf("Crawl %s", src.URL),
+		Priority:    priority,
+		// Late is fine, but not later than the next scheduled crawl
+		Deadline: deadline,
+		Run: func(ctx context.Context) error {
+			return c.crawl(ctx, id)
+		},
+	})
+}
+
+// crawl fetches the source's pages and indexes them, then deletes the
+// pages of the last crawl that are gone
+func (c *Crawler) crawl(ctx context.Context, id string) error {
+	c.mu.Lock()
+	src, ok := c.byID[id]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	snapshot := *src
+	snapshot.Pages = maps.Clone(src.Pages)
+	c.mu.Unlock()
+
+	tenant, ok := c.tenants.ByID(snapshot.TenantID)
+	if !ok {
+		return fmt.Errorf("unknown tenant %q", snapshot.TenantID)
+	}
+	ctx = withTenant(ctx, tenant)
+	start := time.Now()
+	st, err := c.fetchSource(ctx, &snapshot)
+	pages, stats := st.pages, st.stats
+
+	c.mu.Lock()
+	src, ok = c.byID[id]
+	if !ok {
+		// Deleted while crawling: what was just indexed goes too
+		c.mu.Unlock()
+		c.deletePages(ctx, snapshot.TenantID, pages, nil)
+		return nil
+	}
+	now := c.now().UTC()
+	src.LastRunAt = &now
+	src.LastError = ""
+	var gone map[string]*CrawledPage
+	if err != nil {
+		src.LastError = err.Error()
+		// Keep what was indexed before, a failed crawl proves nothing gone
+		for pageURL, page := range pages {
+			if src.Pages == nil {
+				src.Pages = make(map[string]*CrawledPage)
+			}
+			src.Pages[pageURL] = page
+		}
+	} else {
+		gone = src.Pages
+		src.Pages = pages
+		for pageURL := range gone {
+			if _, ok := pages[pageURL]; !ok {
+				stats.Removed++
+			}
+		}
+	}
+	src.LastStats = &stats
+	if saveErr := c.save(); saveErr != nil {
+		slog.Error("Error saving crawl sources", "error", saveErr)
+	}
+	c.mu.Unlock()
+
+	c.deletePages(ctx, snapshot.TenantID, gone, pages)
+	if err != nil {
+		crawlRuns.Inc("error")
+		slog.WarnContext(ctx, "Crawl failed", "source", id, "url", snapshot.URL, "pages", len(pages), "indexed", stats.Indexed, "error", err)
+		return err
+	}
+	crawlRuns.Inc("ok")
+	slog.InfoContext(ctx, "Crawled source", "source", id, "url", snapshot.URL, "pages", len(pages),
+		"indexed", stats.Indexed, "unchanged", stats.Unchanged+stats.NotModified, "removed", stats.Removed, "elapsed", time.Since(start))
+	return nil
+}
+
+// deletePages deletes the documents of pages that aren't kept
+func (c *Crawler) deletePages(ctx context.Context, tenantID string, pages, keep map[string]*CrawledPage) {
+	for pageURL, page := range pages {
+		if _, ok := keep[pageURL]; ok {
+			continue
+		}
+		if _, err := c.index.Delete(ctx, tenantID, "", page.DocumentID); err != nil {
+			slog.WarnContext(ctx, "Error deleting crawled page", "url", pageURL, "error", err)
+		}
+	}
+}
+
+// crawlState is one crawl in progress
+type crawlState struct {
+	src    *CrawlSource
+	seed   *url.URL
+	robots *robotsRules
+	delay  time.Duration
+	last   time.Time
+	pages  map[string]*CrawledPage
+	stats  CrawlStats
+}
+
+// fetchSource crawls the source breadth first within its host, honoring
+// robots.txt. The state it returns holds the pages it indexed or found
+// unchanged, even when the crawl failed halfway.
+func (c *Crawler) fetchSource(ctx context.Context, src *CrawlSource) (*crawlState, error) {
+	st := &crawlState{src: src, pages: make(map[string]*CrawledPage)}
+	seed, err := url.Parse(src.URL)
+	if err != nil {
+		return st, fmt.Errorf("invalid url: %v", err)
+	}
+	st.seed = seed
+	if st.robots, err = c.fetchRobots(ctx, seed); err != nil {
+		return st, err
+	}
+	st.delay = min(max(c.delay, st.robots.delay), maxCrawlDelay)
+	maxPages := min(src.MaxPages, c.maxPages)
+
+	type queued struct {
+		url   string
+		depth int
+	}
+	var queue []queued
+	if src.Sitemap {
+		urls, err := c.fetchSitemap(ctx, st, src.URL)
+		if err != nil {
+			return st, err
+		}
+		for _, u := range urls {
+			queue = append(queue, queued{u, 0})
+		}
+	} else {
+		queue = append(queue, queued{seed.String(), 0})
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 && len(st.pages) < maxPages {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next.url] {
+			continue
+		}
+		seen[next.url] = true
+		links, err := c.fetchPage(ctx, st, next.url)
+		if errors.Is(err, errCrawlStopped) {
+			return st, err
+		}
+		if err != nil {
+			st.stats.Failed++
+			crawledPages.Inc("error")
+			slog.DebugContext(ctx, "Error crawling page", "url", next.url, "error", err)
+			continue
+		}
+		if next.depth < src.MaxDepth {
+			for _, link := range links {
+				if !seen[link] {
+					queue = append(queue, queued{link, next.depth + 1})
+				}
+			}
+		}
+	}
+	return st, nil
+}
+
+// inScope tells whether the crawler may fetch u: on the seed's site and
+// allowed by its robots.txt
+func (st *crawlState) inScope(u *url.URL) bool {
+	if (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Host, st.seed.Host) {
+		return false
+	}
+	return st.robots.Allowed(u.RequestURI())
+}
+
+// get fetches a URL of the site, waiting out the crawl delay before it and
+// each redirect. Redirects out of scope fail with errCrawlOutOfScope. With
+// the page as last crawled, the request is conditional on its validators.
+func (c *Crawler) get(ctx context.Context, st *crawlState, rawURL string, prev *CrawledPage) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if prev != nil && prev.ETag != "" {
+		req.Header.Set("If-None-Match", prev.ETag)
+	}
+	if prev != nil && prev.LastModified != "" {
+		req.Header.Set("If-Modified-Since", prev.LastModified)
+	}
+	pause := func() error {
+		if wait := st.delay - time.Since(st.last); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w: %v", errCrawlStopped, ctx.Err())
+			case <-time.After(wait):
+			}
+		}
+		st.last = time.Now()
+		return nil
+	}
+	return c.follow(req, st.inScope, pause)
+}
+
+// follow sends a request and the redirects it gets, each only once allowed
+// approves its URL and pause, if set, lets it go
+func (c *Crawler) follow(req *http.Request, allowed func(*url.URL) bool, pause func() error) (*http.Response, error) {
+	for hops := 0; ; hops++ {
+		if pause != nil {
+			if err := pause(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching %s: %w", req.URL, err)
+		}
+		location := resp.Header.Get("Location")
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return resp, nil
+		}
+		if location == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if hops == maxCrawlRedirects {
+			return nil, fmt.Errorf("%s redirected more than %d times", req.URL, maxCrawlRedirects)
+		}
+		next, err := req.URL.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect from %s: %v", req.URL, err)
+		}
+		if !allowed(next) {
+			return nil, fmt.Errorf("%w: %s", errCrawlOutOfScope, next.Redacted())
+		}
+		req = req.Clone(req.Context())
+		req.URL, req.Host = next, ""
+	}
+}
+
+// fetchRobots reads the site's robots.txt. A missing one allows everything;
+// one that can't be read stops the crawl, as RFC 9309 asks.
+func (c *Crawler) fetchRobots(ctx context.Context, seed *url.URL) (*robotsRules, error) {
+	robotsURL := &url.URL{Scheme: seed.Scheme, Host: seed.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	// RFC 9309 has robots.txt redirects followed, even to another host
+	resp, err := c.follow(req, func(u *url.URL) bool { return u.Scheme == "http" || u.Scheme == "https" }, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching robots.txt: %v", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("robots.txt unavailable (%s), not crawling", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return &robotsRules{}, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 512<<10))
+	if err != nil {
+		return nil, fmt.Errorf("error reading robots.txt: %v", err)
+	}
+	return parseRobots(string(data), c.userAgent), nil
+}
+
+// fetchSitemap returns the page URLs of a sitemap, following sitemap
+// indexes. Like pages, the sitemaps must be in scope, redirects included;
+// the nested ones that aren't are skipped.
+func (c *Crawler) fetchSitemap(ctx context.Context, st *crawlState, sitemapURL string) ([]string, error) {
+	u, err := url.Parse(sitemapURL)
+	if err != nil || !st.inScope(u) {
+		return nil, fmt.Errorf("sitemap %s is not on the site or disallowed by robots.txt", sitemapURL)
+	}
+	var urls []string
+	pending := []string{u.String()}
+	for fetched := 0; len(pending) > 0 && fetched < maxSitemapFiles; fetched++ {
+		current := pending[0]
+		pending = pending[1:]
+		resp, err := c.get(ctx, st, current, nil)
+		if errors.Is(err, errCrawlOutOfScope) && current != u.String() {
+			slog.DebugContext(ctx, "Skipping sitemap", "url", current, "error", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 50<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading sitemap: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("sitemap %s answered %s", current, resp.Status)
+		}
+		var sitemap struct {
+			URLs     []string `xml:"url>loc"`
+			Sitemaps []string `xml:"sitemap>loc"`
+		}
+		if err := xml.Unmarshal(data, &sitemap); err != nil {
+			return nil, fmt.Errorf("error parsing sitemap %s: %v", current, err)
+		}
+		for _, loc := range sitemap.URLs {
+			if u, err := url.Parse(strings.TrimSpace(loc)); err == nil && st.inScope(u) {
+				u.Fragment = ""
+				urls = append(urls, u.String())
+			}
+		}
+		for _, loc := range sitemap.Sitemaps {
+			if u, err := url.Parse(strings.TrimSpace(loc)); err == nil && st.inScope(u) {
+				pending = append(pending, u.String())
+			}
+		}
+	}
+	return urls, nil
+}
+
+// fetchPage fetches a page, indexes its text and returns its links in
+// scope. Only budget and quota errors of the index stop the crawl.
+func (c *Crawler) fetchPage(ctx context.Context, st *crawlState, pageURL string) ([]string, error) {
+	u, err := url.Parse(pageURL)
+	if err != nil || !st.inScope(u) {
+		crawledPages.Inc("skipped")
+		return nil, nil
+	}
+	prev := st.src.Pages[pageURL]
+	if prev != nil && !c.stored(ctx, st, prev) {
+		prev = nil
+	}
+	resp, err := c.get(ctx, st, pageURL, prev)
+	if errors.Is(err, errCrawlOutOfScope) {
+		crawledPages.Inc("skipped")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	now := c.now().UTC()
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		page := *prev
+		page.CheckedAt = now
+		st.pages[pageURL] = &page
+		st.stats.NotModified++
+		crawledPages.Inc("not_modified")
+		return prev.Links, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading page: %v", err)
+	}
+	if int64(len(data)) > c.maxBytes {
+		crawledPages.Inc("skipped")
+		return nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var text, title string
+	var links []string
+	index := true
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		page := parseHTML(string(data))
+		text, title = page.Text, page.Title
+		if title != "" {
+			text = title + "\n" + text
+		}
+		index = !page.NoIndex
+		if !page.NoFollow {
+			base := resp.Request.URL
+			if page.Base != "" {
+				if b, err := base.Parse(page.Base); err == nil {
+					base = b
+				}
+			}
+			for _, href := range page.Links {
+				link, err := base.Parse(href)
+				if err != nil {
+					continue
+				}
+				link.Fragment = ""
+				if st.inScope(link) {
+					links = append(links, link.String())
+				}
+			}
+		}
+	case "application/pdf", "text/plain", "text/markdown":
+		if text, err = extractDocumentText(crawledFormats[mediaType], data); err != nil {
+			return nil, err
+		}
+	default:
+		crawledPages.Inc("skipped")
+		return nil, nil
+	}
+	if !index {
+		crawledPages.Inc("skipped")
+		return links, nil
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	page := &CrawledPage{
+		DocumentID:     crawledDocumentID(st.src.ID, pageURL),
+		Title:          title,
+		CrawledAt:      now,
+		CheckedAt:      now,
+		ETag:           resp.Header.Get("ETag"),
+		LastModified:   resp.Header.Get("Last-Modified"),
+		ContentHash:    hex.EncodeToString(sum[:]),
+		EmbeddingModel: c.index.model,
+		Links:          links,
+	}
+	// Markup, ads or a new ETag don't change the passages: only a new text
+	// is embedded again
+	if prev != nil && prev.ContentHash == page.ContentHash {
+		page.CrawledAt = prev.CrawledAt
+		st.pages[pageURL] = page
+		st.stats.Unchanged++
+		crawledPages.Inc("unchanged")
+		return links, nil
+	}
+
+	doc := &Document{
+		ID:        page.DocumentID,
+		TenantID:  st.src.TenantID,
+		Name:      pageURL,
+		Format:    crawledFormats[mediaType],
+		Bytes:     int64(len(data)),
+		CreatedAt: now,
+	}
+	switch err := c.index.Index(ctx, doc, text); {
+	case errors.Is(err, errNoDocumentText):
+		crawledPages.Inc("no_text")
+		return links, nil
+	case errors.Is(err, errDocumentTooLong):
+		crawledPages.Inc("skipped")
+		return links, nil
+	case err != nil:
+		return links, fmt.Errorf("%w: %v", errCrawlStopped, err)
+	}
+	crawledPages.Inc("indexed")
+	st.stats.Indexed++
+	st.pages[pageURL] = page
+	return links, nil
+}
+
+// stored tells whether the page can be kept as it was indexed: its
+// document is still in the store, embedded with the current model. A
+// memory store forgets documents on restart, and a new model needs new
+// vectors.
+func (c *Crawler) stored(ctx context.Context, st *crawlState, prev *CrawledPage) bool {
+	if prev.ContentHash == "" || prev.EmbeddingModel != c.index.model {
+		return false
+	}
+	doc, err := c.index.store.Get(ctx, st.src.TenantID, "", prev.DocumentID)
+	return err == nil && doc != nil
+}
+
+// crawledDocumentID is stable across crawls, so a page's document is
+// replaced when it is crawled again
+func crawledDocumentID(sourceID, pageURL string) string {
+	sum := sha256.Sum256([]byte(sourceID + "\x00" + pageURL))
+	return hex.EncodeToString(sum[:12])
+}
+
+// handleSources lists the crawl sources (GET) or adds one (POST) and
+// crawls it right away
+func (c *Crawler) handleSources(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.mu.Lock()
+		list := make([]map[string]interface{}, 0, len(c.byID))
+		for _, src := range c.byID {
+			list = append(list, renderCrawlSource(src, false))
+		}
+		c.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i]["id"].(string) < list[j]["id"].(string) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sources": list})
+	case http.MethodPost:
+		c.create(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Crawler) create(w http.ResponseWriter, r *http.Request) {
+	var src CrawlSource
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&src); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if src.TenantID == "" {
+		src.TenantID = DefaultTenantID
+	}
+	if _, ok := c.tenants.ByID(src.TenantID); !ok {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(src.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+	u.Fragment = ""
+	src.URL = u.String()
+	if src.MaxDepth == 0 && !src.Sitemap {
+		src.MaxDepth = defaultCrawlDepth
+	}
+	if src.MaxDepth < 0 || src.MaxDepth > maxCrawlDepth {
+		http.Error(w, fmt.Sprintf("max_depth must be between 0 and %d", maxCrawlDepth), http.StatusBadRequest)
+		return
+	}
+	if src.MaxPages == 0 {
+		src.MaxPages = min(defaultCrawlPages, c.maxPages)
+	}
+	if src.MaxPages < 0 || src.MaxPages > c.maxPages {
+		http.Error(w, fmt.Sprintf("max_pages must be between 1 and %d", c.maxPages), http.StatusBadRequest)
+		return
+	}
+	if _, ok := crawlSchedules[src.Schedule]; src.Schedule != "" && !ok {
+		http.Error(w, "schedule must be hourly, daily or weekly", http.StatusBadRequest)
+		return
+	}
+	src.ID = newHistoryID()
+	src.CreatedAt = c.now().UTC()
+	src.LastRunAt, src.LastError, src.Pages = nil, "", nil
+	if every, ok := crawlSchedules[src.Schedule]; ok {
+		next := src.CreatedAt.Add(every)
+		src.NextRunAt = &next
+	} else {
+		src.NextRunAt = nil
+	}
+
+	c.mu.Lock()
+	c.byID[src.ID] = &src
+	err = c.save()
+	c.mu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error saving crawl source", "error", err)
+		http.Error(w, "Error saving crawl source", http.StatusInternalServerError)
+		return
+	}
+	c.submit(&src, PriorityNormal)
+	writeJSON(w, http.StatusCreated, renderCrawlSource(&src, false))
+}
+
+// handleSource returns a source with its pages (GET) or deletes it with its
+// pages (DELETE)
+func (c *Crawler) handleSource(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c.mu.Lock()
+	src, ok := c.byID[id]
+	if !ok {
+		c.mu.Unlock()
+		http.Error(w, "Crawl source not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		out := renderCrawlSource(src, true)
+		c.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodDelete:
+		delete(c.byID, id)
+		err := c.save()
+		c.mu.Unlock()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error saving crawl sources", "error", err)
+			http.Error(w, "Error deleting crawl source", http.StatusInternalServerError)
+			return
+		}
+		c.scheduler.Cancel("crawl-" + id)
+		c.deletePages(r.Context(), src.TenantID, src.Pages, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		c.mu.Unlock()
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRun queues a crawl of the source now (POST)
+func (c *Crawler) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.Lock()
+	src, ok := c.byID[r.PathValue("id")]
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, "Crawl source not found", http.StatusNotFound)
+		return
+	}
+	c.submit(src, PriorityNormal)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleFreshness reports how fresh the index of every source is (GET):
+// when its pages were last checked and embedded, and how many are stale,
+// that is not checked for longer than the source's schedule, or embedded
+// with another model than the current one
+func (c *Crawler) handleFreshness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := c.now().UTC()
+	c.mu.Lock()
+	list := make([]map[string]interface{}, 0, len(c.byID))
+	for _, src := range c.byID {
+		list = append(list, c.freshness(src, now))
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i]["id"].(string) < list[j]["id"].(string) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sources": list, "embedding_model": c.index.model})
+}
+
+// freshness renders the freshness of a source; the caller holds mu
+func (c *Crawler) freshness(src *CrawlSource, now time.Time) map[string]interface{} {
+	out := map[string]interface{}{
+		"id":         src.ID,
+		"tenant_id":  src.TenantID,
+		"url":        src.URL,
+		"page_count": len(src.Pages),
+	}
+	every, scheduled := crawlSchedules[src.Schedule]
+	var oldestChecked, oldestCrawled, newestCrawled time.Time
+	stale, outdated := 0, 0
+	for _, page := range src.Pages {
+		if oldestChecked.IsZero() || page.CheckedAt.Before(oldestChecked) {
+			oldestChecked = page.CheckedAt
+		}
+		if oldestCrawled.IsZero() || page.CrawledAt.Before(oldestCrawled) {
+			oldestCrawled = page.CrawledAt
+		}
+		if page.CrawledAt.After(newestCrawled) {
+			newestCrawled = page.CrawledAt
+		}
+		if scheduled && now.Sub(page.CheckedAt) > every {
+			stale++
+		}
+		if page.EmbeddingModel != c.index.model {
+			outdated++
+		}
+	}
+	if len(src.Pages) > 0 {
+		out["oldest_checked_at"] = oldestChecked
+		out["oldest_crawled_at"] = oldestCrawled
+		out["newest_crawled_at"] = newestCrawled
+	}
+	out["outdated_pages"] = outdated
+	if scheduled {
+		out["schedule"] = src.Schedule
+		out["stale_pages"] = stale
+	}
+	if src.LastRunAt != nil {
+		out["last_run_at"] = src.LastRunAt
+	}
+	if src.NextRunAt != nil {
+		out["next_run_at"] = src.NextRunAt
+		out["overdue"] = now.After(*src.NextRunAt)
+	}
+	if src.LastError != "" {
+		out["last_error"] = src.LastError
+	}
+	if src.LastStats != nil {
+		out["last_stats"] = src.LastStats
+	}
+	return out
+}
+
+// renderCrawlSource renders a source, with its pages or just their count;
+// the caller holds mu
+func renderCrawlSource(src *CrawlSource, withPages bool) map[string]interface{} {
+	out := map[string]interface{}{
+		"id":         src.ID,
+		"tenant_id":  src.TenantID,
+		"url":        src.URL,
+		"sitemap":    src.Sitemap,
+		"max_depth":  src.MaxDepth,
+		"max_pages":  src.MaxPages,
+		"created_at": src.CreatedAt,
+		"page_count": len(src.Pages),
+	}
+	if src.Schedule != "" {
+		out["schedule"] = src.Schedule
+	}
+	if src.LastRunAt != nil {
+		out["last_run_at"] = src.LastRunAt
+	}
+	if src.NextRunAt != nil {
+		out["next_run_at"] = src.NextRunAt
+	}
+	if src.LastError != "" {
+		out["last_error"] = src.LastError
+	}
+	if src.LastStats != nil {
+		out["last_stats"] = src.LastStats
+	}
+	if withPages {
+		pages := make([]map[string]interface{}, 0, len(src.Pages))
+		for pageURL, page := range src.Pages {
+			pages = append(pages, map[string]interface{}{
+				"url":         pageURL,
+				"title":       page.Title,
+				"document_id": page.DocumentID,
+				"crawled_at":  page.CrawledAt,
+				"checked_at":  page.CheckedAt,
+			})
+		}
+		sort.Slice(pages, func(i, j int) bool { return pages[i]["url"].(string) < pages[j]["url"].(string) })
+		out["pages"] = pages
+	}
+	return out
+}
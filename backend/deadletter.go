@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDeadLetters bounds the store; the oldest entries are dropped beyond it
+const maxDeadLetters = 1000
+
+var deadLetterCount = metricsRegistry.Gauge("dead_letter_jobs",
+	"Background jobs that exhausted their retries and await replay.")
+
+// DeadLetter is a background job that failed on every attempt
+type DeadLetter struct {
+	Job      *Job      `json:"job"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterQueue keeps failed jobs for inspection and replay, instead of
+// dropping them once retries run out
+type DeadLetterQueue struct {
+	mu      sync.Mutex
+	letters map[string]*DeadLetter
+}
+
+func NewDeadLetterQueue() *DeadLetterQueue {
+	return &DeadLetterQueue{letters: make(map[string]*DeadLetter)}
+}
+
+// Add stores a failed job, evicting the oldest letter when full
+func (q *DeadLetterQueue) Add(job *Job, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.letters[job.ID]; !ok && len(q.letters) >= maxDeadLetters {
+		var oldest *DeadLetter
+		for _, l := range q.letters {
+			if oldest == nil || l.FailedAt.Before(oldest.FailedAt) {
+				oldest = l
+			}
+		}
+		delete(q.letters, oldest.Job.ID)
+	}
+	q.letters[job.ID] = &DeadLetter{Job: job, Error: err.Error(), FailedAt: now}
+	deadLetterCount.Set(float64(len(q.letters)))
+}
+
+// List returns the letters, newest first, optionally of one job kind
+func (q *DeadLetterQueue) List(kind string) []*DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make([]*DeadLetter, 0, len(q.letters))
+	for _, l := range q.letters {
+		if kind == "" || l.Job.Kind == kind {
+			out = append(out, l)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].FailedAt.After(out[j].FailedAt) })
+	return out
+}
+
+// PurgeBefore drops letters that failed before cutoff and returns how many
+func (q *DeadLetterQueue) PurgeBefore(cutoff time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for id, l := range q.letters {
+		if l.FailedAt.Before(cutoff) {
+			delete(q.letters, id)
+			n++
+		}
+	}
+	deadLetterCount.Set(float64(len(q.letters)))
+	return n
+}
+
+// Remove takes a letter out of the queue
+func (q *DeadLetterQueue) Remove(id string) (*DeadLetter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.letters[id]
+	if ok {
+		delete(q.letters, id)
+		deadLetterCount.Set(float64(len(q.letters)))
+	}
+	return l, ok
+}
+
+// Replay moves dead letters back into the scheduler with fresh retries.
+// With an empty id, every letter of the kind (or all of them) is replayed.
+func (s *JobScheduler) Replay(id, kind string) []string {
+	var letters []*DeadLetter
+	if id != "" {
+		if l, ok := s.dead.Remove(id); ok {
+			letters = append(letters, l)
+		}
+	} else {
+		for _, l := range s.dead.List(kind) {
+			if l, ok := s.dead.Remove(l.Job.ID); ok {
+				letters = append(letters, l)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(letters))
+	for _, l := range letters {
+		l.Job.Attempts = 0
+		l.Job.NotBefore = time.Time{}
+		s.Submit(l.Job)
+		ids = append(ids, l.Job.ID)
+	}
+	return ids
+}
+
+// handleDeadLetters lists (GET), replays (POST) or discards (DELETE) dead letters
+func (s *JobScheduler) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"dead_letters": s.dead.List(r.URL.Query().Get("kind")),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			ID   string `json:"id"`
+			Kind string `json:"kind"`
+			All  bool   `json:"all"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" && req.Kind == "" && !req.All {
+			http.Error(w, "Missing id, kind or all", http.StatusBadRequest)
+			return
+		}
+		replayed := s.Replay(req.ID, req.Kind)
+		if req.ID != "" && len(replayed) == 0 {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"replayed": replayed})
+
+	case http.MethodDelete:
+		if _, ok := s.dead.Remove(r.URL.Query().Get("id")); !ok {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// newDebugMux serves the profiling and runtime endpoints, all behind the
+// admin key. It is meant for its own listener, never the public port.
+func newDebugMux(adminKey string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", requireAdmin(adminKey, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(adminKey, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdmin(adminKey, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(adminKey, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdmin(adminKey, pprof.Trace))
+	mux.HandleFunc("/debug/runtime", requireAdmin(adminKey, handleRuntimeStats))
+	mux.HandleFunc("/debug/goroutines", requireAdmin(adminKey, handleGoroutineDump))
+	mux.HandleFunc("/debug/gc", requireAdmin(adminKey, handleForceGC))
+	return mux
+}
+
+// handleRuntimeStats reports memory, GC and scheduler figures as JSON
+func handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gc := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&gc)
+	gogc := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	metrics.Read(gogc)
+	quantiles := make([]float64, len(gc.PauseQuantiles))
+	for i, q := range gc.PauseQuantiles {
+		quantiles[i] = float64(q.Microseconds()) / 1000
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"go_version": runtime.Version(),
+		"num_cpu":    runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]interface{}{
+			"heap_alloc_bytes":    mem.HeapAlloc,
+			"heap_inuse_bytes":    mem.HeapInuse,
+			"heap_idle_bytes":     mem.HeapIdle,
+			"heap_released_bytes": mem.HeapReleased,
+			"heap_objects":        mem.HeapObjects,
+			"stack_inuse_bytes":   mem.StackInuse,
+			"sys_bytes":           mem.Sys,
+			"total_alloc_bytes":   mem.TotalAlloc,
+			"mallocs":             mem.Mallocs,
+			"frees":               mem.Frees,
+		},
+		"gc": map[string]interface{}{
+			"num_gc":         gc.NumGC,
+			"last_gc":        gc.LastGC,
+			"pause_total_ms": float64(gc.PauseTotal.Microseconds()) / 1000,
+			// min, 25th, 50th, 75th percentile and max pause
+			"pause_quantiles_ms": quantiles,
+			"next_gc_bytes":      mem.NextGC,
+			"gc_cpu_fraction":    mem.GCCPUFraction,
+			"gogc_percent":       gogc[0].Value.Uint64(),
+			"memory_limit_bytes": debug.SetMemoryLimit(-1),
+		},
+	})
+}
+
+// handleGoroutineDump writes every goroutine's stack as text, like a
+// SIGQUIT dump but without killing the process
+func handleGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// handleForceGC runs a garbage collection and returns freed memory to the OS
+func handleForceGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	debug.FreeOSMemory()
+	runtime.ReadMemStats(&after)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"duration_ms":         float64(time.Since(start).Microseconds()) / 1000,
+		"heap_alloc_before":   before.HeapAlloc,
+		"heap_alloc_after":    after.HeapAlloc,
+		"heap_released_after": after.HeapReleased,
+	})
+}
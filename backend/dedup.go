@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var dedupedAnalyses = metricsRegistry.Counter("analysis_dedup_total",
+	"Analyses through the deduplicator, by how they were answered (leader, local, remote, fallback).", "result")
+
+const (
+	// dedupResultTTL is how long an analysis stays in Redis for the replicas
+	// that waited on it; the intent cache of each replica keeps it after that
+	dedupResultTTL = time.Minute
+	// dedupPollInterval is how often a replica waiting on another one checks
+	// for its analysis
+	dedupPollInterval = 100 * time.Millisecond
+)
+
+// AnalysisDeduplicator makes identical analyses running at the same time
+// share one OpenAI call: within a replica the first caller's call is
+// waited on, and across replicas a Redis lock elects the one replica making
+// it, which leaves the answer in Redis for the others. A replica whose lock
+// holder fails or takes longer than wait analyzes the prompt itself, as
+// does any replica when Redis is unavailable. A nil deduplicator makes
+// every call.
+type AnalysisDeduplicator struct {
+	client  *RedisClient
+	prefix  string
+	wait    time.Duration
+	lockTTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*analysisCall
+}
+
+// analysisCall is an analysis that callers of the same replica wait on
+type analysisCall struct {
+	done   chan struct{}
+	intent *SearchIntent
+	err    error
+}
+
+// NewAnalysisDeduplicator shares analyses through client for up to wait.
+// The lock outlives wait by the request timeout at most, so a replica that
+// dies holding it doesn't block the others for long.
+func NewAnalysisDeduplicator(client *RedisClient, wait, requestTimeout time.Duration) *AnalysisDeduplicator {
+	lockTTL := wait + requestTimeout
+	if requestTimeout <= 0 {
+		lockTTL = 2 * wait
+	}
+	return &AnalysisDeduplicator{
+		client:   client,
+		prefix:   "analysis:",
+		wait:     wait,
+		lockTTL:  lockTTL,
+		inflight: make(map[string]*analysisCall),
+	}
+}
+
+// UseDeduplicator turns on sharing analyses running at the same time
+func (h *SearchHandler) UseDeduplicator(dedup *AnalysisDeduplicator) {
+	h.dedup = dedup
+}
+
+// Do returns the intent of the analysis keyed by key, calling analyze only
+// when no other caller, here or on another replica, is already making it
+func (d *AnalysisDeduplicator) Do(ctx context.Context, key string, analyze func(context.Context) (*SearchIntent, error)) (*SearchIntent, error) {
+	if d == nil {
+		return analyze(ctx)
+	}
+	d.mu.Lock()
+	if call, ok := d.inflight[key]; ok {
+		d.mu.Unlock()
+		select {
+		case <-call.done:
+			if call.err != nil {
+				// The first caller's failure may be its own, e.g. its client
+				// went away
+				dedupedAnalyses.Inc("fallback")
+				return analyze(ctx)
+			}
+			dedupedAnalyses.Inc("local")
+			intent := *call.intent
+			return &intent, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &analysisCall{done: make(chan struct{})}
+	d.inflight[key] = call
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.inflight, key)
+		d.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.intent, call.err = d.shared(ctx, key, analyze)
+	if call.err != nil {
+		return nil, call.err
+	}
+	intent := *call.intent
+	return &intent, nil
+}
+
+// shared answers the analysis from Redis, or makes it under the lock, or
+// waits for the replica holding the lock
+func (d *AnalysisDeduplicator) shared(ctx context.Context, key string, analyze func(context.Context) (*SearchIntent, error)) (*SearchIntent, error) {
+	if intent, err := d.load(ctx, key); err != nil {
+		return d.fallback(ctx, analyze, err)
+	} else if intent != nil {
+		dedupedAnalyses.Inc("remote")
+		return intent, nil
+	}
+	// The token tells this replica's lock from the next leader's
+	token := newHistoryID()
+	reply, err := d.client.Do(ctx, "SET", d.prefix+key+":lock", token, "NX", "PX", fmt.Sprint(d.lockTTL.Milliseconds()))
+	if err != nil {
+		return d.fallback(ctx, analyze, err)
+	}
+	if reply != nil {
+		dedupedAnalyses.Inc("leader")
+		return d.lead(ctx, key, token, analyze)
+	}
+
+	ticker := time.NewTicker(dedupPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(d.wait)
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			dedupedAnalyses.Inc("fallback")
+			return analyze(ctx)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		intent, err := d.load(ctx, key)
+		if err != nil {
+			return d.fallback(ctx, analyze, err)
+		}
+		if intent != nil {
+			dedupedAnalyses.Inc("remote")
+			return intent, nil
+		}
+		held, err := d.client.Do(ctx, "EXISTS", d.prefix+key+":lock")
+		if err != nil {
+			return d.fallback(ctx, analyze, err)
+		}
+		if n, _ := redisInt(held); n == 0 {
+			// The lock holder gave up without an answer
+			dedupedAnalyses.Inc("fallback")
+			return analyze(ctx)
+		}
+	}
+}
+
+// redisReleaseLockScript deletes a lock only while it holds the token it was
+// taken with. KEYS[1] lock key; ARGV[1] token. Returns 1 if released.
+const redisReleaseLockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// lead makes the analysis for every replica and shares it. The lock is
+// released when the analysis fails, so the waiting replicas make their own
+// rather than wait it out. A leader slower than lockTTL finds its lock
+// taken over and leaves it alone.
+func (d *AnalysisDeduplicator) lead(ctx context.Context, key, token string, analyze func(context.Context) (*SearchIntent, error)) (*SearchIntent, error) {
+	intent, err := analyze(ctx)
+	// Not the request's context: a client going away must not leave the
+	// lock held
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err == nil {
+		if data, merr := json.Marshal(intent); merr == nil {
+			if _, serr := d.client.Do(storeCtx, "SET", d.prefix+key, string(data), "PX", fmt.Sprint(dedupResultTTL.Milliseconds())); serr != nil {
+				slog.WarnContext(ctx, "Error sharing analysis", "error", serr)
+			}
+		}
+	}
+	if _, derr := d.client.Do(storeCtx, "EVAL", redisReleaseLockScript, "1", d.prefix+key+":lock", token); derr != nil {
+		slog.WarnContext(ctx, "Error releasing analysis lock", "error", derr)
+	}
+	return intent, err
+}
+
+// load returns the analysis another replica shared, or nil
+func (d *AnalysisDeduplicator) load(ctx context.Context, key string) (*SearchIntent, error) {
+	reply, err := d.client.Do(ctx, "GET", d.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply type %T", reply)
+	}
+	var intent SearchIntent
+	if err := json.Unmarshal([]byte(v), &intent); err != nil {
+		return nil, fmt.Errorf("error parsing shared analysis: %v", err)
+	}
+	return &intent, nil
+}
+
+// fallback makes the analysis when Redis can't coordinate it
+func (d *AnalysisDeduplicator) fallback(ctx context.Context, analyze func(context.Context) (*SearchIntent, error), err error) (*SearchIntent, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	slog.WarnContext(ctx, "Analysis deduplication unavailable, analyzing alone", "error", err)
+	dedupedAnalyses.Inc("fallback")
+	return analyze(ctx)
+}
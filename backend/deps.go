@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// HTTPDoer sends outbound HTTP requests. *http.Client is one; tests pass a
+// fake that answers without the network.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Clock returns the current time. Dates in prompts and in the heuristic
+// parser are resolved against it.
+type Clock func() time.Time
+
+// Random returns a number in [0, 1) for sampling decisions
+type Random func() float64
+
+// UseClock replaces the handler's clock, so dates resolve the same way on
+// every run
+func (h *SearchHandler) UseClock(now Clock) {
+	h.now = now
+}
+
+// UseRandom replaces the handler's randomness, so sampling is repeatable
+func (h *SearchHandler) UseRandom(random Random) {
+	h.random = random
+}
+
+// defaultRandom is the handler's randomness unless UseRandom replaces it
+var defaultRandom Random = rand.Float64
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock the test moves by hand
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 3, 18, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// fakeDoer is an HTTPDoer answering the nth request with the nth answer
+type fakeDoer struct {
+	mu      sync.Mutex
+	calls   int
+	answers []func(req *http.Request) (*http.Response, error)
+}
+
+func (d *fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	answer := d.answers[d.calls%len(d.answers)]
+	d.calls++
+	d.mu.Unlock()
+	return answer(req)
+}
+
+func (d *fakeDoer) Calls() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+// fakeResponse is an HTTP response with a body
+func fakeResponse(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(bytes.NewBufferString(body))}
+}
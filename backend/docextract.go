@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxDocxXMLBytes caps the decompressed body of a .docx, against zip bombs
+const maxDocxXMLBytes = 64 << 20
+
+var errNoPDFText = errors.New("no text found in the PDF, scanned pages need OCR first")
+
+// extractDocumentText returns the plain text of an uploaded document
+func extractDocumentText(format string, data []byte) (string, error) {
+	switch format {
+	case "txt", "md":
+		return plainText(data)
+	case "docx":
+		return docxText(data)
+	case "pdf":
+		text, err := pdfText(data)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(text) == "" {
+			return "", errNoPDFText
+		}
+		return text, nil
+	}
+	return "", fmt.Errorf("unsupported format %q", format)
+}
+
+// plainText decodes a text file: UTF-8, or UTF-16 with a byte order mark as
+// Windows editors save it
+func plainText(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		data = data[3:]
+	case bytes.HasPrefix(data, []byte("\xff\xfe")), bytes.HasPrefix(data, []byte("\xfe\xff")):
+		units := make([]uint16, (len(data)-2)/2)
+		for i := range units {
+			lo, hi := data[2+2*i], data[3+2*i]
+			if data[0] == 0xfe {
+				lo, hi = hi, lo
+			}
+			units[i] = uint16(hi)<<8 | uint16(lo)
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	if !utf8.Valid(data) {
+		return "", errors.New("the file is not UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// docxText reads the paragraphs of a Word document's body
+func docxText(data []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a .docx file: %v", err)
+	}
+	var body io.ReadCloser
+	for _, f := range archive.File {
+		if f.Name == "word/document.xml" {
+			if body, err = f.Open(); err != nil {
+				return "", fmt.Errorf("error opening document body: %v", err)
+			}
+			break
+		}
+	}
+	if body == nil {
+		return "", errors.New("not a .docx file: no word/document.xml")
+	}
+	defer body.Close()
+
+	var text strings.Builder
+	decoder := xml.NewDecoder(io.LimitReader(body, maxDocxXMLBytes))
+	inText := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading document body: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+	return text.String(), nil
+}
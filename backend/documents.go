@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// documentChunkWords is the size of the chunks documents are embedded
+	// in, documentChunkOverlap how many words a chunk repeats from the one
+	// before, so a passage cut in two is still found whole
+	documentChunkWords   = 200
+	documentChunkOverlap = 40
+	// maxDocumentChunks caps the embedding spend of one document
+	maxDocumentChunks = 2000
+	// defaultDocumentResults and maxDocumentResults bound a search
+	defaultDocumentResults = 5
+	maxDocumentResults     = 50
+	// hybridCandidates is how many passages each ranking of a hybrid search
+	// contributes to the fusion
+	hybridCandidates = 50
+	// keywordIndexTTL is how long an owner's keyword index is reused.
+	// Changes made through this replica rebuild it at once, those made
+	// through others after at most this long.
+	keywordIndexTTL = time.Minute
+	// maxKeywordIndexes bounds how many owners' indexes are kept
+	maxKeywordIndexes = 1000
+)
+
+// Document search modes: similarity of embeddings, BM25 over the words, or
+// both fused by reciprocal rank
+const (
+	DocumentSearchVector  = "vector"
+	DocumentSearchKeyword = "keyword"
+	DocumentSearchHybrid  = "hybrid"
+)
+
+var (
+	errNoDocumentText  = errors.New("no text found in the document")
+	errDocumentTooLong = fmt.Errorf("document too long, the limit is about %d words", maxDocumentChunks*(documentChunkWords-documentChunkOverlap))
+	errDocumentStore   = errors.New("error storing document")
+)
+
+// documentFormats maps the extensions documents can be uploaded with to
+// their format
+var documentFormats = map[string]string{
+	"pdf": "pdf", "txt": "txt", "text": "txt", "md": "md", "markdown": "md", "docx": "docx",
+}
+
+// documentQueryRes recognize prompts asking to search the caller's own
+// documents rather than the web; the first group is what to search for
+var documentQueryRes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^\s*(?:please\s+)?(?:search|find|look\s+up|look|check)\s+(?:in\s+|through\s+)?(?:my|our)\s+(?:own\s+)?(?:docs|documents|files|notes|uploads)\s*(?:for|about|on|:)?\s+(.+?)\s*$`),
+	regexp.MustCompile(`(?i)^\s*(?:please\s+)?(?:search|find|look\s+up|look\s+for)?\s*(.+?)\s+in\s+(?:my|our)\s+(?:own\s+)?(?:docs|documents|files|notes|uploads)\s*[.?!]?\s*$`),
+}
+
+var (
+	documentsIndexed = metricsRegistry.Counter("documents_indexed_total",
+		"Documents uploaded, by format and result (indexed, no_text, error).", "format", "result")
+	documentSearches = metricsRegistry.Counter("document_searches_total",
+		"Searches of the document index, by how they came in (api, routed) and mode.", "source", "mode")
+)
+
+// Document is an uploaded file whose text is indexed for its owner. The
+// file itself isn't kept, only the text of its chunks.
+type Document struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id,omitempty"`
+	Name     string `json:"name"`
+	Format   string `json:"format"`
+	Bytes    int64  `json:"bytes"`
+	Chunks   int    `json:"chunks"`
+	// EmbeddingModel made the vectors; searches embed with the same model
+	EmbeddingModel string    `json:"embedding_model"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// DocumentChunk is a passage of a document with its embedding
+type DocumentChunk struct {
+	DocumentID string
+	Index      int
+	Text       string
+	Vector     []float64
+}
+
+// ChunkMatch is a passage found by a search, with its similarity
+type ChunkMatch struct {
+	DocumentID   string  `json:"document_id"`
+	DocumentName string  `json:"document_name"`
+	Chunk        int     `json:"chunk"`
+	Text         string  `json:"text"`
+	Score        float64 `json:"score"`
+	// VectorRank and KeywordRank are the places of the passage in the
+	// similarity and BM25 rankings of a hybrid search, zero when absent
+	VectorRank  int `json:"vector_rank,omitempty"`
+	KeywordRank int `json:"keyword_rank,omitempty"`
+}
+
+// chunkText splits text into overlapping windows of words
+func chunkText(text string) []string {
+	words := strings.Fields(text)
+	var chunks []string
+	for start := 0; start < len(words); start += documentChunkWords - documentChunkOverlap {
+		end := min(start+documentChunkWords, len(words))
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+	}
+	return chunks
+}
+
+// documentQuery returns what to search for when the prompt asks to search
+// the caller's own documents
+func documentQuery(prompt string) (string, bool) {
+	for _, re := range documentQueryRes {
+		if m := re.FindStringSubmatch(prompt); m != nil && strings.TrimSpace(m[1]) != "" {
+			return strings.TrimSpace(m[1]), true
+		}
+	}
+	return "", false
+}
+
+// DocumentIndex indexes the documents users upload and searches them
+type DocumentIndex struct {
+	store VectorStore
+	// embed returns the embeddings of texts with model, charging the
+	// caller's budget
+	embed    func(ctx context.Context, texts []string) ([][]float64, error)
+	model    string
+	maxBytes int64
+
+	mu       sync.Mutex
+	keywords map[string]*ownerKeywordIndex
+}
+
+// ownerKeywordIndex is the keyword index of one owner's passages
+type ownerKeywordIndex struct {
+	index   *keywordIndex
+	builtAt time.Time
+}
+
+func NewDocumentIndex(store VectorStore, embed func(ctx context.Context, texts []string) ([][]float64, error), model string, maxBytes int64) *DocumentIndex {
+	return &DocumentIndex{store: store, embed: embed, model: model, maxBytes: maxBytes, keywords: make(map[string]*ownerKeywordIndex)}
+}
+
+// UseDocuments routes prompts asking to search the caller's documents to
+// the index instead of the web
+func (h *SearchHandler) UseDocuments(index *DocumentIndex) {
+	h.documents = index
+}
+
+// routeToDocuments answers a prompt asking to search the caller's documents
+// with the nearest passages, telling whether it did. No intent is analyzed:
+// there is no web search to build.
+func (h *SearchHandler) routeToDocuments(w http.ResponseWriter, r *http.Request, prompt string) bool {
+	if h.documents == nil {
+		return false
+	}
+	query, ok := documentQuery(prompt)
+	if !ok || !h.flags.Enabled(r.Context(), FlagDocuments, true) {
+		return false
+	}
+	// Without an authenticated user only the tenant's shared documents are searched
+	tenantID, userID, _ := authenticatedOwner(r)
+	documentSearches.Inc("routed", DocumentSearchHybrid)
+	matches, err := h.documents.Search(r.Context(), tenantID, userID, query, DocumentSearchHybrid, defaultDocumentResults)
+	if err != nil {
+		writeAnalyzeError(w, r, fmt.Errorf("error searching documents: %w", err))
+		return true
+	}
+	if matches == nil {
+		matches = []*ChunkMatch{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source":   "documents",
+		"query":    query,
+		"matches":  matches,
+		"trace_id": spanFromContext(r.Context()).TraceID(),
+	})
+	return true
+}
+
+// Search returns the passages of the user's and the tenant's shared documents
+// best matching the query in the mode
+func (d *DocumentIndex) Search(ctx context.Context, tenantID, userID, query, mode string, limit int) ([]*ChunkMatch, error) {
+	ctx, span := tracer.Start(ctx, "documents.search", SpanKindInternal)
+	defer span.End()
+	span.SetAttr("documents.mode", mode)
+	var matches []*ChunkMatch
+	var err error
+	switch mode {
+	case DocumentSearchVector:
+		matches, err = d.vectorSearch(ctx, tenantID, userID, query, limit)
+	case DocumentSearchKeyword:
+		matches, err = d.keywordSearch(ctx, tenantID, userID, query, limit)
+	default:
+		// Exact identifiers are found by their words, paraphrases by their
+		// meaning; fusing both rankings finds either in one query
+		candidates := max(limit, hybridCandidates)
+		var byVector, byKeyword []*ChunkMatch
+		if byVector, err = d.vectorSearch(ctx, tenantID, userID, query, candidates); err == nil {
+			if byKeyword, err = d.keywordSearch(ctx, tenantID, userID, query, candidates); err == nil {
+				matches = fuseRanks(limit, byVector, byKeyword)
+			}
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttr("documents.matches", len(matches))
+	return matches, nil
+}
+
+// searchedUsers are whose documents a user's searches look at: their own
+// and the tenant's shared ones, like crawled sites, which have no user
+func searchedUsers(userID string) []string {
+	if userID == "" {
+		return []string{""}
+	}
+	return []string{userID, ""}
+}
+
+// vectorSearch embeds the query and returns the nearest passages
+func (d *DocumentIndex) vectorSearch(ctx context.Context, tenantID, userID, query string, limit int) ([]*ChunkMatch, error) {
+	vectors, err := d.embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	var matches []*ChunkMatch
+	for _, user := range searchedUsers(userID) {
+		found, err := d.store.Search(ctx, tenantID, user, vectors[0], limit)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, found...)
+	}
+	return nearestMatches(matches, limit), nil
+}
+
+// keywordSearch ranks the passages by BM25, building their index from the
+// store when there is none fresh
+func (d *DocumentIndex) keywordSearch(ctx context.Context, tenantID, userID, query string, limit int) ([]*ChunkMatch, error) {
+	key := tenantID + "\x00" + userID
+	d.mu.Lock()
+	cached := d.keywords[key]
+	d.mu.Unlock()
+	if cached == nil || time.Since(cached.builtAt) > keywordIndexTTL {
+		var passages []*ChunkMatch
+		for _, user := range searchedUsers(userID) {
+			found, err := d.store.Passages(ctx, tenantID, user)
+			if err != nil {
+				return nil, err
+			}
+			passages = append(passages, found...)
+		}
+		cached = &ownerKeywordIndex{index: newKeywordIndex(passages), builtAt: time.Now()}
+		d.mu.Lock()
+		if len(d.keywords) >= maxKeywordIndexes {
+			d.evictOldestLocked()
+		}
+		d.keywords[key] = cached
+		d.mu.Unlock()
+	}
+	return cached.index.Search(query, limit), nil
+}
+
+// evictOldestLocked drops the index built longest ago
+func (d *DocumentIndex) evictOldestLocked() {
+	var oldest string
+	for key, cached := range d.keywords {
+		if oldest == "" || cached.builtAt.Before(d.keywords[oldest].builtAt) {
+			oldest = key
+		}
+	}
+	delete(d.keywords, oldest)
+}
+
+// invalidate drops the keyword indexes with the owner's documents after a
+// change: all of the tenant's for a shared document
+func (d *DocumentIndex) invalidate(tenantID, userID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if userID != "" {
+		delete(d.keywords, tenantID+"\x00"+userID)
+		return
+	}
+	for key := range d.keywords {
+		if strings.HasPrefix(key, tenantID+"\x00") {
+			delete(d.keywords, key)
+		}
+	}
+}
+
+// Index chunks and embeds the text, then stores the document with its
+// chunks, replacing any with the same ID
+func (d *DocumentIndex) Index(ctx context.Context, doc *Document, text string) error {
+	chunks := chunkText(text)
+	if len(chunks) == 0 {
+		return errNoDocumentText
+	}
+	if len(chunks) > maxDocumentChunks {
+		return errDocumentTooLong
+	}
+	vectors, err := d.embed(ctx, chunks)
+	if err != nil {
+		return fmt.Errorf("error embedding document: %w", err)
+	}
+	doc.Chunks = len(chunks)
+	doc.EmbeddingModel = d.model
+	stored := make([]*DocumentChunk, len(chunks))
+	for i, text := range chunks {
+		stored[i] = &DocumentChunk{DocumentID: doc.ID, Index: i, Text: text, Vector: vectors[i]}
+	}
+	if err := d.store.Put(ctx, doc, stored); err != nil {
+		return fmt.Errorf("%w: %v", errDocumentStore, err)
+	}
+	d.invalidate(doc.TenantID, doc.UserID)
+	return nil
+}
+
+// Delete deletes one of the owner's documents
+func (d *DocumentIndex) Delete(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	deleted, err := d.store.DeleteOwned(ctx, tenantID, userID, id)
+	if deleted {
+		d.invalidate(tenantID, userID)
+	}
+	return deleted, err
+}
+
+// DeleteAllOwned deletes the owner's documents, for user erasure, along
+// with the keyword index of their text
+func (d *DocumentIndex) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	defer d.invalidate(tenantID, userID)
+	return d.store.DeleteAllOwned(ctx, tenantID, userID)
+}
+
+// handleDocuments lists the caller's documents (GET) or indexes an uploaded
+// one (POST, multipart/form-data with the file in "file")
+func (d *DocumentIndex) handleDocuments(w http.ResponseWriter, r *http.Request) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	d.serveDocuments(w, r, tenantID, userID)
+}
+
+// handleDocument returns (GET) or deletes (DELETE) one of the caller's
+// documents. Documents of other users and shared ones are not found.
+func (d *DocumentIndex) handleDocument(w http.ResponseWriter, r *http.Request) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	d.serveDocument(w, r, tenantID, userID, r.PathValue("id"))
+}
+
+// handleShared manages a tenant's shared documents, which all of its users
+// search, on the admin API: the tenant is ?tenant_id= (default: default),
+// and uploads are charged to its budgets
+func (d *DocumentIndex) handleShared(tenants *TenantRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenantID := r.URL.Query().Get("tenant_id")
+		if tenantID == "" {
+			tenantID = DefaultTenantID
+		}
+		tenant, ok := tenants.ByID(tenantID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown tenant %q", tenantID), http.StatusNotFound)
+			return
+		}
+		r = r.WithContext(withTenant(r.Context(), tenant))
+		if id := r.PathValue("id"); id != "" {
+			d.serveDocument(w, r, tenantID, "", id)
+			return
+		}
+		d.serveDocuments(w, r, tenantID, "")
+	}
+}
+
+// serveDocuments lists or indexes the documents of an owner, the tenant's
+// shared ones when userID is empty
+func (d *DocumentIndex) serveDocuments(w http.ResponseWriter, r *http.Request, tenantID, userID string) {
+	switch r.Method {
+	case http.MethodGet:
+		docs, err := d.store.List(r.Context(), tenantID, userID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error listing documents", "error", err)
+			http.Error(w, "Error listing documents", http.StatusInternalServerError)
+			return
+		}
+		if docs == nil {
+			docs = []*Document{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"documents": docs})
+	case http.MethodPost:
+		d.upload(w, r, tenantID, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *DocumentIndex) upload(w http.ResponseWriter, r *http.Request, tenantID, userID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, d.maxBytes+64<<10)
+	form, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+	upload, err := readFormUpload(form, "file", d.maxBytes)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errUploadTooLarge) || errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("File too large, the limit is %d bytes", d.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	format, ok := documentFormats[upload.format]
+	if !ok {
+		http.Error(w, "Unsupported document format, upload a .pdf, .txt, .md or .docx file", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	text, err := extractDocumentText(format, upload.data)
+	if err != nil {
+		documentsIndexed.Inc(format, "error")
+		slog.WarnContext(r.Context(), "Error reading document", "format", format, "error", err)
+		http.Error(w, fmt.Sprintf("Error reading the document: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	doc := &Document{
+		ID:        newHistoryID(),
+		TenantID:  tenantID,
+		UserID:    userID,
+		Name:      upload.filename,
+		Format:    format,
+		Bytes:     int64(len(upload.data)),
+		CreatedAt: time.Now().UTC(),
+	}
+	err = d.Index(r.Context(), doc, text)
+	switch {
+	case errors.Is(err, errNoDocumentText):
+		documentsIndexed.Inc(format, "no_text")
+		http.Error(w, "No text found in the document", http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errDocumentTooLong):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errDocumentStore):
+		documentsIndexed.Inc(format, "error")
+		slog.ErrorContext(r.Context(), "Error storing document", "error", err)
+		http.Error(w, "Error storing document", http.StatusInternalServerError)
+		return
+	case err != nil:
+		documentsIndexed.Inc(format, "error")
+		writeAnalyzeError(w, r, err)
+		return
+	}
+	documentsIndexed.Inc(format, "indexed")
+	slog.InfoContext(r.Context(), "Indexed document", "id", doc.ID, "format", format, "chunks", doc.Chunks)
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+// serveDocument returns or deletes one of an owner's documents
+func (d *DocumentIndex) serveDocument(w http.ResponseWriter, r *http.Request, tenantID, userID, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		doc, err := d.store.Get(r.Context(), tenantID, userID, id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error reading document", "error", err)
+			http.Error(w, "Error reading document", http.StatusInternalServerError)
+			return
+		}
+		if doc == nil {
+			http.Error(w, "Document not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+	case http.MethodDelete:
+		deleted, err := d.Delete(r.Context(), tenantID, userID, id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting document", "error", err)
+			http.Error(w, "Error deleting document", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Document not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSearch searches the caller's documents and the tenant's shared ones:
+// {"query": "...", "limit": 5, "mode": "hybrid"}
+func (d *DocumentIndex) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+		Mode  string `json:"mode"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Query = strings.TrimSpace(req.Query); req.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultDocumentResults
+	}
+	req.Limit = min(req.Limit, maxDocumentResults)
+	switch req.Mode {
+	case "":
+		req.Mode = DocumentSearchHybrid
+	case DocumentSearchHybrid, DocumentSearchVector, DocumentSearchKeyword:
+	default:
+		http.Error(w, "mode must be hybrid, vector or keyword", http.StatusBadRequest)
+		return
+	}
+	documentSearches.Inc("api", req.Mode)
+	matches, err := d.Search(r.Context(), tenantID, userID, req.Query, req.Mode, req.Limit)
+	if err != nil {
+		writeAnalyzeError(w, r, fmt.Errorf("error searching documents: %w", err))
+		return
+	}
+	if matches == nil {
+		matches = []*ChunkMatch{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"query": req.Query, "mode": req.Mode, "matches": matches})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxExcludedSites caps the -site: operators added to a search URL; engines
+// ignore the words of long queries, so the rest are only dropped from
+// fetched results
+const maxExcludedSites = 10
+
+var resultsBlocked = metricsRegistry.Counter("results_blocked_total",
+	"Fetched results dropped by a tenant's domain blocklist or allowlist.")
+
+// validateDomains normalizes the tenant's blocked and allowed domains to
+// bare hostnames
+func (t *Tenant) validateDomains() error {
+	for _, list := range []*[]string{&t.BlockedDomains, &t.AllowedDomains} {
+		for i, d := range *list {
+			host := sanitizeSiteFilter(strings.TrimPrefix(strings.TrimSpace(d), "*."))
+			if host == "" {
+				return fmt.Errorf("%q is not a domain", d)
+			}
+			(*list)[i] = host
+		}
+	}
+	return nil
+}
+
+// domainUnder tells whether host is domain or one of its subdomains
+func domainUnder(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// DomainBlocked tells whether results from host are dropped for the
+// tenant. With allowed domains, hosts under none of them are. Otherwise the
+// most specific of its blocked and allowed domains matching the host
+// decides, allowed on a tie.
+func (t *Tenant) DomainBlocked(host string) bool {
+	if t == nil || (len(t.BlockedDomains) == 0 && len(t.AllowedDomains) == 0) {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	blocked, allowed := 0, 0
+	for _, d := range t.BlockedDomains {
+		if domainUnder(host, d) && len(d) > blocked {
+			blocked = len(d)
+		}
+	}
+	for _, d := range t.AllowedDomains {
+		if domainUnder(host, d) && len(d) > allowed {
+			allowed = len(d)
+		}
+	}
+	if len(t.AllowedDomains) > 0 && allowed == 0 {
+		return true
+	}
+	return blocked > allowed
+}
+
+// ExcludedSites returns the blocked domains to exclude from the search URL
+// of an intent. A domain with an allowed subdomain is left out, -site:
+// would exclude that too, and so is any but the subdomains of the intent's
+// site filter.
+func (t *Tenant) ExcludedSites(intent *SearchIntent) []string {
+	if t == nil {
+		return nil
+	}
+	var sites []string
+	for _, d := range t.BlockedDomains {
+		// Asking for a site overrides the list, down to its subdomains
+		if intent.SiteFilter != "" && (d == intent.SiteFilter || !domainUnder(d, intent.SiteFilter)) {
+			continue
+		}
+		excepted := false
+		for _, a := range t.AllowedDomains {
+			if domainUnder(a, d) {
+				excepted = true
+				break
+			}
+		}
+		if !excepted && len(sites) < maxExcludedSites {
+			sites = append(sites, d)
+		}
+	}
+	return sites
+}
+
+// filterResults drops the results from the tenant's blocked domains, or
+// outside its allowed ones, unless the intent asks for their site
+func filterResults(t *Tenant, intent *SearchIntent, results []SearchResult) []SearchResult {
+	if t == nil || (len(t.BlockedDomains) == 0 && len(t.AllowedDomains) == 0) {
+		return results
+	}
+	kept := make([]SearchResult, 0, len(results))
+	for _, r := range results {
+		u, err := url.Parse(r.URL)
+		if err == nil && t.DomainBlocked(u.Hostname()) &&
+			(intent.SiteFilter == "" || !domainUnder(strings.ToLower(u.Hostname()), intent.SiteFilter)) {
+			resultsBlocked.Inc()
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
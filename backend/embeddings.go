@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const OPENAI_EMBEDDINGS_URL = "https://api.openai.com/v1/embeddings"
+
+// maxEmbeddingBatch is how many texts one embeddings request carries
+const maxEmbeddingBatch = 100
+
+// maxEmbeddingInputs is how many texts one call of /v1/embeddings may embed
+const maxEmbeddingInputs = 512
+
+var embeddingRequests = metricsRegistry.Counter("embedding_requests_total",
+	"Calls of /v1/embeddings, by result (ok, invalid, error).", "result")
+
+type embeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// embed returns the embedding of each text with model, in order. Batches
+// wait for upstream slots in the tenant's place of the queue, and the spend
+// goes to the budget of the tenant in ctx, or the global one.
+func (h *SearchHandler) embed(ctx context.Context, model string, texts []string) ([][]float64, error) {
+	vectors := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += maxEmbeddingBatch {
+		batch := texts[start:min(start+maxEmbeddingBatch, len(texts))]
+		jsonBody, err := json.Marshal(embeddingRequest{Model: model, Input: batch})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling embeddings request: %v", err)
+		}
+		// Each batch is its own upstream call, so it queues for a slot
+		// like any other; a large input doesn't take several at once
+		release, err := h.limiter.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := h.doWithKeys(ctx, "embeddings", OPENAI_EMBEDDINGS_URL, "application/json", jsonBody)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("error reading response body: %w", err)
+		}
+
+		var embResp embeddingResponse
+		if err := json.Unmarshal(body, &embResp); err != nil {
+			return nil, fmt.Errorf("error parsing embeddings response: %v", err)
+		}
+		cost := costUSD(model, embResp.Usage.PromptTokens, 0)
+		h.budget.Record(ctx, tenantFromContext(ctx), cost)
+		openAITokens.Add(float64(embResp.Usage.PromptTokens), model, "prompt")
+		openAICost.Add(cost, model)
+		if embResp.Error != nil {
+			return nil, fmt.Errorf("OpenAI API error: %s", embResp.Error.Message)
+		}
+		if len(embResp.Data) != len(batch) {
+			return nil, fmt.Errorf("OpenAI returned %d embeddings for %d inputs", len(embResp.Data), len(batch))
+		}
+
+		out := make([][]float64, len(batch))
+		for _, d := range embResp.Data {
+			if d.Index < 0 || d.Index >= len(batch) {
+				return nil, fmt.Errorf("OpenAI returned an embedding for unknown input %d", d.Index)
+			}
+			out[d.Index] = d.Embedding
+		}
+		vectors = append(vectors, out...)
+	}
+	return vectors, nil
+}
+
+// UseEmbeddingModel serves /v1/embeddings with model, the one the document
+// index and few-shot examples are embedded with
+func (h *SearchHandler) UseEmbeddingModel(model string) {
+	h.embeddingModel = model
+}
+
+// handleEmbeddings embeds arbitrary texts for clients building their own
+// retrieval (POST). The request and answer are shaped like OpenAI's, with
+// input a string or a list of them; the model can be left out, and any
+// other than the configured one is refused so vectors stay comparable
+// with the server's own.
+func (h *SearchHandler) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.embeddingModel == "" || !h.flags.Enabled(r.Context(), FlagEmbeddings, true) {
+		http.Error(w, "Embeddings are disabled", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Input json.RawMessage `json:"input"`
+		Model string          `json:"model"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2<<20)).Decode(&req); err != nil {
+		embeddingRequests.Inc("invalid")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model != "" && req.Model != h.embeddingModel {
+		embeddingRequests.Inc("invalid")
+		http.Error(w, fmt.Sprintf("Unsupported model, use %s", h.embeddingModel), http.StatusBadRequest)
+		return
+	}
+	texts, err := embeddingInputs(req.Input)
+	if err != nil {
+		embeddingRequests.Inc("invalid")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+		embeddingRequests.Inc("error")
+		writeAnalyzeError(w, r, err)
+		return
+	}
+	vectors, err := h.embed(ctx, h.embeddingModel, texts)
+	if err != nil {
+		embeddingRequests.Inc("error")
+		slog.WarnContext(ctx, "Error embedding texts", "texts", len(texts), "error", err)
+		writeAnalyzeError(w, r, fmt.Errorf("error embedding texts: %w", err))
+		return
+	}
+	embeddingRequests.Inc("ok")
+	data := make([]map[string]interface{}, len(vectors))
+	for i, vector := range vectors {
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": vector}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"model":  h.embeddingModel,
+		"data":   data,
+	})
+}
+
+// embeddingInputs reads the input of /v1/embeddings, a string or a list
+// of strings, none of them blank
+func embeddingInputs(raw json.RawMessage) ([]string, error) {
+	var texts []string
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		texts = []string{single}
+	} else if err := json.Unmarshal(raw, &texts); err != nil {
+		return nil, fmt.Errorf("input must be a string or a list of strings")
+	}
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("input is required")
+	}
+	if len(texts) > maxEmbeddingInputs {
+		return nil, fmt.Errorf("input may hold at most %d texts", maxEmbeddingInputs)
+	}
+	for i, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			return nil, fmt.Errorf("input %d is empty", i)
+		}
+	}
+	return texts, nil
+}
+
+// cosineSimilarity compares two embeddings, 0 when either is empty or their
+// dimensions differ
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+// SearchEngine is where search URLs point; every engine understands the
+// quote, site:, filetype: and - operators
+type SearchEngine struct {
+	Name    string
+	BaseURL string
+	Param   string
+	// Operators lists the query operators the engine understands, for the
+	// analysis prompt
+	Operators []string
+	// Language is the language the engine's index answers best, the one
+	// queries are translated into
+	Language string
+	// MaxWords and MaxQueryLength are the most words, operators included,
+	// and bytes of a query the engine reads; zero means no limit
+	MaxWords       int
+	MaxQueryLength int
+}
+
+var commonOperators = []string{`"exact phrase"`, "site:", "filetype:", "-exclude"}
+
+var searchEngines = map[string]*SearchEngine{
+	"google":     {Name: "google", BaseURL: "https://www.google.com/search", Param: "q", Operators: append(commonOperators[:len(commonOperators):len(commonOperators)], "after:"), Language: "en", MaxWords: 32, MaxQueryLength: 2048},
+	"bing":       {Name: "bing", BaseURL: "https://www.bing.com/search", Param: "q", Operators: commonOperators, Language: "en", MaxQueryLength: 1500},
+	"duckduckgo": {Name: "duckduckgo", BaseURL: "https://duckduckgo.com/", Param: "q", Operators: commonOperators, Language: "en", MaxQueryLength: 2048},
+}
+
+// defaultEngine builds every search URL; it can be switched at runtime
+var defaultEngine atomic.Pointer[SearchEngine]
+
+func init() {
+	defaultEngine.Store(searchEngines["google"])
+}
+
+// setDefaultEngine switches the engine of new search URLs
+func setDefaultEngine(name string) error {
+	e, ok := searchEngines[name]
+	if !ok {
+		return fmt.Errorf("unknown search engine %q, expected one of %v", name, engineNames())
+	}
+	defaultEngine.Store(e)
+	return nil
+}
+
+func engineNames() []string {
+	names := make([]string, 0, len(searchEngines))
+	for name := range searchEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// URL returns the engine's search URL for a query string
+func (e *SearchEngine) URL(query string) string {
+	params := url.Values{}
+	params.Add(e.Param, query)
+	return fmt.Sprintf("%s?%s", e.BaseURL, params.Encode())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Entity types: what a named entity of the intent is
+const (
+	EntityPerson       = "person"
+	EntityProduct      = "product"
+	EntityOrganization = "organization"
+	EntityLocation     = "location"
+)
+
+var entityTypes = []string{EntityPerson, EntityProduct, EntityOrganization, EntityLocation}
+
+// maxIntentEntities bounds the entities of an intent
+const maxIntentEntities = 10
+
+// Entity verticals: the specialized searches an entity of the intent leads to
+const (
+	// EntityVerticalMaps finds a location on a map
+	EntityVerticalMaps = "maps"
+	// EntityVerticalFinance quotes the stock of a listed organization
+	EntityVerticalFinance = "finance"
+)
+
+var intentEntities = metricsRegistry.Counter("intent_entities_total",
+	"Named entities extracted by analyses, by type.", "type")
+
+// tickerRe is what a ticker must be: a stock symbol like AAPL or BRK.B, no
+// exchange prefix
+var tickerRe = regexp.MustCompile(`^[A-Z]{1,5}(?:[.-][A-Z]{1,2})?$`)
+
+// IntentEntity is a person, product, organization or location the prompt is
+// about
+type IntentEntity struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Ticker is the stock symbol of a listed organization, e.g. MSFT
+	Ticker string `json:"ticker,omitempty"`
+}
+
+// EntityVertical is a specialized search for an entity of the intent, e.g.
+// the map of a place
+type EntityVertical struct {
+	Vertical string `json:"vertical"`
+	Entity   string `json:"entity"`
+	URL      string `json:"url"`
+}
+
+// intentEntitySchema is the JSON schema of the entities of an intent
+var intentEntitySchema = map[string]interface{}{
+	"type": "array",
+	"items": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":   map[string]interface{}{"type": "string"},
+			"type":   map[string]interface{}{"type": "string", "enum": entityTypes},
+			"ticker": map[string]interface{}{"type": "string"},
+		},
+		"required": []string{"name", "type"},
+	},
+}
+
+// sanitizeEntities drops the entities without a name or a known type, and
+// the repeated ones, up to maxIntentEntities. Tickers are kept for
+// organizations only, upper-cased, when they look like one. nil stays nil
+// so the JSON of the intent doesn't change.
+func sanitizeEntities(entities []IntentEntity) []IntentEntity {
+	if entities == nil {
+		return nil
+	}
+	out := make([]IntentEntity, 0, len(entities))
+	seen := make(map[IntentEntity]bool)
+	for _, e := range entities {
+		e.Name = strings.TrimSpace(stripInvisible(e.Name))
+		e.Type = strings.ToLower(strings.TrimSpace(e.Type))
+		if e.Name == "" || !slices.Contains(entityTypes, e.Type) {
+			continue
+		}
+		e.Ticker = strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(stripInvisible(e.Ticker), "$")))
+		if e.Type != EntityOrganization || !tickerRe.MatchString(e.Ticker) {
+			e.Ticker = ""
+		}
+		key := IntentEntity{Name: strings.ToLower(e.Name), Type: e.Type}
+		if seen[key] || len(out) >= maxIntentEntities {
+			continue
+		}
+		seen[key] = true
+		out = append(out, e)
+	}
+	return out
+}
+
+// countEntities counts the entities of an analysis by type
+func countEntities(intent *SearchIntent) {
+	for _, e := range intent.Entities {
+		intentEntities.Inc(e.Type)
+	}
+}
+
+// entityVerticals lists the specialized searches the entities of an intent
+// lead to: the map of every location and the stock quote of every listed
+// organization
+func entityVerticals(intent *SearchIntent) []EntityVertical {
+	var verticals []EntityVertical
+	for _, e := range intent.Entities {
+		switch {
+		case e.Type == EntityLocation:
+			verticals = append(verticals, EntityVertical{
+				Vertical: EntityVerticalMaps,
+				Entity:   e.Name,
+				URL:      "https://www.google.com/maps/search/?api=1&query=" + url.QueryEscape(e.Name),
+			})
+		case e.Ticker != "":
+			verticals = append(verticals, EntityVertical{
+				Vertical: EntityVerticalFinance,
+				Entity:   e.Name,
+				URL:      "https://finance.yahoo.com/quote/" + url.PathEscape(strings.ReplaceAll(e.Ticker, ".", "-")),
+			})
+		}
+	}
+	return verticals
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// builtinEvalCorpus is the golden set used when EVAL_CORPUS_FILE is not set
+//
+//go:embed eval/golden.json
+var builtinEvalCorpus []byte
+
+// evalConcurrency is how many cases of a run are analyzed at once
+const evalConcurrency = 4
+
+var evalFieldAccuracy = metricsRegistry.Gauge("eval_field_accuracy",
+	"Share of golden-set cases whose field matched the expected intent in the last evaluation, by field.", "field")
+
+// EvalCase is a prompt of the golden set and the intent it must produce.
+// Fields listed in Ignore are not scored, for cases where any reasonable
+// answer will do.
+type EvalCase struct {
+	ID       string          `json:"id"`
+	Prompt   string          `json:"prompt"`
+	Locale   string          `json:"locale,omitempty"`
+	Expected json.RawMessage `json:"expected"`
+	Ignore   []string        `json:"ignore,omitempty"`
+
+	expected *SearchIntent
+}
+
+// EvalResult is the outcome of one case
+type EvalResult struct {
+	ID         string        `json:"id"`
+	Passed     bool          `json:"passed"`
+	Mismatched []string      `json:"mismatched,omitempty"`
+	Expected   *SearchIntent `json:"expected"`
+	Actual     *SearchIntent `json:"actual,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	DurationMS int64         `json:"duration_ms"`
+}
+
+// EvalFieldScore is how often a field matched across the scored cases
+type EvalFieldScore struct {
+	Correct  int     `json:"correct"`
+	Scored   int     `json:"scored"`
+	Accuracy float64 `json:"accuracy"`
+}
+
+// EvalReport scores one run of the golden set. Cases that fail to analyze
+// count as wrong on every field they score.
+type EvalReport struct {
+	Analyzer      string                    `json:"analyzer"`
+	Model         string                    `json:"model,omitempty"`
+	PromptVersion string                    `json:"prompt_version,omitempty"`
+	StartedAt     time.Time                 `json:"started_at"`
+	DurationMS    int64                     `json:"duration_ms"`
+	Cases         int                       `json:"cases"`
+	Passed        int                       `json:"passed"`
+	Errors        int                       `json:"errors"`
+	Accuracy      float64                   `json:"accuracy"`
+	Fields        map[string]EvalFieldScore `json:"fields"`
+	Results       []EvalResult              `json:"results"`
+}
+
+// EvalOptions choose what a run evaluates. Empty fields evaluate what
+// production uses.
+type EvalOptions struct {
+	Model         string `json:"model,omitempty"`
+	PromptVersion string `json:"prompt_version,omitempty"`
+	// Cases restricts the run to these case IDs
+	Cases []string `json:"cases,omitempty"`
+	// MinAccuracy is the case pass rate under which the run fails
+	MinAccuracy float64 `json:"min_accuracy,omitempty"`
+}
+
+// Evaluator runs the golden set against the live analyzer, so a prompt or
+// model change that makes intents worse shows before it ships
+type Evaluator struct {
+	h    *SearchHandler
+	path string
+
+	mu   sync.Mutex
+	last *EvalReport
+}
+
+// NewEvaluator loads the corpus from path, or the built-in one when path is
+// empty, to fail at startup on a broken file. The corpus is read again for
+// every run, so edits need no restart.
+func NewEvaluator(h *SearchHandler, path string) (*Evaluator, error) {
+	e := &Evaluator{h: h, path: path}
+	if _, err := e.corpus(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Evaluator) corpus() ([]EvalCase, error) {
+	data := builtinEvalCorpus
+	if e.path != "" {
+		var err error
+		if data, err = os.ReadFile(e.path); err != nil {
+			return nil, fmt.Errorf("error reading eval corpus: %v", err)
+		}
+	}
+	return parseEvalCorpus(data)
+}
+
+func parseEvalCorpus(data []byte) ([]EvalCase, error) {
+	var cases []EvalCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("error parsing eval corpus: %v", err)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("eval corpus has no cases")
+	}
+	seen := make(map[string]bool)
+	for i := range cases {
+		c := &cases[i]
+		if c.ID == "" || seen[c.ID] {
+			return nil, fmt.Errorf("eval case %d: id %q is empty or used twice", i, c.ID)
+		}
+		seen[c.ID] = true
+		if c.Prompt == "" {
+			return nil, fmt.Errorf("eval case %q has no prompt", c.ID)
+		}
+		if len(c.Expected) == 0 {
+			return nil, fmt.Errorf("eval case %q has no expected intent", c.ID)
+		}
+		expected, err := decodeIntentJSON(c.Expected)
+		if err != nil {
+			return nil, fmt.Errorf("eval case %q: error parsing expected intent: %v", c.ID, err)
+		}
+		c.expected = expected
+		for _, field := range c.Ignore {
+			if !slices.Contains(intentFields, field) {
+				return nil, fmt.Errorf("eval case %q ignores unknown field %q", c.ID, field)
+			}
+		}
+	}
+	return cases, nil
+}
+
+// Run analyzes every case and scores the intents field by field. The intent
+// cache and few-shot examples are bypassed: the run measures the prompt and
+// model alone. With heuristicOnly the regex parser is scored instead, for
+// free.
+func (e *Evaluator) Run(ctx context.Context, opts EvalOptions, heuristicOnly bool) (*EvalReport, error) {
+	cases, err := e.corpus()
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Cases) > 0 {
+		cases = slices.DeleteFunc(cases, func(c EvalCase) bool { return !slices.Contains(opts.Cases, c.ID) })
+		if len(cases) == 0 {
+			return nil, fmt.Errorf("no eval case matches %v", opts.Cases)
+		}
+	}
+
+	report := &EvalReport{Analyzer: "openai", StartedAt: time.Now().UTC(), Cases: len(cases)}
+	var analyze func(ctx context.Context, c EvalCase) (*SearchIntent, error)
+	if heuristicOnly {
+		report.Analyzer = "heuristic"
+		analyze = func(ctx context.Context, c EvalCase) (*SearchIntent, error) {
+			return parsePromptHeuristically(c.Prompt, e.h.now()), nil
+		}
+	} else {
+		prompts := e.h.prompts
+		if opts.PromptVersion != "" {
+			if prompts, err = prompts.WithVersion(opts.PromptVersion); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Model != "" {
+			if err := e.h.policy.Validate(AnalyzeOptions{Model: opts.Model}); err != nil {
+				return nil, err
+			}
+		}
+		if err := e.h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+			return nil, err
+		}
+		report.Model, report.PromptVersion = opts.Model, prompts.Version()
+		analyze = func(ctx context.Context, c EvalCase) (*SearchIntent, error) {
+			_, model := e.h.router.Route(c.Prompt, e.h.router.Enabled())
+			if opts.Model != "" {
+				model = opts.Model
+			}
+			system := prompts.System(prompts.Vertical(c.Prompt), NewPromptData(e.h.now(), c.Locale))
+			return e.h.analyzePromptWithOpenAI(ctx, c.Prompt, system, model, defaultTemperature, nil)
+		}
+	}
+
+	report.Results = make([]EvalResult, len(cases))
+	slots := make(chan struct{}, evalConcurrency)
+	var wg sync.WaitGroup
+	for i, c := range cases {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			start := time.Now()
+			intent, err := analyze(ctx, c)
+			res := EvalResult{ID: c.ID, Expected: c.expected, Actual: intent, DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Error = err.Error()
+				res.Mismatched = slices.DeleteFunc(slices.Clone(intentFields), func(f string) bool { return slices.Contains(c.Ignore, f) })
+			} else {
+				res.Mismatched = slices.DeleteFunc(intentFieldDiff(c.expected, intent), func(f string) bool { return slices.Contains(c.Ignore, f) })
+			}
+			res.Passed = err == nil && len(res.Mismatched) == 0
+			report.Results[i] = res
+		}()
+	}
+	wg.Wait()
+
+	report.Fields = make(map[string]EvalFieldScore, len(intentFields))
+	for _, field := range intentFields {
+		var score EvalFieldScore
+		for i, res := range report.Results {
+			if slices.Contains(cases[i].Ignore, field) {
+				continue
+			}
+			score.Scored++
+			if !slices.Contains(res.Mismatched, field) {
+				score.Correct++
+			}
+		}
+		if score.Scored > 0 {
+			score.Accuracy = float64(score.Correct) / float64(score.Scored)
+		}
+		report.Fields[field] = score
+		evalFieldAccuracy.Set(score.Accuracy, field)
+	}
+	for _, res := range report.Results {
+		if res.Passed {
+			report.Passed++
+		}
+		if res.Error != "" {
+			report.Errors++
+		}
+	}
+	report.Accuracy = float64(report.Passed) / float64(report.Cases)
+	report.DurationMS = time.Since(report.StartedAt).Milliseconds()
+
+	e.mu.Lock()
+	e.last = report
+	e.mu.Unlock()
+	return report, nil
+}
+
+// handleEval runs the golden set (POST, with optional EvalOptions as body;
+// ?analyzer=heuristic scores the regex parser) or returns the last report
+// (GET). A run answers 417 when its pass rate is under min_accuracy, so CI
+// can gate on the status code.
+func (e *Evaluator) handleEval(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		e.mu.Lock()
+		last := e.last
+		e.mu.Unlock()
+		if last == nil {
+			http.Error(w, "No evaluation has run yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, last)
+	case http.MethodPost:
+		var opts EvalOptions
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &opts); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		if opts.MinAccuracy < 0 || opts.MinAccuracy > 1 {
+			http.Error(w, "min_accuracy must be between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		report, err := e.Run(r.Context(), opts, r.URL.Query().Get("analyzer") == "heuristic")
+		var budgetErr *BudgetExceededError
+		if errors.As(err, &budgetErr) {
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusOK
+		if report.Accuracy < opts.MinAccuracy {
+			status = http.StatusExpectationFailed
+		}
+		writeJSON(w, status, report)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
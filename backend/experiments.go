@@ -0,0 +1,507 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Experiment events counted per variant
+const (
+	ExperimentSearch     = "search"
+	ExperimentFailure    = "failure"
+	ExperimentClick      = "click"
+	ExperimentRatingUp   = "rating_up"
+	ExperimentRatingDown = "rating_down"
+)
+
+// maxTrackedSearches bounds the searches remembered for attributing later
+// feedback to their variant
+const maxTrackedSearches = 100000
+
+var experimentEvents = metricsRegistry.Counter("experiment_events_total",
+	"Analyses and feedback of searches in experiments, by experiment, variant and event (search, failure, click, rating_up, rating_down).", "experiment", "variant", "event")
+
+// Variant is one arm of an experiment. Empty fields keep the server's
+// settings, so a control variant sets nothing.
+type Variant struct {
+	Name string `json:"name"`
+	// Weight is the variant's share of the traffic, relative to the others
+	Weight        float64 `json:"weight"`
+	PromptVersion string  `json:"prompt_version,omitempty"`
+	Model         string  `json:"model,omitempty"`
+}
+
+// Experiment splits analyses between variants. Users keep their variant
+// for as long as the experiment's variants don't change; requests without
+// X-User-ID are assigned one by one.
+type Experiment struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	Variants    []Variant `json:"variants"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Assignment is the variant an analysis runs with
+type Assignment struct {
+	Experiment string
+	Variant    string
+	// prompts and model replace the server's when set
+	prompts *PromptTemplate
+	model   string
+}
+
+// variantStats are the counts of one variant since the server started
+type variantStats struct {
+	Searches        int `json:"searches"`
+	Failures        int `json:"failures"`
+	ClickedSearches int `json:"clicked_searches"`
+	RatingsUp       int `json:"ratings_up"`
+	RatingsDown     int `json:"ratings_down"`
+}
+
+// trackedSearch remembers the variant of a recorded search
+type trackedSearch struct {
+	id         string
+	experiment string
+	variant    string
+	clicked    bool
+	rating     string
+}
+
+// Experiments holds the experiments, saved to path after every admin change
+// and reloaded when the file changes. At most one runs at a time, so
+// variants never mix.
+type Experiments struct {
+	path    string
+	prompts *PromptTemplate
+	policy  *ModelPolicy
+
+	mu          sync.RWMutex
+	experiments map[string]*Experiment
+	stats       map[string]map[string]*variantStats
+	order       *list.List // oldest tracked search first
+	searches    map[string]*list.Element
+}
+
+// NewExperiments loads the experiments saved at path, if any. Variants may
+// use the prompt versions prompts can load and the models policy allows.
+func NewExperiments(path string, prompts *PromptTemplate, policy *ModelPolicy) (*Experiments, error) {
+	x := &Experiments{
+		path:        path,
+		prompts:     prompts,
+		policy:      policy,
+		experiments: make(map[string]*Experiment),
+		stats:       make(map[string]map[string]*variantStats),
+		order:       list.New(),
+		searches:    make(map[string]*list.Element),
+	}
+	if path == "" {
+		return x, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading experiments file: %v", err)
+	}
+	if err := x.Reload(data); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *Experiments) validate(e *Experiment) error {
+	if !flagNameRe.MatchString(e.Name) {
+		return fmt.Errorf("experiment name %q must be lowercase letters, digits and _", e.Name)
+	}
+	if len(e.Variants) < 2 {
+		return fmt.Errorf("experiment %q needs at least two variants", e.Name)
+	}
+	seen := make(map[string]bool)
+	total := 0.0
+	for _, v := range e.Variants {
+		if !flagNameRe.MatchString(v.Name) {
+			return fmt.Errorf("experiment %q: variant name %q must be lowercase letters, digits and _", e.Name, v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("experiment %q: variant %q is defined twice", e.Name, v.Name)
+		}
+		seen[v.Name] = true
+		if v.Weight < 0 {
+			return fmt.Errorf("experiment %q: variant %q has a negative weight", e.Name, v.Name)
+		}
+		total += v.Weight
+		if v.PromptVersion != "" {
+			if _, err := x.prompts.WithVersion(v.PromptVersion); err != nil {
+				return fmt.Errorf("experiment %q: variant %q: %v", e.Name, v.Name, err)
+			}
+		}
+		if v.Model != "" {
+			if err := x.policy.Validate(AnalyzeOptions{Model: v.Model}); err != nil {
+				return fmt.Errorf("experiment %q: variant %q: %v", e.Name, v.Name, err)
+			}
+		}
+	}
+	if total <= 0 {
+		return fmt.Errorf("experiment %q: the variant weights must add up to more than 0", e.Name)
+	}
+	return nil
+}
+
+var errExperimentRunning = errors.New("only one experiment can be enabled at a time")
+
+// checkRunning rejects a second enabled experiment
+func checkRunning(experiments map[string]*Experiment) error {
+	var running []string
+	for name, e := range experiments {
+		if e.Enabled {
+			running = append(running, name)
+		}
+	}
+	if len(running) > 1 {
+		sort.Strings(running)
+		return fmt.Errorf("%w, found %s", errExperimentRunning, strings.Join(running, ", "))
+	}
+	return nil
+}
+
+// Reload validates new experiment definitions and swaps them in; on error
+// the current experiments stay in place
+func (x *Experiments) Reload(data []byte) error {
+	var defs []*Experiment
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("error parsing experiments file: %v", err)
+	}
+	experiments := make(map[string]*Experiment, len(defs))
+	for _, e := range defs {
+		if err := x.validate(e); err != nil {
+			return err
+		}
+		experiments[e.Name] = e
+	}
+	if err := checkRunning(experiments); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.experiments = experiments
+	return nil
+}
+
+// List returns the experiments sorted by name
+func (x *Experiments) List() []Experiment {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	out := make([]Experiment, 0, len(x.experiments))
+	for _, e := range x.experiments {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Set creates or replaces an experiment
+func (x *Experiments) Set(e Experiment) error {
+	if err := x.validate(&e); err != nil {
+		return err
+	}
+	e.UpdatedAt = time.Now().UTC()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prev, existed := x.experiments[e.Name]
+	x.experiments[e.Name] = &e
+	err := checkRunning(x.experiments)
+	if err == nil {
+		err = x.save()
+	}
+	if err != nil {
+		if existed {
+			x.experiments[e.Name] = prev
+		} else {
+			delete(x.experiments, e.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes an experiment and its results
+func (x *Experiments) Delete(name string) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prev, ok := x.experiments[name]
+	if !ok {
+		return false, nil
+	}
+	delete(x.experiments, name)
+	if err := x.save(); err != nil {
+		x.experiments[name] = prev
+		return false, err
+	}
+	delete(x.stats, name)
+	return true, nil
+}
+
+// save writes the experiments to the file; the caller holds the lock
+func (x *Experiments) save() error {
+	if x.path == "" {
+		return nil
+	}
+	defs := make([]*Experiment, 0, len(x.experiments))
+	for _, e := range x.experiments {
+		defs = append(defs, e)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling experiments: %v", err)
+	}
+	if err := writeFileAtomic(x.path, data); err != nil {
+		return fmt.Errorf("error saving experiments: %v", err)
+	}
+	return nil
+}
+
+// UseExperiments splits the analyses between the variants of the running
+// experiment
+func (h *SearchHandler) UseExperiments(experiments *Experiments) {
+	h.experiments = experiments
+}
+
+// Assign picks the variant of the running experiment for the request in
+// ctx, or returns nil when no experiment runs
+func (x *Experiments) Assign(ctx context.Context) *Assignment {
+	if x == nil {
+		return nil
+	}
+	x.mu.RLock()
+	var running *Experiment
+	for _, e := range x.experiments {
+		if e.Enabled {
+			running = e
+		}
+	}
+	x.mu.RUnlock()
+	if running == nil {
+		return nil
+	}
+
+	// Users stick to a variant; anonymous requests are split one by one
+	unit := requestIDFromContext(ctx)
+	if info := requestInfoFromContext(ctx); info != nil && info.user != "" {
+		tenantID := DefaultTenantID
+		if t := tenantFromContext(ctx); t != nil {
+			tenantID = t.ID
+		}
+		unit = tenantID + "\x00" + info.user
+	}
+	total := 0.0
+	for _, v := range running.Variants {
+		total += v.Weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(running.Name + "\x00" + unit))
+	point := float64(h.Sum32()%10000) / 10000 * total
+
+	variant := running.Variants[len(running.Variants)-1]
+	for _, v := range running.Variants {
+		if point < v.Weight {
+			variant = v
+			break
+		}
+		point -= v.Weight
+	}
+	a := &Assignment{Experiment: running.Name, Variant: variant.Name, model: variant.Model}
+	if variant.PromptVersion != "" {
+		// Loaded when the experiment was saved, so this doesn't fail
+		a.prompts, _ = x.prompts.WithVersion(variant.PromptVersion)
+	}
+	return a
+}
+
+// Observe counts an analysis event of an assignment
+func (x *Experiments) Observe(a *Assignment, event string) {
+	if x == nil || a == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.count(a.Experiment, a.Variant, event, 1)
+}
+
+// count adds n to an event of a variant; the caller holds the lock
+func (x *Experiments) count(experiment, variant, event string, n int) {
+	if x.stats[experiment] == nil {
+		x.stats[experiment] = make(map[string]*variantStats)
+	}
+	s := x.stats[experiment][variant]
+	if s == nil {
+		s = &variantStats{}
+		x.stats[experiment][variant] = s
+	}
+	switch event {
+	case ExperimentSearch:
+		s.Searches += n
+	case ExperimentFailure:
+		s.Failures += n
+	case ExperimentClick:
+		s.ClickedSearches += n
+	case ExperimentRatingUp:
+		s.RatingsUp += n
+	case ExperimentRatingDown:
+		s.RatingsDown += n
+	}
+	if n > 0 {
+		experimentEvents.Add(float64(n), experiment, variant, event)
+	}
+}
+
+// Track remembers the variant of a recorded search, so feedback on it
+// counts for the variant
+func (x *Experiments) Track(searchID string, result *AnalysisResult) {
+	if x == nil || searchID == "" || result.Variant == "" {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.searches[searchID] = x.order.PushBack(&trackedSearch{id: searchID, experiment: result.Experiment, variant: result.Variant})
+	for x.order.Len() > maxTrackedSearches {
+		oldest := x.order.Remove(x.order.Front()).(*trackedSearch)
+		delete(x.searches, oldest.id)
+	}
+}
+
+// Feedback counts a click on a result or a rating (ExperimentRatingUp,
+// ExperimentRatingDown) of a tracked search. Each search counts once as clicked, and a new rating
+// replaces the search's earlier one.
+func (x *Experiments) Feedback(searchID, event string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	el, ok := x.searches[searchID]
+	if !ok {
+		return
+	}
+	s := el.Value.(*trackedSearch)
+	switch event {
+	case ExperimentClick:
+		if !s.clicked {
+			s.clicked = true
+			x.count(s.experiment, s.variant, ExperimentClick, 1)
+		}
+	case ExperimentRatingUp, ExperimentRatingDown:
+		if s.rating == event {
+			return
+		}
+		if s.rating != "" {
+			x.count(s.experiment, s.variant, s.rating, -1)
+		}
+		s.rating = event
+		x.count(s.experiment, s.variant, event, 1)
+	}
+}
+
+// handleAdmin lists (GET), creates or updates (PUT, an Experiment as body)
+// and deletes (DELETE ?name=) experiments
+func (x *Experiments) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"experiments": x.List()})
+
+	case http.MethodPut:
+		var e Experiment
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&e); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		e.Name = strings.TrimSpace(e.Name)
+		if err := x.validate(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := x.Set(e); errors.Is(err, errExperimentRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Error saving experiment", "experiment", e.Name, "error", err)
+			http.Error(w, "Error saving experiment", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Experiment updated", "experiment", e.Name, "enabled", e.Enabled, "variants", len(e.Variants))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"experiments": x.List()})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		deleted, err := x.Delete(name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting experiment", "experiment", name, "error", err)
+			http.Error(w, "Error saving experiments", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Experiment not found", http.StatusNotFound)
+			return
+		}
+		slog.InfoContext(r.Context(), "Experiment deleted", "experiment", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleResults reports each experiment's variants with their counts and
+// rates since the server started: failure rate of the analyses, click
+// through rate and share of up ratings
+func (x *Experiments) handleResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rate := func(n, of int) interface{} {
+		if of == 0 {
+			return nil
+		}
+		return float64(n) / float64(of)
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	out := make([]map[string]interface{}, 0, len(x.experiments))
+	for _, e := range x.experiments {
+		variants := make([]map[string]interface{}, 0, len(e.Variants))
+		for _, v := range e.Variants {
+			s := variantStats{}
+			if recorded := x.stats[e.Name][v.Name]; recorded != nil {
+				s = *recorded
+			}
+			variants = append(variants, map[string]interface{}{
+				"name":               v.Name,
+				"weight":             v.Weight,
+				"prompt_version":     v.PromptVersion,
+				"model":              v.Model,
+				"stats":              s,
+				"failure_rate":       rate(s.Failures, s.Searches+s.Failures),
+				"click_through_rate": rate(s.ClickedSearches, s.Searches),
+				"approval_rate":      rate(s.RatingsUp, s.RatingsUp+s.RatingsDown),
+			})
+		}
+		out = append(out, map[string]interface{}{"name": e.Name, "enabled": e.Enabled, "variants": variants})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"experiments": out})
+}
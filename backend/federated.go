@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Intent scopes: where the answer to a prompt is likely to be when the
+// tenant's documents are searched along with the web
+const (
+	IntentScopeWeb   = "web"
+	IntentScopeLocal = "local"
+	IntentScopeBoth  = "both"
+)
+
+var intentScopes = []string{IntentScopeWeb, IntentScopeLocal, IntentScopeBoth}
+
+const (
+	// federatedLocalResults is how many documents are blended into the web
+	// results, more when the prompt is about them
+	federatedLocalResults      = 3
+	federatedLocalResultsLocal = 5
+	// federatedSnippetRunes bounds the passage shown for a document
+	federatedSnippetRunes = 300
+)
+
+// federatedWeights weigh the web and local rankings by scope: a prompt about
+// the organization puts its documents first, a general one mixes both
+var federatedWeights = map[string]struct{ web, local float64 }{
+	IntentScopeLocal: {web: 0.5, local: 1},
+	IntentScopeBoth:  {web: 1, local: 1},
+}
+
+// localScopeRe recognizes prompts about the organization's own knowledge,
+// for analyses that didn't tell the scope
+var localScopeRe = regexp.MustCompile(`(?i)\b(?:internal(?:ly)?|intranet|(?:our|team|company|the)\s+wiki|confluence|notion|sharepoint|runbooks?|playbooks?|handbook|onboarding|our\s+(?:docs|documentation|policy|policies|process(?:es)?|team|company|guidelines?|codebase|services?)|(?:company|team|hr|it)\s+(?:policy|policies|docs|guidelines?))\b`)
+
+var federatedSearches = metricsRegistry.Counter("federated_searches_total",
+	"Searches whose results blend the web and the tenant's documents, by scope.", "scope")
+
+// FederatedResult is a result of a federated search, from the results
+// provider (source web) or the tenant's documents (source local)
+type FederatedResult struct {
+	Source  string `json:"source"`
+	Title   string `json:"title"`
+	URL     string `json:"url,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+	// SnippetHTML is the snippet with the terms of the search marked, as
+	// for web results
+	SnippetHTML string `json:"snippet_html,omitempty"`
+	// DocumentID is the matching document of a local result
+	DocumentID string  `json:"document_id,omitempty"`
+	Score      float64 `json:"score"`
+}
+
+// normalizeScope returns a known scope, or "" for anything else
+func normalizeScope(scope string) string {
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	for _, s := range intentScopes {
+		if scope == s {
+			return s
+		}
+	}
+	return ""
+}
+
+// classifyScope picks the scope of a prompt by its wording, for analyses
+// that didn't tell it (the v1 prompts, the heuristic parser)
+func classifyScope(prompt string) string {
+	if localScopeRe.MatchString(prompt) {
+		return IntentScopeLocal
+	}
+	return IntentScopeBoth
+}
+
+// federates tells whether searches can blend the tenant's documents into
+// the web results
+func (h *SearchHandler) federates() bool {
+	return h.documents != nil && h.results != nil
+}
+
+// federatedResults searches the web and the caller's documents in parallel
+// and sets the results of the response to both, merged by weighted
+// reciprocal rank in the proportions the scope of the intent asks for. A
+// source that fails leaves the other's results.
+func (h *SearchHandler) federatedResults(r *http.Request, prompt string, intent *SearchIntent, locale string, response map[string]interface{}) {
+	ctx, span := tracer.Start(r.Context(), "search.federated", SpanKindInternal)
+	defer span.End()
+	scope := intent.Scope
+	if scope == "" {
+		scope = classifyScope(prompt)
+	}
+	span.SetAttr("search.scope", scope)
+	federatedSearches.Inc(scope)
+	response["scope"] = scope
+
+	var wg sync.WaitGroup
+	var web *ResultsPage
+	var served string
+	var webErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q := ResultsQuery{Query: buildQueryString(intent), Engine: defaultEngine.Load().Name, Locale: locale}
+		web, served, webErr = h.results.Page(ctx, q)
+	}()
+	var local []*ChunkMatch
+	var localErr error
+	if scope != IntentScopeWeb {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit := federatedLocalResults
+			if scope == IntentScopeLocal {
+				limit = federatedLocalResultsLocal
+			}
+			local, localErr = h.localResults(ctx, r, intent, limit)
+		}()
+	}
+	wg.Wait()
+
+	if webErr != nil {
+		slog.WarnContext(ctx, "Error fetching results", "error", webErr)
+		response["results_error"] = "results provider unavailable"
+	} else {
+		response["results_cache"] = served
+		if web.Entity != nil {
+			response["entity"] = web.Entity
+		}
+		if len(web.RelatedQuestions) > 0 {
+			relatedQuestionRequests.Inc("engine")
+			response["related_questions"] = web.RelatedQuestions
+		}
+	}
+	if localErr != nil {
+		slog.WarnContext(ctx, "Error searching documents", "error", localErr)
+		response["local_results_error"] = "document search unavailable"
+	}
+	var webResults []SearchResult
+	if web != nil {
+		webResults = web.Results
+	}
+	merged := mergeFederated(scope, filterResults(tenantFromContext(ctx), intent, webResults), local)
+	if highlighter := NewHighlighter(intent); !highlighter.Empty() {
+		for _, result := range merged {
+			if result.Snippet != "" {
+				result.SnippetHTML = highlighter.HTML(result.Snippet)
+			}
+		}
+	}
+	response["results"] = merged
+}
+
+// localResults returns the caller's best matching documents, one passage
+// each
+func (h *SearchHandler) localResults(ctx context.Context, r *http.Request, intent *SearchIntent, limit int) ([]*ChunkMatch, error) {
+	query := strings.TrimSpace(strings.Join(append([]string{intent.MainQuery}, intent.ExactPhrases...), " "))
+	if query == "" {
+		return nil, nil
+	}
+	tenantID, userID, _ := authenticatedOwner(r)
+	documentSearches.Inc("federated", DocumentSearchHybrid)
+	// Several passages of a document are one result
+	matches, err := h.documents.Search(ctx, tenantID, userID, query, DocumentSearchHybrid, limit*3)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var out []*ChunkMatch
+	for _, m := range matches {
+		if !seen[m.DocumentID] && len(out) < limit {
+			seen[m.DocumentID] = true
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// mergeFederated merges the web results and document matches by weighted
+// reciprocal rank. A crawled page that is also a web result is listed once,
+// as local, with both scores.
+func mergeFederated(scope string, web []SearchResult, local []*ChunkMatch) []*FederatedResult {
+	weights, ok := federatedWeights[scope]
+	if !ok {
+		weights = federatedWeights[IntentScopeBoth]
+	}
+	merged := make([]*FederatedResult, 0, len(web)+len(local))
+	byURL := make(map[string]*FederatedResult)
+	for i, m := range local {
+		result := &FederatedResult{
+			Source:     "local",
+			Title:      m.DocumentName,
+			Snippet:    truncate(m.Text, federatedSnippetRunes),
+			DocumentID: m.DocumentID,
+			Score:      weights.local / float64(rrfK+i+1),
+		}
+		// Crawled pages are named by their URL
+		if strings.HasPrefix(m.DocumentName, "http://") || strings.HasPrefix(m.DocumentName, "https://") {
+			result.URL = m.DocumentName
+			byURL[m.DocumentName] = result
+		}
+		merged = append(merged, result)
+	}
+	for i, w := range web {
+		score := weights.web / float64(rrfK+i+1)
+		if result, ok := byURL[w.URL]; ok {
+			result.Title = w.Title
+			result.Score += score
+			continue
+		}
+		merged = append(merged, &FederatedResult{Source: "web", Title: w.Title, URL: w.URL, Snippet: w.Snippet, Score: score})
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Score > merged[j].Score })
+	return merged
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	feedbackClicks = metricsRegistry.Counter("feedback_clicks_total",
+		"Result clicks reported by clients, by engine and whether the result was on the first three positions (top3, lower, unknown).", "engine", "position")
+	feedbackRatings = metricsRegistry.Counter("feedback_ratings_total",
+		"Intent ratings reported by clients, by rating and whether a corrected intent came with it.", "rating", "corrected")
+)
+
+// ClickFeedback records that a user opened a result of one of their
+// searches. The search's prompt and intent are copied in, so the click is
+// still usable for evaluation after the history entry expires.
+type ClickFeedback struct {
+	ID       string `json:"id"`
+	SearchID string `json:"search_id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id,omitempty"`
+	URL      string `json:"url"`
+	Engine   string `json:"engine,omitempty"`
+	// Position is the 1-based rank of the result, zero when unknown
+	Position  int           `json:"position,omitempty"`
+	Prompt    string        `json:"prompt,omitempty"`
+	Intent    *SearchIntent `json:"intent,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+const (
+	RatingUp   = "up"
+	RatingDown = "down"
+)
+
+// IntentFeedback is a user's verdict on how a search prompt was parsed, with
+// the intent they expected when they rated it down. Pairs of prompt and
+// correct intent are the analyzer's training data.
+type IntentFeedback struct {
+	ID       string `json:"id"`
+	SearchID string `json:"search_id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id,omitempty"`
+	// Rating is RatingUp or RatingDown
+	Rating string        `json:"rating"`
+	Prompt string        `json:"prompt,omitempty"`
+	Intent *SearchIntent `json:"intent,omitempty"`
+	// Correction is the intent the user expected, only on RatingDown
+	Correction *SearchIntent `json:"correction,omitempty"`
+	Comment    string        `json:"comment,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	// ApprovedAt is when an admin approved the correction as a few-shot
+	// example, nil until then; rating the search again withdraws it
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	// Redacted lists the kinds of personal data taken out of Prompt
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// hasPII tells ratings that must not reach other users' analyses or the
+// training data: those of prompts with personal data, redacted or stored
+// before prompts were
+func (f *IntentFeedback) hasPII() bool {
+	return len(f.Redacted) > 0 || len(redactPII(f.Prompt).kinds) > 0
+}
+
+// FeedbackStore keeps what users tell us about searches
+type FeedbackStore interface {
+	AddClick(ctx context.Context, c *ClickFeedback) error
+	// ListClicks returns up to limit clicks after (since, afterID) in
+	// (created_at, id) order, of one tenant or of all when tenantID is
+	// empty. An empty afterID includes the clicks created at since.
+	ListClicks(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*ClickFeedback, error)
+	// AddRating stores a rating, replacing an earlier one of the same search
+	AddRating(ctx context.Context, f *IntentFeedback) error
+	// ListRatings returns up to limit ratings after (since, afterID) in
+	// (created_at, id) order, of one tenant or of all when tenantID is
+	// empty. An empty afterID includes the ratings created at since.
+	ListRatings(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*IntentFeedback, error)
+	// GetRating returns one rating, nil when there is none
+	GetRating(ctx context.Context, id string) (*IntentFeedback, error)
+	// SetApproval approves a rating's correction at the given time, or
+	// withdraws the approval with nil
+	SetApproval(ctx context.Context, id string, at *time.Time) error
+	// ListApproved returns up to limit approved ratings after (since,
+	// afterID) in (approved_at, id) order, of all tenants
+	ListApproved(ctx context.Context, since time.Time, afterID string, limit int) ([]*IntentFeedback, error)
+	// PurgeBefore deletes feedback created before cutoff
+	PurgeBefore(ctx context.Context, cutoff time.Time) (int, error)
+	// DeleteAllOwned deletes the owner's feedback, for user erasure
+	DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error)
+}
+
+// memoryFeedbackStore keeps feedback in process memory, mainly for development
+type memoryFeedbackStore struct {
+	mu      sync.RWMutex
+	clicks  []*ClickFeedback
+	ratings []*IntentFeedback
+}
+
+func NewMemoryFeedbackStore() *memoryFeedbackStore {
+	return &memoryFeedbackStore{}
+}
+
+func (s *memoryFeedbackStore) AddClick(ctx context.Context, c *ClickFeedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clicks = append(s.clicks, c)
+	return nil
+}
+
+func (s *memoryFeedbackStore) ListClicks(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*ClickFeedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*ClickFeedback
+	for _, c := range s.clicks {
+		if tenantID != "" && c.TenantID != tenantID {
+			continue
+		}
+		if c.CreatedAt.After(since) || (c.CreatedAt.Equal(since) && c.ID > afterID) {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryFeedbackStore) AddRating(ctx context.Context, f *IntentFeedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ratings = slices.DeleteFunc(s.ratings, func(old *IntentFeedback) bool { return old.SearchID == f.SearchID })
+	s.ratings = append(s.ratings, f)
+	return nil
+}
+
+func (s *memoryFeedbackStore) ListRatings(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*IntentFeedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*IntentFeedback
+	for _, f := range s.ratings {
+		if tenantID != "" && f.TenantID != tenantID {
+			continue
+		}
+		if f.CreatedAt.After(since) || (f.CreatedAt.Equal(since) && f.ID > afterID) {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryFeedbackStore) GetRating(ctx context.Context, id string) (*IntentFeedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.ratings {
+		if f.ID == id {
+			copied := *f
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryFeedbackStore) SetApproval(ctx context.Context, id string, at *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.ratings {
+		if f.ID == id {
+			// Ratings are shared with readers, so they are replaced rather
+			// than changed
+			approved := *f
+			approved.ApprovedAt = at
+			s.ratings[i] = &approved
+		}
+	}
+	return nil
+}
+
+func (s *memoryFeedbackStore) ListApproved(ctx context.Context, since time.Time, afterID string, limit int) ([]*IntentFeedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*IntentFeedback
+	for _, f := range s.ratings {
+		if f.ApprovedAt == nil {
+			continue
+		}
+		if f.ApprovedAt.After(since) || (f.ApprovedAt.Equal(since) && f.ID > afterID) {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].ApprovedAt.Equal(*out[j].ApprovedAt) {
+			return out[i].ApprovedAt.Before(*out[j].ApprovedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryFeedbackStore) PurgeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.clicks) + len(s.ratings)
+	s.clicks = slices.DeleteFunc(s.clicks, func(c *ClickFeedback) bool { return c.CreatedAt.Before(cutoff) })
+	s.ratings = slices.DeleteFunc(s.ratings, func(f *IntentFeedback) bool { return f.CreatedAt.Before(cutoff) })
+	return n - len(s.clicks) - len(s.ratings), nil
+}
+
+func (s *memoryFeedbackStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.clicks) + len(s.ratings)
+	s.clicks = slices.DeleteFunc(s.clicks, func(c *ClickFeedback) bool {
+		return c.TenantID == tenantID && c.UserID == userID
+	})
+	s.ratings = slices.DeleteFunc(s.ratings, func(f *IntentFeedback) bool {
+		return f.TenantID == tenantID && f.UserID == userID
+	})
+	return n - len(s.clicks) - len(s.ratings), nil
+}
+
+// FeedbackService records feedback against the caller's search history
+type FeedbackService struct {
+	store   FeedbackStore
+	history HistoryStore
+	// prompts renders the system prompt of fine-tuning examples
+	prompts *PromptTemplate
+	// experiments gets the feedback on searches of experiment variants
+	experiments *Experiments
+	// fewShot forgets the corrections whose approval is withdrawn, nil
+	// when few-shot examples are off
+	fewShot *FewShotIndex
+}
+
+func NewFeedbackService(store FeedbackStore, history HistoryStore, prompts *PromptTemplate, experiments *Experiments) *FeedbackService {
+	return &FeedbackService{store: store, history: history, prompts: prompts, experiments: experiments}
+}
+
+// UseFewShot has withdrawn approvals take the corrections out of the
+// few-shot examples right away
+func (f *FeedbackService) UseFewShot(index *FewShotIndex) {
+	f.fewShot = index
+}
+
+// handleClick records which result the caller opened: {"search_id": "...",
+// "url": "https://...", "position": 2}. The search_id comes from the /search
+// response and must be one of the caller's own searches.
+func (f *FeedbackService) handleClick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		SearchID string `json:"search_id"`
+		URL      string `json:"url"`
+		Engine   string `json:"engine"`
+		Position int    `json:"position"`
+		// Intent is only used for encrypted searches, whose intent the
+		// server can't read
+		Intent *SearchIntent `json:"intent"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+	if req.Position < 0 {
+		http.Error(w, "position must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	rec, err := f.history.Get(r.Context(), tenantID, userID, req.SearchID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading history entry", "error", err)
+		http.Error(w, "Error recording feedback", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil {
+		http.Error(w, "Search not found", http.StatusNotFound)
+		return
+	}
+
+	click := &ClickFeedback{
+		ID:        newHistoryID(),
+		SearchID:  rec.ID,
+		TenantID:  tenantID,
+		UserID:    userID,
+		URL:       req.URL,
+		Engine:    rec.Engine,
+		Position:  req.Position,
+		Prompt:    rec.Prompt,
+		Intent:    rec.Intent,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.Engine != "" {
+		if _, ok := searchEngines[req.Engine]; !ok {
+			http.Error(w, "unknown engine", http.StatusBadRequest)
+			return
+		}
+		click.Engine = req.Engine
+	}
+	if click.Intent == nil {
+		click.Intent = req.Intent
+	}
+	if err := f.store.AddClick(r.Context(), click); err != nil {
+		slog.ErrorContext(r.Context(), "Error storing click feedback", "error", err)
+		http.Error(w, "Error recording feedback", http.StatusInternalServerError)
+		return
+	}
+
+	position := "unknown"
+	switch {
+	case click.Position > 3:
+		position = "lower"
+	case click.Position > 0:
+		position = "top3"
+	}
+	feedbackClicks.Inc(click.Engine, position)
+	f.experiments.Feedback(click.SearchID, ExperimentClick)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": click.ID})
+}
+
+// handleAdminClicks lists recorded clicks for offline evaluation, oldest
+// first: ?tenant_id=, since (RFC 3339) and limit (default 1000, at most 10000)
+func (f *FeedbackService) handleAdminClicks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	var since time.Time
+	if v := params.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := 1000
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	clicks, err := f.store.ListClicks(r.Context(), params.Get("tenant_id"), since, "", limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing click feedback", "error", err)
+		http.Error(w, "Error listing feedback", http.StatusInternalServerError)
+		return
+	}
+	if clicks == nil {
+		clicks = []*ClickFeedback{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clicks": clicks})
+}
+
+// handleIntent records the caller's rating of how a search was parsed:
+// {"search_id": "...", "rating": "down", "correction": {...}, "comment": "..."}.
+// The correction is the intent the user expected, in either schema version,
+// and is only taken with a down rating. Rating a search again replaces the
+// earlier rating.
+func (f *FeedbackService) handleIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		SearchID   string          `json:"search_id"`
+		Rating     string          `json:"rating"`
+		Correction json.RawMessage `json:"correction"`
+		Comment    string          `json:"comment"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Rating != RatingUp && req.Rating != RatingDown {
+		http.Error(w, "rating must be up or down", http.StatusBadRequest)
+		return
+	}
+	if len(req.Comment) > 2000 {
+		http.Error(w, "comment must be at most 2000 bytes", http.StatusBadRequest)
+		return
+	}
+	var correction *SearchIntent
+	if len(req.Correction) > 0 && string(req.Correction) != "null" {
+		if req.Rating != RatingDown {
+			http.Error(w, "correction is only accepted with a down rating", http.StatusBadRequest)
+			return
+		}
+		c, err := decodeIntentJSON(req.Correction)
+		if err != nil || strings.TrimSpace(c.MainQuery) == "" {
+			http.Error(w, "correction must be an intent with a main_query", http.StatusBadRequest)
+			return
+		}
+		correction = c
+	}
+
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	rec, err := f.history.Get(r.Context(), tenantID, userID, req.SearchID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading history entry", "error", err)
+		http.Error(w, "Error recording feedback", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil {
+		http.Error(w, "Search not found", http.StatusNotFound)
+		return
+	}
+
+	// The prompt and intent always come from the record: ratings of
+	// encrypted searches have neither, and never become training examples.
+	// Personal data is kept out of the prompt, which other users' analyses
+	// may be shown.
+	redaction := redactPII(rec.Prompt)
+	rating := &IntentFeedback{
+		ID:         newHistoryID(),
+		SearchID:   rec.ID,
+		TenantID:   tenantID,
+		UserID:     userID,
+		Rating:     req.Rating,
+		Prompt:     redaction.prompt,
+		Redacted:   redaction.kinds,
+		Intent:     rec.Intent,
+		Correction: correction,
+		Comment:    req.Comment,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if len(rating.Redacted) > 0 {
+		// The intent has the personal data back in it
+		rating.Intent = nil
+	}
+	if err := f.store.AddRating(r.Context(), rating); err != nil {
+		slog.ErrorContext(r.Context(), "Error storing intent feedback", "error", err)
+		http.Error(w, "Error recording feedback", http.StatusInternalServerError)
+		return
+	}
+	feedbackRatings.Inc(rating.Rating, strconv.FormatBool(correction != nil))
+	event := ExperimentRatingUp
+	if rating.Rating == RatingDown {
+		event = ExperimentRatingDown
+	}
+	f.experiments.Feedback(rating.SearchID, event)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": rating.ID})
+}
+
+// handleCorrections lists the corrections users sent, oldest first, for
+// review before they become few-shot examples. Takes tenant_id, status
+// (pending, the default, approved or all), since (RFC 3339), after_id (the
+// last ID of the previous page) and limit (default 100, at most 1000).
+func (f *FeedbackService) handleCorrections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	status := params.Get("status")
+	if status == "" {
+		status = "pending"
+	}
+	if status != "pending" && status != "approved" && status != "all" {
+		http.Error(w, "status must be pending, approved or all", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := params.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	corrections := []*IntentFeedback{}
+	afterID := params.Get("after_id")
+	for len(corrections) < limit {
+		ratings, err := f.store.ListRatings(r.Context(), params.Get("tenant_id"), since, afterID, historyExportBatch)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error listing intent feedback", "error", err)
+			http.Error(w, "Error listing corrections", http.StatusInternalServerError)
+			return
+		}
+		for _, rating := range ratings {
+			if rating.Correction == nil || (status == "pending" && rating.ApprovedAt != nil) || (status == "approved" && rating.ApprovedAt == nil) {
+				continue
+			}
+			if corrections = append(corrections, rating); len(corrections) == limit {
+				break
+			}
+		}
+		if len(ratings) < historyExportBatch {
+			break
+		}
+		last := ratings[len(ratings)-1]
+		since, afterID = last.CreatedAt, last.ID
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"corrections": corrections})
+}
+
+// handleApproval approves a correction as a few-shot example or withdraws
+// the approval: PUT {"approved": true}
+func (f *FeedbackService) handleApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Approved *bool `json:"approved"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Approved == nil {
+		http.Error(w, `Invalid request body, expected {"approved": true|false}`, http.StatusBadRequest)
+		return
+	}
+	rating, err := f.store.GetRating(r.Context(), r.PathValue("id"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading intent feedback", "error", err)
+		http.Error(w, "Error updating correction", http.StatusInternalServerError)
+		return
+	}
+	if rating == nil || rating.Correction == nil {
+		http.Error(w, "Correction not found", http.StatusNotFound)
+		return
+	}
+	if *req.Approved && rating.hasPII() {
+		http.Error(w, "The prompt has personal data, it can't be an example", http.StatusConflict)
+		return
+	}
+	var at *time.Time
+	if *req.Approved {
+		now := time.Now().UTC()
+		at = &now
+	}
+	if err := f.store.SetApproval(r.Context(), rating.ID, at); err != nil {
+		slog.ErrorContext(r.Context(), "Error updating intent feedback", "error", err)
+		http.Error(w, "Error updating correction", http.StatusInternalServerError)
+		return
+	}
+	if at == nil && f.fewShot != nil {
+		f.fewShot.Forget(rating.ID)
+	}
+	slog.InfoContext(r.Context(), "Correction reviewed", "id", rating.ID, "tenant", rating.TenantID, "approved", *req.Approved)
+	rating.ApprovedAt = at
+	writeJSON(w, http.StatusOK, rating)
+}
+
+// handleDataset exports rated prompts as JSON Lines to improve the analyzer.
+// format=openai (the default) writes chat fine-tuning examples with the
+// current system prompt, format=fewshot plain {"prompt", "intent"} pairs.
+// Corrections are always exported; include=up adds the intents users rated
+// up. Takes ?tenant_id= and since (RFC 3339).
+func (f *FeedbackService) handleDataset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "openai"
+	}
+	if format != "openai" && format != "fewshot" {
+		http.Error(w, "format must be openai or fewshot", http.StatusBadRequest)
+		return
+	}
+	includeUp := false
+	switch params.Get("include") {
+	case "":
+	case RatingUp:
+		includeUp = true
+	default:
+		http.Error(w, "include must be up", http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if v := params.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="intent-%s-%s.jsonl"`, format, time.Now().UTC().Format("20060102")))
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	exported := 0
+	afterID := ""
+	for {
+		ratings, err := f.store.ListRatings(r.Context(), params.Get("tenant_id"), since, afterID, historyExportBatch)
+		if err == nil {
+			for _, rating := range ratings {
+				example := f.datasetExample(rating, format, includeUp)
+				if example == nil {
+					continue
+				}
+				if err = enc.Encode(example); err != nil {
+					break
+				}
+				exported++
+			}
+		}
+		if err != nil {
+			// Same as history exports: a cut connection rather than a
+			// dataset that silently misses examples
+			slog.ErrorContext(r.Context(), "Feedback dataset export failed", "exported", exported, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		rc.Flush()
+		if len(ratings) < historyExportBatch {
+			break
+		}
+		last := ratings[len(ratings)-1]
+		since, afterID = last.CreatedAt, last.ID
+	}
+	slog.InfoContext(r.Context(), "Feedback dataset exported", "format", format, "examples", exported)
+}
+
+// datasetExample turns a rating into a training example, or nil when it
+// doesn't make one: down ratings without a correction, up ratings unless
+// includeUp, encrypted searches and prompts with personal data
+func (f *FeedbackService) datasetExample(rating *IntentFeedback, format string, includeUp bool) interface{} {
+	target := rating.Correction
+	if rating.Rating == RatingUp && includeUp {
+		target = rating.Intent
+	}
+	if target == nil || rating.Prompt == "" || rating.hasPII() {
+		return nil
+	}
+	if format == "fewshot" {
+		return map[string]interface{}{"prompt": rating.Prompt, "intent": target}
+	}
+	answer, err := analyzerAnswer(target)
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{"messages": []OpenAIMessage{
+		{Role: "system", Content: f.prompts.System(f.prompts.Vertical(rating.Prompt), NewPromptData(rating.CreatedAt, ""))},
+		{Role: "user", Content: rating.Prompt},
+		{Role: "assistant", Content: answer},
+	}}
+}
+
+// analyzerAnswer renders an intent the way the analyzer should answer it,
+// with every field as the system prompt asks
+func analyzerAnswer(intent *SearchIntent) (string, error) {
+	data, err := json.Marshal(struct {
+		MainQuery    string   `json:"main_query"`
+		ExactPhrases []string `json:"exact_phrases"`
+		SiteFilter   string   `json:"site_filter"`
+		FileType     string   `json:"file_type"`
+		ExcludeWords []string `json:"exclude_words"`
+		DateRange    string   `json:"date_range"`
+	}{intent.MainQuery, nonNil(intent.ExactPhrases), intent.SiteFilter, intent.FileType, nonNil(intent.ExcludeWords), intent.DateRange})
+	return string(data), err
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// feedbackSchema creates the feedback tables next to the history tables
+var feedbackSchema = map[string][]string{
+	HistoryStoreSQLite: {
+		`CREATE TABLE IF NOT EXISTS click_feedback (
+			id TEXT PRIMARY KEY,
+			search_id TEXT NOT NULL,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			url TEXT NOT NULL,
+			engine TEXT NOT NULL DEFAULT '',
+			position INTEGER NOT NULL DEFAULT 0,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent TEXT,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS click_feedback_tenant ON click_feedback (tenant_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS click_feedback_created ON click_feedback (created_at)`,
+		`CREATE TABLE IF NOT EXISTS intent_feedback (
+			id TEXT PRIMARY KEY,
+			search_id TEXT NOT NULL UNIQUE,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			rating TEXT NOT NULL,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent TEXT,
+			correction TEXT,
+			comment TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			approved_at TIMESTAMP,
+			redacted TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_tenant ON intent_feedback (tenant_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_created ON intent_feedback (created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_approved ON intent_feedback (approved_at, id)`,
+	},
+	HistoryStorePostgres: {
+		`CREATE TABLE IF NOT EXISTS click_feedback (
+			id TEXT PRIMARY KEY,
+			search_id TEXT NOT NULL,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			url TEXT NOT NULL,
+			engine TEXT NOT NULL DEFAULT '',
+			position INTEGER NOT NULL DEFAULT 0,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent JSONB,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS click_feedback_tenant ON click_feedback (tenant_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS click_feedback_created ON click_feedback (created_at)`,
+		`CREATE TABLE IF NOT EXISTS intent_feedback (
+			id TEXT PRIMARY KEY,
+			search_id TEXT NOT NULL UNIQUE,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			rating TEXT NOT NULL,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent JSONB,
+			correction JSONB,
+			comment TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			approved_at TIMESTAMPTZ,
+			redacted TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_tenant ON intent_feedback (tenant_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_created ON intent_feedback (created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS intent_feedback_approved ON intent_feedback (approved_at, id)`,
+	},
+}
+
+const (
+	clickColumns  = `id, search_id, tenant_id, user_id, url, engine, position, prompt, intent, created_at`
+	ratingColumns = `id, search_id, tenant_id, user_id, rating, prompt, intent, correction, comment, created_at, approved_at, redacted`
+)
+
+// sqlFeedbackStore keeps feedback in the history database
+type sqlFeedbackStore struct {
+	h *sqlHistoryStore
+}
+
+// NewSQLFeedbackStore creates the feedback tables in the history database
+func NewSQLFeedbackStore(ctx context.Context, history *sqlHistoryStore) (*sqlFeedbackStore, error) {
+	for _, stmt := range feedbackSchema[history.dialect] {
+		if _, err := history.db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("error creating feedback tables: %v", err)
+		}
+	}
+	return &sqlFeedbackStore{h: history}, nil
+}
+
+func (s *sqlFeedbackStore) AddClick(ctx context.Context, c *ClickFeedback) error {
+	intent, err := nullJSON(c.Intent, c.Intent == nil)
+	if err != nil {
+		return fmt.Errorf("error encoding intent: %v", err)
+	}
+	_, err = s.h.db.ExecContext(ctx, s.h.rebind(`INSERT INTO click_feedback (`+clickColumns+`) VALUES (`+placeholders(10)+`)`),
+		c.ID, c.SearchID, c.TenantID, c.UserID, c.URL, c.Engine, c.Position, c.Prompt, intent, c.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error inserting click feedback: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlFeedbackStore) ListClicks(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*ClickFeedback, error) {
+	query := `SELECT ` + clickColumns + ` FROM click_feedback WHERE (created_at > ? OR (created_at = ? AND id > ?))`
+	args := []interface{}{since.UTC(), since.UTC(), afterID}
+	if tenantID != "" {
+		query += ` AND tenant_id = ?`
+		args = append(args, tenantID)
+	}
+	args = append(args, limit)
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(query+` ORDER BY created_at, id LIMIT ?`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying click feedback: %v", err)
+	}
+	defer rows.Close()
+
+	var clicks []*ClickFeedback
+	for rows.Next() {
+		c := &ClickFeedback{}
+		var intent sql.NullString
+		if err := rows.Scan(&c.ID, &c.SearchID, &c.TenantID, &c.UserID, &c.URL, &c.Engine, &c.Position,
+			&c.Prompt, &intent, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading click feedback: %v", err)
+		}
+		c.CreatedAt = c.CreatedAt.UTC()
+		if intent.Valid {
+			if err := json.Unmarshal([]byte(intent.String), &c.Intent); err != nil {
+				return nil, fmt.Errorf("error decoding intent of %s: %v", c.ID, err)
+			}
+		}
+		clicks = append(clicks, c)
+	}
+	return clicks, rows.Err()
+}
+
+func (s *sqlFeedbackStore) AddRating(ctx context.Context, f *IntentFeedback) error {
+	intent, err := nullJSON(f.Intent, f.Intent == nil)
+	if err != nil {
+		return fmt.Errorf("error encoding intent: %v", err)
+	}
+	correction, err := nullJSON(f.Correction, f.Correction == nil)
+	if err != nil {
+		return fmt.Errorf("error encoding correction: %v", err)
+	}
+	_, err = s.h.db.ExecContext(ctx, s.h.rebind(`INSERT INTO intent_feedback (`+ratingColumns+`) VALUES (`+placeholders(12)+`)
+		ON CONFLICT (search_id) DO UPDATE SET id = excluded.id, rating = excluded.rating, prompt = excluded.prompt,
+			intent = excluded.intent, correction = excluded.correction, comment = excluded.comment, created_at = excluded.created_at,
+			approved_at = excluded.approved_at, redacted = excluded.redacted`),
+		f.ID, f.SearchID, f.TenantID, f.UserID, f.Rating, f.Prompt, intent, correction, f.Comment, f.CreatedAt.UTC(), nullTime(f.ApprovedAt),
+		strings.Join(f.Redacted, ","))
+	if err != nil {
+		return fmt.Errorf("error inserting intent feedback: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlFeedbackStore) ListRatings(ctx context.Context, tenantID string, since time.Time, afterID string, limit int) ([]*IntentFeedback, error) {
+	query := `SELECT ` + ratingColumns + ` FROM intent_feedback WHERE (created_at > ? OR (created_at = ? AND id > ?))`
+	args := []interface{}{since.UTC(), since.UTC(), afterID}
+	if tenantID != "" {
+		query += ` AND tenant_id = ?`
+		args = append(args, tenantID)
+	}
+	args = append(args, limit)
+	return s.queryRatings(ctx, query+` ORDER BY created_at, id LIMIT ?`, args...)
+}
+
+func (s *sqlFeedbackStore) GetRating(ctx context.Context, id string) (*IntentFeedback, error) {
+	ratings, err := s.queryRatings(ctx, `SELECT `+ratingColumns+` FROM intent_feedback WHERE id = ?`, id)
+	if err != nil || len(ratings) == 0 {
+		return nil, err
+	}
+	return ratings[0], nil
+}
+
+func (s *sqlFeedbackStore) SetApproval(ctx context.Context, id string, at *time.Time) error {
+	if _, err := s.h.db.ExecContext(ctx, s.h.rebind(`UPDATE intent_feedback SET approved_at = ? WHERE id = ?`), nullTime(at), id); err != nil {
+		return fmt.Errorf("error updating intent feedback: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlFeedbackStore) ListApproved(ctx context.Context, since time.Time, afterID string, limit int) ([]*IntentFeedback, error) {
+	return s.queryRatings(ctx, `SELECT `+ratingColumns+` FROM intent_feedback
+		WHERE approved_at > ? OR (approved_at = ? AND id > ?) ORDER BY approved_at, id LIMIT ?`,
+		since.UTC(), since.UTC(), afterID, limit)
+}
+
+// nullTime stores a nil time as NULL
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// queryRatings runs a SELECT of ratingColumns
+func (s *sqlFeedbackStore) queryRatings(ctx context.Context, query string, args ...interface{}) ([]*IntentFeedback, error) {
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying intent feedback: %v", err)
+	}
+	defer rows.Close()
+
+	var ratings []*IntentFeedback
+	for rows.Next() {
+		f := &IntentFeedback{}
+		var intent, correction sql.NullString
+		var approved sql.NullTime
+		var redacted string
+		if err := rows.Scan(&f.ID, &f.SearchID, &f.TenantID, &f.UserID, &f.Rating, &f.Prompt,
+			&intent, &correction, &f.Comment, &f.CreatedAt, &approved, &redacted); err != nil {
+			return nil, fmt.Errorf("error reading intent feedback: %v", err)
+		}
+		if redacted != "" {
+			f.Redacted = strings.Split(redacted, ",")
+		}
+		f.CreatedAt = f.CreatedAt.UTC()
+		if approved.Valid {
+			t := approved.Time.UTC()
+			f.ApprovedAt = &t
+		}
+		if intent.Valid {
+			if err := json.Unmarshal([]byte(intent.String), &f.Intent); err != nil {
+				return nil, fmt.Errorf("error decoding intent of %s: %v", f.ID, err)
+			}
+		}
+		if correction.Valid {
+			if err := json.Unmarshal([]byte(correction.String), &f.Correction); err != nil {
+				return nil, fmt.Errorf("error decoding correction of %s: %v", f.ID, err)
+			}
+		}
+		ratings = append(ratings, f)
+	}
+	return ratings, rows.Err()
+}
+
+func (s *sqlFeedbackStore) PurgeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	return s.execAll(ctx, `DELETE FROM %s WHERE created_at < ?`, cutoff.UTC())
+}
+
+func (s *sqlFeedbackStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return s.execAll(ctx, `DELETE FROM %s WHERE tenant_id = ? AND user_id = ?`, tenantID, userID)
+}
+
+// execAll runs a statement on every feedback table and sums the affected rows
+func (s *sqlFeedbackStore) execAll(ctx context.Context, query string, args ...interface{}) (int, error) {
+	total := 0
+	for _, table := range []string{"click_feedback", "intent_feedback"} {
+		n, err := s.exec(ctx, fmt.Sprintf(query, table), args...)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// exec runs a statement and returns the number of affected rows
+func (s *sqlFeedbackStore) exec(ctx context.Context, query string, args ...interface{}) (int, error) {
+	res, err := s.h.db.ExecContext(ctx, s.h.rebind(query), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting feedback: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting feedback: %v", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	fewShotSelections = metricsRegistry.Counter("few_shot_selections_total",
+		"Analyses that looked for few-shot examples, by result (injected, none, error).", "result")
+	fewShotIndexSize = metricsRegistry.Gauge("few_shot_index_examples",
+		"Corrected examples available for few-shot selection.")
+)
+
+// EmbedFunc returns the embedding of each text, in order
+type EmbedFunc func(ctx context.Context, texts []string) ([][]float64, error)
+
+// fewShotReloadEvery is how often Refresh reloads every approved correction
+// rather than the newly approved ones, dropping those erased, expired or
+// rated again since
+const fewShotReloadEvery = time.Hour
+
+// fewShotExample is a prompt users corrected and the intent they expected
+type fewShotExample struct {
+	id       string
+	tenantID string
+	userID   string
+	prompt   string
+	intent   *SearchIntent
+	vector   []float64
+}
+
+// FewShotIndex keeps the embedded corrections of every tenant in memory and
+// picks the ones closest to a new prompt, so the analyzer sees how similar
+// prompts should have been parsed. Only corrections an admin approved are
+// used, and examples never cross tenants.
+type FewShotIndex struct {
+	store         FeedbackStore
+	embed         EmbedFunc
+	k             int
+	minSimilarity float64
+
+	mu       sync.RWMutex
+	examples map[string][]*fewShotExample // by tenant
+	// generations change with a tenant's examples, so its cached analyses
+	// made with other examples are no longer used
+	generations map[string]uint64
+	// since and afterID are the approval the last Refresh read up to
+	since   time.Time
+	afterID string
+	// reloadedAt is when every approved correction was last loaded
+	reloadedAt time.Time
+}
+
+// NewFewShotIndex selects up to k examples at least minSimilarity close to
+// the prompt. The index is empty until the first Refresh.
+func NewFewShotIndex(store FeedbackStore, embed EmbedFunc, k int, minSimilarity float64) *FewShotIndex {
+	return &FewShotIndex{
+		store:         store,
+		embed:         embed,
+		k:             k,
+		minSimilarity: minSimilarity,
+		examples:      make(map[string][]*fewShotExample),
+		generations:   make(map[string]uint64),
+	}
+}
+
+// Refresh loads the corrections approved since the last call and embeds
+// them. Every fewShotReloadEvery it loads all of them instead, embedding
+// only the new ones.
+func (x *FewShotIndex) Refresh(ctx context.Context) error {
+	x.mu.RLock()
+	full := time.Since(x.reloadedAt) >= fewShotReloadEvery
+	since, afterID := x.since, x.afterID
+	known := make(map[string]*fewShotExample)
+	for _, examples := range x.examples {
+		for _, ex := range examples {
+			known[ex.id] = ex
+		}
+	}
+	x.mu.RUnlock()
+	if full {
+		since, afterID = time.Time{}, ""
+	}
+
+	var loaded, pending []*fewShotExample
+	for {
+		ratings, err := x.store.ListApproved(ctx, since, afterID, historyExportBatch)
+		if err != nil {
+			return err
+		}
+		for _, rating := range ratings {
+			if rating.Correction == nil || rating.Prompt == "" || rating.hasPII() {
+				continue
+			}
+			ex, ok := known[rating.ID]
+			if !ok {
+				ex = &fewShotExample{id: rating.ID, tenantID: rating.TenantID, userID: rating.UserID, prompt: rating.Prompt, intent: rating.Correction}
+				pending = append(pending, ex)
+			}
+			loaded = append(loaded, ex)
+		}
+		if len(ratings) < historyExportBatch {
+			break
+		}
+		last := ratings[len(ratings)-1]
+		since, afterID = *last.ApprovedAt, last.ID
+	}
+
+	if len(pending) > 0 {
+		texts := make([]string, len(pending))
+		for i, ex := range pending {
+			texts[i] = ex.prompt
+		}
+		vectors, err := x.embed(ctx, texts)
+		if err != nil {
+			return err
+		}
+		for i, ex := range pending {
+			ex.vector = vectors[i]
+		}
+	}
+
+	x.mu.Lock()
+	if full {
+		examples := make(map[string][]*fewShotExample)
+		for _, ex := range loaded {
+			examples[ex.tenantID] = append(examples[ex.tenantID], ex)
+		}
+		for tenantID := range x.examples {
+			if !sameExamples(x.examples[tenantID], examples[tenantID]) {
+				x.generations[tenantID]++
+			}
+		}
+		for tenantID := range examples {
+			if _, ok := x.examples[tenantID]; !ok {
+				x.generations[tenantID]++
+			}
+		}
+		x.examples = examples
+		x.reloadedAt = time.Now()
+	} else {
+		for _, ex := range loaded {
+			if !slices.ContainsFunc(x.examples[ex.tenantID], func(have *fewShotExample) bool { return have.id == ex.id }) {
+				x.examples[ex.tenantID] = append(x.examples[ex.tenantID], ex)
+				x.generations[ex.tenantID]++
+			}
+		}
+	}
+	x.since, x.afterID = since, afterID
+	n := 0
+	for _, tenantExamples := range x.examples {
+		n += len(tenantExamples)
+	}
+	x.mu.Unlock()
+	fewShotIndexSize.Set(float64(n))
+	return nil
+}
+
+// sameExamples tells whether two lists hold the same examples in order
+func sameExamples(a, b []*fewShotExample) bool {
+	return slices.EqualFunc(a, b, func(x, y *fewShotExample) bool { return x.id == y.id })
+}
+
+// Forget drops an example whose approval was withdrawn
+func (x *FewShotIndex) Forget(id string) {
+	x.remove(func(ex *fewShotExample) bool { return ex.id == id })
+}
+
+// DeleteAllOwned drops the user's examples, for user erasure
+func (x *FewShotIndex) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return x.remove(func(ex *fewShotExample) bool { return ex.tenantID == tenantID && ex.userID == userID }), nil
+}
+
+func (x *FewShotIndex) remove(drop func(ex *fewShotExample) bool) int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	removed := 0
+	for tenantID, examples := range x.examples {
+		kept := slices.DeleteFunc(slices.Clone(examples), drop)
+		if len(kept) < len(examples) {
+			removed += len(examples) - len(kept)
+			x.examples[tenantID] = kept
+			x.generations[tenantID]++
+		}
+	}
+	return removed
+}
+
+// Generation changes whenever the tenant's examples do
+func (x *FewShotIndex) Generation(tenantID string) uint64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.generations[tenantID]
+}
+
+// Run refreshes the index every interval until ctx is cancelled
+func (x *FewShotIndex) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := x.Refresh(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error refreshing few-shot examples", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Has reports whether the tenant has any examples. Prompts of tenants
+// without corrections skip the embeddings call.
+func (x *FewShotIndex) Has(tenantID string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.examples[tenantID]) > 0
+}
+
+// Select returns the tenant's examples closest to prompt, least similar
+// first so the closest one sits right before the prompt
+func (x *FewShotIndex) Select(ctx context.Context, tenantID, prompt string) ([]*fewShotExample, error) {
+	x.mu.RLock()
+	candidates := x.examples[tenantID]
+	x.mu.RUnlock()
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	vectors, err := x.embed(ctx, []string{prompt})
+	if err != nil {
+		return nil, err
+	}
+	type scored struct {
+		ex    *fewShotExample
+		score float64
+	}
+	var matches []scored
+	for _, ex := range candidates {
+		score := cosineSimilarity(vectors[0], ex.vector)
+		if score >= x.minSimilarity {
+			matches = append(matches, scored{ex, score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	if len(matches) > x.k {
+		matches = matches[:x.k]
+	}
+	selected := make([]*fewShotExample, len(matches))
+	for i, m := range matches {
+		selected[len(matches)-1-i] = m.ex
+	}
+	return selected, nil
+}
+
+// UseFewShot turns on few-shot examples for the analyses
+func (h *SearchHandler) UseFewShot(index *FewShotIndex) {
+	h.fewShot = index
+}
+
+// fewShotTenant returns the tenant whose corrections shape the analysis, or
+// "" when few-shot is off or the tenant has no corrections
+func (h *SearchHandler) fewShotTenant(ctx context.Context) string {
+	if h.fewShot == nil || !h.flags.Enabled(ctx, FlagFewShot, true) {
+		return ""
+	}
+	tenantID := DefaultTenantID
+	if t := tenantFromContext(ctx); t != nil {
+		tenantID = t.ID
+	}
+	if !h.fewShot.Has(tenantID) {
+		return ""
+	}
+	return tenantID
+}
+
+// fewShotExamples selects the examples of the analysis. Failures only cost
+// the examples, the analysis goes ahead without them.
+func (h *SearchHandler) fewShotExamples(ctx context.Context, tenantID, prompt string) []*fewShotExample {
+	if tenantID == "" {
+		return nil
+	}
+	examples, err := h.fewShot.Select(ctx, tenantID, prompt)
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "Error selecting few-shot examples", "error", err)
+		fewShotSelections.Inc("error")
+	case len(examples) == 0:
+		fewShotSelections.Inc("none")
+	default:
+		fewShotSelections.Inc("injected")
+	}
+	return examples
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flags checked by the server; other flags can be defined ahead of the
+// features that will read them
+const (
+	// FlagModelRouter routes prompts between the cheap and capable models,
+	// overriding MODEL_ROUTER_ENABLED
+	FlagModelRouter = "model_router"
+	// FlagResults lets searches include result pages from the results provider
+	FlagResults = "results"
+	// FlagFewShot adds the tenant's corrected examples to analyses, on by
+	// default when FEW_SHOT_EXAMPLES is set
+	FlagFewShot = "few_shot"
+	// FlagVoiceSearch allows voice queries on /v1/search/audio
+	FlagVoiceSearch = "voice_search"
+	// FlagImageSearch allows image queries on /v1/search/image
+	FlagImageSearch = "image_search"
+	// FlagDocuments routes prompts asking to search the caller's documents to
+	// the document index
+	FlagDocuments = "documents"
+	// FlagEmbeddings allows embedding texts on /v1/embeddings
+	FlagEmbeddings = "embeddings"
+	// FlagFederated blends the tenant's documents into the results of
+	// searches, when both are configured
+	FlagFederated = "federated"
+	// FlagPersonalized re-ranks the results of signed-in users by their
+	// clicks, when PERSONALIZATION_ENABLED is set
+	FlagPersonalized = "personalized"
+	// FlagCompare allows comparing engines on /v1/compare
+	FlagCompare = "compare"
+	// FlagInstant answers weather and stock prompts without an analysis,
+	// when INSTANT_ANSWERS_ENABLED is set
+	FlagInstant = "instant"
+	// FlagCalculator answers arithmetic and unit conversion prompts without
+	// an analysis
+	FlagCalculator = "calculator"
+	// FlagQueryTrimming strips filler like "please find me" from the main
+	// query of analyses
+	FlagQueryTrimming = "query_trimming"
+)
+
+var flagEvaluations = metricsRegistry.Counter("feature_flag_evaluations_total",
+	"Feature flag checks, by flag and result (on, off).", "flag", "result")
+
+var flagNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// Flag turns a behavior on for some tenants. Enabled is the kill switch;
+// while it is on, Tenants overrides win and the remaining tenants are in for
+// Rollout percent, picked by a stable hash so they don't flap.
+type Flag struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Enabled     bool            `json:"enabled"`
+	Rollout     float64         `json:"rollout"`
+	Tenants     map[string]bool `json:"tenants,omitempty"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+func (f *Flag) validate() error {
+	if !flagNameRe.MatchString(f.Name) {
+		return fmt.Errorf("flag name %q must be lowercase letters, digits and _", f.Name)
+	}
+	if f.Rollout < 0 || f.Rollout > 100 {
+		return fmt.Errorf("flag %q: rollout must be between 0 and 100", f.Name)
+	}
+	return nil
+}
+
+// on evaluates the flag for a tenant
+func (f *Flag) on(tenantID string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if v, ok := f.Tenants[tenantID]; ok {
+		return v
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + "\x00" + tenantID))
+	return float64(h.Sum32()%10000)/100 < f.Rollout
+}
+
+// FeatureFlags holds the flags, saved to path after every admin change and
+// reloaded when the file changes
+type FeatureFlags struct {
+	path string
+
+	mu    sync.RWMutex
+	flags map[string]*Flag
+}
+
+// NewFeatureFlags loads the flags saved at path, if any
+func NewFeatureFlags(path string) (*FeatureFlags, error) {
+	ff := &FeatureFlags{path: path, flags: make(map[string]*Flag)}
+	if path == "" {
+		return ff, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ff, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading flags file: %v", err)
+	}
+	if err := ff.Reload(data); err != nil {
+		return nil, err
+	}
+	return ff, nil
+}
+
+// Reload validates new flag definitions and swaps them in; on error the
+// current flags stay in place
+func (ff *FeatureFlags) Reload(data []byte) error {
+	var list []*Flag
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("error parsing flags file: %v", err)
+	}
+	flags := make(map[string]*Flag, len(list))
+	for _, f := range list {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		flags[f.Name] = f
+	}
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	ff.flags = flags
+	return nil
+}
+
+// Enabled evaluates a flag for the tenant of ctx; undefined flags return def,
+// so a feature keeps its configured behavior until a flag takes it over
+func (ff *FeatureFlags) Enabled(ctx context.Context, name string, def bool) bool {
+	if ff == nil {
+		return def
+	}
+	ff.mu.RLock()
+	f, ok := ff.flags[name]
+	ff.mu.RUnlock()
+	if !ok {
+		return def
+	}
+
+	tenantID := DefaultTenantID
+	if t := tenantFromContext(ctx); t != nil {
+		tenantID = t.ID
+	}
+	on := f.on(tenantID)
+	if on {
+		flagEvaluations.Inc(name, "on")
+	} else {
+		flagEvaluations.Inc(name, "off")
+	}
+	return on
+}
+
+// List returns the flags sorted by name
+func (ff *FeatureFlags) List() []Flag {
+	ff.mu.RLock()
+	defer ff.mu.RUnlock()
+	out := make([]Flag, 0, len(ff.flags))
+	for _, f := range ff.flags {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Set creates or replaces a flag
+func (ff *FeatureFlags) Set(f Flag) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	f.UpdatedAt = time.Now().UTC()
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	prev, existed := ff.flags[f.Name]
+	ff.flags[f.Name] = &f
+	if err := ff.save(); err != nil {
+		if existed {
+			ff.flags[f.Name] = prev
+		} else {
+			delete(ff.flags, f.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a flag, so the feature falls back to its configured default
+func (ff *FeatureFlags) Delete(name string) (bool, error) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	prev, ok := ff.flags[name]
+	if !ok {
+		return false, nil
+	}
+	delete(ff.flags, name)
+	if err := ff.save(); err != nil {
+		ff.flags[name] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes the flags to the file; the caller holds the lock
+func (ff *FeatureFlags) save() error {
+	if ff.path == "" {
+		return nil
+	}
+	list := make([]*Flag, 0, len(ff.flags))
+	for _, f := range ff.flags {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling flags: %v", err)
+	}
+	if err := writeFileAtomic(ff.path, data); err != nil {
+		return fmt.Errorf("error saving flags: %v", err)
+	}
+	return nil
+}
+
+// handleAdmin lists (GET), creates or updates (PUT, a Flag as body) and
+// deletes (DELETE ?name=) flags
+func (ff *FeatureFlags) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": ff.List()})
+
+	case http.MethodPut:
+		var f Flag
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&f); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		f.Name = strings.TrimSpace(f.Name)
+		if err := f.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ff.Set(f); err != nil {
+			slog.ErrorContext(r.Context(), "Error saving feature flag", "flag", f.Name, "error", err)
+			http.Error(w, "Error saving flag", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Feature flag updated", "flag", f.Name, "enabled", f.Enabled, "rollout", f.Rollout)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": ff.List()})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		deleted, err := ff.Delete(name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting feature flag", "flag", name, "error", err)
+			http.Error(w, "Error saving flags", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Flag not found", http.StatusNotFound)
+			return
+		}
+		slog.InfoContext(r.Context(), "Feature flag deleted", "flag", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEvaluated shows the calling tenant which flags are on for it, so
+// clients can hide features that are off
+func (ff *FeatureFlags) handleEvaluated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID := DefaultTenantID
+	if t := tenantFromContext(r.Context()); t != nil {
+		tenantID = t.ID
+	}
+	ff.mu.RLock()
+	evaluated := make(map[string]bool, len(ff.flags))
+	for name, f := range ff.flags {
+		evaluated[name] = f.on(tenantID)
+	}
+	ff.mu.RUnlock()
+	writeCacheableJSON(w, r, cachePrivateRevalidate, map[string]interface{}{"flags": evaluated})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheImmutable is for the frontend's files under static/, whose names
+// carry a content hash, so they never change. Everything else, above all
+// index.html, is revalidated so a deploy shows up on the next load.
+const cacheImmutable = "public, max-age=31536000, immutable"
+
+const frontendIndex = "index.html"
+
+// frontendFile is a file of the built frontend, read once at startup
+type frontendFile struct {
+	data []byte
+	etag string
+}
+
+// FrontendHandler serves the single-page app: files of the build by name,
+// and index.html for every other path without an extension, so the app's
+// own routes survive a reload
+type FrontendHandler struct {
+	files   map[string]*frontendFile
+	started time.Time
+}
+
+// NewFrontendHandler loads the build in fsys, which must have an index.html
+// at its root
+func NewFrontendHandler(fsys fs.FS) (*FrontendHandler, error) {
+	f := &FrontendHandler{files: make(map[string]*frontendFile), started: time.Now()}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		f.files[name] = &frontendFile{data: data, etag: `W/"` + hex.EncodeToString(sum[:16]) + `"`}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading frontend: %v", err)
+	}
+	if f.files[frontendIndex] == nil {
+		return nil, fmt.Errorf("frontend has no %s, build it first", frontendIndex)
+	}
+	return f, nil
+}
+
+func (f *FrontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	file, ok := f.files[name]
+	cacheControl := cacheRevalidate
+	switch {
+	case ok && strings.HasPrefix(name, "static/"):
+		cacheControl = cacheImmutable
+	case ok:
+	case name == "" || path.Ext(name) == "":
+		// A route of the app
+		name, file = frontendIndex, f.files[frontendIndex]
+	default:
+		// A missing asset must not come back as HTML
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", file.etag)
+	// ServeContent sets the type from the name, answers If-None-Match and
+	// Range requests
+	http.ServeContent(w, r, name, f.started, bytes.NewReader(file.data))
+}
+
+// withFrontend sends GET and HEAD requests that match no API route to the
+// frontend, so the app and the API share one origin
+func withFrontend(frontend http.Handler, mux *http.ServeMux, api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if _, pattern := mux.Handler(r); pattern == "" {
+				frontend.ServeHTTP(w, r)
+				return
+			}
+		}
+		api.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,20 @@
+//go:build embedui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The React build, copied into web/ before compiling:
+//
+//	cd ../smart-search && npm run build && rm -rf ../backend/web && cp -r build ../backend/web
+//
+//go:embed all:web
+var embeddedWeb embed.FS
+
+// embeddedFrontend returns the frontend compiled into the binary
+func embeddedFrontend() (fs.FS, error) {
+	return fs.Sub(embeddedWeb, "web")
+}
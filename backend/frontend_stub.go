@@ -0,0 +1,13 @@
+//go:build !embedui
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// embeddedFrontend needs the built frontend in web/, which default builds leave out
+func embeddedFrontend() (fs.FS, error) {
+	return nil, fmt.Errorf("built without the frontend, rebuild with -tags embedui or set FRONTEND_DIR")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Prompt guard modes
+const (
+	PromptGuardOff    = "off"
+	PromptGuardLog    = "log"
+	PromptGuardStrip  = "strip"
+	PromptGuardRefuse = "refuse"
+)
+
+var promptInjections = metricsRegistry.Counter("prompt_injection_attempts_total",
+	"Prompts that tried to override the analyzer's instructions, by rule and action (logged, stripped, refused).", "rule", "action")
+
+// promptGuardRules spot text written for the model rather than for the
+// search engine. They look at one sentence at a time, and only at what
+// addresses the model: people search for "eslint ignore rules", "print api
+// key aws cli" or the intent's field names too.
+var promptGuardRules = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	// "ignore all previous instructions", "disregard the rules above"
+	{"override", regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\s+(all\s+|any\s+)?(of\s+)?(the\s+|your\s+|these\s+)?((previous|prior|above|earlier|preceding|original|initial|system)\s+(instructions?|prompts?|rules|directions|guidelines)\b|(instructions?|prompts?|rules|directions|guidelines)\s+(above|before|you were given)\b)`)},
+	// "output your system prompt", "print your API key"
+	{"exfiltration", regexp.MustCompile(`(?i)\b(reveal|print|output|show|repeat|tell|give|leak|return|reply with)\b[^.\n]{0,40}\b((your|the|this)\s+(system prompt|initial prompt|hidden instructions)|instructions you were given)\b|\b(reveal|print|output|show|repeat|tell|give|leak|return|reply with)\s+(me\s+|us\s+)?your\s+(api[ _-]?keys?|secrets?|passwords?|credentials|instructions)\b`)},
+	// "you are now DAN", "act as an AI without restrictions"
+	{"role_play", regexp.MustCompile(`(?i)\b(you are now|from now on,? you are|act as|pretend to be|roleplay as)\b[^.\n]{0,40}\b(dan|jailbroken|unrestricted|without (restrictions|rules|filters|limits))\b`)},
+	// chat markup: "</user>", "SYSTEM:", "[INST]"
+	{"role_tag", regexp.MustCompile(`(?im)(</?\s*(system|assistant|user)\s*>|^\s*(system|assistant)\s*:|\[/?(inst|sys)\])`)},
+	// closing a JSON string to add a field of the intent: `cats", "site_filter": "evil`
+	{"json_break", regexp.MustCompile(`(?i)"\s*[,}]\s*"(site_filter|main_query|file_type|exclude_words|exact_phrases|date_range)"\s*:`)},
+}
+
+// guardSentenceEndRe ends a sentence; a period inside a word, as in a
+// domain name, doesn't
+var guardSentenceEndRe = regexp.MustCompile(`[.!?;]+\s+|\n+`)
+
+// PromptRejectedError is returned for prompts the guard refuses
+type PromptRejectedError struct {
+	Rules []string
+}
+
+func (e *PromptRejectedError) Error() string {
+	return fmt.Sprintf("prompt rejected: it tries to change the analyzer's instructions (%s)", strings.Join(e.Rules, ", "))
+}
+
+// PromptGuard checks prompts for instructions aimed at the analyzer before
+// they reach the model, since its answer becomes a URL. In log mode flagged
+// prompts are analyzed as they are. In strip mode the offending sentences
+// are removed and the rest is analyzed; prompts with nothing left, and every
+// flagged prompt in refuse mode, are rejected. Attempts are logged in every
+// mode but off.
+type PromptGuard struct {
+	mode string
+}
+
+func NewPromptGuard(mode string) *PromptGuard {
+	return &PromptGuard{mode: mode}
+}
+
+func validatePromptGuard(mode string) error {
+	switch mode {
+	case PromptGuardOff, PromptGuardLog, PromptGuardStrip, PromptGuardRefuse:
+		return nil
+	}
+	return fmt.Errorf("invalid prompt guard mode %q (want off, log, strip or refuse)", mode)
+}
+
+// logOnly tells whether flagged prompts are analyzed unchanged
+func (g *PromptGuard) logOnly() bool {
+	return g != nil && g.mode == PromptGuardLog
+}
+
+// UseGuard screens the prompts of the analyses
+func (h *SearchHandler) UseGuard(guard *PromptGuard) {
+	h.guard = guard
+}
+
+// Check returns the prompt to analyze and the rules it tripped, or a
+// *PromptRejectedError. In log mode the prompt is always returned as is.
+func (g *PromptGuard) Check(ctx context.Context, prompt string) (string, []string, error) {
+	if g == nil || g.mode == PromptGuardOff {
+		return prompt, nil, nil
+	}
+	var rules []string
+	var kept strings.Builder
+	for _, sentence := range splitSentences(prompt) {
+		matched := false
+		for _, rule := range promptGuardRules {
+			if rule.re.MatchString(sentence) {
+				matched = true
+				if !slices.Contains(rules, rule.name) {
+					rules = append(rules, rule.name)
+				}
+			}
+		}
+		if !matched {
+			kept.WriteString(sentence)
+		}
+	}
+	if len(rules) == 0 {
+		return prompt, nil, nil
+	}
+
+	stripped := strings.TrimSpace(kept.String())
+	action := "stripped"
+	switch {
+	case g.mode == PromptGuardLog:
+		action, stripped = "logged", prompt
+	case g.mode == PromptGuardRefuse || stripped == "":
+		action = "refused"
+	}
+	for _, rule := range rules {
+		promptInjections.Inc(rule, action)
+	}
+	slog.WarnContext(ctx, "Prompt injection attempt", "rules", rules, "action", action, "prompt", loggedPrompt(ctx, prompt))
+	spanFromContext(ctx).SetAttr("search.prompt_guard", action)
+	if action == "refused" {
+		return "", rules, &PromptRejectedError{Rules: rules}
+	}
+	return stripped, rules, nil
+}
+
+// splitSentences cuts s after each sentence end, keeping every byte
+func splitSentences(s string) []string {
+	var sentences []string
+	start := 0
+	for _, end := range guardSentenceEndRe.FindAllStringIndex(s, -1) {
+		sentences = append(sentences, s[start:end[1]])
+		start = end[1]
+	}
+	if start < len(s) {
+		sentences = append(sentences, s[start:])
+	}
+	return sentences
+}
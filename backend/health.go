@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Build information, set with
+// -ldflags "-X main.version=1.2.3 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)".
+// Without them the VCS stamp of the Go toolchain is used.
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildTime = ""
+)
+
+const (
+	readyCheckTimeout = 2 * time.Second
+	// upstreamFailureThreshold consecutive connection failures to OpenAI make
+	// the instance unready, until a call gets through again
+	upstreamFailureThreshold = 5
+)
+
+// upstreamTracker follows whether OpenAI can be reached at all. HTTP error
+// statuses count as reachable; only failed connections count.
+type upstreamTracker struct {
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+}
+
+// openAIUpstream tracks the calls made by doWithKeys
+var openAIUpstream = &upstreamTracker{}
+
+func (u *upstreamTracker) success() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures, u.lastErr = 0, nil
+}
+
+func (u *upstreamTracker) failure(err error) {
+	// A caller giving up says nothing about the upstream
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	u.lastErr = err
+}
+
+func (u *upstreamTracker) check(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failures >= upstreamFailureThreshold {
+		return fmt.Errorf("%d consecutive connection failures, last: %v", u.failures, u.lastErr)
+	}
+	return nil
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Health serves the liveness, readiness and version endpoints
+type Health struct {
+	ready  atomic.Bool
+	checks []readinessCheck
+	schema map[string]interface{}
+}
+
+// NewHealth creates the endpoints; schema describes the API schema versions
+// for /version
+func NewHealth(schema map[string]interface{}) *Health {
+	return &Health{schema: schema}
+}
+
+// AddCheck registers a dependency that must be healthy for /readyz
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, readinessCheck{name, check})
+}
+
+// SetReady marks the instance as ready (configuration loaded) or draining
+func (h *Health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+// handleLive answers as long as the process serves HTTP
+func (h *Health) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady answers 200 only once started and while every check passes
+func (h *Health) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "starting"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	results := make(map[string]string, len(h.checks))
+	for _, c := range h.checks {
+		if err := c.check(ctx); err != nil {
+			results[c.name] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+			continue
+		}
+		results[c.name] = "ok"
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": results})
+}
+
+// handleVersion reports the build and the schema versions, so clients can
+// check compatibility
+func (h *Health) handleVersion(w http.ResponseWriter, r *http.Request) {
+	commit, built := gitCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	writeCacheableJSON(w, r, cacheRevalidate, map[string]interface{}{
+		"version":    version,
+		"git_sha":    commit,
+		"build_time": built,
+		"go_version": runtime.Version(),
+		"schema":     h.schema,
+	})
+}
+
+// keysCheck fails when every OpenAI key is quarantined
+func keysCheck(keys *KeyPool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for _, st := range keys.Status() {
+			if st.Healthy {
+				return nil
+			}
+		}
+		return ErrNoHealthyKeys
+	}
+}
+
+// redisCheck pings a Redis server
+func redisCheck(client *RedisClient) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := client.Do(ctx, "PING")
+		return err
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// maxHedgeLoserWait bounds how long the request that lost a hedged race is
+// waited for, to count its tokens
+const maxHedgeLoserWait = time.Minute
+
+var hedgedRequests = metricsRegistry.Counter("openai_hedged_requests_total",
+	"OpenAI calls that were hedged, by which request answered first.", "winner")
+
+// postOnce sends the chat completion request and reads the whole response,
+// with its status
+func (h *SearchHandler) postOnce(ctx context.Context, jsonBody []byte) ([]byte, int, error) {
+	resp, err := h.doWithKeys(ctx, "chat_completion", OPENAI_API_URL, "application/json", jsonBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading response body: %w", err)
+	}
+	return body, resp.StatusCode, nil
+}
+
+// hedgeOutcome is the answer of one of the racing requests
+type hedgeOutcome struct {
+	body   []byte
+	status int
+	err    error
+	hedge  bool
+}
+
+func (o hedgeOutcome) ok() bool {
+	return o.err == nil && o.status >= 200 && o.status < 300
+}
+
+// postHedged sends the request and, if no answer came within hedgeDelay,
+// races a second copy (on the next key in the pool) and keeps the first
+// successful answer. The hedge takes an upstream slot when one is free and
+// goes out without one otherwise, so it still cuts the tail under load. Both
+// requests are billed, so the one that loses is waited for in the background
+// and its tokens recorded like the winner's.
+func (h *SearchHandler) postHedged(ctx context.Context, model string, jsonBody []byte) ([]byte, error) {
+	if h.hedgeDelay <= 0 {
+		body, _, err := h.postOnce(ctx, jsonBody)
+		return body, err
+	}
+
+	// The requests outlive ctx once one has won, until then they end with it
+	sendCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), maxHedgeLoserWait)
+	results := make(chan hedgeOutcome, 2)
+	send := func(hedge bool) {
+		body, status, err := h.postOnce(sendCtx, jsonBody)
+		results <- hedgeOutcome{body, status, err, hedge}
+	}
+	go send(false)
+
+	timer := time.NewTimer(h.hedgeDelay)
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	var failed *hedgeOutcome
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			// %w keeps a context deadline recognizable to writeAnalyzeError
+			return nil, fmt.Errorf("error calling OpenAI: %w", ctx.Err())
+
+		case <-timer.C:
+			pending, hedged = pending+1, true
+			release, slot := h.limiter.TryAcquire()
+			go func() {
+				if slot {
+					defer release()
+				}
+				send(true)
+			}()
+
+		case res := <-results:
+			pending--
+			if res.ok() {
+				if hedged {
+					winner := "primary"
+					if res.hedge {
+						winner = "hedge"
+					}
+					hedgedRequests.Inc(winner)
+					spanFromContext(ctx).SetAttr("openai.hedge_winner", winner)
+				}
+				if pending > 0 {
+					go h.countHedgeLoser(context.WithoutCancel(ctx), model, results, cancel)
+				} else {
+					cancel()
+				}
+				return res.body, nil
+			}
+			// An error answer is only returned when no request succeeds
+			if failed == nil || (failed.err != nil && res.err == nil) {
+				failed = &res
+			}
+			if pending == 0 {
+				cancel()
+				if failed.err != nil {
+					return nil, failed.err
+				}
+				return failed.body, nil
+			}
+		}
+	}
+}
+
+// countHedgeLoser waits for the request that lost the race and records the
+// tokens it was billed for
+func (h *SearchHandler) countHedgeLoser(ctx context.Context, model string, results <-chan hedgeOutcome, cancel context.CancelFunc) {
+	defer cancel()
+	res := <-results
+	if res.err != nil {
+		return
+	}
+	var resp OpenAIResponse
+	if err := json.Unmarshal(res.body, &resp); err != nil {
+		return
+	}
+	h.recordUsage(ctx, model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+}
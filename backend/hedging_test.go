@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPostHedged(t *testing.T) {
+	const usage = `{"choices":[{"message":{"content":"{}"}}],"usage":{"prompt_tokens":100000,"completion_tokens":0}}`
+	tests := []struct {
+		name string
+		// the hedge answers first, then the primary request
+		hedge, primary int
+		want           string
+		loserCounted   bool
+	}{
+		{"hedge wins", http.StatusOK, http.StatusOK, "hedge", true},
+		{"error answer never wins", http.StatusInternalServerError, http.StatusOK, "primary", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hedgeAnswered := make(chan struct{})
+			doer := &fakeDoer{answers: []func(*http.Request) (*http.Response, error){
+				func(*http.Request) (*http.Response, error) {
+					<-hedgeAnswered
+					return fakeResponse(tt.primary, `{"id":"primary",`+usage[1:]), nil
+				},
+				func(*http.Request) (*http.Response, error) {
+					defer close(hedgeAnswered)
+					if tt.hedge != http.StatusOK {
+						return fakeResponse(tt.hedge, `{"error":{"message":"overloaded"}}`), nil
+					}
+					return fakeResponse(tt.hedge, `{"id":"hedge",`+usage[1:]), nil
+				},
+			}}
+			keys, err := NewKeyPool([]string{"sk-one", "sk-two"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every upstream slot is taken, the hedge goes out anyway
+			limiter := NewUpstreamLimiter(1, 1, time.Second, false)
+			release, _ := limiter.TryAcquire()
+			defer release()
+			budget := NewBudgetTracker(NewMemorySpendStore(), 100, 0, BudgetActionFallback)
+			h := &SearchHandler{keys: keys, client: doer, limiter: limiter, budget: budget, hedgeDelay: time.Millisecond}
+
+			body, err := h.postHedged(context.Background(), "gpt-4o-mini", []byte("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `{"id":"` + tt.want + `"`; string(body[:len(want)]) != want {
+				t.Errorf("answer %.20s, want the %s's", body, tt.want)
+			}
+			if doer.Calls() != 2 {
+				t.Errorf("%d requests sent, want 2", doer.Calls())
+			}
+
+			// The winner is recorded by the caller, the loser in the background
+			spent := false
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !spent; time.Sleep(5 * time.Millisecond) {
+				spent = budget.Remaining(context.Background()) < 100
+			}
+			if spent != tt.loserCounted {
+				t.Errorf("loser recorded in the budget: %v, want %v", spent, tt.loserCounted)
+			}
+		})
+	}
+}
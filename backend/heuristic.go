@@ -0,0 +1,124 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The heuristic parser is a rule based stand-in for the OpenAI analysis. It
+// only understands the common phrasings, but costs nothing and never fails,
+// so it's used when the LLM must not (or cannot) be called.
+
+var (
+	quotedPhraseRe = regexp.MustCompile(`"([^"]+)"`)
+	siteOperatorRe = regexp.MustCompile(`(?i)\bsite:(\S+)`)
+	siteMentionRe  = regexp.MustCompile(`(?i)\b(?:from|on|at)\s+((?:[a-z0-9-]+\.)+[a-z]{2,})\b`)
+	fileTypeRe     = regexp.MustCompile(`(?i)\b(?:filetype:)?(pdf|docx?|pptx?|xlsx?|csv|txt|epub)\b(?:\s+(?:files?|documents?))?`)
+	excludeRe      = regexp.MustCompile(`(?i)(?:^|\s)-(\w+)|\b(?:without|excluding|except|but not)\s+(\w+)`)
+	sinceYearRe    = regexp.MustCompile(`(?i)\b(?:since|after|from)\s+((?:19|20)\d{2})\b`)
+	relativeDateRe = regexp.MustCompile(`(?i)\b(?:in\s+|from\s+|over\s+|published\s+in\s+)?(?:the\s+)?(?:last|past)\s+(day|week|month|year|\d+\s+(?:days|weeks|months|years))\b`)
+	fillerRe       = regexp.MustCompile(`(?i)^\s*(?:please\s+)?(?:can you\s+)?(?:find|search(?: for)?|look(?:ing)? for|show|get|give)(?:\s+me)?\s+`)
+	spacesRe       = regexp.MustCompile(`\s+`)
+)
+
+// knownSites maps site names people say to the domain to filter on
+var knownSites = map[string]string{
+	"arxiv":          "arxiv.org",
+	"github":         "github.com",
+	"reddit":         "reddit.com",
+	"stackoverflow":  "stackoverflow.com",
+	"stack overflow": "stackoverflow.com",
+	"wikipedia":      "wikipedia.org",
+	"youtube":        "youtube.com",
+	"hacker news":    "news.ycombinator.com",
+	"medium":         "medium.com",
+}
+
+var knownSiteRe = func() *regexp.Regexp {
+	names := make([]string, 0, len(knownSites))
+	for name := range knownSites {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	return regexp.MustCompile(`(?i)\b(?:from|on|at)\s+(` + strings.Join(names, "|") + `)\b`)
+}()
+
+// parsePromptHeuristically extracts a SearchIntent from the prompt with regular expressions
+func parsePromptHeuristically(prompt string, now time.Time) *SearchIntent {
+	intent := &SearchIntent{ExactPhrases: []string{}, ExcludeWords: []string{}}
+	rest := prompt
+
+	for _, m := range quotedPhraseRe.FindAllStringSubmatch(rest, -1) {
+		intent.ExactPhrases = append(intent.ExactPhrases, strings.TrimSpace(m[1]))
+	}
+	rest = quotedPhraseRe.ReplaceAllString(rest, " ")
+
+	if m := siteOperatorRe.FindStringSubmatch(rest); m != nil {
+		intent.SiteFilter = m[1]
+		rest = strings.Replace(rest, m[0], " ", 1)
+	} else if m := siteMentionRe.FindStringSubmatch(rest); m != nil {
+		intent.SiteFilter = strings.ToLower(m[1])
+		rest = strings.Replace(rest, m[0], " ", 1)
+	} else if m := knownSiteRe.FindStringSubmatch(rest); m != nil {
+		intent.SiteFilter = knownSites[strings.ToLower(m[1])]
+		rest = strings.Replace(rest, m[0], " ", 1)
+	}
+
+	if m := fileTypeRe.FindStringSubmatch(rest); m != nil {
+		intent.FileType = strings.ToLower(m[1])
+		rest = strings.Replace(rest, m[0], " ", 1)
+	}
+
+	for _, m := range excludeRe.FindAllStringSubmatch(rest, -1) {
+		word := m[1]
+		if word == "" {
+			word = m[2]
+		}
+		intent.ExcludeWords = append(intent.ExcludeWords, strings.ToLower(word))
+	}
+	rest = excludeRe.ReplaceAllString(rest, " ")
+
+	if m := relativeDateRe.FindStringSubmatch(rest); m != nil {
+		intent.DateRange = relativeDate(strings.ToLower(m[1]), now)
+		rest = strings.Replace(rest, m[0], " ", 1)
+	} else if m := sinceYearRe.FindStringSubmatch(rest); m != nil {
+		intent.DateRange = m[1] + "-01-01"
+		rest = strings.Replace(rest, m[0], " ", 1)
+	}
+
+	rest = fillerRe.ReplaceAllString(rest, "")
+	rest = strings.Trim(spacesRe.ReplaceAllString(rest, " "), " ,.?!")
+	if rest == "" && len(intent.ExactPhrases) > 0 {
+		rest = intent.ExactPhrases[0]
+		intent.ExactPhrases = intent.ExactPhrases[1:]
+	}
+	intent.MainQuery = rest
+
+	return intent
+}
+
+// relativeDate turns "week" or "3 months" into the ISO date that long before now
+func relativeDate(span string, now time.Time) string {
+	n := 1
+	unit := span
+	if fields := strings.Fields(span); len(fields) == 2 {
+		if v, err := strconv.Atoi(fields[0]); err == nil {
+			n = v
+		}
+		unit = strings.TrimSuffix(fields[1], "s")
+	}
+
+	var t time.Time
+	switch unit {
+	case "day":
+		t = now.AddDate(0, 0, -n)
+	case "week":
+		t = now.AddDate(0, 0, -7*n)
+	case "month":
+		t = now.AddDate(0, -n, 0)
+	default:
+		t = now.AddDate(-n, 0, 0)
+	}
+	return t.Format("2006-01-02")
+}
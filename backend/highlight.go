@@ -0,0 +1,156 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Highlights are wrapped in these tags, the rest of the snippet is escaped,
+// so a snippet_html can be inserted in a page as is
+const (
+	highlightOpen  = "<mark>"
+	highlightClose = "</mark>"
+)
+
+// highlightStopWords aren't highlighted on their own, they'd mark most of
+// a snippet; they still are within an exact phrase
+var highlightStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true, "for": true,
+	"from": true, "how": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true, "the": true,
+	"to": true, "was": true, "what": true, "when": true, "where": true, "which": true, "who": true, "why": true,
+	"with": true,
+}
+
+// Highlighter marks the terms of an intent in snippets: the words of the
+// main query, matched whole and ignoring case, and the exact phrases
+type Highlighter struct {
+	terms   map[string]bool
+	phrases []*regexp.Regexp
+}
+
+// NewHighlighter prepares the highlighting of the intent's terms
+func NewHighlighter(intent *SearchIntent) *Highlighter {
+	h := &Highlighter{terms: make(map[string]bool)}
+	for _, word := range highlightWords(intent.MainQuery) {
+		if w := strings.ToLower(word.text); !highlightStopWords[w] {
+			h.terms[w] = true
+		}
+	}
+	for _, phrase := range intent.ExactPhrases {
+		words := strings.Fields(phrase)
+		if len(words) == 0 {
+			continue
+		}
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		// Phrases match across any run of spaces, like the engines do
+		h.phrases = append(h.phrases, regexp.MustCompile(`(?i)`+strings.Join(words, `\s+`)))
+	}
+	return h
+}
+
+// Empty tells whether there is nothing to highlight
+func (h *Highlighter) Empty() bool {
+	return len(h.terms) == 0 && len(h.phrases) == 0
+}
+
+// HTML returns the text escaped for HTML with its matches in <mark> tags
+func (h *Highlighter) HTML(text string) string {
+	type span struct{ start, end int }
+	var spans []span
+	for _, re := range h.phrases {
+		for _, m := range re.FindAllStringIndex(text, -1) {
+			// A phrase matches whole words only
+			if wordBoundary(text, m[0]) && wordBoundary(text, m[1]) {
+				spans = append(spans, span{m[0], m[1]})
+			}
+		}
+	}
+	for _, word := range highlightWords(text) {
+		if h.terms[strings.ToLower(word.text)] {
+			spans = append(spans, span{word.start, word.start + len(word.text)})
+		}
+	}
+	if len(spans) == 0 {
+		return html.EscapeString(text)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var b strings.Builder
+	pos := 0
+	for i := 0; i < len(spans); {
+		// Overlapping and adjacent matches make one mark
+		start, end := spans[i].start, spans[i].end
+		for i++; i < len(spans) && spans[i].start <= end; i++ {
+			end = max(end, spans[i].end)
+		}
+		if start < pos {
+			start = pos
+		}
+		b.WriteString(html.EscapeString(text[pos:start]))
+		b.WriteString(highlightOpen)
+		b.WriteString(html.EscapeString(text[start:end]))
+		b.WriteString(highlightClose)
+		pos = end
+	}
+	b.WriteString(html.EscapeString(text[pos:]))
+	return b.String()
+}
+
+// Results returns a copy of the results with their snippet_html set; the
+// results themselves may be shared with the results cache
+func (h *Highlighter) Results(results []SearchResult) []SearchResult {
+	out := make([]SearchResult, len(results))
+	copy(out, results)
+	if h.Empty() {
+		return out
+	}
+	for i := range out {
+		if out[i].Snippet != "" {
+			out[i].SnippetHTML = h.HTML(out[i].Snippet)
+		}
+	}
+	return out
+}
+
+type highlightWord struct {
+	text  string
+	start int
+}
+
+// highlightWords splits text into its words, runs of letters and digits,
+// with their byte offsets
+func highlightWords(text string) []highlightWord {
+	var words []highlightWord
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			words = append(words, highlightWord{text[start:i], start})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, highlightWord{text[start:], start})
+	}
+	return words
+}
+
+// wordBoundary tells whether the byte offset i of text isn't inside a word
+func wordBoundary(text string, i int) bool {
+	if i == 0 || i == len(text) {
+		return true
+	}
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i:])
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	return !isWord(before) || !isWord(after)
+}
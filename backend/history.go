@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is one stored search. For clients in encryption mode Prompt
+// and Intent are empty; the content is only available in Encrypted, and
+// Fingerprints are the sole thing the server can match on.
+type HistoryRecord struct {
+	ID           string            `json:"id"`
+	TenantID     string            `json:"tenant_id"`
+	UserID       string            `json:"user_id,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Prompt       string            `json:"prompt,omitempty"`
+	Intent       *SearchIntent     `json:"intent,omitempty"`
+	SearchURL    string            `json:"search_url,omitempty"`
+	Engine       string            `json:"engine,omitempty"`
+	Analyzer     string            `json:"analyzer"`
+	Encrypted    *EncryptedPayload `json:"encrypted,omitempty"`
+	Fingerprints []string          `json:"fingerprints,omitempty"`
+	// TraceID is the trace of the request that made the search
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// HistoryStore persists search history
+type HistoryStore interface {
+	Add(ctx context.Context, rec *HistoryRecord) error
+	// FindByFingerprints returns the owner's records carrying all fingerprints, newest first
+	FindByFingerprints(ctx context.Context, tenantID, userID string, fingerprints []string) ([]*HistoryRecord, error)
+	// ListOlderThan returns up to limit records created before cutoff, oldest first
+	ListOlderThan(ctx context.Context, cutoff time.Time, limit int) ([]*HistoryRecord, error)
+	Delete(ctx context.Context, ids []string) error
+	// List returns up to f.Limit of the owner's records matching f, newest first
+	List(ctx context.Context, f HistoryFilter) ([]*HistoryRecord, error)
+	// Get returns one of the owner's records, nil when there is none
+	Get(ctx context.Context, tenantID, userID, id string) (*HistoryRecord, error)
+	// DeleteOwned deletes one record if it belongs to the owner
+	DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error)
+	// DeleteAllOwned deletes all of the owner's records and returns how many there were
+	DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error)
+	// Recording tells whether the user opted in to having their searches recorded
+	Recording(ctx context.Context, tenantID, userID string) (bool, error)
+	// SetRecording opts the user in or out; opting out forgets the setting
+	SetRecording(ctx context.Context, tenantID, userID string, on bool) error
+}
+
+// HistoryFilter selects an owner's records for listing. Records come newest
+// first; a page continues after the record at AfterTime/AfterID.
+type HistoryFilter struct {
+	TenantID string
+	UserID   string
+	// Since and Until bound CreatedAt when set, Until exclusive
+	Since time.Time
+	Until time.Time
+	// Engine matches exactly, Query is a case-insensitive substring of the
+	// prompt, so encrypted records never match it
+	Engine    string
+	Query     string
+	AfterTime time.Time
+	AfterID   string
+	Limit     int
+}
+
+// match checks everything but the owner and the page position
+func (f *HistoryFilter) match(rec *HistoryRecord) bool {
+	if !f.Since.IsZero() && rec.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.CreatedAt.Before(f.Until) {
+		return false
+	}
+	if f.Engine != "" && rec.Engine != f.Engine {
+		return false
+	}
+	return f.Query == "" || strings.Contains(strings.ToLower(rec.Prompt), strings.ToLower(f.Query))
+}
+
+// newerFirst orders records by creation time, then ID, both descending
+func newerFirst(a, b *HistoryRecord) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID > b.ID
+}
+
+// userIDFromRequest returns the end user a tenant says it acts for, with the
+// X-User-ID header; it is only meaningful within the tenant. The header alone
+// proves nothing, authenticatedOwner tells whom to believe.
+func userIDFromRequest(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get("X-User-ID"))
+}
+
+func newHistoryID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// maxMemoryHistoryRecords caps the memory store; past it the oldest tenth
+// of the records are dropped
+const maxMemoryHistoryRecords = 100000
+
+// memoryHistoryStore keeps history in process memory, mainly for development
+type memoryHistoryStore struct {
+	mu      sync.RWMutex
+	records []*HistoryRecord
+	// recording holds the users who opted in, by tenant and user
+	recording map[[2]string]bool
+}
+
+func NewMemoryHistoryStore() *memoryHistoryStore {
+	return &memoryHistoryStore{recording: make(map[[2]string]bool)}
+}
+
+func (s *memoryHistoryStore) Add(ctx context.Context, rec *HistoryRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) >= maxMemoryHistoryRecords {
+		// Records are added in time order but for imports, so the first
+		// ones are about the oldest
+		drop := maxMemoryHistoryRecords / 10
+		clear(s.records[:drop])
+		s.records = slices.Delete(s.records, 0, drop)
+	}
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *memoryHistoryStore) Recording(ctx context.Context, tenantID, userID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recording[[2]string{tenantID, userID}], nil
+}
+
+func (s *memoryHistoryStore) SetRecording(ctx context.Context, tenantID, userID string, on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if on {
+		s.recording[[2]string{tenantID, userID}] = true
+	} else {
+		delete(s.recording, [2]string{tenantID, userID})
+	}
+	return nil
+}
+
+func (s *memoryHistoryStore) FindByFingerprints(ctx context.Context, tenantID, userID string, fingerprints []string) ([]*HistoryRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*HistoryRecord
+	for _, rec := range s.records {
+		if rec.TenantID != tenantID || rec.UserID != userID {
+			continue
+		}
+		if containsAll(rec.Fingerprints, fingerprints) {
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (s *memoryHistoryStore) ListOlderThan(ctx context.Context, cutoff time.Time, limit int) ([]*HistoryRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []*HistoryRecord
+	for _, rec := range s.records {
+		if rec.CreatedAt.Before(cutoff) {
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryHistoryStore) Delete(ctx context.Context, ids []string) error {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.records[:0]
+	for _, rec := range s.records {
+		if !drop[rec.ID] {
+			kept = append(kept, rec)
+		}
+	}
+	clear(s.records[len(kept):])
+	s.records = kept
+	return nil
+}
+
+func (s *memoryHistoryStore) List(ctx context.Context, f HistoryFilter) ([]*HistoryRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cursor := &HistoryRecord{CreatedAt: f.AfterTime, ID: f.AfterID}
+	var out []*HistoryRecord
+	for _, rec := range s.records {
+		if rec.TenantID != f.TenantID || rec.UserID != f.UserID || !f.match(rec) {
+			continue
+		}
+		if f.AfterID != "" && !newerFirst(cursor, rec) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return newerFirst(out[i], out[j]) })
+	if len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out, nil
+}
+
+func (s *memoryHistoryStore) Get(ctx context.Context, tenantID, userID, id string) (*HistoryRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, rec := range s.records {
+		if rec.ID == id && rec.TenantID == tenantID && rec.UserID == userID {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryHistoryStore) DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, rec := range s.records {
+		if rec.ID == id && rec.TenantID == tenantID && rec.UserID == userID {
+			s.records = slices.Delete(s.records, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryHistoryStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.records)
+	s.records = slices.DeleteFunc(s.records, func(rec *HistoryRecord) bool {
+		return rec.TenantID == tenantID && rec.UserID == userID
+	})
+	return n - len(s.records), nil
+}
+
+func containsAll(have, want []string) bool {
+	set := make(map[string]bool, len(have))
+	for _, h := range have {
+		set[h] = true
+	}
+	for _, w := range want {
+		if !set[w] {
+			return false
+		}
+	}
+	return true
+}
+
+// HistoryService records searches and serves history lookups
+type HistoryService struct {
+	store        HistoryStore
+	fingerprints *Fingerprinter
+}
+
+func NewHistoryService(store HistoryStore, fingerprints *Fingerprinter) *HistoryService {
+	return &HistoryService{store: store, fingerprints: fingerprints}
+}
+
+// Record stores a completed search and returns its ID, empty when it wasn't
+// stored. Only the searches of authenticated users who opted in with
+// PUT /v1/history/settings are stored. With an X-History-Public-Key header
+// the prompt and intent are sealed to the client's key instead of stored in
+// clear.
+func (s *HistoryService) Record(r *http.Request, prompt string, result *AnalysisResult, searchURL string) string {
+	ctx := r.Context()
+	tenantID, userID, ok := authenticatedOwner(r)
+	if !ok {
+		return ""
+	}
+	on, err := s.store.Recording(ctx, tenantID, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading history setting", "error", err)
+		return ""
+	}
+	if !on {
+		return ""
+	}
+	rec := &HistoryRecord{
+		ID:        newHistoryID(),
+		TenantID:  tenantID,
+		UserID:    userID,
+		CreatedAt: time.Now().UTC(),
+		Analyzer:  result.Analyzer,
+		Engine:    defaultEngine.Load().Name,
+		TraceID:   spanFromContext(ctx).TraceID(),
+	}
+
+	var clientKey []byte
+	if encoded := strings.TrimSpace(r.Header.Get("X-History-Public-Key")); encoded != "" {
+		pub, err := parseHistoryPublicKey(encoded)
+		if err != nil {
+			slog.WarnContext(ctx, "Not recording history", "error", err)
+			return ""
+		}
+		plaintext, err := json.Marshal(map[string]interface{}{
+			"prompt":     prompt,
+			"intent":     result.Intent,
+			"search_url": searchURL,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error encoding history entry", "error", err)
+			return ""
+		}
+		if rec.Encrypted, err = sealForClient(pub, plaintext); err != nil {
+			slog.ErrorContext(ctx, "Error encrypting history entry", "error", err)
+			return ""
+		}
+		clientKey = pub.Bytes()
+	} else {
+		rec.Prompt = prompt
+		rec.Intent = result.Intent
+		rec.SearchURL = searchURL
+	}
+	rec.Fingerprints = s.fingerprints.Fingerprints(clientKey, IntentTerms(result.Intent))
+
+	if err := s.store.Add(ctx, rec); err != nil {
+		slog.ErrorContext(ctx, "Error storing history entry", "error", err)
+		return ""
+	}
+	return rec.ID
+}
+
+// Import stores a search made before this service existed, in clear
+func (s *HistoryService) Import(ctx context.Context, tenantID, userID string, createdAt time.Time, prompt string, result *AnalysisResult) error {
+	return s.store.Add(ctx, &HistoryRecord{
+		ID:           newHistoryID(),
+		TenantID:     tenantID,
+		UserID:       userID,
+		CreatedAt:    createdAt.UTC(),
+		Analyzer:     result.Analyzer,
+		Prompt:       prompt,
+		Intent:       result.Intent,
+		SearchURL:    constructSearchQuery(result.Intent),
+		Engine:       defaultEngine.Load().Name,
+		Fingerprints: s.fingerprints.Fingerprints(nil, IntentTerms(result.Intent)),
+	})
+}
+
+// handleSearch finds the caller's history entries matching a query such as
+// `kubernetes operators site:github.com`. Encrypted clients must send the same
+// X-History-Public-Key they record with; matching only uses fingerprints.
+func (s *HistoryService) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	terms := queryTerms(req.Query)
+	if len(terms) == 0 {
+		http.Error(w, "Query has no searchable terms", http.StatusBadRequest)
+		return
+	}
+
+	var clientKey []byte
+	if encoded := strings.TrimSpace(r.Header.Get("X-History-Public-Key")); encoded != "" {
+		pub, err := parseHistoryPublicKey(encoded)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clientKey = pub.Bytes()
+	}
+
+	records, err := s.store.FindByFingerprints(r.Context(), tenantID, userID, s.fingerprints.Fingerprints(clientKey, terms))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error searching history", "error", err)
+		http.Error(w, "Error searching history", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []*HistoryRecord{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": records})
+}
+
+// parseHistoryFilter reads the since, until (RFC 3339 or YYYY-MM-DD), engine
+// and q parameters shared by the listing endpoints; the owner is up to the
+// caller
+func parseHistoryFilter(r *http.Request) (HistoryFilter, error) {
+	f := HistoryFilter{}
+	params := r.URL.Query()
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		v := params.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				return f, fmt.Errorf("invalid %s %q, expected RFC 3339 or YYYY-MM-DD", name, v)
+			}
+		}
+		*dst = t.UTC()
+	}
+	f.Engine = params.Get("engine")
+	f.Query = strings.TrimSpace(params.Get("q"))
+	return f, nil
+}
+
+// encodeHistoryCursor points after rec; cursors are opaque to clients
+func encodeHistoryCursor(rec *HistoryRecord) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(rec.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + rec.ID))
+}
+
+func decodeHistoryCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid cursor")
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if !ok || err != nil || id == "" {
+		return time.Time{}, "", fmt.Errorf("invalid cursor")
+	}
+	return t, id, nil
+}
+
+// handleList pages through the caller's history (GET) or clears it (DELETE).
+// GET takes limit (1-100, default 20), the next_cursor of the previous page
+// as cursor, and the filters of parseHistoryFilter.
+func (s *HistoryService) handleList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.handleClear(w, r)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	f, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.TenantID, f.UserID = tenantID, userID
+	f.Limit = 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		f.Limit = n
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if f.AfterTime, f.AfterID, err = decodeHistoryCursor(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// One extra record tells whether there is a next page
+	limit := f.Limit
+	f.Limit++
+	records, err := s.store.List(r.Context(), f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing history", "error", err)
+		http.Error(w, "Error listing history", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{}
+	if len(records) > limit {
+		records = records[:limit]
+		resp["next_cursor"] = encodeHistoryCursor(records[limit-1])
+	}
+	if records == nil {
+		records = []*HistoryRecord{}
+	}
+	resp["history"] = records
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleClear deletes all of the caller's history
+func (s *HistoryService) handleClear(w http.ResponseWriter, r *http.Request) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	n, err := s.store.DeleteAllOwned(r.Context(), tenantID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error clearing history", "error", err)
+		http.Error(w, "Error clearing history", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "History cleared", "tenant", tenantID, "entries", n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": n})
+}
+
+// handleSettings reads (GET) or changes (PUT) whether the caller's searches
+// are recorded: {"recording": true}. Turning it off keeps the entries
+// already recorded, DELETE /v1/history removes them.
+func (s *HistoryService) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var req struct {
+			Recording *bool `json:"recording"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Recording == nil {
+			http.Error(w, `Invalid request body, expected {"recording": true|false}`, http.StatusBadRequest)
+			return
+		}
+		if err := s.store.SetRecording(r.Context(), tenantID, userID, *req.Recording); err != nil {
+			slog.ErrorContext(r.Context(), "Error saving history setting", "error", err)
+			http.Error(w, "Error saving history setting", http.StatusInternalServerError)
+			return
+		}
+	}
+	on, err := s.store.Recording(r.Context(), tenantID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading history setting", "error", err)
+		http.Error(w, "Error reading history setting", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"recording": on})
+}
+
+// handleEntry deletes one entry of the caller's history. Entries of other
+// users are reported as not found, so IDs can't be probed.
+func (s *HistoryService) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := s.store.DeleteOwned(r.Context(), tenantID, userID, r.PathValue("id"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting history entry", "error", err)
+		http.Error(w, "Error deleting history entry", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "History entry not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryTerms normalizes a history query the same way IntentTerms does
+func queryTerms(query string) []string {
+	intent := &SearchIntent{}
+	var words []string
+	for _, field := range strings.Fields(query) {
+		lower := strings.ToLower(field)
+		switch {
+		case strings.HasPrefix(lower, "site:"):
+			intent.SiteFilter = strings.TrimPrefix(lower, "site:")
+		case strings.HasPrefix(lower, "filetype:"):
+			intent.FileType = strings.TrimPrefix(lower, "filetype:")
+		default:
+			words = append(words, field)
+		}
+	}
+	intent.MainQuery = strings.Join(words, " ")
+	return IntentTerms(intent)
+}
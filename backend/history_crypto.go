@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Client-side encryption mode: a client sends its X25519 public key in the
+// X-History-Public-Key header and its history is stored sealed to that key
+// (ephemeral X25519 + HKDF-SHA256 + AES-256-GCM). The server keeps only keyed
+// fingerprints of the intent terms, so it can match searches without being
+// able to read them back.
+
+const historyEncryptionAlgorithm = "X25519-HKDF-SHA256-A256GCM"
+
+const historyKeyInfo = "ai-powered-search history v1"
+
+// EncryptedPayload is a sealed history entry; all binary fields are base64
+type EncryptedPayload struct {
+	Algorithm          string `json:"alg"`
+	EphemeralPublicKey string `json:"epk"`
+	Nonce              string `json:"nonce"`
+	Ciphertext         string `json:"ciphertext"`
+}
+
+// parseHistoryPublicKey decodes a base64 X25519 public key
+func parseHistoryPublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if raw, err = base64.RawURLEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("public key is not valid base64")
+		}
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key: %v", err)
+	}
+	return pub, nil
+}
+
+// sealForClient encrypts plaintext so that only the holder of the private key
+// matching pub can decrypt it. The client derives the same AES key from
+// ECDH(priv, epk) with HKDF-SHA256, salt epk||pub and the historyKeyInfo string.
+func sealForClient(pub *ecdh.PublicKey, plaintext []byte) (*EncryptedPayload, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error generating ephemeral key: %v", err)
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving shared secret: %v", err)
+	}
+
+	epk := ephemeral.PublicKey().Bytes()
+	salt := append(append([]byte{}, epk...), pub.Bytes()...)
+	key, err := hkdf.Key(sha256.New, shared, salt, historyKeyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	return &EncryptedPayload{
+		Algorithm:          historyEncryptionAlgorithm,
+		EphemeralPublicKey: base64.StdEncoding.EncodeToString(epk),
+		Nonce:              base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:         base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}, nil
+}
+
+// Fingerprinter derives opaque, per-client fingerprints for intent terms.
+// Fingerprints are keyed by a server secret and the client's public key, so
+// the same term yields unrelated values for different clients.
+type Fingerprinter struct {
+	secret []byte
+}
+
+func NewFingerprinter(secret []byte) *Fingerprinter {
+	return &Fingerprinter{secret: secret}
+}
+
+var fingerprintWordRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// IntentTerms lists the normalized terms of an intent that can be searched on
+func IntentTerms(intent *SearchIntent) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+
+	for _, w := range fingerprintWordRe.FindAllString(strings.ToLower(intent.MainQuery), -1) {
+		add("q:" + w)
+	}
+	for _, p := range intent.ExactPhrases {
+		for _, w := range fingerprintWordRe.FindAllString(strings.ToLower(p), -1) {
+			add("q:" + w)
+		}
+	}
+	if intent.SiteFilter != "" {
+		add("site:" + strings.ToLower(intent.SiteFilter))
+	}
+	if intent.FileType != "" {
+		add("filetype:" + strings.ToLower(intent.FileType))
+	}
+	return terms
+}
+
+// Fingerprints hashes terms for the client identified by clientKey (nil for plaintext clients)
+func (f *Fingerprinter) Fingerprints(clientKey []byte, terms []string) []string {
+	keyMac := hmac.New(sha256.New, f.secret)
+	keyMac.Write(clientKey)
+	key := keyMac.Sum(nil)
+
+	out := make([]string, 0, len(terms))
+	for _, t := range terms {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(t))
+		out = append(out, hex.EncodeToString(mac.Sum(nil)[:16]))
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// historyExportBatch is how many records each store query of an export reads
+const historyExportBatch = 500
+
+// historyCSVHeader lists the export columns; intents are flattened like the
+// Zapier fields, encrypted entries keep their payload as JSON
+var historyCSVHeader = []string{
+	"id", "created_at", "engine", "analyzer", "prompt", "search_url",
+	"main_query", "exact_phrases", "site_filter", "file_type", "exclude_words", "date_range",
+	"encrypted",
+}
+
+// handleExport streams the caller's history, newest first, as a JSON array
+// (format=json, the default) or CSV (format=csv). It takes the filters of
+// parseHistoryFilter and reads the store in batches, so exports of any size
+// run in constant memory.
+func (s *HistoryService) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	f, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.TenantID, f.UserID = tenantID, userID
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	var (
+		write  func(rec *HistoryRecord) error
+		finish func() error
+	)
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		first := true
+		write = func(rec *HistoryRecord) error {
+			// Fingerprints are server-side keyed hashes, of no use outside
+			exported := *rec
+			exported.Fingerprints = nil
+			data, err := json.Marshal(&exported)
+			if err != nil {
+				return err
+			}
+			sep := ",\n"
+			if first {
+				sep, first = "[\n", false
+			}
+			_, err = w.Write(append([]byte(sep), data...))
+			return err
+		}
+		finish = func() error {
+			end := "\n]\n"
+			if first {
+				end = "[]\n"
+			}
+			_, err := w.Write([]byte(end))
+			return err
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		wroteHeader := false
+		write = func(rec *HistoryRecord) error {
+			if !wroteHeader {
+				wroteHeader = true
+				if err := cw.Write(historyCSVHeader); err != nil {
+					return err
+				}
+			}
+			return cw.Write(historyCSVRow(rec))
+		}
+		finish = func() error {
+			if !wroteHeader {
+				cw.Write(historyCSVHeader)
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="history-%s.%s"`, time.Now().UTC().Format("20060102"), format))
+
+	rc := http.NewResponseController(w)
+	exported := 0
+	f.Limit = historyExportBatch
+	for {
+		records, err := s.store.List(r.Context(), f)
+		if err == nil {
+			for _, rec := range records {
+				if err = write(rec); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			// The status is already sent; cut the connection so the client
+			// sees a failed download rather than a truncated file
+			slog.ErrorContext(r.Context(), "History export failed", "exported", exported, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		exported += len(records)
+		rc.Flush()
+		if len(records) < f.Limit {
+			break
+		}
+		last := records[len(records)-1]
+		f.AfterTime, f.AfterID = last.CreatedAt, last.ID
+	}
+	if err := finish(); err != nil {
+		slog.ErrorContext(r.Context(), "History export failed", "exported", exported, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	slog.InfoContext(r.Context(), "History exported", "format", format, "entries", exported)
+}
+
+func historyCSVRow(rec *HistoryRecord) []string {
+	row := []string{
+		rec.ID, rec.CreatedAt.UTC().Format(time.RFC3339), rec.Engine, rec.Analyzer, rec.Prompt, rec.SearchURL,
+		"", "", "", "", "", "",
+		"",
+	}
+	if in := rec.Intent; in != nil {
+		copy(row[6:], []string{
+			in.MainQuery, strings.Join(in.ExactPhrases, ", "), in.SiteFilter, in.FileType,
+			strings.Join(in.ExcludeWords, ", "), in.DateRange,
+		})
+	}
+	if rec.Encrypted != nil {
+		if data, err := json.Marshal(rec.Encrypted); err == nil {
+			row[12] = string(data)
+		}
+	}
+	for i, cell := range row {
+		row[i] = csvSafe(cell)
+	}
+	return row
+}
+
+// csvSafe keeps spreadsheets from running a cell as a formula: prompts are
+// user input, and one starting with =, +, -, @ (or a tab or carriage return
+// before them) gets a leading quote
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
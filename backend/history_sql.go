@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL history dialects; their drivers are only linked in with the matching
+// build tag, so default builds stay free of cgo and extra modules
+const (
+	HistoryStoreMemory   = "memory"
+	HistoryStoreSQLite   = "sqlite"
+	HistoryStorePostgres = "postgres"
+)
+
+// historyDrivers maps a dialect to the database/sql driver registered by its
+// build-tagged file
+var historyDrivers = map[string]string{
+	HistoryStoreSQLite:   "sqlite",
+	HistoryStorePostgres: "pgx",
+}
+
+// historySchema creates the tables of each dialect. Fingerprints get their
+// own table so that history searches are index lookups.
+var historySchema = map[string][]string{
+	HistoryStoreSQLite: {
+		`CREATE TABLE IF NOT EXISTS search_history (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent TEXT,
+			search_url TEXT NOT NULL DEFAULT '',
+			engine TEXT NOT NULL DEFAULT '',
+			analyzer TEXT NOT NULL DEFAULT '',
+			encrypted TEXT,
+			trace_id TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS search_history_owner ON search_history (tenant_id, user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS search_history_created ON search_history (created_at)`,
+		`CREATE TABLE IF NOT EXISTS search_history_fingerprints (
+			history_id TEXT NOT NULL REFERENCES search_history (id) ON DELETE CASCADE,
+			fingerprint TEXT NOT NULL,
+			PRIMARY KEY (fingerprint, history_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS history_settings (
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (tenant_id, user_id)
+		)`,
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA foreign_keys = ON`,
+	},
+	HistoryStorePostgres: {
+		`CREATE TABLE IF NOT EXISTS search_history (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			prompt TEXT NOT NULL DEFAULT '',
+			intent JSONB,
+			search_url TEXT NOT NULL DEFAULT '',
+			engine TEXT NOT NULL DEFAULT '',
+			analyzer TEXT NOT NULL DEFAULT '',
+			encrypted JSONB,
+			trace_id TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS search_history_owner ON search_history (tenant_id, user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS search_history_created ON search_history (created_at)`,
+		`CREATE TABLE IF NOT EXISTS search_history_fingerprints (
+			history_id TEXT NOT NULL REFERENCES search_history (id) ON DELETE CASCADE,
+			fingerprint TEXT NOT NULL,
+			PRIMARY KEY (fingerprint, history_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS history_settings (
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (tenant_id, user_id)
+		)`,
+	},
+}
+
+const historyColumns = `id, tenant_id, user_id, created_at, prompt, intent, search_url, engine, analyzer, encrypted, trace_id`
+
+// sqlHistoryStore keeps history in SQLite (single node) or Postgres
+type sqlHistoryStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewSQLHistoryStore connects to the database and creates the tables. For
+// SQLite dsn is a file path, for Postgres a connection URL.
+func NewSQLHistoryStore(ctx context.Context, dialect, dsn string) (*sqlHistoryStore, error) {
+	driver, ok := historyDrivers[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown history store %q", dialect)
+	}
+	if !slices.Contains(sql.Drivers(), driver) {
+		return nil, fmt.Errorf("built without %s support, rebuild with -tags %s", dialect, dialect)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history database: %v", err)
+	}
+	if dialect == HistoryStoreSQLite {
+		// SQLite allows one writer; queueing in the pool beats SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range historySchema[dialect] {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating history tables: %v", err)
+		}
+	}
+	return &sqlHistoryStore{db: db, dialect: dialect}, nil
+}
+
+// Ping checks the database for the readiness probe
+func (s *sqlHistoryStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind turns ? placeholders into $n for Postgres
+func (s *sqlHistoryStore) rebind(query string) string {
+	if s.dialect != HistoryStorePostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// placeholders returns n comma-separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// nullJSON encodes v for a nullable JSON column
+func nullJSON(v interface{}, isNil bool) (sql.NullString, error) {
+	if isNil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func (s *sqlHistoryStore) Add(ctx context.Context, rec *HistoryRecord) error {
+	intent, err := nullJSON(rec.Intent, rec.Intent == nil)
+	if err != nil {
+		return fmt.Errorf("error encoding intent: %v", err)
+	}
+	encrypted, err := nullJSON(rec.Encrypted, rec.Encrypted == nil)
+	if err != nil {
+		return fmt.Errorf("error encoding encrypted payload: %v", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO search_history (`+historyColumns+`) VALUES (`+placeholders(11)+`)`),
+		rec.ID, rec.TenantID, rec.UserID, rec.CreatedAt.UTC(), rec.Prompt, intent, rec.SearchURL,
+		rec.Engine, rec.Analyzer, encrypted, rec.TraceID)
+	if err != nil {
+		return fmt.Errorf("error inserting history record: %v", err)
+	}
+	for _, fp := range rec.Fingerprints {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO search_history_fingerprints (history_id, fingerprint) VALUES (?, ?) ON CONFLICT DO NOTHING`),
+			rec.ID, fp)
+		if err != nil {
+			return fmt.Errorf("error inserting fingerprint: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing history record: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlHistoryStore) FindByFingerprints(ctx context.Context, tenantID, userID string, fingerprints []string) ([]*HistoryRecord, error) {
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{tenantID, userID}
+	for _, fp := range fingerprints {
+		args = append(args, fp)
+	}
+	args = append(args, len(fingerprints))
+	return s.query(ctx, `SELECT `+historyColumns+` FROM search_history
+		WHERE tenant_id = ? AND user_id = ? AND id IN (
+			SELECT history_id FROM search_history_fingerprints
+			WHERE fingerprint IN (`+placeholders(len(fingerprints))+`)
+			GROUP BY history_id HAVING COUNT(DISTINCT fingerprint) = ?
+		)
+		ORDER BY created_at DESC`, args...)
+}
+
+func (s *sqlHistoryStore) ListOlderThan(ctx context.Context, cutoff time.Time, limit int) ([]*HistoryRecord, error) {
+	return s.query(ctx, `SELECT `+historyColumns+` FROM search_history
+		WHERE created_at < ? ORDER BY created_at LIMIT ?`, cutoff.UTC(), limit)
+}
+
+func (s *sqlHistoryStore) Delete(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	in := placeholders(len(ids))
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM search_history_fingerprints WHERE history_id IN (`+in+`)`), args...); err != nil {
+		return fmt.Errorf("error deleting fingerprints: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM search_history WHERE id IN (`+in+`)`), args...); err != nil {
+		return fmt.Errorf("error deleting history records: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing delete: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlHistoryStore) List(ctx context.Context, f HistoryFilter) ([]*HistoryRecord, error) {
+	where := []string{"tenant_id = ?", "user_id = ?"}
+	args := []interface{}{f.TenantID, f.UserID}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	if f.Engine != "" {
+		where = append(where, "engine = ?")
+		args = append(args, f.Engine)
+	}
+	if f.Query != "" {
+		where = append(where, `LOWER(prompt) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(f.Query))+"%")
+	}
+	if f.AfterID != "" {
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, f.AfterTime.UTC(), f.AfterTime.UTC(), f.AfterID)
+	}
+	args = append(args, f.Limit)
+	return s.query(ctx, `SELECT `+historyColumns+` FROM search_history
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY created_at DESC, id DESC LIMIT ?`, args...)
+}
+
+// likeEscaper makes user input match literally in a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *sqlHistoryStore) Get(ctx context.Context, tenantID, userID, id string) (*HistoryRecord, error) {
+	records, err := s.query(ctx, `SELECT `+historyColumns+` FROM search_history
+		WHERE id = ? AND tenant_id = ? AND user_id = ?`, id, tenantID, userID)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+func (s *sqlHistoryStore) DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	n, err := s.deleteWhere(ctx, "id = ? AND tenant_id = ? AND user_id = ?", id, tenantID, userID)
+	return n > 0, err
+}
+
+func (s *sqlHistoryStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return s.deleteWhere(ctx, "tenant_id = ? AND user_id = ?", tenantID, userID)
+}
+
+// Recording reads the opt-in of a user, who has a row while recording is on
+func (s *sqlHistoryStore) Recording(ctx context.Context, tenantID, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM history_settings WHERE tenant_id = ? AND user_id = ?`), tenantID, userID).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("error reading history setting: %v", err)
+	}
+	return n > 0, nil
+}
+
+func (s *sqlHistoryStore) SetRecording(ctx context.Context, tenantID, userID string, on bool) error {
+	query := `DELETE FROM history_settings WHERE tenant_id = ? AND user_id = ?`
+	if on {
+		query = `INSERT INTO history_settings (tenant_id, user_id) VALUES (?, ?) ON CONFLICT (tenant_id, user_id) DO NOTHING`
+	}
+	if _, err := s.db.ExecContext(ctx, s.rebind(query), tenantID, userID); err != nil {
+		return fmt.Errorf("error saving history setting: %v", err)
+	}
+	return nil
+}
+
+// deleteWhere deletes the records matching a condition on search_history,
+// with their fingerprints, and returns how many there were
+func (s *sqlHistoryStore) deleteWhere(ctx context.Context, cond string, args ...interface{}) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM search_history_fingerprints
+		WHERE history_id IN (SELECT id FROM search_history WHERE `+cond+`)`), args...); err != nil {
+		return 0, fmt.Errorf("error deleting fingerprints: %v", err)
+	}
+	res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM search_history WHERE `+cond), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting history records: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting history records: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing delete: %v", err)
+	}
+	return int(n), nil
+}
+
+// query runs a SELECT of historyColumns and loads the fingerprints of the rows
+func (s *sqlHistoryStore) query(ctx context.Context, query string, args ...interface{}) ([]*HistoryRecord, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %v", err)
+	}
+	defer rows.Close()
+
+	var records []*HistoryRecord
+	byID := make(map[string]*HistoryRecord)
+	for rows.Next() {
+		rec := &HistoryRecord{}
+		var intent, encrypted sql.NullString
+		if err := rows.Scan(&rec.ID, &rec.TenantID, &rec.UserID, &rec.CreatedAt, &rec.Prompt, &intent,
+			&rec.SearchURL, &rec.Engine, &rec.Analyzer, &encrypted, &rec.TraceID); err != nil {
+			return nil, fmt.Errorf("error reading history record: %v", err)
+		}
+		rec.CreatedAt = rec.CreatedAt.UTC()
+		if intent.Valid {
+			if err := json.Unmarshal([]byte(intent.String), &rec.Intent); err != nil {
+				return nil, fmt.Errorf("error decoding intent of %s: %v", rec.ID, err)
+			}
+		}
+		if encrypted.Valid {
+			if err := json.Unmarshal([]byte(encrypted.String), &rec.Encrypted); err != nil {
+				return nil, fmt.Errorf("error decoding encrypted payload of %s: %v", rec.ID, err)
+			}
+		}
+		records = append(records, rec)
+		byID[rec.ID] = rec
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying history: %v", err)
+	}
+	if len(records) == 0 {
+		return records, nil
+	}
+
+	// Archiving needs the fingerprints to rehydrate records later
+	ids := make([]interface{}, 0, len(records))
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	fpRows, err := s.db.QueryContext(ctx, s.rebind(`SELECT history_id, fingerprint FROM search_history_fingerprints
+		WHERE history_id IN (`+placeholders(len(ids))+`)`), ids...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	defer fpRows.Close()
+	for fpRows.Next() {
+		var id, fp string
+		if err := fpRows.Scan(&id, &fp); err != nil {
+			return nil, fmt.Errorf("error reading fingerprint: %v", err)
+		}
+		byID[id].Fingerprints = append(byID[id].Fingerprints, fp)
+	}
+	return records, fpRows.Err()
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// modernc.org/sqlite is pure Go, so the sqlite build still cross-compiles
+// without cgo
+import _ "modernc.org/sqlite"
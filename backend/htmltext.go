@@ -0,0 +1,140 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlAttrRe = regexp.MustCompile(`(?is)([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	htmlTagRe  = regexp.MustCompile(`(?s)^</?([a-zA-Z][a-zA-Z0-9-]*)`)
+)
+
+// htmlBlockTags end a line of text
+var htmlBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figcaption": true, "footer": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// htmlSkipTags hold no readable text
+var htmlSkipTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+}
+
+// htmlPage is what the crawler reads from a page
+type htmlPage struct {
+	Title string
+	Text  string
+	// Links are the href of the page's anchors, unresolved
+	Links []string
+	// Base is the href of the page's <base>, if any
+	Base string
+	// NoIndex and NoFollow come from the page's robots meta tag
+	NoIndex, NoFollow bool
+}
+
+// parseHTML extracts the text and links of a page. It is a tolerant scan of
+// the tags rather than a full parser, which is enough for reading text.
+func parseHTML(page string) *htmlPage {
+	out := &htmlPage{}
+	var text, title strings.Builder
+	skip := ""
+	inTitle := false
+	for len(page) > 0 {
+		lt := strings.IndexByte(page, '<')
+		if lt < 0 {
+			lt = len(page)
+		}
+		if skip == "" {
+			chunk := html.UnescapeString(page[:lt])
+			if inTitle {
+				title.WriteString(chunk)
+			} else {
+				text.WriteString(chunk)
+			}
+		}
+		page = page[lt:]
+		if page == "" {
+			break
+		}
+		if strings.HasPrefix(page, "<!--") {
+			end := strings.Index(page, "-->")
+			if end < 0 {
+				break
+			}
+			page = page[end+3:]
+			continue
+		}
+		gt := strings.IndexByte(page, '>')
+		if gt < 0 {
+			break
+		}
+		tag := page[:gt+1]
+		m := htmlTagRe.FindStringSubmatch(tag)
+		if m == nil && skip == "" && !strings.HasPrefix(tag, "<!") && !strings.HasPrefix(tag, "<?") {
+			// A bare < in the text, like "a < b"
+			text.WriteString("<")
+			page = page[1:]
+			continue
+		}
+		page = page[gt+1:]
+		if m == nil {
+			continue
+		}
+		name := strings.ToLower(m[1])
+		closing := strings.HasPrefix(tag, "</")
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+		if htmlSkipTags[name] && !closing && !strings.HasSuffix(tag, "/>") {
+			skip = name
+			continue
+		}
+		switch name {
+		case "title":
+			inTitle = !closing
+		case "a":
+			if href := htmlAttr(tag, "href"); href != "" && !closing {
+				out.Links = append(out.Links, href)
+			}
+		case "base":
+			out.Base = htmlAttr(tag, "href")
+		case "meta":
+			if strings.EqualFold(htmlAttr(tag, "name"), "robots") {
+				content := strings.ToLower(htmlAttr(tag, "content"))
+				out.NoIndex = strings.Contains(content, "noindex") || strings.Contains(content, "none")
+				out.NoFollow = strings.Contains(content, "nofollow") || strings.Contains(content, "none")
+			}
+		}
+		if htmlBlockTags[name] {
+			text.WriteString("\n")
+		} else {
+			text.WriteString(" ")
+		}
+	}
+	out.Title = strings.Join(strings.Fields(title.String()), " ")
+	var lines []string
+	for _, line := range strings.Split(text.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	out.Text = strings.Join(lines, "\n")
+	return out
+}
+
+// htmlAttr returns the unescaped value of an attribute of a tag
+func htmlAttr(tag, name string) string {
+	for _, m := range htmlAttrRe.FindAllStringSubmatch(tag, -1) {
+		if strings.EqualFold(m[1], name) {
+			return html.UnescapeString(m[2] + m[3] + m[4])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Cache-Control values of the cacheable endpoints
+const (
+	// Changes with deploys only; shared caches may keep it a few minutes
+	cachePublicShort = "public, max-age=300"
+	// Must be revalidated every time, which the ETag makes cheap
+	cacheRevalidate = "no-cache"
+	// Per tenant, so only the caller's own cache may keep it
+	cachePrivateRevalidate = "private, no-cache"
+)
+
+var notModifiedResponses = metricsRegistry.Counter("http_not_modified_total",
+	"Conditional requests answered with 304 Not Modified, by path.", "path")
+
+// writeCacheableJSON writes v like writeJSON, with an ETag computed from the
+// body and the given Cache-Control, and answers 304 Not Modified when the
+// client already has it. The ETag is weak because compression changes the
+// bytes but not the JSON.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, cacheControl string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding response", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		notModifiedResponses.Inc(r.URL.Path)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// etagMatches applies the weak comparison of If-None-Match: any listed tag
+// with the same opaque value matches, as does "*"
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// errNonPublicAddress refuses URLs users give that point into the network
+var errNonPublicAddress = errors.New("address is not on the public internet")
+
+// nonPublicPrefixes are the ranges publicAddr refuses besides the private,
+// loopback and link-local ones: "this network", carrier-grade NAT, IETF
+// protocol assignments, benchmarking, and NAT64, which can map to any of
+// them
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// publicAddr tells whether an address is on the public internet: not
+// loopback, private, link-local (like cloud metadata services), multicast,
+// unspecified or one of nonPublicPrefixes
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicHost resolves a host and refuses it unless all of its
+// addresses are public
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !publicAddr(addr) {
+			return fmt.Errorf("%s: %w", host, errNonPublicAddress)
+		}
+	}
+	return nil
+}
+
+// newPublicClient builds the HTTP client for URLs users give, like alert
+// webhooks. It only connects to public addresses, checked on the address
+// each connection is made to, so neither DNS that changes its answer nor
+// redirects reach the internal network. It connects directly, without
+// OUTBOUND_PROXY, which would hide the address.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(addr.Addr()) {
+				return fmt.Errorf("%s: %w", address, errNonPublicAddress)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: timeout,
+	}
+}
+
+// proxyFunc returns the proxy selection for outbound clients. An explicit
+// OUTBOUND_PROXY wins; otherwise HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply.
+// http, https, socks5 and socks5h (DNS resolved by the proxy) are supported.
+func proxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", u.Redacted())
+	}
+	return http.ProxyURL(u), nil
+}
+
+// newOutboundClient builds the HTTP client for calls leaving the network
+// (OpenAI, search providers)
+func newOutboundClient(cfg *Config) (*http.Client, error) {
+	proxy, err := proxyFunc(cfg.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   cfg.OutboundConnectTimeout,
+		KeepAlive: cfg.OutboundKeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.OutboundTLSTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.OutboundMaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.OutboundIdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	var rt http.RoundTripper = transport
+	if cfg.LLMVCRMode != "" {
+		rt = NewVCRTransport(cfg.LLMVCRMode, cfg.LLMVCRDir, transport, OPENAI_API_URL, OPENAI_EMBEDDINGS_URL)
+	}
+	return &http.Client{Transport: rt, Timeout: cfg.OutboundTimeout}, nil
+}
+
+// statusClientClosedRequest is the status logged for requests whose client
+// went away before the answer, after nginx
+const statusClientClosedRequest = 499
+
+var abandonedRequests = metricsRegistry.Counter("requests_abandoned_total",
+	"Requests that ended before their answer was ready, by reason (client_disconnected, deadline).", "reason")
+
+// withRequestTimeout gives every request a deadline, which outbound calls made
+// on its behalf inherit through the context. The context is also cancelled
+// when the client disconnects, so the model calls, results fetches and page
+// downloads of an abandoned search stop with it.
+func withRequestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := r.Context(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+		switch {
+		case r.Context().Err() != nil:
+			abandonedRequests.Inc("client_disconnected")
+		case ctx.Err() != nil:
+			abandonedRequests.Inc("deadline")
+		}
+	})
+}
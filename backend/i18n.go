@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var localizedErrors = metricsRegistry.Counter("localized_errors_total",
+	"Error messages sent in another language than English, by language.", "language")
+
+// errorMessages translates the fixed error messages, keyed by language and
+// then by the English message
+var errorMessages = map[string]map[string]string{
+	"de": {
+		"Method not allowed":                             "Methode nicht erlaubt",
+		"Invalid request body":                           "Ungültiger Anfragetext",
+		"Error reading request body":                     "Fehler beim Lesen des Anfragetexts",
+		"Service busy, please retry shortly":             "Dienst ausgelastet, bitte in Kürze erneut versuchen",
+		"Too many requests, please retry later":          "Zu viele Anfragen, bitte später erneut versuchen",
+		"Request timed out":                              "Zeitüberschreitung der Anfrage",
+		"Rate limit exceeded":                            "Anfragelimit überschritten",
+		"Unauthorized":                                   "Nicht autorisiert",
+		"Search not found":                               "Suche nicht gefunden",
+		"Results provider unavailable":                   "Ergebnisanbieter nicht verfügbar",
+		"Unknown tenant":                                 "Unbekannter Mandant",
+		"locale must be a language tag like en-US":       "locale muss ein Sprach-Tag wie en-US sein",
+		"result_language must be a language tag like en": "result_language muss ein Sprach-Tag wie en sein",
+	},
+	"fr": {
+		"Method not allowed":                             "Méthode non autorisée",
+		"Invalid request body":                           "Corps de requête invalide",
+		"Error reading request body":                     "Erreur de lecture du corps de la requête",
+		"Service busy, please retry shortly":             "Service occupé, veuillez réessayer dans un instant",
+		"Too many requests, please retry later":          "Trop de requêtes, veuillez réessayer plus tard",
+		"Request timed out":                              "La requête a expiré",
+		"Rate limit exceeded":                            "Limite de requêtes dépassée",
+		"Unauthorized":                                   "Non autorisé",
+		"Search not found":                               "Recherche introuvable",
+		"Results provider unavailable":                   "Fournisseur de résultats indisponible",
+		"Unknown tenant":                                 "Locataire inconnu",
+		"locale must be a language tag like en-US":       "locale doit être une étiquette de langue comme en-US",
+		"result_language must be a language tag like en": "result_language doit être une étiquette de langue comme en",
+	},
+	"es": {
+		"Method not allowed":                             "Método no permitido",
+		"Invalid request body":                           "Cuerpo de la solicitud no válido",
+		"Error reading request body":                     "Error al leer el cuerpo de la solicitud",
+		"Service busy, please retry shortly":             "Servicio ocupado, vuelva a intentarlo en breve",
+		"Too many requests, please retry later":          "Demasiadas solicitudes, vuelva a intentarlo más tarde",
+		"Request timed out":                              "La solicitud agotó el tiempo de espera",
+		"Rate limit exceeded":                            "Límite de solicitudes superado",
+		"Unauthorized":                                   "No autorizado",
+		"Search not found":                               "Búsqueda no encontrada",
+		"Results provider unavailable":                   "Proveedor de resultados no disponible",
+		"Unknown tenant":                                 "Inquilino desconocido",
+		"locale must be a language tag like en-US":       "locale debe ser una etiqueta de idioma como en-US",
+		"result_language must be a language tag like en": "result_language debe ser una etiqueta de idioma como en",
+	},
+	"it": {
+		"Method not allowed":                             "Metodo non consentito",
+		"Invalid request body":                           "Corpo della richiesta non valido",
+		"Error reading request body":                     "Errore nella lettura del corpo della richiesta",
+		"Service busy, please retry shortly":             "Servizio occupato, riprova tra poco",
+		"Too many requests, please retry later":          "Troppe richieste, riprova più tardi",
+		"Request timed out":                              "Richiesta scaduta",
+		"Rate limit exceeded":                            "Limite di richieste superato",
+		"Unauthorized":                                   "Non autorizzato",
+		"Search not found":                               "Ricerca non trovata",
+		"Results provider unavailable":                   "Fornitore di risultati non disponibile",
+		"Unknown tenant":                                 "Tenant sconosciuto",
+		"locale must be a language tag like en-US":       "locale deve essere un tag di lingua come en-US",
+		"result_language must be a language tag like en": "result_language deve essere un tag di lingua come en",
+	},
+	"pt": {
+		"Method not allowed":                             "Método não permitido",
+		"Invalid request body":                           "Corpo da requisição inválido",
+		"Error reading request body":                     "Erro ao ler o corpo da requisição",
+		"Service busy, please retry shortly":             "Serviço ocupado, tente novamente em instantes",
+		"Too many requests, please retry later":          "Muitas requisições, tente novamente mais tarde",
+		"Request timed out":                              "A requisição expirou",
+		"Rate limit exceeded":                            "Limite de requisições excedido",
+		"Unauthorized":                                   "Não autorizado",
+		"Search not found":                               "Pesquisa não encontrada",
+		"Results provider unavailable":                   "Provedor de resultados indisponível",
+		"Unknown tenant":                                 "Inquilino desconhecido",
+		"locale must be a language tag like en-US":       "locale deve ser uma etiqueta de idioma como en-US",
+		"result_language must be a language tag like en": "result_language deve ser uma etiqueta de idioma como en",
+	},
+	"nl": {
+		"Method not allowed":                             "Methode niet toegestaan",
+		"Invalid request body":                           "Ongeldige request body",
+		"Error reading request body":                     "Fout bij het lezen van de request body",
+		"Service busy, please retry shortly":             "Dienst bezet, probeer het zo opnieuw",
+		"Too many requests, please retry later":          "Te veel verzoeken, probeer het later opnieuw",
+		"Request timed out":                              "Time-out van het verzoek",
+		"Rate limit exceeded":                            "Limiet voor verzoeken overschreden",
+		"Unauthorized":                                   "Niet geautoriseerd",
+		"Search not found":                               "Zoekopdracht niet gevonden",
+		"Results provider unavailable":                   "Resultatenprovider niet beschikbaar",
+		"Unknown tenant":                                 "Onbekende tenant",
+		"locale must be a language tag like en-US":       "locale moet een taaltag zijn zoals en-US",
+		"result_language must be a language tag like en": "result_language moet een taaltag zijn zoals en",
+	},
+}
+
+// errorPattern translates a message with variable parts, which the
+// translations take from the pattern's groups as $1, $2...
+type errorPattern struct {
+	re   *regexp.Regexp
+	text map[string]string
+}
+
+var errorPatterns = []errorPattern{
+	{
+		re: regexp.MustCompile(`^(\w+) (\w+) budget of \$([\d.]+) exceeded$`),
+		text: map[string]string{
+			"de": "Budget ($1, $2) von $$$3 überschritten",
+			"fr": "Budget ($1, $2) de $$$3 dépassé",
+			"es": "Presupuesto ($1, $2) de $$$3 superado",
+			"it": "Budget ($1, $2) di $$$3 superato",
+			"pt": "Orçamento ($1, $2) de $$$3 excedido",
+			"nl": "Budget ($1, $2) van $$$3 overschreden",
+		},
+	},
+	{
+		re: regexp.MustCompile(`^the prompt contains personal data \((.*)\), resend it with confirm_pii to send it to the analyzer$`),
+		text: map[string]string{
+			"de": "Der Prompt enthält personenbezogene Daten ($1), senden Sie ihn mit confirm_pii erneut, um ihn an die Analyse zu senden",
+			"fr": "Le prompt contient des données personnelles ($1), renvoyez-le avec confirm_pii pour l'envoyer à l'analyse",
+			"es": "El prompt contiene datos personales ($1), reenvíelo con confirm_pii para enviarlo al análisis",
+			"it": "Il prompt contiene dati personali ($1), invialo di nuovo con confirm_pii per mandarlo all'analisi",
+			"pt": "O prompt contém dados pessoais ($1), reenvie-o com confirm_pii para enviá-lo à análise",
+			"nl": "De prompt bevat persoonsgegevens ($1), stuur hem opnieuw met confirm_pii om hem naar de analyse te sturen",
+		},
+	},
+	{
+		re: regexp.MustCompile(`^prompt rejected: it tries to change the analyzer's instructions \((.*)\)$`),
+		text: map[string]string{
+			"de": "Prompt abgelehnt: er versucht, die Anweisungen der Analyse zu ändern ($1)",
+			"fr": "Prompt refusé : il tente de modifier les instructions de l'analyse ($1)",
+			"es": "Prompt rechazado: intenta cambiar las instrucciones del análisis ($1)",
+			"it": "Prompt rifiutato: tenta di cambiare le istruzioni dell'analisi ($1)",
+			"pt": "Prompt rejeitado: tenta alterar as instruções da análise ($1)",
+			"nl": "Prompt geweigerd: hij probeert de instructies van de analyse te wijzigen ($1)",
+		},
+	},
+	{
+		// The cause comes from OpenAI or the network and stays in English
+		re: regexp.MustCompile(`^Error analyzing prompt: (.*)$`),
+		text: map[string]string{
+			"de": "Fehler bei der Analyse des Prompts: $1",
+			"fr": "Erreur lors de l'analyse du prompt : $1",
+			"es": "Error al analizar el prompt: $1",
+			"it": "Errore nell'analisi del prompt: $1",
+			"pt": "Erro ao analisar o prompt: $1",
+			"nl": "Fout bij het analyseren van de prompt: $1",
+		},
+	},
+}
+
+// localizeMessage translates an error message into language, or returns it
+// as it is when the catalog has no translation
+func localizeMessage(message, language string) string {
+	if translated, ok := errorMessages[language][message]; ok {
+		return translated
+	}
+	for _, p := range errorPatterns {
+		if tmpl, ok := p.text[language]; ok && p.re.MatchString(message) {
+			return p.re.ReplaceAllString(message, tmpl)
+		}
+	}
+	return message
+}
+
+// acceptedLanguage picks the language of the catalog the Accept-Language
+// header weighs most, or "en" when it prefers English or none of them
+func acceptedLanguage(header string) string {
+	best, bestQ := "en", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if _, ok := errorMessages[tag]; (ok || tag == "en") && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// promptStopWords are frequent words that tell the language of a prompt
+var promptStopWords = map[string][]string{
+	"en": {"the", "and", "is", "for", "with", "how", "what", "of", "to", "in", "from"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "mit", "für", "wie", "was", "von", "ein", "eine"},
+	"fr": {"le", "la", "les", "et", "est", "pour", "avec", "des", "une", "comment", "quel", "quelle", "du"},
+	"es": {"el", "los", "las", "y", "es", "para", "con", "una", "cómo", "qué", "por", "del"},
+	"it": {"il", "gli", "e", "è", "per", "con", "una", "come", "che", "di", "della", "dei"},
+	"pt": {"o", "os", "as", "e", "é", "para", "com", "uma", "como", "que", "não", "do", "da"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "met", "voor", "hoe", "wat", "van"},
+}
+
+// promptLanguage guesses the language of a prompt from its stop words, or
+// returns "" when none wins clearly
+func promptLanguage(prompt string) string {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !(r == '\'' || r >= 'a' && r <= 'z' || r > 127)
+	}) {
+		for lang, words := range promptStopWords {
+			for _, w := range words {
+				if w == word {
+					counts[lang]++
+				}
+			}
+		}
+	}
+	best, bestCount, tie := "", 0, false
+	for lang, n := range counts {
+		switch {
+		case n > bestCount:
+			best, bestCount, tie = lang, n, false
+		case n == bestCount:
+			tie = true
+		}
+	}
+	if tie || bestCount < 2 {
+		return ""
+	}
+	return best
+}
+
+// errorLanguage is the language the errors of a request are sent in. It
+// starts as the Accept-Language's, and a handler that reads a prompt
+// switches it to the prompt's.
+type errorLanguage struct {
+	mu       sync.Mutex
+	language string
+}
+
+type errorLanguageKey struct{}
+
+// setPromptLanguage sends the errors of the request in the language of its
+// prompt: the locale's when the catalog has it, otherwise the one its words
+// tell, if any
+func setPromptLanguage(ctx context.Context, prompt, locale string) {
+	l, _ := ctx.Value(errorLanguageKey{}).(*errorLanguage)
+	if l == nil {
+		return
+	}
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if _, ok := errorMessages[language]; !ok && language != "en" {
+		language = promptLanguage(prompt)
+	}
+	if language == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.language = language
+}
+
+// errorLanguageFromContext returns the language of the request's errors, or
+// "en" outside a request
+func errorLanguageFromContext(ctx context.Context) string {
+	l, _ := ctx.Value(errorLanguageKey{}).(*errorLanguage)
+	if l == nil {
+		return "en"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.language
+}
+
+// localizedError translates the message of a JSON error into the request's
+// language
+func localizedError(ctx context.Context, message string) string {
+	language := errorLanguageFromContext(ctx)
+	translated := localizeMessage(message, language)
+	if translated != message {
+		localizedErrors.Inc(language)
+	}
+	return translated
+}
+
+// withErrorLanguage translates the plain text error responses, the ones of
+// http.Error, into the language of the prompt or of Accept-Language. JSON
+// errors translate their message with localizedError.
+func withErrorLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		l := &errorLanguage{language: acceptedLanguage(r.Header.Get("Accept-Language"))}
+		ctx := context.WithValue(r.Context(), errorLanguageKey{}, l)
+		lw := &localizeWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(lw, r.WithContext(ctx))
+		lw.flushStatus()
+	})
+}
+
+// localizeWriter holds the status of a plain text error back until its
+// body, which http.Error writes in one call, is translated, so
+// Content-Language is only set on translated messages
+type localizeWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	language string
+	status   int
+	wrote    bool
+}
+
+func (w *localizeWriter) WriteHeader(status int) {
+	if w.wrote || w.status != 0 {
+		return
+	}
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		if language := errorLanguageFromContext(w.ctx); language != "en" {
+			w.language, w.status = language, status
+			return
+		}
+	}
+	if status >= 200 {
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// flushStatus sends the status held back for a body that never came
+func (w *localizeWriter) flushStatus() {
+	if w.status != 0 {
+		status := w.status
+		w.status = 0
+		w.wrote = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *localizeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.wrote = true
+		return w.ResponseWriter.Write(b)
+	}
+	message := strings.TrimSuffix(string(b), "\n")
+	translated := localizeMessage(message, w.language)
+	if translated == message {
+		w.flushStatus()
+		return w.ResponseWriter.Write(b)
+	}
+	localizedErrors.Inc(w.language)
+	w.Header().Set("Content-Language", w.language)
+	w.flushStatus()
+	if _, err := w.ResponseWriter.Write([]byte(translated + "\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Unwrap lets http.ResponseController reach the writer below, e.g. to flush
+func (w *localizeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
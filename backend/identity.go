@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Ways a request's tenant is authenticated
+const (
+	AuthAPIKey      = "api_key"
+	AuthSignature   = "signature"
+	AuthCertificate = "certificate"
+)
+
+// Identity is who a request authenticated as. Requests of the default tenant
+// without a credential have an empty Method and never a user.
+type Identity struct {
+	// Method is how the tenant was authenticated: api_key, signature or
+	// certificate
+	Method string
+	// UserID is the end user: the one a per-user API key was issued to, or
+	// the X-User-ID the tenant's credential vouches for
+	UserID string
+}
+
+type identityContextKey struct{}
+
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+// identityFromContext returns the request's identity, empty outside a request
+func identityFromContext(ctx context.Context) Identity {
+	id, _ := ctx.Value(identityContextKey{}).(Identity)
+	return id
+}
+
+// requestIdentity tells who a request authenticated as. A per-user key
+// decides the user whatever the X-User-ID header says; the header is only
+// believed when a tenant credential came with it, as anyone can send it.
+func requestIdentity(r *http.Request, method, keyUser string) Identity {
+	id := Identity{Method: method}
+	switch {
+	case method == "":
+	case keyUser != "":
+		id.UserID = keyUser
+	default:
+		id.UserID = userIDFromRequest(r)
+	}
+	return id
+}
+
+// authenticatedOwner returns the tenant and the authenticated end user of a
+// request, with ok false when there is no such user
+func authenticatedOwner(r *http.Request) (tenantID, userID string, ok bool) {
+	tenantID = DefaultTenantID
+	if t := tenantFromContext(r.Context()); t != nil {
+		tenantID = t.ID
+	}
+	userID = identityFromContext(r.Context()).UserID
+	return tenantID, userID, userID != ""
+}
+
+// requireUser is authenticatedOwner for the endpoints of a user's own data,
+// answering 401 when the request has no authenticated user
+func requireUser(w http.ResponseWriter, r *http.Request) (tenantID, userID string, ok bool) {
+	tenantID, userID, ok = authenticatedOwner(r)
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "user_required"})
+	}
+	return tenantID, userID, ok
+}
+
+// requireTenant returns the tenant of a request that authenticated with a
+// tenant credential, answering 401 for the anonymous requests of the
+// default tenant
+func requireTenant(w http.ResponseWriter, r *http.Request) (tenantID string, ok bool) {
+	t := tenantFromContext(r.Context())
+	if t == nil || identityFromContext(r.Context()).Method == "" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "tenant_key_required"})
+		return "", false
+	}
+	return t.ID, true
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instant answer types
+const (
+	InstantWeather = "weather"
+	InstantQuote   = "quote"
+)
+
+// maxInstantEntries bounds the instant answer cache; it is emptied when full
+const maxInstantEntries = 1000
+
+var instantAnswers = metricsRegistry.Counter("instant_answers_total",
+	"Prompts answered without an analysis, by type and result (answered, miss, error).", "type", "result")
+
+var (
+	// weatherPromptRes ask for the weather of a place, the place being the
+	// first group
+	weatherPromptRes = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)^\s*(?:what(?:'s| is) the |how(?:'s| is) the )?(?:weather|forecast|temperature)(?: forecast| like| today| now)? (?:in|for|at) ([^?!.]{2,60}?)(?: today| now| this week)?\s*[?!.]?\s*$`),
+		regexp.MustCompile(`(?i)^\s*([^?!.]{2,60}?) (?:weather|forecast)(?: forecast| today| now| this week)?\s*[?!.]?\s*$`),
+	}
+	// quotePromptRes ask for the stock price of a ticker, the ticker being the
+	// first group; tickers are upper case unless written with a $ sign, so
+	// words aren't taken for them
+	quotePromptRes = []*regexp.Regexp{
+		regexp.MustCompile(`^\s*\$([A-Za-z]{1,5}(?:\.[A-Za-z]{1,2})?)\s*\??\s*$`),
+		regexp.MustCompile(`^\s*(?i:(?:what(?:'s| is) the )?(?:stock|share) price (?:of|for)) \$?([A-Z]{1,5}(?:\.[A-Z]{1,2})?)\s*\??\s*$`),
+		regexp.MustCompile(`^\s*\$?([A-Z]{1,5}(?:\.[A-Z]{1,2})?) (?i:stock(?: price| quote)?|shares?(?: price)?|share price|quote)\s*\??\s*$`),
+	}
+)
+
+// notPlaces start the phrases before "weather" that aren't a place, e.g.
+// "how to check the weather"
+var notPlaces = map[string]bool{
+	"how": true, "what": true, "why": true, "when": true, "where": true, "is": true, "does": true, "do": true,
+	"will": true, "check": true, "best": true, "today": true, "tomorrow": true, "local": true, "my": true,
+}
+
+// weatherConditions describes the WMO weather codes of Open-Meteo
+var weatherConditions = map[int]string{
+	0: "Clear sky", 1: "Mainly clear", 2: "Partly cloudy", 3: "Overcast",
+	45: "Fog", 48: "Freezing fog",
+	51: "Light drizzle", 53: "Drizzle", 55: "Dense drizzle", 56: "Freezing drizzle", 57: "Freezing drizzle",
+	61: "Light rain", 63: "Rain", 65: "Heavy rain", 66: "Freezing rain", 67: "Freezing rain",
+	71: "Light snow", 73: "Snow", 75: "Heavy snow", 77: "Snow grains",
+	80: "Light showers", 81: "Showers", 82: "Violent showers", 85: "Snow showers", 86: "Heavy snow showers",
+	95: "Thunderstorm", 96: "Thunderstorm with hail", 99: "Thunderstorm with hail",
+}
+
+// WeatherAnswer is the current weather of a place and its next days
+type WeatherAnswer struct {
+	Location WeatherLocation `json:"location"`
+	Current  CurrentWeather  `json:"current"`
+	Daily    []DailyWeather  `json:"daily"`
+	// Units of the temperatures and wind speeds, e.g. °C and km/h
+	Units       map[string]string `json:"units"`
+	Attribution string            `json:"attribution"`
+}
+
+// WeatherLocation is the place a weather prompt was resolved to
+type WeatherLocation struct {
+	Name      string  `json:"name"`
+	Region    string  `json:"region,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// CurrentWeather is the weather at a place now, in its local time
+type CurrentWeather struct {
+	Time        string  `json:"time"`
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+	WindSpeed   float64 `json:"wind_speed"`
+	Conditions  string  `json:"conditions"`
+}
+
+// DailyWeather is the forecast of one day
+type DailyWeather struct {
+	Date       string  `json:"date"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	Conditions string  `json:"conditions"`
+}
+
+// QuoteAnswer is the last price of a stock
+type QuoteAnswer struct {
+	Symbol string  `json:"symbol"`
+	Date   string  `json:"date"`
+	Time   string  `json:"time,omitempty"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume int64   `json:"volume,omitempty"`
+	Source string  `json:"source"`
+}
+
+type instantEntry struct {
+	answer  interface{}
+	expires time.Time
+}
+
+// InstantAnswers answers weather and stock prompts from free APIs, Open-Meteo
+// and Stooq, skipping the analysis; answers are cached for ttl
+type InstantAnswers struct {
+	client      *http.Client
+	geocodeURL  string
+	forecastURL string
+	quoteURL    string
+	ttl         time.Duration
+
+	mu    sync.Mutex
+	cache map[string]instantEntry
+}
+
+func NewInstantAnswers(client *http.Client, ttl time.Duration) *InstantAnswers {
+	return &InstantAnswers{
+		client:      client,
+		geocodeURL:  "https://geocoding-api.open-meteo.com/v1/search",
+		forecastURL: "https://api.open-meteo.com/v1/forecast",
+		quoteURL:    "https://stooq.com/q/l/",
+		ttl:         ttl,
+		cache:       make(map[string]instantEntry),
+	}
+}
+
+// UseInstantAnswers turns on answering weather and stock prompts directly
+func (h *SearchHandler) UseInstantAnswers(instant *InstantAnswers) {
+	h.instant = instant
+}
+
+// weatherPlace returns the place a weather prompt asks about
+func weatherPlace(prompt string) (string, bool) {
+	for _, re := range weatherPromptRes {
+		if m := re.FindStringSubmatch(prompt); m != nil {
+			place := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(m[1]), "the "))
+			words := strings.Fields(strings.ToLower(place))
+			if len(words) > 0 && len(words) <= 4 && !notPlaces[words[0]] && place != "the" {
+				return place, true
+			}
+		}
+	}
+	return "", false
+}
+
+// quoteSymbol returns the ticker a stock prompt asks about, upper-cased
+func quoteSymbol(prompt string) (string, bool) {
+	for _, re := range quotePromptRes {
+		if m := re.FindStringSubmatch(prompt); m != nil {
+			return strings.ToUpper(m[1]), true
+		}
+	}
+	return "", false
+}
+
+// routeToInstantAnswer answers a weather or stock prompt from the APIs,
+// telling whether it did. No intent is analyzed and nothing is searched;
+// when the APIs can't answer, the prompt is analyzed as usual.
+func (h *SearchHandler) routeToInstantAnswer(w http.ResponseWriter, r *http.Request, prompt, locale string) bool {
+	if h.instant == nil {
+		return false
+	}
+	kind, answer, ok := "", interface{}(nil), false
+	if symbol, isQuote := quoteSymbol(prompt); isQuote {
+		kind = InstantQuote
+		answer, ok = h.instantAnswer(r.Context(), kind, func(ctx context.Context) (interface{}, error) {
+			return h.instant.Quote(ctx, symbol)
+		})
+	} else if place, isWeather := weatherPlace(prompt); isWeather {
+		kind = InstantWeather
+		answer, ok = h.instantAnswer(r.Context(), kind, func(ctx context.Context) (interface{}, error) {
+			return h.instant.Weather(ctx, place, locale)
+		})
+	}
+	if !ok {
+		return false
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source": "instant",
+		"type":   kind,
+		kind:     answer,
+		// The web search is still one click away
+		"search_url": constructSearchQuery(&SearchIntent{MainQuery: strings.TrimSpace(prompt)}),
+		"trace_id":   spanFromContext(r.Context()).TraceID(),
+	})
+	return true
+}
+
+// instantAnswer fetches an instant answer if the flag allows it, counting
+// the result; answers that are nil are misses
+func (h *SearchHandler) instantAnswer(ctx context.Context, kind string, fetch func(context.Context) (interface{}, error)) (interface{}, bool) {
+	if !h.flags.Enabled(ctx, FlagInstant, true) {
+		return nil, false
+	}
+	ctx, span := tracer.Start(ctx, "search.instant", SpanKindInternal)
+	defer span.End()
+	span.SetAttr("search.instant_type", kind)
+	answer, err := fetch(ctx)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Error fetching instant answer, analyzing the prompt", "type", kind, "error", err)
+		instantAnswers.Inc(kind, "error")
+		return nil, false
+	case answer == nil:
+		instantAnswers.Inc(kind, "miss")
+		return nil, false
+	}
+	instantAnswers.Inc(kind, "answered")
+	return answer, true
+}
+
+// cached returns the answer cached under key, or fetches and caches it
+func (a *InstantAnswers) cached(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	a.mu.Lock()
+	entry, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.answer, nil
+	}
+	answer, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= maxInstantEntries {
+		clear(a.cache)
+	}
+	a.cache[key] = instantEntry{answer: answer, expires: time.Now().Add(a.ttl)}
+	return answer, nil
+}
+
+// Weather returns the weather of the first place matching name, in
+// Fahrenheit and mph for US locales; nil when no place matches
+func (a *InstantAnswers) Weather(ctx context.Context, name, locale string) (interface{}, error) {
+	imperial := strings.HasSuffix(strings.ToUpper(locale), "-US")
+	language, _, _ := strings.Cut(locale, "-")
+	if language == "" {
+		language = "en"
+	}
+	key := fmt.Sprintf("weather:%s:%s:%t", strings.ToLower(name), strings.ToLower(language), imperial)
+	return a.cached(key, func() (interface{}, error) {
+		var places struct {
+			Results []struct {
+				Name      string  `json:"name"`
+				Admin1    string  `json:"admin1"`
+				Country   string  `json:"country"`
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"results"`
+		}
+		// The geocoder matches names only, without their state or country
+		city, _, _ := strings.Cut(name, ",")
+		q := url.Values{"name": {strings.TrimSpace(city)}, "count": {"1"}, "language": {strings.ToLower(language)}, "format": {"json"}}
+		if err := a.getJSON(ctx, a.geocodeURL+"?"+q.Encode(), &places); err != nil {
+			return nil, fmt.Errorf("error geocoding %q: %v", name, err)
+		}
+		if len(places.Results) == 0 {
+			return nil, nil
+		}
+		place := places.Results[0]
+
+		q = url.Values{
+			"latitude":      {strconv.FormatFloat(place.Latitude, 'f', 4, 64)},
+			"longitude":     {strconv.FormatFloat(place.Longitude, 'f', 4, 64)},
+			"current":       {"temperature_2m,relative_humidity_2m,weather_code,wind_speed_10m"},
+			"daily":         {"weather_code,temperature_2m_max,temperature_2m_min"},
+			"timezone":      {"auto"},
+			"forecast_days": {"3"},
+		}
+		if imperial {
+			q.Set("temperature_unit", "fahrenheit")
+			q.Set("wind_speed_unit", "mph")
+		}
+		var forecast struct {
+			CurrentUnits map[string]string `json:"current_units"`
+			Current      struct {
+				Time        string  `json:"time"`
+				Temperature float64 `json:"temperature_2m"`
+				Humidity    float64 `json:"relative_humidity_2m"`
+				WeatherCode int     `json:"weather_code"`
+				WindSpeed   float64 `json:"wind_speed_10m"`
+			} `json:"current"`
+			Daily struct {
+				Time        []string  `json:"time"`
+				WeatherCode []int     `json:"weather_code"`
+				Max         []float64 `json:"temperature_2m_max"`
+				Min         []float64 `json:"temperature_2m_min"`
+			} `json:"daily"`
+		}
+		if err := a.getJSON(ctx, a.forecastURL+"?"+q.Encode(), &forecast); err != nil {
+			return nil, fmt.Errorf("error fetching forecast: %v", err)
+		}
+		answer := &WeatherAnswer{
+			Location: WeatherLocation{
+				Name:      place.Name,
+				Region:    place.Admin1,
+				Country:   place.Country,
+				Latitude:  place.Latitude,
+				Longitude: place.Longitude,
+			},
+			Current: CurrentWeather{
+				Time:        forecast.Current.Time,
+				Temperature: forecast.Current.Temperature,
+				Humidity:    forecast.Current.Humidity,
+				WindSpeed:   forecast.Current.WindSpeed,
+				Conditions:  weatherConditions[forecast.Current.WeatherCode],
+			},
+			Daily: []DailyWeather{},
+			Units: map[string]string{
+				"temperature": forecast.CurrentUnits["temperature_2m"],
+				"wind_speed":  forecast.CurrentUnits["wind_speed_10m"],
+			},
+			Attribution: "Weather data by Open-Meteo.com",
+		}
+		d := forecast.Daily
+		for i, date := range d.Time {
+			if i >= len(d.WeatherCode) || i >= len(d.Max) || i >= len(d.Min) {
+				break
+			}
+			answer.Daily = append(answer.Daily, DailyWeather{Date: date, Min: d.Min[i], Max: d.Max[i], Conditions: weatherConditions[d.WeatherCode[i]]})
+		}
+		return answer, nil
+	})
+}
+
+// Quote returns the last price of a US-listed ticker, nil when Stooq
+// doesn't know it
+func (a *InstantAnswers) Quote(ctx context.Context, symbol string) (interface{}, error) {
+	return a.cached("quote:"+symbol, func() (interface{}, error) {
+		stooqSymbol := strings.ToLower(strings.ReplaceAll(symbol, ".", "-")) + ".us"
+		q := url.Values{"s": {stooqSymbol}, "f": {"sd2t2ohlcv"}, "h": {""}, "e": {"csv"}}
+		body, err := a.get(ctx, a.quoteURL+"?"+q.Encode())
+		if err != nil {
+			return nil, fmt.Errorf("error fetching quote of %s: %v", symbol, err)
+		}
+		rows, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing quote of %s: %v", symbol, err)
+		}
+		// Symbol,Date,Time,Open,High,Low,Close,Volume; unknown symbols are N/D
+		if len(rows) < 2 || len(rows[1]) < 8 || rows[1][1] == "N/D" {
+			return nil, nil
+		}
+		row := rows[1]
+		answer := &QuoteAnswer{Symbol: symbol, Date: row[1], Time: row[2], Source: "Stooq"}
+		for i, dst := range []*float64{&answer.Open, &answer.High, &answer.Low, &answer.Close} {
+			if *dst, err = strconv.ParseFloat(row[3+i], 64); err != nil {
+				return nil, nil
+			}
+		}
+		answer.Volume, _ = strconv.ParseInt(row[7], 10, 64)
+		return answer, nil
+	})
+}
+
+func (a *InstantAnswers) getJSON(ctx context.Context, u string, v interface{}) error {
+	body, err := a.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (a *InstantAnswers) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return body, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Intent schema versions. v1 is the flat SearchIntent; v2 groups the filters
+// and allows several sites. Both are served side by side so clients can
+// migrate one at a time.
+const (
+	IntentV1 = 1
+	IntentV2 = 2
+
+	intentVersionHeader = "X-Intent-Version"
+)
+
+var intentSchemaNewer = metricsRegistry.Counter("intent_schema_newer_total",
+	"Intents of a schema version newer than the server's, read as the newest one it knows.", "version")
+
+// intentSchema is one version of the intent schema. SearchIntent is the hub
+// every version converts to and from, so any two versions convert through
+// it.
+type intentSchema struct {
+	// schema is the JSON schema of the version, for tool definitions
+	schema map[string]interface{}
+	render func(intent *SearchIntent) interface{}
+	decode func(data []byte) (*SearchIntent, error)
+}
+
+// intentSchemas are the versions served and read. A new version registers
+// its converters here. Fields added to SearchIntent need no new version:
+// they are optional, and intents stored before them read with them empty.
+var intentSchemas = map[int]*intentSchema{
+	IntentV1: {
+		schema: searchIntentSchema,
+		render: func(intent *SearchIntent) interface{} { return intent },
+		decode: func(data []byte) (*SearchIntent, error) {
+			// Without UnmarshalJSON, which would come back here
+			type flatIntent SearchIntent
+			var intent flatIntent
+			if err := json.Unmarshal(data, &intent); err != nil {
+				return nil, err
+			}
+			return (*SearchIntent)(&intent), nil
+		},
+	},
+	IntentV2: {
+		schema: searchIntentV2Schema,
+		render: func(intent *SearchIntent) interface{} { return IntentToV2(intent) },
+		decode: func(data []byte) (*SearchIntent, error) {
+			var v2 SearchIntentV2
+			if err := json.Unmarshal(data, &v2); err != nil {
+				return nil, err
+			}
+			return IntentFromV2(&v2), nil
+		},
+	},
+}
+
+// intentVersions lists the registered versions, oldest first
+func intentVersions() []int {
+	versions := make([]int, 0, len(intentSchemas))
+	for v := range intentSchemas {
+		versions = append(versions, v)
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+// intentVersionList names the registered versions for error messages, like
+// "1 or 2"
+func intentVersionList() string {
+	versions := intentVersions()
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = strconv.Itoa(v)
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// SearchIntentV2 is the second version of the intent schema
+type SearchIntentV2 struct {
+	Version int           `json:"version"`
+	Query   string        `json:"query"`
+	Phrases []string      `json:"phrases"`
+	Exclude []string      `json:"exclude"`
+	Filters IntentFilters `json:"filters"`
+	Scope   string        `json:"scope,omitempty"`
+	// Entities are the named entities of the v1 intent
+	Entities []IntentEntity `json:"entities,omitempty"`
+}
+
+// IntentFilters are the v2 search restrictions
+type IntentFilters struct {
+	Sites     []string `json:"sites"`
+	FileType  string   `json:"file_type,omitempty"`
+	DateRange string   `json:"date_range,omitempty"`
+	// ExcludeSites are the tenant's blocked domains
+	ExcludeSites []string `json:"exclude_sites,omitempty"`
+}
+
+// IntentToV2 maps a v1 intent to v2
+func IntentToV2(intent *SearchIntent) *SearchIntentV2 {
+	v2 := &SearchIntentV2{
+		Version: IntentV2,
+		Query:   intent.MainQuery,
+		Phrases: nonNil(intent.ExactPhrases),
+		Exclude: nonNil(intent.ExcludeWords),
+		Filters: IntentFilters{
+			Sites:        []string{},
+			FileType:     intent.FileType,
+			DateRange:    intent.DateRange,
+			ExcludeSites: intent.ExcludeSites,
+		},
+		Scope:    intent.Scope,
+		Entities: intent.Entities,
+	}
+	if intent.SiteFilter != "" {
+		v2.Filters.Sites = append(v2.Filters.Sites, intent.SiteFilter)
+	}
+	return v2
+}
+
+// IntentFromV2 maps a v2 intent back to v1. v1 has room for one site only, so
+// extra sites are dropped.
+func IntentFromV2(v2 *SearchIntentV2) *SearchIntent {
+	intent := &SearchIntent{
+		MainQuery:    v2.Query,
+		ExactPhrases: nonNil(v2.Phrases),
+		ExcludeWords: nonNil(v2.Exclude),
+		FileType:     v2.Filters.FileType,
+		DateRange:    v2.Filters.DateRange,
+		ExcludeSites: v2.Filters.ExcludeSites,
+		Scope:        v2.Scope,
+		Entities:     v2.Entities,
+	}
+	if len(v2.Filters.Sites) > 0 {
+		intent.SiteFilter = v2.Filters.Sites[0]
+	}
+	return intent
+}
+
+// UnmarshalJSON reads an intent in any registered schema, so the analysis
+// prompt can move to v2 independently of the clients, and the intents stored
+// in history, feedback, saved searches, archives and shared analyses stay
+// readable whichever version wrote them. v1 has no version field; a version
+// newer than the server's, written by a newer replica, is read as the
+// newest version it knows, leaving out the fields it doesn't.
+func (intent *SearchIntent) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Version int              `json:"version"`
+		Query   *json.RawMessage `json:"query"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	version := probe.Version
+	if version == 0 {
+		version = IntentV1
+		if probe.Query != nil {
+			version = IntentV2
+		}
+	}
+	schema, ok := intentSchemas[version]
+	if !ok {
+		versions := intentVersions()
+		if latest := versions[len(versions)-1]; version > latest {
+			intentSchemaNewer.Inc(strconv.Itoa(version))
+			schema = intentSchemas[latest]
+		} else {
+			return fmt.Errorf("unknown intent schema version %d", version)
+		}
+	}
+	decoded, err := schema.decode(data)
+	if err != nil {
+		return err
+	}
+	*intent = *decoded
+	return nil
+}
+
+// decodeIntentJSON parses an intent in any registered schema
+func decodeIntentJSON(data []byte) (*SearchIntent, error) {
+	var intent SearchIntent
+	if err := json.Unmarshal(data, &intent); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+// requestedIntentVersion reads the schema version the client asked for from
+// the X-Intent-Version header or the intent_version query parameter
+func requestedIntentVersion(r *http.Request, defaultVersion int) (int, error) {
+	v := strings.TrimSpace(r.Header.Get(intentVersionHeader))
+	if v == "" {
+		v = r.URL.Query().Get("intent_version")
+	}
+	if v == "" {
+		return defaultVersion, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(v), "v"))
+	if _, ok := intentSchemas[version]; err != nil || !ok {
+		return 0, fmt.Errorf("Unsupported intent version %q, expected %s", v, intentVersionList())
+	}
+	return version, nil
+}
+
+// renderIntent returns the intent in the requested schema version
+func renderIntent(intent *SearchIntent, version int) interface{} {
+	if schema, ok := intentSchemas[version]; ok {
+		return schema.render(intent)
+	}
+	return intent
+}
+
+// intentSchemaFor returns the JSON schema of the given intent version
+func intentSchemaFor(version int) map[string]interface{} {
+	if schema, ok := intentSchemas[version]; ok {
+		return schema.schema
+	}
+	return searchIntentSchema
+}
+
+var searchIntentV2Schema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"version": map[string]interface{}{"type": "integer", "const": IntentV2},
+		"query":   map[string]interface{}{"type": "string"},
+		"phrases": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"exclude": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"filters": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"sites":         map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				"file_type":     map[string]interface{}{"type": "string"},
+				"date_range":    map[string]interface{}{"type": "string"},
+				"exclude_sites": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "The tenant's blocked domains"},
+			},
+		},
+		"scope":    map[string]interface{}{"type": "string", "enum": intentScopes},
+		"entities": intentEntitySchema,
+	},
+	"required": []string{"version", "query"},
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	intentCacheRequests = metricsRegistry.Counter("intent_cache_requests_total",
+		"Intent cache lookups, by result (hit, miss).", "result")
+	intentCacheEntries = metricsRegistry.Gauge("intent_cache_entries",
+		"Analyses currently cached.")
+)
+
+// IntentCache keeps recent OpenAI analyses so repeated prompts skip the LLM.
+// It is a fixed size LRU with a TTL; a nil cache caches nothing.
+type IntentCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type cachedAnalysis struct {
+	key     string
+	result  AnalysisResult
+	expires time.Time
+}
+
+// NewIntentCache returns nil when size is zero, disabling the cache
+func NewIntentCache(size int, ttl time.Duration) *IntentCache {
+	if size <= 0 {
+		return nil
+	}
+	return &IntentCache{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// intentCacheKey identifies an analysis by everything that shapes its answer;
+// system is the rendered system prompt, so prompt changes and template
+// variables like the date start new entries
+func intentCacheKey(prompt, system, model string, temperature float64) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+	sum := sha256.Sum256([]byte(system + "\x00" + model + "\x00" +
+		strconv.FormatFloat(temperature, 'g', -1, 64) + "\x00" + normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns a copy of a cached analysis
+func (c *IntentCache) Get(key string) (*AnalysisResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		intentCacheRequests.Inc("miss")
+		return nil, false
+	}
+	entry := el.Value.(*cachedAnalysis)
+	if c.now().After(entry.expires) {
+		c.remove(el)
+		intentCacheRequests.Inc("miss")
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	intentCacheRequests.Inc("hit")
+
+	result := entry.result
+	intent := *entry.result.Intent
+	result.Intent = &intent
+	result.Cached = true
+	return &result, true
+}
+
+// Put caches an analysis, evicting the least recently used one when full
+func (c *IntentCache) Put(key string, result *AnalysisResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedAnalysis{key: key, result: *result, expires: c.now().Add(c.ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	intentCacheEntries.Set(float64(c.order.Len()))
+}
+
+// Len returns the number of cached analyses
+func (c *IntentCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *IntentCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cachedAnalysis).key)
+	intentCacheEntries.Set(float64(c.order.Len()))
+}
+
+// Flush drops every cached analysis and returns how many there were
+func (c *IntentCache) Flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	intentCacheEntries.Set(0)
+	return n
+}
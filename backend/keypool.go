@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyKeys is returned when every OpenAI key is quarantined
+var ErrNoHealthyKeys = errors.New("all OpenAI API keys are quarantined")
+
+const (
+	// unauthorizedQuarantine is long: a 401 usually means the key was revoked
+	unauthorizedQuarantine = time.Hour
+	minRateLimitQuarantine = 10 * time.Second
+	maxRateLimitQuarantine = 10 * time.Minute
+)
+
+var (
+	keyRequests = metricsRegistry.Counter("openai_key_requests_total",
+		"OpenAI requests per API key and HTTP status.", "key", "status")
+	keyQuarantines = metricsRegistry.Counter("openai_key_quarantines_total",
+		"Times an API key was quarantined, by reason.", "key", "reason")
+	keyHealthy = metricsRegistry.Gauge("openai_key_healthy",
+		"1 if the API key is in rotation, 0 while quarantined.", "key")
+)
+
+// pooledKey is one OpenAI API key and its health
+type pooledKey struct {
+	secret   string
+	label    string // safe to log and export: the key's position, nothing of the key
+	inFlight int
+	strikes  int // consecutive 429s, for exponential quarantine
+	until    time.Time
+	reason   string
+}
+
+// KeyPool load-balances across several OpenAI keys, taking keys that answer
+// 401 or 429 out of rotation for a while
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+	now  Clock
+}
+
+func NewKeyPool(secrets []string) (*KeyPool, error) {
+	p := &KeyPool{now: time.Now}
+	for i, s := range secrets {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		k := &pooledKey{secret: s, label: fmt.Sprintf("key-%d", i+1)}
+		p.keys = append(p.keys, k)
+		keyHealthy.Set(1, k.label)
+	}
+	if len(p.keys) == 0 {
+		return nil, fmt.Errorf("no OpenAI API key configured")
+	}
+	return p, nil
+}
+
+// UseClock replaces the pool's clock, which times the quarantines
+func (p *KeyPool) UseClock(now Clock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = now
+}
+
+// Size returns the number of keys in the pool
+func (p *KeyPool) Size() int {
+	return len(p.keys)
+}
+
+// Acquire picks the healthy key with the fewest requests in flight, rotating
+// between equally loaded keys. The caller must Report the outcome.
+func (p *KeyPool) Acquire() (*pooledKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var best *pooledKey
+	for i := range p.keys {
+		k := p.keys[(p.next+i)%len(p.keys)]
+		if now.Before(k.until) {
+			continue
+		}
+		if k.reason != "" {
+			// Quarantine over, back in rotation
+			k.reason = ""
+			keyHealthy.Set(1, k.label)
+		}
+		if best == nil || k.inFlight < best.inFlight {
+			best = k
+		}
+	}
+	if best == nil {
+		return nil, ErrNoHealthyKeys
+	}
+	p.next = (p.next + 1) % len(p.keys)
+	best.inFlight++
+	return best, nil
+}
+
+// Report records the HTTP status a key got and quarantines it on 401/429.
+// It returns true if the request should be retried with another key.
+func (p *KeyPool) Report(k *pooledKey, resp *http.Response) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k.inFlight--
+	keyRequests.Inc(k.label, strconv.Itoa(resp.StatusCode))
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		p.quarantine(k, "unauthorized", unauthorizedQuarantine)
+		return true
+	case http.StatusTooManyRequests:
+		k.strikes++
+		wait := minRateLimitQuarantine << (k.strikes - 1)
+		if ra, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(ra)*time.Second > wait {
+			wait = time.Duration(ra) * time.Second
+		}
+		if wait > maxRateLimitQuarantine || wait <= 0 {
+			wait = maxRateLimitQuarantine
+		}
+		p.quarantine(k, "rate_limited", wait)
+		return true
+	}
+
+	k.strikes = 0
+	return false
+}
+
+// Release returns a key whose request failed before getting a response
+func (p *KeyPool) Release(k *pooledKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.inFlight--
+}
+
+func (p *KeyPool) quarantine(k *pooledKey, reason string, d time.Duration) {
+	k.until = p.now().Add(d)
+	k.reason = reason
+	keyHealthy.Set(0, k.label)
+	keyQuarantines.Inc(k.label, reason)
+}
+
+// Reset puts every quarantined key back in rotation and returns how many
+// were quarantined
+func (p *KeyPool) Reset() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	now := p.now()
+	for _, k := range p.keys {
+		if now.Before(k.until) {
+			n++
+		}
+		k.until, k.reason, k.strikes = time.Time{}, "", 0
+		keyHealthy.Set(1, k.label)
+	}
+	return n
+}
+
+// KeyStatus describes a key's health without revealing it
+type KeyStatus struct {
+	Key              string     `json:"key"`
+	Healthy          bool       `json:"healthy"`
+	InFlight         int        `json:"in_flight"`
+	QuarantineReason string     `json:"quarantine_reason,omitempty"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+}
+
+// Status reports the health of every key
+func (p *KeyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	out := make([]KeyStatus, len(p.keys))
+	for i, k := range p.keys {
+		st := KeyStatus{Key: k.label, Healthy: !now.Before(k.until), InFlight: k.inFlight}
+		if !st.Healthy {
+			until := k.until
+			st.QuarantineReason = k.reason
+			st.QuarantinedUntil = &until
+		}
+		out[i] = st
+	}
+	return out
+}
+
+// handleStatus serves the key health to admins
+func (p *KeyPool) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": p.Status()})
+}
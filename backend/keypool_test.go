@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolQuarantine(t *testing.T) {
+	clock := newFakeClock()
+	pool, err := NewKeyPool([]string{"sk-one", "sk-two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.UseClock(clock.Now)
+
+	limited := fakeResponse(http.StatusTooManyRequests, "")
+	limited.Header.Set("Retry-After", "30")
+	first, _ := pool.Acquire()
+	if !pool.Report(first, limited) {
+		t.Fatal("429 not retried with another key")
+	}
+	second, _ := pool.Acquire()
+	if second == first {
+		t.Fatal("rate limited key handed out again")
+	}
+	if !pool.Report(second, fakeResponse(http.StatusUnauthorized, "")) {
+		t.Fatal("401 not retried with another key")
+	}
+	if _, err := pool.Acquire(); !errors.Is(err, ErrNoHealthyKeys) {
+		t.Fatalf("Acquire with every key quarantined: %v", err)
+	}
+
+	// Retry-After is longer than the first 10s quarantine, so it wins
+	clock.Advance(29 * time.Second)
+	if _, err := pool.Acquire(); !errors.Is(err, ErrNoHealthyKeys) {
+		t.Fatalf("key back before its Retry-After: %v", err)
+	}
+	clock.Advance(time.Second)
+	k, err := pool.Acquire()
+	if err != nil || k != first {
+		t.Fatalf("Acquire after Retry-After = %v, %v, want the rate limited key", k, err)
+	}
+
+	// A second 429 in a row doubles the quarantine
+	if !pool.Report(k, fakeResponse(http.StatusTooManyRequests, "")) {
+		t.Fatal("429 not retried with another key")
+	}
+	clock.Advance(2*minRateLimitQuarantine - time.Second)
+	if _, err := pool.Acquire(); !errors.Is(err, ErrNoHealthyKeys) {
+		t.Fatalf("key back before its doubled quarantine: %v", err)
+	}
+	clock.Advance(time.Second)
+	if k, err := pool.Acquire(); err != nil || k != first {
+		t.Fatalf("Acquire after doubled quarantine = %v, %v", k, err)
+	}
+
+	// The revoked key stays out for the hour
+	clock.Advance(unauthorizedQuarantine - 51*time.Second)
+	for _, st := range pool.Status() {
+		if st.Key == second.label && st.Healthy {
+			t.Errorf("unauthorized key healthy before the hour is over")
+		}
+	}
+	clock.Advance(time.Second)
+	for _, st := range pool.Status() {
+		if !st.Healthy {
+			t.Errorf("key %s still quarantined", st.Key)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxEntityFacts bounds the facts of a knowledge panel
+const maxEntityFacts = 20
+
+// KnowledgeEntity is the knowledge panel of a search, normalized from the
+// knowledge graph block of the engine's answer
+type KnowledgeEntity struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Facts       []EntityFact `json:"facts,omitempty"`
+	// Image is an http(s) URL
+	Image string `json:"image,omitempty"`
+	// URL is the entity's own website
+	URL string `json:"url,omitempty"`
+	// Source is where the description comes from, e.g. Wikipedia
+	Source *EntitySource `json:"source,omitempty"`
+}
+
+// EntityFact is one line of a knowledge panel, e.g. Born: June 28, 1971
+type EntityFact struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// EntitySource credits the text of a knowledge panel
+type EntitySource struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+// knowledgeGraphFields are the fields of a knowledge graph block that aren't
+// facts about the entity
+var knowledgeGraphFields = map[string]bool{
+	"title": true, "type": true, "entity_type": true, "description": true, "source": true, "website": true,
+	"image": true, "thumbnail": true, "header_images": true, "kgmid": true, "facts": true,
+}
+
+// parseKnowledgeGraph normalizes the knowledge_graph block of a SerpAPI
+// answer, which differs by engine: the name, type and description, the
+// first image, and the facts, either listed under facts or as the remaining
+// text fields in the order the engine gave them. A block without a name
+// is no panel.
+func parseKnowledgeGraph(raw json.RawMessage) (*KnowledgeEntity, error) {
+	fields, err := orderedObject(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error reading knowledge graph: %v", err)
+	}
+	values := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		values[f.key] = f.value
+	}
+	text := func(key string) string {
+		var s string
+		json.Unmarshal(values[key], &s)
+		return strings.TrimSpace(s)
+	}
+
+	entity := &KnowledgeEntity{
+		Name:        text("title"),
+		Type:        text("type"),
+		Description: text("description"),
+		URL:         httpURL(text("website")),
+	}
+	if entity.Name == "" {
+		return nil, nil
+	}
+	if entity.Type == "" {
+		entity.Type = text("entity_type")
+	}
+	var source struct {
+		Name string `json:"name"`
+		Link string `json:"link"`
+	}
+	if json.Unmarshal(values["source"], &source) == nil && source.Name != "" {
+		entity.Source = &EntitySource{Name: source.Name, URL: httpURL(source.Link)}
+	}
+	// The first image that can be linked to, header images before the
+	// thumbnail
+	var headers []struct {
+		Image string `json:"image"`
+	}
+	json.Unmarshal(values["header_images"], &headers)
+	images := []string{text("image")}
+	for _, h := range headers {
+		images = append(images, h.Image)
+	}
+	for _, image := range append(images, text("thumbnail")) {
+		if entity.Image = httpURL(image); entity.Image != "" {
+			break
+		}
+	}
+
+	var listed []struct {
+		Label string `json:"label"`
+		Title string `json:"title"`
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if json.Unmarshal(values["facts"], &listed) == nil {
+		for _, f := range listed {
+			label := f.Label
+			if label == "" {
+				label = f.Title
+			}
+			if label == "" {
+				label = f.Name
+			}
+			entity.addFact(label, f.Value)
+		}
+	}
+	for _, f := range fields {
+		if knowledgeGraphFields[f.key] || strings.HasSuffix(f.key, "_link") || strings.HasSuffix(f.key, "_links") {
+			continue
+		}
+		var value string
+		if json.Unmarshal(f.value, &value) == nil {
+			entity.addFact(factLabel(f.key), value)
+		}
+	}
+	return entity, nil
+}
+
+// addFact adds a fact with a label and a value, up to maxEntityFacts
+func (e *KnowledgeEntity) addFact(label, value string) {
+	label, value = strings.TrimSpace(label), strings.TrimSpace(value)
+	if label == "" || value == "" || len(e.Facts) >= maxEntityFacts {
+		return
+	}
+	e.Facts = append(e.Facts, EntityFact{Label: label, Value: value})
+}
+
+// factLabel turns a field name like place_of_birth into Place of birth
+func factLabel(key string) string {
+	label := strings.ReplaceAll(key, "_", " ")
+	if label == "" {
+		return ""
+	}
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+// httpURL returns s when it is an http(s) URL, "" otherwise; panels may
+// carry inline data: images the page shouldn't embed
+func httpURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return s
+}
+
+type objectField struct {
+	key   string
+	value json.RawMessage
+}
+
+// orderedObject reads the fields of a JSON object in order, which a map
+// would lose
+func orderedObject(raw json.RawMessage) ([]objectField, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not an object")
+	}
+	var fields []objectField
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, objectField{key, value})
+	}
+	return fields, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var localDates = metricsRegistry.Counter("local_dates_total",
+	"Relative dates of non-English prompts resolved by the server, by language.", "language")
+
+// dateLanguage holds the relative date phrases of one language
+type dateLanguage struct {
+	// units maps the words of a unit, singular and plural, to day, week,
+	// month or year
+	units map[string]string
+	// last match "last week" and "last 3 days" phrases: the count, if any,
+	// in group 1 and the unit in group 2
+	last []*regexp.Regexp
+	// yesterday matches the word for yesterday, only trusted with the
+	// language's locale: the French "hier" is "here" in German and Dutch
+	yesterday *regexp.Regexp
+	// since matches "since 2020", the year in group 1
+	since *regexp.Regexp
+	// particles lead into a date phrase, like "of" in "news of last week",
+	// and go with it
+	particles []string
+}
+
+// dateLanguages are the languages whose relative dates are resolved by the
+// server instead of the English-centric analysis prompt
+var dateLanguages = map[string]*dateLanguage{
+	"de": {
+		units: map[string]string{
+			"tag": "day", "tage": "day", "tagen": "day", "woche": "week", "wochen": "week",
+			"monat": "month", "monate": "month", "monaten": "month", "jahr": "year", "jahre": "year", "jahren": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:\b(?:in den|im|in der)\s+)?\b(?:letzten|letzte|letzter|letztes|vergangenen|vergangene|vergangenes)\s+(?:(\d+)\s+)?(\pL+)`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:seit )?gestern\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:seit|ab)\s+((?:19|20)\d{2})\b`),
+		particles: []string{"von", "vom", "der", "aus"},
+	},
+	"fr": {
+		units: map[string]string{
+			"jour": "day", "jours": "day", "semaine": "week", "semaines": "week",
+			"mois": "month", "an": "year", "ans": "year", "année": "year", "années": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:\b(?:au cours des|dans les|ces|les|la|le|l['’])\s*)?(?:(\d+)\s+)?derni(?:er|ère|ers|ères)\s+(\pL+)`),
+			regexp.MustCompile(`(?i)(?:\b(?:au cours de|durant|pendant)\s+)?(?:\b(?:la|le|l['’])\s*)?(\d+\s+)?(\pL+)\s+derni(?:er|ère|ers|ères)\b`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:depuis )?hier\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:depuis|après)\s+((?:19|20)\d{2})\b`),
+		particles: []string{"de", "des", "du", "d'"},
+	},
+	"es": {
+		units: map[string]string{
+			"día": "day", "días": "day", "dia": "day", "dias": "day", "semana": "week", "semanas": "week",
+			"mes": "month", "meses": "month", "año": "year", "años": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:^|\s)(?:(?:en|durante)\s+)?(?:(?:los|las|el|la)\s+)?(?:últimos|últimas|último|última|ultimos|ultimas)\s+(?:(\d+)\s+)?(\pL+)`),
+			regexp.MustCompile(`(?i)(?:\b(?:el|la)\s+)?(\d+\s+)?\b(\pL+)\s+(?:pasado|pasada|anterior)\b`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:desde )?ayer\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:desde|a partir de)\s+((?:19|20)\d{2})\b`),
+		particles: []string{"de", "del"},
+	},
+	"it": {
+		units: map[string]string{
+			"giorno": "day", "giorni": "day", "settimana": "week", "settimane": "week",
+			"mese": "month", "mesi": "month", "anno": "year", "anni": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:\b(?:negli|nelle|nell'|nel)\s*)?\b(?:ultimi|ultime|ultimo|ultima)\s+(?:(\d+)\s+)?(\pL+)`),
+			regexp.MustCompile(`(?i)(?:\b(?:la|il|l['’])\s*)?(\d+\s+)?\b(\pL+)\s+(?:scorso|scorsa|passato|passata)\b`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:da )?ieri\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:dal|dall['’]|dopo il)\s*((?:19|20)\d{2})\b`),
+		particles: []string{"di", "del", "della", "dello", "dei", "delle", "degli"},
+	},
+	"pt": {
+		units: map[string]string{
+			"dia": "day", "dias": "day", "semana": "week", "semanas": "week",
+			"mês": "month", "mes": "month", "meses": "month", "ano": "year", "anos": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:^|\s)(?:(?:nos|nas|no|na)\s+)?(?:últimos|últimas|último|última|ultimos|ultimas)\s+(?:(\d+)\s+)?(\pL+)`),
+			regexp.MustCompile(`(?i)(?:\b(?:na|no|o|a)\s+)?(\d+\s+)?\b(\pL+)\s+(?:passado|passada)\b`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:desde )?ontem\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:desde|a partir de)\s+((?:19|20)\d{2})\b`),
+		particles: []string{"de", "do", "da", "dos", "das"},
+	},
+	"nl": {
+		units: map[string]string{
+			"dag": "day", "dagen": "day", "week": "week", "weken": "week",
+			"maand": "month", "maanden": "month", "jaar": "year", "jaren": "year",
+		},
+		last: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(?:\b(?:in de|de)\s+)?\b(?:afgelopen|vorige|vorig|laatste)\s+(?:(\d+)\s+)?(\pL+)`),
+		},
+		yesterday: regexp.MustCompile(`(?i)\b(?:sinds )?gisteren\b`),
+		since:     regexp.MustCompile(`(?i)\b(?:sinds|vanaf)\s+((?:19|20)\d{2})\b`),
+		particles: []string{"van", "uit"},
+	},
+}
+
+// dateLanguageOrder is the order languages are tried in without a locale
+var dateLanguageOrder = []string{"de", "fr", "es", "it", "pt", "nl"}
+
+// localDate resolves the first relative date phrase of a non-English prompt
+// to the earliest date wanted, as YYYY-MM-DD like date_range, and returns
+// the phrase it read. The locale's language is tried alone when it has a
+// table; otherwise all of them are, without the words for yesterday.
+func localDate(prompt, locale string, now time.Time) (date, phrase, language string) {
+	languages := dateLanguageOrder
+	tag, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if _, ok := dateLanguages[tag]; ok {
+		languages = []string{tag}
+	}
+	for _, lang := range languages {
+		table := dateLanguages[lang]
+		for _, re := range table.last {
+			for _, m := range re.FindAllStringSubmatch(prompt, -1) {
+				unit, ok := table.units[strings.ToLower(m[2])]
+				if !ok {
+					continue
+				}
+				span := unit
+				if n := strings.TrimSpace(m[1]); n != "" {
+					span = n + " " + unit + "s"
+				}
+				return relativeDate(span, now), strings.TrimSpace(m[0]), lang
+			}
+		}
+		if lang == tag {
+			if m := table.yesterday.FindString(prompt); m != "" {
+				return relativeDate("day", now), m, lang
+			}
+		}
+		if m := table.since.FindStringSubmatch(prompt); m != nil {
+			if year, err := strconv.Atoi(m[1]); err == nil && year <= now.Year() {
+				return m[1] + "-01-01", m[0], lang
+			}
+		}
+	}
+	return "", "", ""
+}
+
+// resolveLocalDate sets the date_range of the intent from a relative date
+// of a non-English prompt, which wins over the model's reading, and takes
+// the phrase out of the main query if the model left it there
+func resolveLocalDate(intent *SearchIntent, prompt, locale string, now time.Time) {
+	if tag, _, _ := strings.Cut(strings.ToLower(locale), "-"); tag == "en" {
+		return
+	}
+	date, phrase, language := localDate(prompt, locale, now)
+	if date == "" {
+		return
+	}
+	localDates.Inc(language)
+	intent.DateRange = date
+	phraseRe := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(phrase))
+	words := strings.Fields(strings.Trim(phraseRe.ReplaceAllString(intent.MainQuery, " "), " ,.?!"))
+	if n := len(words); n > 1 && slices.Contains(dateLanguages[language].particles, strings.ToLower(words[n-1])) {
+		words = words[:n-1]
+	}
+	if len(words) > 0 {
+		intent.MainQuery = strings.Join(words, " ")
+	}
+}
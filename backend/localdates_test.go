@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveLocalDate(t *testing.T) {
+	// 2026-03-18, a Wednesday
+	now := newFakeClock().Now()
+	tests := []struct {
+		prompt, locale string
+		query          string
+		date           string
+	}{
+		{"nachrichten der letzten woche", "de-DE", "nachrichten", "2026-03-11"},
+		{"rezepte von gestern", "de", "rezepte", "2026-03-17"},
+		{"offres d'emploi des 3 derniers jours", "fr-FR", "offres d'emploi", "2026-03-15"},
+		{"noticias del último mes", "es", "noticias", "2026-02-18"},
+		{"elezioni dal 2024", "it", "elezioni", "2024-01-01"},
+		// English prompts are left to the model
+		{"news from last week", "en-US", "news from last week", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prompt, func(t *testing.T) {
+			intent := &SearchIntent{MainQuery: tt.prompt}
+			resolveLocalDate(intent, tt.prompt, tt.locale, now)
+			if intent.DateRange != tt.date || intent.MainQuery != tt.query {
+				t.Errorf("got %q, date %q; want %q, date %q", intent.MainQuery, intent.DateRange, tt.query, tt.date)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the request ID; clients can send their own and
+// always get it back, so support can find a request in the logs
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+// setupLogging installs the process-wide slog logger
+func setupLogging(format, level, privacy string) error {
+	if err := validateLogPrivacy(privacy); err != nil {
+		return err
+	}
+	logPrivacy = privacy
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q (want text or json)", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// fatal logs an error and exits, for startup failures
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestInfo collects what the access log reports about a request. Handlers
+// deeper in the chain fill in the tenant and the model usage.
+type requestInfo struct {
+	id string
+	// user is the X-User-ID of the request
+	user string
+	// client is the address the request came from
+	client string
+
+	mu               sync.Mutex
+	tenant           string
+	model            string
+	promptTokens     int
+	completionTokens int
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFromContext returns the request's info, or nil outside a request
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestIDFromContext returns the request ID, or ""
+func requestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+func (i *requestInfo) setTenant(id string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tenant = id
+}
+
+// addUsage counts the tokens of one model call made for the request
+func (i *requestInfo) addUsage(model string, promptTokens, completionTokens int) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.model = model
+	i.promptTokens += promptTokens
+	i.completionTokens += completionTokens
+}
+
+// validRequestID accepts short printable IDs, so a client can't inject log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestLog assigns each request an ID, returns it in X-Request-ID and
+// writes one access log line when the request is done
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id, user: userIDFromRequest(r)}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			info.client = host
+		}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+		}
+		info.mu.Lock()
+		if info.tenant != "" {
+			attrs = append(attrs, "tenant", info.tenant)
+		}
+		if info.model != "" {
+			attrs = append(attrs, "model", info.model,
+				"prompt_tokens", info.promptTokens, "completion_tokens", info.completionTokens)
+		}
+		info.mu.Unlock()
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request handled", attrs...)
+	})
+}
+
+// contextHandler scrubs every record for the tenant's privacy mode and adds
+// the request ID, tenant and trace ID of the context to records logged with
+// a *Context call
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r = scrubRecord(r, logPrivacyFor(ctx))
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if t := tenantFromContext(ctx); t != nil {
+		r.AddAttrs(slog.String("tenant", t.ID))
+	}
+	if span := spanFromContext(ctx); span != nil {
+		r.AddAttrs(slog.String("trace_id", span.TraceID()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// luckyCandidates is how many of the top results a tie-break picks from
+const luckyCandidates = 5
+
+// luckyPrompt asks the model to pick the result that answers a search
+const luckyPrompt = `You pick the single search result that best answers a search, the page the user would open first. ` +
+	`Prefer the official or primary source over aggregators, forums and ads. ` +
+	`Reply with JSON only: {"index": n}, n being the number of the result.`
+
+var luckySearches = metricsRegistry.Counter("lucky_searches_total",
+	"Lucky searches, by how the result was picked (top, tie_break, tie_break_failed, none).", "pick")
+
+// LuckyResult is the one result a lucky search returns instead of a list
+type LuckyResult struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	// Pick is "top" when the first result stood out, "tie_break" when the
+	// model chose among the top results
+	Pick string `json:"pick"`
+}
+
+// luckyResult picks the best of the results of an analysis: the first one,
+// unless the top results are too close to tell, in which case the model
+// breaks the tie. A failed tie-break falls back to the first result, and so
+// do analyses that kept personal data from OpenAI, which the results would
+// give away.
+func (h *SearchHandler) luckyResult(ctx context.Context, analysis *AnalysisResult, results []SearchResult) *LuckyResult {
+	ctx, span := tracer.Start(ctx, "search.lucky", SpanKindInternal)
+	defer span.End()
+	var candidates []SearchResult
+	for _, result := range results {
+		if u, err := url.Parse(result.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			candidates = append(candidates, result)
+		}
+	}
+	if len(candidates) == 0 {
+		luckySearches.Inc("none")
+		return nil
+	}
+	if len(candidates) > luckyCandidates {
+		candidates = candidates[:luckyCandidates]
+	}
+	best := &LuckyResult{Title: candidates[0].Title, URL: candidates[0].URL, Pick: "top"}
+	if len(analysis.Redacted) > 0 || !luckyAmbiguous(analysis.Intent, candidates) {
+		luckySearches.Inc(best.Pick)
+		span.SetAttr("search.lucky_pick", best.Pick)
+		return best
+	}
+
+	i, err := h.luckyTieBreak(ctx, analysis.Intent.MainQuery, candidates)
+	if err != nil {
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Error breaking lucky tie, using the top result", "error", err)
+		luckySearches.Inc("tie_break_failed")
+		return best
+	}
+	best = &LuckyResult{Title: candidates[i].Title, URL: candidates[i].URL, Pick: "tie_break"}
+	luckySearches.Inc(best.Pick)
+	span.SetAttr("search.lucky_pick", best.Pick)
+	return best
+}
+
+// luckyAmbiguous tells whether the top results leave the best one open.
+// The first result stands out when the search is limited to a site, when
+// its domain is named in the query (the site a navigational search is
+// after), or when it matches more of the query's words than the others.
+func luckyAmbiguous(intent *SearchIntent, candidates []SearchResult) bool {
+	if len(candidates) == 1 || intent.SiteFilter != "" {
+		return false
+	}
+	terms := personalizationTerms(intent)
+	host := resultHost(candidates[0].URL)
+	for _, term := range terms {
+		if len(term) > 2 && strings.Contains(host, term) {
+			return false
+		}
+	}
+	top := luckyCoverage(terms, candidates[0])
+	for _, c := range candidates[1:] {
+		if luckyCoverage(terms, c) >= top {
+			return true
+		}
+	}
+	return false
+}
+
+// luckyCoverage counts the query terms in the title and snippet of a result
+func luckyCoverage(terms []string, result SearchResult) int {
+	words := make(map[string]bool)
+	for _, w := range highlightWords(result.Title + " " + result.Snippet) {
+		words[strings.ToLower(w.text)] = true
+	}
+	n := 0
+	for _, term := range terms {
+		if words[term] {
+			n++
+		}
+	}
+	return n
+}
+
+// luckyTieBreak asks the cheap model which candidate answers the query
+// best and returns its index. It is refused over budget like analyses.
+func (h *SearchHandler) luckyTieBreak(ctx context.Context, query string, candidates []SearchResult) (int, error) {
+	if err := h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+		return 0, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Search: %s\n\nResults:\n", query)
+	for i, c := range candidates {
+		fmt.Fprintf(&b, "%d. %s\n   %s\n   %s\n", i+1, c.Title, c.URL, truncate(c.Snippet, 200))
+	}
+	reqBody := OpenAIRequest{
+		Model: h.router.cheapModel,
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: luckyPrompt},
+			{Role: "user", Content: b.String()},
+		},
+		MaxTokens: 20,
+	}
+
+	release, err := h.limiter.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	resp, err := h.chatCompletion(ctx, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	var answer struct {
+		Index int `json:"index"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(resp.Choices[0].Message.Content)), &answer); err != nil {
+		return 0, fmt.Errorf("error parsing tie-break answer: %v", err)
+	}
+	if answer.Index < 1 || answer.Index > len(candidates) {
+		return 0, fmt.Errorf("tie-break picked result %d of %d", answer.Index, len(candidates))
+	}
+	return answer.Index - 1, nil
+}
+
+// luckyResponse replaces the results of a search response with the best
+// one, as lucky
+func (h *SearchHandler) luckyResponse(r *http.Request, analysis *AnalysisResult, response map[string]interface{}) {
+	results := responseResults(response)
+	delete(response, "results")
+	delete(response, "best_result")
+	if _, failed := response["results_error"]; failed {
+		return
+	}
+	if best := h.luckyResult(r.Context(), analysis, results); best != nil {
+		response["lucky"] = best
+	}
+}
+
+// truncate cuts s to n runes, marking the cut
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
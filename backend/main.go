@@ -2,15 +2,23 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const OPENAI_API_KEY = "openapi-key"
@@ -24,6 +32,14 @@ type SearchIntent struct {
 	FileType     string   `json:"file_type,omitempty"`
 	ExcludeWords []string `json:"exclude_words,omitempty"`
 	DateRange    string   `json:"date_range,omitempty"`
+	// ExcludeSites are the tenant's blocked domains, not the model's
+	ExcludeSites []string `json:"exclude_sites,omitempty"`
+	// Scope is where the answer is likely to be when a local corpus is
+	// searched too: "web", "local" or "both"
+	Scope string `json:"scope,omitempty"`
+	// Entities are the people, products, organizations and locations the
+	// prompt is about
+	Entities []IntentEntity `json:"entities,omitempty"`
 }
 
 // OpenAIMessage represents a message in the OpenAI chat format
@@ -37,6 +53,7 @@ type OpenAIRequest struct {
 	Model       string          `json:"model"`
 	Messages    []OpenAIMessage `json:"messages"`
 	Temperature float64         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
 }
 
 // OpenAIResponse represents the response structure from OpenAI API
@@ -45,89 +62,422 @@ type OpenAIResponse struct {
 		Message struct {
 			Content string `json:"content"`
 		} `json:"message"`
+		// FinishReason is "length" when max_tokens cut the answer off
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
 	Error *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
 }
 
+// AnalysisResult is the outcome of analyzing a prompt
+type AnalysisResult struct {
+	Intent *SearchIntent
+	// Analyzer is "openai", or "heuristic" when the LLM was skipped
+	Analyzer string
+	// Route and Model tell which model route served an OpenAI analysis
+	Route string
+	Model string
+	// Vertical is the kind of search whose prompt was used
+	Vertical string
+	// QueryType tells whether the search is navigational, informational or
+	// transactional
+	QueryType string
+	// Cached is set when the analysis came from the intent cache
+	Cached bool
+	// Experiment and Variant tell which experiment variant made the analysis
+	Experiment string
+	Variant    string
+	// Guarded lists the prompt guard rules whose sentences were stripped
+	// from the prompt before the analysis, never set in log mode
+	Guarded []string
+	// Redacted lists the kinds of personal data kept from OpenAI
+	Redacted []string
+	// Truncated is set when parts of the intent were dropped for its query
+	// to fit the engine's limits
+	Truncated bool
+}
+
 // SearchHandler processes search requests
 type SearchHandler struct {
-	openAIKey string
-	client    *http.Client
+	keys    *KeyPool
+	client  HTTPDoer
+	limiter *UpstreamLimiter
+	budget  *BudgetTracker
+	history *HistoryService
+	router  *ModelRouter
+	policy  *ModelPolicy
+	// telemetry exports events to the tenants' own sinks
+	telemetry *TelemetryExporter
+	// cache keeps recent analyses, nil when disabled
+	cache *IntentCache
+	// flags switch features per tenant, nil leaves them as configured
+	flags *FeatureFlags
+	// results fetches result pages through the shared cache, nil when no
+	// results provider is configured
+	results *CachingProvider
+	// prompts holds the reloadable system prompt
+	prompts *PromptTemplate
+	// maxTokens caps each completion, zero leaves it to the model
+	maxTokens int
+	// analytics samples anonymized intents of opted-in tenants
+	analytics *AnalyticsSampler
+	// hedgeDelay is how long to wait before racing a second request, 0 disables it
+	hedgeDelay time.Duration
+	// intentVersion is the schema served to clients that don't ask for one
+	intentVersion int
+	// fewShot holds the corrected examples added to analyses, nil when off
+	fewShot *FewShotIndex
+	// experiments splits analyses between prompt and model variants
+	experiments *Experiments
+	// shadow repeats a sample of the analyses with a candidate, nil when off
+	shadow *ShadowComparator
+	// guard screens prompts for injected instructions, nil when off
+	guard *PromptGuard
+	// abuse counts prompts against identical-prompt flooding, nil when off
+	abuse *AbuseDetector
+	// synonyms expands the terms of the analyses, nil when off
+	synonyms *Synonyms
+	// transcriber turns voice queries into prompts, nil when off
+	transcriber *Transcriber
+	// images derives queries from images, nil when off
+	images *ImageSearch
+	// ocr reads the text in screenshots, nil when off
+	ocr *OCR
+	// documents searches the caller's uploaded documents, nil when off
+	documents *DocumentIndex
+	// embeddingModel embeds texts on /v1/embeddings, empty when off
+	embeddingModel string
+	// personalization re-ranks results by the user's clicks, nil when off
+	personalization *ClickProfiles
+	// instant answers weather and stock prompts without an analysis, nil
+	// when off
+	instant *InstantAnswers
+	// usage aggregates the analyses for the usage analytics API, nil when
+	// off
+	usage *UsageStats
+	// dedup shares analyses running at the same time across replicas, nil
+	// when off
+	dedup *AnalysisDeduplicator
+	// now and random are the clock and randomness of the analyses
+	now    Clock
+	random Random
 }
 
-func NewSearchHandler(openAIKey string) *SearchHandler {
+func NewSearchHandler(keys *KeyPool, client HTTPDoer, limiter *UpstreamLimiter, budget *BudgetTracker, history *HistoryService, router *ModelRouter, policy *ModelPolicy, telemetry *TelemetryExporter, analytics *AnalyticsSampler, prompts *PromptTemplate, cache *IntentCache, results *CachingProvider, flags *FeatureFlags, maxTokens int, hedgeDelay time.Duration, intentVersion int) *SearchHandler {
 	return &SearchHandler{
-		openAIKey: openAIKey,
-		client:    &http.Client{},
+		keys:    keys,
+		client:  client,
+		limiter: limiter,
+		budget:  budget,
+		history: history,
+		router:  router,
+		policy:  policy,
+
+		telemetry:     telemetry,
+		analytics:     analytics,
+		prompts:       prompts,
+		cache:         cache,
+		results:       results,
+		flags:         flags,
+		maxTokens:     maxTokens,
+		hedgeDelay:    hedgeDelay,
+		intentVersion: intentVersion,
+		now:           time.Now,
+		random:        defaultRandom,
 	}
 }
 
-// analyzePromptWithOpenAI sends the search prompt to OpenAI for understanding
-func (h *SearchHandler) analyzePromptWithOpenAI(ctx context.Context, prompt string) (*SearchIntent, error) {
-	messages := []OpenAIMessage{
-		{
-			Role: "system",
-			Content: `You are a search query analyzer. Extract search parameters and return ONLY a JSON object like this:
-{
-    "main_query": "the main search terms",
-    "exact_phrases": ["exact phrase 1", "exact phrase 2"],
-    "site_filter": "example.com",
-    "file_type": "pdf",
-    "exclude_words": ["exclude1", "exclude2"],
-    "date_range": "timeframe"
+// analyze checks the spend budget before calling OpenAI. Over budget, the
+// prompt is either parsed heuristically or rejected, as configured. opts must
+// have been validated against the model policy.
+func (h *SearchHandler) analyze(ctx context.Context, prompt string, opts AnalyzeOptions) (result *AnalysisResult, err error) {
+	ctx, span := tracer.Start(ctx, "search.analyze", SpanKindInternal)
+	defer span.End()
+
+	tenant := tenantFromContext(ctx)
+	if tenant != nil {
+		span.SetAttr("tenant.id", tenant.ID)
+	}
+	// Deferred first so it sees the analysis as it's answered
+	began := time.Now()
+	defer func() { h.usage.Observe(ctx, result, err, time.Since(began)) }()
+
+	prompt, guarded, err := h.guard.Check(ctx, prompt)
+	if len(guarded) > 0 {
+		h.telemetry.Emit(ctx, "search.prompt_injection", map[string]interface{}{
+			"rules": guarded, "refused": err != nil,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.guard.logOnly() {
+		// Nothing was stripped
+		guarded = nil
+	}
+	redaction, err := screenPII(ctx, prompt, opts.ConfirmPII)
+	if err != nil {
+		return nil, err
+	}
+	if redaction != nil {
+		prompt = redaction.prompt
+	}
+	// Every analysis, cached or not, reports what was screened out, gets
+	// the redacted values back and is made safe to build a URL from
+	defer func() {
+		if result == nil {
+			return
+		}
+		result.Guarded = guarded
+		if redaction != nil {
+			result.Intent = redaction.restore(result.Intent)
+			result.Redacted = redaction.kinds
+		}
+		result.Intent = cleanIntent(result.Intent)
+		if h.flags.Enabled(ctx, FlagQueryTrimming, true) {
+			result.Intent.MainQuery = trimMainQuery(result.Intent.MainQuery)
+		}
+		h.synonyms.Expand(result.Intent)
+		resolveLocalDate(result.Intent, prompt, opts.Locale, h.now())
+		result.Intent.ExcludeSites = tenant.ExcludedSites(result.Intent)
+		result.Truncated = fitQuery(result.Intent, defaultEngine.Load())
+		// Last, so nothing puts back an operator the tenant banned
+		if tenant != nil {
+			tenant.Prompt.enforce(result.Intent)
+		}
+		result.QueryType = classifyQueryType(prompt, result.Intent)
+		queryTypes.Inc(result.QueryType)
+		countEntities(result.Intent)
+	}()
+
+	route, model := h.router.Route(prompt, h.flags.Enabled(ctx, FlagModelRouter, h.router.Enabled()))
+	if opts.Model != "" {
+		route, model = RouteOverride, opts.Model
+	}
+	temperature := defaultTemperature
+	if opts.Temperature != nil {
+		temperature = *opts.Temperature
+	}
+	// Requests choosing their own model or temperature stay out of
+	// experiments, they would skew the results
+	prompts := h.prompts
+	var assignment *Assignment
+	if opts.Model == "" && opts.Temperature == nil {
+		assignment = h.experiments.Assign(ctx)
+	}
+	if assignment != nil {
+		span.SetAttr("experiment.name", assignment.Experiment)
+		span.SetAttr("experiment.variant", assignment.Variant)
+		if assignment.prompts != nil {
+			prompts = assignment.prompts
+		}
+		if assignment.model != "" {
+			route, model = RouteExperiment, assignment.model
+		}
+	}
+	vertical := prompts.Vertical(prompt)
+	now := h.now()
+	data := NewPromptData(now, opts.Locale)
+	data.LocalCorpus = h.federates()
+	data.Synonyms = h.synonyms.PromptSynonyms(prompt)
+	if tenant != nil {
+		data.customize(tenant.Prompt)
+	}
+	system := prompts.System(vertical, data)
+
+	// Cached analyses are free, so they are served even over budget. Tenants
+	// with corrections have their own entries, shaped by their examples, and
+	// new ones whenever the examples change.
+	cacheKey := intentCacheKey(prompt, system, model, temperature)
+	fewShotTenant := h.fewShotTenant(ctx)
+	if fewShotTenant != "" {
+		cacheKey += ":" + fewShotTenant + ":" + strconv.FormatUint(h.fewShot.Generation(fewShotTenant), 10)
+	}
+	if cached, ok := h.cache.Get(cacheKey); ok {
+		span.SetAttr("search.analyzer", cached.Analyzer)
+		span.SetAttr("search.cache", "hit")
+		if assignment != nil {
+			cached.Experiment, cached.Variant = assignment.Experiment, assignment.Variant
+			h.experiments.Observe(assignment, ExperimentSearch)
+		}
+		return cached, nil
+	}
+
+	if err := h.budget.Check(ctx, tenant); err != nil {
+		var budgetErr *BudgetExceededError
+		if errors.As(err, &budgetErr) {
+			h.telemetry.Emit(ctx, "budget.exceeded", map[string]interface{}{
+				"scope":  budgetErr.Scope,
+				"period": budgetErr.Period,
+				"action": h.budget.Action(tenant),
+			})
+		}
+		if h.budget.Action(tenant) == BudgetActionReject {
+			return nil, err
+		}
+		slog.WarnContext(ctx, "Budget exceeded, using heuristic parser", "error", err)
+		span.SetAttr("search.analyzer", "heuristic")
+		return &AnalysisResult{
+			Intent:   parsePromptHeuristically(prompt, now),
+			Analyzer: "heuristic",
+		}, nil
+	}
+
+	routeRequests.Inc(route, model)
+	verticalRequests.Inc(vertical)
+	span.SetAttr("search.analyzer", "openai")
+	span.SetAttr("search.route", route)
+	span.SetAttr("search.vertical", vertical)
+	span.SetAttr("gen_ai.request.model", model)
+
+	start := time.Now()
+	examples := h.fewShotExamples(ctx, fewShotTenant, prompt)
+	span.SetAttr("search.few_shot_examples", len(examples))
+	intent, err := h.dedup.Do(ctx, cacheKey, func(ctx context.Context) (*SearchIntent, error) {
+		return h.analyzePromptWithOpenAI(ctx, prompt, system, model, temperature, examples)
+	})
+	elapsed := time.Since(start)
+	routeLatency.Observe(elapsed.Seconds(), route)
+	if err != nil {
+		span.RecordError(err)
+		routeFailures.Inc(route, model)
+		h.experiments.Observe(assignment, ExperimentFailure)
+		h.telemetry.Emit(ctx, "search.failed", map[string]interface{}{
+			"route": route, "model": model, "latency_ms": elapsed.Milliseconds(), "error": err.Error(),
+		})
+		return nil, err
+	}
+	h.telemetry.Emit(ctx, "search.completed", map[string]interface{}{
+		"route": route, "model": model, "latency_ms": elapsed.Milliseconds(),
+	})
+	result = &AnalysisResult{Intent: intent, Analyzer: "openai", Route: route, Model: model, Vertical: vertical}
+	h.cache.Put(cacheKey, result)
+	h.shadow.Submit(ctx, h.random(), shadowRequest{
+		prompt: prompt, vertical: vertical, locale: opts.Locale, now: now, model: model, prompts: prompts,
+		temperature: temperature, examples: examples, intent: intent,
+	})
+	if assignment != nil {
+		result.Experiment, result.Variant = assignment.Experiment, assignment.Variant
+		h.experiments.Observe(assignment, ExperimentSearch)
+	}
+	return result, nil
 }
-Always include all fields, use empty arrays [] for empty lists, and empty strings "" for empty fields.`,
-		},
+
+// analyzePromptWithOpenAI sends the search prompt to OpenAI for understanding,
+// after the examples as earlier turns of the conversation
+func (h *SearchHandler) analyzePromptWithOpenAI(ctx context.Context, prompt, system, model string, temperature float64, examples []*fewShotExample) (*SearchIntent, error) {
+	messages := []OpenAIMessage{
 		{
-			Role:    "user",
-			Content: prompt,
+			Role:    "system",
+			Content: system,
 		},
 	}
+	for _, ex := range examples {
+		answer, err := analyzerAnswer(ex.intent)
+		if err != nil {
+			continue
+		}
+		messages = append(messages,
+			OpenAIMessage{Role: "user", Content: ex.prompt},
+			OpenAIMessage{Role: "assistant", Content: answer})
+	}
+	messages = append(messages, OpenAIMessage{Role: "user", Content: prompt})
 
 	reqBody := OpenAIRequest{
-		Model:       "gpt-3.5-turbo",
+		Model:       model,
 		Messages:    messages,
-		Temperature: 0.3, // Lower temperature for more consistent output
+		Temperature: temperature,
+		MaxTokens:   h.maxTokens,
 	}
 
-	jsonBody, err := json.Marshal(reqBody)
+	if !logsBodies(ctx) {
+		slog.DebugContext(ctx, "Sending request to OpenAI", "model", model, "prompt", loggedPrompt(ctx, prompt))
+	}
+
+	// Wait for an upstream slot so traffic spikes queue here instead of
+	// fanning out into hundreds of concurrent OpenAI calls
+	_, wait := tracer.Start(ctx, "upstream.wait", SpanKindInternal)
+	release, err := h.limiter.Acquire(ctx)
+	wait.RecordError(err)
+	wait.End()
 	if err != nil {
-		return nil, fmt.Errorf("error marshaling OpenAI request: %v", err)
+		return nil, err
 	}
+	defer release()
 
-	// Log the request for debugging
-	log.Printf("Sending request to OpenAI: %s", string(jsonBody))
+	openAIResp, err := h.chatCompletion(ctx, reqBody)
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", OPENAI_API_URL, bytes.NewBuffer(jsonBody))
+	// Parse the JSON response from OpenAI into SearchIntent
+	choice := openAIResp.Choices[0]
+	content := strings.TrimSpace(choice.Message.Content)
+	intent, err := decodeIntentJSON([]byte(content))
+	if err != nil {
+		// Answers cut off by max_tokens, or broken the same way, can often be saved
+		if recovered, rerr := h.recoverTruncated(ctx, reqBody, content, choice.FinishReason == "length"); rerr == nil {
+			intent, err = recovered, nil
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error creating OpenAI request: %v", err)
+		if logsBodies(ctx) {
+			slog.DebugContext(ctx, "Unparsable intent", "content", content)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrIntentParse, err)
+	}
+
+	// Initialize empty slices if they're nil
+	if intent.ExactPhrases == nil {
+		intent.ExactPhrases = []string{}
+	}
+	if intent.ExcludeWords == nil {
+		intent.ExcludeWords = []string{}
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", h.openAIKey))
-	req.Header.Set("Content-Type", "application/json")
+	return intent, nil
+}
 
-	resp, err := h.client.Do(req)
+// chatCompletion sends one chat completion request, records its spend and
+// returns the response once it has at least one choice
+func (h *SearchHandler) chatCompletion(ctx context.Context, reqBody OpenAIRequest) (*OpenAIResponse, error) {
+	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("error calling OpenAI: %v", err)
+		return nil, fmt.Errorf("error marshaling OpenAI request: %v", err)
+	}
+	if logsBodies(ctx) {
+		slog.DebugContext(ctx, "Sending request to OpenAI", "body", string(jsonBody))
 	}
-	defer resp.Body.Close()
+	return h.postChatCompletion(ctx, reqBody.Model, jsonBody)
+}
 
-	// Read the full response body
-	body, err := io.ReadAll(resp.Body)
+// postChatCompletion is chatCompletion for a request already encoded, by
+// model
+func (h *SearchHandler) postChatCompletion(ctx context.Context, model string, jsonBody []byte) (*OpenAIResponse, error) {
+	body, err := h.postHedged(ctx, model, jsonBody)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, err
 	}
 
-	// Log the response for debugging
-	log.Printf("OpenAI response: %s", string(body))
+	if logsBodies(ctx) {
+		slog.DebugContext(ctx, "OpenAI response", "body", string(body))
+	} else {
+		slog.DebugContext(ctx, "OpenAI response", "bytes", len(body))
+	}
 
 	var openAIResp OpenAIResponse
 	if err := json.Unmarshal(body, &openAIResp); err != nil {
 		return nil, fmt.Errorf("error parsing OpenAI response: %v", err)
 	}
 
+	// Count the spend even if the content turns out to be unusable
+	h.recordUsage(ctx, model, openAIResp.Usage.PromptTokens, openAIResp.Usage.CompletionTokens)
+
 	if openAIResp.Error != nil {
 		return nil, fmt.Errorf("OpenAI API error: %s", openAIResp.Error.Message)
 	}
@@ -135,26 +485,86 @@ Always include all fields, use empty arrays [] for empty lists, and empty string
 	if len(openAIResp.Choices) == 0 {
 		return nil, fmt.Errorf("no response choices from OpenAI")
 	}
+	return &openAIResp, nil
+}
 
-	// Parse the JSON response from OpenAI into SearchIntent
-	var intent SearchIntent
-	content := strings.TrimSpace(openAIResp.Choices[0].Message.Content)
-	if err := json.Unmarshal([]byte(content), &intent); err != nil {
-		return nil, fmt.Errorf("error parsing intent JSON: %v\nContent: %s", err, content)
+// recordUsage counts the tokens of one chat completion in the budget, the
+// request log, the metrics and telemetry
+func (h *SearchHandler) recordUsage(ctx context.Context, model string, promptTokens, completionTokens int) {
+	cost := costUSD(model, promptTokens, completionTokens)
+	h.budget.Record(ctx, tenantFromContext(ctx), cost)
+	requestInfoFromContext(ctx).addUsage(model, promptTokens, completionTokens)
+	openAITokens.Add(float64(promptTokens), model, "prompt")
+	openAITokens.Add(float64(completionTokens), model, "completion")
+	openAICost.Add(cost, model)
+	if span := spanFromContext(ctx); span != nil {
+		span.SetAttr("gen_ai.usage.input_tokens", promptTokens)
+		span.SetAttr("gen_ai.usage.output_tokens", completionTokens)
+		span.SetAttr("search.cost_usd", cost)
 	}
+	h.telemetry.Emit(ctx, "openai.usage", map[string]interface{}{
+		"model":             model,
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"cost_usd":          cost,
+	})
+}
 
-	// Initialize empty slices if they're nil
-	if intent.ExactPhrases == nil {
-		intent.ExactPhrases = []string{}
-	}
-	if intent.ExcludeWords == nil {
-		intent.ExcludeWords = []string{}
-	}
+// doWithKeys posts a request to an OpenAI endpoint, moving on to the next key
+// when one is rejected (401) or rate limited (429). The last response is
+// returned as is once every key has been tried. operation names the span.
+func (h *SearchHandler) doWithKeys(ctx context.Context, operation, endpoint, contentType string, body []byte) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		key, err := h.keys.Acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		callCtx, span := tracer.Start(ctx, "openai."+operation, SpanKindClient)
+		span.SetAttr("openai.key", key.label)
+		span.SetAttr("openai.attempt", attempt)
 
-	return &intent, nil
+		req, err := http.NewRequestWithContext(callCtx, "POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			h.keys.Release(key)
+			span.End()
+			return nil, fmt.Errorf("error creating OpenAI request: %v", err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key.secret))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("traceparent", span.Traceparent())
+
+		resp, err := h.client.Do(req)
+		if err != nil {
+			h.keys.Release(key)
+			span.RecordError(err)
+			span.End()
+			openAIUpstream.failure(err)
+			// %w keeps a context deadline recognizable to writeAnalyzeError
+			return nil, fmt.Errorf("error calling OpenAI: %w", err)
+		}
+		// The span covers the time to the response headers; reading the
+		// body is accounted to the analysis span
+		openAIUpstream.success()
+		span.SetAttr("http.response.status_code", resp.StatusCode)
+		// OpenAI's own ID, for tickets with their support
+		span.SetAttr("openai.request_id", resp.Header.Get("X-Request-Id"))
+		if resp.StatusCode >= 400 {
+			span.RecordError(fmt.Errorf("OpenAI answered %s", resp.Status))
+		}
+		span.End()
+		if !h.keys.Report(key, resp) || attempt >= h.keys.Size() {
+			return resp, nil
+		}
+		slog.WarnContext(ctx, "OpenAI key rejected, retrying with another key", "key", key.label, "status", resp.StatusCode,
+			"openai_request_id", resp.Header.Get("X-Request-Id"))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
 }
 
-func constructSearchQuery(intent *SearchIntent) string {
+// buildQueryString renders the intent as a query with search operators
+func buildQueryString(intent *SearchIntent) string {
 	var queryParts []string
 
 	if intent.MainQuery != "" {
@@ -185,24 +595,14 @@ func constructSearchQuery(intent *SearchIntent) string {
 		queryParts = append(queryParts, fmt.Sprintf("after:%s", intent.DateRange))
 	}
 
-	baseURL := "https://www.google.com/search"
-	params := url.Values{}
-	params.Add("q", strings.Join(queryParts, " "))
+	for _, site := range intent.ExcludeSites {
+		queryParts = append(queryParts, fmt.Sprintf("-site:%s", site))
+	}
 
-	return fmt.Sprintf("%s?%s", baseURL, params.Encode())
+	return strings.Join(queryParts, " ")
 }
 
 func (h *SearchHandler) handleSearch(w http.ResponseWriter, r *http.Request) {
-	// Enable CORS
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -215,51 +615,895 @@ func (h *SearchHandler) handleSearch(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Log the incoming request
-	log.Printf("Received request body: %s", string(body))
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qrImage, err := requestedQRImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var req struct {
 		Prompt string `json:"prompt"`
+		AnalyzeOptions
+		// IncludeResults adds the first result page, in the Locale of the
+		// options
+		IncludeResults bool `json:"include_results"`
+		// Lucky returns the single best result as lucky instead of the
+		// results
+		Lucky bool `json:"lucky"`
+		// RelatedQuestions has the model suggest related_questions when the
+		// engine has none
+		RelatedQuestions bool `json:"related_questions"`
+		// Translate searches the terms of the intent translated into
+		// ResultLanguage, or the engine's language
+		Translate      bool   `json:"translate"`
+		ResultLanguage string `json:"result_language"`
 	}
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	slog.DebugContext(r.Context(), "Received search", "prompt", loggedPrompt(r.Context(), req.Prompt))
+	setPromptLanguage(r.Context(), req.Prompt, req.Locale)
+	h.abuse.ObservePrompt(r, req.Prompt)
+	if err := h.policy.Validate(req.AnalyzeOptions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ResultLanguage != "" && (len(req.ResultLanguage) > 35 || !localeRe.MatchString(req.ResultLanguage)) {
+		http.Error(w, "result_language must be a language tag like en", http.StatusBadRequest)
+		return
+	}
+	if h.routeToDocuments(w, r, req.Prompt) {
+		return
+	}
+	if h.routeToCalculator(w, r, req.Prompt) {
+		return
+	}
+	if h.routeToInstantAnswer(w, r, req.Prompt, req.Locale) {
+		return
+	}
 
-	intent, err := h.analyzePromptWithOpenAI(r.Context(), req.Prompt)
+	result, err := h.analyze(r.Context(), req.Prompt, req.AnalyzeOptions)
 	if err != nil {
-		log.Printf("Error analyzing prompt: %v", err)
-		http.Error(w, fmt.Sprintf("Error analyzing prompt: %v", err), http.StatusInternalServerError)
+		writeAnalyzeError(w, r, err)
 		return
 	}
 
-	searchURL := constructSearchQuery(intent)
+	var translation *QueryTranslation
+	if req.Translate {
+		translation = h.translateIntent(r, result, translationTarget(req.ResultLanguage), req.Locale)
+	}
+
+	w.Header().Set(intentVersionHeader, strconv.Itoa(version))
+	response := h.searchResponse(r, req.Prompt, result, version, qrImage, req.IncludeResults || req.Lucky, req.Locale)
+	if translation != nil {
+		response["translation"] = translation
+	}
+	if req.Lucky {
+		h.luckyResponse(r, result, response)
+	}
+	if req.RelatedQuestions {
+		h.relatedQuestions(r, result, req.Locale, response)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// searchResponse records an analyzed search in the history, experiments and
+// analytics, and renders the answer of /search, fetching results if asked
+func (h *SearchHandler) searchResponse(r *http.Request, prompt string, result *AnalysisResult, version int, qrImage string, includeResults bool, locale string) map[string]interface{} {
+	searchURL := constructSearchQuery(result.Intent)
+	searchID := h.history.Record(r, prompt, result, searchURL)
+	h.experiments.Track(searchID, result)
+	h.analytics.Observe(r.Context(), result)
+
 	response := map[string]interface{}{
 		"search_url": searchURL,
-		"intent":     intent,
+		"intent":     renderIntent(result.Intent, version),
+		"analyzer":   result.Analyzer,
+		"trace_id":   spanFromContext(r.Context()).TraceID(),
+	}
+	if searchID != "" {
+		// Clients send it back with feedback on the search
+		response["search_id"] = searchID
+	}
+	if result.Model != "" {
+		response["model"] = result.Model
+	}
+	if len(result.Redacted) > 0 {
+		response["pii"] = map[string]interface{}{"redacted": result.Redacted}
+	}
+	if len(result.Guarded) > 0 {
+		// Part of the prompt was ignored, the client may want to say so
+		response["prompt_guard"] = map[string]interface{}{"action": "stripped", "rules": result.Guarded}
 	}
+	if result.Vertical != "" {
+		response["vertical"] = result.Vertical
+	}
+	if result.QueryType != "" {
+		response["query_type"] = result.QueryType
+	}
+	if verticals := entityVerticals(result.Intent); len(verticals) > 0 {
+		response["entity_verticals"] = verticals
+	}
+	if qrImage != "" {
+		// To open the search on a phone
+		if qr, err := qrDataURI(searchURL, qrImage); err != nil {
+			slog.WarnContext(r.Context(), "Error encoding QR code", "error", err)
+		} else {
+			response["qr_code"] = qr
+		}
+	}
+	if result.Cached {
+		response["cached"] = true
+	}
+	if result.Truncated {
+		// The search leaves out part of what was asked
+		response["truncated"] = true
+	}
+	if result.Variant != "" {
+		response["experiment"] = map[string]string{"name": result.Experiment, "variant": result.Variant}
+	}
+	if includeResults && h.results != nil && h.flags.Enabled(r.Context(), FlagResults, true) && h.federates() &&
+		h.flags.Enabled(r.Context(), FlagFederated, true) {
+		h.federatedResults(r, prompt, result.Intent, locale, response)
+	} else if includeResults && h.results != nil && h.flags.Enabled(r.Context(), FlagResults, true) {
+		q := ResultsQuery{Query: buildQueryString(result.Intent), Engine: defaultEngine.Load().Name, Locale: locale}
+		page, served, err := h.results.Page(r.Context(), q)
+		if err != nil {
+			// The search URL is still useful without the results
+			slog.WarnContext(r.Context(), "Error fetching results", "error", err)
+			response["results_error"] = "results provider unavailable"
+		} else {
+			response["results"] = NewHighlighter(result.Intent).Results(filterResults(tenantFromContext(r.Context()), result.Intent, page.Results))
+			response["results_cache"] = served
+			if page.Entity != nil {
+				response["entity"] = page.Entity
+			}
+			if len(page.RelatedQuestions) > 0 {
+				relatedQuestionRequests.Inc("engine")
+				response["related_questions"] = page.RelatedQuestions
+			}
+		}
+	}
+	h.personalize(r, result.Intent, searchID, response)
+	if result.QueryType == QueryNavigational {
+		// The user is after one page, clients can go straight to it
+		if best := bestResult(response); best != nil {
+			response["best_result"] = best
+		}
+	}
+	return response
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+// writeAnalyzeError maps a failed analysis to the matching HTTP status
+func writeAnalyzeError(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+	var budgetErr *BudgetExceededError
+	if errors.As(err, &budgetErr) {
+		slog.WarnContext(ctx, "Rejecting request", "error", budgetErr)
+		retry := int(math.Ceil(time.Until(budgetErr.ResetAt).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"error":    "budget_exceeded",
+			"message":  localizedError(ctx, budgetErr.Error()),
+			"scope":    budgetErr.Scope,
+			"period":   budgetErr.Period,
+			"reset_at": budgetErr.ResetAt,
+			"trace_id": spanFromContext(ctx).TraceID(),
+		})
+		return
+	}
+	var piiErr *PIIConfirmationError
+	if errors.As(err, &piiErr) {
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":    "pii_confirmation_required",
+			"message":  localizedError(ctx, piiErr.Error()),
+			"kinds":    piiErr.Kinds,
+			"trace_id": spanFromContext(ctx).TraceID(),
+		})
+		return
+	}
+	var rejected *PromptRejectedError
+	if errors.As(err, &rejected) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "prompt_rejected",
+			"message":  localizedError(ctx, rejected.Error()),
+			"rules":    rejected.Rules,
+			"trace_id": spanFromContext(ctx).TraceID(),
+		})
+		return
+	}
+	if errors.Is(err, ErrNoHealthyKeys) {
+		slog.ErrorContext(ctx, "No healthy OpenAI key, rejecting request")
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Service busy, please retry shortly", http.StatusServiceUnavailable)
 		return
 	}
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		// Nobody is left to read an error
+		slog.InfoContext(ctx, "Client went away, analysis cancelled")
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.WarnContext(ctx, "Request timed out", "error", err)
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	var overloaded *UpstreamOverloadedError
+	if errors.As(err, &overloaded) {
+		slog.WarnContext(ctx, "Upstream saturated, shedding request", "retry_after", overloaded.RetryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(overloaded.RetryAfter.Seconds())))))
+		http.Error(w, "Too many requests, please retry later", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, ErrUpstreamBusy) {
+		slog.WarnContext(ctx, "Upstream busy, rejecting request")
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Service busy, please retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+	slog.ErrorContext(ctx, "Error analyzing prompt", "error", err)
+	http.Error(w, fmt.Sprintf("Error analyzing prompt: %v", err), http.StatusInternalServerError)
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error encoding response", "error", err)
+	}
+}
+
+// withCORS enables CORS for the allowed origins on every response,
+// including errors produced by middleware, and answers preflight requests.
+// Without allowed origins only same-origin pages, like the embedded
+// frontend, can read the responses.
+func withCORS(origins []string, next http.Handler) http.Handler {
+	anyOrigin := slices.Contains(origins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch origin := r.Header.Get("Origin"); {
+		case anyOrigin:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case origin != "" && slices.Contains(origins, origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		default:
+			w.Header().Add("Vary", "Origin")
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Admin-Key, X-User-ID, X-History-Public-Key, X-Intent-Version, X-Request-ID, If-None-Match, traceparent")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After, X-Intent-Version, X-Request-ID, X-Trace-ID")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func main() {
-	// Get OpenAI API key from environment variable
+	cfg, err := LoadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel, cfg.LogPrivacy); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	piiMode = cfg.PIIMode
+
+	tenants, err := LoadTenants(cfg.TenantsFile)
+	if err != nil {
+		fatal("Error loading tenants", "error", err)
+	}
+
+	limiter := NewUpstreamLimiter(cfg.UpstreamMaxConcurrency, cfg.UpstreamMaxQueue, cfg.UpstreamQueueTimeout, cfg.UpstreamLoadShedding)
+	// background runs the loops and jobs that outlive requests; it's cancelled
+	// once the server has drained
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	health := NewHealth(map[string]interface{}{
+		"intent":          intentVersions(),
+		"intent_default":  cfg.IntentVersion,
+		"history_archive": historyArchiveVersion,
+	})
+	var spendStore SpendStore = NewMemorySpendStore()
+	if cfg.BudgetStore == "redis" {
+		client, err := NewRedisClient(cfg.RedisURL)
+		if err != nil {
+			fatal("Invalid REDIS_URL", "error", err)
+		}
+		spendStore = NewRedisSpendStore(client)
+		health.AddCheck("budget_store", redisCheck(client))
+	}
+	budget := NewBudgetTracker(spendStore, cfg.BudgetDailyUSD, cfg.BudgetMonthlyUSD, cfg.BudgetAction)
+
+	fingerprintSecret := []byte(cfg.HistoryFingerprintSecret)
+	if len(fingerprintSecret) == 0 {
+		slog.Warn("HISTORY_FINGERPRINT_SECRET not set, history fingerprints won't survive a restart")
+		fingerprintSecret = make([]byte, 32)
+		rand.Read(fingerprintSecret)
+	}
+	var historyStore HistoryStore = NewMemoryHistoryStore()
+	var feedbackStore FeedbackStore = NewMemoryFeedbackStore()
+	var shortLinkStore ShortLinkStore = NewMemoryShortLinkStore()
+	// sqlHistory is the history database, nil when history is in memory
+	var sqlHistory *sqlHistoryStore
+	if cfg.HistoryStore != HistoryStoreMemory {
+		store, err := NewSQLHistoryStore(background, cfg.HistoryStore, cfg.HistoryDSN)
+		if err != nil {
+			fatal("Error opening history store", "store", cfg.HistoryStore, "error", err)
+		}
+		defer store.Close()
+		historyStore = store
+		sqlHistory = store
+		if feedbackStore, err = NewSQLFeedbackStore(background, store); err != nil {
+			fatal("Error opening feedback store", "store", cfg.HistoryStore, "error", err)
+		}
+		if shortLinkStore, err = NewSQLShortLinkStore(background, store); err != nil {
+			fatal("Error opening short link store", "store", cfg.HistoryStore, "error", err)
+		}
+		health.AddCheck("history_store", store.Ping)
+		slog.Info("Persisting search history", "store", cfg.HistoryStore)
+	}
+	history := NewHistoryService(historyStore, NewFingerprinter(fingerprintSecret))
+
+	router := NewModelRouter(cfg.ModelRouterEnabled, cfg.OpenAIModel, cfg.CheapModel, cfg.CapableModel, cfg.ModelRouterThreshold)
+	if cfg.ModelRouterEnabled {
+		slog.Info("Model routing enabled", "cheap", cfg.CheapModel, "capable", cfg.CapableModel, "threshold", cfg.ModelRouterThreshold)
+	}
+
+	policy := NewModelPolicy(cfg.AllowedModels, cfg.MaxTemperature)
+
+	keys, err := NewKeyPool(cfg.OpenAIKeys)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	health.AddCheck("openai_keys", keysCheck(keys))
+	health.AddCheck("openai_upstream", openAIUpstream.check)
+	client, err := newOutboundClient(cfg)
+	if err != nil {
+		fatal("Invalid OUTBOUND_PROXY", "error", err)
+	}
+	var mock *MockTransport
+	if cfg.LLMProvider == LLMProviderMock {
+		if mock, err = NewMockTransport(cfg.LLMMockRules, client.Transport); err != nil {
+			fatal("Invalid LLM_MOCK_RULES", "error", err)
+		}
+		client.Transport = mock
+		slog.Warn("Answering analyses with the mock provider, OpenAI is not called", "rules", cfg.LLMMockRules)
+	}
+	telemetry := NewTelemetryExporter(client, cfg.TelemetryFlushInterval)
+	go telemetry.Run(background)
+	tracer.UseTenantTelemetry(telemetry)
+	if cfg.OTLPTracesEndpoint != "" {
+		tracer.Configure(cfg.OTLPTracesEndpoint, cfg.OTLPHeaders, cfg.ServiceName, cfg.TraceSampleRatio, client)
+		go tracer.Run(background, 5*time.Second)
+		slog.Info("Exporting traces", "endpoint", cfg.OTLPTracesEndpoint, "sample_ratio", cfg.TraceSampleRatio)
+	}
+	setDefaultEngine(cfg.SearchEngine)
+	prompts, err := NewPromptTemplate(cfg.PromptDir, cfg.PromptVersion, cfg.PromptFile, cfg.VerticalPrompts)
+	if err != nil {
+		fatal("Invalid prompt configuration", "error", err)
+	}
+	slog.Info("Loaded prompts", "version", prompts.Version(), "dir", cfg.PromptDir)
+	var synonyms *Synonyms
+	if cfg.SynonymsFile != "" {
+		if synonyms, err = NewSynonyms(cfg.SynonymsFile, cfg.SynonymExpansion); err != nil {
+			fatal("Invalid SYNONYMS_FILE", "error", err)
+		}
+		slog.Info("Expanding synonyms", "file", cfg.SynonymsFile, "mode", cfg.SynonymExpansion)
+	}
+	var certs *CertReloader
+	if cfg.TLSCertFile != "" {
+		if certs, err = NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			fatal("Invalid TLS_CERT_FILE or TLS_KEY_FILE", "error", err)
+		}
+	}
+	var clientCAs *ClientCAs
+	if cfg.TLSClientCAFile != "" {
+		if clientCAs, err = NewClientCAs(cfg.TLSClientCAFile, cfg.TLSClientAuth); err != nil {
+			fatal("Invalid TLS_CLIENT_CA_FILE", "error", err)
+		}
+	}
+	flags, err := NewFeatureFlags(cfg.FlagsFile)
+	if err != nil {
+		fatal("Invalid FLAGS_FILE", "error", err)
+	}
+	experiments, err := NewExperiments(cfg.ExperimentsFile, prompts, policy)
+	if err != nil {
+		fatal("Invalid EXPERIMENTS_FILE", "error", err)
+	}
+	var objects ObjectStore
+	if cfg.HistoryArchiveAfterDays > 0 || cfg.AuditArchive {
+		if cfg.ArchiveStore == "s3" {
+			objects, err = NewS3ObjectStore(cfg.ArchiveS3Endpoint, cfg.ArchiveS3Bucket, cfg.ArchiveS3Region, cfg.ArchiveS3AccessKey, cfg.ArchiveS3SecretKey, client)
+		} else {
+			objects, err = NewFileObjectStore(cfg.ArchiveDir)
+		}
+		if err != nil {
+			fatal("Invalid archive configuration", "error", err)
+		}
+	}
+	// audit is nil, recording nothing, unless a destination is configured
+	var audit *AuditLog
+	if cfg.AuditLogFile != "" || cfg.AuditSyslogAddr != "" || cfg.AuditArchive {
+		audit = NewAuditLog()
+		if cfg.AuditLogFile != "" {
+			if err := audit.UseFile(cfg.AuditLogFile); err != nil {
+				fatal("Invalid AUDIT_LOG_FILE", "error", err)
+			}
+		}
+		if cfg.AuditSyslogAddr != "" {
+			if err := audit.UseSyslog(cfg.AuditSyslogAddr); err != nil {
+				fatal("Invalid AUDIT_SYSLOG_ADDR", "error", err)
+			}
+		}
+		if cfg.AuditArchive {
+			audit.UseArchive(objects)
+			go audit.Run(background, cfg.AuditArchiveInterval)
+		}
+		defer audit.Close()
+		tenants.UseAuditLog(audit)
+		slog.Info("Audit logging enabled", "file", cfg.AuditLogFile, "syslog", cfg.AuditSyslogAddr, "archive", cfg.AuditArchive)
+	}
+	if cfg.ConfigWatchInterval > 0 {
+		watcher := NewConfigWatcher(cfg.ConfigWatchInterval)
+		watcher.UseAuditLog(audit)
+		if cfg.FlagsFile != "" {
+			watcher.Watch(cfg.FlagsFile, flags.Reload)
+		}
+		if cfg.ExperimentsFile != "" {
+			watcher.Watch(cfg.ExperimentsFile, experiments.Reload)
+		}
+		if mock != nil && cfg.LLMMockRules != "" {
+			watcher.Watch(cfg.LLMMockRules, mock.Reload)
+		}
+		if certs != nil {
+			watcher.Watch(cfg.TLSCertFile, certs.Reload)
+			watcher.Watch(cfg.TLSKeyFile, certs.Reload)
+		}
+		if clientCAs != nil {
+			watcher.Watch(cfg.TLSClientCAFile, clientCAs.Reload)
+		}
+		if cfg.TenantsFile != "" {
+			watcher.Watch(cfg.TenantsFile, func(data []byte) error { return tenants.Reload(data, cfg.TenantsFile) })
+		}
+		if cfg.PromptFile != "" {
+			watcher.Watch(cfg.PromptFile, prompts.Reload)
+		}
+		if synonyms != nil {
+			watcher.Watch(cfg.SynonymsFile, synonyms.Reload)
+		}
+		// A change to any template reloads the whole version, partials
+		// included
+		for _, file := range prompts.Files() {
+			watcher.Watch(file, func([]byte) error { return prompts.ReloadVersion() })
+		}
+		go watcher.Run(background)
+	}
+	cache := NewIntentCache(cfg.IntentCacheSize, cfg.IntentCacheTTL)
+	var results *CachingProvider
+	var provider ResultsProvider
+	if cfg.ResultsProvider == "serpapi" {
+		provider = NewSerpAPIProvider(client, cfg.SerpAPIKey)
+		var store ResultsCacheStore = NewMemoryResultsStore(cfg.ResultsCacheSize)
+		if cfg.ResultsCacheStore == "redis" {
+			redisClient, err := NewRedisClient(cfg.RedisURL)
+			if err != nil {
+				fatal("Invalid REDIS_URL", "error", err)
+			}
+			store = NewRedisResultsStore(redisClient)
+		}
+		results = NewCachingProvider(provider, store, cfg.ResultsCacheTTL, cfg.ResultsCacheStale)
+		slog.Info("Fetching results", "provider", cfg.ResultsProvider, "cache_store", cfg.ResultsCacheStore,
+			"ttl", cfg.ResultsCacheTTL, "stale_while_revalidate", cfg.ResultsCacheStale)
+	}
+	analytics := NewAnalyticsSampler(cfg.AnalyticsEnabled, cfg.AnalyticsSampleRate, cfg.AnalyticsMaxSamples)
+	handler := NewSearchHandler(keys, client, limiter, budget, history, router, policy, telemetry, analytics, prompts, cache, results, flags, cfg.OpenAIMaxTokens, cfg.HedgeDelay, cfg.IntentVersion)
+	handler.UseExperiments(experiments)
+	if cfg.PromptGuard != PromptGuardOff {
+		handler.UseGuard(NewPromptGuard(cfg.PromptGuard))
+	}
+	if synonyms != nil {
+		handler.UseSynonyms(synonyms)
+	}
+	if cfg.VoiceSearch {
+		handler.UseTranscriber(NewTranscriber(cfg.WhisperURL, cfg.WhisperModel, cfg.AudioMaxBytes))
+		slog.Info("Accepting voice queries", "whisper", cmp.Or(cfg.WhisperURL, "openai"), "model", cfg.WhisperModel)
+	}
+	if cfg.ImageSearch {
+		handler.UseImageSearch(NewImageSearch(cfg.VisionModel, cfg.ImageMaxBytes))
+		slog.Info("Accepting image queries", "model", cfg.VisionModel, "ocr", cfg.OCREngine)
+		if cfg.OCREngine != OCREngineOff {
+			handler.UseOCR(NewOCR(cfg.OCREngine, cfg.TesseractPath, cfg.TesseractLangs, cfg.TesseractMaxConcurrency))
+		}
+	}
+	var documents *DocumentIndex
+	if cfg.Documents {
+		var documentStore VectorStore
+		switch cfg.VectorStore {
+		case VectorStoreSQL:
+			store, err := NewSQLVectorStore(background, sqlHistory, cfg.EmbeddingModel)
+			if err != nil {
+				fatal("Error opening vector store", "store", cfg.VectorStore, "error", err)
+			}
+			if cfg.HistoryStore == HistoryStoreSQLite && !store.sqliteVec {
+				slog.Info("sqlite-vec not loaded, ranking document chunks in Go")
+			}
+			documentStore = store
+		case VectorStoreQdrant:
+			store := NewQdrantVectorStore(client, cfg.QdrantURL, cfg.QdrantAPIKey, cfg.QdrantCollection)
+			health.AddCheck("vector_store", store.Ping)
+			documentStore = store
+		default:
+			documentStore = NewMemoryVectorStore()
+		}
+		// Uploads and searches are refused once the budget is used up, like
+		// analyses
+		documents = NewDocumentIndex(documentStore, func(ctx context.Context, texts []string) ([][]float64, error) {
+			if err := budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+				return nil, err
+			}
+			return handler.embed(ctx, cfg.EmbeddingModel, texts)
+		}, cfg.EmbeddingModel, cfg.DocumentMaxBytes)
+		handler.UseDocuments(documents)
+		slog.Info("Indexing documents", "store", cfg.VectorStore, "embedding_model", cfg.EmbeddingModel, "max_bytes", cfg.DocumentMaxBytes)
+	}
+	handler.UseEmbeddingModel(cfg.EmbeddingModel)
+	if cfg.FewShotExamples > 0 {
+		fewShot := NewFewShotIndex(feedbackStore, func(ctx context.Context, texts []string) ([][]float64, error) {
+			return handler.embed(ctx, cfg.EmbeddingModel, texts)
+		}, cfg.FewShotExamples, cfg.FewShotMinSimilarity)
+		handler.UseFewShot(fewShot)
+		go fewShot.Run(background, cfg.FewShotRefresh)
+		slog.Info("Adding corrected examples to analyses", "examples", cfg.FewShotExamples, "embedding_model", cfg.EmbeddingModel)
+	}
+	var profiles *ClickProfiles
+	if cfg.Personalization {
+		profiles = NewClickProfiles(feedbackStore, cfg.PersonalizationWindow)
+		handler.UsePersonalization(profiles)
+		go profiles.Run(background, cfg.PersonalizationRefresh)
+		slog.Info("Personalizing results by clicks", "window", cfg.PersonalizationWindow)
+	}
+	if cfg.InstantAnswers {
+		handler.UseInstantAnswers(NewInstantAnswers(client, cfg.InstantAnswersTTL))
+		slog.Info("Answering weather and stock prompts directly", "ttl", cfg.InstantAnswersTTL)
+	}
+	var usage *UsageStats
+	if cfg.UsageAnalytics {
+		anonymizer, err := NewQueryAnonymizer(cfg.UsageAnalyticsPrivacy, cfg.UsageAnalyticsK, cfg.UsageAnalyticsHashKey)
+		if err != nil {
+			fatal("Invalid USAGE_ANALYTICS_PRIVACY", "error", err)
+		}
+		usage = NewUsageStats(cfg.UsageAnalyticsRetention, anonymizer)
+		handler.UseUsageStats(usage)
+		slog.Info("Aggregating usage analytics", "retention", cfg.UsageAnalyticsRetention, "privacy", cfg.UsageAnalyticsPrivacy)
+	}
+	if cfg.AnalysisDedup {
+		redisClient, err := NewRedisClient(cfg.RedisURL)
+		if err != nil {
+			fatal("Invalid REDIS_URL", "error", err)
+		}
+		handler.UseDeduplicator(NewAnalysisDeduplicator(redisClient, cfg.AnalysisDedupWait, cfg.RequestTimeout))
+		health.AddCheck("analysis_dedup", redisCheck(redisClient))
+		slog.Info("Sharing concurrent analyses across replicas", "wait", cfg.AnalysisDedupWait)
+	}
+	evaluator, err := NewEvaluator(handler, cfg.EvalCorpusFile)
+	if err != nil {
+		fatal("Invalid EVAL_CORPUS_FILE", "error", err)
+	}
+	var shadow *ShadowComparator
+	if cfg.ShadowModel != "" || cfg.ShadowPromptVersion != "" {
+		var candidate *PromptTemplate
+		if cfg.ShadowPromptVersion != "" {
+			if candidate, err = prompts.WithVersion(cfg.ShadowPromptVersion); err != nil {
+				fatal("Invalid SHADOW_PROMPT_VERSION", "error", err)
+			}
+		}
+		if cfg.ShadowModel != "" {
+			if err := policy.Validate(AnalyzeOptions{Model: cfg.ShadowModel}); err != nil {
+				fatal("Invalid SHADOW_MODEL", "error", err)
+			}
+		}
+		shadow = NewShadowComparator(handler.analyzePromptWithOpenAI, limiter, budget, candidate, cfg.ShadowModel, cfg.ShadowSampleRate, cfg.ShadowMaxConcurrency)
+		handler.UseShadow(shadow)
+		slog.Info("Comparing analyses with a shadow candidate", "model", cfg.ShadowModel, "prompt_version", cfg.ShadowPromptVersion, "sample_rate", cfg.ShadowSampleRate)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", handler.handleSearch)
+	mux.HandleFunc("/v1/search/audio", handler.handleSearchAudio)
+	mux.HandleFunc("/v1/search/image", handler.handleSearchImage)
+	if documents != nil {
+		mux.HandleFunc("/v1/documents", documents.handleDocuments)
+		mux.HandleFunc("/v1/documents/search", documents.handleSearch)
+		mux.HandleFunc("/v1/documents/{id}", documents.handleDocument)
+		mux.HandleFunc("/v1/admin/documents", requireAdmin(cfg.AdminAPIKey, documents.handleShared(tenants)))
+		mux.HandleFunc("/v1/admin/documents/{id}", requireAdmin(cfg.AdminAPIKey, documents.handleShared(tenants)))
+	}
+	mux.HandleFunc("/s", handler.handleResultsPage)
+	mux.HandleFunc("/v1/compare", handler.handleCompare)
+	mux.HandleFunc("/v1/embeddings", handler.handleEmbeddings)
+	mux.HandleFunc("/v1/tools", handler.handleTools)
+	mux.HandleFunc("/v1/tools/call", handler.handleToolCall)
+	mux.HandleFunc("/v1/assist/conversation", handler.handleAssist)
+	mux.HandleFunc("/v1/history/search", history.handleSearch)
+	mux.HandleFunc("/v1/history", history.handleList)
+	mux.HandleFunc("/v1/history/{id}", history.handleEntry)
+	mux.HandleFunc("/v1/history/export", history.handleExport)
+	mux.HandleFunc("/v1/history/settings", history.handleSettings)
+	feedback := NewFeedbackService(feedbackStore, historyStore, prompts, experiments)
+	mux.HandleFunc("/v1/feedback/click", feedback.handleClick)
+	mux.HandleFunc("/v1/admin/feedback/clicks", requireAdmin(cfg.AdminAPIKey, feedback.handleAdminClicks))
+	mux.HandleFunc("/v1/feedback/intent", feedback.handleIntent)
+	mux.HandleFunc("/v1/admin/feedback/corrections", requireAdmin(cfg.AdminAPIKey, feedback.handleCorrections))
+	mux.HandleFunc("/v1/admin/feedback/corrections/{id}", requireAdmin(cfg.AdminAPIKey, feedback.handleApproval))
+	if handler.fewShot != nil {
+		feedback.UseFewShot(handler.fewShot)
+	}
+	links := NewShortLinkService(shortLinkStore, historyStore, cfg.PublicURL)
+	mux.HandleFunc("/v1/links", links.handleLinks)
+	mux.HandleFunc("/l/{id}", links.handleRedirect)
+	mux.HandleFunc("/v1/admin/feedback/dataset", requireAdmin(cfg.AdminAPIKey, feedback.handleDataset))
+	// Metrics name tenants, keys and prompt types, for operators only
+	mux.HandleFunc("/metrics", requireAdmin(cfg.AdminAPIKey, metricsRegistry.ServeHTTP))
+	mux.HandleFunc("/v1/analytics/collected", analytics.handleTransparency)
+	if usage != nil {
+		mux.HandleFunc("/v1/analytics", usage.handleTenant)
+		mux.HandleFunc("/v1/admin/analytics/usage", requireAdmin(cfg.AdminAPIKey, usage.handleAdmin))
+	}
+
+	deadLetters := NewDeadLetterQueue()
+	scheduler := NewJobScheduler(cfg.BatchWindows, cfg.BatchTimezone, limiter, budget, deadLetters, cfg.SchedulerInterval)
+	go scheduler.Run(background)
+	mux.HandleFunc("/v1/admin/scheduler", requireAdmin(cfg.AdminAPIKey, scheduler.handlePlan))
+	mux.HandleFunc("/v1/admin/dead-letters", requireAdmin(cfg.AdminAPIKey, scheduler.handleDeadLetters))
+	mux.HandleFunc("/v1/admin/eval", requireAdmin(cfg.AdminAPIKey, evaluator.handleEval))
+	mux.HandleFunc("/v1/admin/analytics", requireAdmin(cfg.AdminAPIKey, analytics.handleAdmin))
+	mux.HandleFunc("/v1/admin/keys", requireAdmin(cfg.AdminAPIKey, keys.handleStatus))
+	NewAdminHandler(cfg, keys, cache, prompts).Register(mux, cfg.AdminAPIKey)
+	mux.HandleFunc("/v1/admin/flags", requireAdmin(cfg.AdminAPIKey, flags.handleAdmin))
+	mux.HandleFunc("/v1/flags", flags.handleEvaluated)
+	mux.HandleFunc("/v1/admin/experiments", requireAdmin(cfg.AdminAPIKey, experiments.handleAdmin))
+	mux.HandleFunc("/v1/admin/analytics/experiments", requireAdmin(cfg.AdminAPIKey, experiments.handleResults))
+	if shadow != nil {
+		mux.HandleFunc("/v1/admin/shadow", requireAdmin(cfg.AdminAPIKey, shadow.handleAdmin))
+	}
 
-	handler := NewSearchHandler(OPENAI_API_KEY)
-	http.HandleFunc("/search", handler.handleSearch)
+	apiKeys, err := NewAPIKeyStore(cfg.APIKeysFile, cfg.APIKeyWebhookURL, cfg.APIKeyExpiryWarning, cfg.APIKeyRotationGrace, client)
+	if err != nil {
+		fatal("Invalid API_KEYS_FILE", "error", err)
+	}
+	tenants.UseKeyStore(apiKeys)
+	var replay ReplayCache = NewMemoryReplayCache()
+	if cfg.RequestSigningReplayStore == "redis" {
+		redisClient, err := NewRedisClient(cfg.RedisURL)
+		if err != nil {
+			fatal("Invalid REDIS_URL", "error", err)
+		}
+		replay = NewRedisReplayCache(redisClient)
+		health.AddCheck("replay_store", redisCheck(redisClient))
+	}
+	tenants.UseSigner(NewRequestSigner(cfg.RequestSigningMaxSkew, replay))
+	go apiKeys.Run(background, time.Minute)
+	NewAPIKeyAdmin(apiKeys, tenants).Register(mux, cfg.AdminAPIKey)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if cfg.HistoryArchiveAfterDays > 0 {
+		archiver := NewHistoryArchiver(historyStore, objects, time.Duration(cfg.HistoryArchiveAfterDays)*24*time.Hour)
+		go archiver.Schedule(background, scheduler, cfg.ArchiveInterval)
+		mux.HandleFunc("/v1/admin/history/rehydrate", requireAdmin(cfg.AdminAPIKey, archiver.handleRehydrate))
+		slog.Info("Archiving history", "after_days", cfg.HistoryArchiveAfterDays, "store", cfg.ArchiveStore)
 	}
 
-	log.Printf("Starting server on http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	janitor := NewRetentionJanitor(historyStore, objects, deadLetters, analytics,
+		time.Duration(cfg.HistoryRetentionDays)*24*time.Hour, time.Duration(cfg.LogRetentionDays)*24*time.Hour)
+	janitor.AddEraser("feedback", feedbackStore.DeleteAllOwned)
+	janitor.AddPurger("feedback", feedbackStore.PurgeBefore)
+	janitor.AddEraser("short_links", shortLinkStore.DeleteAllOwned)
+	janitor.AddPurger("short_links", shortLinkStore.PurgeBefore)
+	if documents != nil {
+		janitor.AddEraser("documents", documents.DeleteAllOwned)
 	}
+	if profiles != nil {
+		janitor.AddEraser("personalization", profiles.DeleteAllOwned)
+	}
+	if handler.fewShot != nil {
+		janitor.AddEraser("few_shot_examples", handler.fewShot.DeleteAllOwned)
+	}
+	mux.HandleFunc("/v1/me/data", janitor.handleEraseUser)
+	if cfg.HistoryRetentionDays > 0 || cfg.LogRetentionDays > 0 {
+		go janitor.Run(background, cfg.RetentionInterval)
+		slog.Info("Enforcing data retention", "history_days", cfg.HistoryRetentionDays, "log_days", cfg.LogRetentionDays)
+	}
+
+	warmup := NewWarmup(handler, history, tenants, scheduler)
+	mux.HandleFunc("/v1/admin/warmup", requireAdmin(cfg.AdminAPIKey, warmup.handleImport))
+
+	triggers := NewTriggerFeed()
+	NewZapierHandler(handler, tenants, triggers).Register(mux)
+	janitor.AddEraser("trigger_feed", triggers.DeleteAllOwned)
+
+	if provider != nil {
+		smtpConfig := SMTPConfig{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+		// Webhook URLs come from users, so they may only reach public addresses
+		saved, err := NewSavedSearches(cfg.SavedSearchesFile, handler, provider, scheduler, triggers, newPublicClient(cfg.OutboundTimeout), smtpConfig)
+		if err != nil {
+			fatal("Invalid SAVED_SEARCHES_FILE", "error", err)
+		}
+		go saved.Run(background, time.Minute)
+		janitor.AddEraser("saved_searches", saved.DeleteAllOwned)
+		mux.HandleFunc("/v1/saved-searches", saved.handleSavedSearches)
+		mux.HandleFunc("/v1/saved-searches/{id}", saved.handleSavedSearch)
+		mux.HandleFunc("/v1/saved-searches/{id}/verify", saved.handleVerify)
+	}
+
+	if documents != nil {
+		crawler, err := NewCrawler(cfg.CrawlSourcesFile, documents, client, scheduler, tenants, cfg.CrawlUserAgent, cfg.CrawlMaxPages, cfg.CrawlDelay)
+		if err != nil {
+			fatal("Invalid CRAWL_SOURCES_FILE", "error", err)
+		}
+		go crawler.Run(background, time.Minute)
+		mux.HandleFunc("/v1/admin/crawls", requireAdmin(cfg.AdminAPIKey, crawler.handleSources))
+		mux.HandleFunc("/v1/admin/crawls/freshness", requireAdmin(cfg.AdminAPIKey, crawler.handleFreshness))
+		mux.HandleFunc("/v1/admin/crawls/{id}", requireAdmin(cfg.AdminAPIKey, crawler.handleSource))
+		mux.HandleFunc("/v1/admin/crawls/{id}/run", requireAdmin(cfg.AdminAPIKey, crawler.handleRun))
+	}
+
+	var root http.Handler = withRequestTimeout(cfg.RequestTimeout, tenants.Middleware(mux))
+	if cfg.RateLimitEnabled {
+		var store RateLimitStore
+		switch cfg.RateLimitStore {
+		case "redis":
+			client, err := NewRedisClient(cfg.RedisURL)
+			if err != nil {
+				fatal("Invalid REDIS_URL", "error", err)
+			}
+			store = NewRedisRateLimitStore(client)
+			health.AddCheck("rate_limit_store", redisCheck(client))
+		default:
+			store = NewMemoryRateLimitStore()
+		}
+		limiter := NewRateLimiter(store, cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.TrustedProxies, func(key string) bool {
+			_, ok := tenants.Lookup(key)
+			return ok
+		})
+		root = limiter.Middleware(root)
+		slog.Info("Rate limiting enabled", "rps", cfg.RateLimitRPS, "burst", cfg.RateLimitBurst, "store", cfg.RateLimitStore)
+	}
+	if cfg.AbuseDetection {
+		abuse := NewAbuseDetector(cfg.AbuseWindow, cfg.AbuseBurst, cfg.AbuseDuplicatePrompts, cfg.AbuseBanAfter, cfg.AbuseBanDuration, cfg.TrustedProxies)
+		abuse.UseAuditLog(audit)
+		abuse.UseAdminKey(cfg.AdminAPIKey)
+		handler.UseAbuseDetector(abuse)
+		go abuse.Run(background)
+		mux.HandleFunc("/v1/admin/abuse", requireAdmin(cfg.AdminAPIKey, abuse.handleAdmin))
+		mux.HandleFunc("/v1/admin/abuse/unban", requireAdmin(cfg.AdminAPIKey, abuse.handleUnban))
+		root = abuse.Middleware(root)
+		slog.Info("Abuse detection enabled", "window", cfg.AbuseWindow, "burst", cfg.AbuseBurst, "duplicate_prompts", cfg.AbuseDuplicatePrompts)
+	}
+	if len(cfg.IPAllowlist) > 0 || len(cfg.IPDenylist) > 0 {
+		root = NewIPAccessList(cfg.IPAllowlist, cfg.IPDenylist, cfg.TrustedProxies).Middleware(root)
+		slog.Info("Filtering clients by IP", "allowlist", len(cfg.IPAllowlist), "denylist", len(cfg.IPDenylist))
+	}
+	root = tracer.Middleware(withRequestLog(audit.Middleware(root)))
+
+	// Probes skip rate limiting, tenants, tracing and the access log
+	probes := http.NewServeMux()
+	probes.HandleFunc("/healthz", health.handleLive)
+	probes.HandleFunc("/readyz", health.handleReady)
+	probes.HandleFunc("/version", health.handleVersion)
+	if cfg.ServeFrontend {
+		fsys, err := embeddedFrontend()
+		if cfg.FrontendDir != "" {
+			fsys, err = os.DirFS(cfg.FrontendDir), nil
+		}
+		if err != nil {
+			fatal("Error loading the frontend", "error", err)
+		}
+		frontend, err := NewFrontendHandler(fsys)
+		if err != nil {
+			fatal("Error loading the frontend", "error", err)
+		}
+		root = withFrontend(frontend, mux, root)
+		slog.Info("Serving the frontend", "dir", cfg.FrontendDir, "files", len(frontend.files))
+	}
+	probes.Handle("/", root)
+	root = withCORS(cfg.CORSAllowedOrigins, withErrorLanguage(probes))
+	if cfg.CompressionEnabled {
+		root = withCompression(cfg.CompressionMinSize, root)
+	}
+
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: root, ReadHeaderTimeout: 10 * time.Second}
+	var redirect http.Handler
+	if cfg.HTTPRedirectPort != "" {
+		redirect = redirectToHTTPS(cfg.Port)
+	}
+	switch {
+	case certs != nil:
+		srv.TLSConfig = certs.TLSConfig()
+	case len(cfg.TLSAutocertHosts) > 0:
+		var acme http.Handler
+		srv.TLSConfig, acme, err = newAutocert(cfg.TLSAutocertHosts, cfg.TLSAutocertCacheDir, cfg.TLSAutocertEmail, redirectToHTTPS(cfg.Port))
+		if err != nil {
+			fatal("Invalid TLS_AUTOCERT_HOSTS", "error", err)
+		}
+		// Challenges are answered over TLS-ALPN on PORT already, HTTP-01 only
+		// when the redirect port is open
+		if redirect != nil {
+			redirect = acme
+		}
+		slog.Info("Using Let's Encrypt certificates", "hosts", cfg.TLSAutocertHosts, "cache_dir", cfg.TLSAutocertCacheDir)
+	}
+	if clientCAs != nil {
+		clientCAs.Apply(srv.TLSConfig)
+		slog.Info("Authenticating clients by certificate", "ca_file", cfg.TLSClientCAFile, "mode", cfg.TLSClientAuth)
+	}
+
+	serveErr := make(chan error, 3)
+	scheme := "http"
+	if srv.TLSConfig != nil {
+		scheme = "https"
+		go func() { serveErr <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+	var redirectSrv *http.Server
+	if redirect != nil {
+		redirectSrv = &http.Server{Addr: ":" + cfg.HTTPRedirectPort, Handler: redirect, ReadHeaderTimeout: 10 * time.Second}
+		go func() { serveErr <- redirectSrv.ListenAndServe() }()
+		slog.Info("Redirecting HTTP to HTTPS", "port", cfg.HTTPRedirectPort)
+	}
+	var debugSrv *http.Server
+	if cfg.DebugAddr != "" {
+		debugSrv = &http.Server{Addr: cfg.DebugAddr, Handler: audit.Middleware(newDebugMux(cfg.AdminAPIKey)), ReadHeaderTimeout: 10 * time.Second}
+		go func() { serveErr <- debugSrv.ListenAndServe() }()
+		slog.Info("Serving debug endpoints", "addr", cfg.DebugAddr)
+	}
+	health.SetReady(true)
+	slog.Info("Starting server", "addr", scheme+"://localhost:"+cfg.Port)
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err := <-serveErr:
+		fatal("Server stopped", "error", err)
+	case <-signals.Done():
+	}
+
+	// Fail readiness first so load balancers stop sending traffic, then stop
+	// accepting connections and let in-flight searches finish
+	slog.Info("Shutting down", "drain_timeout", cfg.ShutdownTimeout)
+	health.SetReady(false)
+	time.Sleep(cfg.ShutdownDelay)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelDrain()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("Drain timeout reached, closing remaining connections", "error", err)
+		srv.Close()
+	}
+	if redirectSrv != nil {
+		redirectSrv.Close()
+	}
+	if debugSrv != nil {
+		debugSrv.Close()
+	}
+
+	stopBackground()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFlush()
+	telemetry.Flush(flushCtx)
+	tracer.Flush(flushCtx)
+	audit.Flush(flushCtx)
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A small Prometheus-compatible metrics registry. Metrics are declared as
+// package variables next to the code that updates them and exposed on /metrics
+// in the text exposition format.
+
+var metricsRegistry = NewMetricsRegistry()
+
+// defaultLatencyBuckets suit LLM round trips, in seconds
+var defaultLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32}
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// MetricsRegistry holds all metrics exposed by the server
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (reg *MetricsRegistry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// Counter declares a monotonically increasing counter with the given label names
+func (reg *MetricsRegistry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// Gauge declares a value that can go up and down
+func (reg *MetricsRegistry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}}
+	reg.register(g)
+	return g
+}
+
+// Histogram declares a histogram with the given upper bounds
+func (reg *MetricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	reg.register(h)
+	return h
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (reg *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	metrics := append([]metric{}, reg.metrics...)
+	reg.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64 // by encoded label set
+}
+
+// Inc adds one to the series identified by the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series identified by the label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := encodeLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.writeAs(b, "counter")
+}
+
+func (c *CounterVec) writeAs(b *strings.Builder, kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, kind)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	CounterVec
+}
+
+// Set replaces the value of the series identified by the label values
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	key := encodeLabels(g.labels, labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(b *strings.Builder) {
+	g.writeAs(b, "gauge")
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+// Observe records v in the series identified by the label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := encodeLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			le := encodeLabels(append(append([]string{}, h.labels...), "le"), append(append([]string{}, s.labelValues...), formatFloat(upper)))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, le, cumulative)
+		}
+		le := encodeLabels(append(append([]string{}, h.labels...), "le"), append(append([]string{}, s.labelValues...), "+Inf"))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, le, s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// encodeLabels renders {a="x",b="y"}, which doubles as the series key
+func encodeLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, v)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
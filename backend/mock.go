@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// LLM providers
+const (
+	LLMProviderOpenAI = "openai"
+	LLMProviderMock   = "mock"
+)
+
+// mockEmbeddingDims is the size of the mock provider's embeddings
+const mockEmbeddingDims = 64
+
+var mockAnswers = metricsRegistry.Counter("llm_mock_answers_total",
+	"Analyses answered by the mock provider, by source (rule, heuristic).", "source")
+
+// MockRule answers the prompts it matches with a canned intent. Prompt
+// matches the whole prompt, ignoring case and extra spaces; Pattern is a
+// regular expression matched anywhere in it.
+type MockRule struct {
+	Prompt  string          `json:"prompt,omitempty"`
+	Pattern string          `json:"pattern,omitempty"`
+	Intent  json.RawMessage `json:"intent"`
+
+	re     *regexp.Regexp
+	intent *SearchIntent
+}
+
+// MockTransport stands in for OpenAI: chat completions are answered from
+// the rules, the first match winning, or by the heuristic parser, and
+// embeddings are hashed bags of words, so similar prompts still get similar
+// vectors. Transcriptions read the upload as text and every image gets the
+// same query. Usage is reported as zero tokens, so nothing is spent. Calls
+// to other hosts go through unchanged.
+type MockTransport struct {
+	next  http.RoundTripper
+	rules atomic.Pointer[[]*MockRule]
+}
+
+// NewMockTransport loads the rules from path; without rules every prompt
+// goes to the heuristic parser
+func NewMockTransport(path string, next http.RoundTripper) (*MockTransport, error) {
+	m := &MockTransport{next: next}
+	rules := []*MockRule{}
+	m.rules.Store(&rules)
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mock rules: %v", err)
+	}
+	if err := m.Reload(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload validates new rules and swaps them in; on error the current rules
+// stay in place
+func (m *MockTransport) Reload(data []byte) error {
+	var rules []*MockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("error parsing mock rules: %v", err)
+	}
+	for i, rule := range rules {
+		if (rule.Prompt == "") == (rule.Pattern == "") {
+			return fmt.Errorf("mock rule %d needs either a prompt or a pattern", i)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("mock rule %d: invalid pattern: %v", i, err)
+			}
+			rule.re = re
+		}
+		intent, err := decodeIntentJSON(rule.Intent)
+		if err != nil {
+			return fmt.Errorf("mock rule %d: error parsing intent: %v", i, err)
+		}
+		rule.intent = intent
+	}
+	m.rules.Store(&rules)
+	return nil
+}
+
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var answer interface{}
+	var err error
+	switch req.URL.String() {
+	case OPENAI_API_URL:
+		answer, err = m.chatCompletion(req)
+	case OPENAI_EMBEDDINGS_URL:
+		answer, err = m.embeddings(req)
+	case OPENAI_TRANSCRIPTIONS_URL:
+		answer, err = m.transcription(req)
+	default:
+		return m.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if err != nil {
+		body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"message": err.Error()}})
+		return localResponse(req, http.StatusBadRequest, "application/json", string(body)), nil
+	}
+	body, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+	return localResponse(req, http.StatusOK, "application/json", string(body)), nil
+}
+
+func (m *MockTransport) chatCompletion(req *http.Request) (interface{}, error) {
+	// Content is a string, or parts for images
+	var chat struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 32<<20)).Decode(&chat); err != nil {
+		return nil, fmt.Errorf("invalid chat completion request: %v", err)
+	}
+	prompt := ""
+	var parts []visionContent
+	for _, msg := range chat.Messages {
+		if msg.Role == "user" && json.Unmarshal(msg.Content, &prompt) != nil {
+			if err := json.Unmarshal(msg.Content, &parts); err != nil {
+				return nil, fmt.Errorf("invalid chat completion message: %v", err)
+			}
+		}
+	}
+	var content string
+	var err error
+	if parts != nil {
+		content, err = mockImageDescription()
+	} else {
+		content, err = analyzerAnswer(m.match(prompt))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"object": "chat.completion",
+		"model":  chat.Model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       map[string]string{"role": "assistant", "content": content},
+			"finish_reason": "stop",
+		}},
+		"usage": map[string]int{"prompt_tokens": 0, "completion_tokens": 0},
+	}, nil
+}
+
+// match returns the intent of the first rule matching prompt, or the
+// heuristic parser's
+func (m *MockTransport) match(prompt string) *SearchIntent {
+	normalized := normalizedText(prompt)
+	for _, rule := range *m.rules.Load() {
+		if (rule.re != nil && rule.re.MatchString(prompt)) || (rule.Prompt != "" && normalizedText(rule.Prompt) == normalized) {
+			mockAnswers.Inc("rule")
+			return rule.intent
+		}
+	}
+	mockAnswers.Inc("heuristic")
+	return parsePromptHeuristically(prompt, time.Now())
+}
+
+func (m *MockTransport) embeddings(req *http.Request) (interface{}, error) {
+	var emb embeddingRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&emb); err != nil {
+		return nil, fmt.Errorf("invalid embeddings request: %v", err)
+	}
+	data := make([]map[string]interface{}, len(emb.Input))
+	for i, text := range emb.Input {
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": mockEmbedding(text)}
+	}
+	return map[string]interface{}{
+		"object": "list",
+		"model":  emb.Model,
+		"data":   data,
+		"usage":  map[string]int{"prompt_tokens": 0},
+	}, nil
+}
+
+// transcription "hears" the recording's own bytes when they are text, so
+// voice searches can be tested with a file holding the words to hear, and
+// a fixed query otherwise. The duration is zero, so nothing is spent.
+func (m *MockTransport) transcription(req *http.Request) (interface{}, error) {
+	if err := req.ParseMultipartForm(32 << 20); err != nil {
+		return nil, fmt.Errorf("invalid transcription request: %v", err)
+	}
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("invalid transcription request: %v", err)
+	}
+	defer file.Close()
+	audio, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	text := "mock voice query"
+	if utf8.Valid(audio) {
+		text = strings.TrimSpace(string(audio))
+	}
+	language := req.FormValue("language")
+	if language == "" {
+		language = "en"
+	}
+	return map[string]interface{}{
+		"task":     "transcribe",
+		"language": language,
+		"duration": 0,
+		"text":     text,
+	}, nil
+}
+
+// mockImageDescription answers every image with the same query
+func mockImageDescription() (string, error) {
+	answer, err := json.Marshal(map[string]string{
+		"description": "An image described by the mock provider",
+		"query":       "mock image query",
+		"text":        "Mock App v1.2\nError: mock failure at 0x7ffd5e8c in /home/user/app.go",
+	})
+	return string(answer), err
+}
+
+// mockEmbedding hashes the words of text into a normalized vector
+func mockEmbedding(text string) []float64 {
+	vector := make([]float64, mockEmbeddingDims)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		vector[h.Sum32()%mockEmbeddingDims]++
+	}
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Client certificate modes of the HTTPS listener
+const (
+	// ClientAuthRequire refuses TLS connections without a certificate signed
+	// by the client CA
+	ClientAuthRequire = "require"
+	// ClientAuthOptional verifies the certificates clients send, and lets
+	// clients without one authenticate with an API key
+	ClientAuthOptional = "optional"
+)
+
+var clientCertificates = metricsRegistry.Counter("client_certificates_total",
+	"Requests with a verified client certificate, by whether it maps to a tenant (mapped, unmapped).", "result")
+
+func validateClientAuth(mode string) error {
+	if mode != ClientAuthRequire && mode != ClientAuthOptional {
+		return fmt.Errorf("invalid client auth mode %q (want require or optional)", mode)
+	}
+	return nil
+}
+
+// ClientCAs verifies client certificates against a CA bundle, swapped when
+// the file is rotated like the server certificate
+type ClientCAs struct {
+	file string
+	mode string
+	pool atomic.Pointer[x509.CertPool]
+}
+
+func NewClientCAs(file, mode string) (*ClientCAs, error) {
+	if err := validateClientAuth(mode); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file: %v", err)
+	}
+	c := &ClientCAs{file: file, mode: mode}
+	if err := c.Reload(data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload replaces the CA bundle with data, keeping the current one when it
+// holds no certificate
+func (c *ClientCAs) Reload(data []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates in %s", c.file)
+	}
+	c.pool.Store(pool)
+	return nil
+}
+
+// Apply makes the server TLS settings ask for client certificates. ACME
+// TLS-ALPN challenges are answered without, as Let's Encrypt has none.
+func (c *ClientCAs) Apply(cfg *tls.Config) {
+	base := cfg.Clone()
+	clientAuth := tls.RequireAndVerifyClientCert
+	if c.mode == ClientAuthOptional {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, "acme-tls/1") {
+			return nil, nil
+		}
+		conf := base.Clone()
+		conf.ClientCAs = c.pool.Load()
+		conf.ClientAuth = clientAuth
+		return conf, nil
+	}
+}
+
+// certIdentities are the names a tenant's client_certificates are matched
+// against: the URI SANs (like SPIFFE IDs), DNS and email SANs, and the
+// subject's common name
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+// resolveCertificate returns the tenant the request's verified client
+// certificate maps to
+func (reg *TenantRegistry) resolveCertificate(r *http.Request) (*Tenant, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	ids := certIdentities(r.TLS.VerifiedChains[0][0])
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	for _, id := range ids {
+		if t, ok := reg.byCertificate[id]; ok {
+			clientCertificates.Inc("mapped")
+			return t, true
+		}
+	}
+	clientCertificates.Inc("unmapped")
+	return nil, false
+}
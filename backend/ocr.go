@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// OCR engines
+const (
+	OCREngineOff       = "off"
+	OCREngineVision    = "vision"
+	OCREngineTesseract = "tesseract"
+)
+
+const (
+	// maxOCRPhrases is how many phrases of a screenshot go to exact_phrases
+	maxOCRPhrases = 2
+	// maxOCRPhraseWords keeps phrases short enough to still match other
+	// people's reports of the same error
+	maxOCRPhraseWords = 12
+	// maxOCRText caps the text returned to the client
+	maxOCRText = 4 << 10
+)
+
+// ocrErrorRe finds the lines of a screenshot that read like an error message
+var ocrErrorRe = regexp.MustCompile(`(?i)\b(error|exception|failed|failure|fatal|panic|denied|refused|not found|cannot|can't|unable|invalid|timed out|timeout|traceback|segmentation fault|undefined|unexpected)\b`)
+
+// volatileTokenRe matches the words of a message that differ from one
+// machine or run to the next: addresses, paths, dates, times, long numbers
+// and hashes. Quoting them would only find this very screenshot.
+var volatileTokenRe = regexp.MustCompile(`^[("'\[]*(0x[0-9a-fA-F]+|[A-Za-z]:\\\S*|~?/\S*/\S*|\d{4}-\d{2}-\d{2}\S*|\d{1,2}:\d{2}\S*|\d{5,}|[0-9a-fA-F]{12,})[)"'\],.;:]*$`)
+
+var ocrExtractions = metricsRegistry.Counter("ocr_extractions_total",
+	"Texts read from images, by engine and result (phrases, no_phrases, error).", "engine", "result")
+
+// OCR reads the text in screenshots, so the exact words of an error message
+// can be searched for
+type OCR struct {
+	engine string
+	// tesseract is the tesseract binary, langs its -l languages
+	tesseract string
+	langs     string
+	// slots bounds the tesseract processes running at once
+	slots chan struct{}
+}
+
+// NewOCR runs at most maxConcurrent tesseract processes at a time
+func NewOCR(engine, tesseract, langs string, maxConcurrent int) *OCR {
+	return &OCR{engine: engine, tesseract: tesseract, langs: langs, slots: make(chan struct{}, maxConcurrent)}
+}
+
+func validateOCREngine(engine string) error {
+	switch engine {
+	case OCREngineOff, OCREngineVision, OCREngineTesseract:
+		return nil
+	}
+	return fmt.Errorf("unknown OCR engine %q", engine)
+}
+
+// UseOCR adds the text of screenshots to image queries
+func (h *SearchHandler) UseOCR(ocr *OCR) {
+	h.ocr = ocr
+}
+
+// Extract returns the text in the image. The vision engine's is the text the
+// vision model read along with the description, at no extra cost.
+func (o *OCR) Extract(ctx context.Context, image []byte, description *ImageDescription) (string, error) {
+	if o.engine == OCREngineTesseract {
+		return o.runTesseract(ctx, image)
+	}
+	return description.Text, nil
+}
+
+func (o *OCR) runTesseract(ctx context.Context, image []byte) (string, error) {
+	ctx, span := tracer.Start(ctx, "ocr.tesseract", SpanKindInternal)
+	defer span.End()
+	// Each read is a process of its own, a burst of image queries must not
+	// start one per request
+	select {
+	case o.slots <- struct{}{}:
+		defer func() { <-o.slots }()
+	case <-ctx.Done():
+		span.RecordError(ctx.Err())
+		return "", fmt.Errorf("error waiting for tesseract: %v", ctx.Err())
+	}
+	cmd := exec.CommandContext(ctx, o.tesseract, "stdin", "stdout", "-l", o.langs)
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		span.RecordError(err)
+		return "", fmt.Errorf("error running tesseract: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// ocrPhrases picks the phrases of the text worth searching for verbatim:
+// the lines that read like errors or, without any, the longest line. Each is
+// cut down to its longest run of words that aren't volatile.
+func ocrPhrases(text string) []string {
+	var errorLines, otherLines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(strings.ReplaceAll(stripInvisible(line), `"`, "")), " ")
+		if line == "" {
+			continue
+		}
+		if ocrErrorRe.MatchString(line) {
+			errorLines = append(errorLines, line)
+		} else {
+			otherLines = append(otherLines, line)
+		}
+	}
+	candidates := errorLines
+	if len(candidates) == 0 && len(otherLines) > 0 {
+		longest := slices.MaxFunc(otherLines, func(a, b string) int {
+			return len(strings.Fields(a)) - len(strings.Fields(b))
+		})
+		candidates = []string{longest}
+	}
+
+	var phrases []string
+	for _, line := range candidates {
+		phrase := stablePhrase(strings.Fields(line))
+		if len(strings.Fields(phrase)) < 2 || slices.Contains(phrases, phrase) {
+			continue
+		}
+		if phrases = append(phrases, phrase); len(phrases) == maxOCRPhrases {
+			break
+		}
+	}
+	return phrases
+}
+
+// stablePhrase returns the longest run of words without a volatile one, at
+// most maxOCRPhraseWords long
+func stablePhrase(words []string) string {
+	var best []string
+	start := 0
+	for i := 0; i <= len(words); i++ {
+		if i < len(words) && !volatileTokenRe.MatchString(words[i]) {
+			continue
+		}
+		if i-start > len(best) {
+			best = words[start:i]
+		}
+		start = i + 1
+	}
+	if len(best) > maxOCRPhraseWords {
+		best = best[:maxOCRPhraseWords]
+	}
+	return strings.TrimRight(strings.Join(best, " "), ",.;:")
+}
+
+// withExactPhrases returns a copy of the result whose intent also has the
+// phrases, leaving cached analyses untouched
+func withExactPhrases(result *AnalysisResult, phrases []string) *AnalysisResult {
+	intent := *result.Intent
+	intent.ExactPhrases = slices.Clone(intent.ExactPhrases)
+	for _, phrase := range phrases {
+		if !slices.ContainsFunc(intent.ExactPhrases, func(p string) bool { return strings.EqualFold(p, phrase) }) {
+			intent.ExactPhrases = append(intent.ExactPhrases, phrase)
+		}
+	}
+	out := *result
+	out.Intent = cleanIntent(&intent)
+	return &out
+}
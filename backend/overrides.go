@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultTemperature keeps the analysis output consistent
+const defaultTemperature = 0.3
+
+// AnalyzeOptions are per-request overrides of the analysis settings
+type AnalyzeOptions struct {
+	// Model replaces the routed model when set
+	Model string `json:"model,omitempty"`
+	// Temperature replaces the default temperature when set
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Locale (e.g. en-US) is passed to the prompt templates and the results
+	// provider
+	Locale string `json:"locale,omitempty"`
+	// ConfirmPII lets personal data in the prompt go to OpenAI when the
+	// PII mode asks for confirmation
+	ConfirmPII bool `json:"confirm_pii,omitempty"`
+}
+
+var localeRe = regexp.MustCompile(`^[A-Za-z]{2,3}(?:-[A-Za-z0-9]{2,8})*$`)
+
+// ModelPolicy decides which overrides clients may use
+type ModelPolicy struct {
+	allowed        map[string]bool
+	maxTemperature float64
+}
+
+func NewModelPolicy(allowedModels []string, maxTemperature float64) *ModelPolicy {
+	p := &ModelPolicy{allowed: make(map[string]bool), maxTemperature: maxTemperature}
+	for _, m := range allowedModels {
+		if m = strings.TrimSpace(m); m != "" {
+			p.allowed[m] = true
+		}
+	}
+	return p
+}
+
+// Validate rejects models outside the allowlist, out of range temperatures
+// and malformed locales, which end up in the system prompt
+func (p *ModelPolicy) Validate(opts AnalyzeOptions) error {
+	if opts.Locale != "" && (len(opts.Locale) > 35 || !localeRe.MatchString(opts.Locale)) {
+		return fmt.Errorf("locale must be a language tag like en-US")
+	}
+	if opts.Model != "" && !p.allowed[opts.Model] {
+		return fmt.Errorf("model %q is not allowed, use one of: %s", opts.Model, strings.Join(p.Models(), ", "))
+	}
+	if t := opts.Temperature; t != nil && (*t < 0 || *t > p.maxTemperature) {
+		return fmt.Errorf("temperature must be between 0 and %g", p.maxTemperature)
+	}
+	return nil
+}
+
+// Models lists the allowed models, sorted
+func (p *ModelPolicy) Models() []string {
+	models := make([]string, 0, len(p.allowed))
+	for m := range p.allowed {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+	return models
+}
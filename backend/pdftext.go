@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxPDFDecodedBytes caps what the streams of one document inflate to, all
+// of them together, against zip bombs
+const maxPDFDecodedBytes = 64 << 20
+
+var errPDFTooLarge = fmt.Errorf("the PDF's streams decompress to more than %d bytes", maxPDFDecodedBytes)
+
+var (
+	pdfObjRe       = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfRefRe       = regexp.MustCompile(`^\s*(\d+)\s+\d+\s+R`)
+	pdfFontDictRe  = regexp.MustCompile(`/Font\s*<<((?:[^<>]|<<[^<>]*>>)*)>>`)
+	pdfFontRefRe   = regexp.MustCompile(`/Font\s+(\d+)\s+\d+\s+R`)
+	pdfNamedRefRe  = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R`)
+	pdfToUnicodeRe = regexp.MustCompile(`/ToUnicode\s+(\d+)\s+\d+\s+R`)
+	pdfRootRe      = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+	pdfArrayRe     = regexp.MustCompile(`^\s*\[([^\]]*)\]`)
+	pdfIntRe       = regexp.MustCompile(`/(N|First)\s+(\d+)`)
+)
+
+// pdfObject is an object of the file: its dictionary (or value) and its
+// stream as stored, nil when it has none
+type pdfObject struct {
+	dict string
+	raw  []byte
+	// stream is raw decoded, nil when its filter isn't supported; it is
+	// only decoded once needed
+	stream  []byte
+	decoded bool
+}
+
+// pdfCMap maps character codes of a font to text, from its ToUnicode CMap
+type pdfCMap struct {
+	// width is the code length in bytes, 1 or 2
+	width int
+	codes map[uint32]string
+}
+
+// pdfFile is the objects of a file. Streams are only inflated when text is
+// read from them: page contents, object streams holding objects the text
+// needs, and the ToUnicode CMaps of the pages' fonts. Images, embedded fonts
+// and anything no page refers to stay compressed.
+type pdfFile struct {
+	objects map[int]*pdfObject
+	// objStms are the object streams not unpacked yet, by object number
+	objStms []*pdfObject
+	cmaps   map[int]*pdfCMap
+	// budget is what streams may still inflate to; err is set once it's spent
+	budget int
+	err    error
+}
+
+// pdfPage is a page object with the resources it has or inherits
+type pdfPage struct {
+	obj       *pdfObject
+	resources string
+}
+
+// pdfText extracts the text of a PDF, page by page. It reads uncompressed
+// and Flate streams, object streams, and fonts with a ToUnicode CMap or a
+// single-byte encoding, which covers what word processors and browsers
+// write; scanned pages have no text to find, and encrypted files are
+// refused.
+func pdfText(data []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF-")) {
+		return "", errors.New("not a PDF file")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", errors.New("encrypted PDFs are not supported")
+	}
+	f := readPDFObjects(data)
+	if len(f.objects) == 0 && len(f.objStms) == 0 {
+		return "", errors.New("no objects found, the file may be damaged")
+	}
+
+	var text strings.Builder
+	for _, page := range f.pages(data) {
+		cmaps := f.fonts(page.resources)
+		for _, id := range pdfRefs(pdfValue(page.obj.dict, "/Contents")) {
+			if content := f.stream(f.object(id)); content != nil {
+				text.WriteString(pdfContentText(content, cmaps))
+				text.WriteString("\n")
+			}
+		}
+		text.WriteString("\n")
+		if f.err != nil {
+			return "", f.err
+		}
+	}
+	return text.String(), f.err
+}
+
+// readPDFObjects indexes the objects of the file by number. Later
+// definitions win, like incremental updates; objects packed in object
+// streams are found by object once needed.
+func readPDFObjects(data []byte) *pdfFile {
+	f := &pdfFile{objects: make(map[int]*pdfObject), cmaps: make(map[int]*pdfCMap), budget: maxPDFDecodedBytes}
+	locs := pdfObjRe.FindAllSubmatchIndex(data, -1)
+	for i, loc := range locs {
+		end := len(data)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		body := data[loc[1]:end]
+		if j := bytes.LastIndex(body, []byte("endobj")); j >= 0 {
+			body = body[:j]
+		}
+		obj := &pdfObject{dict: string(body)}
+		if j := bytes.Index(body, []byte("stream")); j >= 0 && bytes.Contains(body[:j], []byte("<<")) {
+			obj.dict = string(body[:j])
+			raw := body[j+len("stream"):]
+			raw = bytes.TrimPrefix(bytes.TrimPrefix(raw, []byte("\r")), []byte("\n"))
+			if k := bytes.LastIndex(raw, []byte("endstream")); k >= 0 {
+				raw = raw[:k]
+			}
+			obj.raw = raw
+		}
+		f.objects[atoi(string(data[loc[2]:loc[3]]))] = obj
+	}
+
+	ids := make([]int, 0)
+	for id, obj := range f.objects {
+		if obj.raw != nil && strings.Contains(obj.dict, "/ObjStm") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		f.objStms = append(f.objStms, f.objects[id])
+	}
+	return f
+}
+
+// object returns an object by number, unpacking object streams until it
+// turns up; nil when the file doesn't have it
+func (f *pdfFile) object(id int) *pdfObject {
+	for {
+		if obj, ok := f.objects[id]; ok {
+			return obj
+		}
+		if len(f.objStms) == 0 || f.err != nil {
+			return nil
+		}
+		next := f.objStms[0]
+		f.objStms = f.objStms[1:]
+		f.unpack(next)
+	}
+}
+
+// unpack adds the objects of an object stream, unless the file defines them
+// outside of it
+func (f *pdfFile) unpack(obj *pdfObject) {
+	stream := f.stream(obj)
+	if stream == nil {
+		return
+	}
+	var n, first int
+	for _, m := range pdfIntRe.FindAllStringSubmatch(obj.dict, -1) {
+		if m[1] == "N" {
+			n = atoi(m[2])
+		} else {
+			first = atoi(m[2])
+		}
+	}
+	if first > len(stream) {
+		return
+	}
+	header := strings.Fields(string(stream[:first]))
+	for i := 0; i < n && 2*i+1 < len(header); i++ {
+		start := first + atoi(header[2*i+1])
+		end := len(stream)
+		if 2*i+3 < len(header) {
+			end = first + atoi(header[2*i+3])
+		}
+		if start < 0 || start > end || end > len(stream) {
+			break
+		}
+		id := atoi(header[2*i])
+		if _, ok := f.objects[id]; !ok {
+			f.objects[id] = &pdfObject{dict: string(stream[start:end])}
+		}
+	}
+}
+
+// stream returns the decoded stream of an object, decoding it the first
+// time; nil for nil objects, objects without a stream and unsupported filters
+func (f *pdfFile) stream(obj *pdfObject) []byte {
+	if obj == nil || obj.raw == nil {
+		return nil
+	}
+	if !obj.decoded {
+		obj.decoded = true
+		obj.stream = f.decode(obj.dict, obj.raw)
+	}
+	return obj.stream
+}
+
+// decode undoes the stream's filter, charging what it inflates to the
+// budget; only Flate is supported, the others are images and fonts that
+// have no text to give
+func (f *pdfFile) decode(dict string, raw []byte) []byte {
+	filter := pdfValue(dict, "/Filter")
+	switch {
+	case filter == "":
+		return raw
+	case strings.Contains(filter, "/FlateDecode") && !strings.Contains(strings.ReplaceAll(filter, "/FlateDecode", ""), "/"):
+		if f.err != nil {
+			return nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, int64(f.budget)+1))
+		if len(out) > f.budget {
+			f.err = errPDFTooLarge
+			return nil
+		}
+		f.budget -= len(out)
+		// Truncated streams are common, keep what could be read
+		if err != nil && len(out) == 0 {
+			return nil
+		}
+		return out
+	}
+	return nil
+}
+
+// pages returns the pages in reading order, from the page tree, or in file
+// order when the tree can't be walked
+func (f *pdfFile) pages(data []byte) []pdfPage {
+	var pages []pdfPage
+	seen := make(map[int]bool)
+	var walk func(id int, inherited string)
+	walk = func(id int, inherited string) {
+		obj := f.object(id)
+		if obj == nil || seen[id] {
+			return
+		}
+		seen[id] = true
+		resources := f.resources(obj.dict, inherited)
+		if kids := pdfValue(obj.dict, "/Kids"); kids != "" {
+			for _, kid := range pdfRefs(kids) {
+				walk(kid, resources)
+			}
+			return
+		}
+		if strings.Contains(obj.dict, "/Contents") {
+			pages = append(pages, pdfPage{obj: obj, resources: resources})
+		}
+	}
+	if roots := pdfRootRe.FindAllSubmatch(data, -1); len(roots) > 0 {
+		if catalog := f.object(atoi(string(roots[len(roots)-1][1]))); catalog != nil {
+			if refs := pdfRefs(pdfValue(catalog.dict, "/Pages")); len(refs) > 0 {
+				walk(refs[0], "")
+			}
+		}
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	// No usable tree: every page, by object number
+	for len(f.objStms) > 0 && f.err == nil {
+		f.unpack(f.objStms[0])
+		f.objStms = f.objStms[1:]
+	}
+	var ids []int
+	for id, obj := range f.objects {
+		if strings.Contains(obj.dict, "/Page") && !strings.Contains(obj.dict, "/Pages") && strings.Contains(obj.dict, "/Contents") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		pages = append(pages, pdfPage{obj: f.objects[id], resources: f.resources(f.objects[id].dict, "")})
+	}
+	return pages
+}
+
+// resources returns the resource dictionary of a page tree node, or the
+// one it inherits. An inline dictionary is returned with the rest of the
+// node, which is enough to find its fonts.
+func (f *pdfFile) resources(dict, inherited string) string {
+	i := strings.Index(dict, "/Resources")
+	if i < 0 {
+		return inherited
+	}
+	if refs := pdfRefs(pdfValue(dict, "/Resources")); len(refs) > 0 {
+		if obj := f.object(refs[0]); obj != nil {
+			return obj.dict
+		}
+		return inherited
+	}
+	return dict[i:]
+}
+
+// fonts returns the CMaps of the fonts in a resource dictionary, by the
+// name the page's content uses. Fonts without a ToUnicode CMap are read as
+// single-byte text.
+func (f *pdfFile) fonts(resources string) map[string]*pdfCMap {
+	var entries string
+	if m := pdfFontDictRe.FindStringSubmatch(resources); m != nil {
+		entries = m[1]
+	} else if m := pdfFontRefRe.FindStringSubmatch(resources); m != nil {
+		if fonts := f.object(atoi(m[1])); fonts != nil {
+			entries = fonts.dict
+		}
+	}
+	cmaps := make(map[string]*pdfCMap)
+	for _, m := range pdfNamedRefRe.FindAllStringSubmatch(entries, -1) {
+		font := f.object(atoi(m[2]))
+		if font == nil {
+			continue
+		}
+		ref := pdfToUnicodeRe.FindStringSubmatch(font.dict)
+		if ref == nil {
+			continue
+		}
+		id := atoi(ref[1])
+		cmap, ok := f.cmaps[id]
+		if !ok {
+			if stream := f.stream(f.object(id)); stream != nil {
+				cmap = parsePDFCMap(stream)
+			}
+			f.cmaps[id] = cmap
+		}
+		if cmap != nil {
+			cmaps[m[1]] = cmap
+		}
+	}
+	return cmaps
+}
+
+// pdfValue returns the raw value of key in a dictionary: a reference, an
+// array or a name, enough for the keys read here
+func pdfValue(dict, key string) string {
+	i := strings.Index(dict, key)
+	if i < 0 {
+		return ""
+	}
+	rest := dict[i+len(key):]
+	if m := pdfArrayRe.FindStringSubmatch(rest); m != nil {
+		return "[" + m[1] + "]"
+	}
+	if m := pdfRefRe.FindString(rest); m != "" {
+		return strings.TrimSpace(m)
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "/") {
+		if end := strings.IndexAny(rest[1:], " \t\r\n/<>[]()"); end >= 0 {
+			return rest[:end+1]
+		}
+		return rest
+	}
+	return ""
+}
+
+// pdfRefs returns the object numbers referenced in a value
+func pdfRefs(value string) []int {
+	var ids []int
+	fields := strings.Fields(strings.Trim(value, "[]"))
+	for i := 0; i+2 < len(fields); i++ {
+		if fields[i+2] == "R" {
+			ids = append(ids, atoi(fields[i]))
+			i += 2
+		}
+	}
+	return ids
+}
+
+// pdfToken is a lexical token of a content stream or CMap
+type pdfToken struct {
+	kind  byte // 's' string, 'n' number, '/' name, '[' and ']' arrays, 'o' operator
+	str   []byte
+	num   float64
+	value string
+}
+
+// pdfLexer tokenizes content streams
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func (l *pdfLexer) next() (pdfToken, bool) {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		case c == '(':
+			return pdfToken{kind: 's', str: l.literal()}, true
+		case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<', c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+			l.pos += 2
+		case c == '<':
+			return pdfToken{kind: 's', str: l.hex()}, true
+		case c == '[' || c == ']':
+			l.pos++
+			return pdfToken{kind: c}, true
+		case c == '{' || c == '}' || c == '>' || c == ')':
+			l.pos++
+		default:
+			start := l.pos
+			l.pos++
+			for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !strings.ContainsRune("()<>[]{}/%", rune(l.data[l.pos])) {
+				l.pos++
+			}
+			word := string(l.data[start:l.pos])
+			if c == '/' {
+				return pdfToken{kind: '/', value: word[1:]}, true
+			}
+			if n, err := strconv.ParseFloat(word, 64); err == nil {
+				return pdfToken{kind: 'n', num: n}, true
+			}
+			if word == "ID" {
+				l.skipInlineImage()
+			}
+			return pdfToken{kind: 'o', value: word}, true
+		}
+	}
+	return pdfToken{}, false
+}
+
+// literal reads a (string) with its escapes and balanced parentheses
+func (l *pdfLexer) literal() []byte {
+	var out []byte
+	depth := 0
+	for l.pos++; l.pos < len(l.data); l.pos++ {
+		c := l.data[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				l.pos++
+				return out
+			}
+			depth--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.data) {
+				return out
+			}
+			c = l.data[l.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// A line continuation
+				if c == '\r' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := 0
+					for k := 0; k < 3 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; k++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					l.pos--
+					c = byte(v)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// hex reads a <hex string>, an odd final digit counting as followed by 0
+func (l *pdfLexer) hex() []byte {
+	var digits []byte
+	for l.pos++; l.pos < len(l.data) && l.data[l.pos] != '>'; l.pos++ {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		v, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		out[i] = byte(v)
+	}
+	return out
+}
+
+// skipInlineImage jumps over the binary data of an inline image to its EI
+func (l *pdfLexer) skipInlineImage() {
+	for i := l.pos + 1; i+2 < len(l.data); i++ {
+		if l.data[i] == 'E' && l.data[i+1] == 'I' && isPDFSpace(l.data[i-1]) && (i+2 == len(l.data) || isPDFSpace(l.data[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+// pdfContentText runs the text operators of a content stream, writing a
+// space for gaps between words and a newline for each new line
+func pdfContentText(content []byte, cmaps map[string]*pdfCMap) string {
+	var out strings.Builder
+	var operands []pdfToken
+	var cmap *pdfCMap
+	inArray := false
+	var array []pdfToken
+	space := func() {
+		if s := out.String(); len(s) > 0 && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+			out.WriteByte(' ')
+		}
+	}
+	newline := func() {
+		if s := out.String(); len(s) > 0 && !strings.HasSuffix(s, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	show := func(s []byte) {
+		out.WriteString(decodePDFString(s, cmap))
+	}
+
+	lexer := &pdfLexer{data: content}
+	for {
+		tok, ok := lexer.next()
+		if !ok {
+			break
+		}
+		switch tok.kind {
+		case '[':
+			inArray, array = true, nil
+			continue
+		case ']':
+			inArray = false
+			operands = append(operands, pdfToken{kind: ']'})
+			continue
+		case 'o':
+		default:
+			if inArray {
+				array = append(array, tok)
+			} else {
+				operands = append(operands, tok)
+			}
+			continue
+		}
+
+		switch tok.value {
+		case "Tf":
+			if len(operands) >= 2 && operands[len(operands)-2].kind == '/' {
+				cmap = cmaps[operands[len(operands)-2].value]
+			}
+		case "Tj":
+			if len(operands) > 0 && operands[len(operands)-1].kind == 's' {
+				show(operands[len(operands)-1].str)
+			}
+		case "'", `"`:
+			newline()
+			if len(operands) > 0 && operands[len(operands)-1].kind == 's' {
+				show(operands[len(operands)-1].str)
+			}
+		case "TJ":
+			for _, t := range array {
+				switch {
+				case t.kind == 's':
+					show(t.str)
+				case t.kind == 'n' && t.num < -200:
+					// A gap of a fifth of the font size is a space
+					space()
+				}
+			}
+			array = nil
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if operands[len(operands)-1].num != 0 {
+					newline()
+				} else if operands[len(operands)-2].num > 0 {
+					space()
+				}
+			}
+		case "T*", "Tm", "ET":
+			newline()
+		}
+		operands = operands[:0]
+	}
+	return out.String()
+}
+
+// decodePDFString turns the codes of a shown string into text, through the
+// font's CMap or, without one, as single-byte Latin-1
+func decodePDFString(s []byte, cmap *pdfCMap) string {
+	if cmap == nil {
+		runes := make([]rune, len(s))
+		for i, c := range s {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+	var out strings.Builder
+	for i := 0; i+cmap.width <= len(s); i += cmap.width {
+		var code uint32
+		for _, c := range s[i : i+cmap.width] {
+			code = code<<8 | uint32(c)
+		}
+		out.WriteString(cmap.codes[code])
+	}
+	return out.String()
+}
+
+// parsePDFCMap reads the bfchar and bfrange mappings of a ToUnicode CMap
+func parsePDFCMap(data []byte) *pdfCMap {
+	cmap := &pdfCMap{width: 1, codes: make(map[uint32]string)}
+	lexer := &pdfLexer{data: data}
+	var operands []pdfToken
+	inArray := false
+	var array [][]byte
+	for {
+		tok, ok := lexer.next()
+		if !ok {
+			break
+		}
+		switch tok.kind {
+		case '[':
+			inArray, array = true, nil
+			continue
+		case ']':
+			inArray = false
+			operands = append(operands, pdfToken{kind: ']'})
+			continue
+		case 's':
+			if inArray {
+				array = append(array, tok.str)
+			} else {
+				operands = append(operands, tok)
+			}
+			continue
+		case 'o':
+		default:
+			continue
+		}
+
+		switch tok.value {
+		case "endcodespacerange":
+			if len(operands) > 0 && len(operands[0].str) == 2 {
+				cmap.width = 2
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				cmap.codes[pdfCode(operands[i].str)] = utf16BE(operands[i+1].str)
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, hi := pdfCode(operands[i].str), pdfCode(operands[i+1].str)
+				if hi < lo || hi-lo > 0xFFFF {
+					continue
+				}
+				if operands[i+2].kind == ']' {
+					for k, dst := range array {
+						cmap.codes[lo+uint32(k)] = utf16BE(dst)
+					}
+					continue
+				}
+				dst := utf16.Decode(utf16Units(operands[i+2].str))
+				for code := lo; code <= hi && len(dst) > 0; code++ {
+					cmap.codes[code] = string(dst)
+					dst[len(dst)-1]++
+				}
+			}
+		}
+		if strings.HasPrefix(tok.value, "end") || strings.HasPrefix(tok.value, "begin") {
+			operands = operands[:0]
+		}
+	}
+	return cmap
+}
+
+func pdfCode(b []byte) uint32 {
+	var code uint32
+	for _, c := range b {
+		code = code<<8 | uint32(c)
+	}
+	return code
+}
+
+func utf16Units(b []byte) []uint16 {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return units
+}
+
+func utf16BE(b []byte) string {
+	return string(utf16.Decode(utf16Units(b)))
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPDFText(t *testing.T) {
+	tests := []struct {
+		file string
+		want []string
+	}{
+		// Uncompressed, standard fonts, escapes and TJ gaps
+		{"simple.pdf", []string{"Quarterly Report\n", "Costs (mostly cloud) were flat.", "Next steps: hire two engineers.", "Café opening in May."}},
+		// Page tree in an object stream, inherited resources, ToUnicode bfrange
+		{"objstm.pdf", []string{"the annual summary\nof the board"}},
+		// Two-byte Identity-H codes, resources and fonts by reference
+		{"cidfont.pdf", []string{"Hello world\nDüsseldorf 100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/" + tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := pdfText(data)
+			if err != nil {
+				t.Fatalf("pdfText: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(text, want) {
+					t.Errorf("text %q does not contain %q", text, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPDFTextPageOrder(t *testing.T) {
+	data, err := os.ReadFile("testdata/simple.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := pdfText(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Index(text, "Quarterly") > strings.Index(text, "Next steps") {
+		t.Errorf("pages out of order: %q", text)
+	}
+}
+
+// zeroFlate is a Flate stream object inflating to n zero bytes
+func zeroFlate(id, n int) string {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	chunk := make([]byte, 1<<20)
+	for n > 0 {
+		k := min(n, len(chunk))
+		zw.Write(chunk[:k])
+		n -= k
+	}
+	zw.Close()
+	return fmt.Sprintf("%d 0 obj\n<< /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n", id, buf.Len(), buf.String())
+}
+
+// testPDF is a one page PDF showing "hello" from an uncompressed content
+// stream, with more objects appended
+func testPDF(contents string, more ...string) []byte {
+	return []byte("%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Page /Parent 2 0 R /Contents " + contents + " >>\nendobj\n" +
+		"4 0 obj\n<< /Length 20 >>\nstream\nBT (hello) Tj ET\nendstream\nendobj\n" +
+		strings.Join(more, "") +
+		"trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+}
+
+func TestPDFTextSkipsUnreferencedStreams(t *testing.T) {
+	// An image or font no page's text needs is never inflated, however
+	// large it is
+	text, err := pdfText(testPDF("4 0 R", zeroFlate(5, maxPDFDecodedBytes+1)))
+	if err != nil {
+		t.Fatalf("pdfText: %v", err)
+	}
+	if !strings.Contains(text, "hello") {
+		t.Errorf("text %q does not contain hello", text)
+	}
+}
+
+func TestPDFTextDecodedBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		streams  []string
+	}{
+		{"one stream", "[4 0 R 5 0 R]", []string{zeroFlate(5, maxPDFDecodedBytes+1)}},
+		// Each stream is small enough, all of them together aren't
+		{"all streams", "[4 0 R 5 0 R 6 0 R 7 0 R]", []string{
+			zeroFlate(5, maxPDFDecodedBytes/3+1),
+			zeroFlate(6, maxPDFDecodedBytes/3+1),
+			zeroFlate(7, maxPDFDecodedBytes/3+1),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pdfText(testPDF(tt.contents, tt.streams...))
+			if !errors.Is(err, errPDFTooLarge) {
+				t.Errorf("pdfText error = %v, want %v", err, errPDFTooLarge)
+			}
+		})
+	}
+}
+
+func TestPDFTextRefusals(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not a PDF", "hello"},
+		{"encrypted", "%PDF-1.4\n1 0 obj\n<< /Encrypt 2 0 R >>\nendobj\n"},
+		{"no objects", "%PDF-1.4\n"},
+	}
+	for _, tt := range tests {
+		if _, err := pdfText([]byte(tt.data)); err == nil {
+			t.Errorf("%s: pdfText succeeded", tt.name)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// personalizationShift is how many positions the strongest affinity
+	// moves a result; personalization reorders a page, it doesn't replace
+	// the engine's ranking
+	personalizationShift = 3
+	// personalizationPrior damps the affinity of domains with few clicks and
+	// skips, one click isn't a preference yet
+	personalizationPrior = 2
+	// siteHintAffinity is the affinity a domain needs to be suggested as a
+	// site: search, at most maxSiteHints of them
+	siteHintAffinity = 0.5
+	maxSiteHints     = 3
+	// maxImpressions bounds the searches whose result order is remembered to
+	// tell the skipped results from the clicked ones
+	maxImpressions = 50000
+	// maxDomainTerms bounds the query words remembered per domain
+	maxDomainTerms = 50
+)
+
+var (
+	personalizedSearches = metricsRegistry.Counter("personalized_searches_total",
+		"Result pages of users with a click profile, by whether their order changed (reranked, unchanged).", "result")
+	personalizationProfiles = metricsRegistry.Gauge("personalization_profiles",
+		"Users with a click profile.")
+)
+
+// clickOwner is the user a click profile belongs to
+type clickOwner struct {
+	tenantID, userID string
+}
+
+// domainAffinity is what a user's clicks tell about a domain
+type domainAffinity struct {
+	clicks, skips int
+	// terms are the words of the searches the domain was picked in
+	terms map[string]bool
+}
+
+// score is between -1 (always skipped) and 1 (always picked), closer to 0
+// the less there is to go by
+func (a *domainAffinity) score() float64 {
+	return float64(a.clicks-a.skips) / float64(a.clicks+a.skips+personalizationPrior)
+}
+
+// impression is the order of the results shown for a search
+type impression struct {
+	owner clickOwner
+	hosts []string
+}
+
+// PersonalizedSite is a domain the user often picks for searches like the
+// current one, with the search restricted to it
+type PersonalizedSite struct {
+	Site      string `json:"site"`
+	SearchURL string `json:"search_url"`
+}
+
+// ClickProfiles keeps each signed-in user's affinity to the domains of
+// their results, built from the click feedback: a click counts for the
+// domain, and the results shown above the lowest click of a search count
+// as skipped. Result orders are only remembered in memory, for the last
+// maxImpressions searches, so skips are only known for those.
+type ClickProfiles struct {
+	store  FeedbackStore
+	window time.Duration
+
+	mu       sync.RWMutex
+	profiles map[clickOwner]map[string]*domainAffinity
+
+	impressionsMu   sync.Mutex
+	impressions     map[string]*impression // by search ID
+	impressionOrder []string
+}
+
+// NewClickProfiles builds the profiles from the clicks of the last window.
+// They are empty until the first Refresh.
+func NewClickProfiles(store FeedbackStore, window time.Duration) *ClickProfiles {
+	return &ClickProfiles{
+		store:       store,
+		window:      window,
+		profiles:    make(map[clickOwner]map[string]*domainAffinity),
+		impressions: make(map[string]*impression),
+	}
+}
+
+// Shown remembers the order of the results of a user's search, to tell
+// which ones a later click passed over
+func (p *ClickProfiles) Shown(searchID, tenantID, userID string, urls []string) {
+	if searchID == "" || userID == "" || len(urls) == 0 {
+		return
+	}
+	hosts := make([]string, len(urls))
+	for i, u := range urls {
+		hosts[i] = resultHost(u)
+	}
+	p.impressionsMu.Lock()
+	defer p.impressionsMu.Unlock()
+	if _, ok := p.impressions[searchID]; !ok {
+		p.impressionOrder = append(p.impressionOrder, searchID)
+	}
+	p.impressions[searchID] = &impression{owner: clickOwner{tenantID, userID}, hosts: hosts}
+	for len(p.impressionOrder) > maxImpressions {
+		delete(p.impressions, p.impressionOrder[0])
+		p.impressionOrder = p.impressionOrder[1:]
+	}
+}
+
+// Refresh rebuilds the profiles from the clicks of the window; erased and
+// expired clicks drop out
+func (p *ClickProfiles) Refresh(ctx context.Context) error {
+	since, afterID := time.Now().Add(-p.window), ""
+	bySearch := make(map[string][]*ClickFeedback)
+	var searches []string
+	for {
+		clicks, err := p.store.ListClicks(ctx, "", since, afterID, historyExportBatch)
+		if err != nil {
+			return err
+		}
+		for _, c := range clicks {
+			if c.UserID == "" {
+				continue
+			}
+			if _, ok := bySearch[c.SearchID]; !ok {
+				searches = append(searches, c.SearchID)
+			}
+			bySearch[c.SearchID] = append(bySearch[c.SearchID], c)
+		}
+		if len(clicks) < historyExportBatch {
+			break
+		}
+		// Pages continue after the last click, by time and then ID, so
+		// any number of clicks made at the same time are all read
+		last := clicks[len(clicks)-1]
+		since, afterID = last.CreatedAt, last.ID
+	}
+
+	profiles := make(map[clickOwner]map[string]*domainAffinity)
+	affinity := func(domains map[string]*domainAffinity, host string) *domainAffinity {
+		a, ok := domains[host]
+		if !ok {
+			a = &domainAffinity{terms: make(map[string]bool)}
+			domains[host] = a
+		}
+		return a
+	}
+	p.impressionsMu.Lock()
+	defer p.impressionsMu.Unlock()
+	for _, searchID := range searches {
+		clicks := bySearch[searchID]
+		owner := clickOwner{clicks[0].TenantID, clicks[0].UserID}
+		domains, ok := profiles[owner]
+		if !ok {
+			domains = make(map[string]*domainAffinity)
+			profiles[owner] = domains
+		}
+		clicked := make(map[string]bool)
+		for _, c := range clicks {
+			host := resultHost(c.URL)
+			if host == "" {
+				continue
+			}
+			a := affinity(domains, host)
+			a.clicks++
+			clicked[host] = true
+			if c.Intent != nil {
+				for _, term := range personalizationTerms(c.Intent) {
+					if len(a.terms) < maxDomainTerms {
+						a.terms[term] = true
+					}
+				}
+			}
+		}
+		shown := p.impressions[searchID]
+		if shown == nil || shown.owner != owner {
+			continue
+		}
+		// The results above the lowest click were seen and passed over
+		deepest := -1
+		for i, host := range shown.hosts {
+			if clicked[host] {
+				deepest = i
+			}
+		}
+		skipped := make(map[string]bool)
+		for _, host := range shown.hosts[:deepest+1] {
+			if host != "" && !clicked[host] && !skipped[host] {
+				skipped[host] = true
+				affinity(domains, host).skips++
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.profiles = profiles
+	p.mu.Unlock()
+	personalizationProfiles.Set(float64(len(profiles)))
+	return nil
+}
+
+// Run refreshes the profiles every interval until ctx is cancelled
+func (p *ClickProfiles) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Refresh(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error refreshing click profiles", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// profile returns the user's domain affinities, nil when they have none
+func (p *ClickProfiles) profile(tenantID, userID string) map[string]*domainAffinity {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.profiles[clickOwner{tenantID, userID}]
+}
+
+// DeleteAllOwned forgets the user's profile and result orders, for user
+// erasure; their clicks are erased from the feedback store
+func (p *ClickProfiles) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	owner := clickOwner{tenantID, userID}
+	p.mu.Lock()
+	delete(p.profiles, owner)
+	p.mu.Unlock()
+
+	p.impressionsMu.Lock()
+	defer p.impressionsMu.Unlock()
+	n := 0
+	kept := p.impressionOrder[:0]
+	for _, searchID := range p.impressionOrder {
+		if p.impressions[searchID].owner == owner {
+			delete(p.impressions, searchID)
+			n++
+			continue
+		}
+		kept = append(kept, searchID)
+	}
+	p.impressionOrder = kept
+	return n, nil
+}
+
+// personalizedOrder returns the indexes of the results in the order the
+// user's affinities move them to, each by up to personalizationShift
+// positions
+func personalizedOrder(domains map[string]*domainAffinity, hosts []string) []int {
+	keys := make([]float64, len(hosts))
+	order := make([]int, len(hosts))
+	for i, host := range hosts {
+		order[i] = i
+		keys[i] = float64(i)
+		if a, ok := domains[host]; ok {
+			keys[i] -= personalizationShift * a.score()
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+	return order
+}
+
+// siteHints returns the domains the user picks most for searches sharing
+// words with the intent, as searches restricted to them
+func siteHints(tenant *Tenant, domains map[string]*domainAffinity, intent *SearchIntent) []PersonalizedSite {
+	if intent.SiteFilter != "" || (tenant != nil && tenant.Prompt.bans("site")) {
+		return nil
+	}
+	terms := personalizationTerms(intent)
+	type candidate struct {
+		host  string
+		score float64
+	}
+	var candidates []candidate
+	for host, a := range domains {
+		score := a.score()
+		if score < siteHintAffinity || tenant.DomainBlocked(host) {
+			continue
+		}
+		for _, term := range terms {
+			if a.terms[term] {
+				candidates = append(candidates, candidate{host, score})
+				break
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].host < candidates[j].host
+	})
+	if len(candidates) > maxSiteHints {
+		candidates = candidates[:maxSiteHints]
+	}
+	hints := make([]PersonalizedSite, len(candidates))
+	for i, c := range candidates {
+		hinted := *intent
+		hinted.SiteFilter = c.host
+		hinted.ExcludeSites = tenant.ExcludedSites(&hinted)
+		if tenant != nil {
+			tenant.Prompt.enforce(&hinted)
+		}
+		hints[i] = PersonalizedSite{Site: c.host, SearchURL: constructSearchQuery(&hinted)}
+	}
+	return hints
+}
+
+// personalizationTerms returns the lowercased words of the intent's main
+// query, but common ones
+func personalizationTerms(intent *SearchIntent) []string {
+	var terms []string
+	for _, word := range highlightWords(intent.MainQuery) {
+		if w := strings.ToLower(word.text); !highlightStopWords[w] {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// resultHost returns the lowercased host of a result URL without its www.
+// prefix, which counts as the same domain
+func resultHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), "www.")
+}
+
+// UsePersonalization turns on re-ranking results by the user's clicks
+func (h *SearchHandler) UsePersonalization(profiles *ClickProfiles) {
+	h.personalization = profiles
+}
+
+// personalize reorders the results of the response by the signed-in user's
+// domain affinities, adds the sites they'd likely pick as site_hints, and
+// remembers the order shown for their next click
+func (h *SearchHandler) personalize(r *http.Request, intent *SearchIntent, searchID string, response map[string]interface{}) {
+	tenantID, userID, _ := authenticatedOwner(r)
+	if h.personalization == nil || userID == "" || !h.flags.Enabled(r.Context(), FlagPersonalized, true) {
+		return
+	}
+	domains := h.personalization.profile(tenantID, userID)
+
+	// reorder returns the personalized order of the results from hosts,
+	// nil when the user has no profile
+	reranked := false
+	reorder := func(hosts []string) []int {
+		if len(domains) == 0 {
+			return nil
+		}
+		order := personalizedOrder(domains, hosts)
+		for i, j := range order {
+			reranked = reranked || i != j
+		}
+		return order
+	}
+	var urls []string
+	switch results := response["results"].(type) {
+	case []SearchResult:
+		hosts := make([]string, len(results))
+		for i, result := range results {
+			hosts[i] = resultHost(result.URL)
+		}
+		if order := reorder(hosts); order != nil {
+			reordered := make([]SearchResult, len(results))
+			for i, j := range order {
+				reordered[i] = results[j]
+			}
+			results = reordered
+			response["results"] = results
+		}
+		for _, result := range results {
+			urls = append(urls, result.URL)
+		}
+	case []*FederatedResult:
+		hosts := make([]string, len(results))
+		for i, result := range results {
+			hosts[i] = resultHost(result.URL)
+		}
+		if order := reorder(hosts); order != nil {
+			reordered := make([]*FederatedResult, len(results))
+			for i, j := range order {
+				reordered[i] = results[j]
+			}
+			results = reordered
+			response["results"] = results
+		}
+		for _, result := range results {
+			urls = append(urls, result.URL)
+		}
+	}
+	h.personalization.Shown(searchID, tenantID, userID, urls)
+	if len(domains) == 0 {
+		return
+	}
+
+	personalization := map[string]interface{}{}
+	if _, ok := response["results"]; ok {
+		personalization["reranked"] = reranked
+		if reranked {
+			personalizedSearches.Inc("reranked")
+		} else {
+			personalizedSearches.Inc("unchanged")
+		}
+	}
+	if hints := siteHints(tenantFromContext(r.Context()), domains, intent); len(hints) > 0 {
+		personalization["site_hints"] = hints
+	}
+	if len(personalization) > 0 {
+		response["personalization"] = personalization
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PII modes: what happens to personal data in a prompt before it is sent
+// to OpenAI
+const (
+	PIIOff     = "off"
+	PIIRedact  = "redact"
+	PIIConfirm = "confirm"
+)
+
+// piiMode is the mode for requests without a tenant override, set at startup
+var piiMode = PIIRedact
+
+var piiDetections = metricsRegistry.Counter("pii_detections_total",
+	"Prompts with personal data, by kind (email, phone, card, ssn, address) and action (redacted, confirmation_required, confirmed).", "kind", "action")
+
+// piiDetectors run in order; cards go before phones, whose pattern would
+// take their digits
+var piiDetectors = []struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}{
+	{"email", emailRe, nil},
+	{"card", regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), luhnValid},
+	{"ssn", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), nil},
+	{"phone", phoneRe, nil},
+	{"address", regexp.MustCompile(`(?i)\b\d{1,5}\s+(?:[a-z0-9.'-]+\s+){1,4}(?:street|st|avenue|ave|road|rd|boulevard|blvd|lane|ln|drive|dr|court|ct|way|place|pl|terrace|circle|highway|hwy)\b\.?`), nil},
+}
+
+func validatePIIMode(mode string) error {
+	switch mode {
+	case PIIOff, PIIRedact, PIIConfirm:
+		return nil
+	}
+	return fmt.Errorf("invalid PII mode %q (want off, redact or confirm)", mode)
+}
+
+// piiModeFor returns the PII mode of the request's tenant
+func piiModeFor(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil && t.PIIMode != "" {
+		return t.PIIMode
+	}
+	return piiMode
+}
+
+// PIIConfirmationError asks the client to confirm that the personal data
+// in the prompt may be sent to OpenAI
+type PIIConfirmationError struct {
+	Kinds []string
+}
+
+func (e *PIIConfirmationError) Error() string {
+	return fmt.Sprintf("the prompt contains personal data (%s), resend it with confirm_pii to send it to the analyzer", strings.Join(e.Kinds, ", "))
+}
+
+// piiRedaction is a prompt with its personal data swapped for placeholders
+// like [email_1], and the values to put back into the intent
+type piiRedaction struct {
+	prompt string
+	kinds  []string
+	values map[string]string
+}
+
+// redactPII replaces the personal data in prompt with placeholders
+func redactPII(prompt string) *piiRedaction {
+	r := &piiRedaction{prompt: prompt, values: make(map[string]string)}
+	for _, d := range piiDetectors {
+		n := 0
+		r.prompt = d.re.ReplaceAllStringFunc(r.prompt, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			n++
+			placeholder := fmt.Sprintf("[%s_%d]", d.kind, n)
+			r.values[placeholder] = match
+			return placeholder
+		})
+		if n > 0 {
+			r.kinds = append(r.kinds, d.kind)
+		}
+	}
+	return r
+}
+
+// restore puts the redacted values back into a copy of the intent, so the
+// search itself still has them
+func (r *piiRedaction) restore(intent *SearchIntent) *SearchIntent {
+	if len(r.values) == 0 || intent == nil {
+		return intent
+	}
+	pairs := make([]string, 0, 2*len(r.values))
+	for placeholder, value := range r.values {
+		pairs = append(pairs, placeholder, value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	restored := *intent
+	restored.MainQuery = replacer.Replace(intent.MainQuery)
+	restored.SiteFilter = replacer.Replace(intent.SiteFilter)
+	restored.FileType = replacer.Replace(intent.FileType)
+	restored.DateRange = replacer.Replace(intent.DateRange)
+	restored.ExactPhrases = slices.Clone(intent.ExactPhrases)
+	for i, p := range restored.ExactPhrases {
+		restored.ExactPhrases[i] = replacer.Replace(p)
+	}
+	restored.ExcludeWords = slices.Clone(intent.ExcludeWords)
+	for i, w := range restored.ExcludeWords {
+		restored.ExcludeWords[i] = replacer.Replace(w)
+	}
+	restored.Entities = slices.Clone(intent.Entities)
+	for i, e := range restored.Entities {
+		restored.Entities[i].Name = replacer.Replace(e.Name)
+	}
+	return &restored
+}
+
+// screenPII applies the request's PII mode to the prompt. It returns the
+// redaction to undo on the intent, nil when the prompt goes out as is.
+func screenPII(ctx context.Context, prompt string, confirmed bool) (*piiRedaction, error) {
+	mode := piiModeFor(ctx)
+	if mode == PIIOff {
+		return nil, nil
+	}
+	r := redactPII(prompt)
+	if len(r.kinds) == 0 {
+		return nil, nil
+	}
+	action := "redacted"
+	switch {
+	case mode == PIIConfirm && confirmed:
+		action = "confirmed"
+	case mode == PIIConfirm:
+		action = "confirmation_required"
+	}
+	for _, kind := range r.kinds {
+		piiDetections.Inc(kind, action)
+	}
+	spanFromContext(ctx).SetAttr("search.pii", action)
+	switch action {
+	case "confirmed":
+		return nil, nil
+	case "confirmation_required":
+		return nil, &PIIConfirmationError{Kinds: r.kinds}
+	}
+	return r, nil
+}
+
+// luhnValid tells card numbers from other long digit runs
+func luhnValid(s string) bool {
+	sum, double, digits := 0, false, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// builtinPrompts holds the prompt versions shipped with the server, one
+// directory per version with a <vertical>.tmpl file per vertical. Other
+// .tmpl files only define shared templates.
+//
+//go:embed prompts
+var builtinPrompts embed.FS
+
+// DefaultPromptVersion reproduces the prompts used before they were templates
+const DefaultPromptVersion = "v1"
+
+const maxSystemPromptBytes = 32 << 10
+
+// promptVersionRe keeps versions to plain directory names
+var promptVersionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// PromptData is what the prompt templates can use
+type PromptData struct {
+	// Date is today in the server's timezone, as YYYY-MM-DD
+	Date    string
+	Weekday string
+	Year    int
+	// Locale is the client's locale (e.g. en-US), empty when not given
+	Locale string
+	// Engine is the search engine of the search URL and Operators the
+	// query operators it understands
+	Engine    string
+	Operators []string
+	Vertical  string
+	// LocalCorpus is set when the tenant's own documents are searched along
+	// with the web, so the analysis tells which of them the prompt is about
+	LocalCorpus bool
+	// Synonyms are the other names of the prompt's terms and Tenant the
+	// tenant's customization, both appended to the rendered prompt
+	Synonyms map[string][]string
+	Tenant   *TenantPrompt
+}
+
+// NewPromptData describes an analysis made at now for the current engine
+func NewPromptData(now time.Time, locale string) PromptData {
+	engine := defaultEngine.Load()
+	return PromptData{
+		Date:      now.Format(time.DateOnly),
+		Weekday:   now.Weekday().String(),
+		Year:      now.Year(),
+		Locale:    locale,
+		Engine:    engine.Name,
+		Operators: engine.Operators,
+	}
+}
+
+var promptFuncs = template.FuncMap{
+	"join": strings.Join,
+	"has":  slices.Contains[[]string],
+}
+
+// promptSet is one loaded version of the prompts; general replaces the
+// prompt of every vertical when PROMPT_FILE or the admin API set one
+type promptSet struct {
+	verticals map[string]*template.Template
+	general   *template.Template
+}
+
+// PromptTemplate holds the system prompt templates, one per vertical. They
+// can be swapped while requests are in flight; each request keeps the
+// prompt it started with.
+type PromptTemplate struct {
+	verticals bool
+	version   string
+	// dir holds the versions instead of the built-in ones when set
+	dir string
+	set atomic.Pointer[promptSet]
+
+	mu sync.Mutex
+	// others are the other versions loaded for experiments
+	others map[string]*PromptTemplate
+}
+
+// NewPromptTemplate loads a version of the prompts from dir, or the built-in
+// ones when dir is empty, and the general system prompt from path when set.
+// With verticals, code, academic and shopping prompts get their own smaller
+// prompt.
+func NewPromptTemplate(dir, version, path string, verticals bool) (*PromptTemplate, error) {
+	p := &PromptTemplate{verticals: verticals, version: version, dir: dir}
+	if err := p.ReloadVersion(); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prompt file: %v", err)
+	}
+	if err := p.Reload(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Version is the name of the loaded prompt version
+func (p *PromptTemplate) Version() string {
+	return p.version
+}
+
+// WithVersion returns the prompts of another version from the same place,
+// without the general prompt override. Versions are loaded once.
+func (p *PromptTemplate) WithVersion(version string) (*PromptTemplate, error) {
+	if version == p.version {
+		return p, nil
+	}
+	if !promptVersionRe.MatchString(version) {
+		return nil, fmt.Errorf("prompt version %q must be a directory name like v2", version)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if other, ok := p.others[version]; ok {
+		return other, nil
+	}
+	other, err := NewPromptTemplate(p.dir, version, "", p.verticals)
+	if err != nil {
+		return nil, err
+	}
+	if p.others == nil {
+		p.others = make(map[string]*PromptTemplate)
+	}
+	p.others[version] = other
+	return other, nil
+}
+
+// Files lists the template files of the version in dir, to watch for
+// changes; built-in prompts can't change
+func (p *PromptTemplate) Files() []string {
+	if p.dir == "" {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(p.dir, p.version, "*.tmpl"))
+	return files
+}
+
+// ReloadVersion parses the templates of the version again; on error the
+// current ones stay in place
+func (p *PromptTemplate) ReloadVersion() error {
+	var fsys fs.FS = builtinPrompts
+	root := "prompts/" + p.version
+	if p.dir != "" {
+		fsys, root = os.DirFS(p.dir), p.version
+	}
+	files, err := fs.Glob(fsys, root+"/*.tmpl")
+	if err != nil || len(files) == 0 {
+		return fmt.Errorf("prompt version %q has no templates", p.version)
+	}
+	all, err := template.New("").Funcs(promptFuncs).ParseFS(fsys, files...)
+	if err != nil {
+		return fmt.Errorf("error parsing prompt version %q: %v", p.version, err)
+	}
+
+	set := &promptSet{verticals: make(map[string]*template.Template)}
+	for _, v := range []string{VerticalWeb, VerticalCode, VerticalAcademic, VerticalShopping} {
+		t := all.Lookup(v + ".tmpl")
+		if t == nil {
+			if v == VerticalWeb {
+				return fmt.Errorf("prompt version %q has no web.tmpl", p.version)
+			}
+			// Verticals without a template of their own use the web prompt
+			continue
+		}
+		if err := checkPromptTemplate(t); err != nil {
+			return fmt.Errorf("prompt version %q, %s: %v", p.version, t.Name(), err)
+		}
+		set.verticals[v] = t
+	}
+	if old := p.set.Load(); old != nil {
+		set.general = old.general
+	}
+	p.set.Store(set)
+	return nil
+}
+
+// Vertical picks the vertical whose prompt analyzes the search prompt
+func (p *PromptTemplate) Vertical(prompt string) string {
+	if !p.verticals {
+		return VerticalWeb
+	}
+	// The query type stays an analytics label: "install docker" or
+	// "register a signal handler" are transactional but no shopping
+	return classifyVertical(prompt)
+}
+
+// System renders the current system prompt of a vertical
+func (p *PromptTemplate) System(vertical string, data PromptData) string {
+	set := p.set.Load()
+	t, ok := set.verticals[vertical]
+	if !ok {
+		vertical = VerticalWeb
+		t = set.verticals[VerticalWeb]
+	}
+	// The operator's prompt wins over the built-in vertical ones, it can
+	// tell the verticals apart by .Vertical
+	if set.general != nil {
+		t = set.general
+	}
+	data.Vertical = vertical
+	s, err := renderPrompt(t, data)
+	if err != nil {
+		// Templates render sample data when loaded, so this is a template
+		// depending on data that only some requests have
+		slog.Error("Error rendering system prompt, using the built-in one", "template", t.Name(), "error", err)
+		fallback, _ := builtinPrompts.ReadFile("prompts/" + DefaultPromptVersion + "/web.tmpl")
+		s = strings.TrimSpace(string(fallback))
+	}
+	// Synonyms and tenants customize every template, custom ones included
+	for _, overlay := range []string{synonymsOverlay(data.Synonyms), data.Tenant.overlay()} {
+		if overlay != "" {
+			s += "\n" + overlay
+		}
+	}
+	return s
+}
+
+// Reload validates a new general system prompt template and swaps it in; on
+// error the current prompt stays in place
+func (p *PromptTemplate) Reload(data []byte) error {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return fmt.Errorf("prompt file is empty")
+	}
+	if len(s) > maxSystemPromptBytes {
+		return fmt.Errorf("prompt file is larger than %d bytes", maxSystemPromptBytes)
+	}
+	t, err := template.New("general").Funcs(promptFuncs).Parse(s)
+	if err != nil {
+		return fmt.Errorf("error parsing prompt: %v", err)
+	}
+	if err := checkPromptTemplate(t); err != nil {
+		return err
+	}
+
+	current := p.set.Load()
+	p.set.Store(&promptSet{verticals: current.verticals, general: t})
+	return nil
+}
+
+// checkPromptTemplate renders a template with sample data
+func checkPromptTemplate(t *template.Template) error {
+	s, err := renderPrompt(t, NewPromptData(time.Now(), "en-US"))
+	if err != nil {
+		return fmt.Errorf("error rendering prompt: %v", err)
+	}
+	if len(s) > maxSystemPromptBytes {
+		return fmt.Errorf("prompt is larger than %d bytes", maxSystemPromptBytes)
+	}
+	// The response parser needs the intent fields, so a prompt that doesn't
+	// ask for them is certainly a mistake
+	if !strings.Contains(s, "main_query") {
+		return fmt.Errorf("prompt doesn't mention main_query, the model wouldn't return an intent")
+	}
+	return nil
+}
+
+func renderPrompt(t *template.Template, data PromptData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
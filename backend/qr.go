@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+)
+
+// QR code formats of the search response
+const (
+	QRFormatSVG = "svg"
+	QRFormatPNG = "png"
+)
+
+// QR codes use error correction level M (15% of the code can be damaged,
+// e.g. by a screen's glare). Per version 1-40: the error correction
+// codewords per block and the number of blocks; index 0 is unused.
+var (
+	qrECCPerBlock = [41]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrNumBlocks   = [41]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// qrFormatBitsM are the two format bits of level M
+const qrFormatBitsM = 0
+
+// qrCode is a QR code symbol; modules[y][x] is true for dark modules
+type qrCode struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// encodeQR encodes data in byte mode into the smallest QR code that holds it
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if len(data) < 1<<countBits && 4+countBits+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes are too long for a QR code", len(data))
+	}
+
+	// Mode indicator, character count, data, terminator, then padding
+	var bits qrBitBuffer
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	q := &qrCode{version: version, size: 4*version + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.size)
+		q.function[y] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns()
+	q.drawCodewords(q.addECCAndInterleave(codewords))
+
+	// Keep the mask that leaves the fewest patterns a scanner could misread
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrRawDataModules is the number of modules of a version left for data and
+// error correction once the function patterns are drawn
+func qrRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// qrDataCodewords is the number of data codewords a version holds at level M
+func qrDataCodewords(version int) int {
+	return qrRawDataModules(version)/8 - qrECCPerBlock[version]*qrNumBlocks[version]
+}
+
+// qrAlignmentPositions are the centre coordinates of a version's alignment
+// patterns, on both axes
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, 4*version+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	align := qrAlignmentPositions(q.version)
+	last := len(align) - 1
+	for i, y := range align {
+		for j, x := range align {
+			// The corners with finder patterns have no alignment pattern
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format bits, drawn for real once the mask is chosen
+	q.drawFormatBits(0)
+	if q.version >= 7 {
+		rem := q.version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := q.version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFinder draws a finder pattern centred on x, y with its separator
+func (q *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= q.size || yy < 0 || yy >= q.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			q.set(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	data := qrFormatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	// Next to the top left finder
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	// And again next to the other two
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// addECCAndInterleave splits the data into blocks, appends each block's
+// error correction codewords and interleaves the blocks
+func (q *qrCode) addECCAndInterleave(data []byte) []byte {
+	numBlocks, eccLen := qrNumBlocks[q.version], qrECCPerBlock[q.version]
+	rawCodewords := qrRawDataModules(q.version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		if i < numShort {
+			// A placeholder, so every block has the same length
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i <= shortLen; i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// drawCodewords fills the data modules in the zigzag order of the standard
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern is skipped
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules of a mask pattern; applying it twice
+// undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four rules of the standard: long runs
+// of one color, 2x2 blocks, finder-like patterns and an uneven balance
+func (q *qrCode) penalty() int {
+	result, dark := 0, 0
+	finderLike := []string{"10111010000", "00001011101"}
+	for i := 0; i < q.size; i++ {
+		var row, col strings.Builder
+		for j := 0; j < q.size; j++ {
+			row.WriteByte(qrBit(q.modules[i][j]))
+			col.WriteByte(qrBit(q.modules[j][i]))
+			if q.modules[i][j] {
+				dark++
+			}
+			if i+1 < q.size && j+1 < q.size {
+				c := q.modules[i][j]
+				if q.modules[i][j+1] == c && q.modules[i+1][j] == c && q.modules[i+1][j+1] == c {
+					result += 3
+				}
+			}
+		}
+		for _, line := range []string{row.String(), col.String()} {
+			run := 1
+			for j := 1; j <= len(line); j++ {
+				if j < len(line) && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += 3 + run - 5
+				}
+				run = 1
+			}
+			for _, p := range finderLike {
+				result += 40 * strings.Count(line, p)
+			}
+		}
+	}
+	total := q.size * q.size
+	result += 10 * (abs(dark*20-total*10) / total)
+	return result
+}
+
+func qrBit(dark bool) byte {
+	if dark {
+		return '1'
+	}
+	return '0'
+}
+
+// SVG renders the code with a quiet zone of border modules
+func (q *qrCode) SVG(border int) string {
+	n := q.size + 2*border
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+// PNG renders the code with scale pixels per module and a quiet zone of
+// border modules
+func (q *qrCode) PNG(scale, border int) ([]byte, error) {
+	n := (q.size + 2*border) * scale
+	img := image.NewPaletted(image.Rect(0, 0, n, n), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for py := (y + border) * scale; py < (y+border+1)*scale; py++ {
+				for px := (x + border) * scale; px < (x+border+1)*scale; px++ {
+					img.SetColorIndex(px, py, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// requestedQRImage returns the QR code image format asked for with
+// ?format=qr (svg unless ?qr_image=png), or "" without a QR code
+func requestedQRImage(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	switch query.Get("format") {
+	case "":
+		return "", nil
+	case "qr":
+	default:
+		return "", fmt.Errorf("format must be qr")
+	}
+	switch image := query.Get("qr_image"); image {
+	case "", QRFormatSVG:
+		return QRFormatSVG, nil
+	case QRFormatPNG:
+		return image, nil
+	}
+	return "", fmt.Errorf("qr_image must be svg or png")
+}
+
+// qrDataURI encodes text as a QR code image in a data URI, ready for an
+// <img src>
+func qrDataURI(text, format string) (string, error) {
+	q, err := encodeQR([]byte(text))
+	if err != nil {
+		return "", err
+	}
+	if format == QRFormatPNG {
+		data, err := q.PNG(8, 4)
+		if err != nil {
+			return "", err
+		}
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+	}
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(q.SVG(4))), nil
+}
+
+// rsDivisor is the Reed-Solomon generator polynomial of a degree, highest
+// coefficient first and the leading 1 left out
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder is the error correction of data: the remainder of its
+// division by the generator
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, c := range divisor {
+			result[i] ^= gfMul(c, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrBitBuffer is a sequence of bits, most significant first
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 != 0)
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
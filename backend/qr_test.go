@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// qrAlignmentTable are the alignment pattern centres of ISO/IEC 18004
+// Annex E, by version, to check the encoder's formula against
+var qrAlignmentTable = [41][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+	11: {6, 30, 54}, 12: {6, 32, 58}, 13: {6, 34, 62}, 14: {6, 26, 46, 66},
+	15: {6, 26, 48, 70}, 16: {6, 26, 50, 74}, 17: {6, 30, 54, 78}, 18: {6, 30, 56, 82},
+	19: {6, 30, 58, 86}, 20: {6, 34, 62, 90}, 21: {6, 28, 50, 72, 94}, 22: {6, 26, 50, 74, 98},
+	23: {6, 30, 54, 78, 102}, 24: {6, 28, 54, 80, 106}, 25: {6, 32, 58, 84, 110},
+	26: {6, 30, 58, 86, 114}, 27: {6, 34, 62, 90, 118}, 28: {6, 26, 50, 74, 98, 122},
+	29: {6, 30, 54, 78, 102, 126}, 30: {6, 26, 52, 78, 104, 130}, 31: {6, 30, 56, 82, 108, 134},
+	32: {6, 34, 60, 86, 112, 138}, 33: {6, 30, 58, 86, 114, 142}, 34: {6, 34, 62, 90, 118, 146},
+	35: {6, 30, 54, 78, 102, 126, 150}, 36: {6, 24, 50, 76, 102, 128, 154},
+	37: {6, 28, 54, 80, 106, 132, 158}, 38: {6, 32, 58, 84, 110, 136, 162},
+	39: {6, 26, 54, 82, 110, 138, 166}, 40: {6, 30, 58, 86, 114, 142, 170},
+}
+
+// qrRemainderBits are the modules of a version left over after the last
+// codeword
+func qrRemainderBits(version int) int {
+	switch {
+	case version >= 2 && version <= 6:
+		return 7
+	case version >= 14 && version <= 20, version >= 28 && version <= 34:
+		return 3
+	case version >= 21 && version <= 27:
+		return 4
+	}
+	return 0
+}
+
+// qrMaskFlips is the data mask condition of the standard, on row i and
+// column j
+func qrMaskFlips(mask, i, j int) bool {
+	switch mask {
+	case 0:
+		return (i+j)%2 == 0
+	case 1:
+		return i%2 == 0
+	case 2:
+		return j%3 == 0
+	case 3:
+		return (i+j)%3 == 0
+	case 4:
+		return (i/2+j/3)%2 == 0
+	case 5:
+		return (i*j)%2+(i*j)%3 == 0
+	case 6:
+		return ((i*j)%2+(i*j)%3)%2 == 0
+	default:
+		return ((i+j)%2+(i*j)%3)%2 == 0
+	}
+}
+
+// gf256 are the exponents and logarithms of GF(2^8) modulo
+// x^8 + x^4 + x^3 + x^2 + 1, for the syndromes
+var gf256Exp, gf256Log = func() (exp [510]byte, log [256]int) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = i
+		if x <<= 1; x >= 256 {
+			x ^= 0x11D
+		}
+	}
+	return exp, log
+}()
+
+func gf256Mul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gf256Exp[gf256Log[x]+gf256Log[y]]
+}
+
+// qrDecoded is what a scanner reads from a symbol
+type qrDecoded struct {
+	data    []byte
+	version int
+	mask    int
+}
+
+// decodeQR reads a level M byte mode symbol back the way a scanner would,
+// from the standard's layout rather than the encoder's, and fails on
+// anything a scanner would reject: a broken pattern, format or version
+// information, a codeword with a non-zero syndrome or bad padding
+func decodeQR(grid [][]bool) (*qrDecoded, error) {
+	size := len(grid)
+	version := (size - 17) / 4
+	if size < 21 || (size-17)%4 != 0 || version > 40 {
+		return nil, fmt.Errorf("size %d is no QR code version", size)
+	}
+	dark := func(row, col int) bool { return grid[row][col] }
+
+	// Finder patterns with their light separators, and the timing patterns
+	for _, corner := range [][2]int{{0, 0}, {0, size - 7}, {size - 7, 0}} {
+		for dr := -1; dr <= 7; dr++ {
+			for dc := -1; dc <= 7; dc++ {
+				r, c := corner[0]+dr, corner[1]+dc
+				if r < 0 || r >= size || c < 0 || c >= size {
+					continue
+				}
+				ring := max(abs(dr-3), abs(dc-3))
+				if want := ring != 2 && ring != 4; dark(r, c) != want {
+					return nil, fmt.Errorf("finder pattern at %v broken at row %d, column %d", corner, r, c)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if dark(6, i) != (i%2 == 0) || dark(i, 6) != (i%2 == 0) {
+			return nil, fmt.Errorf("timing pattern broken at %d", i)
+		}
+	}
+	if !dark(size-8, 8) {
+		return nil, fmt.Errorf("dark module missing")
+	}
+
+	// Format information, both copies, bit 0 the least significant
+	var format, formatCopy int
+	for i := 0; i < 15; i++ {
+		var primary, secondary bool
+		switch {
+		case i <= 5:
+			primary = dark(i, 8)
+		case i == 6:
+			primary = dark(7, 8)
+		case i == 7:
+			primary = dark(8, 8)
+		case i == 8:
+			primary = dark(8, 7)
+		default:
+			primary = dark(8, 14-i)
+		}
+		if i < 8 {
+			secondary = dark(8, size-1-i)
+		} else {
+			secondary = dark(size-15+i, 8)
+		}
+		if primary {
+			format |= 1 << i
+		}
+		if secondary {
+			formatCopy |= 1 << i
+		}
+	}
+	if format != formatCopy {
+		return nil, fmt.Errorf("format copies differ: %015b and %015b", format, formatCopy)
+	}
+	format ^= 0x5412
+	if qrPolyMod(format, 0x537) != 0 {
+		return nil, fmt.Errorf("format %015b is not a BCH code word", format)
+	}
+	if level := format >> 13; level != 0b00 {
+		return nil, fmt.Errorf("error correction level %02b, want M", level)
+	}
+	mask := (format >> 10) & 7
+
+	// Version information, both copies
+	if version >= 7 {
+		var info, infoCopy int
+		for i := 0; i < 18; i++ {
+			if dark(i/3, size-11+i%3) {
+				info |= 1 << i
+			}
+			if dark(size-11+i%3, i/3) {
+				infoCopy |= 1 << i
+			}
+		}
+		if info != infoCopy || qrPolyMod(info, 0x1F25) != 0 || info>>12 != version {
+			return nil, fmt.Errorf("version information %018b and %018b are not version %d", info, infoCopy, version)
+		}
+	}
+
+	function := make([][]bool, size)
+	for r := range function {
+		function[r] = make([]bool, size)
+	}
+	fill := func(r0, c0, r1, c1 int) {
+		for r := r0; r <= r1; r++ {
+			for c := c0; c <= c1; c++ {
+				function[r][c] = true
+			}
+		}
+	}
+	fill(0, 0, 8, 8)
+	fill(0, size-8, 8, size-1)
+	fill(size-8, 0, size-1, 8)
+	fill(6, 0, 6, size-1)
+	fill(0, 6, size-1, 6)
+	if version >= 7 {
+		fill(0, size-11, 5, size-9)
+		fill(size-11, 0, size-9, 5)
+	}
+	align := qrAlignmentTable[version]
+	for i, r := range align {
+		for j, c := range align {
+			if last := len(align) - 1; i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				// Under a finder pattern
+				continue
+			}
+			for dr := -2; dr <= 2; dr++ {
+				for dc := -2; dc <= 2; dc++ {
+					if dark(r+dr, c+dc) != (max(abs(dr), abs(dc)) != 1) {
+						return nil, fmt.Errorf("alignment pattern at %d, %d broken", r, c)
+					}
+				}
+			}
+			fill(r-2, c-2, r+2, c+2)
+		}
+	}
+
+	// Codewords, in pairs of columns from the right, up then down
+	var bits []bool
+	upward := true
+	for col := size - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for k := 0; k < size; k++ {
+			r := k
+			if upward {
+				r = size - 1 - k
+			}
+			for _, c := range []int{col, col - 1} {
+				if !function[r][c] {
+					bits = append(bits, dark(r, c) != qrMaskFlips(mask, r, c))
+				}
+			}
+		}
+		upward = !upward
+	}
+	total := len(bits) / 8
+	if len(bits)%8 != qrRemainderBits(version) {
+		return nil, fmt.Errorf("%d data modules, %d bits past the last codeword", len(bits), len(bits)%8)
+	}
+	codewords := make([]byte, total)
+	for i := 0; i < 8*total; i++ {
+		if bits[i] {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	// Blocks: the data codewords interleaved, then the error correction
+	numBlocks, eccLen := qrNumBlocks[version], qrECCPerBlock[version]
+	dataLen := total - numBlocks*eccLen
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= dataLen/numBlocks; i++ {
+		for b := range blocks {
+			// The last dataLen % numBlocks blocks are a codeword longer
+			if i == dataLen/numBlocks && b < numBlocks-dataLen%numBlocks {
+				continue
+			}
+			blocks[b] = append(blocks[b], codewords[k])
+			k++
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[k])
+			k++
+		}
+	}
+	var data []byte
+	for b, block := range blocks {
+		for e := 0; e < eccLen; e++ {
+			var syndrome byte
+			for _, c := range block {
+				syndrome = gf256Mul(syndrome, gf256Exp[e]) ^ c
+			}
+			if syndrome != 0 {
+				return nil, fmt.Errorf("block %d has syndrome %d = %d", b, e, syndrome)
+			}
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+
+	// Byte mode segment, terminator and padding
+	pos := 0
+	read := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v <<= 1
+			if data[pos/8]>>(7-pos%8)&1 != 0 {
+				v |= 1
+			}
+			pos++
+		}
+		return v
+	}
+	if m := read(4); m != 0b0100 {
+		return nil, fmt.Errorf("mode %04b, want byte mode", m)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	n := read(countBits)
+	if 4+countBits+8*n > 8*len(data) {
+		return nil, fmt.Errorf("count %d is past the data", n)
+	}
+	text := make([]byte, n)
+	for i := range text {
+		text[i] = byte(read(8))
+	}
+	for pos < 8*len(data) && pos%8 != 0 {
+		if read(1) != 0 {
+			return nil, fmt.Errorf("terminator or bit padding not zero at bit %d", pos-1)
+		}
+	}
+	for pad := byte(0xEC); pos < 8*len(data); pad ^= 0xEC ^ 0x11 {
+		if b := byte(read(8)); b != pad {
+			return nil, fmt.Errorf("pad codeword %#x, want %#x", b, pad)
+		}
+	}
+	return &qrDecoded{data: text, version: version, mask: mask}, nil
+}
+
+// qrPolyMod is the remainder of the division of a bit polynomial by the
+// generator, over GF(2)
+func qrPolyMod(value, generator int) int {
+	degree := strconv.FormatInt(int64(generator), 2)
+	for n := len(degree) - 1; ; {
+		length := len(strconv.FormatInt(int64(value), 2))
+		if value == 0 || length <= n {
+			return value
+		}
+		value ^= generator << (length - 1 - n)
+	}
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	// Versions are the smallest of the standard's level M byte capacities
+	tests := []struct {
+		name    string
+		data    []byte
+		version int
+	}{
+		{"empty", nil, 1},
+		{"url", []byte("https://www.google.com/search?q=%22go+1.22%22+site%3Ago.dev"), 4},
+		{"utf-8", []byte("café résumé naïve 東京"), 3},
+		{"v1 full", bytes.Repeat([]byte("a"), 14), 1},
+		{"v2 first", bytes.Repeat([]byte("a"), 15), 2},
+		{"v5 full", bytes.Repeat([]byte("b"), 84), 5},
+		{"v7 full", bytes.Repeat([]byte("c"), 122), 7},
+		{"v8 first", bytes.Repeat([]byte("c"), 123), 8},
+		{"v9 full", bytes.Repeat([]byte("d"), 180), 9},
+		{"v10 first, 16 bit count", bytes.Repeat([]byte("d"), 181), 10},
+		{"v10 full", bytes.Repeat([]byte("e"), 213), 10},
+		{"binary", binary, 12},
+		{"v40 full", bytes.Repeat([]byte("f"), 2331), 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := encodeQR(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeQR(q.modules)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if !bytes.Equal(got.data, tt.data) || got.version != tt.version {
+				t.Errorf("decoded %q in version %d; want %q in version %d", got.data, got.version, tt.data, tt.version)
+			}
+		})
+	}
+
+	// Every version, up to its capacity, at a length it alone holds
+	for n := 1; n <= 2331; n += 37 {
+		data := bytes.Repeat([]byte("0123456789abcdef"), n/16+1)[:n]
+		q, err := encodeQR(data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if got, err := decodeQR(q.modules); err != nil || !bytes.Equal(got.data, data) {
+			t.Fatalf("%d bytes in version %d don't decode: %v", n, q.version, err)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 2332)); err == nil {
+		t.Error("2332 bytes encoded, want too long")
+	}
+}
+
+// TestQRMasks decodes the symbol under each of the eight masks, whichever
+// the encoder's penalty would pick
+func TestQRMasks(t *testing.T) {
+	data := []byte("https://duckduckgo.com/?q=kubernetes+operators")
+	q, err := encodeQR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeQR(q.modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := got.mask
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(current)
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		current = mask
+		got, err := decodeQR(q.modules)
+		if err != nil {
+			t.Fatalf("mask %d: %v", mask, err)
+		}
+		if got.mask != mask || !bytes.Equal(got.data, data) {
+			t.Errorf("mask %d: decoded %q under mask %d", mask, got.data, got.mask)
+		}
+	}
+}
+
+// TestQRDataURI decodes the rendered images, quiet zone included
+func TestQRDataURI(t *testing.T) {
+	text := "https://www.bing.com/search?q=hiking+boots+-cheap"
+	const scale, border = 8, 4
+
+	t.Run(QRFormatPNG, func(t *testing.T) {
+		uri, err := qrDataURI(text, QRFormatPNG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/png;base64,"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := img.Bounds().Dx() / scale
+		grid := make([][]bool, n-2*border)
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				r, _, _, _ := img.At(x*scale+scale/2, y*scale+scale/2).RGBA()
+				dark := r < 0x8000
+				inside := x >= border && x < n-border && y >= border && y < n-border
+				if !inside {
+					if dark {
+						t.Fatalf("quiet zone dark at %d, %d", x, y)
+					}
+					continue
+				}
+				grid[y-border] = append(grid[y-border], dark)
+			}
+		}
+		got, err := decodeQR(grid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.data) != text {
+			t.Errorf("decoded %q, want %q", got.data, text)
+		}
+	})
+
+	t.Run(QRFormatSVG, func(t *testing.T) {
+		uri, err := qrDataURI(text, QRFormatSVG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/svg+xml;base64,"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		box := regexp.MustCompile(`viewBox="0 0 (\d+) `).FindStringSubmatch(string(raw))
+		if box == nil {
+			t.Fatalf("no viewBox in %s", raw)
+		}
+		n, _ := strconv.Atoi(box[1])
+		grid := make([][]bool, n-2*border)
+		for i := range grid {
+			grid[i] = make([]bool, n-2*border)
+		}
+		for _, m := range regexp.MustCompile(`M(\d+) (\d+)h1v1h-1z`).FindAllStringSubmatch(string(raw), -1) {
+			x, _ := strconv.Atoi(m[1])
+			y, _ := strconv.Atoi(m[2])
+			if x < border || x >= n-border || y < border || y >= n-border {
+				t.Fatalf("quiet zone dark at %d, %d", x, y)
+			}
+			grid[y-border][x-border] = true
+		}
+		got, err := decodeQR(grid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.data) != text {
+			t.Errorf("decoded %q, want %q", got.data, text)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+)
+
+// maxQueryOperators caps the operators of a query on every engine; past a
+// dozen or so the engines start ignoring some of them
+const maxQueryOperators = 16
+
+var queryTruncations = metricsRegistry.Counter("search_query_truncated_total",
+	"Parts of intents dropped so their query fits the engine's limits, by field.", "field")
+
+// queryFits tells whether the query of an intent is within the engine's
+// limits on words, operators and length
+func queryFits(intent *SearchIntent, engine *SearchEngine) bool {
+	q := buildQueryString(intent)
+	if engine.MaxQueryLength > 0 && len(q) > engine.MaxQueryLength {
+		return false
+	}
+	if engine.MaxWords > 0 && len(strings.Fields(q)) > engine.MaxWords {
+		return false
+	}
+	return queryOperators(intent) <= maxQueryOperators
+}
+
+// queryOperators counts the operators of an intent's query, the OR of
+// synonym groups included
+func queryOperators(intent *SearchIntent) int {
+	n := len(intent.ExactPhrases) + len(intent.ExcludeWords) + len(intent.ExcludeSites)
+	for _, set := range []string{intent.SiteFilter, intent.FileType, intent.DateRange} {
+		if set != "" {
+			n++
+		}
+	}
+	for _, word := range strings.Fields(intent.MainQuery) {
+		if word == "OR" {
+			n++
+		}
+	}
+	return n
+}
+
+// queryCuts drop one part of an intent each, the least important first: the
+// tenant's excluded sites (their results are dropped anyway), synonyms,
+// excluded words, the date, exact phrases but the first, the file type and
+// the last words of the main query. The site filter and the first words of
+// the main query are always kept. A cut reports false when it has nothing
+// left to drop.
+var queryCuts = []struct {
+	field string
+	cut   func(intent *SearchIntent) bool
+}{
+	{"exclude_sites", func(intent *SearchIntent) bool {
+		return dropLast(&intent.ExcludeSites, 0)
+	}},
+	{"synonyms", collapseSynonymGroup},
+	{"exclude_words", func(intent *SearchIntent) bool {
+		return dropLast(&intent.ExcludeWords, 0)
+	}},
+	{"date_range", func(intent *SearchIntent) bool {
+		if intent.DateRange == "" {
+			return false
+		}
+		intent.DateRange = ""
+		return true
+	}},
+	{"exact_phrases", func(intent *SearchIntent) bool {
+		return dropLast(&intent.ExactPhrases, 1)
+	}},
+	{"file_type", func(intent *SearchIntent) bool {
+		if intent.FileType == "" {
+			return false
+		}
+		intent.FileType = ""
+		return true
+	}},
+	{"main_query", func(intent *SearchIntent) bool {
+		tokens := queryTokens(intent.MainQuery)
+		if len(tokens) <= 1 {
+			return false
+		}
+		intent.MainQuery = strings.Join(tokens[:len(tokens)-1], " ")
+		return true
+	}},
+	{"exact_phrases", func(intent *SearchIntent) bool {
+		return dropLast(&intent.ExactPhrases, 0)
+	}},
+}
+
+// dropLast removes the last item of a list longer than keep
+func dropLast(list *[]string, keep int) bool {
+	if len(*list) <= keep {
+		return false
+	}
+	*list = (*list)[:len(*list)-1]
+	return true
+}
+
+// collapseSynonymGroup replaces the last OR group of the main query with
+// its first term, the one the prompt used
+func collapseSynonymGroup(intent *SearchIntent) bool {
+	tokens := queryTokens(intent.MainQuery)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		t := tokens[i]
+		if !strings.HasPrefix(t, "(") || !strings.HasSuffix(t, ")") || !strings.Contains(t, " OR ") {
+			continue
+		}
+		first, _, _ := strings.Cut(strings.TrimPrefix(t, "("), " OR ")
+		tokens[i] = first
+		intent.MainQuery = strings.Join(tokens, " ")
+		return true
+	}
+	return false
+}
+
+// fitQuery drops the least important parts of an intent, deterministically,
+// until its query fits the engine, rather than letting the engine ignore
+// whatever it likes of an overlong one. The intent is a copy owned by the
+// caller. It reports whether anything was dropped.
+func fitQuery(intent *SearchIntent, engine *SearchEngine) bool {
+	truncated := false
+	for _, step := range queryCuts {
+		for !queryFits(intent, engine) {
+			if !step.cut(intent) {
+				break
+			}
+			queryTruncations.Inc(step.field)
+			truncated = true
+		}
+	}
+	return truncated
+}
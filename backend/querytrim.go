@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+var queryTrimmed = metricsRegistry.Counter("main_query_trimmed_total",
+	"Main queries trimmed of filler words, by where (start, end, middle).", "where")
+
+// Filler is what asks for a search rather than says what to search for.
+// Phrases are matched on whole words ignoring case, the longest first.
+var (
+	leadingFillers = fillerPhrases(
+		"please", "kindly", "hey", "hi",
+		"can you", "could you", "would you", "will you", "can u", "pls",
+		"help me find", "help me", "find me", "search for", "search the web for", "look for", "look up",
+		"looking for", "show me", "give me", "get me", "tell me about", "tell me",
+		"i want to know about", "i want to know", "i want to find", "i want to learn about", "i want",
+		"i need to know about", "i need to find", "i need",
+		"i'd like to know about", "i would like to know about", "i'd like to find", "i would like to find",
+		"i'd like", "i would like", "i am looking for", "i'm looking for", "im looking for",
+		"information about", "information on", "info about", "info on", "details about", "details on",
+	)
+	// afterFillers are only trimmed after a filler, "the office cast" keeps
+	// its article
+	afterFillers   = fillerPhrases("the", "a", "an", "some", "any", "about", "on")
+	trailingFiller = fillerPhrases("please", "for me", "thanks", "thank you", "thx", "if possible", "asap")
+	middleFillers  = map[string]bool{"please": true, "kindly": true, "pls": true}
+	// weakFillers also start titles ("Hey Jude", "Please Please Me", "I Want
+	// It That Way"), so alone they don't make a query a request to trim
+	weakFillers = map[string]bool{"please": true, "kindly": true, "hey": true, "hi": true, "pls": true, "i want": true, "i need": true}
+)
+
+// minTrimmedWords is the fewest content words a trimmed query keeps
+const minTrimmedWords = 2
+
+// fillerPhrases splits the phrases into words, the longest first
+func fillerPhrases(phrases ...string) [][]string {
+	out := make([][]string, len(phrases))
+	for i, p := range phrases {
+		out[i] = strings.Fields(p)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out
+}
+
+// queryTokens splits a query into words, keeping quoted phrases and
+// parenthesized groups, like synonym OR groups, whole
+func queryTokens(q string) []string {
+	var tokens []string
+	var cur strings.Builder
+	depth, quoted := 0, false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '(' && !quoted:
+			depth++
+		case r == ')' && !quoted && depth > 0:
+			depth--
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted && depth == 0:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// fillerWord is a token compared with the filler phrases; quoted phrases,
+// groups and operators never are
+func fillerWord(token string) string {
+	if strings.ContainsAny(token, `"():`) {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(token, ",;!?."))
+}
+
+// matchFiller returns how many tokens from start (or ending at end, with
+// fromEnd) the longest matching phrase spans
+func matchFiller(tokens []string, phrases [][]string, fromEnd bool) int {
+	for _, phrase := range phrases {
+		if len(phrase) > len(tokens) {
+			continue
+		}
+		span := tokens[:len(phrase)]
+		if fromEnd {
+			span = tokens[len(tokens)-len(phrase):]
+		}
+		matched := true
+		for i, w := range phrase {
+			if fillerWord(span[i]) != w {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return len(phrase)
+		}
+	}
+	return 0
+}
+
+// fillerPhrase is the filler the tokens spell
+func fillerPhrase(tokens []string) string {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = fillerWord(t)
+	}
+	return strings.Join(words, " ")
+}
+
+// trimMainQuery strips the filler models sometimes leave in main_query when
+// they copy a conversational prompt ("please find me the best hiking boots"
+// is searched as "best hiking boots"), which keyword engines would otherwise
+// require in the results. Only queries that ask for something are trimmed:
+// a request phrase like "find me" or "can you", a closing "thanks", or a
+// greeting set off by a comma ("hey, ..."). A query that would keep fewer
+// than two content words is returned as is, so "Tell Me Why" stays whole.
+func trimMainQuery(q string) string {
+	tokens := queryTokens(q)
+	all := len(tokens)
+	start := 0
+	conversational := false
+	for {
+		n := matchFiller(tokens[start:], leadingFillers, false)
+		if n == 0 {
+			break
+		}
+		if !weakFillers[fillerPhrase(tokens[start:start+n])] || strings.HasSuffix(tokens[start+n-1], ",") {
+			conversational = true
+		}
+		start += n
+	}
+	if start > 0 {
+		for {
+			n := matchFiller(tokens[start:], afterFillers, false)
+			if n == 0 {
+				break
+			}
+			start += n
+		}
+	}
+	tokens = tokens[start:]
+	trailing := 0
+	for {
+		n := matchFiller(tokens, trailingFiller, true)
+		if n == 0 {
+			break
+		}
+		if fillerPhrase(tokens[len(tokens)-n:]) != "please" {
+			conversational = true
+		}
+		tokens = tokens[:len(tokens)-n]
+		trailing += n
+	}
+	if !conversational {
+		return q
+	}
+
+	kept := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		if !middleFillers[fillerWord(t)] {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		return q
+	}
+	// A question mark or comma the filler ended on goes with it
+	last := len(kept) - 1
+	if fillerWord(kept[last]) != "" {
+		kept[last] = strings.TrimRight(kept[last], ",;!?")
+	}
+	if kept[last] == "" {
+		kept = kept[:last]
+	}
+	content := 0
+	for _, t := range kept {
+		if matchFiller([]string{t}, afterFillers, false) == 0 {
+			content++
+		}
+	}
+	if content < minTrimmedWords {
+		return q
+	}
+
+	if start > 0 {
+		queryTrimmed.Inc("start")
+	}
+	if trailing > 0 {
+		queryTrimmed.Inc("end")
+	}
+	if len(kept) < all-start-trailing {
+		queryTrimmed.Inc("middle")
+	}
+	return strings.Join(kept, " ")
+}
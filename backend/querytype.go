@@ -0,0 +1,78 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Query types: what the user means to do with a search
+const (
+	// QueryNavigational looks for one site or page, e.g. "github login"
+	QueryNavigational = "navigational"
+	// QueryInformational looks for information, the default
+	QueryInformational = "informational"
+	// QueryTransactional means to buy, book, download or sign up for something
+	QueryTransactional = "transactional"
+)
+
+var queryTypes = metricsRegistry.Counter("query_types_total",
+	"Analyzed prompts per query type.", "type")
+
+var (
+	// navigationalOpenerRe asks to go somewhere, which beats everything else
+	navigationalOpenerRe = regexp.MustCompile(`(?i)^\s*(?:go to|open|take me to|navigate to|visit)\s`)
+	// navigationalURLRe is a prompt that is just a domain or URL
+	navigationalURLRe = regexp.MustCompile(`(?i)^\s*(?:https?://)?(?:www\.)?[a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,}(?:/\S*)?\s*$`)
+	// navigationalHintRe names a site's own pages
+	navigationalHintRe = regexp.MustCompile(`(?i)\b(?:home ?page|official (?:web)?site|website|web site|log ?in|sign ?in|portal|dashboard)\b`)
+	// transactionalHintRe means to get something done or bought
+	transactionalHintRe = regexp.MustCompile(`(?i)\b(?:buy|purchase|order (?:online|now)|download|install|subscribe|sign ?up|register|book(?:ing)? (?:a|an|my|flights?|hotels?|tickets?|tables?)|reserve|rent|hire|coupons?|deals?|discount|price[sd]?|pricing|cheap(?:est)?|for sale|on sale|tickets?)\b`)
+)
+
+// classifyQueryType tells the query type of a prompt by its wording; an
+// intent restricted to a site with nothing else to look for is
+// navigational too
+func classifyQueryType(prompt string, intent *SearchIntent) string {
+	switch {
+	case navigationalOpenerRe.MatchString(prompt) || navigationalURLRe.MatchString(prompt):
+		return QueryNavigational
+	case transactionalHintRe.MatchString(prompt):
+		return QueryTransactional
+	case navigationalHintRe.MatchString(prompt):
+		return QueryNavigational
+	case intent != nil && intent.SiteFilter != "" && strings.TrimSpace(intent.MainQuery) == "":
+		return QueryNavigational
+	}
+	return QueryInformational
+}
+
+// bestResult returns the first result of the response with a URL, the one
+// a navigational search is after, or nil when there are no results
+func bestResult(response map[string]interface{}) map[string]string {
+	results := responseResults(response)
+	if len(results) == 0 {
+		return nil
+	}
+	return map[string]string{"title": results[0].Title, "url": results[0].URL}
+}
+
+// responseResults returns the results of a search response that link to a
+// page, in order; documents without a URL are left out
+func responseResults(response map[string]interface{}) []SearchResult {
+	var out []SearchResult
+	switch results := response["results"].(type) {
+	case []SearchResult:
+		for _, result := range results {
+			if result.URL != "" {
+				out = append(out, result)
+			}
+		}
+	case []*FederatedResult:
+		for _, result := range results {
+			if result.URL != "" {
+				out = append(out, SearchResult{Title: result.Title, URL: result.URL, Snippet: result.Snippet})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps token buckets keyed by client. Take consumes one token
+// and reports whether the request is allowed and, if not, when to retry.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+// RateLimiter applies a per-client token bucket in front of a handler
+type RateLimiter struct {
+	store   RateLimitStore
+	rate    float64 // tokens added per second
+	burst   int     // bucket capacity
+	proxies []netip.Prefix
+	// knownKey tells the API keys of a tenant from made-up ones
+	knownKey func(key string) bool
+}
+
+func NewRateLimiter(store RateLimitStore, rate float64, burst int, proxies []netip.Prefix, knownKey func(key string) bool) *RateLimiter {
+	return &RateLimiter{
+		store:    store,
+		rate:     rate,
+		burst:    burst,
+		proxies:  proxies,
+		knownKey: knownKey,
+	}
+}
+
+// Middleware rejects clients that exhausted their bucket with 429 and Retry-After
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := clientKey(r, rl.proxies, rl.knownKey)
+		allowed, retryAfter, err := rl.store.Take(r.Context(), key, rl.rate, rl.burst)
+		if err != nil {
+			// Fail open: a broken limiter store must not take the API down
+			slog.ErrorContext(r.Context(), "Rate limiter error", "client", key, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.burst))
+		if !allowed {
+			secs := int(math.Ceil(retryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the caller by API key when it is a tenant's,
+// otherwise by IP: a new made-up key on each request must not get a new
+// bucket. Keys are hashed, bucket names end up in logs and Redis.
+func clientKey(r *http.Request, proxies []netip.Prefix, knownKey func(key string) bool) string {
+	if key := apiKeyFromRequest(r); key != "" && knownKey(key) {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:12])
+	}
+	return "ip:" + clientIP(r, proxies)
+}
+
+// apiKeyFromRequest reads the API key from X-API-Key or a bearer token. The
+// no-code endpoints also accept it as an api_key query parameter, since many
+// of those platforms can only configure a URL.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if strings.HasPrefix(r.URL.Path, zapierPathPrefix) {
+		return strings.TrimSpace(r.URL.Query().Get("api_key"))
+	}
+	return ""
+}
+
+// clientIP returns the remote address, or with the request coming from one
+// of the trusted proxies the address they forwarded it for. Clients can put
+// anything in X-Forwarded-For, so it is read from the right, where each proxy
+// appended the address it got the request from, up to the first hop that
+// isn't a trusted proxy.
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host, proxies) {
+		return host
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			if host = hop; !trustedProxy(hop, proxies) {
+				break
+			}
+		}
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// trustedProxy tells whether ip is one of the proxies' addresses
+func trustedProxy(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryRateLimitStore keeps buckets in process memory, suitable for a single replica
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewMemoryRateLimitStore() *memoryRateLimitStore {
+	s := &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+	go s.janitor(time.Minute)
+	return s
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// janitor drops buckets that have been idle long enough to be full again
+func (s *memoryRateLimitStore) janitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if time.Since(b.last) > 10*interval {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// redisTokenBucketScript refills and takes from a bucket atomically.
+// KEYS[1] bucket key; ARGV rate, burst, now (ms). Returns {allowed, retry_after_ms}.
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, retry}
+`
+
+// redisRateLimitStore shares buckets across replicas through Redis
+type redisRateLimitStore struct {
+	client *RedisClient
+	prefix string
+}
+
+func NewRedisRateLimitStore(client *RedisClient) *redisRateLimitStore {
+	return &redisRateLimitStore{client: client, prefix: "ratelimit:"}
+}
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	reply, err := s.client.Do(ctx, "EVAL", redisTokenBucketScript, "1", s.prefix+key,
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.Itoa(burst),
+		strconv.FormatInt(time.Now().UnixMilli(), 10),
+	)
+	if err != nil {
+		return false, 0, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+	allowed, err := redisInt(items[0])
+	if err != nil {
+		return false, 0, err
+	}
+	retryMs, err := redisInt(items[1])
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, time.Duration(retryMs) * time.Millisecond, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+)
+
+// Log privacy modes
+const (
+	// LogPrivacyOff logs prompts as sent, with secrets scrubbed
+	LogPrivacyOff = "off"
+	// LogPrivacyTruncate logs the start of prompts and scrubs emails and
+	// phone numbers from every log line
+	LogPrivacyTruncate = "truncate"
+	// LogPrivacyHash logs a hash of prompts instead, with the same scrubbing
+	LogPrivacyHash = "hash"
+)
+
+const loggedPromptRunes = 32
+
+var (
+	// secretRe matches OpenAI keys and bearer tokens; scrubbed in every mode
+	secretRe = regexp.MustCompile(`\b(?:sk-|aps_)[A-Za-z0-9_-]{8,}|(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{8,}`)
+	emailRe  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneRe  = regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?\(?\b\d{3}\)?[\s.-]?\d{3}[\s.-]\d{4}\b|\+\d[\d\s-]{8,}\d\b`)
+)
+
+// logPrivacy is the mode for log lines without a tenant, set at startup
+var logPrivacy = LogPrivacyOff
+
+func validateLogPrivacy(mode string) error {
+	switch mode {
+	case LogPrivacyOff, LogPrivacyTruncate, LogPrivacyHash:
+		return nil
+	}
+	return fmt.Errorf("invalid log privacy mode %q (want off, truncate or hash)", mode)
+}
+
+// logPrivacyFor returns the privacy mode of the request's tenant
+func logPrivacyFor(ctx context.Context) string {
+	if t := tenantFromContext(ctx); t != nil && t.LogPrivacy != "" {
+		return t.LogPrivacy
+	}
+	return logPrivacy
+}
+
+// scrub removes secrets, and in a privacy mode emails and phone numbers
+func scrub(s, mode string) string {
+	s = secretRe.ReplaceAllString(s, "[secret]")
+	if mode != LogPrivacyOff {
+		s = emailRe.ReplaceAllString(s, "[email]")
+		s = phoneRe.ReplaceAllString(s, "[phone]")
+	}
+	return s
+}
+
+// loggedPrompt is how a prompt appears in the logs of the request's tenant
+func loggedPrompt(ctx context.Context, prompt string) slog.Value {
+	switch logPrivacyFor(ctx) {
+	case LogPrivacyHash:
+		sum := sha256.Sum256([]byte(prompt))
+		return slog.StringValue("sha256:" + hex.EncodeToString(sum[:8]))
+	case LogPrivacyTruncate:
+		if r := []rune(prompt); len(r) > loggedPromptRunes {
+			return slog.StringValue(fmt.Sprintf("%s... (%d chars)", string(r[:loggedPromptRunes]), len(r)))
+		}
+	}
+	return slog.StringValue(prompt)
+}
+
+// logsBodies reports whether raw request and response bodies may be logged
+func logsBodies(ctx context.Context) bool {
+	return logPrivacyFor(ctx) == LogPrivacyOff
+}
+
+// scrubRecord returns a copy of r with the message and every string and
+// error attribute scrubbed
+func scrubRecord(r slog.Record, mode string) slog.Record {
+	out := slog.NewRecord(r.Time, r.Level, scrub(r.Message, mode), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(scrubAttr(a, mode))
+		return true
+	})
+	return out
+}
+
+func scrubAttr(a slog.Attr, mode string) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, scrub(v.String(), mode))
+	case slog.KindGroup:
+		attrs := v.Group()
+		scrubbed := make([]any, len(attrs))
+		for i, ga := range attrs {
+			scrubbed[i] = scrubAttr(ga, mode)
+		}
+		return slog.Group(a.Key, scrubbed...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, scrub(err.Error(), mode))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisClient is a minimal RESP client, just enough for the shared stores
+// used across replicas. Connections are pooled and reused.
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// RedisError is an error reply returned by the server
+type RedisError string
+
+func (e RedisError) Error() string { return string(e) }
+
+// NewRedisClient parses a redis://[:password@]host:port[/db] URL
+func NewRedisClient(rawURL string) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing redis URL: %v", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis URL scheme %q", u.Scheme)
+	}
+
+	c := &RedisClient{addr: u.Host, timeout: 5 * time.Second}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns the decoded reply: string, int64, []interface{} or nil
+func (c *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	rc, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	rc.conn.SetDeadline(deadline)
+
+	reply, err := rc.do(args...)
+	if err != nil {
+		if _, ok := err.(RedisError); !ok {
+			// Protocol or network failure, the connection state is unknown
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+	c.put(rc)
+	return reply, err
+}
+
+// Close drops all pooled connections
+func (c *RedisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rc := range c.idle {
+		rc.conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *RedisClient) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %v", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis SELECT failed: %v", err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *RedisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= 16 {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := rc.conn.Write([]byte(b.String())); err != nil {
+		return nil, fmt.Errorf("error writing to redis: %v", err)
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading from redis: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length: %v", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.rd, buf); err != nil {
+			return nil, fmt.Errorf("error reading from redis: %v", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length: %v", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := rc.readReply()
+			if err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// redisInt converts an integer reply
+func redisInt(reply interface{}) (int64, error) {
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected redis reply type %T", reply)
+}
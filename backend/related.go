@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxRelatedQuestions bounds the related questions of a search
+const maxRelatedQuestions = 5
+
+// relatedQuestionsPrompt asks the model for follow-up questions when the
+// engine has none
+const relatedQuestionsPrompt = `You suggest the questions people also ask after a web search. ` +
+	`Write up to 5 short questions, each one a complete search on its own, without pronouns referring to the search. ` +
+	`Reply with JSON only: {"questions": ["..."]}.`
+
+var relatedQuestionRequests = metricsRegistry.Counter("related_questions_total",
+	"Related questions of searches, by source (engine, generated), or why there are none (none, failed).", "source")
+
+// RelatedQuestion is a question people also ask about a search, with the
+// prompt that searches it
+type RelatedQuestion struct {
+	Question string `json:"question"`
+	// Prompt is ready to send to /search as is
+	Prompt string `json:"prompt"`
+	// Snippet and URL are the engine's answer to the question, if any
+	Snippet string `json:"snippet,omitempty"`
+	URL     string `json:"url,omitempty"`
+	// Source is "engine" or "generated" by the model
+	Source string `json:"source"`
+}
+
+// parseRelatedQuestions reads the related_questions block of a SerpAPI
+// answer
+func parseRelatedQuestions(raw json.RawMessage) []RelatedQuestion {
+	var block []struct {
+		Question string `json:"question"`
+		Snippet  string `json:"snippet"`
+		Link     string `json:"link"`
+	}
+	if err := json.Unmarshal(raw, &block); err != nil {
+		return nil
+	}
+	var questions []RelatedQuestion
+	for _, q := range block {
+		question := strings.TrimSpace(q.Question)
+		if question == "" || len(questions) >= maxRelatedQuestions {
+			continue
+		}
+		questions = append(questions, RelatedQuestion{
+			Question: question,
+			Prompt:   question,
+			Snippet:  strings.TrimSpace(q.Snippet),
+			URL:      httpURL(q.Link),
+			Source:   "engine",
+		})
+	}
+	return questions
+}
+
+// relatedQuestions sets the related_questions of a search response the
+// engine didn't answer any for, asking the cheap model. Analyses that kept
+// personal data from OpenAI get none.
+func (h *SearchHandler) relatedQuestions(r *http.Request, analysis *AnalysisResult, locale string, response map[string]interface{}) {
+	if _, ok := response["related_questions"]; ok {
+		return
+	}
+	if len(analysis.Redacted) > 0 || strings.TrimSpace(analysis.Intent.MainQuery) == "" {
+		return
+	}
+	ctx, span := tracer.Start(r.Context(), "search.related_questions", SpanKindInternal)
+	defer span.End()
+	questions, err := h.generateRelatedQuestions(ctx, analysis.Intent.MainQuery, locale)
+	if err != nil {
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Error generating related questions", "error", err)
+		relatedQuestionRequests.Inc("failed")
+		return
+	}
+	if len(questions) == 0 {
+		relatedQuestionRequests.Inc("none")
+		return
+	}
+	relatedQuestionRequests.Inc("generated")
+	response["related_questions"] = questions
+}
+
+// generateRelatedQuestions asks the cheap model for follow-up questions to
+// a query, in the language of locale if set. It is refused over budget like
+// analyses.
+func (h *SearchHandler) generateRelatedQuestions(ctx context.Context, query, locale string) ([]RelatedQuestion, error) {
+	if err := h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
+	instruction := "Search: " + query
+	if locale != "" {
+		instruction += "\nWrite the questions in the language of the locale " + locale + "."
+	}
+	reqBody := OpenAIRequest{
+		Model: h.router.cheapModel,
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: relatedQuestionsPrompt},
+			{Role: "user", Content: instruction},
+		},
+		Temperature: defaultTemperature,
+		MaxTokens:   300,
+	}
+
+	release, err := h.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := h.chatCompletion(ctx, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	var answer struct {
+		Questions []string `json:"questions"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(resp.Choices[0].Message.Content)), &answer); err != nil {
+		return nil, fmt.Errorf("error parsing related questions: %v", err)
+	}
+	var questions []RelatedQuestion
+	seen := make(map[string]bool)
+	for _, q := range answer.Questions {
+		q = strings.TrimSpace(stripInvisible(q))
+		key := strings.ToLower(q)
+		if q == "" || seen[key] || len(questions) >= maxRelatedQuestions {
+			continue
+		}
+		seen[key] = true
+		questions = append(questions, RelatedQuestion{Question: q, Prompt: q, Source: "generated"})
+	}
+	return questions, nil
+}
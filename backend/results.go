@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	resultsCacheRequests = metricsRegistry.Counter("results_cache_requests_total",
+		"Results provider lookups, by result (hit, stale, miss).", "result")
+	resultsProviderRequests = metricsRegistry.Counter("results_provider_requests_total",
+		"Paid calls to the results provider, by result (ok, error, cancelled).", "result")
+)
+
+// SearchResult is one organic result from the results provider
+type SearchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet,omitempty"`
+	// SnippetHTML is the snippet escaped for HTML with the terms of the
+	// search in <mark> tags, set on the results of /search only
+	SnippetHTML string `json:"snippet_html,omitempty"`
+}
+
+// ResultsQuery is what a results provider is asked; Locale is a language
+// tag like en-US
+type ResultsQuery struct {
+	Query  string
+	Engine string
+	Locale string
+}
+
+// ResultsProvider fetches search results for a query
+type ResultsProvider interface {
+	Search(ctx context.Context, q ResultsQuery) ([]SearchResult, error)
+}
+
+// ResultsPage is a provider's whole answer: the results and the blocks the
+// engine shows around them
+type ResultsPage struct {
+	Results []SearchResult
+	// Entity is the knowledge panel of the query, nil when there is none
+	Entity *KnowledgeEntity
+	// RelatedQuestions are the engine's "people also ask" questions
+	RelatedQuestions []RelatedQuestion
+}
+
+// PageProvider is a results provider that answers the blocks around the
+// results too
+type PageProvider interface {
+	ResultsProvider
+	SearchPage(ctx context.Context, q ResultsQuery) (*ResultsPage, error)
+}
+
+// serpAPIProvider gets results from SerpAPI, which fronts Google, Bing and
+// DuckDuckGo alike
+type serpAPIProvider struct {
+	client  HTTPDoer
+	apiKey  string
+	baseURL string
+}
+
+func NewSerpAPIProvider(client HTTPDoer, apiKey string) ResultsProvider {
+	return &serpAPIProvider{client: client, apiKey: apiKey, baseURL: "https://serpapi.com/search.json"}
+}
+
+func (p *serpAPIProvider) Search(ctx context.Context, q ResultsQuery) ([]SearchResult, error) {
+	page, err := p.SearchPage(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return page.Results, nil
+}
+
+func (p *serpAPIProvider) SearchPage(ctx context.Context, q ResultsQuery) (*ResultsPage, error) {
+	params := url.Values{}
+	params.Set("engine", q.Engine)
+	params.Set("q", q.Query)
+	params.Set("api_key", p.apiKey)
+	if lang, region, ok := strings.Cut(q.Locale, "-"); q.Locale != "" {
+		// DuckDuckGo takes a single region-language code
+		if q.Engine == "duckduckgo" && ok {
+			params.Set("kl", strings.ToLower(region+"-"+lang))
+		} else {
+			params.Set("hl", strings.ToLower(lang))
+			if ok {
+				params.Set("gl", strings.ToLower(region))
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// The URL in the error carries the API key, which must not reach
+		// the logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("error calling results provider: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading results: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("results provider answered %s", resp.Status)
+	}
+
+	var parsed struct {
+		OrganicResults []struct {
+			Title   string `json:"title"`
+			Link    string `json:"link"`
+			Snippet string `json:"snippet"`
+		} `json:"organic_results"`
+		KnowledgeGraph   json.RawMessage `json:"knowledge_graph"`
+		RelatedQuestions json.RawMessage `json:"related_questions"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("error parsing results: %v", err)
+	}
+	page := &ResultsPage{Results: make([]SearchResult, 0, len(parsed.OrganicResults))}
+	for _, r := range parsed.OrganicResults {
+		page.Results = append(page.Results, SearchResult{Title: r.Title, URL: r.Link, Snippet: r.Snippet})
+	}
+	if len(parsed.KnowledgeGraph) > 0 && string(parsed.KnowledgeGraph) != "null" {
+		// A panel that can't be read only costs the panel
+		entity, err := parseKnowledgeGraph(parsed.KnowledgeGraph)
+		if err != nil {
+			slog.WarnContext(ctx, "Error parsing knowledge graph", "engine", q.Engine, "error", err)
+		}
+		page.Entity = entity
+	}
+	if len(parsed.RelatedQuestions) > 0 {
+		page.RelatedQuestions = parseRelatedQuestions(parsed.RelatedQuestions)
+	}
+	return page, nil
+}
+
+// cachedResults is a stored provider answer
+type cachedResults struct {
+	Results          []SearchResult    `json:"results"`
+	Entity           *KnowledgeEntity  `json:"entity,omitempty"`
+	RelatedQuestions []RelatedQuestion `json:"related_questions,omitempty"`
+	FetchedAt        time.Time         `json:"fetched_at"`
+}
+
+// page is the provider answer the entry holds
+func (e *cachedResults) page() *ResultsPage {
+	return &ResultsPage{Results: e.Results, Entity: e.Entity, RelatedQuestions: e.RelatedQuestions}
+}
+
+// ResultsCacheStore keeps provider answers, in memory or in Redis to share
+// them across replicas
+type ResultsCacheStore interface {
+	Get(ctx context.Context, key string) (*cachedResults, error)
+	Set(ctx context.Context, key string, entry *cachedResults, ttl time.Duration) error
+}
+
+// memoryResultsStore is a bounded in-process store; the oldest entries go
+// first when it is full
+type memoryResultsStore struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResults
+	expires map[string]time.Time
+}
+
+func NewMemoryResultsStore(size int) *memoryResultsStore {
+	return &memoryResultsStore{
+		size:    size,
+		entries: make(map[string]*cachedResults),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryResultsStore) Get(ctx context.Context, key string) (*cachedResults, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().After(s.expires[key]) {
+		delete(s.entries, key)
+		delete(s.expires, key)
+		return nil, nil
+	}
+	return s.entries[key], nil
+}
+
+func (s *memoryResultsStore) Set(ctx context.Context, key string, entry *cachedResults, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.size {
+		oldest, oldestAt := "", time.Time{}
+		for k, e := range s.entries {
+			if oldest == "" || e.FetchedAt.Before(oldestAt) {
+				oldest, oldestAt = k, e.FetchedAt
+			}
+		}
+		delete(s.entries, oldest)
+		delete(s.expires, oldest)
+	}
+	s.entries[key] = entry
+	s.expires[key] = time.Now().Add(ttl)
+	return nil
+}
+
+// redisResultsStore shares provider answers across replicas
+type redisResultsStore struct {
+	client *RedisClient
+	prefix string
+}
+
+func NewRedisResultsStore(client *RedisClient) *redisResultsStore {
+	return &redisResultsStore{client: client, prefix: "results:"}
+}
+
+func (s *redisResultsStore) Get(ctx context.Context, key string) (*cachedResults, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply type %T", reply)
+	}
+	var entry cachedResults
+	if err := json.Unmarshal([]byte(v), &entry); err != nil {
+		return nil, fmt.Errorf("error parsing cached results: %v", err)
+	}
+	return &entry, nil
+}
+
+func (s *redisResultsStore) Set(ctx context.Context, key string, entry *cachedResults, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling results: %v", err)
+	}
+	_, err = s.client.Do(ctx, "SET", s.prefix+key, string(data), "PX", fmt.Sprint(ttl.Milliseconds()))
+	return err
+}
+
+// CachingProvider sits in front of a paid results provider, shared by every
+// tenant. Answers are fresh for ttl; for staleFor after that they are still
+// served (stale-while-revalidate) while one background call refreshes them.
+type CachingProvider struct {
+	next     ResultsProvider
+	store    ResultsCacheStore
+	ttl      time.Duration
+	staleFor time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*resultsCall
+}
+
+// resultsCall is a provider call that concurrent misses wait on. It is
+// cancelled once every request waiting on it has gone, unless it refreshes a
+// stale entry, which nobody waits on.
+type resultsCall struct {
+	done chan struct{}
+	page *ResultsPage
+	err  error
+
+	cancel   context.CancelFunc
+	waiters  int
+	detached bool
+}
+
+func NewCachingProvider(next ResultsProvider, store ResultsCacheStore, ttl, staleFor time.Duration) *CachingProvider {
+	return &CachingProvider{
+		next:     next,
+		store:    store,
+		ttl:      ttl,
+		staleFor: staleFor,
+		inflight: make(map[string]*resultsCall),
+	}
+}
+
+// resultsCacheKey identifies a query by its normalized text, engine and locale
+func resultsCacheKey(q ResultsQuery) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(q.Query), " "))
+	sum := sha256.Sum256([]byte(q.Engine + "\x00" + strings.ToLower(q.Locale) + "\x00" + normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Search returns the cached results when there are some, and how they were
+// served: hit, stale or miss
+func (c *CachingProvider) Search(ctx context.Context, q ResultsQuery) ([]SearchResult, string, error) {
+	page, served, err := c.Page(ctx, q)
+	if err != nil {
+		return nil, served, err
+	}
+	return page.Results, served, nil
+}
+
+// Page is Search for the whole answer of the provider
+func (c *CachingProvider) Page(ctx context.Context, q ResultsQuery) (*ResultsPage, string, error) {
+	key := resultsCacheKey(q)
+	entry, err := c.store.Get(ctx, key)
+	if err != nil {
+		// A broken cache must not take search down; go to the provider
+		slog.WarnContext(ctx, "Results cache unavailable", "error", err)
+	}
+	if entry != nil {
+		age := time.Since(entry.FetchedAt)
+		if age < c.ttl {
+			resultsCacheRequests.Inc("hit")
+			return entry.page(), "hit", nil
+		}
+		if age < c.ttl+c.staleFor {
+			resultsCacheRequests.Inc("stale")
+			c.start(ctx, key, q, true)
+			return entry.page(), "stale", nil
+		}
+	}
+
+	resultsCacheRequests.Inc("miss")
+	call := c.start(ctx, key, q, false)
+	select {
+	case <-call.done:
+		return call.page, "miss", call.err
+	case <-ctx.Done():
+		c.leave(key, call)
+		return nil, "miss", ctx.Err()
+	}
+}
+
+// start calls the provider for key unless a call is already running, which
+// is shared instead. The call outlives the request that started it, so other
+// requests waiting on it aren't cancelled along with it; a detached call
+// isn't waited on and runs to the end.
+func (c *CachingProvider) start(ctx context.Context, key string, q ResultsQuery, detached bool) *resultsCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &resultsCall{done: make(chan struct{})}
+		var callCtx context.Context
+		callCtx, call.cancel = context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		c.inflight[key] = call
+		go func() {
+			defer call.cancel()
+			c.fetch(callCtx, key, q, call)
+		}()
+	}
+	if detached {
+		call.detached = true
+	} else {
+		call.waiters++
+	}
+	return call
+}
+
+// leave gives up waiting on a call, cancelling it when it was the last one
+// waiting, so a search abandoned by its client stops paying for results. The
+// cancelled call is forgotten at once: a request for the same results then
+// starts a call of its own rather than share the cancelled one's error.
+func (c *CachingProvider) leave(key string, call *resultsCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call.waiters--
+	if call.waiters == 0 && !call.detached {
+		call.cancel()
+		if c.inflight[key] == call {
+			delete(c.inflight, key)
+		}
+	}
+}
+
+func (c *CachingProvider) fetch(ctx context.Context, key string, q ResultsQuery, call *resultsCall) {
+	defer func() {
+		c.mu.Lock()
+		// Unless leave dropped it and another call took its place
+		if c.inflight[key] == call {
+			delete(c.inflight, key)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	if pages, ok := c.next.(PageProvider); ok {
+		call.page, call.err = pages.SearchPage(ctx, q)
+	} else {
+		var results []SearchResult
+		results, call.err = c.next.Search(ctx, q)
+		call.page = &ResultsPage{Results: results}
+	}
+	if call.err != nil {
+		if ctx.Err() == context.Canceled {
+			resultsProviderRequests.Inc("cancelled")
+			return
+		}
+		resultsProviderRequests.Inc("error")
+		return
+	}
+	resultsProviderRequests.Inc("ok")
+	entry := &cachedResults{
+		Results:          call.page.Results,
+		Entity:           call.page.Entity,
+		RelatedQuestions: call.page.RelatedQuestions,
+		FetchedAt:        time.Now().UTC(),
+	}
+	if err := c.store.Set(ctx, key, entry, c.ttl+c.staleFor); err != nil {
+		slog.WarnContext(ctx, "Error caching results", "error", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// erasureConfirmTTL is how long the confirmation of a user's erasure
+// request is good for
+const erasureConfirmTTL = 10 * time.Minute
+
+var retentionPurged = metricsRegistry.Counter("retention_purged_total",
+	"Records deleted for being past their retention period or on a user's request, by kind.", "kind")
+
+// UserDataEraser deletes everything one kind of storage holds about an end
+// user and returns how many items it removed
+type UserDataEraser func(ctx context.Context, tenantID, userID string) (int, error)
+
+// RetentionJanitor deletes history older than historyFor and operational
+// logs (dead letters, analytics samples) older than logsFor; a zero period
+// keeps that data forever. It also serves the per-user erasure endpoint.
+type RetentionJanitor struct {
+	history     HistoryStore
+	objects     ObjectStore
+	deadLetters *DeadLetterQueue
+	analytics   *AnalyticsSampler
+	historyFor  time.Duration
+	logsFor     time.Duration
+	now         func() time.Time
+	// confirmKey signs erasure confirmations, which don't outlive the process
+	confirmKey []byte
+
+	mu      sync.Mutex
+	erasers map[string]UserDataEraser
+	purgers map[string]DataPurger
+}
+
+// DataPurger deletes one kind of per-user data created before cutoff and
+// returns how many items it removed
+type DataPurger func(ctx context.Context, cutoff time.Time) (int, error)
+
+// NewRetentionJanitor purges the live history store and, when objects is
+// not nil, the history archives in it
+func NewRetentionJanitor(history HistoryStore, objects ObjectStore, deadLetters *DeadLetterQueue, analytics *AnalyticsSampler, historyFor, logsFor time.Duration) *RetentionJanitor {
+	j := &RetentionJanitor{
+		history:     history,
+		objects:     objects,
+		deadLetters: deadLetters,
+		analytics:   analytics,
+		historyFor:  historyFor,
+		logsFor:     logsFor,
+		now:         time.Now,
+		confirmKey:  make([]byte, 32),
+		erasers:     make(map[string]UserDataEraser),
+		purgers:     make(map[string]DataPurger),
+	}
+	rand.Read(j.confirmKey)
+	j.AddEraser("history", func(ctx context.Context, tenantID, userID string) (int, error) {
+		n, err := history.DeleteAllOwned(ctx, tenantID, userID)
+		if err != nil {
+			return n, err
+		}
+		return n, history.SetRecording(ctx, tenantID, userID, false)
+	})
+	if objects != nil {
+		j.AddEraser("archived_history", j.eraseArchived)
+	}
+	return j
+}
+
+// AddEraser registers the storage of another feature for user erasure
+func (j *RetentionJanitor) AddEraser(kind string, erase UserDataEraser) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.erasers[kind] = erase
+}
+
+// AddPurger puts data derived from history under the history retention
+// period
+func (j *RetentionJanitor) AddPurger(kind string, purge DataPurger) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.purgers[kind] = purge
+}
+
+// Purge deletes everything past its retention period and returns the counts
+// by kind
+func (j *RetentionJanitor) Purge(ctx context.Context) (map[string]int, error) {
+	purged := make(map[string]int)
+	now := j.now()
+	if j.logsFor > 0 {
+		cutoff := now.Add(-j.logsFor)
+		purged["dead_letters"] = j.deadLetters.PurgeBefore(cutoff)
+		purged["analytics_samples"] = j.analytics.PurgeBefore(cutoff)
+	}
+	if j.historyFor > 0 {
+		cutoff := now.Add(-j.historyFor)
+		n, err := j.purgeHistory(ctx, cutoff)
+		purged["history"] = n
+		if err != nil {
+			return purged, err
+		}
+		if j.objects != nil {
+			n, err := j.purgeArchives(ctx, cutoff)
+			purged["archived_history"] = n
+			if err != nil {
+				return purged, err
+			}
+		}
+		j.mu.Lock()
+		purgers := maps.Clone(j.purgers)
+		j.mu.Unlock()
+		for kind, purge := range purgers {
+			n, err := purge(ctx, cutoff)
+			purged[kind] = n
+			if err != nil {
+				return purged, fmt.Errorf("error purging %s: %v", kind, err)
+			}
+		}
+	}
+	for kind, n := range purged {
+		retentionPurged.Add(float64(n), kind)
+	}
+	return purged, nil
+}
+
+func (j *RetentionJanitor) purgeHistory(ctx context.Context, cutoff time.Time) (int, error) {
+	total := 0
+	for {
+		records, err := j.history.ListOlderThan(ctx, cutoff, historyArchiveBatch)
+		if err != nil {
+			return total, fmt.Errorf("error listing expired history: %v", err)
+		}
+		if len(records) == 0 {
+			return total, nil
+		}
+		ids := make([]string, len(records))
+		for i, rec := range records {
+			ids[i] = rec.ID
+		}
+		if err := j.history.Delete(ctx, ids); err != nil {
+			return total, fmt.Errorf("error deleting expired history: %v", err)
+		}
+		total += len(records)
+		if len(records) < historyArchiveBatch {
+			return total, nil
+		}
+	}
+}
+
+// purgeArchives deletes archive objects whose whole day is before cutoff.
+// Archives are grouped by day, so that is decidable from the key alone.
+func (j *RetentionJanitor) purgeArchives(ctx context.Context, cutoff time.Time) (int, error) {
+	keys, err := j.objects.List(ctx, historyArchivePrefix)
+	if err != nil {
+		return 0, fmt.Errorf("error listing archives: %v", err)
+	}
+	n := 0
+	for _, key := range keys {
+		// history/<tenant>/<day>/<unique>.json.gz
+		parts := strings.Split(strings.TrimPrefix(key, historyArchivePrefix), "/")
+		if len(parts) != 3 {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", parts[1])
+		if err != nil || day.Add(24*time.Hour).After(cutoff) {
+			continue
+		}
+		if err := j.objects.Delete(ctx, key); err != nil {
+			return n, fmt.Errorf("error deleting archive %s: %v", key, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// eraseArchived rewrites the tenant's archives without the user's records
+func (j *RetentionJanitor) eraseArchived(ctx context.Context, tenantID, userID string) (int, error) {
+	keys, err := j.objects.List(ctx, historyArchivePrefix+url.PathEscape(tenantID)+"/")
+	if err != nil {
+		return 0, fmt.Errorf("error listing archives: %v", err)
+	}
+	total := 0
+	for _, key := range keys {
+		data, err := j.objects.Get(ctx, key)
+		if err != nil {
+			return total, fmt.Errorf("error reading archive %s: %v", key, err)
+		}
+		records, err := decodeHistoryArchive(data)
+		if err != nil {
+			return total, fmt.Errorf("error decoding archive %s: %v", key, err)
+		}
+		kept := make([]*HistoryRecord, 0, len(records))
+		for _, rec := range records {
+			if rec.UserID != userID {
+				kept = append(kept, rec)
+			}
+		}
+		if len(kept) == len(records) {
+			continue
+		}
+		if len(kept) == 0 {
+			err = j.objects.Delete(ctx, key)
+		} else if data, err = encodeHistoryArchive(kept); err == nil {
+			err = j.objects.Put(ctx, key, data)
+		}
+		if err != nil {
+			return total, fmt.Errorf("error rewriting archive %s: %v", key, err)
+		}
+		total += len(records) - len(kept)
+	}
+	return total, nil
+}
+
+// Run purges every interval until ctx is cancelled
+func (j *RetentionJanitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := j.Purge(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Retention purge failed", "error", err)
+		}
+		if n := sumCounts(purged); n > 0 {
+			slog.InfoContext(ctx, "Purged expired data", "purged", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
+
+// erasureConfirmation signs a confirmation of the user's erasure that
+// expires at the given time, as "<unix time>.<HMAC>"
+func (j *RetentionJanitor) erasureConfirmation(tenantID, userID string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, j.confirmKey)
+	mac.Write([]byte(tenantID + "\x00" + userID + "\x00" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validConfirmation tells whether a confirmation was issued to this user
+// and hasn't expired
+func (j *RetentionJanitor) validConfirmation(tenantID, userID, confirm string) bool {
+	exp, _, ok := strings.Cut(confirm, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if !ok || err != nil || !j.now().Before(time.Unix(unix, 0)) {
+		return false
+	}
+	want := j.erasureConfirmation(tenantID, userID, time.Unix(unix, 0))
+	return hmac.Equal([]byte(confirm), []byte(want))
+}
+
+// handleEraseUser deletes everything stored about the calling end user
+// (DELETE), as the GDPR right to erasure requires. The user is the
+// authenticated one, and erasure takes two requests: the first answers a
+// confirmation token, which the second sends back as ?confirm= within
+// erasureConfirmTTL, so a stray or replayed request erases nothing.
+func (j *RetentionJanitor) handleEraseUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	confirm := r.URL.Query().Get("confirm")
+	if confirm == "" {
+		expires := j.now().Add(erasureConfirmTTL).Truncate(time.Second)
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":      "confirmation_required",
+			"confirm":    j.erasureConfirmation(tenantID, userID, expires),
+			"expires_at": expires.UTC(),
+		})
+		return
+	}
+	if !j.validConfirmation(tenantID, userID, confirm) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_confirmation"})
+		return
+	}
+
+	j.mu.Lock()
+	erasers := maps.Clone(j.erasers)
+	j.mu.Unlock()
+
+	deleted := make(map[string]int, len(erasers))
+	for _, kind := range slices.Sorted(maps.Keys(erasers)) {
+		n, err := erasers[kind](r.Context(), tenantID, userID)
+		if err != nil {
+			// Stop at the first failure; erasure is idempotent, so the
+			// client retries the whole request
+			slog.ErrorContext(r.Context(), "Error erasing user data", "tenant", tenantID, "kind", kind, "error", err)
+			http.Error(w, "Error deleting data, please retry", http.StatusInternalServerError)
+			return
+		}
+		deleted[kind] = n
+		retentionPurged.Add(float64(n), kind)
+	}
+	// The user ID is not logged: after erasure nothing should tie it to the tenant
+	slog.InfoContext(r.Context(), "User data erased", "tenant", tenantID, "deleted", deleted)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": deleted})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robotsRules are the rules of a robots.txt that apply to the crawler
+type robotsRules struct {
+	allow    []string
+	disallow []string
+	// delay is the Crawl-delay asked for, zero when none
+	delay time.Duration
+}
+
+// parseRobots reads the group of robots.txt for userAgent, or the * group
+// when none names it, as RFC 9309 describes
+func parseRobots(data, userAgent string) *robotsRules {
+	agent := strings.ToLower(userAgent)
+	if i := strings.IndexAny(agent, "/ "); i >= 0 {
+		agent = agent[:i]
+	}
+	groups := make(map[string]*robotsRules)
+	var current []*robotsRules
+	// A user-agent line after rules starts a new group
+	inRules := false
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				current, inRules = nil, false
+			}
+			name := strings.ToLower(value)
+			if groups[name] == nil {
+				groups[name] = &robotsRules{}
+			}
+			current = append(current, groups[name])
+		case "allow", "disallow", "crawl-delay":
+			inRules = true
+			for _, g := range current {
+				switch key {
+				case "allow":
+					if value != "" {
+						g.allow = append(g.allow, value)
+					}
+				case "disallow":
+					// An empty Disallow allows everything
+					if value != "" {
+						g.disallow = append(g.disallow, value)
+					}
+				case "crawl-delay":
+					if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+						g.delay = time.Duration(secs * float64(time.Second))
+					}
+				}
+			}
+		}
+	}
+	if g, ok := groups[agent]; ok {
+		return g
+	}
+	if g, ok := groups["*"]; ok {
+		return g
+	}
+	return &robotsRules{}
+}
+
+// Allowed tells whether the path (with its query) may be fetched: the
+// longest matching rule wins, Allow on a tie
+func (r *robotsRules) Allowed(path string) bool {
+	best, allowed := -1, true
+	for _, rule := range r.allow {
+		if robotsMatch(rule, path) && len(rule) >= best {
+			best, allowed = len(rule), true
+		}
+	}
+	for _, rule := range r.disallow {
+		if robotsMatch(rule, path) && len(rule) > best {
+			best, allowed = len(rule), false
+		}
+	}
+	return allowed
+}
+
+// robotsMatch matches a rule against a path; * matches any run of
+// characters and a final $ anchors the rule at the end
+func robotsMatch(rule, path string) bool {
+	anchored := strings.HasSuffix(rule, "$")
+	rule = strings.TrimSuffix(rule, "$")
+	parts := strings.Split(rule, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
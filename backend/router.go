@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Model routes
+const (
+	RouteDefault    = "default" // router disabled, single configured model
+	RouteCheap      = "cheap"
+	RouteCapable    = "capable"
+	RouteOverride   = "override"   // model requested by the client
+	RouteExperiment = "experiment" // model of an experiment variant
+)
+
+var (
+	routeRequests = metricsRegistry.Counter("search_model_route_requests_total",
+		"Prompts analyzed per model route.", "route", "model")
+	routeFailures = metricsRegistry.Counter("search_model_route_failures_total",
+		"Failed analyses per model route.", "route", "model")
+	routeLatency = metricsRegistry.Histogram("search_model_route_latency_seconds",
+		"OpenAI analysis latency per model route.", defaultLatencyBuckets, "route")
+	promptComplexityScores = metricsRegistry.Histogram("search_prompt_complexity_score",
+		"Complexity scores of incoming prompts, for tuning MODEL_ROUTER_THRESHOLD.",
+		[]float64{0, 1, 2, 3, 4, 5, 6, 8})
+)
+
+// ModelRouter sends simple prompts to a cheap model and complex ones to a
+// stronger model, based on a deterministic complexity score
+type ModelRouter struct {
+	enabled      bool
+	defaultModel string
+	cheapModel   string
+	capableModel string
+	threshold    int
+}
+
+func NewModelRouter(enabled bool, defaultModel, cheapModel, capableModel string, threshold int) *ModelRouter {
+	return &ModelRouter{
+		enabled:      enabled,
+		defaultModel: defaultModel,
+		cheapModel:   cheapModel,
+		capableModel: capableModel,
+		threshold:    threshold,
+	}
+}
+
+// Enabled reports whether routing is on by configuration
+func (mr *ModelRouter) Enabled() bool {
+	return mr.enabled
+}
+
+// Route picks the route and model for a prompt; enabled is the router
+// setting for the request, which a feature flag may have changed
+func (mr *ModelRouter) Route(prompt string, enabled bool) (route, model string) {
+	if !enabled {
+		return RouteDefault, mr.defaultModel
+	}
+
+	score := promptComplexity(prompt)
+	promptComplexityScores.Observe(float64(score))
+	if score >= mr.threshold {
+		return RouteCapable, mr.capableModel
+	}
+	return RouteCheap, mr.cheapModel
+}
+
+var (
+	operatorHintRes = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\bsite:|\b(?:from|on|at)\s+(?:[a-z0-9-]+\.)+[a-z]{2,}\b`), // site filter
+		regexp.MustCompile(`(?i)\b(?:filetype:|pdf|docx?|pptx?|xlsx?|csv|slides|spreadsheet)\b`),
+		regexp.MustCompile(`(?i)(?:^|\s)-\w|\b(?:without|excluding|except|but not|no)\s+\w`),
+		regexp.MustCompile(`(?i)\b(?:last|past|since|after|before|between|recent|latest|today|yesterday|(?:19|20)\d{2})\b`),
+		regexp.MustCompile(`"[^"]+"`),
+	}
+	ambiguityRe = regexp.MustCompile(`(?i)\b(?:or|either|vs\.?|versus|compare|comparison|difference|maybe|something like|kind of)\b`)
+)
+
+// promptComplexity scores how hard a prompt is to analyze: long prompts, many
+// kinds of operators and ambiguous or non-English phrasing each add points
+func promptComplexity(prompt string) int {
+	score := 0
+
+	words := len(strings.Fields(prompt))
+	switch {
+	case words > 50:
+		score += 3
+	case words > 25:
+		score += 2
+	case words > 12:
+		score++
+	}
+
+	for _, re := range operatorHintRes {
+		if re.MatchString(prompt) {
+			score++
+		}
+	}
+
+	if ambiguityRe.MatchString(prompt) || strings.Count(prompt, "?") > 1 {
+		score++
+	}
+
+	for _, r := range prompt {
+		if r > unicode.MaxASCII && unicode.IsLetter(r) {
+			score++
+			break
+		}
+	}
+	return score
+}
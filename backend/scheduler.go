@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job priorities; higher runs first
+const (
+	PriorityLow    = 0
+	PriorityNormal = 50
+	PriorityHigh   = 100
+)
+
+const (
+	// defaultMaxAttempts applies to jobs that don't set MaxAttempts
+	defaultMaxAttempts = 3
+	retryBackoff       = time.Minute
+)
+
+// Job is a unit of non-urgent background work (alerts, re-crawls, imports).
+// The scheduler runs it in a low-traffic window once enough budget remains,
+// or as soon as possible once its deadline has passed.
+type Job struct {
+	ID               string    `json:"id"`
+	Kind             string    `json:"kind"`
+	Description      string    `json:"description,omitempty"`
+	Priority         int       `json:"priority"`
+	EstimatedCostUSD float64   `json:"estimated_cost_usd"`
+	NotBefore        time.Time `json:"not_before,omitempty"`
+	Deadline         time.Time `json:"deadline,omitempty"`
+	SubmittedAt      time.Time `json:"submitted_at"`
+	// Failed jobs are retried with exponential backoff, then dead-lettered
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	Attempts    int `json:"attempts"`
+
+	Run func(ctx context.Context) error `json:"-"`
+}
+
+// PlannedJob is a pending job with the reason it's waiting
+type PlannedJob struct {
+	*Job
+	Position int    `json:"position"`
+	Status   string `json:"status"` // "ready", "waiting_window", "waiting_quota", "not_before"
+}
+
+// TimeWindow is a daily window in the scheduler's time zone; it may wrap midnight
+type TimeWindow struct {
+	Start, End time.Duration // offsets from midnight
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// ParseTimeWindows parses "01:00-06:00,22:30-23:30"
+func ParseTimeWindows(spec string) ([]TimeWindow, error) {
+	var windows []TimeWindow
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", part)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, TimeWindow{Start: start, End: end})
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+var (
+	schedulerJobs = metricsRegistry.Counter("scheduler_jobs_total",
+		"Background jobs finished, by kind and outcome.", "kind", "outcome")
+	schedulerPending = metricsRegistry.Gauge("scheduler_pending_jobs",
+		"Background jobs waiting to run.")
+)
+
+// JobScheduler holds background jobs until traffic and quota allow them to run
+type JobScheduler struct {
+	windows  []TimeWindow
+	location *time.Location
+	limiter  *UpstreamLimiter
+	budget   *BudgetTracker
+	dead     *DeadLetterQueue
+	interval time.Duration
+	now      Clock
+
+	mu      sync.Mutex
+	pending map[string]*Job
+	running map[string]*Job
+	wake    chan struct{}
+}
+
+func NewJobScheduler(windows []TimeWindow, location *time.Location, limiter *UpstreamLimiter, budget *BudgetTracker, dead *DeadLetterQueue, interval time.Duration) *JobScheduler {
+	return &JobScheduler{
+		windows:  windows,
+		location: location,
+		limiter:  limiter,
+		budget:   budget,
+		dead:     dead,
+		interval: interval,
+		now:      time.Now,
+		pending:  make(map[string]*Job),
+		running:  make(map[string]*Job),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// UseClock replaces the scheduler's clock, which decides the windows,
+// deadlines and retry times; call it before Run
+func (s *JobScheduler) UseClock(now Clock) {
+	s.now = now
+}
+
+// Submit queues a job. A job with the same ID replaces the pending one.
+func (s *JobScheduler) Submit(job *Job) {
+	s.mu.Lock()
+	if job.ID == "" {
+		job.ID = newHistoryID()
+	}
+	if job.SubmittedAt.IsZero() {
+		job.SubmittedAt = s.now()
+	}
+	s.pending[job.ID] = job
+	schedulerPending.Set(float64(len(s.pending)))
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches jobs until ctx is cancelled, one at a time so batch work never
+// competes with itself for upstream capacity
+func (s *JobScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			job := s.next(ctx)
+			if job == nil {
+				break
+			}
+			s.execute(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *JobScheduler) execute(ctx context.Context, job *Job) {
+	start := s.now()
+	err := job.Run(ctx)
+
+	maxAttempts := job.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	// The plan and the admin API read jobs under the lock
+	s.mu.Lock()
+	delete(s.running, job.ID)
+	attempts := job.Attempts
+	if err != nil {
+		job.Attempts++
+		attempts = job.Attempts
+		if attempts < maxAttempts {
+			job.NotBefore = s.now().Add(retryBackoff << (attempts - 1))
+		}
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		schedulerJobs.Inc(job.Kind, "ok")
+		return
+	}
+
+	slog.Warn("Background job failed", "job", job.ID, "kind", job.Kind, "duration", s.now().Sub(start),
+		"attempt", attempts, "max_attempts", maxAttempts, "error", err)
+	if attempts < maxAttempts {
+		schedulerJobs.Inc(job.Kind, "retry")
+		s.Submit(job)
+		return
+	}
+	schedulerJobs.Inc(job.Kind, "dead_letter")
+	s.dead.Add(job, err, s.now())
+}
+
+// next removes and returns the first runnable job of the plan
+func (s *JobScheduler) next(ctx context.Context) *Job {
+	plan := s.Plan(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range plan {
+		if p.Status != "ready" {
+			continue
+		}
+		// The plan has copies, the job itself is the pending one
+		job, ok := s.pending[p.ID]
+		if !ok {
+			continue
+		}
+		delete(s.pending, p.ID)
+		s.running[p.ID] = job
+		schedulerPending.Set(float64(len(s.pending)))
+		return job
+	}
+	return nil
+}
+
+// Plan returns the pending jobs in the order they'll run and why each waits.
+// Overdue jobs go first, then by priority, then by deadline and submission.
+// The jobs are copies taken under the lock, which the caller may read freely.
+func (s *JobScheduler) Plan(ctx context.Context) []PlannedJob {
+	now := s.now()
+	inWindow := s.inWindow(now) || s.quiet()
+	remaining := s.budget.Remaining(ctx)
+
+	s.mu.Lock()
+	jobs := s.snapshot(s.pending)
+	s.mu.Unlock()
+
+	overdue := func(j *Job) bool { return !j.Deadline.IsZero() && now.After(j.Deadline) }
+	sort.Slice(jobs, func(a, b int) bool {
+		ja, jb := jobs[a], jobs[b]
+		if overdue(ja) != overdue(jb) {
+			return overdue(ja)
+		}
+		if ja.Priority != jb.Priority {
+			return ja.Priority > jb.Priority
+		}
+		if !ja.Deadline.Equal(jb.Deadline) {
+			return !ja.Deadline.IsZero() && (jb.Deadline.IsZero() || ja.Deadline.Before(jb.Deadline))
+		}
+		return ja.SubmittedAt.Before(jb.SubmittedAt)
+	})
+
+	plan := make([]PlannedJob, len(jobs))
+	for i, j := range jobs {
+		status := "ready"
+		switch {
+		case now.Before(j.NotBefore):
+			status = "not_before"
+		case overdue(j):
+			// Late work runs regardless of traffic, but never beyond the budget
+			if j.EstimatedCostUSD > remaining {
+				status = "waiting_quota"
+			}
+		case !inWindow:
+			status = "waiting_window"
+		case j.EstimatedCostUSD > remaining:
+			status = "waiting_quota"
+		}
+		if status == "ready" {
+			remaining -= j.EstimatedCostUSD
+		}
+		plan[i] = PlannedJob{Job: j, Position: i + 1, Status: status}
+	}
+	return plan
+}
+
+// snapshot copies jobs; the caller holds the lock
+func (s *JobScheduler) snapshot(jobs map[string]*Job) []*Job {
+	out := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		c := *j
+		out = append(out, &c)
+	}
+	return out
+}
+
+// Reprioritize changes a pending job's priority and optionally its deadline
+func (s *JobScheduler) Reprioritize(id string, priority int, deadline *time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.pending[id]
+	if !ok {
+		return false
+	}
+	job.Priority = priority
+	if deadline != nil {
+		job.Deadline = *deadline
+	}
+	return true
+}
+
+// Cancel drops a pending job
+func (s *JobScheduler) Cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[id]; !ok {
+		return false
+	}
+	delete(s.pending, id)
+	schedulerPending.Set(float64(len(s.pending)))
+	return true
+}
+
+func (s *JobScheduler) inWindow(now time.Time) bool {
+	local := now.In(s.location)
+	for _, w := range s.windows {
+		if w.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// quiet reports whether interactive traffic is low enough to borrow capacity
+// outside the configured windows: nobody queued, at most a quarter of the slots used
+func (s *JobScheduler) quiet() bool {
+	inFlight, waiting := s.limiter.Load()
+	return waiting == 0 && inFlight*4 <= s.limiter.maxConcurrent
+}
+
+// handlePlan serves GET (inspect) and POST (reprioritize or cancel) on the plan
+func (s *JobScheduler) handlePlan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := s.now()
+		s.mu.Lock()
+		running := s.snapshot(s.running)
+		s.mu.Unlock()
+
+		remaining := s.budget.Remaining(r.Context())
+		var remainingJSON interface{} = remaining
+		if math.IsInf(remaining, 1) {
+			remainingJSON = nil
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"in_window":            s.inWindow(now),
+			"quiet":                s.quiet(),
+			"remaining_budget_usd": remainingJSON,
+			"running":              running,
+			"pending":              s.Plan(r.Context()),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			ID       string     `json:"id"`
+			Priority *int       `json:"priority"`
+			Deadline *time.Time `json:"deadline"`
+			Cancel   bool       `json:"cancel"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var ok bool
+		if req.Cancel {
+			ok = s.Cancel(req.ID)
+		} else {
+			if req.Priority == nil {
+				http.Error(w, "Missing priority", http.StatusBadRequest)
+				return
+			}
+			ok = s.Reprioritize(req.ID, *req.Priority, req.Deadline)
+		}
+		if !ok {
+			http.Error(w, "Job not found or already running", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"pending": s.Plan(r.Context())})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobSchedulerRetry(t *testing.T) {
+	clock := newFakeClock()
+	s := NewJobScheduler([]TimeWindow{{Start: 0, End: 24 * time.Hour}}, time.UTC, NewUpstreamLimiter(4, 4, time.Second, false),
+		NewBudgetTracker(NewMemorySpendStore(), 0, 0, ""), NewDeadLetterQueue(), time.Minute)
+	s.UseClock(clock.Now)
+	ctx := context.Background()
+
+	runs := 0
+	s.Submit(&Job{ID: "flaky", Kind: "test", MaxAttempts: 3, Run: func(context.Context) error {
+		runs++
+		return errors.New("upstream down")
+	}})
+
+	// Each failure waits twice as long as the one before, then the job is
+	// dead-lettered
+	for attempt, backoff := range []time.Duration{retryBackoff, 2 * retryBackoff} {
+		job := s.next(ctx)
+		if job == nil {
+			t.Fatalf("attempt %d: no job ready", attempt+1)
+		}
+		s.execute(ctx, job)
+		if job.Attempts != attempt+1 || !job.NotBefore.Equal(clock.Now().Add(backoff)) {
+			t.Fatalf("attempt %d: attempts %d, not before %v, want %v", attempt+1, job.Attempts, job.NotBefore, clock.Now().Add(backoff))
+		}
+		clock.Advance(backoff - time.Second)
+		if s.next(ctx) != nil {
+			t.Fatalf("attempt %d: job retried before its backoff", attempt+1)
+		}
+		clock.Advance(time.Second)
+	}
+	job := s.next(ctx)
+	if job == nil {
+		t.Fatal("last attempt: no job ready")
+	}
+	s.execute(ctx, job)
+	if runs != 3 {
+		t.Errorf("job ran %d times, want 3", runs)
+	}
+	letters := s.dead.List("test")
+	if len(letters) != 1 || !letters[0].FailedAt.Equal(clock.Now()) {
+		t.Errorf("dead letters = %+v, want the job failed at %v", letters, clock.Now())
+	}
+	if plan := s.Plan(ctx); len(plan) != 0 {
+		t.Errorf("plan = %+v, want nothing pending", plan)
+	}
+}
@@ -0,0 +1,155 @@
+// Package searchtool exposes the smart search backend to Go LLM frameworks.
+//
+// Client talks to a running server over HTTP. Tool satisfies the LangChainGo
+// tools.Tool interface without importing it, and the framework specific
+// retriever and Genkit helpers live behind the "langchaingo" and "genkit"
+// build tags so the package builds without those dependencies.
+package searchtool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Intent mirrors the SearchIntent returned by the backend
+type Intent struct {
+	MainQuery    string   `json:"main_query"`
+	ExactPhrases []string `json:"exact_phrases,omitempty"`
+	SiteFilter   string   `json:"site_filter,omitempty"`
+	FileType     string   `json:"file_type,omitempty"`
+	ExcludeWords []string `json:"exclude_words,omitempty"`
+	DateRange    string   `json:"date_range,omitempty"`
+}
+
+// SearchResult is the outcome of a web_search call
+type SearchResult struct {
+	SearchURL string `json:"search_url"`
+	Query     string `json:"query"`
+}
+
+// SearchResponse is the combined answer of the /search endpoint
+type SearchResponse struct {
+	SearchURL string  `json:"search_url"`
+	Intent    *Intent `json:"intent"`
+}
+
+// Client calls the backend's search and tool endpoints
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the server at baseURL, e.g. "http://localhost:8080"
+func NewClient(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// SetProxy routes the client through an http(s):// or socks5(h):// proxy.
+// Without it, HTTPS_PROXY and NO_PROXY from the environment apply.
+func (c *Client) SetProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("searchtool: invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("searchtool: unsupported proxy scheme %q", u.Scheme)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	c.HTTPClient.Transport = transport
+	return nil
+}
+
+// Analyze returns the structured intent for a natural language prompt
+func (c *Client) Analyze(ctx context.Context, prompt string) (*Intent, error) {
+	var out struct {
+		Intent *Intent `json:"intent"`
+	}
+	if err := c.call(ctx, "analyze_search", prompt, &out); err != nil {
+		return nil, err
+	}
+	if out.Intent == nil {
+		return nil, fmt.Errorf("searchtool: response has no intent")
+	}
+	return out.Intent, nil
+}
+
+// WebSearch returns the optimized search URL for a natural language prompt
+func (c *Client) WebSearch(ctx context.Context, prompt string) (*SearchResult, error) {
+	var out SearchResult
+	if err := c.call(ctx, "web_search", prompt, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Search returns both the intent and the search URL in a single analysis
+func (c *Client) Search(ctx context.Context, prompt string) (*SearchResponse, error) {
+	var out SearchResponse
+	if err := c.post(ctx, "/search", map[string]string{"prompt": prompt}, &out); err != nil {
+		return nil, err
+	}
+	if out.Intent == nil {
+		return nil, fmt.Errorf("searchtool: response has no intent")
+	}
+	return &out, nil
+}
+
+func (c *Client) call(ctx context.Context, tool, prompt string, out interface{}) error {
+	return c.post(ctx, "/v1/tools/call", map[string]interface{}{
+		"name":      tool,
+		"arguments": map[string]string{"prompt": prompt},
+	}, out)
+}
+
+func (c *Client) post(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("searchtool: error marshaling request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("searchtool: error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("searchtool: error calling %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("searchtool: error reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("searchtool: %s failed with status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("searchtool: error parsing response: %v", err)
+	}
+	return nil
+}
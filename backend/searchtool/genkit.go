@@ -0,0 +1,30 @@
+//go:build genkit
+
+package searchtool
+
+import (
+	"github.com/firebase/genkit/go/ai"
+	"github.com/firebase/genkit/go/genkit"
+)
+
+// PromptInput is the tool input schema registered with Genkit
+type PromptInput struct {
+	Prompt string `json:"prompt" jsonschema_description:"What the user is looking for, in natural language"`
+}
+
+// DefineTools registers analyze_search and web_search on a Genkit instance
+func DefineTools(g *genkit.Genkit, c *Client) []ai.Tool {
+	analyze := genkit.DefineTool(g, "analyze_search",
+		"Extracts structured search parameters (main query, exact phrases, site, file type, excluded words, date range) from a natural language request.",
+		func(ctx *ai.ToolContext, in PromptInput) (*Intent, error) {
+			return c.Analyze(ctx, in.Prompt)
+		})
+
+	search := genkit.DefineTool(g, "web_search",
+		"Builds an optimized web search URL for a natural language request.",
+		func(ctx *ai.ToolContext, in PromptInput) (*SearchResult, error) {
+			return c.WebSearch(ctx, in.Prompt)
+		})
+
+	return []ai.Tool{analyze, search}
+}
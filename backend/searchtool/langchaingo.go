@@ -0,0 +1,46 @@
+//go:build langchaingo
+
+package searchtool
+
+import (
+	"context"
+
+	"github.com/tmc/langchaingo/schema"
+	"github.com/tmc/langchaingo/tools"
+)
+
+var _ tools.Tool = (*Tool)(nil)
+var _ schema.Retriever = (*Retriever)(nil)
+
+// Retriever implements LangChainGo's schema.Retriever, returning the search
+// the backend built for the query as a document
+type Retriever struct {
+	client *Client
+}
+
+// NewRetriever wraps the client as a retriever for retrieval chains
+func NewRetriever(c *Client) *Retriever {
+	return &Retriever{client: c}
+}
+
+// GetRelevantDocuments analyzes the query and returns one document describing the search
+func (r *Retriever) GetRelevantDocuments(ctx context.Context, query string) ([]schema.Document, error) {
+	res, err := r.client.Search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	intent := res.Intent
+
+	return []schema.Document{{
+		PageContent: intent.MainQuery,
+		Metadata: map[string]any{
+			"source":        res.SearchURL,
+			"exact_phrases": intent.ExactPhrases,
+			"site_filter":   intent.SiteFilter,
+			"file_type":     intent.FileType,
+			"exclude_words": intent.ExcludeWords,
+			"date_range":    intent.DateRange,
+		},
+		Score: 1,
+	}}, nil
+}
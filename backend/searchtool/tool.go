@@ -0,0 +1,66 @@
+package searchtool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Tool wraps the backend as a single text-in/text-out tool. Its method set
+// matches LangChainGo's tools.Tool, so it can be appended to an agent's tools
+// as is:
+//
+//	agents.NewOneShotAgent(llm, []tools.Tool{searchtool.NewWebSearchTool(client)})
+type Tool struct {
+	client      *Client
+	name        string
+	description string
+	run         func(ctx context.Context, c *Client, input string) (string, error)
+}
+
+// NewWebSearchTool returns a tool answering with an optimized search URL
+func NewWebSearchTool(c *Client) *Tool {
+	return &Tool{
+		client:      c,
+		name:        "web_search",
+		description: "Builds an optimized web search URL for a natural language request. Input should be what you are looking for, e.g. \"PDF papers about transformers on arxiv from last year\".",
+		run: func(ctx context.Context, c *Client, input string) (string, error) {
+			res, err := c.WebSearch(ctx, input)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Search URL: %s\nQuery: %s", res.SearchURL, res.Query), nil
+		},
+	}
+}
+
+// NewAnalyzeSearchTool returns a tool answering with the parsed intent as JSON
+func NewAnalyzeSearchTool(c *Client) *Tool {
+	return &Tool{
+		client:      c,
+		name:        "analyze_search",
+		description: "Extracts structured search parameters (main query, exact phrases, site, file type, excluded words, date range) from a natural language request. Input should be the request text; output is JSON.",
+		run: func(ctx context.Context, c *Client, input string) (string, error) {
+			intent, err := c.Analyze(ctx, input)
+			if err != nil {
+				return "", err
+			}
+			out, err := json.Marshal(intent)
+			if err != nil {
+				return "", fmt.Errorf("searchtool: error encoding intent: %v", err)
+			}
+			return string(out), nil
+		},
+	}
+}
+
+// Name returns the tool name shown to the model
+func (t *Tool) Name() string { return t.name }
+
+// Description tells the model when and how to use the tool
+func (t *Tool) Description() string { return t.description }
+
+// Call runs the tool on the model supplied input
+func (t *Tool) Call(ctx context.Context, input string) (string, error) {
+	return t.run(ctx, t.client, input)
+}
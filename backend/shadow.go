@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shadow comparison results
+const (
+	ShadowMatch    = "match"
+	ShadowDiverged = "diverged"
+	ShadowError    = "error"
+	ShadowSkipped  = "skipped"
+)
+
+const (
+	// shadowTimeout bounds a background analysis; nobody waits for it
+	shadowTimeout = 30 * time.Second
+	// maxShadowSamples is how many recent divergences the admin API shows
+	maxShadowSamples = 100
+)
+
+var (
+	shadowComparisons = metricsRegistry.Counter("shadow_comparisons_total",
+		"Analyses sent to the shadow candidate, by result (match, diverged, error, skipped).", "result")
+	shadowFieldDivergence = metricsRegistry.Counter("shadow_field_divergence_total",
+		"Intent fields on which the shadow candidate disagreed with production, by field.", "field")
+)
+
+// intentFields are the fields intentFieldDiff compares, in JSON names
+var intentFields = []string{"main_query", "exact_phrases", "site_filter", "file_type", "exclude_words", "date_range"}
+
+// intentFieldDiff returns the JSON names of the fields on which two intents
+// disagree. Queries compare without case and extra spaces, phrase and word
+// lists as sets.
+func intentFieldDiff(a, b *SearchIntent) []string {
+	if a == nil {
+		a = &SearchIntent{}
+	}
+	if b == nil {
+		b = &SearchIntent{}
+	}
+	var diff []string
+	if normalizedText(a.MainQuery) != normalizedText(b.MainQuery) {
+		diff = append(diff, "main_query")
+	}
+	if !sameTextSet(a.ExactPhrases, b.ExactPhrases) {
+		diff = append(diff, "exact_phrases")
+	}
+	if !strings.EqualFold(strings.TrimSpace(a.SiteFilter), strings.TrimSpace(b.SiteFilter)) {
+		diff = append(diff, "site_filter")
+	}
+	if !strings.EqualFold(strings.TrimPrefix(a.FileType, "."), strings.TrimPrefix(b.FileType, ".")) {
+		diff = append(diff, "file_type")
+	}
+	if !sameTextSet(a.ExcludeWords, b.ExcludeWords) {
+		diff = append(diff, "exclude_words")
+	}
+	if strings.TrimSpace(a.DateRange) != strings.TrimSpace(b.DateRange) {
+		diff = append(diff, "date_range")
+	}
+	return diff
+}
+
+func normalizedText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+func sameTextSet(a, b []string) bool {
+	set := func(values []string) []string {
+		out := make([]string, 0, len(values))
+		for _, v := range values {
+			if v = normalizedText(v); v != "" {
+				out = append(out, v)
+			}
+		}
+		slices.Sort(out)
+		return slices.Compact(out)
+	}
+	return slices.Equal(set(a), set(b))
+}
+
+// AnalyzeFunc runs one analysis with the given system prompt and model
+type AnalyzeFunc func(ctx context.Context, prompt, system, model string, temperature float64, examples []*fewShotExample) (*SearchIntent, error)
+
+// shadowRequest is a served analysis to repeat with the candidate
+type shadowRequest struct {
+	prompt      string
+	vertical    string
+	locale      string
+	now         time.Time
+	model       string
+	prompts     *PromptTemplate
+	temperature float64
+	examples    []*fewShotExample
+	intent      *SearchIntent
+}
+
+// ShadowDivergence is a recent analysis on which the candidate disagreed.
+// Prompts are logged as LOG_PRIVACY allows; in a privacy mode the intents
+// are left out since they repeat the prompt.
+type ShadowDivergence struct {
+	TenantID   string        `json:"tenant_id"`
+	Prompt     string        `json:"prompt"`
+	Fields     []string      `json:"fields"`
+	Production *SearchIntent `json:"production,omitempty"`
+	Candidate  *SearchIntent `json:"candidate,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// ShadowComparator repeats a sample of the analyses with a candidate model
+// or prompt version in the background and compares the intents with the
+// ones served, so an upgrade can be judged on real traffic before users see
+// it. Shadow calls never delay a search: they are dropped when the upstream
+// queue has waiters or the candidate's own concurrency is used up. They are
+// skipped too once the tenant's budget is used up, and their spend is
+// charged to the tenant like any other call's.
+type ShadowComparator struct {
+	analyze AnalyzeFunc
+	limiter *UpstreamLimiter
+	budget  *BudgetTracker
+	// prompts and model are the candidate's, nil and "" keep production's
+	prompts    *PromptTemplate
+	model      string
+	sampleRate float64
+	slots      chan struct{}
+
+	mu      sync.Mutex
+	results map[string]int
+	fields  map[string]int
+	recent  []ShadowDivergence
+}
+
+// NewShadowComparator sends sampleRate of the analyses to the candidate, at
+// most maxConcurrent at a time
+func NewShadowComparator(analyze AnalyzeFunc, limiter *UpstreamLimiter, budget *BudgetTracker, prompts *PromptTemplate, model string, sampleRate float64, maxConcurrent int) *ShadowComparator {
+	return &ShadowComparator{
+		analyze:    analyze,
+		limiter:    limiter,
+		budget:     budget,
+		prompts:    prompts,
+		model:      model,
+		sampleRate: sampleRate,
+		slots:      make(chan struct{}, maxConcurrent),
+		results:    make(map[string]int),
+		fields:     make(map[string]int),
+	}
+}
+
+// UseShadow turns on shadow comparisons of the analyses
+func (h *SearchHandler) UseShadow(shadow *ShadowComparator) {
+	h.shadow = shadow
+}
+
+// Submit compares a served analysis with the candidate's in the background
+// when draw, a random number in [0, 1), falls in the sample
+func (s *ShadowComparator) Submit(ctx context.Context, draw float64, req shadowRequest) {
+	if s == nil || draw >= s.sampleRate {
+		return
+	}
+	if _, waiting := s.limiter.Load(); waiting > 0 {
+		s.record(ShadowSkipped)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.record(ShadowSkipped)
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+		defer cancel()
+		// Checked here rather than before the slot, the spend store may be remote
+		if err := s.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+			s.record(ShadowSkipped)
+			return
+		}
+		s.compare(ctx, req)
+	}()
+}
+
+func (s *ShadowComparator) compare(ctx context.Context, req shadowRequest) {
+	ctx, span := tracer.Start(ctx, "search.shadow", SpanKindInternal)
+	defer span.End()
+
+	prompts, model := req.prompts, req.model
+	if s.prompts != nil {
+		prompts = s.prompts
+	}
+	if s.model != "" {
+		model = s.model
+	}
+	span.SetAttr("gen_ai.request.model", model)
+	span.SetAttr("search.prompt_version", prompts.Version())
+	// The candidate sees the tenant's customization, like the analysis did
+	data := NewPromptData(req.now, req.locale)
+	if tenant := tenantFromContext(ctx); tenant != nil {
+		data.customize(tenant.Prompt)
+	}
+	system := prompts.System(req.vertical, data)
+
+	candidate, err := s.analyze(ctx, req.prompt, system, model, req.temperature, req.examples)
+	if err != nil {
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Shadow analysis failed", "model", model, "error", err)
+		s.record(ShadowError)
+		return
+	}
+	diff := intentFieldDiff(req.intent, candidate)
+	span.SetAttr("shadow.diverged_fields", strings.Join(diff, ","))
+	if len(diff) == 0 {
+		s.record(ShadowMatch)
+		return
+	}
+
+	sample := ShadowDivergence{
+		TenantID: DefaultTenantID,
+		Prompt:   scrub(loggedPrompt(ctx, req.prompt).String(), logPrivacyFor(ctx)),
+		Fields:   diff,
+		Time:     time.Now().UTC(),
+	}
+	if t := tenantFromContext(ctx); t != nil {
+		sample.TenantID = t.ID
+	}
+	if logsBodies(ctx) {
+		sample.Production, sample.Candidate = req.intent, candidate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[ShadowDiverged]++
+	shadowComparisons.Inc(ShadowDiverged)
+	for _, field := range diff {
+		s.fields[field]++
+		shadowFieldDivergence.Inc(field)
+	}
+	s.recent = append(s.recent, sample)
+	if len(s.recent) > maxShadowSamples {
+		s.recent = s.recent[len(s.recent)-maxShadowSamples:]
+	}
+}
+
+func (s *ShadowComparator) record(result string) {
+	s.mu.Lock()
+	s.results[result]++
+	s.mu.Unlock()
+	shadowComparisons.Inc(result)
+}
+
+// handleAdmin reports how often the candidate agreed with production since
+// the server started (GET)
+func (s *ShadowComparator) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	compared := s.results[ShadowMatch] + s.results[ShadowDiverged]
+	rate := func(n int) interface{} {
+		if compared == 0 {
+			return nil
+		}
+		return float64(n) / float64(compared)
+	}
+	fields := make(map[string]interface{}, len(intentFields))
+	for _, field := range intentFields {
+		fields[field] = map[string]interface{}{"diverged": s.fields[field], "divergence_rate": rate(s.fields[field])}
+	}
+	candidate := map[string]interface{}{"model": s.model}
+	if s.prompts != nil {
+		candidate["prompt_version"] = s.prompts.Version()
+	}
+	recent := slices.Clone(s.recent)
+	slices.Reverse(recent)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"candidate":       candidate,
+		"sample_rate":     s.sampleRate,
+		"compared":        compared,
+		"matched":         s.results[ShadowMatch],
+		"diverged":        s.results[ShadowDiverged],
+		"errors":          s.results[ShadowError],
+		"skipped":         s.results[ShadowSkipped],
+		"divergence_rate": rate(s.results[ShadowDiverged]),
+		"fields":          fields,
+		"recent":          recent,
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	shortLinksCreated = metricsRegistry.Counter("short_links_created_total",
+		"Short links created for searches.")
+	shortLinkClicks = metricsRegistry.Counter("short_link_clicks_total",
+		"Short links followed, by result (redirected, not_found, invalid).", "result")
+)
+
+const (
+	shortLinkIDLength = 10
+	shortLinkAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	maxShortLinksList = 100
+)
+
+// ShortLink is a short, shareable path to a search URL. The prompt isn't
+// kept: whoever gets the link sees the search, not how it was asked for.
+type ShortLink struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id"`
+	UserID   string `json:"user_id,omitempty"`
+	// SearchID is the history entry the link was made from, if any
+	SearchID      string     `json:"search_id,omitempty"`
+	SearchURL     string     `json:"search_url"`
+	Clicks        int64      `json:"clicks"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastClickedAt *time.Time `json:"last_clicked_at,omitempty"`
+}
+
+// ShortLinkStore persists short links and their click counts
+type ShortLinkStore interface {
+	Create(ctx context.Context, link *ShortLink) error
+	// Click counts a click on the link and returns it, nil when there is none
+	Click(ctx context.Context, id string, at time.Time) (*ShortLink, error)
+	// ListOwned returns up to limit of the owner's links, newest first
+	ListOwned(ctx context.Context, tenantID, userID string, limit int) ([]*ShortLink, error)
+	// PurgeBefore deletes links created before cutoff
+	PurgeBefore(ctx context.Context, cutoff time.Time) (int, error)
+	// DeleteAllOwned deletes the owner's links, for user erasure
+	DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error)
+}
+
+// memoryShortLinkStore keeps short links in process memory, mainly for development
+type memoryShortLinkStore struct {
+	mu    sync.Mutex
+	links map[string]*ShortLink
+}
+
+func NewMemoryShortLinkStore() *memoryShortLinkStore {
+	return &memoryShortLinkStore{links: make(map[string]*ShortLink)}
+}
+
+func (s *memoryShortLinkStore) Create(ctx context.Context, link *ShortLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *link
+	s.links[link.ID] = &copied
+	return nil
+}
+
+func (s *memoryShortLinkStore) Click(ctx context.Context, id string, at time.Time) (*ShortLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[id]
+	if !ok {
+		return nil, nil
+	}
+	link.Clicks++
+	at = at.UTC()
+	link.LastClickedAt = &at
+	copied := *link
+	return &copied, nil
+}
+
+func (s *memoryShortLinkStore) ListOwned(ctx context.Context, tenantID, userID string, limit int) ([]*ShortLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*ShortLink
+	for _, link := range s.links {
+		if link.TenantID == tenantID && link.UserID == userID {
+			copied := *link
+			out = append(out, &copied)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *memoryShortLinkStore) PurgeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, link := range s.links {
+		if link.CreatedAt.Before(cutoff) {
+			delete(s.links, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryShortLinkStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, link := range s.links {
+		if link.TenantID == tenantID && link.UserID == userID {
+			delete(s.links, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// newShortLinkID is random rather than a hash of the URL, so links can't be
+// enumerated or guessed from a search
+func newShortLinkID() string {
+	b := make([]byte, shortLinkIDLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = shortLinkAlphabet[int(b[i])%len(shortLinkAlphabet)]
+	}
+	return string(b)
+}
+
+// ShortLinkService creates short links to searches and redirects them
+type ShortLinkService struct {
+	store   ShortLinkStore
+	history HistoryStore
+	// publicURL is where the server is reachable, to return full links
+	publicURL string
+}
+
+func NewShortLinkService(store ShortLinkStore, history HistoryStore, publicURL string) *ShortLinkService {
+	return &ShortLinkService{store: store, history: history, publicURL: strings.TrimRight(publicURL, "/")}
+}
+
+// handleLinks creates a link (POST) to a search of the caller's history or
+// to a search URL, or lists the caller's links with their clicks (GET)
+func (s *ShortLinkService) handleLinks(w http.ResponseWriter, r *http.Request) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		links, err := s.store.ListOwned(r.Context(), tenantID, userID, maxShortLinksList)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error listing short links", "error", err)
+			http.Error(w, "Error listing short links", http.StatusInternalServerError)
+			return
+		}
+		items := make([]map[string]interface{}, len(links))
+		for i, link := range links {
+			items[i] = s.render(link)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"links": items})
+	case http.MethodPost:
+		s.create(w, r, tenantID, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ShortLinkService) create(w http.ResponseWriter, r *http.Request, tenantID, userID string) {
+	var req struct {
+		SearchID  string `json:"search_id"`
+		SearchURL string `json:"search_url"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	link := &ShortLink{
+		ID:        newShortLinkID(),
+		TenantID:  tenantID,
+		UserID:    userID,
+		SearchURL: req.SearchURL,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.SearchID != "" {
+		rec, err := s.history.Get(r.Context(), tenantID, userID, req.SearchID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error reading history entry", "error", err)
+			http.Error(w, "Error creating short link", http.StatusInternalServerError)
+			return
+		}
+		if rec == nil {
+			http.Error(w, "Search not found", http.StatusNotFound)
+			return
+		}
+		link.SearchID = rec.ID
+		// Encrypted searches keep their URL from the server, the client
+		// sends it along
+		if rec.SearchURL != "" {
+			link.SearchURL = rec.SearchURL
+		}
+	}
+	if link.SearchURL == "" {
+		http.Error(w, "search_id or search_url is required", http.StatusBadRequest)
+		return
+	}
+	// Only search engine URLs, or the links would be an open redirect
+	if err := validateSearchURL(link.SearchURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.Create(r.Context(), link); err != nil {
+		slog.ErrorContext(r.Context(), "Error storing short link", "error", err)
+		http.Error(w, "Error creating short link", http.StatusInternalServerError)
+		return
+	}
+	shortLinksCreated.Inc()
+	writeJSON(w, http.StatusCreated, s.render(link))
+}
+
+// handleRedirect follows GET /l/{id} to the search, counting the click
+func (s *ShortLinkService) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	if len(id) != shortLinkIDLength {
+		shortLinkClicks.Inc("not_found")
+		http.NotFound(w, r)
+		return
+	}
+	link, err := s.store.Click(r.Context(), id, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading short link", "error", err)
+		http.Error(w, "Error reading short link", http.StatusInternalServerError)
+		return
+	}
+	if link == nil {
+		shortLinkClicks.Inc("not_found")
+		http.NotFound(w, r)
+		return
+	}
+	// Checked again in case the engines changed since the link was made
+	if err := validateSearchURL(link.SearchURL); err != nil {
+		slog.WarnContext(r.Context(), "Short link to an invalid search URL", "id", id, "error", err)
+		shortLinkClicks.Inc("invalid")
+		http.Error(w, "This link no longer points to a search", http.StatusGone)
+		return
+	}
+	shortLinkClicks.Inc("redirected")
+	// Every click must reach the server to be counted
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, link.SearchURL, http.StatusFound)
+}
+
+func (s *ShortLinkService) render(link *ShortLink) map[string]interface{} {
+	path := "/l/" + link.ID
+	out := map[string]interface{}{
+		"id":         link.ID,
+		"path":       path,
+		"search_url": link.SearchURL,
+		"clicks":     link.Clicks,
+		"created_at": link.CreatedAt,
+	}
+	if s.publicURL != "" {
+		out["short_url"] = s.publicURL + path
+	}
+	if link.SearchID != "" {
+		out["search_id"] = link.SearchID
+	}
+	if link.LastClickedAt != nil {
+		out["last_clicked_at"] = link.LastClickedAt
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// shortLinkSchema creates the short link table next to the history tables
+var shortLinkSchema = map[string][]string{
+	HistoryStoreSQLite: {
+		`CREATE TABLE IF NOT EXISTS short_links (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			search_id TEXT NOT NULL DEFAULT '',
+			search_url TEXT NOT NULL,
+			clicks INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			last_clicked_at TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS short_links_owner ON short_links (tenant_id, user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS short_links_created ON short_links (created_at)`,
+	},
+	HistoryStorePostgres: {
+		`CREATE TABLE IF NOT EXISTS short_links (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			search_id TEXT NOT NULL DEFAULT '',
+			search_url TEXT NOT NULL,
+			clicks BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ NOT NULL,
+			last_clicked_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS short_links_owner ON short_links (tenant_id, user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS short_links_created ON short_links (created_at)`,
+	},
+}
+
+const shortLinkColumns = `id, tenant_id, user_id, search_id, search_url, clicks, created_at, last_clicked_at`
+
+// sqlShortLinkStore keeps short links in the history database
+type sqlShortLinkStore struct {
+	h *sqlHistoryStore
+}
+
+// NewSQLShortLinkStore creates the short link table in the history database
+func NewSQLShortLinkStore(ctx context.Context, history *sqlHistoryStore) (*sqlShortLinkStore, error) {
+	for _, stmt := range shortLinkSchema[history.dialect] {
+		if _, err := history.db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("error creating short link table: %v", err)
+		}
+	}
+	return &sqlShortLinkStore{h: history}, nil
+}
+
+func (s *sqlShortLinkStore) Create(ctx context.Context, link *ShortLink) error {
+	_, err := s.h.db.ExecContext(ctx, s.h.rebind(`INSERT INTO short_links (`+shortLinkColumns+`) VALUES (`+placeholders(8)+`)`),
+		link.ID, link.TenantID, link.UserID, link.SearchID, link.SearchURL, link.Clicks, link.CreatedAt.UTC(), nil)
+	if err != nil {
+		return fmt.Errorf("error inserting short link: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlShortLinkStore) Click(ctx context.Context, id string, at time.Time) (*ShortLink, error) {
+	res, err := s.h.db.ExecContext(ctx, s.h.rebind(`UPDATE short_links SET clicks = clicks + 1, last_clicked_at = ? WHERE id = ?`), at.UTC(), id)
+	if err != nil {
+		return nil, fmt.Errorf("error counting short link click: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, nil
+	}
+	links, err := s.query(ctx, `SELECT `+shortLinkColumns+` FROM short_links WHERE id = ?`, id)
+	if err != nil || len(links) == 0 {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+func (s *sqlShortLinkStore) ListOwned(ctx context.Context, tenantID, userID string, limit int) ([]*ShortLink, error) {
+	return s.query(ctx, `SELECT `+shortLinkColumns+` FROM short_links WHERE tenant_id = ? AND user_id = ? ORDER BY created_at DESC, id LIMIT ?`,
+		tenantID, userID, limit)
+}
+
+func (s *sqlShortLinkStore) query(ctx context.Context, query string, args ...interface{}) ([]*ShortLink, error) {
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying short links: %v", err)
+	}
+	defer rows.Close()
+
+	var links []*ShortLink
+	for rows.Next() {
+		link := &ShortLink{}
+		var lastClicked sql.NullTime
+		if err := rows.Scan(&link.ID, &link.TenantID, &link.UserID, &link.SearchID, &link.SearchURL, &link.Clicks,
+			&link.CreatedAt, &lastClicked); err != nil {
+			return nil, fmt.Errorf("error reading short link: %v", err)
+		}
+		link.CreatedAt = link.CreatedAt.UTC()
+		if lastClicked.Valid {
+			t := lastClicked.Time.UTC()
+			link.LastClickedAt = &t
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (s *sqlShortLinkStore) PurgeBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	return s.exec(ctx, `DELETE FROM short_links WHERE created_at < ?`, cutoff.UTC())
+}
+
+func (s *sqlShortLinkStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return s.exec(ctx, `DELETE FROM short_links WHERE tenant_id = ? AND user_id = ?`, tenantID, userID)
+}
+
+// exec runs a statement and returns the number of affected rows
+func (s *sqlShortLinkStore) exec(ctx context.Context, query string, args ...interface{}) (int, error) {
+	res, err := s.h.db.ExecContext(ctx, s.h.rebind(query), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting short links: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting short links: %v", err)
+	}
+	return int(n), nil
+}
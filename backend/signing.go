@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request
+const (
+	signatureKeyHeader       = "X-Signature-Key"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+	signatureHeader          = "X-Signature"
+)
+
+const (
+	// maxSignedBodyBytes bounds the bodies read to be verified, uploads
+	// included
+	maxSignedBodyBytes = 32 << 20
+	// minSigningSecretLength keeps guessable secrets out of the tenants file
+	minSigningSecretLength  = 32
+	maxSignatureNonceLength = 128
+)
+
+var signedRequests = metricsRegistry.Counter("signed_requests_total",
+	"Requests authenticated by signature, by result (ok, or why they were refused).", "result")
+
+// SignatureError is why a signed request was refused, answered as its error
+type SignatureError struct {
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return e.Reason
+}
+
+// ReplayCache remembers the nonces of signed requests. Claim reports false
+// for a nonce already claimed within ttl.
+type ReplayCache interface {
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// RequestSigner authenticates the requests services sign with a shared
+// secret instead of sending an API key. The signature is the hex HMAC-SHA256,
+// keyed by the secret, of the key ID, the Unix timestamp, a nonce, the
+// method, the request URI, the hex SHA-256 of the body and the identity
+// headers, each on a line.
+// Requests more than maxSkew away from the server's clock are refused, and
+// every nonce is accepted once, so a captured request can't be replayed.
+type RequestSigner struct {
+	maxSkew time.Duration
+	replay  ReplayCache
+	now     func() time.Time
+}
+
+func NewRequestSigner(maxSkew time.Duration, replay ReplayCache) *RequestSigner {
+	return &RequestSigner{maxSkew: maxSkew, replay: replay, now: time.Now}
+}
+
+// UseSigner makes signed requests resolve to the tenant of their signing key
+func (reg *TenantRegistry) UseSigner(signer *RequestSigner) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.signer = signer
+}
+
+// isSigned tells whether a request claims to be signed
+func isSigned(r *http.Request) bool {
+	return r.Header.Get(signatureKeyHeader) != "" || r.Header.Get(signatureHeader) != ""
+}
+
+// signedIdentityHeaders are the headers a signed request is believed on,
+// so they are signed too: otherwise whoever relays a request could pick the
+// user it acts for
+var signedIdentityHeaders = []string{"X-User-ID", "X-History-Public-Key"}
+
+// signingString is what a request's signature is computed over. Identity
+// headers that aren't sent sign as empty lines.
+func signingString(keyID, timestamp, nonce, method, requestURI string, body []byte, header http.Header) string {
+	sum := sha256.Sum256(body)
+	lines := []string{keyID, timestamp, nonce, method, requestURI, hex.EncodeToString(sum[:])}
+	for _, name := range signedIdentityHeaders {
+		lines = append(lines, header.Get(name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Verify checks the signature of r against secret and claims its nonce. The
+// body is read to be hashed, and put back for the handlers.
+func (s *RequestSigner) Verify(r *http.Request, secret string) error {
+	keyID := r.Header.Get(signatureKeyHeader)
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	nonce := r.Header.Get(signatureNonceHeader)
+	signature := r.Header.Get(signatureHeader)
+	if keyID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return &SignatureError{"signature_incomplete"}
+	}
+	if len(nonce) > maxSignatureNonceLength {
+		return &SignatureError{"signature_invalid"}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &SignatureError{"signature_invalid"}
+	}
+	now := s.now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > s.maxSkew || skew < -s.maxSkew {
+		return &SignatureError{"signature_expired"}
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error reading signed body: %v", err)
+		}
+		if len(body) > maxSignedBodyBytes {
+			return &SignatureError{"signature_body_too_large"}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingString(keyID, timestamp, nonce, r.Method, r.URL.RequestURI(), body, r.Header)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return &SignatureError{"signature_invalid"}
+	}
+
+	// A nonce stays claimed for as long as its timestamp could be accepted
+	fresh, err := s.replay.Claim(r.Context(), keyID+":"+nonce, 2*s.maxSkew)
+	if err != nil {
+		return fmt.Errorf("error checking nonce: %v", err)
+	}
+	if !fresh {
+		return &SignatureError{"signature_replayed"}
+	}
+	return nil
+}
+
+// authenticateSigned resolves a signed request to the tenant of its key,
+// answering the request itself when the signature doesn't hold
+func (reg *TenantRegistry) authenticateSigned(w http.ResponseWriter, r *http.Request) (*Tenant, bool) {
+	reg.mu.RLock()
+	signer := reg.signer
+	signing, ok := reg.bySigningKey[r.Header.Get(signatureKeyHeader)]
+	reg.mu.RUnlock()
+	if signer == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "signature_unsupported"})
+		return nil, false
+	}
+	if !ok {
+		signedRequests.Inc("signature_unknown_key")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "signature_unknown_key"})
+		return nil, false
+	}
+	if err := signer.Verify(r, signing.secret); err != nil {
+		var sigErr *SignatureError
+		if !errors.As(err, &sigErr) {
+			signedRequests.Inc("error")
+			http.Error(w, "Error verifying signature", http.StatusInternalServerError)
+			return nil, false
+		}
+		signedRequests.Inc(sigErr.Reason)
+		status := http.StatusUnauthorized
+		if sigErr.Reason == "signature_body_too_large" {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJSON(w, status, map[string]string{"error": sigErr.Reason})
+		return nil, false
+	}
+	signedRequests.Inc("ok")
+	return signing.tenant, true
+}
+
+// signingKey is a tenant's secret for one key ID
+type signingKey struct {
+	tenant *Tenant
+	secret string
+}
+
+// memoryReplayCache keeps nonces in process memory, suitable for a single
+// replica
+type memoryReplayCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewMemoryReplayCache() *memoryReplayCache {
+	return &memoryReplayCache{nonces: make(map[string]time.Time)}
+}
+
+func (c *memoryReplayCache) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expires, ok := c.nonces[key]; ok && now.Before(expires) {
+		return false, nil
+	}
+	if len(c.nonces) >= 10000 {
+		for k, expires := range c.nonces {
+			if !now.Before(expires) {
+				delete(c.nonces, k)
+			}
+		}
+	}
+	c.nonces[key] = now.Add(ttl)
+	return true, nil
+}
+
+// redisReplayCache shares nonces across replicas
+type redisReplayCache struct {
+	client *RedisClient
+}
+
+func NewRedisReplayCache(client *RedisClient) *redisReplayCache {
+	return &redisReplayCache{client: client}
+}
+
+func (c *redisReplayCache) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	reply, err := c.client.Do(ctx, "SET", "nonce:"+key, "1", "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
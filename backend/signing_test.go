@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest builds a request signed the way a client signs it, over the
+// headers it has at that point
+func signedRequest(secret, nonce, body string, header http.Header) *http.Request {
+	r := httptest.NewRequest("POST", "/search?lang=en", strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(signatureKeyHeader, "svc-billing")
+	r.Header.Set(signatureTimestampHeader, ts)
+	r.Header.Set(signatureNonceHeader, nonce)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingString("svc-billing", ts, nonce, r.Method, r.URL.RequestURI(), []byte(body), r.Header)))
+	r.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSignatureCoversIdentity(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	const body = `{"prompt":"cats"}`
+	signer := NewRequestSigner(time.Minute, NewMemoryReplayCache())
+
+	for i, tc := range []struct {
+		name   string
+		signed http.Header
+		// change is applied after signing, as by whoever relays the request
+		change func(h http.Header)
+		want   string
+	}{
+		{name: "unchanged", signed: http.Header{"X-User-Id": {"alice"}}},
+		{name: "no identity", signed: http.Header{}},
+		{
+			name:   "user switched",
+			signed: http.Header{"X-User-Id": {"alice"}},
+			change: func(h http.Header) { h.Set("X-User-ID", "bob") },
+			want:   "signature_invalid",
+		},
+		{
+			name:   "user added",
+			signed: http.Header{},
+			change: func(h http.Header) { h.Set("X-User-ID", "bob") },
+			want:   "signature_invalid",
+		},
+		{
+			name:   "user removed",
+			signed: http.Header{"X-User-Id": {"alice"}},
+			change: func(h http.Header) { h.Del("X-User-ID") },
+			want:   "signature_invalid",
+		},
+		{
+			name:   "history key switched",
+			signed: http.Header{"X-User-Id": {"alice"}, "X-History-Public-Key": {"key-a"}},
+			change: func(h http.Header) { h.Set("X-History-Public-Key", "key-b") },
+			want:   "signature_invalid",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := signedRequest(secret, strconv.Itoa(i), body, tc.signed)
+			if tc.change != nil {
+				tc.change(r.Header)
+			}
+			err := signer.Verify(r, secret)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("signature refused: %v", err)
+				}
+				return
+			}
+			var sigErr *SignatureError
+			if !errors.As(err, &sigErr) || sigErr.Reason != tc.want {
+				t.Fatalf("got %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
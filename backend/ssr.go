@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+//go:embed templates/results.html
+var resultsPageHTML string
+
+var resultsPageTemplate = template.Must(template.New("results").Parse(resultsPageHTML))
+
+// resultsPage is what the results page template renders
+type resultsPage struct {
+	Query      string
+	Locale     string
+	Lang       string
+	Error      string
+	ConfirmPII bool
+	ConfirmURL string
+
+	SearchURL    string
+	Engine       string
+	Intent       *SearchIntent
+	Results      []SearchResult
+	ResultsError string
+	Analyzer     string
+	Model        string
+	TraceID      string
+}
+
+// handleResultsPage serves GET /s?q=...: the analysis, the search URL and,
+// with a results provider, the first result page, rendered as HTML for
+// clients without JavaScript and as a debugging view. Without q it is an
+// empty search form.
+func (h *SearchHandler) handleResultsPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	page := &resultsPage{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Locale: query.Get("locale"),
+		Lang:   "en",
+	}
+	opts := AnalyzeOptions{Locale: page.Locale, ConfirmPII: query.Get("confirm_pii") == "1"}
+	if page.Locale != "" {
+		page.Lang, _, _ = strings.Cut(page.Locale, "-")
+	}
+	// Every load spends an analysis, crawlers must not follow the links
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if page.Query == "" {
+		h.renderResultsPage(w, r, http.StatusOK, page)
+		return
+	}
+	if err := h.policy.Validate(opts); err != nil {
+		page.Error = err.Error()
+		page.Locale, page.Lang = "", "en"
+		h.renderResultsPage(w, r, http.StatusBadRequest, page)
+		return
+	}
+
+	result, err := h.analyze(r.Context(), page.Query, opts)
+	if err != nil {
+		status, message := resultsPageError(r.Context(), err)
+		page.Error = message
+		var piiErr *PIIConfirmationError
+		if errors.As(err, &piiErr) {
+			page.ConfirmPII = true
+			confirm := r.URL.Query()
+			confirm.Set("confirm_pii", "1")
+			page.ConfirmURL = "/s?" + confirm.Encode()
+		}
+		h.renderResultsPage(w, r, status, page)
+		return
+	}
+
+	page.SearchURL = constructSearchQuery(result.Intent)
+	searchID := h.history.Record(r, page.Query, result, page.SearchURL)
+	h.experiments.Track(searchID, result)
+	h.analytics.Observe(r.Context(), result)
+
+	engine := defaultEngine.Load()
+	page.Engine = engine.Name
+	page.Intent = result.Intent
+	page.Analyzer = result.Analyzer
+	page.Model = result.Model
+	page.TraceID = spanFromContext(r.Context()).TraceID()
+	if h.results != nil && h.flags.Enabled(r.Context(), FlagResults, true) {
+		q := ResultsQuery{Query: buildQueryString(result.Intent), Engine: engine.Name, Locale: opts.Locale}
+		results, _, err := h.results.Search(r.Context(), q)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Error fetching results", "error", err)
+			page.ResultsError = "Results are unavailable right now, the search link still works."
+		} else {
+			page.Results = filterResults(tenantFromContext(r.Context()), result.Intent, results)
+		}
+	}
+	if query.Get("lucky") == "1" && len(page.Results) > 0 {
+		// Straight to the best result; without results the page explains
+		if best := h.luckyResult(r.Context(), result, page.Results); best != nil {
+			http.Redirect(w, r, best.URL, http.StatusFound)
+			return
+		}
+	}
+	h.renderResultsPage(w, r, http.StatusOK, page)
+}
+
+func (h *SearchHandler) renderResultsPage(w http.ResponseWriter, r *http.Request, status int, page *resultsPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := resultsPageTemplate.Execute(w, page); err != nil {
+		slog.ErrorContext(r.Context(), "Error rendering results page", "error", err)
+	}
+}
+
+// resultsPageError is writeAnalyzeError for the results page: the status
+// and a message fit for a person
+func resultsPageError(ctx context.Context, err error) (int, string) {
+	var budgetErr *BudgetExceededError
+	var piiErr *PIIConfirmationError
+	var rejected *PromptRejectedError
+	var overloaded *UpstreamOverloadedError
+	switch {
+	case errors.As(err, &budgetErr):
+		return http.StatusTooManyRequests, "The search budget is used up, please try again later."
+	case errors.As(err, &piiErr):
+		return http.StatusPreconditionRequired, "Your search contains personal data (" + strings.Join(piiErr.Kinds, ", ") + ")."
+	case errors.As(err, &rejected):
+		return http.StatusUnprocessableEntity, "This search was rejected: it tries to change the analyzer's instructions."
+	case errors.As(err, &overloaded):
+		return http.StatusTooManyRequests, "Too many searches right now, please retry in a moment."
+	case errors.Is(err, ErrNoHealthyKeys), errors.Is(err, ErrUpstreamBusy):
+		return http.StatusServiceUnavailable, "The service is busy, please retry shortly."
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "The search took too long, please retry."
+	}
+	slog.ErrorContext(ctx, "Error analyzing prompt", "error", err)
+	return http.StatusInternalServerError, "Something went wrong analyzing your search."
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Synonym expansion modes
+const (
+	// SynonymsOR rewrites the terms of main_query as OR groups of their
+	// synonyms after the analysis
+	SynonymsOR = "or"
+	// SynonymsPrompt tells the model the other names of the prompt's terms
+	// and lets it pick
+	SynonymsPrompt = "prompt"
+)
+
+const (
+	maxSynonymTerms      = 10000
+	maxSynonymsPerTerm   = 5
+	maxPromptSynonyms    = 20
+	synonymPunctuation   = `.,;:!?()"'`
+	synonymForbiddenRune = `"()`
+)
+
+var synonymExpansions = metricsRegistry.Counter("synonym_expansions_total",
+	"Terms given their synonyms, by mode (or, prompt).", "mode")
+
+func validateSynonymMode(mode string) error {
+	if mode != SynonymsOR && mode != SynonymsPrompt {
+		return fmt.Errorf("invalid synonym expansion %q (want or or prompt)", mode)
+	}
+	return nil
+}
+
+// synonymSet is one loaded dictionary, by normalized term
+type synonymSet struct {
+	terms map[string][]string
+	// maxWords is the length of the longest term, in words
+	maxWords int
+}
+
+// Synonyms expands abbreviations, codenames and other names of a term ("k8s"
+// is kubernetes) from a dictionary reloaded while requests are in flight
+type Synonyms struct {
+	mode string
+	set  atomic.Pointer[synonymSet]
+}
+
+// NewSynonyms loads the dictionary from path, a JSON object of the synonyms
+// by term: {"k8s": ["kubernetes"]}
+func NewSynonyms(path, mode string) (*Synonyms, error) {
+	if err := validateSynonymMode(mode); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading synonyms file: %v", err)
+	}
+	s := &Synonyms{mode: mode}
+	if err := s.Reload(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// UseSynonyms expands the terms of the analyses with their synonyms
+func (h *SearchHandler) UseSynonyms(s *Synonyms) {
+	h.synonyms = s
+}
+
+// Reload validates a new dictionary and swaps it in; on error the current
+// one stays in place
+func (s *Synonyms) Reload(data []byte) error {
+	var file map[string][]string
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing synonyms file: %v", err)
+	}
+	if len(file) > maxSynonymTerms {
+		return fmt.Errorf("synonyms file has more than %d terms", maxSynonymTerms)
+	}
+	set := &synonymSet{terms: make(map[string][]string, len(file))}
+	for term, synonyms := range file {
+		words := strings.Fields(term)
+		key := synonymKey(words)
+		if key == "" || strings.ContainsAny(term, synonymForbiddenRune) {
+			return fmt.Errorf("synonym term %q must have words and no quotes or parentheses", term)
+		}
+		if _, ok := set.terms[key]; ok {
+			return fmt.Errorf("synonym term %q is listed twice", term)
+		}
+		if len(synonyms) == 0 || len(synonyms) > maxSynonymsPerTerm {
+			return fmt.Errorf("synonym term %q needs 1 to %d synonyms", term, maxSynonymsPerTerm)
+		}
+		clean := make([]string, 0, len(synonyms))
+		for _, syn := range synonyms {
+			syn = strings.Join(strings.Fields(stripInvisible(syn)), " ")
+			if syn == "" || strings.ContainsAny(syn, synonymForbiddenRune) {
+				return fmt.Errorf("synonyms of %q must not be empty or have quotes or parentheses", term)
+			}
+			if !strings.EqualFold(syn, term) {
+				clean = append(clean, syn)
+			}
+		}
+		set.terms[key] = clean
+		set.maxWords = max(set.maxWords, len(words))
+	}
+	s.set.Store(set)
+	return nil
+}
+
+// synonymKey is how terms are looked up: lowercase words without the
+// punctuation around them
+func synonymKey(words []string) string {
+	parts := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.ToLower(strings.Trim(w, synonymPunctuation)); w != "" {
+			parts = append(parts, w)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// find calls found for the longest term starting at each word
+func (set *synonymSet) find(words []string, found func(start, end int, synonyms []string)) {
+	for i := 0; i < len(words); {
+		n := min(set.maxWords, len(words)-i)
+		for ; n > 0; n-- {
+			if synonyms, ok := set.terms[synonymKey(words[i:i+n])]; ok && len(synonyms) > 0 {
+				found(i, i+n, synonyms)
+				break
+			}
+		}
+		i += max(n, 1)
+	}
+}
+
+// PromptSynonyms returns the synonyms of the terms the prompt uses, for the
+// system prompt, in prompt mode
+func (s *Synonyms) PromptSynonyms(prompt string) map[string][]string {
+	if s == nil || s.mode != SynonymsPrompt {
+		return nil
+	}
+	var matched map[string][]string
+	words := strings.Fields(prompt)
+	s.set.Load().find(words, func(start, end int, synonyms []string) {
+		if len(matched) >= maxPromptSynonyms {
+			return
+		}
+		if matched == nil {
+			matched = make(map[string][]string)
+		}
+		matched[synonymKey(words[start:end])] = synonyms
+		synonymExpansions.Inc(SynonymsPrompt)
+	})
+	return matched
+}
+
+// synonymsOverlay is the line of the system prompt naming the synonyms, in
+// term order so the same prompt always gets the same system prompt
+func synonymsOverlay(synonyms map[string][]string) string {
+	if len(synonyms) == 0 {
+		return ""
+	}
+	terms := make([]string, 0, len(synonyms))
+	for term := range synonyms {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	names := make([]string, len(terms))
+	for i, term := range terms {
+		names[i] = fmt.Sprintf("%q is also %s", term, strings.Join(synonyms[term], " or "))
+	}
+	return "Some of the prompt's terms have other names: " + strings.Join(names, "; ") + ". Put the name the web knows best in main_query."
+}
+
+// Expand rewrites the terms of main_query with synonyms as OR groups, like
+// (k8s OR kubernetes), in or mode. Terms whose synonyms the query already
+// has are left alone, so expanding twice changes nothing. The intent is a
+// copy owned by the caller.
+func (s *Synonyms) Expand(intent *SearchIntent) {
+	if s == nil || s.mode != SynonymsOR || intent == nil {
+		return
+	}
+	words := strings.Fields(intent.MainQuery)
+	have := " " + synonymKey(words) + " "
+	var out []string
+	next := 0
+	s.set.Load().find(words, func(start, end int, synonyms []string) {
+		for _, syn := range synonyms {
+			if strings.Contains(have, " "+strings.ToLower(syn)+" ") {
+				return
+			}
+		}
+		group := []string{orTerm(synonymKey(words[start:end]))}
+		for _, syn := range synonyms {
+			group = append(group, orTerm(syn))
+		}
+		out = append(out, words[next:start]...)
+		out = append(out, "("+strings.Join(group, " OR ")+")")
+		next = end
+		synonymExpansions.Inc(SynonymsOR)
+	})
+	if next == 0 {
+		return
+	}
+	intent.MainQuery = strings.Join(append(out, words[next:]...), " ")
+}
+
+// orTerm quotes the terms of an OR group with several words, which would
+// otherwise only be alternatives by their first and last word
+func orTerm(term string) string {
+	if strings.Contains(term, " ") {
+		return `"` + term + `"`
+	}
+	return term
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry sink types
+const (
+	SinkWebhook = "webhook"
+	SinkOTLP    = "otlp"
+)
+
+// Telemetry signals a sink can receive
+const (
+	SignalEvents  = "events"
+	SignalTraces  = "traces"
+	SignalMetrics = "metrics"
+)
+
+const (
+	telemetryMaxBatch  = 100
+	telemetryMaxBuffer = 1000 // per tenant and signal; older ones are dropped beyond it
+	// telemetrySendTimeout bounds the export to one tenant, so a slow
+	// collector only delays its own tenant's telemetry
+	telemetrySendTimeout = 10 * time.Second
+	// telemetryMaxConcurrentSends is how many tenants are exported to at once
+	telemetryMaxConcurrentSends = 16
+)
+
+var (
+	telemetryExported = metricsRegistry.Counter("tenant_telemetry_events_exported_total",
+		"Events delivered to tenant telemetry sinks.", "tenant")
+	telemetryDropped = metricsRegistry.Counter("tenant_telemetry_events_dropped_total",
+		"Events lost because a tenant sink was full or failing.", "tenant")
+	telemetrySpansExported = metricsRegistry.Counter("tenant_telemetry_spans_exported_total",
+		"Spans delivered to tenant telemetry sinks.", "tenant")
+	telemetrySpansDropped = metricsRegistry.Counter("tenant_telemetry_spans_dropped_total",
+		"Spans lost because a tenant sink was full or failing.", "tenant")
+	telemetryMetricsFailed = metricsRegistry.Counter("tenant_telemetry_metric_exports_failed_total",
+		"Metric exports a tenant sink failed; the cumulative values are sent again next time.", "tenant")
+)
+
+// tenantSpanHiddenAttrs are span attributes about the server, not the
+// tenant's request, left out of the tenant's traces
+var tenantSpanHiddenAttrs = []string{"openai.key"}
+
+// TelemetrySink is where a tenant wants its own telemetry delivered
+type TelemetrySink struct {
+	Type    string            `json:"type"` // "webhook" or "otlp"
+	URL     string            `json:"url"`  // for OTLP the logs endpoint, e.g. https://collector:4318/v1/logs
+	Headers map[string]string `json:"headers,omitempty"`
+	// Signals are what the sink receives: events, traces and metrics; empty
+	// means events only
+	Signals []string `json:"signals,omitempty"`
+	// TracesURL and MetricsURL are the OTLP endpoints of traces and metrics,
+	// by default URL with /v1/logs replaced by /v1/traces and /v1/metrics.
+	// Webhooks get every signal at URL.
+	TracesURL  string `json:"traces_url,omitempty"`
+	MetricsURL string `json:"metrics_url,omitempty"`
+	// Events limits the export to these event names; empty means all
+	Events []string `json:"events,omitempty"`
+}
+
+func (s *TelemetrySink) validate() error {
+	if s.Type != SinkWebhook && s.Type != SinkOTLP {
+		return fmt.Errorf("unknown telemetry sink type %q", s.Type)
+	}
+	if s.URL == "" {
+		return fmt.Errorf("telemetry sink without url")
+	}
+	for _, signal := range s.Signals {
+		switch signal {
+		case SignalEvents, SignalTraces, SignalMetrics:
+		default:
+			return fmt.Errorf("unknown telemetry signal %q (want events, traces or metrics)", signal)
+		}
+		if s.endpoint(signal) == "" {
+			return fmt.Errorf("otlp sink needs %s_url for %s, its url doesn't end in /v1/logs", signal, signal)
+		}
+	}
+	return nil
+}
+
+// receives tells whether the sink gets a signal
+func (s *TelemetrySink) receives(signal string) bool {
+	if len(s.Signals) == 0 {
+		return signal == SignalEvents
+	}
+	for _, sig := range s.Signals {
+		if sig == signal {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint is the URL a signal is sent to, "" when an OTLP sink has none
+func (s *TelemetrySink) endpoint(signal string) string {
+	if s.Type != SinkOTLP || signal == SignalEvents {
+		return s.URL
+	}
+	set := s.TracesURL
+	if signal == SignalMetrics {
+		set = s.MetricsURL
+	}
+	if set != "" {
+		return set
+	}
+	if base, ok := strings.CutSuffix(s.URL, "/v1/logs"); ok {
+		return base + "/v1/" + signal
+	}
+	return ""
+}
+
+func (s *TelemetrySink) wants(name string) bool {
+	if !s.receives(SignalEvents) {
+		return false
+	}
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TelemetryEvent is one thing that happened on behalf of a tenant
+type TelemetryEvent struct {
+	Name       string                 `json:"name"`
+	Time       time.Time              `json:"time"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// TenantMetric is one of a tenant's cumulative counters, per attribute set
+type TenantMetric struct {
+	Name       string                 `json:"name"`
+	Unit       string                 `json:"unit"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Value      float64                `json:"value"`
+}
+
+type tenantBuffer struct {
+	sink   *TelemetrySink
+	events []TelemetryEvent
+	spans  []*Span
+	// metrics are cumulative since the exporter started, by name and
+	// attributes; changed is set when they moved since the last export
+	metrics map[string]*TenantMetric
+	changed bool
+}
+
+// TelemetryExporter buffers events and spans per tenant, counts the tenant's
+// metrics, and ships them in batches to each tenant's own sink, so one
+// tenant's slow collector never blocks requests or the other tenants
+type TelemetryExporter struct {
+	client   *http.Client
+	interval time.Duration
+	start    time.Time
+
+	mu      sync.Mutex
+	buffers map[string]*tenantBuffer
+	flush   chan struct{}
+}
+
+func NewTelemetryExporter(client *http.Client, interval time.Duration) *TelemetryExporter {
+	return &TelemetryExporter{
+		client:   client,
+		interval: interval,
+		start:    time.Now(),
+		buffers:  make(map[string]*tenantBuffer),
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+// buffer returns the tenant's buffer, with e.mu held
+func (e *TelemetryExporter) buffer(t *Tenant) *tenantBuffer {
+	buf, ok := e.buffers[t.ID]
+	if !ok {
+		buf = &tenantBuffer{metrics: make(map[string]*TenantMetric)}
+		e.buffers[t.ID] = buf
+	}
+	buf.sink = t.Telemetry
+	return buf
+}
+
+// signalFull asks Run for an early flush
+func (e *TelemetryExporter) signalFull() {
+	select {
+	case e.flush <- struct{}{}:
+	default:
+	}
+}
+
+// Emit records an event for the tenant attached to ctx, if it has a sink,
+// and counts it in the tenant's metrics
+func (e *TelemetryExporter) Emit(ctx context.Context, name string, attrs map[string]interface{}) {
+	t := tenantFromContext(ctx)
+	if t == nil || t.Telemetry == nil {
+		return
+	}
+	if t.Telemetry.receives(SignalMetrics) {
+		e.observe(t, name, attrs)
+	}
+	if !t.Telemetry.wants(name) {
+		return
+	}
+
+	e.mu.Lock()
+	buf := e.buffer(t)
+	if len(buf.events) >= telemetryMaxBuffer {
+		buf.events = buf.events[1:]
+		telemetryDropped.Inc(t.ID)
+	}
+	buf.events = append(buf.events, TelemetryEvent{Name: name, Time: time.Now().UTC(), Attributes: attrs})
+	full := len(buf.events) >= telemetryMaxBatch
+	e.mu.Unlock()
+
+	if full {
+		e.signalFull()
+	}
+}
+
+// emitSpan queues a finished span of a tenant's request, if its sink
+// receives traces
+func (e *TelemetryExporter) emitSpan(t *Tenant, s *Span) {
+	if t.Telemetry == nil || !t.Telemetry.receives(SignalTraces) {
+		return
+	}
+	e.mu.Lock()
+	buf := e.buffer(t)
+	if len(buf.spans) >= telemetryMaxBuffer {
+		buf.spans = buf.spans[1:]
+		telemetrySpansDropped.Inc(t.ID)
+	}
+	buf.spans = append(buf.spans, s)
+	full := len(buf.spans) >= telemetryMaxBatch
+	e.mu.Unlock()
+
+	if full {
+		e.signalFull()
+	}
+}
+
+// observe counts an event in the tenant's metrics: searches and their
+// duration by route, model and result, OpenAI tokens and cost by model,
+// and budget refusals
+func (e *TelemetryExporter) observe(t *Tenant, name string, attrs map[string]interface{}) {
+	type point struct {
+		name, unit string
+		attrs      map[string]interface{}
+		value      float64
+	}
+	var points []point
+	switch name {
+	case "search.completed", "search.failed":
+		result := strings.TrimPrefix(name, "search.")
+		points = []point{
+			{"search.requests", "1", map[string]interface{}{"route": attrs["route"], "model": attrs["model"], "result": result}, 1},
+			{"search.duration", "ms", map[string]interface{}{"route": attrs["route"], "model": attrs["model"], "result": result}, metricValue(attrs["latency_ms"])},
+		}
+	case "openai.usage":
+		points = []point{
+			{"openai.tokens", "{token}", map[string]interface{}{"model": attrs["model"], "type": "prompt"}, metricValue(attrs["prompt_tokens"])},
+			{"openai.tokens", "{token}", map[string]interface{}{"model": attrs["model"], "type": "completion"}, metricValue(attrs["completion_tokens"])},
+			{"openai.cost", "USD", map[string]interface{}{"model": attrs["model"]}, metricValue(attrs["cost_usd"])},
+		}
+	case "budget.exceeded":
+		points = []point{
+			{"budget.exceeded", "1", map[string]interface{}{"scope": attrs["scope"], "period": attrs["period"]}, 1},
+		}
+	default:
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	buf := e.buffer(t)
+	for _, p := range points {
+		key := p.name
+		for _, kv := range otlpAttributes(p.attrs) {
+			key += fmt.Sprintf("|%v=%v", kv["key"], kv["value"])
+		}
+		m, ok := buf.metrics[key]
+		if !ok {
+			m = &TenantMetric{Name: p.name, Unit: p.unit, Attributes: p.attrs}
+			buf.metrics[key] = m
+		}
+		m.Value += p.value
+	}
+	buf.changed = true
+}
+
+// metricValue reads a numeric event attribute
+func metricValue(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// Run ships buffered events until ctx is cancelled
+func (e *TelemetryExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.Flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		e.Flush(ctx)
+	}
+}
+
+// Flush sends every tenant's pending telemetry, to the tenants' sinks at
+// once, each within telemetrySendTimeout
+func (e *TelemetryExporter) Flush(ctx context.Context) {
+	e.mu.Lock()
+	batches := make(map[string]*tenantBuffer, len(e.buffers))
+	for id, buf := range e.buffers {
+		if len(buf.events) == 0 && len(buf.spans) == 0 && !buf.changed {
+			continue
+		}
+		batch := &tenantBuffer{sink: buf.sink, events: buf.events, spans: buf.spans}
+		if buf.changed {
+			batch.metrics = make(map[string]*TenantMetric, len(buf.metrics))
+			for key, m := range buf.metrics {
+				c := *m
+				batch.metrics[key] = &c
+			}
+		}
+		buf.events, buf.spans, buf.changed = nil, nil, false
+		batches[id] = batch
+	}
+	e.mu.Unlock()
+
+	slots := make(chan struct{}, telemetryMaxConcurrentSends)
+	var wg sync.WaitGroup
+	for id, batch := range batches {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(id string, batch *tenantBuffer) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(ctx, telemetrySendTimeout)
+			defer cancel()
+			e.flushTenant(ctx, id, batch)
+		}(id, batch)
+	}
+	wg.Wait()
+}
+
+// flushTenant sends one tenant's batch
+func (e *TelemetryExporter) flushTenant(ctx context.Context, id string, batch *tenantBuffer) {
+	for start := 0; start < len(batch.events); start += telemetryMaxBatch {
+		events := batch.events[start:min(start+telemetryMaxBatch, len(batch.events))]
+		var payload interface{} = map[string]interface{}{"tenant": id, "events": events}
+		if batch.sink.Type == SinkOTLP {
+			payload = otlpLogs(id, events)
+		}
+		if err := e.send(ctx, batch.sink.endpoint(SignalEvents), batch.sink, payload); err != nil {
+			slog.Warn("Telemetry export failed", "tenant", id, "events", len(events), "error", err)
+			telemetryDropped.Add(float64(len(events)), id)
+			continue
+		}
+		telemetryExported.Add(float64(len(events)), id)
+	}
+
+	for start := 0; start < len(batch.spans); start += telemetryMaxBatch {
+		spans := otlpSpans(batch.spans[start:min(start+telemetryMaxBatch, len(batch.spans))], tenantSpanHiddenAttrs...)
+		var payload interface{} = map[string]interface{}{"tenant": id, "spans": spans}
+		if batch.sink.Type == SinkOTLP {
+			payload = otlpResource(id, "resourceSpans", "scopeSpans", "spans", spans)
+		}
+		if err := e.send(ctx, batch.sink.endpoint(SignalTraces), batch.sink, payload); err != nil {
+			slog.Warn("Telemetry span export failed", "tenant", id, "spans", len(spans), "error", err)
+			telemetrySpansDropped.Add(float64(len(spans)), id)
+			continue
+		}
+		telemetrySpansExported.Add(float64(len(spans)), id)
+	}
+
+	if batch.metrics == nil {
+		return
+	}
+	metrics := make([]*TenantMetric, 0, len(batch.metrics))
+	keys := make([]string, 0, len(batch.metrics))
+	for key := range batch.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		metrics = append(metrics, batch.metrics[key])
+	}
+	now := time.Now().UTC()
+	var payload interface{} = map[string]interface{}{"tenant": id, "start": e.start.UTC(), "time": now, "metrics": metrics}
+	if batch.sink.Type == SinkOTLP {
+		payload = otlpMetrics(id, e.start, now, metrics)
+	}
+	if err := e.send(ctx, batch.sink.endpoint(SignalMetrics), batch.sink, payload); err != nil {
+		slog.Warn("Telemetry metric export failed", "tenant", id, "error", err)
+		telemetryMetricsFailed.Inc(id)
+		// The values are cumulative, the next export carries them
+		e.mu.Lock()
+		if buf, ok := e.buffers[id]; ok {
+			buf.changed = true
+		}
+		e.mu.Unlock()
+	}
+}
+
+func (e *TelemetryExporter) send(ctx context.Context, url string, sink *TelemetrySink, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling telemetry: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range sink.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling sink: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpLogs encodes events as an OTLP/HTTP JSON logs export request
+func otlpLogs(tenantID string, events []TelemetryEvent) map[string]interface{} {
+	records := make([]map[string]interface{}, len(events))
+	for i, ev := range events {
+		records[i] = map[string]interface{}{
+			"timeUnixNano": strconv.FormatInt(ev.Time.UnixNano(), 10),
+			"severityText": "INFO",
+			"body":         map[string]interface{}{"stringValue": ev.Name},
+			"attributes":   otlpAttributes(ev.Attributes),
+		}
+	}
+	return otlpResource(tenantID, "resourceLogs", "scopeLogs", "logRecords", records)
+}
+
+// otlpMetrics encodes a tenant's counters as an OTLP/HTTP JSON metrics
+// export request of cumulative sums
+func otlpMetrics(tenantID string, start, now time.Time, metrics []*TenantMetric) map[string]interface{} {
+	var out []map[string]interface{}
+	byName := make(map[string]map[string]interface{})
+	for _, m := range metrics {
+		metric, ok := byName[m.Name]
+		if !ok {
+			metric = map[string]interface{}{
+				"name": m.Name,
+				"unit": m.Unit,
+				"sum": map[string]interface{}{
+					"aggregationTemporality": 2,
+					"isMonotonic":            true,
+					"dataPoints":             []map[string]interface{}{},
+				},
+			}
+			byName[m.Name] = metric
+			out = append(out, metric)
+		}
+		sum := metric["sum"].(map[string]interface{})
+		sum["dataPoints"] = append(sum["dataPoints"].([]map[string]interface{}), map[string]interface{}{
+			"attributes":        otlpAttributes(m.Attributes),
+			"startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+			"timeUnixNano":      strconv.FormatInt(now.UnixNano(), 10),
+			"asDouble":          m.Value,
+		})
+	}
+	return otlpResource(tenantID, "resourceMetrics", "scopeMetrics", "metrics", out)
+}
+
+// otlpResource wraps a tenant's records in the OTLP resource and scope of a
+// signal
+func otlpResource(tenantID, resourceKey, scopeKey, recordsKey string, records interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		resourceKey: []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name": "ai-powered-search",
+					"tenant.id":    tenantID,
+				}),
+			},
+			scopeKey: []map[string]interface{}{{
+				"scope":    map[string]interface{}{"name": "ai-powered-search/tenant-telemetry"},
+				recordsKey: records,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts a map to OTLP KeyValues, sorted for stable output
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		var value map[string]interface{}
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTelemetryExporterFlush(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]string)
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow.example" {
+			// A collector that never answers
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		bodies[req.URL.Path] = string(body)
+		mu.Unlock()
+		return fakeResponse(http.StatusOK, ""), nil
+	})}
+	e := NewTelemetryExporter(client, time.Hour)
+	tr := &Tracer{sampleRatio: 1, flush: make(chan struct{}, 1)}
+	tr.UseTenantTelemetry(e)
+
+	fast := &Tenant{ID: "fast", Telemetry: &TelemetrySink{
+		Type: SinkOTLP, URL: "http://fast.example/v1/logs",
+		Signals: []string{SignalEvents, SignalTraces, SignalMetrics},
+	}}
+	slow := &Tenant{ID: "slow", Telemetry: &TelemetrySink{Type: SinkWebhook, URL: "http://slow.example/hook"}}
+	for _, tenant := range []*Tenant{fast, slow} {
+		if err := tenant.Telemetry.validate(); err != nil {
+			t.Fatal(err)
+		}
+		ctx := withTenant(context.Background(), tenant)
+		_, span := tr.Start(ctx, "search.analyze", SpanKindInternal)
+		span.SetAttr("openai.key", "key-1")
+		span.SetAttr("search.route", "simple")
+		e.Emit(ctx, "search.completed", map[string]interface{}{"route": "simple", "model": "gpt-4o-mini", "latency_ms": int64(420)})
+		e.Emit(ctx, "openai.usage", map[string]interface{}{"model": "gpt-4o-mini", "prompt_tokens": 100, "completion_tokens": 20, "cost_usd": 0.0001})
+		span.End()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	e.Flush(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("flush took %v, the slow tenant held it up", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, want := range map[string][]string{
+		"/v1/logs":    {"resourceLogs", "search.completed", `"stringValue":"fast"`},
+		"/v1/traces":  {"resourceSpans", "search.analyze", "search.route"},
+		"/v1/metrics": {"resourceMetrics", "search.requests", "search.duration", "openai.tokens", `"asDouble":420`},
+	} {
+		body, ok := bodies[path]
+		if !ok {
+			t.Errorf("nothing sent to %s", path)
+			continue
+		}
+		for _, s := range want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s body lacks %s: %s", path, s, body)
+			}
+		}
+	}
+	if strings.Contains(bodies["/v1/traces"], "openai.key") {
+		t.Errorf("tenant spans carry the key label: %s", bodies["/v1/traces"])
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Limits of a tenant's prompt customization, so it can't crowd out the
+// analysis prompt itself
+const (
+	maxPreferredSites      = 20
+	maxGlossaryTerms       = 100
+	maxGlossaryTermLength  = 64
+	maxGlossaryMeanLength  = 256
+	maxTenantPromptOverlay = 8 << 10
+)
+
+// promptOperators are the operators a tenant can ban, with the operator of
+// the engines' Operators lists each one stands for
+var promptOperators = map[string]string{
+	"exact":    `"exact phrase"`,
+	"site":     "site:",
+	"filetype": "filetype:",
+	"exclude":  "-exclude",
+	"after":    "after:",
+}
+
+var tenantPromptOperatorsDropped = metricsRegistry.Counter("tenant_prompt_operators_dropped_total",
+	"Intent fields emptied because the tenant bans their operator, by operator.", "operator")
+
+// TenantPrompt is the part of the analysis prompt a tenant overrides,
+// merged into the system prompt of each of its requests
+type TenantPrompt struct {
+	// PreferredSites are the site_filter the model picks from when the prompt
+	// names no site but one of them fits
+	PreferredSites []string `json:"preferred_sites,omitempty"`
+	// Glossary explains the tenant's jargon, meaning by term
+	Glossary map[string]string `json:"glossary,omitempty"`
+	// BannedOperators are never put in the tenant's search URLs: exact,
+	// site, filetype, exclude or after
+	BannedOperators []string `json:"banned_operators,omitempty"`
+}
+
+// validate normalizes the preferred sites to bare hostnames and the banned
+// operators to their names
+func (p *TenantPrompt) validate() error {
+	if len(p.PreferredSites) > maxPreferredSites {
+		return fmt.Errorf("prompt has more than %d preferred sites", maxPreferredSites)
+	}
+	for i, s := range p.PreferredSites {
+		host := sanitizeSiteFilter(s)
+		if host == "" {
+			return fmt.Errorf("preferred site %q is not a domain", s)
+		}
+		p.PreferredSites[i] = host
+	}
+	if len(p.Glossary) > maxGlossaryTerms {
+		return fmt.Errorf("prompt glossary has more than %d terms", maxGlossaryTerms)
+	}
+	for term, meaning := range p.Glossary {
+		if strings.TrimSpace(term) == "" || strings.TrimSpace(meaning) == "" {
+			return fmt.Errorf("glossary terms need a meaning")
+		}
+		if len(term) > maxGlossaryTermLength || len(meaning) > maxGlossaryMeanLength {
+			return fmt.Errorf("glossary term %q is longer than %d characters or its meaning than %d", term, maxGlossaryTermLength, maxGlossaryMeanLength)
+		}
+	}
+	for i, op := range p.BannedOperators {
+		name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(op), ":"))
+		if _, ok := promptOperators[name]; !ok {
+			return fmt.Errorf("unknown banned operator %q (want exact, site, filetype, exclude or after)", op)
+		}
+		p.BannedOperators[i] = name
+	}
+	if len(p.PreferredSites) > 0 && slices.Contains(p.BannedOperators, "site") {
+		return fmt.Errorf("preferred sites need the site operator, which is banned")
+	}
+	if n := len(p.overlay()); n > maxTenantPromptOverlay {
+		return fmt.Errorf("prompt customization is %d bytes, more than %d", n, maxTenantPromptOverlay)
+	}
+	return nil
+}
+
+// customize merges a tenant's customization into the prompt data; the
+// templates only see the operators the search may use
+func (d *PromptData) customize(p *TenantPrompt) {
+	if p == nil {
+		return
+	}
+	d.Tenant = p
+	if len(p.BannedOperators) == 0 {
+		return
+	}
+	allowed := make([]string, 0, len(d.Operators))
+	for _, op := range d.Operators {
+		banned := false
+		for _, name := range p.BannedOperators {
+			if promptOperators[name] == op {
+				banned = true
+				break
+			}
+		}
+		if !banned {
+			allowed = append(allowed, op)
+		}
+	}
+	d.Operators = allowed
+}
+
+// overlay is the text appended to the system prompt. Glossary terms are
+// sorted, the same customization always gives the same prompt and so the
+// same cache entries.
+func (p *TenantPrompt) overlay() string {
+	if p == nil {
+		return ""
+	}
+	var lines []string
+	if len(p.PreferredSites) > 0 {
+		lines = append(lines, "When the prompt names no site but one of "+strings.Join(p.PreferredSites, ", ")+" fits it, set site_filter to that site.")
+	}
+	if len(p.Glossary) > 0 {
+		terms := make([]string, 0, len(p.Glossary))
+		for term := range p.Glossary {
+			terms = append(terms, term)
+		}
+		sort.Strings(terms)
+		glossary := make([]string, len(terms))
+		for i, term := range terms {
+			glossary[i] = fmt.Sprintf("%q means %s", oneLine(term), oneLine(p.Glossary[term]))
+		}
+		lines = append(lines, "The user's organization uses its own terms: "+strings.Join(glossary, "; ")+". Search for what they mean when the web wouldn't know them.")
+	}
+	for _, name := range p.BannedOperators {
+		switch name {
+		case "exact":
+			lines = append(lines, "Always return exact_phrases as [] and keep the phrases in main_query.")
+		case "site":
+			lines = append(lines, `Always return site_filter as "".`)
+		case "filetype":
+			lines = append(lines, `Always return file_type as "".`)
+		case "exclude":
+			lines = append(lines, "Always return exclude_words as [].")
+		case "after":
+			lines = append(lines, `Always return date_range as "".`)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// oneLine keeps a glossary entry from breaking the prompt's lines
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// bans tells whether the tenant banned an operator
+func (p *TenantPrompt) bans(operator string) bool {
+	return p != nil && slices.Contains(p.BannedOperators, operator)
+}
+
+// enforce empties the intent fields of the banned operators, which the model
+// may have filled anyway. The intent is a copy owned by the caller.
+func (p *TenantPrompt) enforce(intent *SearchIntent) {
+	if p == nil || intent == nil {
+		return
+	}
+	for _, name := range p.BannedOperators {
+		dropped := false
+		switch name {
+		case "exact":
+			// The phrases stay in the query, unquoted
+			for _, phrase := range intent.ExactPhrases {
+				if !strings.Contains(strings.ToLower(intent.MainQuery), strings.ToLower(phrase)) {
+					intent.MainQuery = strings.TrimSpace(intent.MainQuery + " " + phrase)
+				}
+			}
+			if len(intent.ExactPhrases) > 0 {
+				intent.ExactPhrases, dropped = []string{}, true
+			}
+		case "site":
+			dropped = intent.SiteFilter != ""
+			intent.SiteFilter = ""
+		case "filetype":
+			dropped = intent.FileType != ""
+			intent.FileType = ""
+		case "exclude":
+			// The tenant's blocked domains too, they are -site: operators
+			if len(intent.ExcludeWords) > 0 || len(intent.ExcludeSites) > 0 {
+				intent.ExcludeWords, intent.ExcludeSites, dropped = []string{}, nil, true
+			}
+		case "after":
+			dropped = intent.DateRange != ""
+			intent.DateRange = ""
+		}
+		if dropped {
+			tenantPromptOperatorsDropped.Inc(name)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// DefaultTenantID is used for requests without a recognized API key
+const DefaultTenantID = "default"
+
+// Tenant is a customer of the API, identified by one or more API keys
+type Tenant struct {
+	ID      string   `json:"id"`
+	APIKeys []string `json:"api_keys"`
+	// SigningKeys are the secrets, by key ID, of the services signing their
+	// requests instead of sending an API key
+	SigningKeys map[string]string `json:"signing_keys,omitempty"`
+	// ClientCertificates are the identities of the client certificates
+	// authenticating as this tenant: a URI, DNS or email SAN, or the
+	// subject's common name
+	ClientCertificates []string `json:"client_certificates,omitempty"`
+	// Weight is the tenant's share of upstream capacity when it is contended
+	Weight float64 `json:"weight"`
+
+	// Spend limits in USD, zero means unlimited
+	DailyBudgetUSD   float64 `json:"daily_budget_usd"`
+	MonthlyBudgetUSD float64 `json:"monthly_budget_usd"`
+	// BudgetAction overrides BUDGET_ACTION for this tenant
+	BudgetAction string `json:"budget_action"`
+
+	// Telemetry receives this tenant's own events, if set
+	Telemetry *TelemetrySink `json:"telemetry,omitempty"`
+
+	// AnalyticsOptIn allows sampling anonymized intents for product analytics;
+	// AnalyticsSampleRate overrides ANALYTICS_SAMPLE_RATE
+	AnalyticsOptIn      bool    `json:"analytics_opt_in"`
+	AnalyticsSampleRate float64 `json:"analytics_sample_rate,omitempty"`
+	// AnalyticsPrivacy overrides USAGE_ANALYTICS_PRIVACY for this tenant's
+	// queries
+	AnalyticsPrivacy string `json:"analytics_privacy,omitempty"`
+
+	// LogPrivacy overrides LOG_PRIVACY for this tenant's requests
+	LogPrivacy string `json:"log_privacy,omitempty"`
+	// PIIMode overrides PII_MODE for this tenant's requests
+	PIIMode string `json:"pii_mode,omitempty"`
+
+	// BlockedDomains are dropped from fetched results and excluded from
+	// search URLs with -site:, with their subdomains. AllowedDomains, when
+	// set, are the only ones kept in fetched results, a blocked subdomain of
+	// one excepted; they also except their subdomains from a blocked domain.
+	BlockedDomains []string `json:"blocked_domains,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+
+	// Prompt customizes the analysis prompt of the tenant's requests
+	Prompt *TenantPrompt `json:"prompt,omitempty"`
+}
+
+// TenantRegistry resolves API keys to tenants
+type TenantRegistry struct {
+	mu       sync.RWMutex
+	byKey    map[string]*Tenant
+	byID     map[string]*Tenant
+	fallback *Tenant
+	// bySigningKey resolves the key IDs of signed requests
+	bySigningKey map[string]signingKey
+	// byCertificate resolves the identities of client certificates
+	byCertificate map[string]*Tenant
+	// managed holds the keys issued through the admin API, if enabled
+	managed *APIKeyStore
+	audit   *AuditLog
+	signer  *RequestSigner
+}
+
+// UseKeyStore makes keys issued through the admin API resolve to their tenant
+func (reg *TenantRegistry) UseKeyStore(store *APIKeyStore) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.managed = store
+}
+
+// UseAuditLog records the budget changes of every reload to the audit log
+func (reg *TenantRegistry) UseAuditLog(audit *AuditLog) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.audit = audit
+}
+
+// byIDLocked returns every tenant by ID, the default one included. Callers hold
+// the registry's lock.
+func (reg *TenantRegistry) byIDLocked() map[string]*Tenant {
+	tenants := map[string]*Tenant{DefaultTenantID: reg.fallback}
+	for id, t := range reg.byID {
+		tenants[id] = t
+	}
+	return tenants
+}
+
+type tenantsFile struct {
+	Default *Tenant   `json:"default"`
+	Tenants []*Tenant `json:"tenants"`
+}
+
+// LoadTenants reads tenant definitions from a JSON file. An empty path yields
+// a registry where every request belongs to the default tenant.
+func LoadTenants(path string) (*TenantRegistry, error) {
+	if path == "" {
+		return &TenantRegistry{
+			byKey:    make(map[string]*Tenant),
+			fallback: &Tenant{ID: DefaultTenantID, Weight: 1},
+		}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants file: %v", err)
+	}
+	return parseTenants(data, path)
+}
+
+// Reload validates new tenant definitions and swaps them in at once. On error
+// the current tenants stay in place.
+func (reg *TenantRegistry) Reload(data []byte, path string) error {
+	next, err := parseTenants(data, path)
+	if err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	before := reg.byIDLocked()
+	reg.byKey, reg.byID, reg.fallback = next.byKey, next.byID, next.fallback
+	reg.bySigningKey, reg.byCertificate = next.bySigningKey, next.byCertificate
+	reg.audit.auditBudgets(before, reg.byIDLocked())
+	return nil
+}
+
+func parseTenants(data []byte, path string) (*TenantRegistry, error) {
+	reg := &TenantRegistry{
+		byKey:         make(map[string]*Tenant),
+		byID:          make(map[string]*Tenant),
+		fallback:      &Tenant{ID: DefaultTenantID, Weight: 1},
+		bySigningKey:  make(map[string]signingKey),
+		byCertificate: make(map[string]*Tenant),
+	}
+	var file tenantsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file: %v", err)
+	}
+
+	if file.Default != nil {
+		file.Default.ID = DefaultTenantID
+		if file.Default.Weight <= 0 {
+			file.Default.Weight = 1
+		}
+		if err := file.Default.validateDomains(); err != nil {
+			return nil, fmt.Errorf("default tenant: %v", err)
+		}
+		if file.Default.AnalyticsPrivacy != "" {
+			if err := validateQueryPrivacy(file.Default.AnalyticsPrivacy); err != nil {
+				return nil, fmt.Errorf("default tenant: %v", err)
+			}
+		}
+		if file.Default.Prompt != nil {
+			if err := file.Default.Prompt.validate(); err != nil {
+				return nil, fmt.Errorf("default tenant: %v", err)
+			}
+		}
+		reg.fallback = file.Default
+	}
+
+	for _, t := range file.Tenants {
+		if t.ID == "" {
+			return nil, fmt.Errorf("tenant without id in %s", path)
+		}
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		if err := validateBudgetAction(t.BudgetAction); t.BudgetAction != "" && err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+		}
+		if t.LogPrivacy != "" {
+			if err := validateLogPrivacy(t.LogPrivacy); err != nil {
+				return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+			}
+		}
+		if t.PIIMode != "" {
+			if err := validatePIIMode(t.PIIMode); err != nil {
+				return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+			}
+		}
+		if t.AnalyticsPrivacy != "" {
+			if err := validateQueryPrivacy(t.AnalyticsPrivacy); err != nil {
+				return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+			}
+		}
+		if t.Telemetry != nil {
+			if err := t.Telemetry.validate(); err != nil {
+				return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+			}
+		}
+		if err := t.validateDomains(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+		}
+		if t.Prompt != nil {
+			if err := t.Prompt.validate(); err != nil {
+				return nil, fmt.Errorf("tenant %q: %v", t.ID, err)
+			}
+		}
+		for _, key := range t.APIKeys {
+			if other, ok := reg.byKey[key]; ok {
+				return nil, fmt.Errorf("API key of tenant %q is also assigned to %q", t.ID, other.ID)
+			}
+			reg.byKey[key] = t
+		}
+		for keyID, secret := range t.SigningKeys {
+			if keyID == "" || len(secret) < minSigningSecretLength {
+				return nil, fmt.Errorf("tenant %q: signing keys need an ID and a secret of at least %d characters", t.ID, minSigningSecretLength)
+			}
+			if other, ok := reg.bySigningKey[keyID]; ok {
+				return nil, fmt.Errorf("signing key %q of tenant %q is also assigned to %q", keyID, t.ID, other.tenant.ID)
+			}
+			reg.bySigningKey[keyID] = signingKey{tenant: t, secret: secret}
+		}
+		for _, id := range t.ClientCertificates {
+			if other, ok := reg.byCertificate[id]; ok {
+				return nil, fmt.Errorf("client certificate %q of tenant %q is also assigned to %q", id, t.ID, other.ID)
+			}
+			reg.byCertificate[id] = t
+		}
+		reg.byID[t.ID] = t
+	}
+	return reg, nil
+}
+
+// Resolve returns the tenant owning the request's API key, or the default tenant
+func (reg *TenantRegistry) Resolve(r *http.Request) *Tenant {
+	if t, ok := reg.Lookup(apiKeyFromRequest(r)); ok {
+		return t
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.fallback
+}
+
+// Lookup returns the tenant owning an API key. Managed keys only resolve
+// while they are active.
+func (reg *TenantRegistry) Lookup(key string) (*Tenant, bool) {
+	reg.mu.RLock()
+	t, ok := reg.byKey[key]
+	managed := reg.managed
+	reg.mu.RUnlock()
+	if ok {
+		return t, true
+	}
+	tenantID, status, ok := managed.Check(key)
+	if !ok || status != KeyActive {
+		return nil, false
+	}
+	return reg.ByID(tenantID)
+}
+
+// ByID returns a tenant by its ID
+func (reg *TenantRegistry) ByID(id string) (*Tenant, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if id == DefaultTenantID {
+		return reg.fallback, true
+	}
+	t, ok := reg.byID[id]
+	return t, ok
+}
+
+// Middleware attaches the resolved tenant and the identity it was
+// authenticated with to the request context
+func (reg *TenantRegistry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var t *Tenant
+		method, keyUser := "", ""
+		if isSigned(r) {
+			// A signature that doesn't hold is refused, not taken for
+			// an anonymous request
+			var ok bool
+			if t, ok = reg.authenticateSigned(w, r); !ok {
+				return
+			}
+			method = AuthSignature
+		} else if cert, ok := reg.resolveCertificate(r); ok {
+			// A mapped certificate decides the tenant, whatever API key
+			// comes with it
+			t, method = cert, AuthCertificate
+		} else {
+			// A suspended or expired key must not silently fall back to
+			// the default tenant
+			reg.mu.RLock()
+			managed := reg.managed
+			reg.mu.RUnlock()
+			key := apiKeyFromRequest(r)
+			if _, status, ok := managed.Check(key); ok && status != KeyActive {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "api_key_" + status})
+				return
+			}
+			if t, ok = reg.Lookup(key); ok {
+				method, keyUser = AuthAPIKey, managed.User(key)
+			} else {
+				t = reg.Resolve(r)
+			}
+		}
+		requestInfoFromContext(r.Context()).setTenant(t.ID)
+		spanFromContext(r.Context()).setTenant(t)
+		ctx := withIdentity(withTenant(r.Context(), t), requestIdentity(r, method, keyUser))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type tenantContextKey struct{}
+
+func withTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, t)
+}
+
+// tenantFromContext returns the request's tenant, or nil outside a request
+func tenantFromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return t
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// CertReloader serves a certificate pair from disk and swaps it when the
+// files are rotated, without dropping connections
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the pair again; it ignores data so that it can be registered
+// for both files with the config watcher. A mismatched pair, as seen halfway
+// through a rotation, keeps the current certificate.
+func (c *CertReloader) Reload([]byte) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate is the tls.Config hook
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// TLSConfig returns the server TLS settings using the reloaded certificate
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS.
+// httpsPort is omitted from the location when it is the default 443.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		// 301 is what browsers expect, 308 keeps the method and body of API calls
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
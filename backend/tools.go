@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ToolDefinition follows the OpenAI "tools" format so the schema can be passed
+// straight into another application's chat completion request
+type ToolDefinition struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction describes a single callable function and its JSON schema
+type ToolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// ToolCall is the body accepted by /v1/tools/call. Arguments may be the raw
+// JSON string produced by the model or an already decoded object.
+type ToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+var promptParameters = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"prompt": map[string]interface{}{
+			"type":        "string",
+			"description": "What the user is looking for, in natural language",
+		},
+	},
+	"required":             []string{"prompt"},
+	"additionalProperties": false,
+}
+
+// searchIntentSchema is the JSON schema of the SearchIntent returned by analyze_search
+var searchIntentSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"main_query":    map[string]interface{}{"type": "string"},
+		"exact_phrases": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"site_filter":   map[string]interface{}{"type": "string"},
+		"file_type":     map[string]interface{}{"type": "string"},
+		"exclude_words": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"date_range":    map[string]interface{}{"type": "string"},
+		"exclude_sites": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "The tenant's blocked domains, not the model's"},
+		"scope":         map[string]interface{}{"type": "string", "enum": intentScopes},
+		"entities":      intentEntitySchema,
+	},
+	"required": []string{"main_query"},
+}
+
+var toolDefinitions = []ToolDefinition{
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "analyze_search",
+			Description: "Turn a natural language search request into structured search parameters: main query, exact phrases, site filter, file type, excluded words and date range.",
+			Parameters:  promptParameters,
+		},
+	},
+	{
+		Type: "function",
+		Function: ToolFunction{
+			Name:        "web_search",
+			Description: "Build an optimized web search URL (with site:, filetype:, exclusions and exact phrases) for a natural language search request.",
+			Parameters:  promptParameters,
+		},
+	},
+}
+
+// handleTools serves the tool definitions plus how to invoke them over HTTP
+func (h *SearchHandler) handleTools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set(intentVersionHeader, strconv.Itoa(version))
+	w.Header().Add("Vary", intentVersionHeader)
+
+	writeCacheableJSON(w, r, cachePublicShort, map[string]interface{}{
+		"tools": toolDefinitions,
+		"invocation": map[string]interface{}{
+			"method":       "POST",
+			"path":         "/v1/tools/call",
+			"content_type": "application/json",
+			"body":         `{"name": "<tool name>", "arguments": <arguments from the model>}`,
+		},
+		"returns": map[string]interface{}{
+			"analyze_search": map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"intent": intentSchemaFor(version)},
+			},
+			"web_search": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"search_url": map[string]interface{}{"type": "string", "format": "uri"},
+					"query":      map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	})
+}
+
+// handleToolCall executes one of the advertised tools
+func (h *SearchHandler) handleToolCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var call ToolCall
+	if err := json.Unmarshal(body, &call); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	args, err := decodeToolArguments(call.Arguments)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if args.Prompt == "" {
+		http.Error(w, "Missing required argument: prompt", http.StatusBadRequest)
+		return
+	}
+
+	switch call.Name {
+	case "analyze_search":
+		result, err := h.analyze(r.Context(), args.Prompt, AnalyzeOptions{})
+		if err != nil {
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		w.Header().Set(intentVersionHeader, strconv.Itoa(version))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"intent": renderIntent(result.Intent, version)})
+
+	case "web_search":
+		result, err := h.analyze(r.Context(), args.Prompt, AnalyzeOptions{})
+		if err != nil {
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		intent := result.Intent
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"search_url": constructSearchQuery(intent),
+			"query":      buildQueryString(intent),
+		})
+
+	default:
+		http.Error(w, fmt.Sprintf("Unknown tool %q", call.Name), http.StatusNotFound)
+	}
+}
+
+type promptArguments struct {
+	Prompt string `json:"prompt"`
+}
+
+// decodeToolArguments accepts both `"{\"prompt\": ...}"` and `{"prompt": ...}`
+func decodeToolArguments(raw json.RawMessage) (*promptArguments, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("Missing tool arguments")
+	}
+
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		raw = json.RawMessage(encoded)
+	}
+
+	var args promptArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("Invalid tool arguments: %v", err)
+	}
+	return &args, nil
+}
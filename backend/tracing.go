@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+const (
+	traceMaxBatch  = 512
+	traceMaxBuffer = 4096
+)
+
+var (
+	tracesExported = metricsRegistry.Counter("trace_spans_exported_total",
+		"Spans delivered to the OTLP endpoint.")
+	tracesDropped = metricsRegistry.Counter("trace_spans_dropped_total",
+		"Spans lost because the buffer was full or the export failed.")
+)
+
+// traceIDHeader returns the trace ID on every traced response, so a client
+// can quote one identifier for logs, traces, history and OpenAI calls
+const traceIDHeader = "X-Trace-ID"
+
+// tracer is the process-wide tracer. It always creates spans, so trace IDs
+// can be propagated and reported, but only exports them once configured.
+var tracer = &Tracer{sampleRatio: 1, flush: make(chan struct{}, 1)}
+
+// Span is one timed operation of a trace
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	remote   bool // parent received in a traceparent header, not ours to export
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]interface{}
+	errMsg string
+	// tenant is whose request the span is part of, which also gets it when
+	// its telemetry sink receives traces
+	tenant *Tenant
+}
+
+// TraceID returns the hex trace ID, or "" for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Traceparent formats the span as a W3C traceparent header value
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags)
+}
+
+// SetAttr records an attribute on the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// setTenant tells whose request the span is part of, once the tenant is
+// known
+func (s *Span) setTenant(t *Tenant) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenant = t
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	tenant := s.tenant
+	s.mu.Unlock()
+
+	if s.sampled && !s.remote {
+		s.tracer.enqueue(s)
+	}
+	// Tenants get their spans whatever our own sampling
+	if tenant != nil && !s.remote && s.tracer.tenants != nil {
+		s.tracer.tenants.emitSpan(tenant, s)
+	}
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the current span, or nil
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// Tracer creates spans and exports them to an OTLP/HTTP endpoint
+type Tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+	// tenants exports the spans of tenants whose sinks receive traces
+	tenants *TelemetryExporter
+
+	mu      sync.Mutex
+	pending []*Span
+	flush   chan struct{}
+}
+
+// Configure enables export to an OTLP/HTTP traces endpoint
+// (e.g. http://collector:4318/v1/traces)
+func (t *Tracer) Configure(endpoint string, headers map[string]string, serviceName string, sampleRatio float64, client *http.Client) {
+	t.endpoint = endpoint
+	t.headers = headers
+	t.serviceName = serviceName
+	t.sampleRatio = sampleRatio
+	t.client = client
+}
+
+// UseTenantTelemetry sends each tenant's spans to its own telemetry sink,
+// when it receives traces. Call before serving.
+func (t *Tracer) UseTenantTelemetry(e *TelemetryExporter) {
+	t.tenants = e
+}
+
+// Start begins a span as a child of the span in ctx, or a new trace
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), tenant: tenantFromContext(ctx)}
+	rand.Read(s.spanID[:])
+
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+		if s.tenant == nil {
+			parent.mu.Lock()
+			s.tenant = parent.tenant
+			parent.mu.Unlock()
+		}
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	s.sampled = s.sampled && t.endpoint != ""
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// sample decides from the trace ID, so every service agrees on the same trace
+func (t *Tracer) sample(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11)/(1<<53) < t.sampleRatio
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent span
+func parseTraceparent(header string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	s := &Span{remote: true}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+	return s, true
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the writer below, e.g. to flush
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware wraps each request in a server span, continuing the caller's
+// trace when a valid traceparent header is sent
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, parent)
+		}
+		ctx, span := t.Start(ctx, r.Method+" "+r.URL.Path, SpanKindServer)
+		defer span.End()
+		w.Header().Set(traceIDHeader, span.TraceID())
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttr("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.RecordError(fmt.Errorf("HTTP %d", rec.status))
+		}
+	})
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	if len(t.pending) >= traceMaxBuffer {
+		t.mu.Unlock()
+		tracesDropped.Inc()
+		return
+	}
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= traceMaxBatch
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run exports finished spans every interval until ctx is cancelled
+func (t *Tracer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Flush(context.Background())
+			return
+		case <-ticker.C:
+		case <-t.flush:
+		}
+		t.Flush(ctx)
+	}
+}
+
+// Flush exports the pending spans
+func (t *Tracer) Flush(ctx context.Context) {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for start := 0; start < len(spans); start += traceMaxBatch {
+		batch := spans[start:min(start+traceMaxBatch, len(spans))]
+		if err := t.export(ctx, batch); err != nil {
+			slog.Error("Error exporting spans", "spans", len(batch), "error", err)
+			tracesDropped.Add(float64(len(batch)))
+			continue
+		}
+		tracesExported.Add(float64(len(batch)))
+	}
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.otlpTraces(spans))
+	if err != nil {
+		return fmt.Errorf("error marshaling spans: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating OTLP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling OTLP endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpTraces encodes spans as an OTLP/HTTP JSON trace export request
+func (t *Tracer) otlpTraces(spans []*Span) map[string]interface{} {
+	out := otlpSpans(spans)
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.serviceName}),
+			},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]interface{}{"name": "ai-powered-search"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+// otlpSpans encodes spans as OTLP JSON spans, without the hidden attributes
+func otlpSpans(spans []*Span, hidden ...string) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		attrs := s.attrs
+		if len(hidden) > 0 {
+			attrs = make(map[string]interface{}, len(s.attrs))
+			for k, v := range s.attrs {
+				if !slices.Contains(hidden, k) {
+					attrs[k] = v
+				}
+			}
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(attrs),
+			"status":            map[string]interface{}{"code": 1},
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		out[i] = span
+	}
+	return out
+}
+
+// parseOTLPHeaders reads OTEL_EXPORTER_OTLP_HEADERS ("k1=v1,k2=v2")
+func parseOTLPHeaders(spec string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			continue
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
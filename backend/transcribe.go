@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OPENAI_TRANSCRIPTIONS_URL = "https://api.openai.com/v1/audio/transcriptions"
+
+// audioPricing is the OpenAI list price of transcription in USD per minute
+// of audio
+var audioPricing = map[string]float64{
+	"whisper-1": 0.006,
+}
+
+// fallbackAudioPrice is charged for models missing from audioPricing
+const fallbackAudioPrice = 0.006
+
+// audioFormats are the file extensions Whisper accepts
+var audioFormats = map[string]bool{
+	"flac": true, "m4a": true, "mp3": true, "mp4": true, "mpeg": true,
+	"mpga": true, "oga": true, "ogg": true, "wav": true, "webm": true,
+}
+
+var languageRe = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+var (
+	transcriptions = metricsRegistry.Counter("audio_transcriptions_total",
+		"Voice queries transcribed, by result (ok, empty, error).", "result")
+	transcribedSeconds = metricsRegistry.Counter("audio_transcribed_seconds_total",
+		"Seconds of audio transcribed.")
+)
+
+// Transcript is what Whisper heard in a recording
+type Transcript struct {
+	Text string `json:"text"`
+	// Language is the spoken language, as Whisper names it (e.g. "english")
+	Language string  `json:"language,omitempty"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// Transcriber turns voice queries into prompts with Whisper: OpenAI's API,
+// or a local server that speaks it (e.g. faster-whisper-server or the
+// whisper.cpp server) when url is set
+type Transcriber struct {
+	url      string
+	model    string
+	maxBytes int64
+}
+
+func NewTranscriber(url, model string, maxBytes int64) *Transcriber {
+	return &Transcriber{url: url, model: model, maxBytes: maxBytes}
+}
+
+// local tells whether recordings stay with the configured server instead of
+// going to OpenAI
+func (t *Transcriber) local() bool {
+	return t.url != ""
+}
+
+// UseTranscriber enables voice queries on /v1/search/audio
+func (h *SearchHandler) UseTranscriber(transcriber *Transcriber) {
+	h.transcriber = transcriber
+}
+
+// transcribe sends the recording to Whisper. OpenAI transcriptions are
+// charged to the budget by the second, and refused once it is used up:
+// unlike an analysis, there is nothing to fall back to.
+func (h *SearchHandler) transcribe(ctx context.Context, audio []byte, filename, language string) (*Transcript, error) {
+	ctx, span := tracer.Start(ctx, "search.transcribe", SpanKindInternal)
+	defer span.End()
+	t := h.transcriber
+	span.SetAttr("audio.bytes", len(audio))
+	span.SetAttr("audio.local", t.local())
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("error building transcription request: %v", err)
+	}
+	file.Write(audio)
+	form.WriteField("model", t.model)
+	// verbose_json has the duration, which the spend is computed from
+	form.WriteField("response_format", "verbose_json")
+	if language != "" {
+		form.WriteField("language", language)
+	}
+	if err := form.Close(); err != nil {
+		return nil, fmt.Errorf("error building transcription request: %v", err)
+	}
+
+	tenant := tenantFromContext(ctx)
+	if !t.local() {
+		if err := h.budget.Check(ctx, tenant); err != nil {
+			return nil, err
+		}
+	}
+	release, err := h.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var resp *http.Response
+	if t.local() {
+		resp, err = h.postLocalTranscription(ctx, form.FormDataContentType(), body.Bytes())
+	} else {
+		resp, err = h.doWithKeys(ctx, "transcription", OPENAI_TRANSCRIPTIONS_URL, form.FormDataContentType(), body.Bytes())
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var answer struct {
+		Transcript
+		Duration float64 `json:"duration"`
+		Error    *struct {
+			Message string `json:"message"`
+		} `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil {
+		return nil, fmt.Errorf("error parsing transcription response (status %d): %v", resp.StatusCode, err)
+	}
+	if answer.Error != nil {
+		return nil, fmt.Errorf("transcription error: %s", answer.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("transcription failed with status %d", resp.StatusCode)
+	}
+	transcript := &answer.Transcript
+	transcript.Text = strings.TrimSpace(transcript.Text)
+	transcript.Duration = answer.Duration
+	transcribedSeconds.Add(transcript.Duration)
+	span.SetAttr("audio.duration_seconds", transcript.Duration)
+
+	if !t.local() {
+		price, ok := audioPricing[t.model]
+		if !ok {
+			price = fallbackAudioPrice
+		}
+		cost := transcript.Duration / 60 * price
+		h.budget.Record(ctx, tenant, cost)
+		openAICost.Add(cost, t.model)
+		span.SetAttr("search.cost_usd", cost)
+		h.telemetry.Emit(ctx, "openai.usage", map[string]interface{}{
+			"model":         t.model,
+			"audio_seconds": transcript.Duration,
+			"cost_usd":      cost,
+		})
+	}
+	return transcript, nil
+}
+
+// postLocalTranscription sends the request to the local Whisper server
+func (h *SearchHandler) postLocalTranscription(ctx context.Context, contentType string, body []byte) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "whisper.transcription", SpanKindClient)
+	defer span.End()
+	req, err := http.NewRequestWithContext(ctx, "POST", h.transcriber.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating transcription request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("traceparent", span.Traceparent())
+	resp, err := h.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		// %w keeps a context deadline recognizable to writeAnalyzeError
+		return nil, fmt.Errorf("error calling Whisper: %w", err)
+	}
+	span.SetAttr("http.response.status_code", resp.StatusCode)
+	return resp, nil
+}
+
+// handleSearchAudio serves POST /v1/search/audio: a voice query, uploaded as
+// multipart form data with the recording in "audio" and the options of
+// /search as fields, is transcribed and analyzed like a typed prompt. The
+// answer is that of /search with the transcript.
+func (h *SearchHandler) handleSearchAudio(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.transcriber == nil || !h.flags.Enabled(r.Context(), FlagVoiceSearch, true) {
+		http.Error(w, "Voice search is disabled", http.StatusNotFound)
+		return
+	}
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qrImage, err := requestedQRImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := h.readSearchUpload(w, r, "audio", h.transcriber.maxBytes)
+	if !ok {
+		return
+	}
+	if !audioFormats[upload.format] {
+		http.Error(w, "Unsupported audio format, name the file after its format (flac, m4a, mp3, mp4, mpeg, mpga, oga, ogg, wav or webm)",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	opts := upload.opts
+	// Naming the language spares Whisper detecting it, which is the less
+	// reliable the shorter the recording
+	language := upload.fields.Get("language")
+	if language == "" && opts.Locale != "" {
+		language, _, _ = strings.Cut(opts.Locale, "-")
+	}
+	language = strings.ToLower(language)
+	if language != "" && !languageRe.MatchString(language) {
+		http.Error(w, "language must be an ISO 639-1 code, e.g. en", http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	transcript, err := h.transcribe(r.Context(), upload.data, "query."+upload.format, language)
+	if err != nil {
+		transcriptions.Inc("error")
+		var budgetErr *BudgetExceededError
+		if errors.As(err, &budgetErr) || errors.Is(err, ErrNoHealthyKeys) || errors.Is(err, ErrUpstreamBusy) ||
+			errors.Is(err, context.DeadlineExceeded) {
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error transcribing audio", "error", err)
+		http.Error(w, "Error transcribing audio", http.StatusBadGateway)
+		return
+	}
+	slog.DebugContext(r.Context(), "Transcribed voice query", "prompt", loggedPrompt(r.Context(), transcript.Text),
+		"duration_seconds", transcript.Duration, "elapsed", time.Since(start))
+	if transcript.Text == "" {
+		transcriptions.Inc("empty")
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "no_speech",
+			"message":  "No speech was recognized in the recording",
+			"trace_id": spanFromContext(r.Context()).TraceID(),
+		})
+		return
+	}
+	transcriptions.Inc("ok")
+
+	result, err := h.analyze(r.Context(), transcript.Text, opts)
+	var piiErr *PIIConfirmationError
+	if errors.As(err, &piiErr) {
+		// Confirming goes through /search with the transcript, rather than
+		// paying for the transcription again
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":      "pii_confirmation_required",
+			"message":    piiErr.Error(),
+			"kinds":      piiErr.Kinds,
+			"transcript": transcript,
+			"trace_id":   spanFromContext(r.Context()).TraceID(),
+		})
+		return
+	}
+	if err != nil {
+		writeAnalyzeError(w, r, err)
+		return
+	}
+
+	w.Header().Set(intentVersionHeader, strconv.Itoa(version))
+	response := h.searchResponse(r, transcript.Text, result, version, qrImage, upload.includeResults, opts.Locale)
+	response["transcript"] = transcript
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// translatePrompt asks the model to translate the terms of an intent
+const translatePrompt = `You translate web search terms for a search engine. ` +
+	`Translate main_query, exact_phrases and exclude_words into the target language the way a native speaker would search, ` +
+	`keeping names, brands, code and units as they are, and leaving terms already in the target language unchanged. ` +
+	`Reply with JSON only: {"language": "<ISO 639-1 code of the original terms>", "main_query": "...", "exact_phrases": [...], "exclude_words": [...]}.`
+
+var queryTranslations = metricsRegistry.Counter("query_translations_total",
+	"Searches asking for translated queries, by result (translated, unchanged, skipped, failed).", "result")
+
+// SearchTerms are the words of an intent that a translation changes
+type SearchTerms struct {
+	MainQuery    string   `json:"main_query"`
+	ExactPhrases []string `json:"exact_phrases"`
+	ExcludeWords []string `json:"exclude_words"`
+}
+
+// QueryTranslation tells how the terms of a search were translated
+type QueryTranslation struct {
+	// Language is the language of the original terms, as the model told it
+	Language   string      `json:"language,omitempty"`
+	Target     string      `json:"target"`
+	Original   SearchTerms `json:"original"`
+	Translated SearchTerms `json:"translated"`
+}
+
+func searchTerms(intent *SearchIntent) SearchTerms {
+	return SearchTerms{MainQuery: intent.MainQuery, ExactPhrases: nonNil(intent.ExactPhrases), ExcludeWords: nonNil(intent.ExcludeWords)}
+}
+
+// translationTarget is the language a search is translated into: the one
+// the client asked results in, or the engine's
+func translationTarget(resultLanguage string) string {
+	if resultLanguage != "" {
+		return strings.ToLower(resultLanguage)
+	}
+	return defaultEngine.Load().Language
+}
+
+// translateIntent replaces the terms of the analysis' intent with their
+// translation into target, so the search URL is built from them, and
+// returns the translation, or nil when the terms were left as they are:
+// the client's locale is in the target language already, the analysis kept
+// personal data from OpenAI, or the translation failed.
+func (h *SearchHandler) translateIntent(r *http.Request, analysis *AnalysisResult, target, locale string) *QueryTranslation {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	targetLanguage, _, _ := strings.Cut(target, "-")
+	if language == targetLanguage || len(analysis.Redacted) > 0 || strings.TrimSpace(analysis.Intent.MainQuery) == "" {
+		queryTranslations.Inc("skipped")
+		return nil
+	}
+	ctx, span := tracer.Start(r.Context(), "search.translate", SpanKindInternal)
+	defer span.End()
+	span.SetAttr("search.translation_target", target)
+	original := searchTerms(analysis.Intent)
+	source, translated, err := h.translateTerms(ctx, original, target)
+	if err != nil {
+		span.RecordError(err)
+		slog.WarnContext(ctx, "Error translating query, searching the original terms", "error", err)
+		queryTranslations.Inc("failed")
+		return nil
+	}
+	intent := *analysis.Intent
+	intent.MainQuery, intent.ExactPhrases, intent.ExcludeWords = translated.MainQuery, translated.ExactPhrases, translated.ExcludeWords
+	analysis.Intent = cleanIntent(&intent)
+	translation := &QueryTranslation{Language: source, Target: target, Original: original, Translated: searchTerms(analysis.Intent)}
+	if translation.Translated.MainQuery == original.MainQuery &&
+		strings.Join(translation.Translated.ExactPhrases, "\x00") == strings.Join(original.ExactPhrases, "\x00") &&
+		strings.Join(translation.Translated.ExcludeWords, "\x00") == strings.Join(original.ExcludeWords, "\x00") {
+		queryTranslations.Inc("unchanged")
+	} else {
+		queryTranslations.Inc("translated")
+	}
+	return translation
+}
+
+// translateTerms asks the cheap model to translate the terms into target,
+// returning the language they were in. It is refused over budget like
+// analyses; an answer missing terms is an error rather than a search for
+// less.
+func (h *SearchHandler) translateTerms(ctx context.Context, terms SearchTerms, target string) (string, SearchTerms, error) {
+	if err := h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+		return "", SearchTerms{}, err
+	}
+	input, err := json.Marshal(terms)
+	if err != nil {
+		return "", SearchTerms{}, err
+	}
+	reqBody := OpenAIRequest{
+		Model: h.router.cheapModel,
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: translatePrompt},
+			{Role: "user", Content: fmt.Sprintf("Target language: %s\n%s", target, input)},
+		},
+		MaxTokens: 300,
+	}
+
+	release, err := h.limiter.Acquire(ctx)
+	if err != nil {
+		return "", SearchTerms{}, err
+	}
+	defer release()
+
+	resp, err := h.chatCompletion(ctx, reqBody)
+	if err != nil {
+		return "", SearchTerms{}, err
+	}
+	var answer struct {
+		Language string `json:"language"`
+		SearchTerms
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(resp.Choices[0].Message.Content)), &answer); err != nil {
+		return "", SearchTerms{}, fmt.Errorf("error parsing translation: %v", err)
+	}
+	if strings.TrimSpace(answer.MainQuery) == "" || len(answer.ExactPhrases) != len(terms.ExactPhrases) || len(answer.ExcludeWords) != len(terms.ExcludeWords) {
+		return "", SearchTerms{}, fmt.Errorf("translation doesn't match the terms")
+	}
+	return strings.ToLower(strings.TrimSpace(answer.Language)), answer.SearchTerms, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+const continuationPrompt = "Your JSON answer was cut off. Continue it exactly where it stopped, without repeating anything. Output only the rest of the JSON."
+
+var truncatedResponses = metricsRegistry.Counter("openai_truncated_responses_total",
+	"Cut off intent answers, by how they were recovered (repaired, continued, failed).", "outcome")
+
+// repairTruncatedJSON closes a JSON document that was cut off: an open string
+// is terminated and open arrays and objects are closed. When the cut fell in
+// the middle of a key or a value, the incomplete member is dropped.
+func repairTruncatedJSON(s string) (string, bool) {
+	type cut struct {
+		at    int
+		stack string
+	}
+	var (
+		stack    []byte // expected closers
+		cuts     []cut  // places after a complete member where the document may end
+		inString bool
+		escaped  bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+			cuts = append(cuts, cut{i + 1, string(stack)})
+		case '[':
+			stack = append(stack, ']')
+			cuts = append(cuts, cut{i + 1, string(stack)})
+		case '}', ']':
+			if len(stack) == 0 || stack[len(stack)-1] != c {
+				return "", false
+			}
+			stack = stack[:len(stack)-1]
+			cuts = append(cuts, cut{i + 1, string(stack)})
+		case ',':
+			cuts = append(cuts, cut{i, string(stack)})
+		}
+	}
+	if len(stack) == 0 && !inString {
+		return s, json.Valid([]byte(s))
+	}
+
+	// First try to keep everything, closing the string that was cut off
+	candidate := s
+	if inString {
+		if escaped {
+			candidate = candidate[:len(candidate)-1]
+		}
+		candidate += `"`
+	}
+	if fixed := closeJSON(candidate, string(stack)); json.Valid([]byte(fixed)) {
+		return fixed, true
+	}
+
+	// Otherwise drop the incomplete member, trying later cut points first
+	for i := len(cuts) - 1; i >= 0; i-- {
+		prefix := strings.TrimRight(s[:cuts[i].at], " \t\r\n")
+		if fixed := closeJSON(prefix, cuts[i].stack); json.Valid([]byte(fixed)) {
+			return fixed, true
+		}
+	}
+	return "", false
+}
+
+func closeJSON(prefix, stack string) string {
+	prefix = strings.TrimRight(prefix, " \t\r\n,:")
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := len(stack) - 1; i >= 0; i-- {
+		b.WriteByte(stack[i])
+	}
+	return b.String()
+}
+
+// recoverTruncated rescues an intent answer that was cut off. A structural
+// repair is enough when the main query made it through; otherwise, when
+// max_tokens did cut the answer, the model is asked once to continue it.
+func (h *SearchHandler) recoverTruncated(ctx context.Context, reqBody OpenAIRequest, content string, cutOff bool) (*SearchIntent, error) {
+	span := spanFromContext(ctx)
+	if repaired, ok := repairTruncatedJSON(stripCodeFence(content)); ok {
+		if intent, err := decodeIntentJSON([]byte(repaired)); err == nil && intent.MainQuery != "" {
+			truncatedResponses.Inc("repaired")
+			span.SetAttr("openai.truncation", "repaired")
+			slog.WarnContext(ctx, "Repaired truncated intent", "model", reqBody.Model)
+			return intent, nil
+		}
+	}
+
+	if !cutOff {
+		return nil, fmt.Errorf("answer is not valid JSON")
+	}
+
+	cont := reqBody
+	cont.Messages = append(append([]OpenAIMessage{}, reqBody.Messages...),
+		OpenAIMessage{Role: "assistant", Content: content},
+		OpenAIMessage{Role: "user", Content: continuationPrompt},
+	)
+	resp, err := h.chatCompletion(ctx, cont)
+	if err != nil {
+		truncatedResponses.Inc("failed")
+		return nil, fmt.Errorf("error continuing truncated answer: %w", err)
+	}
+	combined := stripCodeFence(content) + stripCodeFence(strings.TrimSpace(resp.Choices[0].Message.Content))
+	intent, err := decodeIntentJSON([]byte(combined))
+	if err != nil {
+		// The continuation may itself have been cut off
+		if repaired, ok := repairTruncatedJSON(combined); ok {
+			intent, err = decodeIntentJSON([]byte(repaired))
+		}
+	}
+	if err != nil {
+		truncatedResponses.Inc("failed")
+		span.SetAttr("openai.truncation", "failed")
+		return nil, err
+	}
+	truncatedResponses.Inc("continued")
+	span.SetAttr("openai.truncation", "continued")
+	slog.WarnContext(ctx, "Completed truncated intent with a continuation request", "model", reqBody.Model)
+	return intent, nil
+}
+
+// stripCodeFence removes a markdown code fence some models wrap JSON in
+func stripCodeFence(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimPrefix(s, "json")
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxUploadFieldBytes caps each form field sent along with an uploaded file
+const maxUploadFieldBytes = 4 << 10
+
+// errUploadTooLarge rejects files over the configured size
+var errUploadTooLarge = errors.New("file too large")
+
+// searchUpload is a file to search with, such as a recording or an image,
+// with the options of /search sent along as form fields
+type searchUpload struct {
+	data     []byte
+	filename string
+	// format is the lowercased extension of the file name
+	format         string
+	fields         url.Values
+	opts           AnalyzeOptions
+	includeResults bool
+}
+
+// readSearchUpload reads a multipart/form-data upload with the file, at most
+// maxBytes, in the part named field, and the options of /search (locale,
+// model, temperature, confirm_pii, include_results) in the others. On error
+// the request has been answered.
+func (h *SearchHandler) readSearchUpload(w http.ResponseWriter, r *http.Request, field string, maxBytes int64) (*searchUpload, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+	form, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return nil, false
+	}
+	upload, err := readFormUpload(form, field, maxBytes)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errUploadTooLarge) || errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("File too large, the limit is %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	upload.opts = AnalyzeOptions{
+		Model:      upload.fields.Get("model"),
+		Locale:     upload.fields.Get("locale"),
+		ConfirmPII: formBool(upload.fields.Get("confirm_pii")),
+	}
+	if v := upload.fields.Get("temperature"); v != "" {
+		temperature, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "temperature must be a number", http.StatusBadRequest)
+			return nil, false
+		}
+		upload.opts.Temperature = &temperature
+	}
+	upload.includeResults = formBool(upload.fields.Get("include_results"))
+	if err := h.policy.Validate(upload.opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return upload, true
+}
+
+// readFormUpload reads the file from the part named field and keeps the
+// other parts as fields
+func readFormUpload(form *multipart.Reader, field string, maxBytes int64) (*searchUpload, error) {
+	upload := &searchUpload{fields: make(url.Values)}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == field {
+			upload.filename = part.FileName()
+			upload.format = strings.TrimPrefix(strings.ToLower(path.Ext(upload.filename)), ".")
+			if upload.data, err = io.ReadAll(io.LimitReader(part, maxBytes+1)); err != nil {
+				return nil, err
+			}
+			if int64(len(upload.data)) > maxBytes {
+				return nil, errUploadTooLarge
+			}
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+		if err != nil {
+			return nil, err
+		}
+		upload.fields.Add(name, string(value))
+	}
+	if len(upload.data) == 0 {
+		return nil, fmt.Errorf("the file is missing, upload it in the %q field", field)
+	}
+	return upload, nil
+}
+
+// formBool reads a checkbox-like form field: "true", "1" and "on" are set
+func formBool(v string) bool {
+	return v == "true" || v == "1" || v == "on"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	searchURLSanitized = metricsRegistry.Counter("search_url_sanitized_total",
+		"Intent fields cleaned or dropped before building a search URL, by field.", "field")
+	searchURLRejected = metricsRegistry.Counter("search_url_rejected_total",
+		"Search URLs that failed validation and were replaced by the engine's home page.")
+)
+
+var (
+	// hostnameRe is what a site filter must be: an ASCII hostname, no
+	// scheme, port or path
+	hostnameRe  = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+	extensionRe = regexp.MustCompile(`^[a-z0-9]{1,10}$`)
+)
+
+// stripInvisible removes control characters and the zero-width and bidi
+// override characters that can disguise what a query says
+func stripInvisible(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f,
+			r >= 0x200b && r <= 0x200f,
+			r >= 0x202a && r <= 0x202e,
+			r >= 0x2060 && r <= 0x2069,
+			r == 0xfeff:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// sanitizeIntent returns a copy of the intent whose operator values can't
+// change what the search URL does: the site filter is a bare hostname, the
+// file type an extension, and phrases can't close their quotes. Values that
+// can't be cleaned are dropped. It also returns the fields it changed.
+func sanitizeIntent(intent *SearchIntent) (*SearchIntent, []string) {
+	if intent == nil {
+		return nil, nil
+	}
+	var changed []string
+	set := func(field string, dst *string, v string) {
+		if v != *dst {
+			changed = append(changed, field)
+			*dst = v
+		}
+	}
+	out := *intent
+	set("main_query", &out.MainQuery, strings.TrimSpace(stripInvisible(intent.MainQuery)))
+	set("site_filter", &out.SiteFilter, sanitizeSiteFilter(intent.SiteFilter))
+	fileType := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(stripInvisible(intent.FileType)), "."))
+	if !extensionRe.MatchString(fileType) {
+		fileType = ""
+	}
+	set("file_type", &out.FileType, fileType)
+	set("date_range", &out.DateRange, strings.TrimSpace(stripInvisible(intent.DateRange)))
+	set("scope", &out.Scope, normalizeScope(intent.Scope))
+
+	out.ExactPhrases = sanitizeTerms(intent.ExactPhrases, func(s string) string {
+		return strings.ReplaceAll(s, `"`, "")
+	})
+	if len(out.ExactPhrases) != len(intent.ExactPhrases) || strings.Join(out.ExactPhrases, "\x00") != strings.Join(intent.ExactPhrases, "\x00") {
+		changed = append(changed, "exact_phrases")
+	}
+	out.ExcludeWords = sanitizeTerms(intent.ExcludeWords, func(s string) string {
+		return strings.TrimLeft(s, "-")
+	})
+	if len(out.ExcludeWords) != len(intent.ExcludeWords) || strings.Join(out.ExcludeWords, "\x00") != strings.Join(intent.ExcludeWords, "\x00") {
+		changed = append(changed, "exclude_words")
+	}
+	out.ExcludeSites = sanitizeTerms(intent.ExcludeSites, sanitizeSiteFilter)
+	if len(out.ExcludeSites) != len(intent.ExcludeSites) {
+		changed = append(changed, "exclude_sites")
+	}
+	out.Entities = sanitizeEntities(intent.Entities)
+	if !slices.Equal(out.Entities, intent.Entities) {
+		changed = append(changed, "entities")
+	}
+	return &out, changed
+}
+
+// cleanIntent sanitizes the intent and counts the fields it had to change
+func cleanIntent(intent *SearchIntent) *SearchIntent {
+	clean, changed := sanitizeIntent(intent)
+	for _, field := range changed {
+		searchURLSanitized.Inc(field)
+	}
+	return clean
+}
+
+// sanitizeTerms cleans every phrase or word and drops the empty ones; nil
+// stays nil so the JSON of the intent doesn't change
+func sanitizeTerms(terms []string, clean func(string) string) []string {
+	if terms == nil {
+		return nil
+	}
+	out := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t = strings.TrimSpace(clean(stripInvisible(t))); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// sanitizeSiteFilter reduces a URL or host to its hostname, or "" when it
+// isn't one
+func sanitizeSiteFilter(s string) string {
+	s = strings.ToLower(strings.TrimSpace(stripInvisible(s)))
+	if s == "" {
+		return ""
+	}
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		// user@host: only the host is where the link would go
+		s = s[i+1:]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSuffix(s, ".")
+	if !hostnameRe.MatchString(s) {
+		return ""
+	}
+	return s
+}
+
+// validateSearchURL checks that a search URL goes to a known engine's
+// search page with nothing but the query parameter
+func validateSearchURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.User != nil || u.Fragment != "" || u.Opaque != "" {
+		return fmt.Errorf("search URL must be a plain https URL")
+	}
+	for _, engine := range searchEngines {
+		base, err := url.Parse(engine.BaseURL)
+		if err != nil || base.Host != u.Host || base.Path != u.Path {
+			continue
+		}
+		query := u.Query()
+		if len(query) != 1 || len(query[engine.Param]) != 1 {
+			return fmt.Errorf("search URL may only carry the %q parameter", engine.Param)
+		}
+		return nil
+	}
+	return fmt.Errorf("search URL %q is not the search page of a known engine", u.Host+u.Path)
+}
+
+// constructSearchQuery builds the search URL of an intent on the current
+// engine. Intents come from the model, so their values are sanitized and
+// the URL is validated against the engines before anyone is sent there.
+func constructSearchQuery(intent *SearchIntent) string {
+	engine := defaultEngine.Load()
+	searchURL := engine.URL(buildQueryString(cleanIntent(intent)))
+	if err := validateSearchURL(searchURL); err != nil {
+		slog.Error("Invalid search URL, sending the engine's home page instead", "error", err)
+		searchURLRejected.Inc()
+		return engine.BaseURL
+	}
+	return searchURL
+}
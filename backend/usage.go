@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrIntentParse is returned when the model's answer isn't an intent
+var ErrIntentParse = errors.New("error parsing intent JSON")
+
+const (
+	// maxUsageQueries bounds the distinct queries counted per tenant and
+	// hour; later ones still count as searches
+	maxUsageQueries = 500
+	// maxUsageWindow is the longest window a report covers
+	maxUsageWindow = 90 * 24 * time.Hour
+)
+
+// usageLatencyBounds are the upper bounds, in milliseconds, of the latency
+// buckets percentiles are read from
+var usageLatencyBounds = []int64{50, 100, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 5000, 8000, 13000, 20000, 30000}
+
+// usageFields are the intent fields whose use is counted
+var usageFields = []string{"exact_phrases", "site_filter", "file_type", "exclude_words", "date_range", "exclude_sites", "entities"}
+
+// UsageStats aggregates the analyses of each tenant by the hour for the
+// usage analytics API: searches, failures, latencies, the queries searched
+// and the intent fields, engines and models used. Queries are counted by
+// their keyed hash, their text kept as the tenant's privacy policy allows.
+// Hours older than retention are dropped.
+type UsageStats struct {
+	retention  time.Duration
+	anonymizer *QueryAnonymizer
+	now        func() time.Time
+
+	mu    sync.Mutex
+	hours map[usageHourKey]*usageHour
+	// texts holds what each tenant's analytics may show of the queries,
+	// by hash
+	texts     map[string]map[string]*usageQueryText
+	lastPrune time.Time
+}
+
+type usageHourKey struct {
+	tenant string
+	hour   time.Time
+}
+
+// usageHour is what UsageStats keeps of one tenant's hour
+type usageHour struct {
+	searches      int
+	failures      int
+	parseFailures int
+	refused       int
+	cached        int
+	// queries counts the searches by query hash
+	queries   map[string]int
+	fields    map[string]int
+	fileTypes map[string]int
+	engines   map[string]int
+	models    map[string]int
+	// latency counts the analyses per usageLatencyBounds bucket, the last
+	// one for slower ones
+	latency []int
+}
+
+func newUsageHour() *usageHour {
+	return &usageHour{
+		queries:   make(map[string]int),
+		fields:    make(map[string]int),
+		fileTypes: make(map[string]int),
+		engines:   make(map[string]int),
+		models:    make(map[string]int),
+		latency:   make([]int, len(usageLatencyBounds)+1),
+	}
+}
+
+func NewUsageStats(retention time.Duration, anonymizer *QueryAnonymizer) *UsageStats {
+	return &UsageStats{
+		retention:  retention,
+		anonymizer: anonymizer,
+		now:        time.Now,
+		hours:      make(map[usageHourKey]*usageHour),
+		texts:      make(map[string]map[string]*usageQueryText),
+	}
+}
+
+// UseUsageStats turns on aggregating analyses for the usage analytics API
+func (h *SearchHandler) UseUsageStats(usage *UsageStats) {
+	h.usage = usage
+}
+
+// usageQuery normalizes the main query of an intent for counting
+func usageQuery(intent *SearchIntent) string {
+	return strings.ToLower(strings.Join(strings.Fields(intent.MainQuery), " "))
+}
+
+// Observe counts an analysis of the request's tenant, with its error and
+// how long it took. Queries whose personal data was kept from OpenAI are
+// counted as searches but not by their words; refusals (prompt guard,
+// personal data, budget) are counted apart from failures, and a caller
+// giving up isn't counted at all.
+func (u *UsageStats) Observe(ctx context.Context, result *AnalysisResult, err error, elapsed time.Duration) {
+	if u == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	tenantID := DefaultTenantID
+	if t := tenantFromContext(ctx); t != nil {
+		tenantID = t.ID
+	}
+	now := u.now().UTC()
+	key := usageHourKey{tenant: tenantID, hour: now.Truncate(time.Hour)}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Sub(u.lastPrune) >= time.Hour {
+		u.pruneLocked(now)
+	}
+	h, ok := u.hours[key]
+	if !ok {
+		h = newUsageHour()
+		u.hours[key] = h
+	}
+	h.searches++
+	var budgetErr *BudgetExceededError
+	var piiErr *PIIConfirmationError
+	var rejected *PromptRejectedError
+	switch {
+	case errors.As(err, &budgetErr), errors.As(err, &piiErr), errors.As(err, &rejected):
+		h.refused++
+		return
+	case errors.Is(err, ErrIntentParse):
+		h.parseFailures++
+		h.failures++
+		return
+	case err != nil:
+		h.failures++
+		return
+	}
+
+	ms := elapsed.Milliseconds()
+	i := sort.Search(len(usageLatencyBounds), func(i int) bool { return ms <= usageLatencyBounds[i] })
+	h.latency[i]++
+	if result.Cached {
+		h.cached++
+	}
+	intent := result.Intent
+	if q := usageQuery(intent); q != "" && len(result.Redacted) == 0 {
+		hash := u.anonymizeLocked(ctx, tenantID, q, now)
+		if _, seen := h.queries[hash]; seen || len(h.queries) < maxUsageQueries {
+			h.queries[hash]++
+		}
+	}
+	used := map[string]bool{
+		"exact_phrases": len(intent.ExactPhrases) > 0,
+		"site_filter":   intent.SiteFilter != "",
+		"file_type":     intent.FileType != "",
+		"exclude_words": len(intent.ExcludeWords) > 0,
+		"date_range":    intent.DateRange != "",
+		"exclude_sites": len(intent.ExcludeSites) > 0,
+		"entities":      len(intent.Entities) > 0,
+	}
+	for field, ok := range used {
+		if ok {
+			h.fields[field]++
+		}
+	}
+	if intent.FileType != "" {
+		h.fileTypes[strings.ToLower(intent.FileType)]++
+	}
+	h.engines[defaultEngine.Load().Name]++
+	model := result.Analyzer
+	if result.Model != "" {
+		model = result.Model
+	}
+	h.models[model]++
+}
+
+func (u *UsageStats) pruneLocked(now time.Time) {
+	u.lastPrune = now
+	cutoff := now.Add(-u.retention)
+	for key := range u.hours {
+		if key.hour.Before(cutoff) {
+			delete(u.hours, key)
+		}
+	}
+	u.pruneTextsLocked(cutoff)
+}
+
+// UsageQuery is a query and how many searches were for it. Query is only
+// set when the tenant's privacy policy lets its text be shown.
+type UsageQuery struct {
+	Query string `json:"query,omitempty"`
+	Hash  string `json:"query_hash"`
+	Count int    `json:"count"`
+}
+
+// UsageField tells how many successful analyses used an intent field
+type UsageField struct {
+	Count int     `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+// UsageLatency are latency percentiles in milliseconds, read from buckets:
+// each is the upper bound of the bucket the percentile falls in
+type UsageLatency struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+}
+
+// UsageTotals sum the analyses of a period. Refusals are left out of the
+// failure rates.
+type UsageTotals struct {
+	Searches         int          `json:"searches"`
+	Failures         int          `json:"failures"`
+	ParseFailures    int          `json:"parse_failures"`
+	Refused          int          `json:"refused"`
+	FailureRate      float64      `json:"failure_rate"`
+	ParseFailureRate float64      `json:"parse_failure_rate"`
+	LatencyMS        UsageLatency `json:"latency_ms"`
+}
+
+// UsagePeriod is one interval of a usage report's time series
+type UsagePeriod struct {
+	Start time.Time `json:"start"`
+	UsageTotals
+}
+
+// UsageReport sums the usage of a tenant, or of every tenant, over a window
+type UsageReport struct {
+	TenantID string    `json:"tenant_id,omitempty"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Interval string    `json:"interval"`
+	UsageTotals
+	Cached     int                   `json:"cached"`
+	TopQueries []UsageQuery          `json:"top_queries"`
+	Fields     map[string]UsageField `json:"fields"`
+	FileTypes  map[string]int        `json:"file_types"`
+	Engines    map[string]int        `json:"engines"`
+	Models     map[string]int        `json:"models"`
+	Series     []UsagePeriod         `json:"series"`
+}
+
+// usageSum adds hours up into one period
+type usageSum struct {
+	totals  UsageTotals
+	latency []int
+}
+
+func (s *usageSum) add(h *usageHour) {
+	if s.latency == nil {
+		s.latency = make([]int, len(usageLatencyBounds)+1)
+	}
+	s.totals.Searches += h.searches
+	s.totals.Failures += h.failures
+	s.totals.ParseFailures += h.parseFailures
+	s.totals.Refused += h.refused
+	for i, n := range h.latency {
+		s.latency[i] += n
+	}
+}
+
+func (s *usageSum) finish() UsageTotals {
+	p := s.totals
+	if attempted := p.Searches - p.Refused; attempted > 0 {
+		p.FailureRate = float64(p.Failures) / float64(attempted)
+		p.ParseFailureRate = float64(p.ParseFailures) / float64(attempted)
+	}
+	p.LatencyMS = UsageLatency{
+		P50: latencyPercentile(s.latency, 0.5),
+		P90: latencyPercentile(s.latency, 0.9),
+		P99: latencyPercentile(s.latency, 0.99),
+	}
+	return p
+}
+
+// latencyPercentile reads the q percentile from bucket counts, 0 without
+// any; the slowest bucket reports the last bound
+func latencyPercentile(counts []int, q float64) int64 {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int(q*float64(total)+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	seen := 0
+	for i, n := range counts {
+		seen += n
+		if seen > rank {
+			if i >= len(usageLatencyBounds) {
+				break
+			}
+			return usageLatencyBounds[i]
+		}
+	}
+	return usageLatencyBounds[len(usageLatencyBounds)-1]
+}
+
+// Report sums the usage of tenantID, or every tenant when empty, over the
+// window ending now, in intervals of an hour or a day for the time series,
+// with the limit most searched queries
+func (u *UsageStats) Report(tenantID string, window, interval time.Duration, limit int) *UsageReport {
+	now := u.now().UTC()
+	from := now.Add(-window).Truncate(time.Hour)
+	report := &UsageReport{
+		TenantID:  tenantID,
+		From:      from,
+		To:        now,
+		Interval:  "hour",
+		Fields:    make(map[string]UsageField),
+		FileTypes: make(map[string]int),
+		Engines:   make(map[string]int),
+		Models:    make(map[string]int),
+	}
+	if interval == 24*time.Hour {
+		report.Interval = "day"
+	}
+	periods := make([]usageSum, int((now.Sub(from)+interval-1)/interval))
+	var total usageSum
+	// Queries are summed by text where it may be shown, by hash otherwise,
+	// so a tenant's hidden query isn't merged with another's shown one
+	queries := make(map[string]*UsageQuery)
+	fields := make(map[string]int)
+
+	u.mu.Lock()
+	for key, h := range u.hours {
+		if (tenantID != "" && key.tenant != tenantID) || key.hour.Before(from) {
+			continue
+		}
+		i := int(key.hour.Sub(from) / interval)
+		if i >= len(periods) {
+			continue
+		}
+		periods[i].add(h)
+		total.add(h)
+		report.Cached += h.cached
+		for hash, n := range h.queries {
+			q := UsageQuery{Hash: hash}
+			if entry := u.texts[key.tenant][hash]; entry != nil {
+				q.Query = entry.text
+			}
+			id := "#" + hash
+			if q.Query != "" {
+				id = q.Query
+			}
+			if queries[id] == nil {
+				queries[id] = &q
+			}
+			queries[id].Count += n
+		}
+		for f, n := range h.fields {
+			fields[f] += n
+		}
+		for t, n := range h.fileTypes {
+			report.FileTypes[t] += n
+		}
+		for e, n := range h.engines {
+			report.Engines[e] += n
+		}
+		for m, n := range h.models {
+			report.Models[m] += n
+		}
+	}
+	u.mu.Unlock()
+
+	report.UsageTotals = total.finish()
+	report.Series = make([]UsagePeriod, len(periods))
+	for i := range periods {
+		report.Series[i] = UsagePeriod{Start: from.Add(time.Duration(i) * interval), UsageTotals: periods[i].finish()}
+	}
+	succeeded := report.Searches - report.Failures - report.Refused
+	for _, f := range usageFields {
+		field := UsageField{Count: fields[f]}
+		if succeeded > 0 {
+			field.Rate = float64(field.Count) / float64(succeeded)
+		}
+		report.Fields[f] = field
+	}
+	report.TopQueries = make([]UsageQuery, 0, len(queries))
+	for _, q := range queries {
+		report.TopQueries = append(report.TopQueries, *q)
+	}
+	sort.Slice(report.TopQueries, func(i, j int) bool {
+		a, b := report.TopQueries[i], report.TopQueries[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Query+a.Hash < b.Query+b.Hash
+	})
+	if len(report.TopQueries) > limit {
+		report.TopQueries = report.TopQueries[:limit]
+	}
+	return report
+}
+
+// usageParams reads window (default 24h), interval (an hour up to two days,
+// a day beyond) and limit (default 10) of a report request
+func usageParams(r *http.Request) (window, interval time.Duration, limit int, err error) {
+	params := r.URL.Query()
+	window = 24 * time.Hour
+	if v := params.Get("window"); v != "" {
+		if window, err = time.ParseDuration(v); err != nil || window < time.Hour || window > maxUsageWindow {
+			return 0, 0, 0, errors.New("window must be a duration between 1h and 2160h")
+		}
+	}
+	interval = time.Hour
+	if window > 48*time.Hour {
+		interval = 24 * time.Hour
+	}
+	if v := params.Get("interval"); v != "" {
+		switch v {
+		case "hour":
+			interval = time.Hour
+		case "day":
+			interval = 24 * time.Hour
+		default:
+			return 0, 0, 0, errors.New("interval must be hour or day")
+		}
+	}
+	limit = 10
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 100 {
+			return 0, 0, 0, errors.New("limit must be between 1 and 100")
+		}
+	}
+	return window, interval, limit, nil
+}
+
+// handleTenant reports the usage of the calling tenant
+func (u *UsageStats) handleTenant(w http.ResponseWriter, r *http.Request) {
+	// Anyone can be the default tenant, whose report has its top queries
+	tenantID, ok := requireTenant(w, r)
+	if !ok {
+		return
+	}
+	u.serveReport(w, r, tenantID)
+}
+
+// handleAdmin reports the usage of every tenant, or of ?tenant_id=
+func (u *UsageStats) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	u.serveReport(w, r, r.URL.Query().Get("tenant_id"))
+}
+
+func (u *UsageStats) serveReport(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window, interval, limit, err := usageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, u.Report(tenantID, window, interval, limit))
+}
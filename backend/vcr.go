@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record/replay modes of the LLM transport
+const (
+	VCRRecord = "record"
+	VCRReplay = "replay"
+)
+
+var vcrRequests = metricsRegistry.Counter("llm_vcr_requests_total",
+	"LLM calls seen by the record/replay transport, by mode and result (recorded, replayed, missing, passed).", "mode", "result")
+
+// vcrFixture is one recorded LLM call. Only the request fields that decide
+// the answer are kept; the API key never reaches the file.
+type vcrFixture struct {
+	Request struct {
+		Method string          `json:"method"`
+		URL    string          `json:"url"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status      int    `json:"status"`
+		ContentType string `json:"content_type,omitempty"`
+		Body        string `json:"body"`
+	} `json:"response"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// VCRTransport records the calls to the LLM hosts into fixture files
+// (record) or answers them from those files without touching the network
+// (replay), so tests and local development run without an API key. Calls
+// to other hosts go through unchanged. Fixtures are named after a hash of
+// the method, URL and JSON body, so a changed prompt, model or parameter is
+// a new fixture.
+type VCRTransport struct {
+	mode  string
+	dir   string
+	hosts map[string]bool
+	next  http.RoundTripper
+
+	// mu serializes writes of the same fixture by hedged requests
+	mu sync.Mutex
+}
+
+// NewVCRTransport records or replays the calls to the hosts of llmURLs in dir
+func NewVCRTransport(mode, dir string, next http.RoundTripper, llmURLs ...string) *VCRTransport {
+	hosts := make(map[string]bool, len(llmURLs))
+	for _, u := range llmURLs {
+		if parsed, err := url.Parse(u); err == nil {
+			hosts[parsed.Host] = true
+		}
+	}
+	return &VCRTransport{mode: mode, dir: dir, hosts: hosts, next: next}
+}
+
+func (t *VCRTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[req.URL.Host] {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key, canonical := vcrKey(req.Method, req.URL.String(), body)
+	path := filepath.Join(t.dir, key+".json")
+
+	if t.mode == VCRReplay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			vcrRequests.Inc(t.mode, "missing")
+			slog.WarnContext(req.Context(), "No recorded LLM fixture", "url", req.URL.String(), "fixture", path)
+			// An answer rather than an error, so a missing fixture fails the
+			// call without counting against the upstream's health
+			return localResponse(req, http.StatusNotFound, "application/json",
+				fmt.Sprintf(`{"error":{"message":"no recorded fixture %s for this request, record it with LLM_VCR_MODE=record"}}`, key+".json")), nil
+		}
+		var fixture vcrFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("error parsing fixture %s: %v", path, err)
+		}
+		vcrRequests.Inc(t.mode, "replayed")
+		return localResponse(req, fixture.Response.Status, fixture.Response.ContentType, fixture.Response.Body), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// Rate limits and server errors are transient, freezing them into a
+	// fixture would make every replay fail
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		vcrRequests.Inc(t.mode, "passed")
+		return resp, nil
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	var fixture vcrFixture
+	fixture.Request.Method, fixture.Request.URL, fixture.Request.Body = req.Method, req.URL.String(), canonical
+	fixture.Response.Status = resp.StatusCode
+	fixture.Response.ContentType = resp.Header.Get("Content-Type")
+	fixture.Response.Body = string(respBody)
+	fixture.RecordedAt = time.Now().UTC()
+	if err := t.save(path, &fixture); err != nil {
+		slog.ErrorContext(req.Context(), "Error recording LLM fixture", "fixture", path, "error", err)
+	} else {
+		vcrRequests.Inc(t.mode, "recorded")
+	}
+	return resp, nil
+}
+
+func (t *VCRTransport) save(path string, fixture *vcrFixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// vcrKey names the fixture of a request. JSON bodies are compacted first so
+// formatting doesn't matter; the compacted body is returned to be stored.
+func vcrKey(method, rawURL string, body []byte) (string, json.RawMessage) {
+	var canonical json.RawMessage
+	if len(body) > 0 {
+		var buf bytes.Buffer
+		if json.Compact(&buf, body) == nil {
+			canonical = buf.Bytes()
+		} else {
+			canonical, _ = json.Marshal(string(body))
+		}
+	}
+	sum := sha256.Sum256([]byte(method + " " + rawURL + "\n" + string(canonical)))
+	return hex.EncodeToString(sum[:12]), canonical
+}
+
+// localResponse is an answer made without calling the upstream
+func localResponse(req *http.Request, status int, contentType, body string) *http.Response {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Vector store backends. The SQL store lives in the history database, so
+// which of sqlite-vec and pgvector it uses follows HISTORY_STORE.
+const (
+	VectorStoreMemory = "memory"
+	VectorStoreSQL    = "sql"
+	VectorStoreQdrant = "qdrant"
+)
+
+// VectorStore keeps documents and the embeddings of their chunks. Every
+// method is scoped to an owner; documents never cross owners.
+type VectorStore interface {
+	// Put stores the document with its chunks, replacing any with the same ID
+	Put(ctx context.Context, doc *Document, chunks []*DocumentChunk) error
+	// Search returns up to limit of the owner's chunks nearest to vector,
+	// best first
+	Search(ctx context.Context, tenantID, userID string, vector []float64, limit int) ([]*ChunkMatch, error)
+	// Passages returns the text of all the owner's chunks, for the keyword
+	// index
+	Passages(ctx context.Context, tenantID, userID string) ([]*ChunkMatch, error)
+	// List returns the owner's documents, newest first
+	List(ctx context.Context, tenantID, userID string) ([]*Document, error)
+	// Get returns one of the owner's documents, nil when there is none
+	Get(ctx context.Context, tenantID, userID, id string) (*Document, error)
+	// DeleteOwned deletes a document and its chunks if it belongs to the owner
+	DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error)
+	// DeleteAllOwned deletes the owner's documents, for user erasure
+	DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error)
+}
+
+// memoryVectorStore keeps documents in process memory and searches them
+// exhaustively, which is fine up to some ten thousand chunks per owner
+type memoryVectorStore struct {
+	mu     sync.RWMutex
+	docs   map[string]*Document
+	chunks map[string][]*DocumentChunk
+}
+
+func NewMemoryVectorStore() *memoryVectorStore {
+	return &memoryVectorStore{docs: make(map[string]*Document), chunks: make(map[string][]*DocumentChunk)}
+}
+
+func (s *memoryVectorStore) Put(ctx context.Context, doc *Document, chunks []*DocumentChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *doc
+	s.docs[doc.ID] = &copied
+	s.chunks[doc.ID] = chunks
+	return nil
+}
+
+func (s *memoryVectorStore) Search(ctx context.Context, tenantID, userID string, vector []float64, limit int) ([]*ChunkMatch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []*ChunkMatch
+	for id, doc := range s.docs {
+		if doc.TenantID != tenantID || doc.UserID != userID {
+			continue
+		}
+		for _, chunk := range s.chunks[id] {
+			matches = append(matches, &ChunkMatch{
+				DocumentID:   id,
+				DocumentName: doc.Name,
+				Chunk:        chunk.Index,
+				Text:         chunk.Text,
+				Score:        cosineSimilarity(vector, chunk.Vector),
+			})
+		}
+	}
+	return nearestMatches(matches, limit), nil
+}
+
+func (s *memoryVectorStore) Passages(ctx context.Context, tenantID, userID string) ([]*ChunkMatch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var passages []*ChunkMatch
+	for id, doc := range s.docs {
+		if doc.TenantID != tenantID || doc.UserID != userID {
+			continue
+		}
+		for _, chunk := range s.chunks[id] {
+			passages = append(passages, &ChunkMatch{DocumentID: id, DocumentName: doc.Name, Chunk: chunk.Index, Text: chunk.Text})
+		}
+	}
+	return passages, nil
+}
+
+func (s *memoryVectorStore) List(ctx context.Context, tenantID, userID string) ([]*Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Document
+	for _, doc := range s.docs {
+		if doc.TenantID == tenantID && doc.UserID == userID {
+			copied := *doc
+			out = append(out, &copied)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (s *memoryVectorStore) Get(ctx context.Context, tenantID, userID, id string) (*Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, ok := s.docs[id]
+	if !ok || doc.TenantID != tenantID || doc.UserID != userID {
+		return nil, nil
+	}
+	copied := *doc
+	return &copied, nil
+}
+
+func (s *memoryVectorStore) DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.docs[id]
+	if !ok || doc.TenantID != tenantID || doc.UserID != userID {
+		return false, nil
+	}
+	delete(s.docs, id)
+	delete(s.chunks, id)
+	return true, nil
+}
+
+func (s *memoryVectorStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, doc := range s.docs {
+		if doc.TenantID == tenantID && doc.UserID == userID {
+			delete(s.docs, id)
+			delete(s.chunks, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// sortMatches orders matches best first, ties by document and position
+func sortMatches(matches []*ChunkMatch) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		if matches[i].DocumentID != matches[j].DocumentID {
+			return matches[i].DocumentID < matches[j].DocumentID
+		}
+		return matches[i].Chunk < matches[j].Chunk
+	})
+}
+
+// nearestMatches returns the best limit of matches, best first
+func nearestMatches(matches []*ChunkMatch, limit int) []*ChunkMatch {
+	sortMatches(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
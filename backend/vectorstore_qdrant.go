@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// qdrantBatch is how many points go in one upsert
+const qdrantBatch = 256
+
+// qdrantVectorStore keeps documents in a Qdrant collection, one point per
+// chunk with the owner in its payload. The first chunk also carries the
+// document, which is how documents are listed.
+type qdrantVectorStore struct {
+	client     HTTPDoer
+	baseURL    string
+	apiKey     string
+	collection string
+
+	// The collection is created on the first upload, once the size of the
+	// vectors is known
+	mu    sync.Mutex
+	ready bool
+}
+
+func NewQdrantVectorStore(client HTTPDoer, baseURL, apiKey, collection string) *qdrantVectorStore {
+	return &qdrantVectorStore{client: client, baseURL: strings.TrimRight(baseURL, "/"), apiKey: apiKey, collection: collection}
+}
+
+// qdrantPoint is a point as Qdrant returns it
+type qdrantPoint struct {
+	Score   float64 `json:"score"`
+	Payload struct {
+		DocumentID string    `json:"document_id"`
+		Name       string    `json:"name"`
+		Chunk      int       `json:"chunk"`
+		Text       string    `json:"text"`
+		Document   *Document `json:"document,omitempty"`
+	} `json:"payload"`
+}
+
+// call sends a request to Qdrant and decodes the result of its answer into
+// out. A missing collection is reported as found false, not an error.
+func (s *qdrantVectorStore) call(ctx context.Context, method, path string, body, out interface{}) (found bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return false, fmt.Errorf("error encoding Qdrant request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, reader)
+	if err != nil {
+		return false, fmt.Errorf("error creating Qdrant request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("api-key", s.apiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error calling Qdrant: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return false, fmt.Errorf("error reading Qdrant response: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+		Status interface{}     `json:"status"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil {
+		return false, fmt.Errorf("error parsing Qdrant response (status %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Qdrant answered %s: %v", resp.Status, answer.Status)
+	}
+	if out != nil && len(answer.Result) > 0 {
+		if err := json.Unmarshal(answer.Result, out); err != nil {
+			return false, fmt.Errorf("error parsing Qdrant result: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// Ping checks Qdrant for the readiness probe
+func (s *qdrantVectorStore) Ping(ctx context.Context) error {
+	_, err := s.call(ctx, http.MethodGet, "/collections", nil, nil)
+	return err
+}
+
+// ensureCollection creates the collection for vectors of size dimensions,
+// with the owner fields indexed, unless it exists
+func (s *qdrantVectorStore) ensureCollection(ctx context.Context, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	path := "/collections/" + s.collection
+	found, err := s.call(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if _, err := s.call(ctx, http.MethodPut, path, map[string]interface{}{
+			"vectors": map[string]interface{}{"size": size, "distance": "Cosine"},
+		}, nil); err != nil {
+			return fmt.Errorf("error creating Qdrant collection: %v", err)
+		}
+		fields := map[string]string{"tenant_id": "keyword", "user_id": "keyword", "document_id": "keyword", "chunk": "integer"}
+		for field, schema := range fields {
+			if _, err := s.call(ctx, http.MethodPut, path+"/index?wait=true", map[string]interface{}{
+				"field_name": field, "field_schema": schema,
+			}, nil); err != nil {
+				return fmt.Errorf("error indexing Qdrant collection: %v", err)
+			}
+		}
+	}
+	s.ready = true
+	return nil
+}
+
+// qdrantFilter matches the points of an owner, and the extra conditions
+func qdrantFilter(tenantID, userID string, extra ...map[string]interface{}) map[string]interface{} {
+	must := []map[string]interface{}{
+		{"key": "tenant_id", "match": map[string]interface{}{"value": tenantID}},
+		{"key": "user_id", "match": map[string]interface{}{"value": userID}},
+	}
+	return map[string]interface{}{"must": append(must, extra...)}
+}
+
+func qdrantMatch(key string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"key": key, "match": map[string]interface{}{"value": value}}
+}
+
+// qdrantPointID derives a stable point ID from the chunk, as Qdrant wants
+// integers or UUIDs
+func qdrantPointID(documentID string, chunk int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", documentID, chunk)))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func (s *qdrantVectorStore) Put(ctx context.Context, doc *Document, chunks []*DocumentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	if err := s.ensureCollection(ctx, len(chunks[0].Vector)); err != nil {
+		return err
+	}
+	path := "/collections/" + s.collection + "/points"
+	// Replacing a document may leave it with fewer chunks
+	if _, err := s.call(ctx, http.MethodPost, path+"/delete?wait=true", map[string]interface{}{
+		"filter": qdrantFilter(doc.TenantID, doc.UserID, qdrantMatch("document_id", doc.ID)),
+	}, nil); err != nil {
+		return fmt.Errorf("error replacing document: %v", err)
+	}
+	for start := 0; start < len(chunks); start += qdrantBatch {
+		var points []map[string]interface{}
+		for _, chunk := range chunks[start:min(start+qdrantBatch, len(chunks))] {
+			payload := map[string]interface{}{
+				"tenant_id":   doc.TenantID,
+				"user_id":     doc.UserID,
+				"document_id": doc.ID,
+				"name":        doc.Name,
+				"chunk":       chunk.Index,
+				"text":        chunk.Text,
+			}
+			if chunk.Index == 0 {
+				payload["document"] = doc
+			}
+			points = append(points, map[string]interface{}{
+				"id":      qdrantPointID(doc.ID, chunk.Index),
+				"vector":  chunk.Vector,
+				"payload": payload,
+			})
+		}
+		if _, err := s.call(ctx, http.MethodPut, path+"?wait=true", map[string]interface{}{"points": points}, nil); err != nil {
+			return fmt.Errorf("error storing document chunks: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *qdrantVectorStore) Search(ctx context.Context, tenantID, userID string, vector []float64, limit int) ([]*ChunkMatch, error) {
+	var points []qdrantPoint
+	if _, err := s.call(ctx, http.MethodPost, "/collections/"+s.collection+"/points/search", map[string]interface{}{
+		"vector":       vector,
+		"limit":        limit,
+		"filter":       qdrantFilter(tenantID, userID),
+		"with_payload": []string{"document_id", "name", "chunk", "text"},
+	}, &points); err != nil {
+		return nil, fmt.Errorf("error searching documents: %v", err)
+	}
+	matches := make([]*ChunkMatch, len(points))
+	for i, p := range points {
+		matches[i] = &ChunkMatch{
+			DocumentID:   p.Payload.DocumentID,
+			DocumentName: p.Payload.Name,
+			Chunk:        p.Payload.Chunk,
+			Text:         p.Payload.Text,
+			Score:        p.Score,
+		}
+	}
+	return matches, nil
+}
+
+// scroll calls visit with every point matching filter, with the given
+// payload fields
+func (s *qdrantVectorStore) scroll(ctx context.Context, filter map[string]interface{}, payload []string, visit func(p *qdrantPoint)) error {
+	var offset interface{}
+	for {
+		var page struct {
+			Points []qdrantPoint `json:"points"`
+			Next   interface{}   `json:"next_page_offset"`
+		}
+		req := map[string]interface{}{"filter": filter, "limit": 256, "with_payload": payload}
+		if offset != nil {
+			req["offset"] = offset
+		}
+		if _, err := s.call(ctx, http.MethodPost, "/collections/"+s.collection+"/points/scroll", req, &page); err != nil {
+			return err
+		}
+		for i := range page.Points {
+			visit(&page.Points[i])
+		}
+		if page.Next == nil {
+			return nil
+		}
+		offset = page.Next
+	}
+}
+
+// documents returns the documents carried by the first chunks matching
+// filter, newest first
+func (s *qdrantVectorStore) documents(ctx context.Context, filter map[string]interface{}) ([]*Document, error) {
+	var docs []*Document
+	err := s.scroll(ctx, filter, []string{"document"}, func(p *qdrantPoint) {
+		if p.Payload.Document != nil {
+			docs = append(docs, p.Payload.Document)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing documents: %v", err)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].CreatedAt.After(docs[j].CreatedAt) })
+	return docs, nil
+}
+
+func (s *qdrantVectorStore) Passages(ctx context.Context, tenantID, userID string) ([]*ChunkMatch, error) {
+	var passages []*ChunkMatch
+	err := s.scroll(ctx, qdrantFilter(tenantID, userID), []string{"document_id", "name", "chunk", "text"}, func(p *qdrantPoint) {
+		passages = append(passages, &ChunkMatch{
+			DocumentID:   p.Payload.DocumentID,
+			DocumentName: p.Payload.Name,
+			Chunk:        p.Payload.Chunk,
+			Text:         p.Payload.Text,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading document chunks: %v", err)
+	}
+	return passages, nil
+}
+
+func (s *qdrantVectorStore) List(ctx context.Context, tenantID, userID string) ([]*Document, error) {
+	return s.documents(ctx, qdrantFilter(tenantID, userID, qdrantMatch("chunk", 0)))
+}
+
+func (s *qdrantVectorStore) Get(ctx context.Context, tenantID, userID, id string) (*Document, error) {
+	docs, err := s.documents(ctx, qdrantFilter(tenantID, userID, qdrantMatch("document_id", id), qdrantMatch("chunk", 0)))
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+func (s *qdrantVectorStore) DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	n, err := s.delete(ctx, tenantID, userID, qdrantMatch("document_id", id))
+	return n > 0, err
+}
+
+func (s *qdrantVectorStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return s.delete(ctx, tenantID, userID)
+}
+
+// delete removes the owner's points matching the conditions and returns
+// the number of documents they made
+func (s *qdrantVectorStore) delete(ctx context.Context, tenantID, userID string, conditions ...map[string]interface{}) (int, error) {
+	docs, err := s.documents(ctx, qdrantFilter(tenantID, userID, append(conditions, qdrantMatch("chunk", 0))...))
+	if err != nil || len(docs) == 0 {
+		return 0, err
+	}
+	if _, err := s.call(ctx, http.MethodPost, "/collections/"+s.collection+"/points/delete?wait=true",
+		map[string]interface{}{"filter": qdrantFilter(tenantID, userID, conditions...)}, nil); err != nil {
+		return 0, fmt.Errorf("error deleting documents: %v", err)
+	}
+	return len(docs), nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// vectorSchema creates the document tables next to the history tables.
+// Chunks repeat their owner, so searches pick them by index.
+var vectorSchema = map[string][]string{
+	HistoryStoreSQLite: {
+		`CREATE TABLE IF NOT EXISTS documents (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			format TEXT NOT NULL,
+			bytes INTEGER NOT NULL,
+			chunks INTEGER NOT NULL,
+			embedding_model TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS documents_owner ON documents (tenant_id, user_id, created_at)`,
+		// Embeddings are float32 blobs, the format of sqlite-vec
+		`CREATE TABLE IF NOT EXISTS document_chunks (
+			document_id TEXT NOT NULL,
+			chunk INTEGER NOT NULL,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			embedding BLOB NOT NULL,
+			PRIMARY KEY (document_id, chunk)
+		)`,
+		`CREATE INDEX IF NOT EXISTS document_chunks_owner ON document_chunks (tenant_id, user_id)`,
+	},
+	HistoryStorePostgres: {
+		`CREATE EXTENSION IF NOT EXISTS vector`,
+		`CREATE TABLE IF NOT EXISTS documents (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			format TEXT NOT NULL,
+			bytes BIGINT NOT NULL,
+			chunks INTEGER NOT NULL,
+			embedding_model TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS documents_owner ON documents (tenant_id, user_id, created_at)`,
+		// No dimension, so changing EMBEDDING_MODEL needs no migration. That
+		// rules out an HNSW index, which searches filtered to one owner's
+		// chunks wouldn't use well anyway. <=> fails on vectors of different
+		// dimensions, so searches only rank the chunks of documents embedded
+		// with the current model.
+		`CREATE TABLE IF NOT EXISTS document_chunks (
+			document_id TEXT NOT NULL,
+			chunk INTEGER NOT NULL,
+			tenant_id TEXT NOT NULL,
+			user_id TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			embedding vector NOT NULL,
+			PRIMARY KEY (document_id, chunk)
+		)`,
+		`CREATE INDEX IF NOT EXISTS document_chunks_owner ON document_chunks (tenant_id, user_id)`,
+	},
+}
+
+const documentColumns = `id, tenant_id, user_id, name, format, bytes, chunks, embedding_model, created_at`
+
+// sqlVectorStore keeps documents in the history database. Postgres ranks
+// chunks with pgvector; SQLite with sqlite-vec when the driver has it
+// loaded, and otherwise in Go, reading the owner's embeddings.
+type sqlVectorStore struct {
+	h *sqlHistoryStore
+	// model is the embedding model searches are made with; chunks of
+	// documents embedded with another are left out of them
+	model string
+	// sqliteVec tells whether SQLite has the sqlite-vec functions
+	sqliteVec bool
+}
+
+// NewSQLVectorStore creates the document tables in the history database,
+// for searches with the vectors of model
+func NewSQLVectorStore(ctx context.Context, history *sqlHistoryStore, model string) (*sqlVectorStore, error) {
+	for _, stmt := range vectorSchema[history.dialect] {
+		if _, err := history.db.ExecContext(ctx, stmt); err != nil {
+			if history.dialect == HistoryStorePostgres && strings.Contains(stmt, "EXTENSION") {
+				return nil, fmt.Errorf("error enabling pgvector, is it installed? %v", err)
+			}
+			return nil, fmt.Errorf("error creating document tables: %v", err)
+		}
+	}
+	s := &sqlVectorStore{h: history, model: model}
+	if history.dialect == HistoryStoreSQLite {
+		var version string
+		s.sqliteVec = history.db.QueryRowContext(ctx, `SELECT vec_version()`).Scan(&version) == nil
+	}
+	return s, nil
+}
+
+// encodeVector renders a vector as a query argument: a float32 blob for
+// SQLite, pgvector's text form for Postgres
+func (s *sqlVectorStore) encodeVector(vector []float64) interface{} {
+	if s.h.dialect == HistoryStorePostgres {
+		parts := make([]string, len(vector))
+		for i, v := range vector {
+			parts[i] = strconv.FormatFloat(float64(float32(v)), 'g', -1, 32)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	}
+	blob := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(float32(v)))
+	}
+	return blob
+}
+
+func decodeVectorBlob(blob []byte) []float64 {
+	vector := make([]float64, len(blob)/4)
+	for i := range vector {
+		vector[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:])))
+	}
+	return vector
+}
+
+func (s *sqlVectorStore) Put(ctx context.Context, doc *Document, chunks []*DocumentChunk) error {
+	tx, err := s.h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error storing document: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.h.rebind(`DELETE FROM document_chunks WHERE document_id = ?`), doc.ID); err != nil {
+		return fmt.Errorf("error replacing document: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, s.h.rebind(`DELETE FROM documents WHERE id = ?`), doc.ID); err != nil {
+		return fmt.Errorf("error replacing document: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, s.h.rebind(`INSERT INTO documents (`+documentColumns+`) VALUES (`+placeholders(9)+`)`),
+		doc.ID, doc.TenantID, doc.UserID, doc.Name, doc.Format, doc.Bytes, doc.Chunks, doc.EmbeddingModel, doc.CreatedAt.UTC()); err != nil {
+		return fmt.Errorf("error inserting document: %v", err)
+	}
+	vector := "?"
+	if s.h.dialect == HistoryStorePostgres {
+		vector = "CAST(? AS vector)"
+	}
+	stmt, err := tx.PrepareContext(ctx, s.h.rebind(`INSERT INTO document_chunks (document_id, chunk, tenant_id, user_id, text, embedding) VALUES (?, ?, ?, ?, ?, `+vector+`)`))
+	if err != nil {
+		return fmt.Errorf("error inserting document chunks: %v", err)
+	}
+	defer stmt.Close()
+	for _, chunk := range chunks {
+		if _, err := stmt.ExecContext(ctx, doc.ID, chunk.Index, doc.TenantID, doc.UserID, chunk.Text, s.encodeVector(chunk.Vector)); err != nil {
+			return fmt.Errorf("error inserting document chunk: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error storing document: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlVectorStore) Search(ctx context.Context, tenantID, userID string, vector []float64, limit int) ([]*ChunkMatch, error) {
+	var score string
+	switch {
+	case s.h.dialect == HistoryStorePostgres:
+		score = `1 - (c.embedding <=> CAST(? AS vector))`
+	case s.sqliteVec:
+		score = `1 - vec_distance_cosine(c.embedding, ?)`
+	default:
+		return s.searchInGo(ctx, tenantID, userID, vector, limit)
+	}
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(`SELECT c.document_id, d.name, c.chunk, c.text, `+score+` AS score
+		FROM document_chunks c JOIN documents d ON d.id = c.document_id
+		WHERE c.tenant_id = ? AND c.user_id = ? AND d.embedding_model = ? ORDER BY score DESC, c.document_id, c.chunk LIMIT ?`),
+		s.encodeVector(vector), tenantID, userID, s.model, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching documents: %v", err)
+	}
+	defer rows.Close()
+	var matches []*ChunkMatch
+	for rows.Next() {
+		m := &ChunkMatch{}
+		if err := rows.Scan(&m.DocumentID, &m.DocumentName, &m.Chunk, &m.Text, &m.Score); err != nil {
+			return nil, fmt.Errorf("error reading document chunk: %v", err)
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// searchInGo ranks the owner's chunks without sqlite-vec
+func (s *sqlVectorStore) searchInGo(ctx context.Context, tenantID, userID string, vector []float64, limit int) ([]*ChunkMatch, error) {
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(`SELECT c.document_id, d.name, c.chunk, c.text, c.embedding
+		FROM document_chunks c JOIN documents d ON d.id = c.document_id
+		WHERE c.tenant_id = ? AND c.user_id = ? AND d.embedding_model = ?`), tenantID, userID, s.model)
+	if err != nil {
+		return nil, fmt.Errorf("error searching documents: %v", err)
+	}
+	defer rows.Close()
+	var matches []*ChunkMatch
+	for rows.Next() {
+		m := &ChunkMatch{}
+		var blob []byte
+		if err := rows.Scan(&m.DocumentID, &m.DocumentName, &m.Chunk, &m.Text, &blob); err != nil {
+			return nil, fmt.Errorf("error reading document chunk: %v", err)
+		}
+		m.Score = cosineSimilarity(vector, decodeVectorBlob(blob))
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading document chunks: %v", err)
+	}
+	return nearestMatches(matches, limit), nil
+}
+
+func (s *sqlVectorStore) Passages(ctx context.Context, tenantID, userID string) ([]*ChunkMatch, error) {
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(`SELECT c.document_id, d.name, c.chunk, c.text
+		FROM document_chunks c JOIN documents d ON d.id = c.document_id
+		WHERE c.tenant_id = ? AND c.user_id = ?`), tenantID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading document chunks: %v", err)
+	}
+	defer rows.Close()
+	var passages []*ChunkMatch
+	for rows.Next() {
+		m := &ChunkMatch{}
+		if err := rows.Scan(&m.DocumentID, &m.DocumentName, &m.Chunk, &m.Text); err != nil {
+			return nil, fmt.Errorf("error reading document chunk: %v", err)
+		}
+		passages = append(passages, m)
+	}
+	return passages, rows.Err()
+}
+
+func (s *sqlVectorStore) List(ctx context.Context, tenantID, userID string) ([]*Document, error) {
+	return s.query(ctx, `SELECT `+documentColumns+` FROM documents WHERE tenant_id = ? AND user_id = ? ORDER BY created_at DESC, id`,
+		tenantID, userID)
+}
+
+func (s *sqlVectorStore) Get(ctx context.Context, tenantID, userID, id string) (*Document, error) {
+	docs, err := s.query(ctx, `SELECT `+documentColumns+` FROM documents WHERE id = ? AND tenant_id = ? AND user_id = ?`,
+		id, tenantID, userID)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+func (s *sqlVectorStore) query(ctx context.Context, query string, args ...interface{}) ([]*Document, error) {
+	rows, err := s.h.db.QueryContext(ctx, s.h.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying documents: %v", err)
+	}
+	defer rows.Close()
+	var docs []*Document
+	for rows.Next() {
+		doc := &Document{}
+		if err := rows.Scan(&doc.ID, &doc.TenantID, &doc.UserID, &doc.Name, &doc.Format, &doc.Bytes, &doc.Chunks,
+			&doc.EmbeddingModel, &doc.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading document: %v", err)
+		}
+		doc.CreatedAt = doc.CreatedAt.UTC()
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+func (s *sqlVectorStore) DeleteOwned(ctx context.Context, tenantID, userID, id string) (bool, error) {
+	n, err := s.delete(ctx, `id = ? AND tenant_id = ? AND user_id = ?`, `document_id = ? AND tenant_id = ? AND user_id = ?`,
+		id, tenantID, userID)
+	return n > 0, err
+}
+
+func (s *sqlVectorStore) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	return s.delete(ctx, `tenant_id = ? AND user_id = ?`, `tenant_id = ? AND user_id = ?`, tenantID, userID)
+}
+
+// delete removes the documents and chunks matching the conditions, which
+// take the same arguments, and returns the number of documents
+func (s *sqlVectorStore) delete(ctx context.Context, documents, chunks string, args ...interface{}) (int, error) {
+	tx, err := s.h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting documents: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.h.rebind(`DELETE FROM document_chunks WHERE `+chunks), args...); err != nil {
+		return 0, fmt.Errorf("error deleting document chunks: %v", err)
+	}
+	res, err := tx.ExecContext(ctx, s.h.rebind(`DELETE FROM documents WHERE `+documents), args...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting documents: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting documents: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error deleting documents: %v", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Search verticals, each with its own analysis prompt
+const (
+	VerticalWeb      = "web"
+	VerticalCode     = "code"
+	VerticalAcademic = "academic"
+	VerticalShopping = "shopping"
+)
+
+var verticalRequests = metricsRegistry.Counter("search_vertical_requests_total",
+	"Prompts analyzed per detected vertical.", "vertical")
+
+// verticalHints are scored against the prompt; the vertical with the most
+// hits wins, ties and no hits fall back to web
+var verticalHints = map[string]*regexp.Regexp{
+	VerticalCode:     regexp.MustCompile(`(?i)\b(?:error|exception|stack ?trace|segfault|compile[rds]?|function|method|api|sdk|library|package|npm|pip|cargo|docker|kubernetes|golang|python|javascript|typescript|java|rust|c\+\+|c#|regex|sql|github|stack ?overflow|code|snippet|bug|null pointer|undefined)\b`),
+	VerticalAcademic: regexp.MustCompile(`(?i)\b(?:papers?|study|studies|research|journals?|peer[- ]reviewed|thesis|dissertation|citations?|arxiv|pubmed|scholar|meta[- ]analysis|literature|doi|preprints?|academic)\b`),
+	VerticalShopping: regexp.MustCompile(`(?i)\b(?:buy|purchase|price[sd]?|cheap(?:est)?|deals?|discount|coupon|under \$?\d+|shop|store|order|shipping|in stock|on sale|for sale|best .{1,30} (?:for|under))\b|\$\d+`),
+}
+
+// classifyVertical is the fast, deterministic pass that picks the prompt
+func classifyVertical(prompt string) string {
+	best, bestHits, tie := VerticalWeb, 0, false
+	for _, v := range []string{VerticalCode, VerticalAcademic, VerticalShopping} {
+		hits := len(verticalHints[v].FindAllStringIndex(prompt, -1))
+		switch {
+		case hits > bestHits:
+			best, bestHits, tie = v, hits, false
+		case hits == bestHits && hits > 0:
+			tie = true
+		}
+	}
+	if tie {
+		return VerticalWeb
+	}
+	return best
+}
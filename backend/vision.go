@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// visionPrompt turns an image into the request a user would have typed
+const visionPrompt = `The user searches the web with an image instead of words: a screenshot of an error, a photo of a product, a place, a page of a document. Work out what they most likely want to find.
+Answer only with JSON: {"description": "<one sentence on what the image shows>", "query": "<the search, phrased as a request in natural language>", "text": "<the text in the image that matters, such as error messages, titles and labels, verbatim, one line per line of the image>"}
+Copy error messages, product names and model numbers exactly as they appear in the image. If there is nothing to search for in the image, answer with an empty query. If there is no text, answer with an empty text.`
+
+// imageTypes are the sniffed content types vision models accept
+var imageTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+}
+
+var imageQueries = metricsRegistry.Counter("image_queries_total",
+	"Image queries, by result (ok, empty, error).", "result")
+
+// ImageDescription is what the vision model made of an image
+type ImageDescription struct {
+	Description string `json:"description"`
+	// Query is the prompt derived from the image, analyzed like a typed one
+	Query string `json:"query"`
+	// Text is the text the model read in the image, for the vision OCR
+	Text string `json:"-"`
+}
+
+// visionContent is a part of a multimodal message, text or an image
+type visionContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *visionImageURL `json:"image_url,omitempty"`
+}
+
+type visionImageURL struct {
+	URL string `json:"url"`
+}
+
+// visionMessage is an OpenAIMessage whose content is a string or parts
+type visionMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type visionRequest struct {
+	Model       string          `json:"model"`
+	Messages    []visionMessage `json:"messages"`
+	Temperature float64         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+}
+
+// ImageSearch derives queries from images with a vision model
+type ImageSearch struct {
+	model    string
+	maxBytes int64
+}
+
+func NewImageSearch(model string, maxBytes int64) *ImageSearch {
+	return &ImageSearch{model: model, maxBytes: maxBytes}
+}
+
+// UseImageSearch enables image queries on /v1/search/image
+func (h *SearchHandler) UseImageSearch(images *ImageSearch) {
+	h.images = images
+}
+
+// describeImage asks the vision model what the image is and what to search
+// for, in the language of locale if set. Like transcriptions, it is refused
+// over budget.
+func (h *SearchHandler) describeImage(ctx context.Context, image []byte, contentType, locale string) (*ImageDescription, error) {
+	ctx, span := tracer.Start(ctx, "search.describe_image", SpanKindInternal)
+	defer span.End()
+	model := h.images.model
+	span.SetAttr("image.bytes", len(image))
+	span.SetAttr("gen_ai.request.model", model)
+
+	if err := h.budget.Check(ctx, tenantFromContext(ctx)); err != nil {
+		return nil, err
+	}
+
+	instruction := "What should I search for?"
+	if locale != "" {
+		instruction += " Write the query in the language of the locale " + locale + "."
+	}
+	reqBody := visionRequest{
+		Model: model,
+		Messages: []visionMessage{
+			{Role: "system", Content: visionPrompt},
+			{Role: "user", Content: []visionContent{
+				{Type: "text", Text: instruction},
+				{Type: "image_url", ImageURL: &visionImageURL{
+					URL: "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(image),
+				}},
+			}},
+		},
+		MaxTokens: h.maxTokens,
+	}
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling OpenAI request: %v", err)
+	}
+	// The request body is mostly the image, it's not logged
+
+	release, err := h.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	openAIResp, err := h.postChatCompletion(ctx, model, jsonBody)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	var answer struct {
+		Description string `json:"description"`
+		Query       string `json:"query"`
+		Text        string `json:"text"`
+	}
+	content := stripCodeFence(openAIResp.Choices[0].Message.Content)
+	if err := json.Unmarshal([]byte(content), &answer); err != nil {
+		return nil, fmt.Errorf("error parsing image description: %v", err)
+	}
+	return &ImageDescription{
+		Description: strings.TrimSpace(answer.Description),
+		Query:       strings.TrimSpace(answer.Query),
+		Text:        strings.TrimSpace(answer.Text),
+	}, nil
+}
+
+// handleSearchImage serves POST /v1/search/image: an image, uploaded as
+// multipart form data in "image" with the options of /search as fields, is
+// turned into a query by the vision model, which is then analyzed like a
+// typed prompt. The answer is that of /search with the image description.
+func (h *SearchHandler) handleSearchImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.images == nil || !h.flags.Enabled(r.Context(), FlagImageSearch, true) {
+		http.Error(w, "Image search is disabled", http.StatusNotFound)
+		return
+	}
+	version, err := requestedIntentVersion(r, h.intentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	qrImage, err := requestedQRImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload, ok := h.readSearchUpload(w, r, "image", h.images.maxBytes)
+	if !ok {
+		return
+	}
+	// The content decides, whatever the file is named
+	contentType := http.DetectContentType(upload.data)
+	if !imageTypes[contentType] {
+		http.Error(w, "Unsupported image format, use PNG, JPEG, GIF or WebP", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	description, err := h.describeImage(r.Context(), upload.data, contentType, upload.opts.Locale)
+	if err != nil {
+		imageQueries.Inc("error")
+		var budgetErr *BudgetExceededError
+		if errors.As(err, &budgetErr) || errors.Is(err, ErrNoHealthyKeys) || errors.Is(err, ErrUpstreamBusy) ||
+			errors.Is(err, context.DeadlineExceeded) {
+			writeAnalyzeError(w, r, err)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error describing image", "error", err)
+		http.Error(w, "Error describing image", http.StatusBadGateway)
+		return
+	}
+	slog.DebugContext(r.Context(), "Derived query from image", "prompt", loggedPrompt(r.Context(), description.Query))
+	if description.Query == "" {
+		imageQueries.Inc("empty")
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    "no_query",
+			"message":  "Nothing to search for was found in the image",
+			"image":    description,
+			"trace_id": spanFromContext(r.Context()).TraceID(),
+		})
+		return
+	}
+	imageQueries.Inc("ok")
+	// Set ocr=false to keep the text of the image out of the intent
+	var ocr map[string]interface{}
+	var phrases []string
+	if h.ocr != nil && upload.fields.Get("ocr") != "false" {
+		ocr, phrases = h.readImageText(r.Context(), upload.data, description)
+	}
+
+	result, err := h.analyze(r.Context(), description.Query, upload.opts)
+	var piiErr *PIIConfirmationError
+	if errors.As(err, &piiErr) {
+		// Confirming goes through /search with the query, rather than
+		// describing the image again
+		writeJSON(w, http.StatusPreconditionRequired, map[string]interface{}{
+			"error":    "pii_confirmation_required",
+			"message":  piiErr.Error(),
+			"kinds":    piiErr.Kinds,
+			"image":    description,
+			"trace_id": spanFromContext(r.Context()).TraceID(),
+		})
+		return
+	}
+	if err != nil {
+		writeAnalyzeError(w, r, err)
+		return
+	}
+
+	if len(phrases) > 0 {
+		result = withExactPhrases(result, phrases)
+	}
+
+	w.Header().Set(intentVersionHeader, strconv.Itoa(version))
+	response := h.searchResponse(r, description.Query, result, version, qrImage, upload.includeResults, upload.opts.Locale)
+	response["image"] = description
+	if ocr != nil {
+		response["ocr"] = ocr
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// readImageText reads the text in the image and picks the phrases to search
+// for verbatim. It returns what to tell the client, nil when reading failed:
+// the search goes on without the text.
+func (h *SearchHandler) readImageText(ctx context.Context, image []byte, description *ImageDescription) (map[string]interface{}, []string) {
+	text, err := h.ocr.Extract(ctx, image, description)
+	if err != nil {
+		ocrExtractions.Inc(h.ocr.engine, "error")
+		slog.WarnContext(ctx, "Error reading text in image", "engine", h.ocr.engine, "error", err)
+		return nil, nil
+	}
+	text = strings.TrimSpace(text)
+	phrases := ocrPhrases(text)
+	if len(phrases) == 0 {
+		ocrExtractions.Inc(h.ocr.engine, "no_phrases")
+		phrases = []string{}
+	} else {
+		ocrExtractions.Inc(h.ocr.engine, "phrases")
+	}
+	if len(text) > maxOCRText {
+		text = strings.ToValidUTF8(text[:maxOCRText], "")
+	}
+	return map[string]interface{}{"engine": h.ocr.engine, "text": text, "phrases": phrases}, phrases
+}
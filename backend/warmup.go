@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxWarmupUpload  = 256 << 20
+	defaultWarmupMax = 10000
+)
+
+var warmupPrompts = metricsRegistry.Counter("cache_warmup_prompts_total",
+	"Prompts replayed from imported logs, by result (analyzed, cached, failed).", "result")
+
+var (
+	// requestLineRe finds the request of nginx combined and ALB log lines
+	requestLineRe = regexp.MustCompile(`"(?:GET|POST|HEAD) (\S+) HTTP/[\d.]+"`)
+	nginxTimeRe   = regexp.MustCompile(`\[([^\]]+)\]`)
+)
+
+// warmupSearch is one search found in an imported log
+type warmupSearch struct {
+	Prompt string
+	UserID string
+	Time   time.Time
+}
+
+// parseSearchLog reads searches from an access log or a search log export.
+// Formats: "nginx" (combined), "alb", "jsonl" ({"query", "user_id", "time"}
+// per line) and "text" (one query per line). For access logs the query is
+// taken from the param query parameter of each request.
+func parseSearchLog(r io.Reader, format, param string) ([]warmupSearch, int, error) {
+	var searches []warmupSearch
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		s, ok := parseSearchLogLine(line, format, param)
+		if !ok || strings.TrimSpace(s.Prompt) == "" {
+			skipped++
+			continue
+		}
+		s.Prompt = strings.TrimSpace(s.Prompt)
+		searches = append(searches, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("error reading log: %v", err)
+	}
+	return searches, skipped, nil
+}
+
+func parseSearchLogLine(line, format, param string) (warmupSearch, bool) {
+	var s warmupSearch
+	switch format {
+	case "text":
+		s.Prompt = line
+		return s, true
+
+	case "jsonl":
+		var entry struct {
+			Query  string    `json:"query"`
+			Prompt string    `json:"prompt"`
+			UserID string    `json:"user_id"`
+			Time   time.Time `json:"time"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return s, false
+		}
+		s.Prompt, s.UserID, s.Time = entry.Query, entry.UserID, entry.Time
+		if s.Prompt == "" {
+			s.Prompt = entry.Prompt
+		}
+		return s, true
+
+	case "nginx", "alb":
+		m := requestLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return s, false
+		}
+		u, err := url.Parse(m[1])
+		if err != nil {
+			return s, false
+		}
+		s.Prompt = u.Query().Get(param)
+		if format == "nginx" {
+			if t := nginxTimeRe.FindStringSubmatch(line); t != nil {
+				s.Time, _ = time.Parse("02/Jan/2006:15:04:05 -0700", t[1])
+			}
+		} else if fields := strings.Fields(line); len(fields) > 1 {
+			s.Time, _ = time.Parse(time.RFC3339Nano, fields[1])
+		}
+		return s, true
+	}
+	return s, false
+}
+
+// Warmup replays searches from the old search box through the analyzer, to
+// fill the intent cache and history before cutover
+type Warmup struct {
+	search    *SearchHandler
+	history   *HistoryService
+	tenants   *TenantRegistry
+	scheduler *JobScheduler
+}
+
+func NewWarmup(search *SearchHandler, history *HistoryService, tenants *TenantRegistry, scheduler *JobScheduler) *Warmup {
+	return &Warmup{search: search, history: history, tenants: tenants, scheduler: scheduler}
+}
+
+// Run analyzes each distinct prompt once, most frequent first, and with
+// withHistory imports every search into the history
+func (wu *Warmup) Run(ctx context.Context, tenant *Tenant, searches []warmupSearch, limit int, withHistory bool) error {
+	ctx = withTenant(ctx, tenant)
+
+	counts := make(map[string]int)
+	for _, s := range searches {
+		counts[s.Prompt]++
+	}
+	prompts := make([]string, 0, len(counts))
+	for p := range counts {
+		prompts = append(prompts, p)
+	}
+	sort.Slice(prompts, func(i, j int) bool {
+		if counts[prompts[i]] != counts[prompts[j]] {
+			return counts[prompts[i]] > counts[prompts[j]]
+		}
+		return prompts[i] < prompts[j]
+	})
+	if len(prompts) > limit {
+		prompts = prompts[:limit]
+	}
+
+	results := make(map[string]*AnalysisResult, len(prompts))
+	failed := 0
+	for _, prompt := range prompts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result, err := wu.search.analyze(ctx, prompt, AnalyzeOptions{})
+		if err != nil {
+			failed++
+			warmupPrompts.Inc("failed")
+			continue
+		}
+		if result.Cached {
+			warmupPrompts.Inc("cached")
+		} else {
+			warmupPrompts.Inc("analyzed")
+		}
+		results[prompt] = result
+	}
+
+	imported := 0
+	if withHistory {
+		now := time.Now()
+		for _, s := range searches {
+			result, ok := results[s.Prompt]
+			if !ok {
+				continue
+			}
+			createdAt := s.Time
+			if createdAt.IsZero() {
+				createdAt = now
+			}
+			if err := wu.history.Import(ctx, tenant.ID, s.UserID, createdAt, s.Prompt, result); err != nil {
+				return fmt.Errorf("error importing history: %v", err)
+			}
+			imported++
+		}
+	}
+
+	slog.Info("Cache warm-up done", "tenant", tenant.ID, "prompts", len(prompts),
+		"failed", failed, "history_imported", imported)
+	if failed > 0 && len(results) == 0 {
+		return fmt.Errorf("all %d prompts failed", failed)
+	}
+	return nil
+}
+
+// handleImport takes a log file as the request body and schedules its replay
+// as a low priority background job:
+// POST /v1/admin/warmup?format=nginx|alb|jsonl|text&param=q&tenant_id=&limit=&history=true
+func (wu *Warmup) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "nginx"
+	}
+	param := q.Get("param")
+	if param == "" {
+		param = "q"
+	}
+	tenantID := q.Get("tenant_id")
+	if tenantID == "" {
+		tenantID = DefaultTenantID
+	}
+	tenant, ok := wu.tenants.ByID(tenantID)
+	if !ok {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return
+	}
+	limit := defaultWarmupMax
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	withHistory := q.Get("history") == "true"
+
+	switch format {
+	case "nginx", "alb", "jsonl", "text":
+	default:
+		http.Error(w, "format must be nginx, alb, jsonl or text", http.StatusBadRequest)
+		return
+	}
+
+	searches, skipped, err := parseSearchLog(http.MaxBytesReader(w, r.Body, maxWarmupUpload), format, param)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(searches) == 0 {
+		http.Error(w, "No searches found in the log", http.StatusBadRequest)
+		return
+	}
+
+	jobID := "cache-warmup-" + newHistoryID()[:8]
+	wu.scheduler.Submit(&Job{
+		ID:          jobID,
+		Kind:        "cache_warmup",
+		Description: fmt.Sprintf("Replay %d searches of tenant %s from a %s log", len(searches), tenant.ID, format),
+		Priority:    PriorityLow,
+		Run: func(ctx context.Context) error {
+			return wu.Run(ctx, tenant, searches, limit, withHistory)
+		},
+	})
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"job_id":   jobID,
+		"searches": len(searches),
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zapierPathPrefix groups the endpoints shaped for no-code platforms
+// (Zapier, Make, n8n): GET only, key in the query string, flat JSON
+const zapierPathPrefix = "/v1/zap/"
+
+// maxTriggerItems is how many trigger items are kept per owner
+const maxTriggerItems = 100
+
+// TriggerItem is one entry of a polling trigger. Platforms deduplicate on ID,
+// so it must be unique and stable.
+type TriggerItem struct {
+	ID            string    `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	SavedSearchID string    `json:"saved_search_id"`
+	Prompt        string    `json:"prompt"`
+	Title         string    `json:"title"`
+	URL           string    `json:"url"`
+	Snippet       string    `json:"snippet"`
+}
+
+// TriggerFeed keeps the most recent trigger items per owner, newest first.
+// Items carry a user's saved-search prompts and results, so they are keyed
+// by tenant and user and only read back by that same user.
+type TriggerFeed struct {
+	mu    sync.Mutex
+	seq   int64
+	items map[string][]TriggerItem
+}
+
+func triggerFeedKey(tenantID, userID string) string {
+	return tenantID + "\x00" + userID
+}
+
+func NewTriggerFeed() *TriggerFeed {
+	return &TriggerFeed{items: make(map[string][]TriggerItem)}
+}
+
+// Publish adds an item to the owner's feed, assigning its ID and timestamp
+func (f *TriggerFeed) Publish(tenantID, userID string, item TriggerItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	item.ID = strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(f.seq, 36)
+	item.CreatedAt = time.Now().UTC()
+
+	key := triggerFeedKey(tenantID, userID)
+	items := append([]TriggerItem{item}, f.items[key]...)
+	if len(items) > maxTriggerItems {
+		items = items[:maxTriggerItems]
+	}
+	f.items[key] = items
+}
+
+// List returns up to limit items of the owner's feed, newest first
+func (f *TriggerFeed) List(tenantID, userID string, limit int) []TriggerItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := f.items[triggerFeedKey(tenantID, userID)]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return append([]TriggerItem{}, items...)
+}
+
+// DeleteAllOwned drops the owner's feed, for user erasure
+func (f *TriggerFeed) DeleteAllOwned(ctx context.Context, tenantID, userID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := triggerFeedKey(tenantID, userID)
+	n := len(f.items[key])
+	delete(f.items, key)
+	return n, nil
+}
+
+// ZapierHandler serves the simplified no-code endpoints
+type ZapierHandler struct {
+	search  *SearchHandler
+	tenants *TenantRegistry
+	feed    *TriggerFeed
+}
+
+func NewZapierHandler(search *SearchHandler, tenants *TenantRegistry, feed *TriggerFeed) *ZapierHandler {
+	return &ZapierHandler{search: search, tenants: tenants, feed: feed}
+}
+
+// Register mounts the endpoints on mux
+func (z *ZapierHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(zapierPathPrefix+"me", z.authenticated(z.handleMe))
+	mux.HandleFunc(zapierPathPrefix+"search", z.authenticated(z.handleSearch))
+	mux.HandleFunc(zapierPathPrefix+"triggers/new-results", z.authenticated(z.handleNewResults))
+}
+
+// authenticated only lets through GET requests carrying a known API key
+func (z *ZapierHandler) authenticated(next func(http.ResponseWriter, *http.Request, *Tenant)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tenant, ok := z.tenants.Lookup(apiKeyFromRequest(r))
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing api_key"})
+			return
+		}
+		next(w, r, tenant)
+	}
+}
+
+// handleMe is the connection test: it succeeds for any valid key
+func (z *ZapierHandler) handleMe(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	writeJSON(w, http.StatusOK, map[string]string{"tenant": tenant.ID})
+}
+
+// handleSearch analyzes ?prompt= and returns the intent flattened to strings
+func (z *ZapierHandler) handleSearch(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	prompt := strings.TrimSpace(r.URL.Query().Get("prompt"))
+	if prompt == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing prompt parameter"})
+		return
+	}
+
+	result, err := z.search.analyze(r.Context(), prompt, AnalyzeOptions{})
+	if err != nil {
+		writeAnalyzeError(w, r, err)
+		return
+	}
+	intent := result.Intent
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"prompt":        prompt,
+		"search_url":    constructSearchQuery(intent),
+		"query":         buildQueryString(intent),
+		"main_query":    intent.MainQuery,
+		"exact_phrases": strings.Join(intent.ExactPhrases, ", "),
+		"site_filter":   intent.SiteFilter,
+		"file_type":     intent.FileType,
+		"exclude_words": strings.Join(intent.ExcludeWords, ", "),
+		"date_range":    intent.DateRange,
+	})
+}
+
+// handleNewResults is a polling trigger over the user's saved-search results.
+// It returns a bare array, newest first, as the platforms expect.
+func (z *ZapierHandler) handleNewResults(w http.ResponseWriter, r *http.Request, tenant *Tenant) {
+	tenantID, userID, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid limit %q", v)})
+			return
+		}
+		limit = n
+	}
+
+	items := z.feed.List(tenantID, userID, limit)
+	if id := r.URL.Query().Get("saved_search_id"); id != "" {
+		filtered := items[:0]
+		for _, item := range items {
+			if item.SavedSearchID == id {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+	writeJSON(w, http.StatusOK, items)
+}
@@ -1,32 +1,67 @@
-import React, { useState } from 'react';
-import { Search, Loader2 } from 'lucide-react';
+import React, { useRef, useState } from 'react';
+import { Search, Loader2, Mic, Square, Image } from 'lucide-react';
+
+// Precision mode asks the backend for its stronger model at zero temperature
+const PRECISION_MODEL = 'gpt-4o';
+
+// Same origin by default: the backend serves the app, and `npm start`
+// proxies API calls to it
+const API_URL = process.env.REACT_APP_API_URL || '';
+
+// The backend tells the audio format from the file extension
+const audioExtension = (mimeType) => {
+  if (mimeType.includes('mp4')) return 'mp4';
+  if (mimeType.includes('ogg')) return 'ogg';
+  return 'webm';
+};
+
+const voiceSupported = typeof window !== 'undefined' && !!window.MediaRecorder && !!navigator.mediaDevices;
 
 const SearchFrontend = () => {
   const [prompt, setPrompt] = useState('');
+  const [precisionMode, setPrecisionMode] = useState(false);
+  // QR mode shows the search as a QR code to open it on a phone
+  const [qrMode, setQrMode] = useState(false);
+  const [qrCode, setQrCode] = useState(null);
+  // Prompts like "search my docs for ..." answer with passages of the
+  // user's documents instead of a search URL
+  const [documentMatches, setDocumentMatches] = useState(null);
   const [isLoading, setIsLoading] = useState(false);
   const [error, setError] = useState('');
+  const [isRecording, setIsRecording] = useState(false);
+  const recorderRef = useRef(null);
 
-  const handleSearch = async (e) => {
-    e.preventDefault();
+  // runSearch sends the request and opens, or shows as a QR code, the search
+  // URL of the answer
+  const runSearch = async (request) => {
     setIsLoading(true);
     setError('');
+    setQrCode(null);
+    setDocumentMatches(null);
 
     try {
-      const response = await fetch('http://localhost:8080/search', {
-        method: 'POST',
-        headers: {
-          'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({ prompt }),
-      });
+      const response = await request();
 
       if (!response.ok) {
         const errorData = await response.text();
-        throw new Error(errorData || 'Failed to get search results');
+        // The trace ID lets support find this request in logs and traces
+        const traceId = response.headers.get('X-Trace-ID');
+        const message = errorData || 'Failed to get search results';
+        throw new Error(traceId ? `${message} (reference: ${traceId})` : message);
       }
 
       const data = await response.json();
-      if (data.search_url) {
+      if (data.transcript) {
+        // Shows what was heard, and lets the user fix it and search again
+        setPrompt(data.transcript.text);
+      } else if (data.image) {
+        setPrompt(data.image.query);
+      }
+      if (data.source === 'documents') {
+        setDocumentMatches(data.matches);
+      } else if (data.search_url && qrMode && data.qr_code) {
+        setQrCode({ image: data.qr_code, url: data.search_url });
+      } else if (data.search_url) {
         window.open(data.search_url, '_blank')?.focus();
       } else {
         throw new Error('No search URL received');
@@ -39,6 +74,77 @@ const SearchFrontend = () => {
     }
   };
 
+  const handleSearch = (e) => {
+    e.preventDefault();
+    runSearch(() =>
+      fetch(`${API_URL}/search${qrMode ? '?format=qr' : ''}`, {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(
+          precisionMode
+            ? { prompt, model: PRECISION_MODEL, temperature: 0 }
+            : { prompt }
+        ),
+      })
+    );
+  };
+
+  // searchWithFile uploads a recording or an image to the endpoint that
+  // turns it into a search
+  const searchWithFile = (path, field, file, filename) => {
+    const form = new FormData();
+    form.append(field, file, filename);
+    form.append('locale', navigator.language);
+    if (precisionMode) {
+      form.append('model', PRECISION_MODEL);
+      form.append('temperature', '0');
+    }
+    runSearch(() =>
+      fetch(`${API_URL}${path}${qrMode ? '?format=qr' : ''}`, {
+        method: 'POST',
+        body: form,
+      })
+    );
+  };
+
+  const searchByVoice = (recording) =>
+    searchWithFile('/v1/search/audio', 'audio', recording, `query.${audioExtension(recording.type)}`);
+
+  const searchByImage = (e) => {
+    const image = e.target.files[0];
+    e.target.value = '';
+    if (image) {
+      searchWithFile('/v1/search/image', 'image', image, image.name);
+    }
+  };
+
+  // toggleRecording starts recording a voice query, or stops and sends it
+  const toggleRecording = async () => {
+    if (isRecording) {
+      recorderRef.current?.stop();
+      return;
+    }
+    setError('');
+    try {
+      const stream = await navigator.mediaDevices.getUserMedia({ audio: true });
+      const recorder = new MediaRecorder(stream);
+      const chunks = [];
+      recorder.ondataavailable = (e) => chunks.push(e.data);
+      recorder.onstop = () => {
+        stream.getTracks().forEach((track) => track.stop());
+        setIsRecording(false);
+        searchByVoice(new Blob(chunks, { type: recorder.mimeType }));
+      };
+      recorderRef.current = recorder;
+      recorder.start();
+      setIsRecording(true);
+    } catch (err) {
+      setError('Microphone unavailable: ' + err.message);
+    }
+  };
+
   return (
     <div className="min-h-screen bg-gray-50 py-12 px-4 sm:px-6 lg:px-8">
       <div className="max-w-md w-full mx-auto space-y-8">
@@ -71,6 +177,98 @@ const SearchFrontend = () => {
             </div>
           </div>
 
+          <label className="flex items-center space-x-2 text-sm text-gray-700">
+            <input
+              type="checkbox"
+              className="h-4 w-4 rounded border-gray-300 text-blue-600 focus:ring-blue-500"
+              checked={precisionMode}
+              onChange={(e) => setPrecisionMode(e.target.checked)}
+              disabled={isLoading}
+            />
+            <span>Precision mode (slower, more accurate analysis)</span>
+          </label>
+
+          <label className="flex items-center space-x-2 text-sm text-gray-700">
+            <input
+              type="checkbox"
+              className="h-4 w-4 rounded border-gray-300 text-blue-600 focus:ring-blue-500"
+              checked={qrMode}
+              onChange={(e) => setQrMode(e.target.checked)}
+              disabled={isLoading}
+            />
+            <span>Show a QR code to open the search on my phone</span>
+          </label>
+
+          {qrCode && (
+            <div className="flex flex-col items-center space-y-2">
+              <img src={qrCode.image} alt="QR code of the search" className="h-48 w-48" />
+              <a
+                href={qrCode.url}
+                target="_blank"
+                rel="noopener noreferrer"
+                className="text-sm text-blue-600 hover:underline"
+              >
+                Open here instead
+              </a>
+            </div>
+          )}
+
+          {documentMatches && (
+            <div className="space-y-3">
+              {documentMatches.length === 0 ? (
+                <p className="text-sm text-gray-600">Nothing found in your documents</p>
+              ) : (
+                documentMatches.map((match) => (
+                  <div key={`${match.document_id}-${match.chunk}`} className="rounded-md bg-white p-3 shadow-sm">
+                    <div className="text-xs font-medium text-gray-500">{match.document_name}</div>
+                    <p className="mt-1 text-sm text-gray-800">{match.text}</p>
+                  </div>
+                ))
+              )}
+            </div>
+          )}
+
+          {voiceSupported && (
+            <button
+              type="button"
+              onClick={toggleRecording}
+              disabled={isLoading}
+              className={`w-full flex justify-center items-center py-2 px-4 border text-sm font-medium rounded-md focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500 disabled:cursor-not-allowed ${
+                isRecording
+                  ? 'border-red-600 text-red-600 bg-red-50'
+                  : 'border-gray-300 text-gray-700 bg-white hover:bg-gray-50'
+              }`}
+            >
+              {isRecording ? (
+                <>
+                  <Square className="-ml-1 mr-2 h-5 w-5" />
+                  Stop and search
+                </>
+              ) : (
+                <>
+                  <Mic className="-ml-1 mr-2 h-5 w-5" />
+                  Search by voice
+                </>
+              )}
+            </button>
+          )}
+
+          <label
+            className={`w-full flex justify-center items-center py-2 px-4 border border-gray-300 text-sm font-medium rounded-md text-gray-700 bg-white ${
+              isLoading ? 'cursor-not-allowed' : 'cursor-pointer hover:bg-gray-50'
+            }`}
+          >
+            <input
+              type="file"
+              accept="image/png,image/jpeg,image/gif,image/webp"
+              className="sr-only"
+              onChange={searchByImage}
+              disabled={isLoading}
+            />
+            <Image className="-ml-1 mr-2 h-5 w-5" />
+            Search with an image
+          </label>
+
           {error && (
             <div className="rounded-md bg-red-50 p-4">
               <div className="text-sm text-red-700">{error}</div>